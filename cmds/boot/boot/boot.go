@@ -8,7 +8,7 @@
 
 //
 // Synopsis:
-//	boot [-v][-no-load][-no-exec]
+//	boot [-v][-no-load][-no-exec][-verify-certs FILE][-verify-keyring FILE][-kexec-load-fallback]
 //
 // Description:
 //	If returns to u-root shell, the code didn't found a local bootable option
@@ -16,12 +16,18 @@
 //      -v prints messages
 //      -no-load prints the boot image paths it was going to load, but doesn't load + exec them
 //      -no-exec loads the boot image, but doesn't exec it
+//      -verify-certs only boots kernels signed by these Authenticode certificates
+//      -verify-keyring only boots kernels and initrds signed by these OpenPGP keys
+//      -kexec-load-fallback uses kexec_load if kexec_file_load cannot load a kernel
 //
 // Notes:
 //	The code is looking for boot/grub/grub.cfg file as to identify the
 //	boot option.
 //	The first bootable device found in the block device tree is the one used
 //	Windows is not supported (that is a work in progress)
+//	The boot menu's timeout, default entry and editing of command lines are
+//	set with the uroot.bootmenu.timeout, uroot.bootmenu.default and
+//	uroot.bootmenu.edit kernel parameters.
 //
 // Example:
 //	boot -v 	- Start the script in verbose mode for debugging purpose
@@ -37,6 +43,7 @@ import (
 	"github.com/u-root/u-root/pkg/boot/bootcmd"
 	"github.com/u-root/u-root/pkg/boot/localboot"
 	"github.com/u-root/u-root/pkg/boot/menu"
+	"github.com/u-root/u-root/pkg/boot/sigverify"
 	"github.com/u-root/u-root/pkg/cmdline"
 	"github.com/u-root/u-root/pkg/mount/block"
 	"github.com/u-root/u-root/pkg/ulog"
@@ -51,6 +58,9 @@ var (
 	reuseCmdlineItem  = flag.String("reuse", "console", "comma separated list of kernel params value to reuse from current kernel (default to console)")
 	appendCmdline     = flag.String("append", "", "Additional kernel params")
 	blockList         = flag.String("block", "", "comma separated list of pci vendor and device ids to ignore (format vendor:device). E.g. 0x8086:0x1234,0x8086:0xabcd")
+	verifyCerts       = flag.String("verify-certs", "", "only boot kernels with an Authenticode signature of one of the PEM certificates in this file")
+	verifyKeyring     = flag.String("verify-keyring", "", "only boot kernels and initrds with a detached signature of one of the OpenPGP keys in this file")
+	kexecLoadFallback = flag.Bool("kexec-load-fallback", false, "load kernels with kexec_load if the running kernel cannot kexec_file_load them; kexec_load does not check kernel signatures")
 )
 
 // updateBootCmdline get the kernel command line parameters and filter it:
@@ -100,6 +110,18 @@ func main() {
 		}
 	}
 
+	if *verifyCerts != "" || *verifyKeyring != "" {
+		v, err := sigverify.New(*verifyCerts, *verifyKeyring)
+		if err != nil {
+			log.Fatalf("Signature verification: %v", err)
+		}
+		images = boot.Verify(v, images...)
+	}
+
+	if *kexecLoadFallback {
+		boot.AllowKexecLoadFallback(images...)
+	}
+
 	menuEntries := menu.OSImages(*verbose, images...)
 	menuEntries = append(menuEntries, menu.Reboot{})
 	menuEntries = append(menuEntries, menu.StartShell{})
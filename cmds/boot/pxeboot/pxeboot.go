@@ -17,51 +17,87 @@
 //
 // - a pxelinux.0, in which case we will ignore the pxelinux and try to parse
 //   pxelinux.cfg/<files>
+//
+// - a kernel, unified kernel image, ISO image, cpio archive or bootball, which
+//   is booted directly. With -http-boot, pxeboot asks for one as a UEFI HTTP
+//   Boot client. Bootballs are only booted if they are signed by a key
+//   certified by one of the -bootball-roots certificates.
+//
+// If the lease instead has an iSCSI root path, pxeboot logs into the target
+// and boots from the configuration on the disk like localboot. A CHAP secret
+// is read from -iscsi-chap-secret-file or $ISCSI_CHAP_SECRET rather than the
+// command line, which any user can read.
 package main
 
 import (
 	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/u-root/u-root/pkg/boot"
 	"github.com/u-root/u-root/pkg/boot/bootcmd"
+	"github.com/u-root/u-root/pkg/boot/localboot"
 	"github.com/u-root/u-root/pkg/boot/menu"
 	"github.com/u-root/u-root/pkg/boot/netboot"
+	"github.com/u-root/u-root/pkg/boot/sigverify"
 	"github.com/u-root/u-root/pkg/curl"
 	"github.com/u-root/u-root/pkg/dhclient"
+	"github.com/u-root/u-root/pkg/iscsi"
+	"github.com/u-root/u-root/pkg/mount"
 	"github.com/u-root/u-root/pkg/ulog"
 )
 
 var (
-	ifName      = "^e.*"
-	noLoad      = flag.Bool("no-load", false, "get DHCP response, print chosen boot configuration, but do not download + exec it")
-	noExec      = flag.Bool("no-exec", false, "download boot configuration, but do not exec it")
-	noNetConfig = flag.Bool("no-net-config", false, "get DHCP response, but do not apply the network config it to the kernel interface")
-	verbose     = flag.Bool("v", false, "Verbose output")
+	ifName            = "^e.*"
+	noLoad            = flag.Bool("no-load", false, "get DHCP response, print chosen boot configuration, but do not download + exec it")
+	noExec            = flag.Bool("no-exec", false, "download boot configuration, but do not exec it")
+	noNetConfig       = flag.Bool("no-net-config", false, "get DHCP response, but do not apply the network config it to the kernel interface")
+	verbose           = flag.Bool("v", false, "Verbose output")
+	httpBoot          = flag.Bool("http-boot", false, "request the boot file URL as a UEFI HTTP Boot client (vendor class HTTPClient)")
+	bootBallRoots     = flag.String("bootball-roots", "", "PEM file with the root certificates bootball signatures are checked against; bootballs are not booted without it")
+	verifyCerts       = flag.String("verify-certs", "", "only boot kernels with an Authenticode signature of one of the PEM certificates in this file")
+	verifyKeyring     = flag.String("verify-keyring", "", "only boot kernels and initrds with a detached signature of one of the OpenPGP keys in this file")
+	kexecLoadFallback = flag.Bool("kexec-load-fallback", false, "load kernels with kexec_load if the running kernel cannot kexec_file_load them; kexec_load does not check kernel signatures")
+	initiatorName     = flag.String("iscsi-initiator", iscsi.DefaultInitiatorName, "iSCSI initiator name to log into iSCSI root paths with")
+	chapName          = flag.String("iscsi-chap-name", "", "CHAP user name for iSCSI targets")
+	chapSecretFile    = flag.String("iscsi-chap-secret-file", "", "file with the CHAP secret for iSCSI targets (default: $"+chapSecretEnv+")")
+	lun               = flag.Uint64("iscsi-lun", 0, "iSCSI logical unit to boot from")
+	nbdDev            = flag.String("nbd", "", "network block device to attach the iSCSI logical unit to (default: first unused one)")
 )
 
 const (
 	dhcpTimeout = 5 * time.Second
 	dhcpTries   = 3
+
+	// chapSecretEnv is the environment variable with the CHAP secret. Like
+	// a file, and unlike a flag, it is not visible to other users.
+	chapSecretEnv = "ISCSI_CHAP_SECRET"
 )
 
+// chapSecret is the CHAP secret for iSCSI targets.
+var chapSecret = os.Getenv(chapSecretEnv)
+
 // NetbootImages requests DHCP on every ifaceNames interface, and parses
-// netboot images from the DHCP leases. Returns bootable OSes.
-func NetbootImages(ifaceNames string) ([]boot.OSImage, error) {
+// netboot images from the DHCP leases. Returns bootable OSes, and the file
+// systems they were found on if the lease had an iSCSI root path.
+func NetbootImages(ifaceNames string, nc netboot.Config) ([]boot.OSImage, []*mount.MountPoint, error) {
 	filteredIfs, err := dhclient.Interfaces(ifaceNames)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), (1<<dhcpTries)*dhcpTimeout)
 	defer cancel()
 
 	c := dhclient.Config{
-		Timeout: dhcpTimeout,
-		Retries: dhcpTries,
+		Timeout:  dhcpTimeout,
+		Retries:  dhcpTries,
+		HTTPBoot: *httpBoot,
 	}
 	if *verbose {
 		c.LogLevel = dhclient.LogSummary
@@ -71,11 +107,11 @@ func NetbootImages(ifaceNames string) ([]boot.OSImage, error) {
 	for {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return nil, nil, ctx.Err()
 
 		case result, ok := <-r:
 			if !ok {
-				return nil, fmt.Errorf("nothing bootable found, all interfaces are configured or timed out")
+				return nil, nil, fmt.Errorf("nothing bootable found, all interfaces are configured or timed out")
 			}
 			iname := result.Interface.Attrs().Name
 			if result.Err != nil {
@@ -93,17 +129,65 @@ func NetbootImages(ifaceNames string) ([]boot.OSImage, error) {
 				// ip/ipv6 address.
 			}
 
+			if _, _, err := result.Lease.ISCSIBoot(); err == nil {
+				c := iscsi.Config{
+					InitiatorName: *initiatorName,
+					CHAPName:      *chapName,
+					CHAPSecret:    chapSecret,
+				}
+				imgs, mps, err := iscsiImages(context.Background(), result.Lease, c)
+				if err != nil {
+					log.Printf("Failed to boot iSCSI root path of lease %v: %v", result.Lease, err)
+					continue
+				}
+				return imgs, mps, nil
+			}
+
 			// Don't use the other context, as it's for the DHCP timeout.
-			imgs, err := netboot.BootImages(context.Background(), ulog.Log, curl.DefaultSchemes, result.Lease)
+			imgs, err := netboot.BootImagesWithConfig(context.Background(), ulog.Log, curl.DefaultSchemes, result.Lease, nc)
 			if err != nil {
 				log.Printf("Failed to boot lease %v: %v", result.Lease, err)
 				continue
 			}
-			return imgs, nil
+			return imgs, nil, nil
 		}
 	}
 }
 
+// iscsiImages logs into the iSCSI target of lease and returns the images found
+// on its logical unit like localboot does, with an iBFT for the kernel to use
+// the target as well. The logical unit stays attached if any are found.
+func iscsiImages(ctx context.Context, lease dhclient.Lease, c iscsi.Config) ([]boot.OSImage, []*mount.MountPoint, error) {
+	disk, err := netboot.AttachISCSI(ctx, ulog.Log, lease, c, *lun, *nbdDev)
+	if err != nil {
+		return nil, nil, err
+	}
+	imgs, mps, err := localboot.Localboot(ulog.Log, disk.Devices)
+	if err == nil && len(imgs) == 0 {
+		err = fmt.Errorf("no boot configuration found on %s", disk)
+	}
+	if err != nil {
+		for _, mp := range mps {
+			if err := mp.Unmount(mount.MNT_DETACH); err != nil {
+				log.Printf("Failed to unmount %s: %v", mp.Path, err)
+			}
+		}
+		if err := disk.Close(); err != nil {
+			log.Printf("Failed to detach %s: %v", disk, err)
+		}
+		return nil, nil, err
+	}
+	for _, img := range imgs {
+		switch i := img.(type) {
+		case *boot.LinuxImage:
+			i.IBFT = disk.IBFT
+		case *boot.MultibootImage:
+			i.IBFT = disk.IBFT
+		}
+	}
+	return imgs, mps, nil
+}
+
 func main() {
 	flag.Parse()
 	if len(flag.Args()) > 1 {
@@ -113,15 +197,44 @@ func main() {
 		ifName = flag.Args()[0]
 	}
 
-	images, err := NetbootImages(ifName)
+	if *chapSecretFile != "" {
+		b, err := ioutil.ReadFile(*chapSecretFile)
+		if err != nil {
+			log.Fatalf("iSCSI CHAP secret: %v", err)
+		}
+		chapSecret = strings.TrimRight(string(b), "\r\n")
+	}
+
+	var nc netboot.Config
+	if *bootBallRoots != "" {
+		roots, err := ioutil.ReadFile(*bootBallRoots)
+		if err != nil {
+			log.Fatalf("Bootball root certificates: %v", err)
+		}
+		nc.BootBallRoots = roots
+	}
+
+	images, mps, err := NetbootImages(ifName, nc)
 	if err != nil {
 		log.Printf("Netboot failed: %v", err)
 	}
 
+	if *verifyCerts != "" || *verifyKeyring != "" {
+		v, err := sigverify.New(*verifyCerts, *verifyKeyring)
+		if err != nil {
+			log.Fatalf("Signature verification: %v", err)
+		}
+		images = boot.Verify(v, images...)
+	}
+
+	if *kexecLoadFallback {
+		boot.AllowKexecLoadFallback(images...)
+	}
+
 	menuEntries := menu.OSImages(*verbose, images...)
 	menuEntries = append(menuEntries, menu.Reboot{})
 	menuEntries = append(menuEntries, menu.StartShell{})
 
 	// Boot does not return.
-	bootcmd.ShowMenuAndBoot(menuEntries, nil, *noLoad, *noExec)
+	bootcmd.ShowMenuAndBoot(menuEntries, mps, *noLoad, *noExec)
 }
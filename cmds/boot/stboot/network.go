@@ -16,13 +16,16 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/u-root/u-root/pkg/boot/stboot"
+	"github.com/u-root/u-root/pkg/curl"
 	"github.com/u-root/u-root/pkg/dhclient"
+	"github.com/u-root/u-root/pkg/uio"
 	"github.com/vishvananda/netlink"
 )
 
@@ -126,7 +129,7 @@ func findNetworkInterface() (netlink.Link, error) {
 	return nil, fmt.Errorf("Could not find a non-loopback network interface with hardware address in any of %v", ifnames)
 }
 
-func downloadFromHTTPS(url string, destination string) error {
+func downloadFromHTTPS(rawURL string, destination string) error {
 	roots := x509.NewCertPool()
 	if err := loadHTTPSCertificate(roots); err != nil {
 		return fmt.Errorf("Failed to load root certificate: %v", err)
@@ -166,15 +169,18 @@ func downloadFromHTTPS(url string, destination string) error {
 		log.Print("WARNING: low entropy!")
 		log.Printf("%s : %d", entropyAvail, entr)
 	}
-	// get remote boot bundle
+	// get remote boot bundle. Interrupted downloads are resumed, and a
+	// digest in the URL's fragment is checked.
 	log.Print("Downloading bootball ...")
-	resp, err := client.Get(url)
+	u, err := url.Parse(rawURL)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("non-200 HTTP status: %d", resp.StatusCode)
+	https := curl.NewHTTPClient(&client)
+	https.Progress = &uio.ProgressWriter{Symbol: ".", Interval: 1 << 20, W: os.Stdout}
+	r, err := curl.Schemes{"https": https}.Fetch(context.Background(), u)
+	if err != nil {
+		return err
 	}
 	f, err := os.Create(destination)
 	if err != nil {
@@ -182,7 +188,7 @@ func downloadFromHTTPS(url string, destination string) error {
 	}
 	defer f.Close()
 
-	_, err = io.Copy(f, resp.Body)
+	_, err = io.Copy(f, uio.Reader(r))
 	if err != nil {
 		return fmt.Errorf("failed to save bootball: %v", err)
 	}
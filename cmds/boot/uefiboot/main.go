@@ -0,0 +1,92 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// uefiboot boots the OS that the UEFI firmware would have booted, as
+// configured with UEFI boot variables, e.g. by efibootmgr.
+//
+// Synopsis:
+//	uefiboot [-v][-no-load][-no-exec][-verify-certs FILE][-verify-keyring FILE][-kexec-load-fallback]
+//
+// Description:
+//	The BootNext entry and the entries in BootOrder are resolved, in that
+//	order. Linux kernels with an EFI stub are booted directly, GRUB, shim
+//	and systemd-boot entries are replaced by the entries of their config,
+//	and network entries are booted with DHCP.
+//
+//	The boot menu's timeout, default entry and editing of command lines are
+//	set with the uroot.bootmenu.timeout, uroot.bootmenu.default and
+//	uroot.bootmenu.edit kernel parameters.
+//
+//	-v prints messages
+//	-no-load prints the boot image paths it was going to load, but doesn't load + exec them
+//	-no-exec loads the boot image, but doesn't exec it
+//	-verify-certs only boots kernels signed by these Authenticode certificates
+//	-verify-keyring only boots kernels and initrds signed by these OpenPGP keys
+//	-kexec-load-fallback loads kernels with kexec_load if kexec_file_load cannot load them
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/bootcmd"
+	"github.com/u-root/u-root/pkg/boot/menu"
+	"github.com/u-root/u-root/pkg/boot/sigverify"
+	"github.com/u-root/u-root/pkg/boot/uefiboot"
+	"github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/mount/block"
+	"github.com/u-root/u-root/pkg/ulog"
+)
+
+var (
+	verbose           = flag.Bool("v", false, "Print debug messages")
+	noLoad            = flag.Bool("no-load", false, "print chosen boot configuration, but do not load + exec it")
+	noExec            = flag.Bool("no-exec", false, "load boot configuration, but do not exec it")
+	verifyCerts       = flag.String("verify-certs", "", "only boot kernels with an Authenticode signature of one of the PEM certificates in this file")
+	verifyKeyring     = flag.String("verify-keyring", "", "only boot kernels and initrds with a detached signature of one of the OpenPGP keys in this file")
+	kexecLoadFallback = flag.Bool("kexec-load-fallback", false, "load kernels with kexec_load if the running kernel cannot kexec_file_load them; kexec_load does not check kernel signatures")
+)
+
+func main() {
+	flag.Parse()
+
+	var l ulog.Logger = ulog.Null
+	if *verbose {
+		l = ulog.Log
+		block.Debug = log.Printf
+	}
+
+	blockDevs, err := block.GetBlockDevices()
+	if err != nil {
+		log.Printf("No block devices: %v", err)
+	}
+	blockDevs = blockDevs.FilterZeroSize()
+
+	var mountPool mount.Pool
+	images, err := uefiboot.BootImages(context.Background(), l, blockDevs, &mountPool)
+	if err != nil {
+		log.Fatalf("Reading UEFI boot entries: %v", err)
+	}
+
+	if *verifyCerts != "" || *verifyKeyring != "" {
+		v, err := sigverify.New(*verifyCerts, *verifyKeyring)
+		if err != nil {
+			log.Fatalf("Signature verification: %v", err)
+		}
+		images = boot.Verify(v, images...)
+	}
+
+	if *kexecLoadFallback {
+		boot.AllowKexecLoadFallback(images...)
+	}
+
+	menuEntries := menu.OSImages(*verbose, images...)
+	menuEntries = append(menuEntries, menu.Reboot{})
+	menuEntries = append(menuEntries, menu.StartShell{})
+
+	// Boot does not return.
+	bootcmd.ShowMenuAndBoot(menuEntries, mountPool.MountPoints, *noLoad, *noExec)
+}
@@ -13,6 +13,7 @@
 //     -timeout:  lease timeout in seconds
 //     -renewals: number of DHCP renewals before exiting
 //     -verbose:  verbose output
+//     -daemon:   keep renewing leases until killed, then release them
 package main
 
 import (
@@ -20,6 +21,10 @@ import (
 	"flag"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
@@ -42,8 +47,12 @@ var (
 	v6Server = flag.String("v6-server", "ff02::1:2", "DHCPv6 server address to send to (multicast or unicast)")
 
 	v4Port = flag.Int("v4-port", dhcpv4.ServerPort, "DHCPv4 server port to send to")
+
+	daemon = flag.Bool("daemon", false, "Keep renewing leases until killed, and release them on SIGINT or SIGTERM")
 )
 
+const linkUpTimeout = 30 * time.Second
+
 func main() {
 	flag.Parse()
 	if len(flag.Args()) > 1 {
@@ -59,10 +68,14 @@ func main() {
 		log.Fatal(err)
 	}
 
-	configureAll(filteredIfs)
+	if *daemon {
+		keepAll(filteredIfs)
+	} else {
+		configureAll(filteredIfs)
+	}
 }
 
-func configureAll(ifs []netlink.Link) {
+func config() dhclient.Config {
 	packetTimeout := time.Duration(*timeout) * time.Second
 
 	c := dhclient.Config{
@@ -83,7 +96,11 @@ func configureAll(ifs []netlink.Link) {
 	if *vverbose {
 		c.LogLevel = dhclient.LogDebug
 	}
-	r := dhclient.SendRequests(context.Background(), ifs, *ipv4, *ipv6, c, 30*time.Second)
+	return c
+}
+
+func configureAll(ifs []netlink.Link) {
+	r := dhclient.SendRequests(context.Background(), ifs, *ipv4, *ipv6, config(), linkUpTimeout)
 
 	for result := range r {
 		if result.Err != nil {
@@ -98,3 +115,43 @@ func configureAll(ifs []netlink.Link) {
 	}
 	log.Printf("Finished trying to configure all interfaces.")
 }
+
+// keepAll keeps the leases of all ifs alive until a signal to terminate.
+func keepAll(ifs []netlink.Link) {
+	c := config()
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		log.Printf("Got %v, releasing leases", <-sig)
+		cancel()
+	}()
+
+	var wg sync.WaitGroup
+	for _, iface := range ifs {
+		wg.Add(1)
+		go func(iface netlink.Link) {
+			defer wg.Done()
+
+			log.Printf("Bringing up interface %s...", iface.Attrs().Name)
+			if _, err := dhclient.IfUp(iface.Attrs().Name, linkUpTimeout); err != nil {
+				log.Printf("Could not bring up interface %s: %v", iface.Attrs().Name, err)
+				return
+			}
+
+			m := dhclient.NewManager(iface, c, linkUpTimeout)
+			if *dryRun {
+				m.Configure = func(l dhclient.Lease) error {
+					log.Printf("Dry run: would have configured %s with %s", iface.Attrs().Name, l)
+					return nil
+				}
+				m.Deconfigure = func(l dhclient.Lease) error {
+					log.Printf("Dry run: would have removed %s from %s", l, iface.Attrs().Name)
+					return nil
+				}
+			}
+			m.Run(ctx, *ipv4, *ipv6)
+		}(iface)
+	}
+	wg.Wait()
+}
@@ -3,14 +3,55 @@
 // license that can be found in the LICENSE file.
 
 // ip manipulates network addresses, interfaces, routing, and other config.
+//
+// Synopsis:
+//     ip [-4|-6] [-j [-p]] [-n NETNS] OBJECT COMMAND
+//
+//     ip addr [show [dev] DEV]
+//     ip addr {add|del} CIDR [dev] DEV
+//
+//     ip link [show [dev] DEV]
+//     ip link add [link DEV] [name] NAME [address MAC] [mtu MTU] type TYPE [ARGS]
+//     ip link del [dev] DEV
+//     ip link set [dev] DEV {up|down|address MAC|mtu MTU|name NAME|master DEV|nomaster|netns {NETNS|PID}}...
+//
+//     ip route [show [table TABLE] [dev DEV] [proto PROTO]]
+//     ip route {add|del|replace} {PREFIX|default} [via GW] [dev DEV] [metric N] [table TABLE] [src IP] [proto PROTO] [scope SCOPE] [mtu MTU]
+//
+//     ip rule [show]
+//     ip rule {add|del} [from PREFIX] [to PREFIX] [fwmark MARK[/MASK]] [iif DEV] [oif DEV] [pref N] [table TABLE]
+//
+//     ip neigh [show]
+//
+//     ip netns [list]
+//     ip netns {add|del} NAME
+//     ip netns exec NAME COMMAND [ARGS]
+//
+//     ip monitor [all|link|address|route|neigh]...
+//
+// Link types and their arguments are:
+//     bridge, dummy, wireguard
+//     bond [mode MODE] [miimon N] [lacp_rate RATE] [xmit_hash_policy POLICY]
+//     veth [peer [name] NAME]
+//     vlan id ID [protocol {802.1q|802.1ad}]
+//     macvlan [mode {private|vepa|bridge|passthru|source}]
+//     vxlan id VNI [dev DEV] [{group|remote} IP] [local IP] [dstport PORT] [ttl TTL] [[no]learning]
+//     {gre|ipip|sit} [remote IP] [local IP] [ttl TTL] [dev DEV] [key KEY] [ikey KEY] [okey KEY]
+//
+// Options:
+//     -4, -6:    only show IPv4 or IPv6 addresses, routes and rules
+//     -j:        print JSON, with the fields of iproute2
+//     -p:        pretty print JSON
+//     -n NETNS:  run in the network namespace NETNS
 package main
 
 import (
-	"errors"
 	"fmt"
+	"io"
 	l "log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 
 	flag "github.com/spf13/pflag"
@@ -18,7 +59,13 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
-var inet6 = flag.BoolP("6", "6", false, "use ipv6")
+var (
+	inet4   = flag.BoolP("4", "4", false, "use ipv4")
+	inet6   = flag.BoolP("6", "6", false, "use ipv6")
+	jsonOut = flag.BoolP("json", "j", false, "print JSON")
+	pretty  = flag.BoolP("pretty", "p", false, "pretty print JSON")
+	nsName  = flag.StringP("netns", "n", "", "network namespace to run in")
+)
 
 // The language implemented by the standard 'ip' is not super consistent
 // and has lots of convenience shortcuts.
@@ -79,6 +126,11 @@ func one(cmd string, cmds []string) string {
 	return ""
 }
 
+// more returns whether there are args after the cursor.
+func more() bool {
+	return cursor < len(arg)-1
+}
+
 // in the ip command, turns out 'dev' is a noise word.
 // The BNF it shows is not right in that case.
 // Always make 'dev' optional.
@@ -92,6 +144,18 @@ func dev() (netlink.Link, error) {
 	return netlink.LinkByName(arg[cursor])
 }
 
+// devName is dev for commands that take the name of a link that may not
+// exist.
+func devName() string {
+	cursor++
+	whatIWant = []string{"dev", "device name"}
+	if arg[cursor] == "dev" {
+		cursor++
+	}
+	whatIWant = []string{"device name"}
+	return arg[cursor]
+}
+
 func maybename() (string, error) {
 	cursor++
 	whatIWant = []string{"name", "device name"}
@@ -102,14 +166,70 @@ func maybename() (string, error) {
 	return arg[cursor], nil
 }
 
-func addrip() error {
+// integer parses the next arg as a number.
+func integer(what string) (int, error) {
+	cursor++
+	whatIWant = []string{what}
+	n, err := strconv.ParseInt(arg[cursor], 0, 64)
+	if err != nil || n < 0 || n > 1<<32-1 {
+		return 0, fmt.Errorf("invalid %s %q", what, arg[cursor])
+	}
+	return int(n), nil
+}
+
+// ipAddr parses the next arg as an IP address.
+func ipAddr(what string) (net.IP, error) {
+	cursor++
+	whatIWant = []string{what}
+	ip := net.ParseIP(arg[cursor])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid %s %q", what, arg[cursor])
+	}
+	return ip, nil
+}
+
+// prefix parses the next arg as an address prefix. Addresses without
+// prefix length are host routes.
+func prefix(what string) (*net.IPNet, error) {
+	cursor++
+	whatIWant = []string{what}
+	if !strings.Contains(arg[cursor], "/") {
+		ip := net.ParseIP(arg[cursor])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid %s %q", what, arg[cursor])
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(arg[cursor])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", what, arg[cursor])
+	}
+	return n, nil
+}
+
+// family returns the address family that -4 and -6 select, or def if
+// neither is set.
+func family(def int) int {
+	switch {
+	case *inet4:
+		return netlink.FAMILY_V4
+	case *inet6:
+		return netlink.FAMILY_V6
+	}
+	return def
+}
+
+func addrip(w io.Writer) error {
 	var err error
 	var addr *netlink.Addr
 	if len(arg) == 1 {
-		return showLinks(os.Stdout, true)
+		return showLinks(w, true, "")
 	}
 	cursor++
-	whatIWant = []string{"add", "del"}
+	whatIWant = []string{"add", "del", "show", "list"}
 	cmd := arg[cursor]
 
 	c := one(cmd, whatIWant)
@@ -121,6 +241,11 @@ func addrip() error {
 		if err != nil {
 			return err
 		}
+	case "show", "list":
+		if !more() {
+			return showLinks(w, true, "")
+		}
+		return showLinks(w, true, devName())
 	default:
 		return usage()
 	}
@@ -131,11 +256,11 @@ func addrip() error {
 	switch c {
 	case "add":
 		if err := netlink.AddrAdd(iface, addr); err != nil {
-			return fmt.Errorf("adding %v to %v failed: %v", arg[1], arg[2], err)
+			return fmt.Errorf("adding %v to %v failed: %v", addr, iface.Attrs().Name, err)
 		}
 	case "del":
 		if err := netlink.AddrDel(iface, addr); err != nil {
-			return fmt.Errorf("deleting %v from %v failed: %v", arg[1], arg[2], err)
+			return fmt.Errorf("deleting %v from %v failed: %v", addr, iface.Attrs().Name, err)
 		}
 	default:
 		return fmt.Errorf("devip: arg[0] changed: can't happen")
@@ -143,199 +268,57 @@ func addrip() error {
 	return nil
 }
 
-func neigh() error {
-	if len(arg) != 1 {
-		return errors.New("neigh subcommands not supported yet")
-	}
-	return showNeighbours(os.Stdout, true)
-}
-
-func linkshow() error {
-	cursor++
-	whatIWant = []string{"<nothing>", "<device name>"}
-	if len(arg[cursor:]) == 0 {
-		return showLinks(os.Stdout, false)
-	}
-	return nil
-}
-
-func setHardwareAddress(iface netlink.Link) error {
-	cursor++
-	hwAddr, err := net.ParseMAC(arg[cursor])
-	if err != nil {
-		return fmt.Errorf("%v cant parse mac addr %v: %v", iface.Attrs().Name, hwAddr, err)
-	}
-	err = netlink.LinkSetHardwareAddr(iface, hwAddr)
-	if err != nil {
-		return fmt.Errorf("%v cant set mac addr %v: %v", iface.Attrs().Name, hwAddr, err)
-	}
-	return nil
-}
-
-func linkset() error {
-	iface, err := dev()
-	if err != nil {
-		return err
-	}
-
-	cursor++
-	whatIWant = []string{"address", "up", "down", "master"}
-	switch one(arg[cursor], whatIWant) {
-	case "address":
-		return setHardwareAddress(iface)
-	case "up":
-		if err := netlink.LinkSetUp(iface); err != nil {
-			return fmt.Errorf("%v can't make it up: %v", iface.Attrs().Name, err)
-		}
-	case "down":
-		if err := netlink.LinkSetDown(iface); err != nil {
-			return fmt.Errorf("%v can't make it down: %v", iface.Attrs().Name, err)
-		}
-	case "master":
-		cursor++
-		whatIWant = []string{"device name"}
-		master, err := netlink.LinkByName(arg[cursor])
-		if err != nil {
-			return err
-		}
-		return netlink.LinkSetMaster(iface, master)
-	default:
-		return usage()
-	}
-	return nil
-}
-
-func linkadd() error {
-	name, err := maybename()
-	if err != nil {
-		return err
-	}
-	attrs := netlink.LinkAttrs{Name: name}
-
-	cursor++
-	whatIWant = []string{"type"}
-	if arg[cursor] != "type" {
-		return usage()
-	}
-
-	cursor++
-	whatIWant = []string{"bridge"}
-	if arg[cursor] != "bridge" {
-		return usage()
-	}
-	return netlink.LinkAdd(&netlink.Bridge{LinkAttrs: attrs})
-}
-
-func link() error {
+func neigh(w io.Writer) error {
 	if len(arg) == 1 {
-		return linkshow()
+		return showNeighbours(w, true)
 	}
-
 	cursor++
-	whatIWant = []string{"show", "set", "add"}
-	cmd := arg[cursor]
-
-	switch one(cmd, whatIWant) {
-	case "show":
-		return linkshow()
-	case "set":
-		return linkset()
-	case "add":
-		return linkadd()
-	}
-	return usage()
-}
-
-func routeshow() error {
-	return showRoutes(*inet6)
-}
-
-func nodespec() string {
-	cursor++
-	whatIWant = []string{"default", "CIDR"}
-	return arg[cursor]
-}
-
-func nexthop() (string, *netlink.Addr, error) {
-	cursor++
-	whatIWant = []string{"via"}
-	if arg[cursor] != "via" {
-		return "", nil, usage()
-	}
-	nh := arg[cursor]
-	cursor++
-	whatIWant = []string{"Gateway CIDR"}
-	addr, err := netlink.ParseAddr(arg[cursor])
-	if err != nil {
-		return "", nil, fmt.Errorf("failed to parse gateway CIDR: %v", err)
-	}
-	return nh, addr, nil
-}
-
-func routeadddefault() error {
-	nh, nhval, err := nexthop()
-	if err != nil {
-		return err
-	}
-	// TODO: NHFLAGS.
-	l, err := dev()
-	if err != nil {
-		return err
-	}
-	switch nh {
-	case "via":
-		log.Printf("Add default route %v via %v", nhval, l.Attrs().Name)
-		r := &netlink.Route{LinkIndex: l.Attrs().Index, Gw: nhval.IPNet.IP}
-		if err := netlink.RouteAdd(r); err != nil {
-			return fmt.Errorf("error adding default route to %v: %v", l.Attrs().Name, err)
-		}
-		return nil
+	whatIWant = []string{"show", "list"}
+	switch one(arg[cursor], whatIWant) {
+	case "show", "list":
+		return showNeighbours(w, true)
 	}
 	return usage()
 }
 
-func routeadd() error {
-	ns := nodespec()
-	switch ns {
-	case "default":
-		return routeadddefault()
-	default:
-		addr, err := netlink.ParseAddr(arg[cursor])
-		if err != nil {
-			return usage()
-		}
-		d, err := dev()
-		if err != nil {
-			return usage()
-		}
-		r := &netlink.Route{LinkIndex: d.Attrs().Index, Dst: addr.IPNet}
-		if err := netlink.RouteAdd(r); err != nil {
-			return fmt.Errorf("error adding route %s -> %s: %v", addr, d.Attrs().Name, err)
-		}
-		return nil
-	}
-}
-
-func route() error {
-	cursor++
-	if len(arg[cursor:]) == 0 {
-		return routeshow()
+// run runs the command in arg.
+func run(w io.Writer) error {
+	// The ip command doesn't actually follow the BNF it prints on error.
+	// There are lots of handy shortcuts that people will expect.
+	whatIWant = []string{"addr", "route", "link", "neigh", "rule", "netns", "monitor"}
+	switch arg[cursor] {
+	// Shortcuts of iproute2 that are prefixes of several objects.
+	case "r", "ro":
+		return route(w)
+	case "n":
+		return neigh(w)
 	}
-
-	whatIWant = []string{"show", "add"}
 	switch one(arg[cursor], whatIWant) {
-	case "show":
-		return routeshow()
-	case "add":
-		return routeadd()
+	case "addr":
+		return addrip(w)
+	case "link":
+		return link(w)
+	case "route":
+		return route(w)
+	case "neigh":
+		return neigh(w)
+	case "rule":
+		return rule(w)
+	case "netns":
+		return netnsCmd(w)
+	case "monitor":
+		return monitor(w)
 	}
 	return usage()
 }
 
 func main() {
 	// When this is embedded in busybox we need to reinit some things.
-	whatIWant = []string{"addr", "route", "link", "neigh"}
+	whatIWant = []string{"addr", "route", "link", "neigh", "rule", "netns", "monitor"}
 	cursor = 0
+	// Options come before the object, and commands run by netns exec
+	// have options of their own.
+	flag.CommandLine.SetInterspersed(false)
 	flag.Parse()
 	arg = flag.Args()
 
@@ -354,23 +337,12 @@ func main() {
 		}
 	}()
 
-	// The ip command doesn't actually follow the BNF it prints on error.
-	// There are lots of handy shortcuts that people will expect.
-	var err error
-	switch one(arg[cursor], whatIWant) {
-	case "addr":
-		err = addrip()
-	case "link":
-		err = link()
-	case "route":
-		err = route()
-	case "neigh":
-		err = neigh()
-	default:
-		usage()
+	if *nsName != "" {
+		if err := enterNetns(*nsName); err != nil {
+			log.Fatal(err)
+		}
 	}
-	if err != nil {
+	if err := run(os.Stdout); err != nil {
 		log.Fatal(err)
 	}
-
 }
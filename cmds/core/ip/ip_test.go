@@ -0,0 +1,466 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/testutil"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// setArgs makes the parser parse cmd, which starts with the object, and
+// sets the flags of its leading options.
+func setArgs(cmd string) {
+	*inet4, *inet6, *jsonOut = false, false, false
+	arg = strings.Fields(cmd)
+	for len(arg) > 0 && strings.HasPrefix(arg[0], "-") {
+		switch arg[0] {
+		case "-4":
+			*inet4 = true
+		case "-6":
+			*inet6 = true
+		case "-j":
+			*jsonOut = true
+		}
+		arg = arg[1:]
+	}
+	cursor = 0
+}
+
+// parse runs a parse function on the command cmd, with the cursor at its
+// subcommand, as the object's parser would.
+func parse(cmd string, f func() (interface{}, error)) (v interface{}, err error) {
+	setArgs(cmd)
+	cursor = 1
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return f()
+}
+
+func loIndex(t *testing.T) int {
+	t.Helper()
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		t.Skipf("no loopback link: %v", err)
+	}
+	return lo.Attrs().Index
+}
+
+func TestParseLinkAdd(t *testing.T) {
+	lo := loIndex(t)
+	attrs := func(name string) netlink.LinkAttrs {
+		a := netlink.NewLinkAttrs()
+		a.Name = name
+		return a
+	}
+	bond := netlink.NewLinkBond(attrs("bond0"))
+	bond.MTU = 9000
+	bond.Mode = netlink.BOND_MODE_802_3AD
+	bond.Miimon = 100
+	bond.LacpRate = netlink.BOND_LACP_RATE_FAST
+	bond.XmitHashPolicy = netlink.BOND_XMIT_HASH_POLICY_LAYER3_4
+	vlan := attrs("lo.10")
+	vlan.ParentIndex = lo
+	macvlan := attrs("mv0")
+	macvlan.ParentIndex = lo
+	dummy := attrs("d0")
+	dummy.HardwareAddr = net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	for _, tt := range []struct {
+		cmd  string
+		want netlink.Link
+	}{
+		{cmd: "link add br0 type bridge", want: &netlink.Bridge{LinkAttrs: attrs("br0")}},
+		{cmd: "link add address 02:00:00:00:00:01 d0 type dummy", want: &netlink.Dummy{LinkAttrs: dummy}},
+		{cmd: "link add name bond0 mtu 9000 type bond mode 802.3ad miimon 100 lacp_rate fast xmit_hash_policy layer3+4", want: bond},
+		{cmd: "link add v0 type veth peer name v1", want: &netlink.Veth{LinkAttrs: attrs("v0"), PeerName: "v1"}},
+		{cmd: "link add v0 type veth peer v1", want: &netlink.Veth{LinkAttrs: attrs("v0"), PeerName: "v1"}},
+		{cmd: "link add link lo name lo.10 type vlan id 10", want: &netlink.Vlan{LinkAttrs: vlan, VlanId: 10}},
+		{cmd: "link add link lo lo.10 type vlan id 10 protocol 802.1ad", want: &netlink.Vlan{LinkAttrs: vlan, VlanId: 10, VlanProtocol: netlink.VLAN_PROTOCOL_8021AD}},
+		{cmd: "link add mv0 link lo type macvlan mode bridge", want: &netlink.Macvlan{LinkAttrs: macvlan, Mode: netlink.MACVLAN_MODE_BRIDGE}},
+		{cmd: "link add vx0 type vxlan id 42 remote 10.0.0.1 local 10.0.0.2 dev lo dstport 4789 nolearning", want: &netlink.Vxlan{
+			LinkAttrs:    attrs("vx0"),
+			VxlanId:      42,
+			Group:        net.ParseIP("10.0.0.1"),
+			SrcAddr:      net.ParseIP("10.0.0.2"),
+			VtepDevIndex: lo,
+			Port:         4789,
+		}},
+		{cmd: "link add vx0 type vxlan id 42", want: &netlink.Vxlan{LinkAttrs: attrs("vx0"), VxlanId: 42, Learning: true}},
+		{cmd: "link add wg0 type wireguard", want: &netlink.GenericLink{LinkAttrs: attrs("wg0"), LinkType: "wireguard"}},
+		{cmd: "link add gre1 type gre remote 10.0.0.1 local 10.0.0.2 ttl 64 key 7", want: &netlink.Gretun{
+			LinkAttrs: attrs("gre1"),
+			Remote:    net.ParseIP("10.0.0.1"),
+			Local:     net.ParseIP("10.0.0.2"),
+			Ttl:       64,
+			IKey:      7,
+			OKey:      7,
+		}},
+		{cmd: "link add gre1 type gre okey 7", want: &netlink.Gretun{LinkAttrs: attrs("gre1"), OKey: 7}},
+		{cmd: "link add ipip1 type ipip remote 10.0.0.1 dev lo", want: &netlink.Iptun{LinkAttrs: attrs("ipip1"), Remote: net.ParseIP("10.0.0.1"), Link: uint32(lo)}},
+		{cmd: "link add sit1 type sit local 10.0.0.2", want: &netlink.Sittun{LinkAttrs: attrs("sit1"), Local: net.ParseIP("10.0.0.2")}},
+
+		{cmd: "link add type bridge"},
+		{cmd: "link add x0 type nosuch"},
+		{cmd: "link add x0 mtu big type dummy"},
+		{cmd: "link add x0 type bond mode nosuch"},
+		{cmd: "link add x0 type veth"},
+		{cmd: "link add x0 type vlan id 10"},
+		{cmd: "link add link lo x0 type vlan id 5000"},
+		{cmd: "link add x0 type macvlan"},
+		{cmd: "link add x0 type vxlan"},
+		{cmd: "link add x0 type ipip key 7"},
+		{cmd: "link add x0 type gre ttl 300"},
+		{cmd: "link add x0 link nosuch type macvlan"},
+	} {
+		got, err := parse(tt.cmd, func() (interface{}, error) { return parseLinkAdd() })
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: got %+v, want error", tt.cmd, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, %v, want %+v", tt.cmd, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	lo := loIndex(t)
+	cidr := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	for _, tt := range []struct {
+		cmd  string
+		want *netlink.Route
+	}{
+		{cmd: "route add 10.0.0.0/8 via 192.168.1.1 metric 100 table 10 proto static", want: &netlink.Route{
+			Dst:      cidr("10.0.0.0/8"),
+			Gw:       net.ParseIP("192.168.1.1"),
+			Priority: 100,
+			Table:    10,
+			Protocol: unix.RTPROT_STATIC,
+		}},
+		{cmd: "route add default via 10.0.0.1/24", want: &netlink.Route{Gw: net.ParseIP("10.0.0.1")}},
+		{cmd: "route add 10.0.0.1 dev lo src 127.0.0.1 scope host", want: &netlink.Route{
+			Dst:       cidr("10.0.0.1/32"),
+			LinkIndex: lo,
+			Src:       net.ParseIP("127.0.0.1"),
+			Scope:     netlink.SCOPE_HOST,
+		}},
+		{cmd: "route replace 10.0.0.0/8 dev lo table main", want: &netlink.Route{Dst: cidr("10.0.0.0/8"), LinkIndex: lo, Table: unix.RT_TABLE_MAIN, Scope: netlink.SCOPE_LINK}},
+		{cmd: "route delete 10.0.0.0/8", want: &netlink.Route{Dst: cidr("10.0.0.0/8"), Scope: netlink.SCOPE_NOWHERE}},
+		{cmd: "route add 2001:db8::/64 dev lo mtu 1280 metric 1024", want: &netlink.Route{Dst: cidr("2001:db8::/64"), LinkIndex: lo, MTU: 1280, Priority: 1024}},
+		{cmd: "-6 route add default via fe80::1 dev lo", want: &netlink.Route{Dst: cidr("::/0"), Gw: net.ParseIP("fe80::1"), LinkIndex: lo}},
+
+		{cmd: "route add 10.0.0.0/8"},
+		{cmd: "route add nonsense via 10.0.0.1"},
+		{cmd: "route add 10.0.0.0/8 via nonsense"},
+		{cmd: "route add 10.0.0.0/8 dev lo table nosuch"},
+		{cmd: "route add 10.0.0.0/8 dev lo scope nosuch"},
+		{cmd: "route add 10.0.0.0/8 dev lo frobnicate 1"},
+		{cmd: "route add 10.0.0.0/8 dev lo metric"},
+	} {
+		got, err := parse(tt.cmd, func() (interface{}, error) { return parseRoute(arg[1]) })
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: got %+v, want error", tt.cmd, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, %v, want %+v", tt.cmd, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	rule := func(f func(r *netlink.Rule)) *netlink.Rule {
+		r := netlink.NewRule()
+		r.Family = netlink.FAMILY_V4
+		f(r)
+		return r
+	}
+	_, src, _ := net.ParseCIDR("10.0.0.0/8")
+	_, dst, _ := net.ParseCIDR("2001:db8::/32")
+
+	for _, tt := range []struct {
+		cmd  string
+		want *netlink.Rule
+	}{
+		{cmd: "rule add from 10.0.0.0/8 table 100 pref 100", want: rule(func(r *netlink.Rule) {
+			r.Src, r.Table, r.Priority = src, 100, 100
+		})},
+		{cmd: "rule add to 2001:db8::/32 lookup local", want: rule(func(r *netlink.Rule) {
+			r.Dst, r.Table, r.Family = dst, unix.RT_TABLE_LOCAL, netlink.FAMILY_V6
+		})},
+		{cmd: "rule add from all fwmark 0x10/0xff iif eth0 oif eth1", want: rule(func(r *netlink.Rule) {
+			r.Mark, r.Mask, r.IifName, r.OifName, r.Table = 0x10, 0xff, "eth0", "eth1", unix.RT_TABLE_MAIN
+		})},
+		{cmd: "-6 rule add fwmark 1", want: rule(func(r *netlink.Rule) {
+			r.Mark, r.Table, r.Family = 1, unix.RT_TABLE_MAIN, netlink.FAMILY_V6
+		})},
+		{cmd: "rule delete priority 100", want: rule(func(r *netlink.Rule) { r.Priority = 100 })},
+
+		{cmd: "rule add fwmark nonsense"},
+		{cmd: "rule add from 10.0.0.300"},
+		{cmd: "rule add table nosuch"},
+		{cmd: "rule add frobnicate"},
+	} {
+		got, err := parse(tt.cmd, func() (interface{}, error) { return parseRule(arg[1]) })
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: got %+v, want error", tt.cmd, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, %v, want %+v", tt.cmd, got, err, tt.want)
+		}
+	}
+}
+
+// inNetns moves the calling goroutine to a new network namespace, and
+// returns the namespace and a function that moves it back.
+func inNetns(t *testing.T) (netns.NsHandle, func()) {
+	t.Helper()
+	testutil.SkipIfNotRoot(t)
+	runtime.LockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Skipf("no network namespaces: %v", err)
+	}
+	ns, err := netns.New()
+	if err != nil {
+		orig.Close()
+		runtime.UnlockOSThread()
+		t.Skipf("no network namespaces: %v", err)
+	}
+	return ns, func() {
+		if err := netns.Set(orig); err != nil {
+			// Leave the thread locked, so that it dies with the test.
+			t.Fatalf("restoring network namespace: %v", err)
+		}
+		ns.Close()
+		orig.Close()
+		runtime.UnlockOSThread()
+	}
+}
+
+func ipCmd(cmd string) (string, error) {
+	setArgs(cmd)
+	var b bytes.Buffer
+	err := run(&b)
+	return b.String(), err
+}
+
+func TestNetns(t *testing.T) {
+	_, restore := inNetns(t)
+	defer restore()
+
+	// Commands build on each other.
+	for _, tt := range []struct {
+		cmd  string
+		want []string
+		not  string
+		err  bool
+	}{
+		{cmd: "link add br0 type bridge"},
+		{cmd: "link add v0 type veth peer name v1"},
+		{cmd: "link add mv0 link v1 type macvlan mode bridge"},
+		{cmd: "link add vx0 type vxlan id 42 dstport 4789"},
+		{cmd: "link add x0 type nosuch", err: true},
+		{cmd: "link set v0 master br0 mtu 1400 up"},
+		{cmd: "link set br0 up"},
+		{cmd: "link set mv0 name mac0"},
+		{cmd: "link show v0", want: []string{": v0: <", "mtu 1400 master br0"}},
+		{cmd: "link show mv0", err: true},
+		{cmd: "link", want: []string{": mac0: <", ": vx0: <"}},
+		{cmd: "-j link show br0", want: []string{`"ifname":"br0"`, `"info_kind":"bridge"`, `"flags":["UP"`}},
+		{cmd: "-j link show v0", want: []string{`"master":"br0"`, `"mtu":1400`, `"info_kind":"veth"`}},
+
+		{cmd: "addr add 10.0.0.1/24 dev br0"},
+		{cmd: "addr show br0", want: []string{"inet 10.0.0.1 brd 10.0.0.255 scope global br0"}},
+		{cmd: "-j addr show dev br0", want: []string{`"addr_info":[{"family":"inet","local":"10.0.0.1","prefixlen":24,"broadcast":"10.0.0.255","scope":"global","label":"br0"`}},
+		{cmd: "-6 addr show br0", not: "10.0.0.1"},
+
+		{cmd: "route add 10.1.0.0/16 via 10.0.0.254 dev br0 metric 100 table 100"},
+		{cmd: "route add 10.2.0.0/16 dev br0 proto static"},
+		{cmd: "route show table 100", want: []string{"10.1.0.0/16 via 10.0.0.254 dev br0 table 100 proto boot scope global metric 100\n"}},
+		{cmd: "-j route show table 100", want: []string{`[{"dst":"10.1.0.0/16","gateway":"10.0.0.254","dev":"br0","table":"100","metric":100,"flags":[]}]`}},
+		{cmd: "route", want: []string{"10.2.0.0/16 dev br0 proto static scope link metric 0\n"}, not: "10.1.0.0"},
+		{cmd: "route show proto static", not: "10.0.0.0/24"},
+		{cmd: "route show table all", want: []string{"10.1.0.0/16", "10.2.0.0/16", "local 10.0.0.1 dev br0 table local proto kernel scope host src 10.0.0.1"}},
+		{cmd: "route del 10.1.0.0/16 table 100"},
+		{cmd: "route show table 100", not: "10.1.0.0"},
+		{cmd: "-6 route add 2001:db8::/64 dev br0 metric 512"},
+		{cmd: "-6 route", want: []string{"2001:db8::/64 dev br0 proto boot metric 512\n"}},
+
+		{cmd: "rule add from 10.0.0.0/8 table 100 pref 100"},
+		{cmd: "rule add fwmark 0x10/0xff lookup 200 pref 200"},
+		{cmd: "rule", want: []string{"100:\tfrom 10.0.0.0/8 lookup 100\n", "200:\tfrom all fwmark 0x10/0xff lookup 200\n", "32766:\tfrom all lookup main\n"}},
+		{cmd: "-j rule show", want: []string{`{"priority":100,"src":"10.0.0.0","srclen":8,"table":"100"}`}},
+		{cmd: "rule del pref 100"},
+		{cmd: "rule", not: "lookup 100"},
+
+		{cmd: "link set v0 nomaster"},
+		{cmd: "link show v0", not: "master"},
+		{cmd: "link del v0"},
+		{cmd: "link show v1", err: true},
+		{cmd: "link", not: "v1"},
+	} {
+		got, err := ipCmd(tt.cmd)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: err = %v, want error %t", tt.cmd, err, tt.err)
+			continue
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%q: output %q does not contain %q", tt.cmd, got, w)
+			}
+		}
+		if tt.not != "" && strings.Contains(got, tt.not) {
+			t.Errorf("%q: output %q contains %q", tt.cmd, got, tt.not)
+		}
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	ns, restore := inNetns(t)
+	defer restore()
+
+	done := make(chan struct{})
+	u, err := subscribe([]string{"link", "address"}, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setArgs("monitor")
+	r, w := io.Pipe()
+	go func() {
+		// Names are looked up in the namespace. The thread dies with
+		// the goroutine.
+		runtime.LockOSThread()
+		if err := netns.Set(ns); err != nil {
+			w.CloseWithError(err)
+			return
+		}
+		u.print(w, done)
+		w.Close()
+	}()
+	lines := make(chan string)
+	go func() {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+		close(lines)
+	}()
+	defer func() {
+		close(done)
+		for range lines {
+		}
+	}()
+
+	for _, tt := range []struct {
+		cmd  string
+		want string
+	}{
+		{cmd: "link add br1 type bridge", want: ": br1: <"},
+		{cmd: "addr add 10.0.0.1/24 dev br1", want: "br1    inet 10.0.0.1/24 scope global"},
+		{cmd: "link del br1", want: "Deleted "},
+	} {
+		// Flags are not to change while print runs.
+		arg, cursor = strings.Fields(tt.cmd), 0
+		if err := run(ioutil.Discard); err != nil {
+			t.Fatalf("%q: %v", tt.cmd, err)
+		}
+		timeout := time.After(5 * time.Second)
+	wait:
+		for {
+			select {
+			case l := <-lines:
+				if strings.Contains(l, tt.want) {
+					break wait
+				}
+			case <-timeout:
+				t.Fatalf("%q: no update %q", tt.cmd, tt.want)
+			}
+		}
+	}
+}
+
+func TestNetnsAdd(t *testing.T) {
+	testutil.SkipIfNotRoot(t)
+	dir, err := ioutil.TempDir("", "netns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { netnsDir = d }(netnsDir)
+	netnsDir = dir
+
+	if err := netnsAdd("test"); err != nil {
+		t.Skipf("can't add network namespaces: %v", err)
+	}
+	if out, err := ipCmd("netns add test"); err == nil {
+		t.Errorf("adding existing namespace = %q, want error", out)
+	}
+	if out, err := ipCmd("netns"); err != nil || out != "test\n" {
+		t.Errorf("netns = %q, %v, want %q", out, err, "test\n")
+	}
+	if out, err := ipCmd("-j netns list"); err != nil || out != "[{\"name\":\"test\"}]\n" {
+		t.Errorf("-j netns list = %q, %v", out, err)
+	}
+
+	// A link moved to the namespace is found there.
+	_, restore := inNetns(t)
+	if _, err := ipCmd("link add v0 type veth peer name v1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ipCmd("link set v0 netns test"); err != nil {
+		t.Error(err)
+	}
+	if _, err := netlink.LinkByName("v0"); err == nil {
+		t.Errorf("v0 is still in the original namespace")
+	}
+	if err := enterNetns("test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := netlink.LinkByName("v0"); err != nil {
+		t.Errorf("v0 is not in namespace test: %v", err)
+	}
+	restore()
+
+	if _, err := ipCmd("netns delete test"); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := ipCmd("netns"); err != nil || out != "" {
+		t.Errorf("netns after delete = %q, %v, want nothing", out, err)
+	}
+}
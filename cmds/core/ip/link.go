@@ -0,0 +1,457 @@
+// Copyright 2012-2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+var macvlanModes = map[string]netlink.MacvlanMode{
+	"private":  netlink.MACVLAN_MODE_PRIVATE,
+	"vepa":     netlink.MACVLAN_MODE_VEPA,
+	"bridge":   netlink.MACVLAN_MODE_BRIDGE,
+	"passthru": netlink.MACVLAN_MODE_PASSTHRU,
+	"source":   netlink.MACVLAN_MODE_SOURCE,
+}
+
+func linkshow(w io.Writer) error {
+	cursor++
+	whatIWant = []string{"<nothing>", "<device name>"}
+	if len(arg[cursor:]) == 0 {
+		return showLinks(w, false, "")
+	}
+	cursor--
+	return showLinks(w, false, devName())
+}
+
+func setHardwareAddress(iface netlink.Link) error {
+	cursor++
+	hwAddr, err := net.ParseMAC(arg[cursor])
+	if err != nil {
+		return fmt.Errorf("%v cant parse mac addr %v: %v", iface.Attrs().Name, hwAddr, err)
+	}
+	err = netlink.LinkSetHardwareAddr(iface, hwAddr)
+	if err != nil {
+		return fmt.Errorf("%v cant set mac addr %v: %v", iface.Attrs().Name, hwAddr, err)
+	}
+	return nil
+}
+
+// setNetns moves iface to the network namespace named by the next arg, or
+// to that of the process with the PID of the next arg.
+func setNetns(iface netlink.Link) error {
+	cursor++
+	whatIWant = []string{"network namespace name", "PID"}
+	if pid, err := strconv.Atoi(arg[cursor]); err == nil {
+		return netlink.LinkSetNsPid(iface, pid)
+	}
+	ns, err := netns.GetFromPath(filepath.Join(netnsDir, arg[cursor]))
+	if err != nil {
+		return fmt.Errorf("network namespace %s: %v", arg[cursor], err)
+	}
+	defer ns.Close()
+	return netlink.LinkSetNsFd(iface, int(ns))
+}
+
+func linkset() error {
+	iface, err := dev()
+	if err != nil {
+		return err
+	}
+	name := iface.Attrs().Name
+
+	// Settings may be combined, as in "ip link set eth0 mtu 9000 up".
+	for more() {
+		cursor++
+		whatIWant = []string{"address", "up", "down", "master", "nomaster", "mtu", "name", "netns"}
+		switch one(arg[cursor], whatIWant) {
+		case "address":
+			err = setHardwareAddress(iface)
+		case "up":
+			if err := netlink.LinkSetUp(iface); err != nil {
+				return fmt.Errorf("%v can't make it up: %v", name, err)
+			}
+		case "down":
+			if err := netlink.LinkSetDown(iface); err != nil {
+				return fmt.Errorf("%v can't make it down: %v", name, err)
+			}
+		case "master":
+			cursor++
+			whatIWant = []string{"device name"}
+			master, err := netlink.LinkByName(arg[cursor])
+			if err != nil {
+				return err
+			}
+			if err := netlink.LinkSetMaster(iface, master); err != nil {
+				return fmt.Errorf("%v can't set master %v: %v", name, arg[cursor], err)
+			}
+		case "nomaster":
+			if err := netlink.LinkSetNoMaster(iface); err != nil {
+				return fmt.Errorf("%v can't unset master: %v", name, err)
+			}
+		case "mtu":
+			var mtu int
+			if mtu, err = integer("MTU"); err == nil {
+				if err = netlink.LinkSetMTU(iface, mtu); err != nil {
+					err = fmt.Errorf("%v can't set mtu %d: %v", name, mtu, err)
+				}
+			}
+		case "name":
+			cursor++
+			whatIWant = []string{"new device name"}
+			if err := netlink.LinkSetName(iface, arg[cursor]); err != nil {
+				return fmt.Errorf("%v can't rename to %v: %v", name, arg[cursor], err)
+			}
+		case "netns":
+			err = setNetns(iface)
+		default:
+			return usage()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseLinkAdd parses the arguments of link add into the link to create.
+func parseLinkAdd() (netlink.Link, error) {
+	attrs := netlink.NewLinkAttrs()
+	for {
+		cursor++
+		whatIWant = []string{"name", "link", "address", "mtu", "type", "device name"}
+		switch arg[cursor] {
+		case "name", "dev":
+			cursor++
+			whatIWant = []string{"device name"}
+			attrs.Name = arg[cursor]
+		case "link":
+			parent, err := linkIndex()
+			if err != nil {
+				return nil, err
+			}
+			attrs.ParentIndex = parent
+		case "address":
+			cursor++
+			whatIWant = []string{"MAC address"}
+			mac, err := net.ParseMAC(arg[cursor])
+			if err != nil {
+				return nil, err
+			}
+			attrs.HardwareAddr = mac
+		case "mtu":
+			mtu, err := integer("MTU")
+			if err != nil {
+				return nil, err
+			}
+			attrs.MTU = mtu
+		case "type":
+			if attrs.Name == "" {
+				whatIWant = []string{"device name"}
+				return nil, usage()
+			}
+			return linkType(attrs)
+		default:
+			attrs.Name = arg[cursor]
+		}
+	}
+}
+
+// linkType parses the link type and its arguments.
+func linkType(attrs netlink.LinkAttrs) (netlink.Link, error) {
+	cursor++
+	whatIWant = []string{"bridge", "bond", "dummy", "veth", "vlan", "macvlan", "vxlan", "wireguard", "gre", "ipip", "sit"}
+	switch arg[cursor] {
+	case "bridge":
+		return &netlink.Bridge{LinkAttrs: attrs}, nil
+	case "dummy":
+		return &netlink.Dummy{LinkAttrs: attrs}, nil
+	case "wireguard":
+		// Keys and peers are set with wg.
+		return &netlink.GenericLink{LinkAttrs: attrs, LinkType: "wireguard"}, nil
+	case "bond":
+		return bond(attrs)
+	case "veth":
+		return veth(attrs)
+	case "vlan":
+		return vlan(attrs)
+	case "macvlan":
+		return macvlan(attrs)
+	case "vxlan":
+		return vxlan(attrs)
+	case "gre", "ipip", "sit":
+		return tunnel(attrs, arg[cursor])
+	}
+	return nil, usage()
+}
+
+// linkIndex returns the index of the link named by the next arg.
+func linkIndex() (int, error) {
+	cursor++
+	whatIWant = []string{"device name"}
+	l, err := netlink.LinkByName(arg[cursor])
+	if err != nil {
+		return 0, err
+	}
+	return l.Attrs().Index, nil
+}
+
+func bond(attrs netlink.LinkAttrs) (netlink.Link, error) {
+	b := netlink.NewLinkBond(attrs)
+	for more() {
+		cursor++
+		whatIWant = []string{"mode", "miimon", "lacp_rate", "xmit_hash_policy"}
+		var err error
+		switch arg[cursor] {
+		case "mode":
+			cursor++
+			whatIWant = []string{"bonding mode"}
+			mode, ok := netlink.StringToBondModeMap[arg[cursor]]
+			if !ok {
+				return nil, fmt.Errorf("unknown bonding mode %q", arg[cursor])
+			}
+			b.Mode = mode
+		case "miimon":
+			b.Miimon, err = integer("miimon interval")
+		case "lacp_rate":
+			cursor++
+			whatIWant = []string{"slow", "fast"}
+			if b.LacpRate = netlink.StringToBondLacpRate(arg[cursor]); b.LacpRate == netlink.BOND_LACP_RATE_UNKNOWN {
+				return nil, usage()
+			}
+		case "xmit_hash_policy":
+			cursor++
+			whatIWant = []string{"transmit hash policy"}
+			policy, ok := netlink.StringToBondXmitHashPolicyMap[arg[cursor]]
+			if !ok {
+				return nil, fmt.Errorf("unknown transmit hash policy %q", arg[cursor])
+			}
+			b.XmitHashPolicy = policy
+		default:
+			return nil, usage()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func veth(attrs netlink.LinkAttrs) (netlink.Link, error) {
+	v := &netlink.Veth{LinkAttrs: attrs}
+	if more() {
+		cursor++
+		whatIWant = []string{"peer"}
+		if arg[cursor] != "peer" {
+			return nil, usage()
+		}
+		name, err := maybename()
+		if err != nil {
+			return nil, err
+		}
+		v.PeerName = name
+	}
+	if v.PeerName == "" {
+		return nil, fmt.Errorf("veth %s needs a peer name", attrs.Name)
+	}
+	return v, nil
+}
+
+func vlan(attrs netlink.LinkAttrs) (netlink.Link, error) {
+	v := &netlink.Vlan{LinkAttrs: attrs, VlanId: -1}
+	for more() {
+		cursor++
+		whatIWant = []string{"id", "protocol"}
+		var err error
+		switch arg[cursor] {
+		case "id":
+			v.VlanId, err = integer("VLAN ID")
+		case "protocol":
+			cursor++
+			whatIWant = []string{"802.1q", "802.1ad"}
+			if v.VlanProtocol = netlink.StringToVlanProtocol(arg[cursor]); v.VlanProtocol == netlink.VLAN_PROTOCOL_UNKNOWN {
+				return nil, usage()
+			}
+		default:
+			return nil, usage()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if attrs.ParentIndex == 0 {
+		return nil, fmt.Errorf("vlan %s needs a link", attrs.Name)
+	}
+	if v.VlanId < 0 || v.VlanId > 4095 {
+		return nil, fmt.Errorf("vlan %s needs an id within 0-4095", attrs.Name)
+	}
+	return v, nil
+}
+
+func macvlan(attrs netlink.LinkAttrs) (netlink.Link, error) {
+	m := &netlink.Macvlan{LinkAttrs: attrs}
+	for more() {
+		cursor++
+		whatIWant = []string{"mode"}
+		if arg[cursor] != "mode" {
+			return nil, usage()
+		}
+		cursor++
+		whatIWant = []string{"private", "vepa", "bridge", "passthru", "source"}
+		mode, ok := macvlanModes[arg[cursor]]
+		if !ok {
+			return nil, usage()
+		}
+		m.Mode = mode
+	}
+	if attrs.ParentIndex == 0 {
+		return nil, fmt.Errorf("macvlan %s needs a link", attrs.Name)
+	}
+	return m, nil
+}
+
+func vxlan(attrs netlink.LinkAttrs) (netlink.Link, error) {
+	// The defaults of iproute2.
+	v := &netlink.Vxlan{LinkAttrs: attrs, VxlanId: -1, Learning: true}
+	for more() {
+		cursor++
+		whatIWant = []string{"id", "dev", "group", "remote", "local", "dstport", "ttl", "learning", "nolearning"}
+		var err error
+		switch arg[cursor] {
+		case "id":
+			v.VxlanId, err = integer("VNI")
+		case "dev":
+			v.VtepDevIndex, err = linkIndex()
+		case "group", "remote":
+			v.Group, err = ipAddr(arg[cursor] + " address")
+		case "local":
+			v.SrcAddr, err = ipAddr("local address")
+		case "dstport":
+			v.Port, err = integer("destination port")
+		case "ttl":
+			v.TTL, err = integer("TTL")
+		case "learning":
+			v.Learning = true
+		case "nolearning":
+			v.Learning = false
+		default:
+			return nil, usage()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if v.VxlanId < 0 || v.VxlanId >= 1<<24 {
+		return nil, fmt.Errorf("vxlan %s needs an id within 0-16777215", attrs.Name)
+	}
+	return v, nil
+}
+
+// tunnel parses the arguments of gre, ipip and sit tunnels.
+func tunnel(attrs netlink.LinkAttrs, kind string) (netlink.Link, error) {
+	var (
+		local, remote net.IP
+		ttl, link     int
+		ikey, okey    int
+		err           error
+	)
+	for more() {
+		cursor++
+		whatIWant = []string{"remote", "local", "ttl", "dev"}
+		if kind == "gre" {
+			whatIWant = append(whatIWant, "key", "ikey", "okey")
+		}
+		switch arg[cursor] {
+		case "remote":
+			remote, err = ipAddr("remote address")
+		case "local":
+			local, err = ipAddr("local address")
+		case "ttl":
+			ttl, err = integer("TTL")
+		case "dev":
+			link, err = linkIndex()
+		case "key", "ikey", "okey":
+			if kind != "gre" {
+				return nil, usage()
+			}
+			which := arg[cursor]
+			var key int
+			if key, err = integer("key"); err == nil {
+				if which != "okey" {
+					ikey = key
+				}
+				if which != "ikey" {
+					okey = key
+				}
+			}
+		default:
+			return nil, usage()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ttl > 255 {
+		return nil, fmt.Errorf("%s %s: TTL %d is not within 0-255", kind, attrs.Name, ttl)
+	}
+	switch kind {
+	case "gre":
+		return &netlink.Gretun{LinkAttrs: attrs, Local: local, Remote: remote, Ttl: uint8(ttl), Link: uint32(link), IKey: uint32(ikey), OKey: uint32(okey)}, nil
+	case "ipip":
+		return &netlink.Iptun{LinkAttrs: attrs, Local: local, Remote: remote, Ttl: uint8(ttl), Link: uint32(link)}, nil
+	}
+	return &netlink.Sittun{LinkAttrs: attrs, Local: local, Remote: remote, Ttl: uint8(ttl), Link: uint32(link)}, nil
+}
+
+func linkadd() error {
+	l, err := parseLinkAdd()
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkAdd(l); err != nil {
+		return fmt.Errorf("adding %s link %s: %v", l.Type(), l.Attrs().Name, err)
+	}
+	return nil
+}
+
+func linkdel() error {
+	iface, err := dev()
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkDel(iface); err != nil {
+		return fmt.Errorf("deleting %s: %v", iface.Attrs().Name, err)
+	}
+	return nil
+}
+
+func link(w io.Writer) error {
+	if len(arg) == 1 {
+		return linkshow(w)
+	}
+
+	cursor++
+	whatIWant = []string{"show", "list", "set", "add", "delete"}
+	cmd := arg[cursor]
+
+	switch one(cmd, whatIWant) {
+	case "show", "list":
+		return linkshow(w)
+	case "set":
+		return linkset()
+	case "add":
+		return linkadd()
+	case "delete":
+		return linkdel()
+	}
+	return usage()
+}
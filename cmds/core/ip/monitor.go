@@ -0,0 +1,149 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// updates are the channels of netlink notifications that monitor prints.
+type updates struct {
+	links  chan netlink.LinkUpdate
+	addrs  chan netlink.AddrUpdate
+	routes chan netlink.RouteUpdate
+	neighs chan netlink.NeighUpdate
+}
+
+// subscribe subscribes to the notifications about objects, which are
+// "link", "address", "route" and "neigh", until done is closed.
+func subscribe(objects []string, done <-chan struct{}) (*updates, error) {
+	u := &updates{}
+	for _, o := range objects {
+		var err error
+		switch o {
+		case "link":
+			u.links = make(chan netlink.LinkUpdate)
+			err = netlink.LinkSubscribe(u.links, done)
+		case "address":
+			u.addrs = make(chan netlink.AddrUpdate)
+			err = netlink.AddrSubscribe(u.addrs, done)
+		case "route":
+			u.routes = make(chan netlink.RouteUpdate)
+			err = netlink.RouteSubscribe(u.routes, done)
+		case "neigh":
+			u.neighs = make(chan netlink.NeighUpdate)
+			err = netlink.NeighSubscribe(u.neighs, done)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("subscribing to %s updates: %v", o, err)
+		}
+	}
+	return u, nil
+}
+
+// addrUpdateInfo is an address update of -j.
+type addrUpdateInfo struct {
+	Deleted  bool       `json:"deleted,omitempty"`
+	Index    int        `json:"ifindex"`
+	Name     string     `json:"ifname"`
+	AddrInfo []addrInfo `json:"addr_info"`
+}
+
+// print prints updates to w until done is closed.
+func (u *updates) print(w io.Writer, done <-chan struct{}) error {
+	for {
+		var err error
+		select {
+		case <-done:
+			return nil
+		case l := <-u.links:
+			err = showLinkUpdate(w, l)
+		case a := <-u.addrs:
+			err = showAddrUpdate(w, a)
+		case r := <-u.routes:
+			del := r.Type == unix.RTM_DELROUTE
+			if *jsonOut {
+				i := routeJSON(r.Route)
+				i.Deleted = del
+				err = printJSON(w, i)
+			} else {
+				deleted(w, del)
+				err = showRoute(w, r.Route)
+			}
+		case n := <-u.neighs:
+			del := n.Type == unix.RTM_DELNEIGH
+			if *jsonOut {
+				i := neighJSON(n.Neigh)
+				i.Deleted = del
+				err = printJSON(w, i)
+			} else {
+				deleted(w, del)
+				err = showNeighbour(w, n.Neigh)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func showLinkUpdate(w io.Writer, l netlink.LinkUpdate) error {
+	del := l.Header.Type == unix.RTM_DELLINK
+	if *jsonOut {
+		i, err := linkJSON(l.Link, false)
+		if err != nil {
+			return err
+		}
+		i.Deleted = del
+		return printJSON(w, i)
+	}
+	deleted(w, del)
+	return showLink(w, l.Link, false)
+}
+
+func showAddrUpdate(w io.Writer, a netlink.AddrUpdate) error {
+	addr := netlink.Addr{IPNet: &a.LinkAddress, Scope: a.Scope, PreferedLft: a.PreferedLft, ValidLft: a.ValidLft}
+	name := linkName(a.LinkIndex)
+	if *jsonOut {
+		return printJSON(w, addrUpdateInfo{
+			Deleted:  !a.NewAddr,
+			Index:    a.LinkIndex,
+			Name:     name,
+			AddrInfo: []addrInfo{addrJSON(addr)},
+		})
+	}
+	deleted(w, !a.NewAddr)
+	_, err := fmt.Fprintf(w, "%d: %s    %s %s scope %s\n", a.LinkIndex, name, inetFamily(addr.IP), addr.IPNet, addrScopes[netlink.Scope(addr.Scope)])
+	return err
+}
+
+func monitor(w io.Writer) error {
+	objects := []string{"link", "address", "route", "neigh"}
+	if more() {
+		objects = nil
+	}
+	for more() {
+		cursor++
+		whatIWant = []string{"all", "link", "address", "route", "neigh"}
+		o := one(arg[cursor], whatIWant)
+		switch o {
+		case "all":
+			objects = append(objects, "link", "address", "route", "neigh")
+		case "link", "address", "route", "neigh":
+			objects = append(objects, o)
+		default:
+			return usage()
+		}
+	}
+	u, err := subscribe(objects, nil)
+	if err != nil {
+		return err
+	}
+	return u.print(w, nil)
+}
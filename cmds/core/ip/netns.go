@@ -0,0 +1,151 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"syscall"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// netnsDir is where named network namespaces are bind mounted, as in
+// iproute2.
+var netnsDir = "/var/run/netns"
+
+// netnsNames returns the names of the named network namespaces.
+func netnsNames() ([]string, error) {
+	fis, err := ioutil.ReadDir(netnsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// netnsAdd creates the network namespace name and bind mounts it to
+// netnsDir, so that it lives on without processes.
+func netnsAdd(name string) (err error) {
+	if err := os.MkdirAll(netnsDir, 0755); err != nil {
+		return err
+	}
+	p := filepath.Join(netnsDir, name)
+	f, err := os.OpenFile(p, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0)
+	if err != nil {
+		return fmt.Errorf("network namespace %s: %v", name, err)
+	}
+	f.Close()
+	defer func() {
+		if err != nil {
+			os.Remove(p)
+		}
+	}()
+
+	// Namespaces belong to threads.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		return err
+	}
+	defer orig.Close()
+	ns, err := netns.New()
+	if err != nil {
+		return fmt.Errorf("network namespace %s: %v", name, err)
+	}
+	defer ns.Close()
+	defer netns.Set(orig)
+
+	self := fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid())
+	if err := unix.Mount(self, p, "none", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind mounting network namespace %s: %v", name, err)
+	}
+	return nil
+}
+
+// netnsDel unmounts and removes the network namespace name. It is gone once
+// the last of its processes exits.
+func netnsDel(name string) error {
+	p := filepath.Join(netnsDir, name)
+	if err := unix.Unmount(p, unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmounting network namespace %s: %v", name, err)
+	}
+	return os.Remove(p)
+}
+
+// enterNetns moves the process to the network namespace name. Only the
+// calling thread moves, so it stays locked to the goroutine.
+func enterNetns(name string) error {
+	ns, err := netns.GetFromPath(filepath.Join(netnsDir, name))
+	if err != nil {
+		return fmt.Errorf("network namespace %s: %v", name, err)
+	}
+	defer ns.Close()
+	runtime.LockOSThread()
+	if err := netns.Set(ns); err != nil {
+		return fmt.Errorf("entering network namespace %s: %v", name, err)
+	}
+	return nil
+}
+
+// netnsExec runs a command in the network namespace name. It replaces the
+// ip process.
+func netnsExec(name string, args []string) error {
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	if err := enterNetns(name); err != nil {
+		return err
+	}
+	return syscall.Exec(path, args, os.Environ())
+}
+
+func netnsCmd(w io.Writer) error {
+	cursor++
+	whatIWant = []string{"list", "show", "add", "delete", "exec"}
+	cmd := "list"
+	if len(arg[cursor:]) != 0 {
+		cmd = one(arg[cursor], whatIWant)
+	}
+	switch cmd {
+	case "list", "show":
+		names, err := netnsNames()
+		if err != nil {
+			return err
+		}
+		return showNetns(w, names)
+	case "add", "delete":
+		cursor++
+		whatIWant = []string{"network namespace name"}
+		if cmd == "add" {
+			return netnsAdd(arg[cursor])
+		}
+		return netnsDel(arg[cursor])
+	case "exec":
+		cursor++
+		whatIWant = []string{"network namespace name"}
+		name := arg[cursor]
+		cursor++
+		whatIWant = []string{"command"}
+		return netnsExec(name, arg[cursor:])
+	}
+	return usage()
+}
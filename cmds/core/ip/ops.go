@@ -5,48 +5,220 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"math"
 	"net"
+	"strconv"
 	"strings"
 
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 )
 
-func showLinks(w io.Writer, withAddresses bool) error {
-	ifaces, err := netlink.LinkList()
-	if err != nil {
-		return fmt.Errorf("can't enumerate interfaces: %v", err)
+// The types below are the objects of -j, with the fields of iproute2.
+// Deleted is set by monitor.
+
+type linkInfo struct {
+	Deleted   bool       `json:"deleted,omitempty"`
+	Index     int        `json:"ifindex"`
+	Name      string     `json:"ifname"`
+	Flags     []string   `json:"flags"`
+	MTU       int        `json:"mtu"`
+	Master    string     `json:"master,omitempty"`
+	OperState string     `json:"operstate"`
+	LinkType  string     `json:"link_type"`
+	Address   string     `json:"address,omitempty"`
+	LinkInfo  *linkKind  `json:"linkinfo,omitempty"`
+	AddrInfo  []addrInfo `json:"addr_info,omitempty"`
+}
+
+type linkKind struct {
+	Kind string `json:"info_kind"`
+}
+
+type addrInfo struct {
+	Family            string `json:"family"`
+	Local             string `json:"local"`
+	PrefixLen         int    `json:"prefixlen"`
+	Broadcast         string `json:"broadcast,omitempty"`
+	Scope             string `json:"scope"`
+	Label             string `json:"label,omitempty"`
+	ValidLifeTime     uint32 `json:"valid_life_time"`
+	PreferredLifeTime uint32 `json:"preferred_life_time"`
+}
+
+type neighInfo struct {
+	Deleted bool     `json:"deleted,omitempty"`
+	Dst     string   `json:"dst"`
+	Dev     string   `json:"dev"`
+	LLAddr  string   `json:"lladdr,omitempty"`
+	Router  bool     `json:"router,omitempty"`
+	State   []string `json:"state"`
+}
+
+type routeInfo struct {
+	Deleted  bool     `json:"deleted,omitempty"`
+	Type     string   `json:"type,omitempty"`
+	Dst      string   `json:"dst"`
+	Gateway  string   `json:"gateway,omitempty"`
+	Dev      string   `json:"dev,omitempty"`
+	Table    string   `json:"table,omitempty"`
+	Protocol string   `json:"protocol,omitempty"`
+	Scope    string   `json:"scope,omitempty"`
+	PrefSrc  string   `json:"prefsrc,omitempty"`
+	Metric   int      `json:"metric,omitempty"`
+	Flags    []string `json:"flags"`
+}
+
+type ruleInfo struct {
+	Priority int    `json:"priority"`
+	Src      string `json:"src"`
+	SrcLen   int    `json:"srclen,omitempty"`
+	Dst      string `json:"dst,omitempty"`
+	DstLen   int    `json:"dstlen,omitempty"`
+	FwMark   string `json:"fwmark,omitempty"`
+	FwMask   string `json:"fwmask,omitempty"`
+	Iif      string `json:"iif,omitempty"`
+	Oif      string `json:"oif,omitempty"`
+	Table    string `json:"table"`
+}
+
+type netnsInfo struct {
+	Name string `json:"name"`
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	if *pretty {
+		enc.SetIndent("", "    ")
 	}
+	return enc.Encode(v)
+}
 
-	for _, v := range ifaces {
-		l := v.Attrs()
+// deleted starts the line of an object that monitor reports deleted.
+func deleted(w io.Writer, del bool) {
+	if del {
+		fmt.Fprint(w, "Deleted ")
+	}
+}
+
+func linkFlags(l *netlink.LinkAttrs) []string {
+	flags := []string{}
+	if l.Flags != 0 {
+		flags = strings.Split(strings.ToUpper(l.Flags.String()), "|")
+	}
+	return flags
+}
+
+func showLinks(w io.Writer, withAddresses bool, name string) error {
+	var ifaces []netlink.Link
+	if name != "" {
+		iface, err := netlink.LinkByName(name)
+		if err != nil {
+			return err
+		}
+		ifaces = append(ifaces, iface)
+	} else {
+		var err error
+		if ifaces, err = netlink.LinkList(); err != nil {
+			return fmt.Errorf("can't enumerate interfaces: %v", err)
+		}
+	}
 
-		master := ""
-		if l.MasterIndex != 0 {
-			link, err := netlink.LinkByIndex(l.MasterIndex)
+	if *jsonOut {
+		links := []linkInfo{}
+		for _, v := range ifaces {
+			l, err := linkJSON(v, withAddresses)
 			if err != nil {
-				return fmt.Errorf("can't get link with index %d: %v", l.MasterIndex, err)
+				return err
 			}
-			master = fmt.Sprintf("master %s ", link.Attrs().Name)
+			links = append(links, *l)
 		}
-		fmt.Fprintf(w, "%d: %s: <%s> mtu %d %sstate %s\n", l.Index, l.Name,
-			strings.Replace(strings.ToUpper(l.Flags.String()), "|", ",", -1),
-			l.MTU, master, strings.ToUpper(l.OperState.String()))
+		return printJSON(w, links)
+	}
+	for _, v := range ifaces {
+		if err := showLink(w, v, withAddresses); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		fmt.Fprintf(w, "    link/%s %s\n", l.EncapType, l.HardwareAddr)
+func showLink(w io.Writer, link netlink.Link, withAddresses bool) error {
+	l := link.Attrs()
+	master := ""
+	if l.MasterIndex != 0 {
+		master = fmt.Sprintf("master %s ", linkName(l.MasterIndex))
+	}
+	fmt.Fprintf(w, "%d: %s: <%s> mtu %d %sstate %s\n", l.Index, l.Name,
+		strings.Join(linkFlags(l), ","), l.MTU, master, strings.ToUpper(l.OperState.String()))
 
-		if withAddresses {
-			showLinkAddresses(w, v)
-		}
+	fmt.Fprintf(w, "    link/%s %s\n", l.EncapType, l.HardwareAddr)
+
+	if withAddresses {
+		return showLinkAddresses(w, link)
 	}
 	return nil
 }
 
+func linkJSON(link netlink.Link, withAddresses bool) (*linkInfo, error) {
+	l := link.Attrs()
+	info := &linkInfo{
+		Index:     l.Index,
+		Name:      l.Name,
+		Flags:     linkFlags(l),
+		MTU:       l.MTU,
+		OperState: strings.ToUpper(l.OperState.String()),
+		LinkType:  l.EncapType,
+		Address:   l.HardwareAddr.String(),
+	}
+	if l.MasterIndex != 0 {
+		info.Master = linkName(l.MasterIndex)
+	}
+	if t := link.Type(); t != "device" {
+		info.LinkInfo = &linkKind{Kind: t}
+	}
+	if withAddresses {
+		addrs, err := netlink.AddrList(link, family(netlink.FAMILY_ALL))
+		if err != nil {
+			return nil, fmt.Errorf("can't enumerate addresses: %v", err)
+		}
+		info.AddrInfo = []addrInfo{}
+		for _, addr := range addrs {
+			info.AddrInfo = append(info.AddrInfo, addrJSON(addr))
+		}
+	}
+	return info, nil
+}
+
+func inetFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "inet"
+	}
+	return "inet6"
+}
+
+func addrJSON(addr netlink.Addr) addrInfo {
+	ones, _ := addr.Mask.Size()
+	a := addrInfo{
+		Family:            inetFamily(addr.IP),
+		Local:             addr.IP.String(),
+		PrefixLen:         ones,
+		Scope:             addrScopes[netlink.Scope(addr.Scope)],
+		Label:             addr.Label,
+		ValidLifeTime:     uint32(addr.ValidLft),
+		PreferredLifeTime: uint32(addr.PreferedLft),
+	}
+	if addr.Broadcast != nil {
+		a.Broadcast = addr.Broadcast.String()
+	}
+	return a
+}
+
 func showLinkAddresses(w io.Writer, link netlink.Link) error {
-	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	addrs, err := netlink.AddrList(link, family(netlink.FAMILY_ALL))
 	if err != nil {
 		return fmt.Errorf("can't enumerate addresses: %v", err)
 	}
@@ -111,42 +283,73 @@ func getState(state int) string {
 	return strings.Join(ret, ",")
 }
 
+// linkName returns the name of the link with index, or the index if there
+// is no such link.
+func linkName(index int) string {
+	l, err := netlink.LinkByIndex(index)
+	if err != nil {
+		return strconv.Itoa(index)
+	}
+	return l.Attrs().Name
+}
+
+func neighJSON(n netlink.Neigh) neighInfo {
+	i := neighInfo{
+		Dst:    n.IP.String(),
+		Dev:    linkName(n.LinkIndex),
+		Router: n.Flags&netlink.NTF_ROUTER != 0,
+		State:  strings.Split(getState(n.State), ","),
+	}
+	if n.HardwareAddr != nil {
+		i.LLAddr = n.HardwareAddr.String()
+	}
+	return i
+}
+
+func showNeighbour(w io.Writer, n netlink.Neigh) error {
+	entry := fmt.Sprintf("%s dev %s", n.IP.String(), linkName(n.LinkIndex))
+	if n.HardwareAddr != nil {
+		entry += fmt.Sprintf(" lladdr %s", n.HardwareAddr)
+	}
+	if n.Flags&netlink.NTF_ROUTER != 0 {
+		entry += " router"
+	}
+	entry += " " + getState(n.State)
+	_, err := fmt.Fprintln(w, entry)
+	return err
+}
+
 func showNeighbours(w io.Writer, withAddresses bool) error {
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return err
 	}
+	neighs := []neighInfo{}
 	for _, iface := range ifaces {
-		neighs, err := netlink.NeighList(iface.Index, 0)
+		ns, err := netlink.NeighList(iface.Index, family(netlink.FAMILY_ALL))
 		if err != nil {
 			return fmt.Errorf("can't list neighbours: %v", err)
 		}
 
-		for _, v := range neighs {
+		for _, v := range ns {
 			if v.State&netlink.NUD_NOARP != 0 {
 				continue
 			}
-			entry := fmt.Sprintf("%s dev %s", v.IP.String(), iface.Name)
-			if v.HardwareAddr != nil {
-				entry += fmt.Sprintf(" lladdr %s", v.HardwareAddr)
+			if *jsonOut {
+				neighs = append(neighs, neighJSON(v))
+				continue
 			}
-			if v.Flags&netlink.NTF_ROUTER != 0 {
-				entry += " router"
+			if err := showNeighbour(w, v); err != nil {
+				return err
 			}
-			entry += " " + getState(v.State)
-			fmt.Println(entry)
 		}
 	}
+	if *jsonOut {
+		return printJSON(w, neighs)
+	}
 	return nil
 }
 
-const (
-	defaultFmt   = "default via %v dev %s proto %s metric %d\n"
-	routeFmt     = "%v dev %s proto %s scope %s src %s metric %d\n"
-	route6Fmt    = "%s dev %s proto %s metric %d\n"
-	routeVia6Fmt = "%s via %s dev %s proto %s metric %d\n"
-)
-
 // routing protocol identifier
 // specified in Linux Kernel header: include/uapi/linux/rtnetlink.h
 // See man IP-ROUTE(8) and RTNETLINK(7)
@@ -174,56 +377,194 @@ var rtProto = map[int]string{
 	unix.RTPROT_ZEBRA:    "zebra",
 }
 
-func showRoutes(inet6 bool) error {
-	var f int
-	if inet6 {
-		f = netlink.FAMILY_V6
-	} else {
-		f = netlink.FAMILY_V4
-	}
+// route types other than unicast.
+var rtTypes = map[int]string{
+	unix.RTN_LOCAL:       "local",
+	unix.RTN_BROADCAST:   "broadcast",
+	unix.RTN_ANYCAST:     "anycast",
+	unix.RTN_MULTICAST:   "multicast",
+	unix.RTN_BLACKHOLE:   "blackhole",
+	unix.RTN_UNREACHABLE: "unreachable",
+	unix.RTN_PROHIBIT:    "prohibit",
+	unix.RTN_THROW:       "throw",
+	unix.RTN_NAT:         "nat",
+}
 
-	routes, err := netlink.RouteList(nil, f)
+func showRoutes(w io.Writer, f int, filter *netlink.Route, mask uint64) error {
+	routes, err := netlink.RouteListFiltered(f, filter, mask)
 	if err != nil {
 		return err
 	}
-	for _, route := range routes {
-		link, err := netlink.LinkByIndex(route.LinkIndex)
-		if err != nil {
+	if *jsonOut {
+		infos := []routeInfo{}
+		for _, r := range routes {
+			infos = append(infos, routeJSON(r))
+		}
+		return printJSON(w, infos)
+	}
+	for _, r := range routes {
+		if err := showRoute(w, r); err != nil {
 			return err
 		}
-		if route.Dst == nil {
-			defaultRoute(route, link)
-		} else {
-			showRoute(route, link, f)
+	}
+	return nil
+}
+
+// routeDst is the destination of r as ip shows it.
+func routeDst(r *netlink.Route) string {
+	if r.Dst == nil {
+		return "default"
+	}
+	switch ones, bits := r.Dst.Mask.Size(); ones {
+	case 0:
+		return "default"
+	case bits:
+		return r.Dst.IP.String()
+	}
+	return r.Dst.String()
+}
+
+func routeJSON(r netlink.Route) routeInfo {
+	i := routeInfo{
+		Type:   rtTypes[r.Type],
+		Dst:    routeDst(&r),
+		Scope:  addrScopes[r.Scope],
+		Metric: r.Priority,
+		Flags:  append([]string{}, r.ListFlags()...),
+	}
+	if r.Gw != nil {
+		i.Gateway = r.Gw.String()
+	}
+	if r.LinkIndex != 0 {
+		i.Dev = linkName(r.LinkIndex)
+	}
+	if r.Table != unix.RT_TABLE_MAIN {
+		i.Table = tableName(r.Table)
+	}
+	// iproute2 omits the defaults.
+	if r.Protocol != unix.RTPROT_BOOT {
+		i.Protocol = rtProto[r.Protocol]
+	}
+	if r.Scope == netlink.SCOPE_UNIVERSE {
+		i.Scope = ""
+	}
+	if r.Src != nil {
+		i.PrefSrc = r.Src.String()
+	}
+	return i
+}
+
+func showRoute(w io.Writer, r netlink.Route) error {
+	var b strings.Builder
+	if t, ok := rtTypes[r.Type]; ok {
+		b.WriteString(t + " ")
+	}
+	b.WriteString(routeDst(&r))
+	if r.Gw != nil {
+		fmt.Fprintf(&b, " via %s", r.Gw)
+	}
+	if r.LinkIndex != 0 {
+		fmt.Fprintf(&b, " dev %s", linkName(r.LinkIndex))
+	}
+	if r.Table != unix.RT_TABLE_MAIN {
+		fmt.Fprintf(&b, " table %s", tableName(r.Table))
+	}
+	fmt.Fprintf(&b, " proto %s", rtProto[r.Protocol])
+	// IPv6 routes have no scopes.
+	if r.Dst != nil && r.Dst.IP.To4() != nil {
+		fmt.Fprintf(&b, " scope %s", addrScopes[r.Scope])
+	}
+	if r.Src != nil {
+		fmt.Fprintf(&b, " src %s", r.Src)
+	}
+	fmt.Fprintf(&b, " metric %d", r.Priority)
+	_, err := fmt.Fprintln(w, b.String())
+	return err
+}
+
+// prefixJSON returns the address and length of n, which is all if n is nil.
+func prefixJSON(n *net.IPNet) (string, int) {
+	if n == nil {
+		return "all", 0
+	}
+	ones, _ := n.Mask.Size()
+	return n.IP.String(), ones
+}
+
+func ruleJSON(r netlink.Rule) ruleInfo {
+	i := ruleInfo{
+		Priority: r.Priority,
+		Iif:      r.IifName,
+		Oif:      r.OifName,
+		Table:    tableName(r.Table),
+	}
+	i.Src, i.SrcLen = prefixJSON(r.Src)
+	if r.Dst != nil {
+		i.Dst, i.DstLen = prefixJSON(r.Dst)
+	}
+	if r.Mark >= 0 {
+		i.FwMark = fmt.Sprintf("%#x", r.Mark)
+	}
+	if r.Mask >= 0 && uint32(r.Mask) != math.MaxUint32 {
+		i.FwMask = fmt.Sprintf("%#x", r.Mask)
+	}
+	return i
+}
+
+func showRules(w io.Writer, f int) error {
+	rules, err := netlink.RuleList(f)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		infos := []ruleInfo{}
+		for _, r := range rules {
+			infos = append(infos, ruleJSON(r))
+		}
+		return printJSON(w, infos)
+	}
+	for _, r := range rules {
+		i := ruleJSON(r)
+		src := i.Src
+		if i.SrcLen != 0 && i.SrcLen != 8*len(r.Src.IP) {
+			src += "/" + strconv.Itoa(i.SrcLen)
+		}
+		line := fmt.Sprintf("%d:\tfrom %s", i.Priority, src)
+		if r.Dst != nil {
+			line += " to " + r.Dst.String()
+		}
+		if i.FwMark != "" {
+			line += " fwmark " + i.FwMark
+			if i.FwMask != "" {
+				line += "/" + i.FwMask
+			}
+		}
+		if i.Iif != "" {
+			line += " iif " + i.Iif
+		}
+		if i.Oif != "" {
+			line += " oif " + i.Oif
+		}
+		line += " lookup " + i.Table
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func defaultRoute(r netlink.Route, l netlink.Link) {
-	gw := r.Gw
-	name := l.Attrs().Name
-	proto := rtProto[r.Protocol]
-	metric := r.Priority
-	fmt.Printf(defaultFmt, gw, name, proto, metric)
-}
-
-func showRoute(r netlink.Route, l netlink.Link, f int) {
-	dest := r.Dst
-	name := l.Attrs().Name
-	proto := rtProto[r.Protocol]
-	metric := r.Priority
-	switch f {
-	case netlink.FAMILY_V4:
-		scope := addrScopes[r.Scope]
-		src := r.Src
-		fmt.Printf(routeFmt, dest, name, proto, scope, src, metric)
-	case netlink.FAMILY_V6:
-		if r.Gw != nil {
-			gw := r.Gw
-			fmt.Printf(routeVia6Fmt, dest, gw, name, proto, metric)
-		} else {
-			fmt.Printf(route6Fmt, dest, name, proto, metric)
+func showNetns(w io.Writer, names []string) error {
+	if *jsonOut {
+		infos := []netnsInfo{}
+		for _, n := range names {
+			infos = append(infos, netnsInfo{Name: n})
 		}
+		return printJSON(w, infos)
 	}
+	for _, n := range names {
+		if _, err := fmt.Fprintln(w, n); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,208 @@
+// Copyright 2012-2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// routing table names, as in /etc/iproute2/rt_tables.
+var rtTables = map[int]string{
+	unix.RT_TABLE_DEFAULT: "default",
+	unix.RT_TABLE_MAIN:    "main",
+	unix.RT_TABLE_LOCAL:   "local",
+}
+
+func tableName(t int) string {
+	if name, ok := rtTables[t]; ok {
+		return name
+	}
+	return strconv.Itoa(t)
+}
+
+// table parses the next arg as a routing table. all is table 0.
+func table() (int, error) {
+	cursor++
+	whatIWant = []string{"main", "local", "default", "all", "table number"}
+	if arg[cursor] == "all" {
+		return unix.RT_TABLE_UNSPEC, nil
+	}
+	for t, name := range rtTables {
+		if arg[cursor] == name {
+			return t, nil
+		}
+	}
+	cursor--
+	return integer("table number")
+}
+
+// proto parses the next arg as a routing protocol.
+func proto() (int, error) {
+	cursor++
+	whatIWant = []string{"protocol number"}
+	for p, name := range rtProto {
+		whatIWant = append(whatIWant, name)
+		if arg[cursor] == name {
+			return p, nil
+		}
+	}
+	cursor--
+	return integer("protocol number")
+}
+
+// scope parses the next arg as a route scope.
+func scope() (netlink.Scope, error) {
+	cursor++
+	whatIWant = nil
+	for s, name := range addrScopes {
+		whatIWant = append(whatIWant, name)
+		if arg[cursor] == name {
+			return s, nil
+		}
+	}
+	return 0, usage()
+}
+
+func routeshow(w io.Writer) error {
+	filter := &netlink.Route{Table: unix.RT_TABLE_MAIN}
+	mask := netlink.RT_FILTER_TABLE
+	for more() {
+		cursor++
+		whatIWant = []string{"table", "dev", "proto"}
+		switch arg[cursor] {
+		case "table":
+			t, err := table()
+			if err != nil {
+				return err
+			}
+			filter.Table = t
+		case "dev":
+			index, err := linkIndex()
+			if err != nil {
+				return err
+			}
+			filter.LinkIndex = index
+			mask |= netlink.RT_FILTER_OIF
+		case "proto":
+			p, err := proto()
+			if err != nil {
+				return err
+			}
+			filter.Protocol = p
+			mask |= netlink.RT_FILTER_PROTOCOL
+		default:
+			return usage()
+		}
+	}
+	return showRoutes(w, family(netlink.FAMILY_V4), filter, mask)
+}
+
+// parseRoute parses the route of route add, delete or replace.
+func parseRoute(cmd string) (*netlink.Route, error) {
+	r := &netlink.Route{}
+	cursor++
+	whatIWant = []string{"default", "CIDR"}
+	if arg[cursor] == "default" {
+		if family(netlink.FAMILY_V4) == netlink.FAMILY_V6 {
+			r.Dst = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)}
+		}
+	} else {
+		cursor--
+		dst, err := prefix("CIDR")
+		if err != nil {
+			return nil, err
+		}
+		r.Dst = dst
+	}
+
+	for more() {
+		cursor++
+		whatIWant = []string{"via", "dev", "metric", "table", "src", "proto", "scope", "mtu"}
+		var err error
+		switch arg[cursor] {
+		case "via":
+			cursor++
+			whatIWant = []string{"gateway"}
+			// Gateways used to be given in CIDR format.
+			gw := strings.SplitN(arg[cursor], "/", 2)[0]
+			if r.Gw = net.ParseIP(gw); r.Gw == nil {
+				err = fmt.Errorf("invalid gateway %q", arg[cursor])
+			}
+		case "dev":
+			r.LinkIndex, err = linkIndex()
+		case "metric", "priority", "preference":
+			r.Priority, err = integer("metric")
+		case "table":
+			r.Table, err = table()
+		case "src":
+			r.Src, err = ipAddr("source address")
+		case "proto":
+			r.Protocol, err = proto()
+		case "scope":
+			r.Scope, err = scope()
+		case "mtu":
+			r.MTU, err = integer("MTU")
+		default:
+			return nil, usage()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The scope defaults as in iproute2.
+	switch {
+	case cmd == "delete":
+		if r.Scope == netlink.SCOPE_UNIVERSE {
+			// Any scope.
+			r.Scope = netlink.SCOPE_NOWHERE
+		}
+	case r.Gw == nil && r.LinkIndex == 0:
+		return nil, fmt.Errorf("route to %s needs a gateway or a device", routeDst(r))
+	case r.Gw == nil && r.Scope == netlink.SCOPE_UNIVERSE && (r.Dst == nil || r.Dst.IP.To4() != nil):
+		// Without gateway, the destination is on the link.
+		r.Scope = netlink.SCOPE_LINK
+	}
+	return r, nil
+}
+
+func route(w io.Writer) error {
+	cursor++
+	if len(arg[cursor:]) == 0 {
+		return routeshow(w)
+	}
+
+	whatIWant = []string{"show", "list", "add", "delete", "replace"}
+	cmd := one(arg[cursor], whatIWant)
+	switch cmd {
+	case "show", "list":
+		return routeshow(w)
+	case "add", "delete", "replace":
+		r, err := parseRoute(cmd)
+		if err != nil {
+			return err
+		}
+		switch cmd {
+		case "add":
+			err = netlink.RouteAdd(r)
+		case "delete":
+			err = netlink.RouteDel(r)
+		case "replace":
+			err = netlink.RouteReplace(r)
+		}
+		if err != nil {
+			return fmt.Errorf("%s route to %s: %v", cmd, routeDst(r), err)
+		}
+		return nil
+	}
+	return usage()
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// parseRule parses the rule of rule add or del.
+func parseRule(cmd string) (*netlink.Rule, error) {
+	r := netlink.NewRule()
+	r.Family = family(netlink.FAMILY_V4)
+	for more() {
+		cursor++
+		whatIWant = []string{"from", "to", "fwmark", "iif", "oif", "pref", "table"}
+		var err error
+		switch arg[cursor] {
+		case "from", "to":
+			which := arg[cursor]
+			if arg[cursor+1] == "all" {
+				cursor++
+				break
+			}
+			if which == "from" {
+				r.Src, err = prefix("source prefix")
+			} else {
+				r.Dst, err = prefix("destination prefix")
+			}
+		case "fwmark":
+			cursor++
+			whatIWant = []string{"MARK[/MASK]"}
+			f := strings.SplitN(arg[cursor], "/", 2)
+			var mark, mask uint64
+			if mark, err = strconv.ParseUint(f[0], 0, 32); err == nil && len(f) == 2 {
+				mask, err = strconv.ParseUint(f[1], 0, 32)
+				r.Mask = int(mask)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid fwmark %q", arg[cursor])
+			}
+			r.Mark = int(mark)
+		case "iif", "dev":
+			cursor++
+			whatIWant = []string{"device name"}
+			r.IifName = arg[cursor]
+		case "oif":
+			cursor++
+			whatIWant = []string{"device name"}
+			r.OifName = arg[cursor]
+		case "pref", "priority", "order":
+			r.Priority, err = integer("preference")
+		case "table", "lookup":
+			r.Table, err = table()
+		default:
+			return nil, usage()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.Src != nil && r.Src.IP.To4() == nil || r.Dst != nil && r.Dst.IP.To4() == nil {
+		r.Family = netlink.FAMILY_V6
+	}
+	if cmd == "add" && r.Table == unix.RT_TABLE_UNSPEC {
+		r.Table = unix.RT_TABLE_MAIN
+	}
+	return r, nil
+}
+
+func rule(w io.Writer) error {
+	cursor++
+	if len(arg[cursor:]) == 0 {
+		return showRules(w, family(netlink.FAMILY_V4))
+	}
+
+	whatIWant = []string{"show", "list", "add", "delete"}
+	cmd := one(arg[cursor], whatIWant)
+	switch cmd {
+	case "show", "list":
+		return showRules(w, family(netlink.FAMILY_V4))
+	case "add", "delete":
+		r, err := parseRule(cmd)
+		if err != nil {
+			return err
+		}
+		if cmd == "add" {
+			err = netlink.RuleAdd(r)
+		} else {
+			err = netlink.RuleDel(r)
+		}
+		if err != nil {
+			return fmt.Errorf("%s rule: %v", cmd, err)
+		}
+		return nil
+	}
+	return usage()
+}
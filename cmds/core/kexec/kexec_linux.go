@@ -16,6 +16,7 @@
 //     --i=FILE or --initrd=FILE:     Use file as the kernel's initial ramdisk
 //     -l or --load:                  Load the new kernel into the current kernel
 //     -e or --exec:                  Execute a currently loaded kernel
+//     --kexec-load-fallback:         Use kexec_load if kexec_file_load cannot load the kernel
 package main
 
 import (
@@ -39,6 +40,7 @@ type options struct {
 	load         bool
 	exec         bool
 	debug        bool
+	fallback     bool
 	modules      []string
 }
 
@@ -52,6 +54,7 @@ func registerFlags() *options {
 	flag.BoolVarP(&o.load, "load", "l", false, "Load the new kernel into the current kernel")
 	flag.BoolVarP(&o.exec, "exec", "e", false, "Execute a currently loaded kernel")
 	flag.BoolVarP(&o.debug, "debug", "d", false, "Print debug info")
+	flag.BoolVar(&o.fallback, "kexec-load-fallback", false, "Load with kexec_load if the running kernel cannot kexec_file_load the kernel. kexec_load does not check kernel signatures")
 	flag.StringArrayVar(&o.modules, "module", nil, `Load multiboot module with command line args (e.g --module="mod arg1")`)
 	return o
 }
@@ -108,6 +111,8 @@ func main() {
 				Kernel:  uio.NewLazyFile(kernelpath),
 				Initrd:  i,
 				Cmdline: newCmdline,
+
+				KexecLoadFallback: opts.fallback,
 			}
 		}
 		if err := image.Load(opts.debug); err != nil {
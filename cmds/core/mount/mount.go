@@ -11,9 +11,13 @@
 //
 // Options:
 //     -r: read only
+//
+// With -t nfs, DEV is SERVER:/EXPORT. The address of the server is resolved
+// and passed to the kernel, as mount.nfs would.
 package main
 
 import (
+	"context"
 	"flag"
 	"io/ioutil"
 	"log"
@@ -22,6 +26,7 @@ import (
 
 	"github.com/u-root/u-root/pkg/mount"
 	"github.com/u-root/u-root/pkg/mount/loop"
+	"github.com/u-root/u-root/pkg/nfs"
 	"golang.org/x/sys/unix"
 )
 
@@ -125,7 +130,18 @@ func main() {
 	if *ro {
 		flags |= unix.MS_RDONLY
 	}
-	if *fsType == "" {
+	if *fsType == "nfs" {
+		rp, err := nfs.ParseRootPath(dev, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if rp.Options != "" {
+			data = append(data, rp.Options)
+		}
+		if _, err := nfs.Mount(context.Background(), rp.Server, rp.Export, path, strings.Join(data, ","), flags); err != nil {
+			log.Fatal(err)
+		}
+	} else if *fsType == "" {
 		if _, err := mount.TryMount(dev, path, strings.Join(data, ","), flags); err != nil {
 			log.Fatalf("%v", err)
 		}
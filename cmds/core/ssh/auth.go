@@ -0,0 +1,140 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/termios"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// defaultIdentities are the identity files in ~/.ssh used without -i.
+var defaultIdentities = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// loadIdentities reads the private keys in files, asking for the passphrase
+// of encrypted ones. A certificate in FILE-cert.pub goes with the key in
+// FILE. Files that do not exist are skipped, unless they are required.
+func loadIdentities(files []string, required bool) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if os.IsNotExist(err) && !required {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s, err := ssh.ParsePrivateKey(b)
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			p, perr := readPassword(fmt.Sprintf("Enter passphrase for key '%s': ", f))
+			if perr != nil {
+				return nil, perr
+			}
+			s, err = ssh.ParsePrivateKeyWithPassphrase(b, []byte(p))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		if b, err := ioutil.ReadFile(f + "-cert.pub"); err == nil {
+			k, _, _, _, err := ssh.ParseAuthorizedKey(b)
+			if err != nil {
+				return nil, fmt.Errorf("%s-cert.pub: %v", f, err)
+			}
+			cert, ok := k.(*ssh.Certificate)
+			if !ok {
+				return nil, fmt.Errorf("%s-cert.pub: not a certificate", f)
+			}
+			cs, err := ssh.NewCertSigner(cert, s)
+			if err != nil {
+				return nil, fmt.Errorf("%s-cert.pub: %v", f, err)
+			}
+			signers = append(signers, cs)
+		}
+		signers = append(signers, s)
+	}
+	return signers, nil
+}
+
+// readLine prompts for a line on the terminal, without echo unless echo.
+func readLine(prompt string, echo bool) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("can't prompt without a terminal: %v", err)
+	}
+	defer tty.Close()
+	if !echo {
+		t, err := termios.GetTermios(tty.Fd())
+		if err != nil {
+			return "", err
+		}
+		noecho := *t.Termios
+		noecho.Lflag &^= unix.ECHO
+		if err := termios.SetTermios(tty.Fd(), &termios.Termios{Termios: &noecho}); err != nil {
+			return "", err
+		}
+		defer termios.SetTermios(tty.Fd(), t)
+		defer fmt.Fprintln(tty)
+	}
+	fmt.Fprint(tty, prompt)
+	l, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(l, "\r\n"), nil
+}
+
+func readPassword(prompt string) (string, error) {
+	return readLine(prompt, false)
+}
+
+// askTTY asks a yes or no question on the terminal.
+func askTTY(question string) (bool, error) {
+	for {
+		a, err := readLine(question, true)
+		if err != nil {
+			return false, err
+		}
+		switch a {
+		case "yes":
+			return true, nil
+		case "no":
+			return false, nil
+		}
+		question = "Please type 'yes' or 'no': "
+	}
+}
+
+// authMethods returns the ways user can authenticate to host: keys,
+// then the keyboard-interactive and password prompts.
+func authMethods(signers []ssh.Signer, user, host string) []ssh.AuthMethod {
+	var m []ssh.AuthMethod
+	if len(signers) > 0 {
+		m = append(m, ssh.PublicKeys(signers...))
+	}
+	return append(m,
+		ssh.RetryableAuthMethod(ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			if name != "" || instruction != "" {
+				fmt.Fprintln(os.Stderr, strings.TrimSpace(name+"\n"+instruction))
+			}
+			answers := make([]string, len(questions))
+			for i, q := range questions {
+				var err error
+				if answers[i], err = readLine(q, echos[i]); err != nil {
+					return nil, err
+				}
+			}
+			return answers, nil
+		}), 3),
+		ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+			return readPassword(fmt.Sprintf("%s@%s's password: ", user, host))
+		}), 3),
+	)
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// forward is a port forward of -L or -R, from bind:port to host:hostPort.
+type forward struct {
+	bind     string
+	port     int
+	host     string
+	hostPort int
+}
+
+func (f forward) listenAddr() string {
+	return net.JoinHostPort(f.bind, strconv.Itoa(f.port))
+}
+
+func (f forward) dialAddr() string {
+	return net.JoinHostPort(f.host, strconv.Itoa(f.hostPort))
+}
+
+// splitColons splits s at the colons which are not in brackets, and takes
+// the brackets off.
+func splitColons(s string) []string {
+	var f []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				f = append(f, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	f = append(f, s[start:])
+	for i := range f {
+		f[i] = strings.TrimSuffix(strings.TrimPrefix(f[i], "["), "]")
+	}
+	return f
+}
+
+// parseForward parses [BIND:]PORT:HOST:HOSTPORT. Without BIND, the forward
+// binds to localhost, and a BIND of * or "" binds to all addresses.
+func parseForward(s string) (forward, error) {
+	f := forward{bind: "localhost"}
+	fields := splitColons(s)
+	switch len(fields) {
+	case 3:
+	case 4:
+		f.bind = fields[0]
+		if f.bind == "*" {
+			f.bind = ""
+		}
+		fields = fields[1:]
+	default:
+		return f, fmt.Errorf("bad forwarding specification %q", s)
+	}
+	var err error
+	if f.port, err = strconv.Atoi(fields[0]); err != nil || f.port < 0 || f.port > 65535 {
+		return f, fmt.Errorf("bad port in forwarding specification %q", s)
+	}
+	f.host = fields[1]
+	if f.hostPort, err = strconv.Atoi(fields[2]); err != nil || f.hostPort <= 0 || f.hostPort > 65535 {
+		return f, fmt.Errorf("bad host port in forwarding specification %q", s)
+	}
+	return f, nil
+}
+
+// relay copies between a and b until both directions are done.
+func relay(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(a, b)
+		if cw, ok := a.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		close(done)
+	}()
+	io.Copy(b, a)
+	if cw, ok := b.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	<-done
+}
+
+// serveForward relays the connections to l to what dial returns.
+func serveForward(l net.Listener, dial func() (net.Conn, error)) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			d, err := dial()
+			if err != nil {
+				v("forwarding %s: %v", l.Addr(), err)
+				c.Close()
+				return
+			}
+			relay(c, d)
+		}()
+	}
+}
+
+// localForward forwards a port of this host through the remote host (-L).
+func localForward(client *ssh.Client, f forward) (net.Listener, error) {
+	l, err := net.Listen("tcp", f.listenAddr())
+	if err != nil {
+		return nil, err
+	}
+	go serveForward(l, func() (net.Conn, error) {
+		return client.Dial("tcp", f.dialAddr())
+	})
+	return l, nil
+}
+
+// remoteForward forwards a port of the remote host through this host (-R).
+func remoteForward(client *ssh.Client, f forward) (net.Listener, error) {
+	// The ssh package needs an address to ask for; * is all of them.
+	bind := f.bind
+	if bind == "" {
+		bind = "0.0.0.0"
+	}
+	l, err := client.Listen("tcp", net.JoinHostPort(bind, strconv.Itoa(f.port)))
+	if err != nil {
+		return nil, err
+	}
+	go serveForward(l, func() (net.Conn, error) {
+		return net.Dial("tcp", f.dialAddr())
+	})
+	return l, nil
+}
@@ -0,0 +1,300 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// knownHost is an entry of a known_hosts file.
+type knownHost struct {
+	// marker is "", "cert-authority" or "revoked".
+	marker   string
+	patterns []string
+	key      ssh.PublicKey
+	file     string
+	line     int
+}
+
+// knownHosts checks host keys against known_hosts files, as OpenSSH does.
+type knownHosts struct {
+	// files are the known_hosts files. New keys are added to the
+	// first.
+	files []string
+	hosts []knownHost
+	// strict is the StrictHostKeyChecking of OpenSSH: for unknown
+	// hosts, "yes" fails, "accept-new" and "no" add their key, and
+	// "ask" asks whether to.
+	strict string
+	ask    func(question string) (bool, error)
+}
+
+// readKnownHosts reads the known_hosts files. Files that do not exist are
+// empty, and bad lines are skipped.
+func readKnownHosts(files []string) (*knownHosts, error) {
+	k := &knownHosts{files: files, strict: "ask"}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i, l := range bytes.Split(b, []byte("\n")) {
+			marker, hosts, key, _, _, err := ssh.ParseKnownHosts(l)
+			if err != nil {
+				if len(bytes.TrimSpace(l)) > 0 && l[0] != '#' {
+					log.Printf("%s:%d: %v", f, i+1, err)
+				}
+				continue
+			}
+			k.hosts = append(k.hosts, knownHost{marker: marker, patterns: hosts, key: key, file: f, line: i + 1})
+		}
+	}
+	return k, nil
+}
+
+// knownHostName returns the name of host in known_hosts, which has the port
+// unless it is 22.
+func knownHostName(host string, port int) string {
+	if port == 22 {
+		return host
+	}
+	return "[" + host + "]:" + strconv.Itoa(port)
+}
+
+// wildcard matches s against a pattern with * and ?.
+func wildcard(p, s string) bool {
+	for len(p) > 0 {
+		switch p[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcard(p[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || p[0] != s[0] {
+				return false
+			}
+		}
+		p, s = p[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// matchPattern matches name against a pattern, which is hashed if it
+// starts with |1|.
+func matchPattern(pattern, name string) bool {
+	if !strings.HasPrefix(pattern, "|1|") {
+		return wildcard(strings.ToLower(pattern), strings.ToLower(name))
+	}
+	f := strings.Split(pattern[3:], "|")
+	if len(f) != 2 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(f[0])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(f[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// matches reports whether any of names matches the patterns of h, and none
+// of them matches a negated pattern.
+func (h *knownHost) matches(names []string) bool {
+	match := false
+	for _, p := range h.patterns {
+		neg := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		for _, n := range names {
+			if matchPattern(p, n) {
+				if neg {
+					return false
+				}
+				match = true
+			}
+		}
+	}
+	return match
+}
+
+func sameKey(a, b ssh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
+
+// names returns the names of host and its address remote in known_hosts.
+func names(host string, port int, remote net.Addr) []string {
+	n := []string{knownHostName(host, port)}
+	if a, ok := remote.(*net.TCPAddr); ok && a.IP.String() != host {
+		n = append(n, knownHostName(a.IP.String(), port))
+	}
+	return n
+}
+
+// certAlgos are the algorithms of host certificates, and plainAlgos those of
+// host keys, in the order of preference of the ssh package.
+var (
+	certAlgos = []string{
+		ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+		ssh.CertAlgoED25519v01, ssh.CertAlgoRSAv01,
+	}
+	plainAlgos = []string{
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoED25519, ssh.KeyAlgoRSA,
+	}
+)
+
+// algorithms returns the host key algorithms to ask host for: those of its
+// known keys first, and certificates only if an authority is known for it.
+func (k *knownHosts) algorithms(host string, port int) []string {
+	n := []string{knownHostName(host, port)}
+	var known, rest []string
+	ca := false
+	for _, h := range k.hosts {
+		if !h.matches(n) {
+			continue
+		}
+		switch h.marker {
+		case "cert-authority":
+			ca = true
+		case "":
+			known = append(known, h.key.Type())
+		}
+	}
+	if ca {
+		known = append(append([]string{}, certAlgos...), known...)
+	}
+	for _, a := range plainAlgos {
+		dup := false
+		for _, b := range known {
+			dup = dup || a == b
+		}
+		if !dup {
+			rest = append(rest, a)
+		}
+	}
+	return append(known, rest...)
+}
+
+// callback returns the HostKeyCallback for host and port.
+func (k *knownHosts) callback(host string, port int) ssh.HostKeyCallback {
+	return func(addr string, remote net.Addr, key ssh.PublicKey) error {
+		return k.check(host, port, remote, key)
+	}
+}
+
+func (k *knownHosts) check(host string, port int, remote net.Addr, key ssh.PublicKey) error {
+	n := names(host, port, remote)
+	plain := key
+	cert, isCert := key.(*ssh.Certificate)
+	if isCert {
+		plain = cert.Key
+	}
+	for _, h := range k.hosts {
+		if h.marker != "revoked" || !h.matches(n) {
+			continue
+		}
+		if sameKey(h.key, plain) || isCert && sameKey(h.key, cert.SignatureKey) {
+			return fmt.Errorf("%s host key for %s is revoked in %s:%d", key.Type(), n[0], h.file, h.line)
+		}
+	}
+
+	if isCert {
+		checker := &ssh.CertChecker{
+			IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+				for _, h := range k.hosts {
+					if h.marker == "cert-authority" && h.matches(n) && sameKey(h.key, auth) {
+						return true
+					}
+				}
+				return false
+			},
+		}
+		return checker.CheckHostKey(net.JoinHostPort(host, strconv.Itoa(port)), remote, key)
+	}
+
+	var changed *knownHost
+	for i, h := range k.hosts {
+		if h.marker != "" || h.key.Type() != key.Type() || !h.matches(n) {
+			continue
+		}
+		if sameKey(h.key, key) {
+			return nil
+		}
+		changed = &k.hosts[i]
+	}
+	if changed != nil {
+		return fmt.Errorf("REMOTE HOST IDENTIFICATION HAS CHANGED: the %s host key for %s is %s, not the one in %s:%d",
+			key.Type(), n[0], ssh.FingerprintSHA256(key), changed.file, changed.line)
+	}
+
+	switch k.strict {
+	case "yes":
+		return fmt.Errorf("no %s host key is known for %s", key.Type(), n[0])
+	case "accept-new", "no":
+	default:
+		ok, err := k.ask(fmt.Sprintf("The authenticity of host '%s' can't be established.\n%s key fingerprint is %s.\nAre you sure you want to continue connecting (yes/no)? ",
+			n[0], key.Type(), ssh.FingerprintSHA256(key)))
+		if err != nil {
+			return fmt.Errorf("%s host key for %s is unknown: %v", key.Type(), n[0], err)
+		}
+		if !ok {
+			return fmt.Errorf("host key verification failed")
+		}
+	}
+	return k.add(n[0], key)
+}
+
+// add adds the key of host to the first known_hosts file.
+func (k *knownHosts) add(host string, key ssh.PublicKey) error {
+	h := knownHost{patterns: []string{host}, key: key}
+	if len(k.files) > 0 {
+		f := k.files[0]
+		if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+			return err
+		}
+		w, err := os.OpenFile(f, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s %s", host, ssh.MarshalAuthorizedKey(key))
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		h.file = f
+		log.Printf("Warning: Permanently added '%s' (%s) to the list of known hosts.", host, key.Type())
+	}
+	k.hosts = append(k.hosts, h)
+	return nil
+}
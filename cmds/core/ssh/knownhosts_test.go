@@ -0,0 +1,220 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T, kind string) ssh.Signer {
+	t.Helper()
+	var key interface{}
+	var err error
+	switch kind {
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func hashed(name string) string {
+	salt := make([]byte, 20)
+	rand.Read(salt)
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestMatchPattern(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"host", "host", true},
+		{"host", "HOST", true},
+		{"host", "host2", false},
+		{"*.example.com", "a.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"10.0.0.?", "10.0.0.1", true},
+		{"10.0.0.?", "10.0.0.10", false},
+		{"[host]:2222", "[host]:2222", true},
+		{"[host]:*", "[host]:2222", true},
+		{hashed("host"), "host", true},
+		{hashed("host"), "other", false},
+		{"|1|bad", "host", false},
+	} {
+		if got := matchPattern(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchPattern(%q, %q): got %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+
+	h := &knownHost{patterns: []string{"*.example.com", "!bad.example.com"}}
+	if !h.matches([]string{"good.example.com"}) || h.matches([]string{"bad.example.com"}) || h.matches([]string{"other.org", "bad.example.com"}) {
+		t.Errorf("negated patterns: got wrong matches")
+	}
+}
+
+func line(patterns string, key ssh.PublicKey) string {
+	return patterns + " " + string(ssh.MarshalAuthorizedKey(key))
+}
+
+func hostCert(t *testing.T, ca ssh.Signer, principal string) ssh.PublicKey {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             newSigner(t, "ed25519").PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{principal},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCheck(t *testing.T) {
+	d, err := ioutil.TempDir("", "knownhosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	known, port, hashedKey, changed, revoked := newSigner(t, "ed25519").PublicKey(), newSigner(t, "ed25519").PublicKey(), newSigner(t, "ecdsa").PublicKey(), newSigner(t, "ed25519").PublicKey(), newSigner(t, "ed25519").PublicKey()
+	ca := newSigner(t, "ed25519")
+	other := newSigner(t, "ed25519").PublicKey()
+	f := filepath.Join(d, "known_hosts")
+	content := strings.Join([]string{
+		"# comment",
+		line("known,10.0.0.1", known),
+		line("[known]:2222", port),
+		line(hashed("hashed"), hashedKey),
+		line("changed", changed),
+		"garbage line",
+		line("@revoked *", revoked),
+		line("@cert-authority *.example.com", ca.PublicKey()),
+	}, "\n")
+	if err := ioutil.WriteFile(f, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 22}
+
+	for _, tt := range []struct {
+		name   string
+		host   string
+		port   int
+		key    ssh.PublicKey
+		strict string
+		answer bool
+		err    string
+		added  bool
+	}{
+		{name: "known", host: "known", port: 22, key: known},
+		{name: "known address", host: "alias", port: 22, key: known},
+		{name: "port", host: "known", port: 2222, key: port},
+		{name: "other port", host: "known", port: 2223, key: port, strict: "yes", err: "no ssh-ed25519 host key"},
+		{name: "hashed", host: "hashed", port: 22, key: hashedKey},
+		{name: "changed", host: "changed", port: 22, key: other, err: "CHANGED"},
+		{name: "revoked", host: "new", port: 22, key: revoked, err: "revoked"},
+		{name: "certificate", host: "host.example.com", port: 22, key: hostCert(t, ca, "host.example.com")},
+		{name: "certificate for another host", host: "host.example.com", port: 22, key: hostCert(t, ca, "other.example.com"), err: "principal"},
+		{name: "certificate of another CA", host: "host.example.com", port: 22, key: hostCert(t, newSigner(t, "ed25519"), "host.example.com"), err: "no authorities"},
+		{name: "unknown strict", host: "new", port: 22, key: other, strict: "yes", err: "no ssh-ed25519 host key"},
+		{name: "unknown accept-new", host: "new", port: 22, key: other, strict: "accept-new", added: true},
+		{name: "unknown ask yes", host: "new2", port: 2222, key: other, answer: true, added: true},
+		{name: "unknown ask no", host: "new3", port: 22, key: other, err: "verification failed"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			before, err := ioutil.ReadFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			k, err := readKnownHosts([]string{f})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.strict != "" {
+				k.strict = tt.strict
+			}
+			k.ask = func(string) (bool, error) {
+				return tt.answer, nil
+			}
+			remote := net.Addr(addr)
+			if tt.name == "known address" {
+				remote = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+			}
+			err = k.callback(tt.host, tt.port)(tt.host, remote, tt.key)
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("check: got %v, want error containing %q", err, tt.err)
+			}
+			after, err := ioutil.ReadFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := string(before)
+			if tt.added {
+				want += line(knownHostName(tt.host, tt.port), tt.key)
+			}
+			if string(after) != want {
+				t.Errorf("%s: got %q, want %q", f, after, want)
+			}
+		})
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	ed, ec, ca := newSigner(t, "ed25519").PublicKey(), newSigner(t, "ecdsa").PublicKey(), newSigner(t, "ed25519").PublicKey()
+	k := &knownHosts{hosts: []knownHost{
+		{patterns: []string{"ed"}, key: ed},
+		{patterns: []string{"[ec]:2222"}, key: ec},
+		{marker: "cert-authority", patterns: []string{"*.example.com"}, key: ca},
+	}}
+	for _, tt := range []struct {
+		host string
+		port int
+		want []string
+	}{
+		{"new", 22, plainAlgos},
+		{"ed", 22, []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521, ssh.KeyAlgoRSA}},
+		{"ec", 2222, plainAlgos},
+		{"a.example.com", 22, append(append([]string{}, certAlgos...), plainAlgos...)},
+	} {
+		if got := k.algorithms(tt.host, tt.port); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("algorithms(%s, %d): got %q, want %q", tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+func ExampleknownHostName() {
+	fmt.Println(knownHostName("host", 22))
+	fmt.Println(knownHostName("::1", 2222))
+	// Output:
+	// host
+	// [::1]:2222
+}
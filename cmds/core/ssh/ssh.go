@@ -0,0 +1,503 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Ssh logs in to a remote host and runs commands there.
+//
+// Synopsis:
+//     ssh [OPTIONS] [USER@]HOST [COMMAND [ARGS...]]
+//
+// Description:
+//     ssh runs COMMAND on HOST, or a shell if there is none, and exits with
+//     its exit status. If ssh itself fails, it exits with 255.
+//
+//     Host keys are checked against ~/.ssh/known_hosts and
+//     /etc/ssh/ssh_known_hosts, which may have hashed names and
+//     @cert-authority and @revoked entries. Users authenticate with their
+//     identity files, then with passwords.
+//
+//     HOST may also be ssh://[USER@]HOST[:PORT].
+//
+// Options:
+//     -p: port to connect to
+//     -l: user to log in as
+//     -i: identity file, may be repeated (default ~/.ssh/id_ed25519,
+//         ~/.ssh/id_ecdsa and ~/.ssh/id_rsa)
+//     -L: [BIND:]PORT:HOST:HOSTPORT, forward PORT of this host to
+//         HOST:HOSTPORT from the remote host, may be repeated
+//     -R: [BIND:]PORT:HOST:HOSTPORT, forward PORT of the remote host to
+//         HOST:HOSTPORT from this host, may be repeated
+//     -J: connect through the jump hosts [USER@]HOST[:PORT],...
+//     -N: run no command, only forward ports
+//     -t: force a pty
+//     -T: do not allocate a pty
+//     -o: OPTION=VALUE, where OPTION is StrictHostKeyChecking
+//         (yes, accept-new, no or ask), UserKnownHostsFile or ConnectTimeout
+//     -v: verbose
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/u-root/u-root/pkg/termios"
+	"golang.org/x/crypto/ssh"
+)
+
+// list is a flag that may be repeated.
+type list []string
+
+func (l *list) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *list) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+var (
+	port       = flag.Int("p", 22, "Port to connect to")
+	login      = flag.String("l", "", "User to log in as")
+	jump       = flag.String("J", "", "Jump hosts, [USER@]HOST[:PORT],...")
+	noCommand  = flag.Bool("N", false, "Run no command, only forward ports")
+	forceTTY   = flag.Bool("t", false, "Force a pty")
+	noTTY      = flag.Bool("T", false, "Do not allocate a pty")
+	verbose    = flag.Bool("v", false, "Verbose")
+	identities list
+	locals     list
+	remotes    list
+	sshOptions list
+	v          = func(string, ...interface{}) {}
+)
+
+func init() {
+	flag.Var(&identities, "i", "Identity file, may be repeated")
+	flag.Var(&locals, "L", "[BIND:]PORT:HOST:HOSTPORT, forward a local port, may be repeated")
+	flag.Var(&remotes, "R", "[BIND:]PORT:HOST:HOSTPORT, forward a remote port, may be repeated")
+	flag.Var(&sshOptions, "o", "OPTION=VALUE, may be repeated")
+}
+
+// ttyMode is whether to allocate a pty.
+type ttyMode int
+
+const (
+	// ttyAuto allocates a pty for shells on terminals.
+	ttyAuto ttyMode = iota
+	ttyForce
+	ttyNo
+)
+
+// host is a host to connect to.
+type host struct {
+	user string
+	name string
+	port int
+}
+
+func (h host) addr() string {
+	return net.JoinHostPort(h.name, strconv.Itoa(h.port))
+}
+
+// parseHost parses [USER@]HOST[:PORT], where a HOST with colons, an IPv6
+// address, needs brackets to have a PORT. Missing parts are 0 or "".
+func parseHost(s string) (host, error) {
+	var h host
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		h.user, s = s[:i], s[i+1:]
+	}
+	h.name = s
+	if strings.HasPrefix(s, "[") || strings.Count(s, ":") == 1 {
+		name, port, err := net.SplitHostPort(s)
+		if err != nil {
+			return h, err
+		}
+		if h.port, err = strconv.Atoi(port); err != nil || h.port <= 0 || h.port > 65535 {
+			return h, fmt.Errorf("bad port in %q", s)
+		}
+		h.name = name
+	}
+	if h.name == "" {
+		return h, fmt.Errorf("no host in %q", s)
+	}
+	return h, nil
+}
+
+// config is how to connect and what to do once connected.
+type config struct {
+	// user is the user on the host, and jumpUser the one on the
+	// jump hosts, without USER@.
+	user       string
+	jumpUser   string
+	port       int
+	jump       []host
+	signers    []ssh.Signer
+	known      *knownHosts
+	timeout    time.Duration
+	local      []forward
+	remote     []forward
+	noCommand  bool
+	tty        ttyMode
+	stdin      io.Reader
+	stdout     io.Writer
+	stderr     io.Writer
+	authMethod func(signers []ssh.Signer, user, host string) []ssh.AuthMethod
+}
+
+// dial connects to h, through the jump hosts. It returns the clients of all
+// the hosts, the one of h last.
+func (c *config) dial(h host) ([]*ssh.Client, error) {
+	if h.user == "" {
+		h.user = c.user
+	}
+	var clients []*ssh.Client
+	for _, hop := range append(append([]host{}, c.jump...), h) {
+		if hop.user == "" {
+			hop.user = c.jumpUser
+		}
+		if hop.port == 0 {
+			hop.port = 22
+		}
+		v("Connecting to %s as %s", hop.addr(), hop.user)
+		config := &ssh.ClientConfig{
+			User:              hop.user,
+			Auth:              c.authMethod(c.signers, hop.user, hop.name),
+			HostKeyCallback:   c.known.callback(hop.name, hop.port),
+			HostKeyAlgorithms: c.known.algorithms(hop.name, hop.port),
+			Timeout:           c.timeout,
+		}
+		var conn net.Conn
+		var err error
+		if len(clients) == 0 {
+			conn, err = net.DialTimeout("tcp", hop.addr(), c.timeout)
+		} else {
+			conn, err = clients[len(clients)-1].Dial("tcp", hop.addr())
+		}
+		if err == nil {
+			var sc ssh.Conn
+			var chans <-chan ssh.NewChannel
+			var reqs <-chan *ssh.Request
+			if sc, chans, reqs, err = ssh.NewClientConn(conn, hop.addr(), config); err == nil {
+				clients = append(clients, ssh.NewClient(sc, chans, reqs))
+				continue
+			}
+			conn.Close()
+		}
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+		return nil, fmt.Errorf("%s: %v", hop.addr(), err)
+	}
+	return clients, nil
+}
+
+// run connects to h and runs cmd there, or a shell if cmd is empty. It
+// returns the exit status of the command.
+func (c *config) run(h host, cmd string) (int, error) {
+	if h.port == 0 {
+		h.port = c.port
+	}
+	clients, err := c.dial(h)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+	}()
+	client := clients[len(clients)-1]
+
+	for _, f := range c.local {
+		l, err := localForward(client, f)
+		if err != nil {
+			return 0, fmt.Errorf("forwarding %s: %v", f.listenAddr(), err)
+		}
+		defer l.Close()
+		v("Forwarding %s to %s", l.Addr(), f.dialAddr())
+	}
+	for _, f := range c.remote {
+		l, err := remoteForward(client, f)
+		if err != nil {
+			return 0, fmt.Errorf("forwarding remote %s: %v", f.listenAddr(), err)
+		}
+		defer l.Close()
+		v("Forwarding remote %s to %s", l.Addr(), f.dialAddr())
+	}
+	if c.noCommand {
+		return 0, client.Wait()
+	}
+	return c.session(client, cmd)
+}
+
+// exitStatus returns the exit status of a session which ended with err.
+func exitStatus(err error) (int, error) {
+	switch e := err.(type) {
+	case nil:
+		return 0, nil
+	case *ssh.ExitError:
+		return e.ExitStatus(), nil
+	default:
+		return 0, err
+	}
+}
+
+func (c *config) session(client *ssh.Client, cmd string) (int, error) {
+	s, err := client.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	s.Stdout, s.Stderr = c.stdout, c.stderr
+
+	// The ssh package waits for Stdin to end, which a terminal does
+	// not, so stdin is copied here instead.
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		return 0, err
+	}
+	go func() {
+		io.Copy(stdin, c.stdin)
+		stdin.Close()
+	}()
+
+	if c.tty == ttyForce || c.tty == ttyAuto && cmd == "" && isTerminal(c.stdin) {
+		restore, err := c.pty(s)
+		if err != nil {
+			return 0, err
+		}
+		defer restore()
+	}
+
+	if cmd == "" {
+		err = s.Shell()
+	} else {
+		err = s.Start(cmd)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return exitStatus(s.Wait())
+}
+
+func isTerminal(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	_, err := termios.GetTermios(f.Fd())
+	return err == nil
+}
+
+// pty requests a pty for s. If there is a terminal, it is put in raw mode,
+// and changes to its size are sent along, until restore is called.
+func (c *config) pty(s *ssh.Session) (func(), error) {
+	term := os.Getenv("TERM")
+	if term == "" {
+		term = "vt100"
+	}
+	tty, err := termios.New()
+	if err != nil {
+		// There is no terminal, but a pty was asked for.
+		return func() {}, s.RequestPty(term, 24, 80, ssh.TerminalModes{})
+	}
+	ws, err := tty.GetWinSize()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.RequestPty(term, int(ws.Row), int(ws.Col), ssh.TerminalModes{}); err != nil {
+		return nil, err
+	}
+	restorer, err := tty.Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			if ws, err := tty.GetWinSize(); err == nil {
+				s.WindowChange(int(ws.Row), int(ws.Col))
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(winch)
+		close(winch)
+		tty.Set(restorer)
+	}, nil
+}
+
+// defaultUser returns the user to log in as without -l or USER@.
+func defaultUser() string {
+	if u := os.Getenv("USER"); u != "" {
+		return u
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "root"
+}
+
+func homeDir() string {
+	if h, err := os.UserHomeDir(); err == nil {
+		return h
+	}
+	return "/"
+}
+
+// newConfig returns the config of the flags.
+func newConfig() (*config, error) {
+	c := &config{
+		user:       *login,
+		port:       *port,
+		noCommand:  *noCommand,
+		stdin:      os.Stdin,
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+		authMethod: authMethods,
+	}
+	c.jumpUser = defaultUser()
+	if c.user == "" {
+		c.user = c.jumpUser
+	}
+	switch {
+	case *noTTY:
+		c.tty = ttyNo
+	case *forceTTY:
+		c.tty = ttyForce
+	}
+
+	home := homeDir()
+	knownHostsFiles := []string{filepath.Join(home, ".ssh", "known_hosts"), "/etc/ssh/ssh_known_hosts"}
+	strict := "ask"
+	for _, o := range sshOptions {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad option %q, want OPTION=VALUE", o)
+		}
+		switch strings.ToLower(kv[0]) {
+		case "stricthostkeychecking":
+			switch strings.ToLower(kv[1]) {
+			case "yes", "accept-new", "no", "ask":
+				strict = strings.ToLower(kv[1])
+			case "off":
+				strict = "no"
+			default:
+				return nil, fmt.Errorf("bad StrictHostKeyChecking %q", kv[1])
+			}
+		case "userknownhostsfile":
+			knownHostsFiles = append(strings.Fields(kv[1]), "/etc/ssh/ssh_known_hosts")
+		case "connecttimeout":
+			t, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("bad ConnectTimeout %q", kv[1])
+			}
+			c.timeout = time.Duration(t) * time.Second
+		default:
+			return nil, fmt.Errorf("unsupported option %q", kv[0])
+		}
+	}
+	var err error
+	if c.known, err = readKnownHosts(knownHostsFiles); err != nil {
+		return nil, err
+	}
+	c.known.strict, c.known.ask = strict, askTTY
+
+	if len(identities) > 0 {
+		c.signers, err = loadIdentities(identities, true)
+	} else {
+		var files []string
+		for _, f := range defaultIdentities {
+			files = append(files, filepath.Join(home, ".ssh", f))
+		}
+		c.signers, err = loadIdentities(files, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if *jump != "" {
+		for _, j := range strings.Split(*jump, ",") {
+			h, err := parseHost(j)
+			if err != nil {
+				return nil, fmt.Errorf("jump host: %v", err)
+			}
+			c.jump = append(c.jump, h)
+		}
+	}
+	for _, l := range locals {
+		f, err := parseForward(l)
+		if err != nil {
+			return nil, err
+		}
+		c.local = append(c.local, f)
+	}
+	for _, r := range remotes {
+		f, err := parseForward(r)
+		if err != nil {
+			return nil, err
+		}
+		c.remote = append(c.remote, f)
+	}
+	return c, nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: ssh [OPTIONS] [USER@]HOST [COMMAND [ARGS...]]\n")
+	flag.PrintDefaults()
+	os.Exit(255)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("ssh: ")
+	if *verbose {
+		v = log.Printf
+	}
+	if flag.NArg() < 1 {
+		usage()
+	}
+	c, err := newConfig()
+	if err != nil {
+		log.Print(err)
+		os.Exit(255)
+	}
+	dest := flag.Arg(0)
+	uri := strings.HasPrefix(dest, "ssh://")
+	var h host
+	if uri {
+		h, err = parseHost(strings.TrimPrefix(dest, "ssh://"))
+	} else {
+		// Without ssh://, HOST has no PORT, so that bare IPv6
+		// addresses work.
+		h.name = dest
+		if i := strings.LastIndex(dest, "@"); i >= 0 {
+			h.user, h.name = dest[:i], dest[i+1:]
+		}
+	}
+	if err != nil {
+		log.Print(err)
+		os.Exit(255)
+	}
+	status, err := c.run(h, strings.Join(flag.Args()[1:], " "))
+	if err != nil {
+		log.Print(err)
+		os.Exit(255)
+	}
+	os.Exit(status)
+}
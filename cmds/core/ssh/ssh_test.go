@@ -0,0 +1,427 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseHost(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want host
+		err  bool
+	}{
+		{in: "host", want: host{name: "host"}},
+		{in: "user@host", want: host{user: "user", name: "host"}},
+		{in: "user@host:2222", want: host{user: "user", name: "host", port: 2222}},
+		{in: "a@b@host", want: host{user: "a@b", name: "host"}},
+		{in: "[::1]:2222", want: host{name: "::1", port: 2222}},
+		{in: "::1", want: host{name: "::1"}},
+		{in: "host:port", err: true},
+		{in: "host:0", err: true},
+		{in: "user@", err: true},
+	} {
+		got, err := parseHost(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("parseHost(%q): got %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("parseHost(%q): got %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseForward(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want forward
+		err  bool
+	}{
+		{in: "8080:web:80", want: forward{bind: "localhost", port: 8080, host: "web", hostPort: 80}},
+		{in: "0.0.0.0:8080:web:80", want: forward{bind: "0.0.0.0", port: 8080, host: "web", hostPort: 80}},
+		{in: "*:8080:web:80", want: forward{bind: "", port: 8080, host: "web", hostPort: 80}},
+		{in: "[::1]:8080:[fe80::1]:80", want: forward{bind: "::1", port: 8080, host: "fe80::1", hostPort: 80}},
+		{in: "8080:[::1]:80", want: forward{bind: "localhost", port: 8080, host: "::1", hostPort: 80}},
+		{in: "0:web:80", want: forward{bind: "localhost", port: 0, host: "web", hostPort: 80}},
+		{in: "8080:web", err: true},
+		{in: "a:b:c:d:e", err: true},
+		{in: "x:web:80", err: true},
+		{in: "8080:web:0", err: true},
+		{in: "8080:web:65536", err: true},
+	} {
+		got, err := parseForward(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("parseForward(%q): got %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseForward(%q): got %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// testServer is an SSH server which runs commands with sh, and forwards
+// ports both ways. A pty request sets TERM and PTY, ROWSxCOLS, in the
+// environment of commands.
+type testServer struct {
+	l    net.Listener
+	host ssh.Signer
+	user ssh.Signer
+	port int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{host: newSigner(t, "ed25519"), user: newSigner(t, "ed25519")}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !sameKey(key, s.user.PublicKey()) {
+				return nil, fmt.Errorf("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(s.host)
+	var err error
+	if s.l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	s.port = s.l.Addr().(*net.TCPAddr).Port
+	go func() {
+		for {
+			c, err := s.l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c, config)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) close() {
+	s.l.Close()
+}
+
+func (s *testServer) serve(c net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	go func() {
+		for req := range reqs {
+			if req.Type != "tcpip-forward" {
+				req.Reply(false, nil)
+				continue
+			}
+			var r struct {
+				Addr string
+				Port uint32
+			}
+			ssh.Unmarshal(req.Payload, &r)
+			l, err := net.Listen("tcp", net.JoinHostPort(r.Addr, strconv.Itoa(int(r.Port))))
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			defer l.Close()
+			port := uint32(l.Addr().(*net.TCPAddr).Port)
+			req.Reply(true, ssh.Marshal(struct{ Port uint32 }{port}))
+			go func() {
+				for {
+					tc, err := l.Accept()
+					if err != nil {
+						return
+					}
+					ch, creqs, err := conn.OpenChannel("forwarded-tcpip", ssh.Marshal(struct {
+						Addr     string
+						Port     uint32
+						OrigAddr string
+						OrigPort uint32
+					}{r.Addr, port, "127.0.0.1", 1}))
+					if err != nil {
+						tc.Close()
+						continue
+					}
+					go ssh.DiscardRequests(creqs)
+					go relay(tc, channelConn{ch})
+				}
+			}()
+		}
+	}()
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			go session(nc)
+		case "direct-tcpip":
+			var r struct {
+				Host     string
+				Port     uint32
+				OrigHost string
+				OrigPort uint32
+			}
+			ssh.Unmarshal(nc.ExtraData(), &r)
+			tc, err := net.Dial("tcp", net.JoinHostPort(r.Host, strconv.Itoa(int(r.Port))))
+			if err != nil {
+				nc.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			ch, creqs, err := nc.Accept()
+			if err != nil {
+				tc.Close()
+				continue
+			}
+			go ssh.DiscardRequests(creqs)
+			go relay(tc, channelConn{ch})
+		default:
+			nc.Reject(ssh.UnknownChannelType, "")
+		}
+	}
+}
+
+// channelConn makes a channel enough of a net.Conn for relay.
+type channelConn struct {
+	ssh.Channel
+}
+
+func (channelConn) LocalAddr() net.Addr              { return nil }
+func (channelConn) RemoteAddr() net.Addr             { return nil }
+func (channelConn) SetDeadline(time.Time) error      { return nil }
+func (channelConn) SetReadDeadline(time.Time) error  { return nil }
+func (channelConn) SetWriteDeadline(time.Time) error { return nil }
+
+func session(nc ssh.NewChannel) {
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	var env []string
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req":
+			var r struct {
+				Term             string
+				Cols, Rows, W, H uint32
+				Modes            string
+			}
+			ssh.Unmarshal(req.Payload, &r)
+			env = append(env, "TERM="+r.Term, fmt.Sprintf("PTY=%dx%d", r.Rows, r.Cols))
+			req.Reply(true, nil)
+		case "exec":
+			var r struct{ Command string }
+			ssh.Unmarshal(req.Payload, &r)
+			req.Reply(true, nil)
+			c := exec.Command("sh", "-c", r.Command)
+			c.Env = env
+			stdin, _ := c.StdinPipe()
+			c.Stdout, c.Stderr = ch, ch.Stderr()
+			go func() {
+				io.Copy(stdin, ch)
+				stdin.Close()
+			}()
+			c.Run()
+			ws := c.ProcessState.Sys().(syscall.WaitStatus)
+			if ws.Signaled() {
+				ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+					Signal      string
+					Core        bool
+					Error, Lang string
+				}{Signal: "TERM"}))
+			} else {
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(ws.ExitStatus())}))
+			}
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// config returns a config for s, which knows its host key.
+func (s *testServer) config(t *testing.T, stdin string) (*config, *bytes.Buffer, *bytes.Buffer) {
+	var stdout, stderr bytes.Buffer
+	return &config{
+		user:       "root",
+		jumpUser:   "root",
+		port:       s.port,
+		signers:    []ssh.Signer{s.user},
+		known:      &knownHosts{strict: "yes", hosts: []knownHost{{patterns: []string{knownHostName("127.0.0.1", s.port)}, key: s.host.PublicKey()}}},
+		tty:        ttyNo,
+		stdin:      strings.NewReader(stdin),
+		stdout:     &stdout,
+		stderr:     &stderr,
+		authMethod: authMethods,
+	}, &stdout, &stderr
+}
+
+func TestRun(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	for _, tt := range []struct {
+		name           string
+		cmd            string
+		stdin          string
+		tty            ttyMode
+		jump           bool
+		stdout, stderr string
+		status         int
+	}{
+		{name: "ok", cmd: "echo hi", stdout: "hi\n"},
+		{name: "status", cmd: "echo err >&2; exit 3", stderr: "err\n", status: 3},
+		{name: "stdin", cmd: "cat", stdin: "in\n", stdout: "in\n"},
+		{name: "signal", cmd: "kill -TERM $$", status: 128 + 15},
+		{name: "pty", cmd: "echo $TERM $PTY", tty: ttyForce, stdout: os.Getenv("TERM") + " 24x80\n"},
+		{name: "jump", cmd: "echo jumped", jump: true, stdout: "jumped\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, stdout, stderr := s.config(t, tt.stdin)
+			c.tty = tt.tty
+			if tt.jump {
+				c.jump = []host{{name: "127.0.0.1", port: s.port}}
+			}
+			if tt.tty == ttyForce && os.Getenv("TERM") == "" {
+				tt.stdout = "vt100 24x80\n"
+			}
+			status, err := c.run(host{name: "127.0.0.1"}, tt.cmd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.status || stdout.String() != tt.stdout || stderr.String() != tt.stderr {
+				t.Errorf("run(%q): got %d, %q, %q, want %d, %q, %q", tt.cmd, status, stdout, stderr, tt.status, tt.stdout, tt.stderr)
+			}
+		})
+	}
+}
+
+func TestRunHostKey(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	d, err := ioutil.TempDir("", "ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	c, _, _ := s.config(t, "")
+	c.known.hosts[0].key = newSigner(t, "ed25519").PublicKey()
+	if _, err := c.run(host{name: "127.0.0.1"}, "true"); err == nil || !strings.Contains(err.Error(), "CHANGED") {
+		t.Errorf("changed host key: got %v, want an error", err)
+	}
+
+	f := filepath.Join(d, "known_hosts")
+	if c.known, err = readKnownHosts([]string{f}); err != nil {
+		t.Fatal(err)
+	}
+	c.known.strict = "yes"
+	if _, err := c.run(host{name: "127.0.0.1"}, "true"); err == nil {
+		t.Errorf("unknown host key: got nil, want error")
+	}
+	c.known.strict = "accept-new"
+	if _, err := c.run(host{name: "127.0.0.1"}, "true"); err != nil {
+		t.Errorf("accept-new: got %v, want nil", err)
+	}
+	if c.known, err = readKnownHosts([]string{f}); err != nil {
+		t.Fatal(err)
+	}
+	c.known.strict = "yes"
+	if _, err := c.run(host{name: "127.0.0.1"}, "true"); err != nil {
+		t.Errorf("added host key: got %v, want nil", err)
+	}
+
+	c.signers = []ssh.Signer{newSigner(t, "ed25519")}
+	if _, err := c.run(host{name: "127.0.0.1"}, "true"); err == nil {
+		t.Errorf("unknown user key: got nil, want error")
+	}
+}
+
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func echo(addr string) error {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		return err
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return err
+	}
+	if string(b) != "ping" {
+		return fmt.Errorf("got %q, want ping", b)
+	}
+	return nil
+}
+
+func TestForward(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	e := echoServer(t)
+	defer e.Close()
+	ep := e.Addr().(*net.TCPAddr).Port
+
+	c, _, _ := s.config(t, "")
+	clients, err := c.dial(host{name: "127.0.0.1", port: s.port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clients[0].Close()
+
+	l, err := localForward(clients[0], forward{bind: "127.0.0.1", host: "127.0.0.1", hostPort: ep})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := echo(l.Addr().String()); err != nil {
+		t.Errorf("-L: %v", err)
+	}
+
+	r, err := remoteForward(clients[0], forward{bind: "127.0.0.1", host: "127.0.0.1", hostPort: ep})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := echo(r.Addr().String()); err != nil {
+		t.Errorf("-R: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The payloads of port forwarding, from RFC 4254 section 7.
+type (
+	directTCPIPReq struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	tcpipForwardReq struct {
+		Addr string
+		Port uint32
+	}
+	tcpipForwardReply struct {
+		Port uint32
+	}
+	forwardedTCPIPReq struct {
+		Addr     string
+		Port     uint32
+		OrigAddr string
+		OrigPort uint32
+	}
+)
+
+var errForwardingDisabled = errors.New("port forwarding is disabled")
+
+// forwarder forwards TCP ports for a connection, both local ports of the
+// client (ssh -L) and ports of the server (ssh -R).
+type forwarder struct {
+	conn  ssh.Conn
+	allow bool
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[string]net.Listener
+}
+
+func newForwarder(conn ssh.Conn, allow bool) *forwarder {
+	return &forwarder{conn: conn, allow: allow, listeners: map[string]net.Listener{}}
+}
+
+// relay copies between c and tc until both directions are done.
+func relay(c ssh.Channel, tc net.Conn) {
+	defer c.Close()
+	defer tc.Close()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(tc, c)
+		if cw, ok := tc.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		close(done)
+	}()
+	io.Copy(c, tc)
+	c.CloseWrite()
+	<-done
+}
+
+// direct serves a direct-tcpip channel, which connects to a host and port
+// on behalf of the client.
+func (f *forwarder) direct(newChannel ssh.NewChannel) {
+	if !f.allow {
+		newChannel.Reject(ssh.Prohibited, errForwardingDisabled.Error())
+		return
+	}
+	r := &directTCPIPReq{}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), r); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	addr := net.JoinHostPort(r.Host, strconv.Itoa(int(r.Port)))
+	dprintf("Forwarding %s:%d to %s", r.OrigHost, r.OrigPort, addr)
+	tc, err := net.Dial("tcp", addr)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	c, reqs, err := newChannel.Accept()
+	if err != nil {
+		tc.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	relay(c, tc)
+}
+
+// requests serves the global requests of the connection.
+func (f *forwarder) requests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		dprintf("Global request %v", req.Type)
+		switch req.Type {
+		case "tcpip-forward":
+			r := &tcpipForwardReq{}
+			if err := ssh.Unmarshal(req.Payload, r); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			port, err := f.listen(r)
+			if err != nil {
+				dprintf("tcpip-forward: %v", err)
+				req.Reply(false, nil)
+				continue
+			}
+			// Only the client that asked for any port needs to
+			// know which one it got.
+			var reply []byte
+			if r.Port == 0 {
+				reply = ssh.Marshal(tcpipForwardReply{port})
+			}
+			req.Reply(true, reply)
+		case "cancel-tcpip-forward":
+			r := &tcpipForwardReq{}
+			if err := ssh.Unmarshal(req.Payload, r); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(f.cancel(r) == nil, nil)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func forwardKey(addr string, port uint32) string {
+	return net.JoinHostPort(addr, strconv.Itoa(int(port)))
+}
+
+// listen listens on the address of a tcpip-forward request, and returns
+// the port.
+func (f *forwarder) listen(r *tcpipForwardReq) (uint32, error) {
+	if !f.allow {
+		return 0, errForwardingDisabled
+	}
+	// As in OpenSSH, "" and "*" are all addresses.
+	host := r.Addr
+	if host == "*" {
+		host = ""
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(int(r.Port))))
+	if err != nil {
+		return 0, err
+	}
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		l.Close()
+		return 0, errors.New("connection closed")
+	}
+	f.listeners[forwardKey(r.Addr, port)] = l
+	dprintf("Forwarding %s to the client", l.Addr())
+	go f.accept(l, r.Addr, port)
+	return port, nil
+}
+
+// accept forwards the connections to l to the client until l is closed.
+func (f *forwarder) accept(l net.Listener, addr string, port uint32) {
+	for {
+		tc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			orig := tc.RemoteAddr().(*net.TCPAddr)
+			c, reqs, err := f.conn.OpenChannel("forwarded-tcpip", ssh.Marshal(forwardedTCPIPReq{
+				Addr:     addr,
+				Port:     port,
+				OrigAddr: orig.IP.String(),
+				OrigPort: uint32(orig.Port),
+			}))
+			if err != nil {
+				dprintf("Forwarding %s: %v", l.Addr(), err)
+				tc.Close()
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			relay(c, tc)
+		}()
+	}
+}
+
+// cancel stops listening for a tcpip-forward request.
+func (f *forwarder) cancel(r *tcpipForwardReq) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	k := forwardKey(r.Addr, r.Port)
+	l, ok := f.listeners[k]
+	if !ok {
+		return fmt.Errorf("%s is not forwarded", k)
+	}
+	delete(f.listeners, k)
+	return l.Close()
+}
+
+// close stops listening for all the tcpip-forward requests.
+func (f *forwarder) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for k, l := range f.listeners {
+		l.Close()
+		delete(f.listeners, k)
+	}
+}
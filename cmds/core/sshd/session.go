@@ -0,0 +1,310 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/u-root/u-root/pkg/pty"
+	"github.com/u-root/u-root/pkg/sftp"
+	"github.com/u-root/u-root/pkg/termios"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// The ssh package does not define these things so we will
+type (
+	ptyReq struct {
+		TERM   string //TERM environment variable value (e.g., vt100)
+		Col    uint32
+		Row    uint32
+		Xpixel uint32
+		Ypixel uint32
+		Modes  string //encoded terminal modes
+	}
+	windowChangeReq struct {
+		Col    uint32
+		Row    uint32
+		Xpixel uint32
+		Ypixel uint32
+	}
+	envReq struct {
+		Name  string
+		Value string
+	}
+	execReq struct {
+		Command string
+	}
+	subsystemReq struct {
+		Name string
+	}
+	signalReq struct {
+		Signal string
+	}
+	exitStatusReq struct {
+		ExitStatus uint32
+	}
+	exitSignalReq struct {
+		Signal     string
+		CoreDumped bool
+		Error      string
+		Lang       string
+	}
+)
+
+// signals are the signal names of RFC 4254.
+var signals = map[string]syscall.Signal{
+	"ABRT": unix.SIGABRT,
+	"ALRM": unix.SIGALRM,
+	"FPE":  unix.SIGFPE,
+	"HUP":  unix.SIGHUP,
+	"ILL":  unix.SIGILL,
+	"INT":  unix.SIGINT,
+	"KILL": unix.SIGKILL,
+	"PIPE": unix.SIGPIPE,
+	"QUIT": unix.SIGQUIT,
+	"SEGV": unix.SIGSEGV,
+	"TERM": unix.SIGTERM,
+	"USR1": unix.SIGUSR1,
+	"USR2": unix.SIGUSR2,
+}
+
+var errStarted = errors.New("session already started")
+
+// session is a session channel. It runs one command, shell or subsystem,
+// as set up by the requests before it.
+type session struct {
+	c       ssh.Channel
+	env     []string
+	pty     *pty.Pty
+	started bool
+	// cmd is the command, if it is not a subsystem.
+	cmd *exec.Cmd
+}
+
+// newSession accepts a session channel and serves its requests.
+func newSession(newChannel ssh.NewChannel) {
+	c, reqs, err := newChannel.Accept()
+	if err != nil {
+		log.Printf("Could not accept channel: %v", err)
+		return
+	}
+	s := &session{c: c}
+	for req := range reqs {
+		dprintf("Request %v", req.Type)
+		run, err := s.request(req)
+		if err != nil {
+			dprintf("%s request: %v", req.Type, err)
+		}
+		req.Reply(err == nil, nil)
+		// The command runs once it has been replied to, so that its
+		// exit status comes last.
+		if run != nil {
+			go run()
+		}
+	}
+	if s.pty != nil && !s.started {
+		s.pty.Ptm.Close()
+		s.pty.Pts.Close()
+	}
+}
+
+// request handles a session request. If it starts something, it returns a
+// function that sees it through.
+func (s *session) request(req *ssh.Request) (func(), error) {
+	switch req.Type {
+	case "env":
+		e := &envReq{}
+		if err := ssh.Unmarshal(req.Payload, e); err != nil {
+			return nil, err
+		}
+		s.env = append(s.env, e.Name+"="+e.Value)
+	case "pty-req":
+		return nil, s.newPTY(req.Payload)
+	case "window-change":
+		w := &windowChangeReq{}
+		if err := ssh.Unmarshal(req.Payload, w); err != nil {
+			return nil, err
+		}
+		return nil, s.setWinSize(w.Row, w.Col, w.Xpixel, w.Ypixel)
+	case "shell":
+		return s.start(shell)
+	case "exec":
+		e := &execReq{}
+		if err := ssh.Unmarshal(req.Payload, e); err != nil {
+			return nil, err
+		}
+		// Execute command using user's shell. This is what OpenSSH does
+		// so it's the least surprising to the user.
+		return s.start(shell, "-c", e.Command)
+	case "subsystem":
+		r := &subsystemReq{}
+		if err := ssh.Unmarshal(req.Payload, r); err != nil {
+			return nil, err
+		}
+		if r.Name != "sftp" {
+			return nil, fmt.Errorf("unknown subsystem %q", r.Name)
+		}
+		if s.started {
+			return nil, errStarted
+		}
+		s.started = true
+		return s.sftp, nil
+	case "signal":
+		r := &signalReq{}
+		if err := ssh.Unmarshal(req.Payload, r); err != nil {
+			return nil, err
+		}
+		sig, ok := signals[r.Signal]
+		if !ok {
+			return nil, fmt.Errorf("unknown signal %q", r.Signal)
+		}
+		if s.cmd == nil || s.cmd.Process == nil {
+			return nil, errors.New("no process to signal")
+		}
+		return nil, s.cmd.Process.Signal(sig)
+	default:
+		return nil, fmt.Errorf("not handling req %q", string(req.Payload))
+	}
+	return nil, nil
+}
+
+func (s *session) newPTY(b []byte) error {
+	ptyReq := &ptyReq{}
+	if err := ssh.Unmarshal(b, ptyReq); err != nil {
+		return err
+	}
+	dprintf("newPTY: %q", ptyReq)
+	if s.pty != nil {
+		return errors.New("pty already allocated")
+	}
+	p, err := pty.Open()
+	if err != nil {
+		return err
+	}
+	s.pty = p
+	if err := s.setWinSize(ptyReq.Row, ptyReq.Col, ptyReq.Xpixel, ptyReq.Ypixel); err != nil {
+		return err
+	}
+	dprintf("newPTY: set TERM to %q", ptyReq.TERM)
+	s.env = append(s.env, "TERM="+ptyReq.TERM)
+	return nil
+}
+
+func (s *session) setWinSize(row, col, xpixel, ypixel uint32) error {
+	if s.pty == nil {
+		return errors.New("no pty")
+	}
+	ws := &termios.Winsize{Winsize: unix.Winsize{
+		Row:    uint16(row),
+		Col:    uint16(col),
+		Xpixel: uint16(xpixel),
+		Ypixel: uint16(ypixel),
+	}}
+	dprintf("Set winsizes to %v", ws)
+	return termios.SetWinSize(s.pty.Ptm.Fd(), ws)
+}
+
+// start starts a command, in the pty if there is one.
+// TODO: use /etc/passwd, but the Go support for that is incomplete
+func (s *session) start(cmd string, args ...string) (func(), error) {
+	if s.started {
+		return nil, errStarted
+	}
+	if s.pty == nil {
+		return s.startPipes(cmd, args...)
+	}
+
+	log.Printf("Executing PTY command %s %v", cmd, args)
+	p := s.pty
+	p.Command(cmd, args...)
+	p.C.Env = append(os.Environ(), s.env...)
+	if err := p.C.Start(); err != nil {
+		dprintf("Failed to execute: %v", err)
+		return nil, err
+	}
+	s.started, s.cmd = true, p.C
+	// Once the command has the pts, reads of the ptm fail when it and
+	// its children are done with it.
+	p.Pts.Close()
+	go io.Copy(p.Ptm, s.c)
+	return func() {
+		io.Copy(s.c, p.Ptm)
+		p.C.Wait()
+		p.Ptm.Close()
+		s.exit(p.C.ProcessState)
+	}, nil
+}
+
+func (s *session) startPipes(cmd string, args ...string) (func(), error) {
+	log.Printf("Executing non-PTY command %s %v", cmd, args)
+	c := exec.Command(cmd, args...)
+	c.Env = append(os.Environ(), s.env...)
+	c.Stdout, c.Stderr = s.c, s.c.Stderr()
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Start(); err != nil {
+		dprintf("Failed to execute: %v", err)
+		return nil, err
+	}
+	s.started, s.cmd = true, c
+	go func() {
+		io.Copy(stdin, s.c)
+		stdin.Close()
+	}()
+	return func() {
+		c.Wait()
+		s.exit(c.ProcessState)
+	}, nil
+}
+
+func (s *session) sftp() {
+	log.Printf("Starting sftp subsystem")
+	code := uint32(0)
+	if err := sftp.NewServer(s.c).Serve(); err != nil {
+		log.Printf("sftp: %v", err)
+		code = 1
+	}
+	s.c.CloseWrite()
+	s.c.SendRequest("exit-status", false, ssh.Marshal(exitStatusReq{code}))
+	s.c.Close()
+}
+
+// exit reports how the command exited, and closes the channel.
+func (s *session) exit(ps *os.ProcessState) {
+	defer s.c.Close()
+	s.c.CloseWrite()
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+	if !ok {
+		return
+	}
+	if ws.Signaled() {
+		for name, sig := range signals {
+			if sig == ws.Signal() {
+				dprintf("Exit signal %v", name)
+				s.c.SendRequest("exit-signal", false, ssh.Marshal(exitSignalReq{
+					Signal:     name,
+					CoreDumped: ws.CoreDump(),
+				}))
+				return
+			}
+		}
+	}
+	code := uint32(ws.ExitStatus())
+	if ws.Signaled() {
+		// Like shells, report other signals as 128 plus the signal.
+		code = 128 + uint32(ws.Signal())
+	}
+	dprintf("Exit status %v", code)
+	s.c.SendRequest("exit-status", false, ssh.Marshal(exitStatusReq{code}))
+}
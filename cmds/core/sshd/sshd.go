@@ -2,181 +2,291 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// sshd is an SSH server.
+//
+// Synopsis:
+//     sshd [OPTIONS]
+//
+// Description:
+//     sshd runs commands and shells, with or without a pty, serves the
+//     sftp subsystem, and forwards TCP ports both ways (ssh -L and -R).
+//
+//     Clients authenticate with the keys in the authorized_keys file, or
+//     with certificates signed by the keys marked cert-authority there,
+//     optionally restricted to principals="name,...".
+//
+// Options:
+//     -d:          enable debug prints
+//     -keys:       path of the authorized_keys file
+//     -privatekey: comma-separated paths of host keys (RSA, ECDSA or ed25519)
+//     -ip:         IP address to listen on
+//     -port:       port to listen on
+//     -forward:    allow TCP port forwarding
+//     -keepalive:  interval of keepalive requests to clients, 0 for none
+//     -keepalive-max: unanswered keepalives after which to disconnect
+//     -idle:       disconnect clients that send nothing for this long, 0 for never
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net"
-	"os"
 	"os/exec"
-	"syscall"
+	"strings"
+	"time"
 
-	"github.com/u-root/u-root/pkg/pty"
 	"golang.org/x/crypto/ssh"
 )
 
-// The ssh package does not define these things so we will
-type (
-	ptyReq struct {
-		TERM   string //TERM environment variable value (e.g., vt100)
-		Col    uint32
-		Row    uint32
-		Xpixel uint32
-		Ypixel uint32
-		Modes  string //encoded terminal modes
-	}
-	execReq struct {
-		Command string
-	}
-	exitStatusReq struct {
-		ExitStatus uint32
-	}
-)
-
 var (
-	shells  = [...]string{"bash", "zsh", "elvish"}
-	shell   = "/bin/sh"
-	debug   = flag.Bool("d", false, "Enable debug prints")
-	keys    = flag.String("keys", "authorized_keys", "Path to the authorized_keys file")
-	privkey = flag.String("privatekey", "id_rsa", "Path of private key")
-	ip      = flag.String("ip", "0.0.0.0", "ip address to listen on")
-	port    = flag.String("port", "2022", "port to listen on")
-	dprintf = func(string, ...interface{}) {}
+	shells       = [...]string{"bash", "zsh", "elvish"}
+	shell        = "/bin/sh"
+	debug        = flag.Bool("d", false, "Enable debug prints")
+	keys         = flag.String("keys", "authorized_keys", "Path to the authorized_keys file")
+	privkey      = flag.String("privatekey", "id_rsa", "Comma-separated paths of host private keys")
+	ip           = flag.String("ip", "0.0.0.0", "ip address to listen on")
+	port         = flag.String("port", "2022", "port to listen on")
+	forward      = flag.Bool("forward", true, "Allow TCP port forwarding")
+	keepalive    = flag.Duration("keepalive", 0, "Interval of keepalive requests to clients, 0 to disable")
+	keepaliveMax = flag.Int("keepalive-max", 3, "Number of unanswered keepalive requests before disconnecting")
+	idle         = flag.Duration("idle", 0, "Disconnect clients idle for this long, 0 to disable")
+	dprintf      = func(string, ...interface{}) {}
 )
 
-// start a command
-// TODO: use /etc/passwd, but the Go support for that is incomplete
-func runCommand(c ssh.Channel, p *pty.Pty, cmd string, args ...string) error {
-	var ps *os.ProcessState
-	defer c.Close()
+func init() {
+	for _, s := range shells {
+		if _, err := exec.LookPath(s); err == nil {
+			shell = s
+		}
+	}
+}
 
-	if p != nil {
-		log.Printf("Executing PTY command %s %v", cmd, args)
-		p.Command(cmd, args...)
-		if err := p.C.Start(); err != nil {
-			dprintf("Failed to execute: %v", err)
-			return err
+// authorizedKeys are the keys of an authorized_keys file.
+type authorizedKeys struct {
+	keys map[string]bool
+	// cas maps certificate authorities to the principals they may
+	// sign for. No principals means the user name.
+	cas map[string][]string
+}
+
+// parseAuthorizedKeys parses an authorized_keys file. Of the options, it
+// honors cert-authority and principals.
+func parseAuthorizedKeys(b []byte) (*authorizedKeys, error) {
+	a := &authorizedKeys{keys: map[string]bool{}, cas: map[string][]string{}}
+	for len(bytes.TrimSpace(b)) > 0 {
+		pubKey, _, options, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, err
 		}
-		defer p.C.Wait()
-		go io.Copy(p.Ptm, c)
-		go io.Copy(c, p.Ptm)
-		ps, _ = p.C.Process.Wait()
-	} else {
-		e := exec.Command(cmd, args...)
-		e.Stdin, e.Stdout, e.Stderr = c, c, c
-		log.Printf("Executing non-PTY command %s %v", cmd, args)
-		if err := e.Start(); err != nil {
-			dprintf("Failed to execute: %v", err)
-			return err
+		b = rest
+
+		ca := false
+		var principals []string
+		for _, o := range options {
+			switch {
+			case o == "cert-authority":
+				ca = true
+			case strings.HasPrefix(o, "principals="):
+				p := strings.Trim(strings.TrimPrefix(o, "principals="), `"`)
+				principals = strings.Split(p, ",")
+			}
+		}
+		if ca {
+			a.cas[string(pubKey.Marshal())] = principals
+		} else {
+			a.keys[string(pubKey.Marshal())] = true
 		}
-		ps, _ = e.Process.Wait()
 	}
+	return a, nil
+}
 
-	ws := ps.Sys().(syscall.WaitStatus)
-	// TODO(bluecmd): If somebody wants we can send exit-signal to return
-	// information about signal termination, but leave it until somebody needs
-	// it.
-	// if ws.Signaled() {
-	// }
-	if ws.Exited() {
-		code := uint32(ws.ExitStatus())
-		dprintf("Exit status %v", code)
-		c.SendRequest("exit-status", false, ssh.Marshal(exitStatusReq{code}))
-	}
-	return nil
+// principalConn is a ConnMetadata whose user is a principal of a
+// certificate, for principals= authorities.
+type principalConn struct {
+	ssh.ConnMetadata
+	principal string
 }
 
-func newPTY(b []byte) (*pty.Pty, error) {
-	ptyReq := &ptyReq{}
-	err := ssh.Unmarshal(b, ptyReq)
-	dprintf("newPTY: %q", ptyReq)
-	if err != nil {
-		return nil, err
+func (p principalConn) User() string {
+	return p.principal
+}
+
+// authenticate authenticates users by their public keys or certificates.
+func (a *authorizedKeys) authenticate(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			_, ok := a.cas[string(auth.Marshal())]
+			return ok
+		},
+		UserKeyFallback: func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+			if !a.keys[string(pubKey.Marshal())] {
+				return nil, fmt.Errorf("unknown public key for %q", c.User())
+			}
+			return &ssh.Permissions{}, nil
+		},
 	}
-	p, err := pty.New()
-	if err != nil {
-		return nil, err
+	if cert, ok := pubKey.(*ssh.Certificate); ok {
+		if principals := a.cas[string(cert.SignatureKey.Marshal())]; len(principals) > 0 {
+			pc := principalConn{ConnMetadata: c}
+			for _, p := range cert.ValidPrincipals {
+				for _, q := range principals {
+					if p == q {
+						pc.principal = p
+					}
+				}
+			}
+			if pc.principal == "" {
+				return nil, fmt.Errorf("certificate for %q has no allowed principal", c.User())
+			}
+			c = pc
+		}
 	}
-	ws, err := p.TTY.GetWinSize()
+	perms, err := checker.Authenticate(c, pubKey)
 	if err != nil {
 		return nil, err
 	}
-	ws.Row = uint16(ptyReq.Row)
-	ws.Ypixel = uint16(ptyReq.Ypixel)
-	ws.Col = uint16(ptyReq.Col)
-	ws.Xpixel = uint16(ptyReq.Xpixel)
-	dprintf("newPTY: Set winsizes to %v", ws)
-	if err := p.TTY.SetWinSize(ws); err != nil {
-		return nil, err
-	}
-	dprintf("newPTY: set TERM to %q", ptyReq.TERM)
-	if err := os.Setenv("TERM", ptyReq.TERM); err != nil {
-		return nil, err
+	// Record the public key used for authentication. The permissions of
+	// a certificate are its own, so they are copied.
+	p := &ssh.Permissions{CriticalOptions: perms.CriticalOptions, Extensions: map[string]string{}}
+	for k, v := range perms.Extensions {
+		p.Extensions[k] = v
 	}
+	p.Extensions["pubkey-fp"] = ssh.FingerprintSHA256(pubKey)
 	return p, nil
 }
 
-func init() {
-	for _, s := range shells {
-		if _, err := exec.LookPath(s); err == nil {
-			shell = s
+// server is an SSH server.
+type server struct {
+	config       *ssh.ServerConfig
+	forward      bool
+	keepalive    time.Duration
+	keepaliveMax int
+	idle         time.Duration
+}
+
+// idleConn is a net.Conn which times out reads after idle.
+type idleConn struct {
+	net.Conn
+	idle time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	if err := c.SetReadDeadline(time.Now().Add(c.idle)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// serve accepts connections on l until it fails.
+func (s *server) serve(l net.Listener) error {
+	for {
+		nConn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Printf("failed to accept incoming connection: %s", err)
+				continue
+			}
+			return err
 		}
+		go s.handleConn(nConn)
 	}
 }
 
-func session(chans <-chan ssh.NewChannel) {
-	var p *pty.Pty
-	// Service the incoming Channel channel.
+func (s *server) handleConn(nConn net.Conn) {
+	if s.idle > 0 {
+		nConn = &idleConn{Conn: nConn, idle: s.idle}
+	}
+	// Before use, a handshake must be performed on the incoming
+	// net.Conn.
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, s.config)
+	if err != nil {
+		log.Printf("failed to handshake: %v", err)
+		nConn.Close()
+		return
+	}
+	log.Printf("%v logged in as %q with key %s", conn.RemoteAddr(), conn.User(), conn.Permissions.Extensions["pubkey-fp"])
+	defer log.Printf("%v disconnected", conn.RemoteAddr())
+
+	done := make(chan struct{})
+	defer close(done)
+	if s.keepalive > 0 {
+		go s.keepAlive(conn, done)
+	}
+
+	f := newForwarder(conn, s.forward)
+	defer f.close()
+	go f.requests(reqs)
+
 	for newChannel := range chans {
-		// Channels have a type, depending on the application level
-		// protocol intended. In the case of a shell, the type is
-		// "session" and ServerShell may be used to present a simple
-		// terminal interface.
-		if newChannel.ChannelType() != "session" {
+		switch newChannel.ChannelType() {
+		case "session":
+			go newSession(newChannel)
+		case "direct-tcpip":
+			go f.direct(newChannel)
+		default:
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
-			continue
-		}
-		channel, requests, err := newChannel.Accept()
-		if err != nil {
-			log.Printf("Could not accept channel: %v", err)
-			continue
 		}
+	}
+}
 
-		// Sessions have out-of-band requests such as "shell",
-		// "pty-req" and "env".  Here we handle only the
-		// "shell" request.
-		go func(in <-chan *ssh.Request) {
-			for req := range in {
-				dprintf("Request %v", req.Type)
-				switch req.Type {
-				case "shell":
-					err := runCommand(channel, p, shell)
-					req.Reply(true, []byte(fmt.Sprintf("%v", err)))
-				case "exec":
-					e := &execReq{}
-					if err := ssh.Unmarshal(req.Payload, e); err != nil {
-						log.Printf("sshd: %v", err)
-						break
-					}
-					// Execute command using user's shell. This is what OpenSSH does
-					// so it's the least surprising to the user.
-					err := runCommand(channel, p, shell, "-c", e.Command)
-					req.Reply(true, []byte(fmt.Sprintf("%v", err)))
-				case "pty-req":
-					p, err = newPTY(req.Payload)
-					req.Reply(err == nil, nil)
-				default:
-					log.Printf("Not handling req %v %q", req, string(req.Payload))
-					req.Reply(false, nil)
-				}
+// keepAlive sends keepalive requests to conn, and closes it when
+// keepaliveMax requests in a row go unanswered.
+func (s *server) keepAlive(conn ssh.Conn, done <-chan struct{}) {
+	t := time.NewTicker(s.keepalive)
+	defer t.Stop()
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		reply := make(chan error, 1)
+		go func() {
+			// Clients reply to requests they do not know with a
+			// failure, which is as good as success here.
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case <-done:
+			return
+		case err := <-reply:
+			if err != nil {
+				conn.Close()
+				return
+			}
+			missed = 0
+		case <-time.After(s.keepalive):
+			missed++
+			dprintf("%v missed %d keepalives", conn.RemoteAddr(), missed)
+			if missed >= s.keepaliveMax {
+				log.Printf("%v timed out", conn.RemoteAddr())
+				conn.Close()
+				return
 			}
-		}(requests)
+		}
+	}
+}
 
+// hostKeys reads the host keys from the files in paths.
+func hostKeys(paths []string) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	for _, p := range paths {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		s, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		signers = append(signers, s)
 	}
+	return signers, nil
 }
 
 func main() {
@@ -191,72 +301,36 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	authorizedKeysMap := map[string]bool{}
-	for len(authorizedKeysBytes) > 0 {
-		pubKey, _, _, rest, err := ssh.ParseAuthorizedKey(authorizedKeysBytes)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		authorizedKeysMap[string(pubKey.Marshal())] = true
-		authorizedKeysBytes = rest
+	authorized, err := parseAuthorizedKeys(authorizedKeysBytes)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// An SSH server is represented by a ServerConfig, which holds
 	// certificate details and handles authentication of ServerConns.
 	config := &ssh.ServerConfig{
-		// Remove to disable public key auth.
-		PublicKeyCallback: func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
-			if authorizedKeysMap[string(pubKey.Marshal())] {
-				return &ssh.Permissions{
-					// Record the public key used for authentication.
-					Extensions: map[string]string{
-						"pubkey-fp": ssh.FingerprintSHA256(pubKey),
-					},
-				}, nil
-			}
-			return nil, fmt.Errorf("unknown public key for %q", c.User())
-		},
+		PublicKeyCallback: authorized.authenticate,
 	}
-
-	privateBytes, err := ioutil.ReadFile(*privkey)
+	signers, err := hostKeys(strings.Split(*privkey, ","))
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	private, err := ssh.ParsePrivateKey(privateBytes)
-	if err != nil {
-		log.Fatal(err)
+	for _, s := range signers {
+		config.AddHostKey(s)
 	}
 
-	config.AddHostKey(private)
-
 	// Once a ServerConfig has been configured, connections can be
 	// accepted.
 	listener, err := net.Listen("tcp", net.JoinHostPort(*ip, *port))
 	if err != nil {
 		log.Fatal(err)
 	}
-	for {
-		nConn, err := listener.Accept()
-		if err != nil {
-			log.Printf("failed to accept incoming connection: %s", err)
-			continue
-		}
-
-		// Before use, a handshake must be performed on the incoming
-		// net.Conn.
-		conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
-		if err != nil {
-			log.Printf("failed to handshake: %v", err)
-			continue
-		}
-		log.Printf("%v logged in with key %s", conn.RemoteAddr(), conn.Permissions.Extensions["pubkey-fp"])
-
-		// The incoming Request channel must be serviced.
-		go ssh.DiscardRequests(reqs)
-
-		go session(chans)
+	s := &server{
+		config:       config,
+		forward:      *forward,
+		keepalive:    *keepalive,
+		keepaliveMax: *keepaliveMax,
+		idle:         *idle,
 	}
+	log.Fatal(s.serve(listener))
 }
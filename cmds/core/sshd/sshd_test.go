@@ -0,0 +1,611 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T, kind string) ssh.Signer {
+	t.Helper()
+	var key interface{}
+	var err error
+	switch kind {
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newCert returns a user certificate for principals, signed by ca.
+func newCert(t *testing.T, ca ssh.Signer, principals ...string) ssh.Signer {
+	t.Helper()
+	key := newSigner(t, "ed25519")
+	cert := &ssh.Certificate{
+		Key:             key.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: principals,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	s, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testServer runs a server for user, with host keys of kinds.
+type testServer struct {
+	*server
+	addr string
+	user ssh.Signer
+	l    net.Listener
+}
+
+func newTestServer(t *testing.T, kinds ...string) *testServer {
+	t.Helper()
+	ts := &testServer{user: newSigner(t, "ed25519")}
+	a, err := parseAuthorizedKeys(ssh.MarshalAuthorizedKey(ts.user.PublicKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{PublicKeyCallback: a.authenticate}
+	if len(kinds) == 0 {
+		kinds = []string{"ed25519"}
+	}
+	for _, k := range kinds {
+		config.AddHostKey(newSigner(t, k))
+	}
+	ts.server = &server{config: config, forward: true}
+	if ts.l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	ts.addr = ts.l.Addr().String()
+	return ts
+}
+
+func (ts *testServer) start() {
+	go ts.serve(ts.l)
+}
+
+func (ts *testServer) close() {
+	ts.l.Close()
+}
+
+func (ts *testServer) dial(t *testing.T) *ssh.Client {
+	t.Helper()
+	c, err := ssh.Dial("tcp", ts.addr, &ssh.ClientConfig{
+		User:            "root",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(ts.user)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	user, ca, pca := newSigner(t, "ed25519"), newSigner(t, "ecdsa"), newSigner(t, "ed25519")
+	b := ssh.MarshalAuthorizedKey(user.PublicKey())
+	b = append(b, "\n# comment\n"...)
+	b = append(b, "cert-authority "...)
+	b = append(b, ssh.MarshalAuthorizedKey(ca.PublicKey())...)
+	b = append(b, `cert-authority,principals="alice,bob" `...)
+	b = append(b, ssh.MarshalAuthorizedKey(pca.PublicKey())...)
+	a, err := parseAuthorizedKeys(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.keys) != 1 || !a.keys[string(user.PublicKey().Marshal())] {
+		t.Errorf("keys: got %d keys, want the user key only", len(a.keys))
+	}
+	if p, ok := a.cas[string(ca.PublicKey().Marshal())]; !ok || p != nil {
+		t.Errorf("CA: got %q, %v, want no principals, true", p, ok)
+	}
+	if p := a.cas[string(pca.PublicKey().Marshal())]; strings.Join(p, ",") != "alice,bob" {
+		t.Errorf("CA principals: got %q, want [alice bob]", p)
+	}
+	if _, err := parseAuthorizedKeys([]byte("not a key\n")); err == nil {
+		t.Errorf("bad authorized_keys: got nil, want error")
+	}
+}
+
+type connMetadata struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (c connMetadata) User() string {
+	return c.user
+}
+
+func (c connMetadata) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+}
+
+func TestAuthenticate(t *testing.T) {
+	user, ca, pca, other := newSigner(t, "ed25519"), newSigner(t, "ed25519"), newSigner(t, "ecdsa"), newSigner(t, "ed25519")
+	a := &authorizedKeys{
+		keys: map[string]bool{string(user.PublicKey().Marshal()): true},
+		cas: map[string][]string{
+			string(ca.PublicKey().Marshal()):  nil,
+			string(pca.PublicKey().Marshal()): {"admins"},
+		},
+	}
+	for _, tt := range []struct {
+		name string
+		user string
+		key  ssh.PublicKey
+		ok   bool
+	}{
+		{"key", "root", user.PublicKey(), true},
+		{"unknown key", "root", other.PublicKey(), false},
+		{"certificate", "root", newCert(t, ca, "root").PublicKey(), true},
+		{"certificate for another user", "root", newCert(t, ca, "alice").PublicKey(), false},
+		{"certificate of unknown CA", "root", newCert(t, other, "root").PublicKey(), false},
+		{"CA key", "root", ca.PublicKey(), false},
+		{"principals", "root", newCert(t, pca, "alice", "admins").PublicKey(), true},
+		{"principals not allowed", "root", newCert(t, pca, "root").PublicKey(), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := a.authenticate(connMetadata{user: tt.user}, tt.key)
+			if (err == nil) != tt.ok {
+				t.Fatalf("authenticate: got %v, want success %v", err, tt.ok)
+			}
+			if err == nil && p.Extensions["pubkey-fp"] != ssh.FingerprintSHA256(tt.key) {
+				t.Errorf("pubkey-fp: got %q, want %q", p.Extensions["pubkey-fp"], ssh.FingerprintSHA256(tt.key))
+			}
+		})
+	}
+}
+
+func TestHostKeys(t *testing.T) {
+	for _, kind := range []string{"rsa", "ecdsa", "ed25519"} {
+		t.Run(kind, func(t *testing.T) {
+			ts := newTestServer(t, kind)
+			ts.start()
+			defer ts.close()
+			var got string
+			c, err := ssh.Dial("tcp", ts.addr, &ssh.ClientConfig{
+				User: "root",
+				Auth: []ssh.AuthMethod{ssh.PublicKeys(ts.user)},
+				HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+					got = key.Type()
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Close()
+			if !strings.Contains(got, kind) {
+				t.Errorf("host key: got %q, want %s", got, kind)
+			}
+		})
+	}
+}
+
+func TestExec(t *testing.T) {
+	ts := newTestServer(t)
+	ts.start()
+	defer ts.close()
+	c := ts.dial(t)
+	defer c.Close()
+
+	for _, tt := range []struct {
+		name           string
+		cmd            string
+		env            map[string]string
+		stdin          string
+		stdout, stderr string
+		status         int
+		signal         string
+	}{
+		{name: "ok", cmd: "echo hi", stdout: "hi\n"},
+		{name: "stderr", cmd: "echo out; echo err >&2", stdout: "out\n", stderr: "err\n"},
+		{name: "status", cmd: "exit 3", status: 3},
+		{name: "stdin", cmd: "cat; echo done", stdin: "in\n", stdout: "in\ndone\n"},
+		{name: "env", cmd: "echo $A $B", env: map[string]string{"A": "a", "B": "b c"}, stdout: "a b c\n"},
+		{name: "signal", cmd: "kill -TERM $$", status: 143, signal: "TERM"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := c.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			for k, v := range tt.env {
+				if err := s.Setenv(k, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var stdout, stderr bytes.Buffer
+			s.Stdin, s.Stdout, s.Stderr = strings.NewReader(tt.stdin), &stdout, &stderr
+			err = s.Run(tt.cmd)
+			status, signal := 0, ""
+			if ee, ok := err.(*ssh.ExitError); ok {
+				status, signal = ee.ExitStatus(), ee.Signal()
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.status || signal != tt.signal {
+				t.Errorf("exit: got status %d signal %q, want %d %q", status, signal, tt.status, tt.signal)
+			}
+			if stdout.String() != tt.stdout || stderr.String() != tt.stderr {
+				t.Errorf("output: got %q and %q, want %q and %q", stdout.String(), stderr.String(), tt.stdout, tt.stderr)
+			}
+		})
+	}
+}
+
+func TestPTY(t *testing.T) {
+	ts := newTestServer(t)
+	ts.start()
+	defer ts.close()
+	c := ts.dial(t)
+	defer c.Close()
+
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.RequestPty("vt100", 40, 80, ssh.TerminalModes{}); err != nil {
+		t.Skipf("no pty: %v", err)
+	}
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := bufio.NewReader(stdout)
+	if err := s.Start("stty size; tty; echo $TERM; read x; stty size"); err != nil {
+		t.Fatal(err)
+	}
+	line := func() string {
+		l, err := out.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimRight(l, "\r\n")
+	}
+	if l := line(); l != "40 80" {
+		t.Errorf("size: got %q, want 40 80", l)
+	}
+	if l := line(); !strings.HasPrefix(l, "/dev/pts/") {
+		t.Errorf("tty: got %q, want a pts", l)
+	}
+	if l := line(); l != "vt100" {
+		t.Errorf("TERM: got %q, want vt100", l)
+	}
+
+	if err := s.WindowChange(50, 100); err != nil {
+		t.Fatal(err)
+	}
+	// Requests are handled in order, so once this one is answered
+	// the window has changed.
+	if err := s.Setenv("SYNC", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stdin.Write([]byte("\n")); err != nil {
+		t.Fatal(err)
+	}
+	// The newline echoes.
+	line()
+	if l := line(); l != "50 100" {
+		t.Errorf("size after window-change: got %q, want 50 100", l)
+	}
+	if err := s.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sftpPacket returns an SFTP packet of type typ with the fields.
+func sftpPacket(typ byte, fields ...interface{}) []byte {
+	var p []byte
+	for _, f := range fields {
+		switch f := f.(type) {
+		case uint32:
+			p = append(p, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(p[len(p)-4:], f)
+		case uint64:
+			p = append(p, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.BigEndian.PutUint64(p[len(p)-8:], f)
+		case string:
+			p = append(p, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(p[len(p)-4:], uint32(len(f)))
+			p = append(p, f...)
+		}
+	}
+	b := make([]byte, 5)
+	binary.BigEndian.PutUint32(b, uint32(len(p)+1))
+	b[4] = typ
+	return append(b, p...)
+}
+
+func TestSFTP(t *testing.T) {
+	d, err := ioutil.TempDir("", "sshd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	ts := newTestServer(t)
+	ts.start()
+	defer ts.close()
+	c := ts.dial(t)
+	defer c.Close()
+
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RequestSubsystem("sftp"); err != nil {
+		t.Fatal(err)
+	}
+	// reply reads a reply, and returns its type and the rest after
+	// the version or ID.
+	reply := func() (byte, []byte) {
+		var l [4]byte
+		if _, err := io.ReadFull(stdout, l[:]); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, binary.BigEndian.Uint32(l[:]))
+		if _, err := io.ReadFull(stdout, b); err != nil {
+			t.Fatal(err)
+		}
+		return b[0], b[5:]
+	}
+
+	f := filepath.Join(d, "f")
+	for _, tt := range []struct {
+		packet []byte
+		reply  byte
+	}{
+		{sftpPacket(1, uint32(3)), 2},
+		// OPEN with READ|WRITE|CREAT and no attributes.
+		{sftpPacket(3, uint32(1), f, uint32(0x0b), uint32(0)), 102},
+		{sftpPacket(6, uint32(2), "1", uint64(0), "hello"), 101},
+		{sftpPacket(4, uint32(3), "1"), 101},
+		{sftpPacket(17, uint32(4), f), 105},
+	} {
+		if _, err := stdin.Write(tt.packet); err != nil {
+			t.Fatal(err)
+		}
+		typ, b := reply()
+		if typ != tt.reply {
+			t.Fatalf("packet type %d: got reply %d (%q), want %d", tt.packet[4], typ, b, tt.reply)
+		}
+		if typ == 101 && binary.BigEndian.Uint32(b) != 0 {
+			t.Fatalf("packet type %d: got status %q, want OK", tt.packet[4], b)
+		}
+	}
+	if b, err := ioutil.ReadFile(f); err != nil || string(b) != "hello" {
+		t.Errorf("file: got %q, %v, want %q, nil", b, err, "hello")
+	}
+	// The subsystem ends with the client's input.
+	stdin.Close()
+	if b, err := ioutil.ReadAll(stdout); err != nil || len(b) != 0 {
+		t.Errorf("sftp after EOF: got %q, %v, want no output and nil", b, err)
+	}
+
+	s, err = c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.RequestSubsystem("nope"); err == nil {
+		t.Errorf("unknown subsystem: got nil, want error")
+	}
+}
+
+// echoServer echoes what it reads on a listener of its own.
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func echo(c net.Conn) error {
+	defer c.Close()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		return err
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return err
+	}
+	if string(b) != "ping" {
+		return fmt.Errorf("got %q, want ping", b)
+	}
+	return nil
+}
+
+func TestForward(t *testing.T) {
+	e := echoServer(t)
+	defer e.Close()
+	ts := newTestServer(t)
+	ts.start()
+	defer ts.close()
+	c := ts.dial(t)
+	defer c.Close()
+
+	// ssh -L
+	conn, err := c.Dial("tcp", e.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(conn); err != nil {
+		t.Errorf("direct-tcpip: %v", err)
+	}
+
+	// ssh -R
+	l, err := c.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(conn); err != nil {
+		t.Errorf("forwarded-tcpip: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Errorf("cancel-tcpip-forward: %v", err)
+	}
+	if conn, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("dial after cancel-tcpip-forward: got nil, want error")
+	}
+}
+
+func TestForwardDisabled(t *testing.T) {
+	e := echoServer(t)
+	defer e.Close()
+	ts := newTestServer(t)
+	ts.forward = false
+	ts.start()
+	defer ts.close()
+	c := ts.dial(t)
+	defer c.Close()
+
+	if conn, err := c.Dial("tcp", e.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("direct-tcpip: got nil, want error")
+	}
+	if l, err := c.Listen("tcp", "127.0.0.1:0"); err == nil {
+		l.Close()
+		t.Errorf("tcpip-forward: got nil, want error")
+	}
+}
+
+// waitClosed fails unless the server closes c within d.
+func waitClosed(t *testing.T, c ssh.Conn, d time.Duration) {
+	t.Helper()
+	closed := make(chan struct{})
+	go func() {
+		c.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(d):
+		c.Close()
+		t.Errorf("connection still open after %v", d)
+	}
+}
+
+func TestIdle(t *testing.T) {
+	ts := newTestServer(t)
+	ts.idle = 200 * time.Millisecond
+	ts.start()
+	defer ts.close()
+	c := ts.dial(t)
+	waitClosed(t, c, 10*time.Second)
+}
+
+func TestKeepAlive(t *testing.T) {
+	ts := newTestServer(t)
+	ts.keepalive, ts.keepaliveMax = 50*time.Millisecond, 2
+	ts.start()
+	defer ts.close()
+
+	// A client which answers keepalives stays connected.
+	c := ts.dial(t)
+	defer c.Close()
+	time.Sleep(300 * time.Millisecond)
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatalf("session after keepalives: %v", err)
+	}
+	s.Close()
+
+	// One which does not is disconnected.
+	nc, err := net.Dial("tcp", ts.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, _, err := ssh.NewClientConn(nc, ts.addr, &ssh.ClientConfig{
+		User:            "root",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(ts.user)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitClosed(t, conn, 10*time.Second)
+}
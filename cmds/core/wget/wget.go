@@ -5,11 +5,16 @@
 // Wget reads one file from a url and writes to stdout.
 //
 // Synopsis:
-//     wget URL
+//     wget [-O FILE] [-segments N] [-progress] URL
 //
 // Description:
 //     Returns a non-zero code on failure.
 //
+//     HTTP downloads that fail part way through are resumed where they
+//     stopped. If the URL's fragment names a digest, as in #sha256=<hex>, or
+//     #sha256 for the digest in the side-car file URL.sha256, the file is
+//     checked against it.
+//
 // Notes:
 //     There are a few differences with GNU wget:
 //     - Upon error, the return value is always 1.
@@ -24,6 +29,7 @@ import (
 	"flag"
 	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
@@ -33,7 +39,9 @@ import (
 )
 
 var (
-	outPath = flag.String("O", "", "output file")
+	outPath  = flag.String("O", "", "output file")
+	segments = flag.Int("segments", 1, "number of parallel range requests to download large HTTP files with")
+	progress = flag.Bool("progress", false, "print a dot to stderr for every MiB downloaded over HTTP")
 )
 
 func usage() {
@@ -67,12 +75,18 @@ func main() {
 		}
 	}
 
+	client := curl.NewHTTPClient(http.DefaultClient)
+	client.Segments = *segments
+	client.SegmentSize = 16 << 20
+	if *progress {
+		client.Progress = &uio.ProgressWriter{Symbol: ".", Interval: 1 << 20, W: os.Stderr}
+	}
 	schemes := curl.Schemes{
 		"tftp": curl.DefaultTFTPClient,
-		"http": curl.DefaultHTTPClient,
+		"http": client,
 
 		// curl.DefaultSchemes doesn't support HTTPS by default.
-		"https": curl.DefaultHTTPClient,
+		"https": client,
 		"file":  &curl.LocalFileClient{},
 	}
 
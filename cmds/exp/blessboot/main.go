@@ -0,0 +1,112 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blessboot marks the Boot Loader Specification entry that was booted as good
+// or bad, so boot loaders counting boot attempts stop falling back from it or
+// do not boot it anymore.
+//
+// Synopsis:
+//	blessboot [-root DIR] [-entry ENTRY] good|bad|status
+//
+// Description:
+//	Entries with a boot counter in their file name, e.g.
+//	loader/entries/fedora+3.conf, are tried 3 times before they are
+//	considered bad and booted last. Once the OS has booted successfully,
+//	"blessboot good" removes the counter. "blessboot bad" gives up on the
+//	entry immediately. "blessboot status" prints the counter.
+//
+//	The booted entry is taken from the bls.entry kernel parameter, which
+//	is set by u-root boot loaders.
+//
+// Options:
+//	-root: boot partition, by default the first of /efi, /boot/efi and /boot
+//	       that contains the entry
+//	-entry: entry relative to the boot partition, without boot counter
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/u-root/u-root/pkg/boot/bls"
+	"github.com/u-root/u-root/pkg/cmdline"
+)
+
+var (
+	root  = flag.String("root", "", "boot partition, by default the first of /efi, /boot/efi and /boot that contains the entry")
+	entry = flag.String("entry", "", "entry relative to the boot partition, without boot counter (default from the bls.entry kernel parameter)")
+
+	defaultRoots = []string{"/efi", "/boot/efi", "/boot"}
+)
+
+// find returns the boot counter of entry in the first of roots that has it.
+// It returns bls.ErrNotCounted if the entry was already marked good.
+func find(roots []string, entry string) (*bls.BootCount, error) {
+	for _, r := range roots {
+		b, err := bls.FindBootCount(r, entry)
+		if err == nil || errors.Is(err, bls.ErrNotCounted) {
+			return b, err
+		}
+	}
+	return nil, fmt.Errorf("entry %s not found in %v", entry, roots)
+}
+
+func run(w io.Writer, roots []string, entry string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: blessboot [-root DIR] [-entry ENTRY] good|bad|status")
+	}
+	if entry == "" {
+		return fmt.Errorf("%s kernel parameter not set, no entry to mark", bls.EntryParam)
+	}
+	b, err := find(roots, filepath.FromSlash(entry))
+	if errors.Is(err, bls.ErrNotCounted) {
+		switch args[0] {
+		case "good", "status":
+			fmt.Fprintf(w, "%s: good\n", entry)
+			return nil
+		case "bad":
+			return fmt.Errorf("%s: cannot mark bad, it has no boot counter", entry)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "good":
+		err = b.MarkGood()
+	case "bad":
+		err = b.MarkBad()
+	case "status":
+		state := "indeterminate"
+		if b.Bad() {
+			state = "bad"
+		}
+		fmt.Fprintf(w, "%s: %s\n", b, state)
+	default:
+		return fmt.Errorf("unknown action %q, want good, bad or status", args[0])
+	}
+	return err
+}
+
+func main() {
+	flag.Parse()
+
+	roots := defaultRoots
+	if *root != "" {
+		roots = []string{*root}
+	}
+	e := *entry
+	if e == "" {
+		e, _ = cmdline.Flag(bls.EntryParam)
+	}
+	if err := run(os.Stdout, roots, e, flag.Args()); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blessboot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The entry is found in the second root.
+	roots := []string{filepath.Join(dir, "efi"), filepath.Join(dir, "boot")}
+	entries := filepath.Join(roots[1], "loader", "entries")
+	if err := os.MkdirAll(entries, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"a+1-2.conf", "b+3.conf"} {
+		if err := ioutil.WriteFile(filepath.Join(entries, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		entry string
+		args  []string
+		want  string
+		file  string
+		err   string
+	}{
+		{entry: "loader/entries/a.conf", args: []string{"status"}, want: "1 tries left, 2 done: indeterminate"},
+		{entry: "loader/entries/a.conf", args: []string{"good"}, file: "a.conf"},
+		{entry: "loader/entries/a.conf", args: []string{"status"}, want: "loader/entries/a.conf: good"},
+		{entry: "loader/entries/a.conf", args: []string{"bad"}, err: "no boot counter"},
+		{entry: "loader/entries/b.conf", args: []string{"bad"}, file: "b+0-0.conf"},
+		{entry: "loader/entries/b.conf", args: []string{"status"}, want: "0 tries left, 0 done: bad"},
+		{entry: "loader/entries/b.conf", args: []string{"frob"}, err: "unknown action"},
+		{entry: "loader/entries/c.conf", args: []string{"good"}, err: "not found"},
+		{args: []string{"good"}, err: "kernel parameter not set"},
+		{entry: "loader/entries/b.conf", err: "usage"},
+	} {
+		var out bytes.Buffer
+		err := run(&out, roots, tt.entry, tt.args)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("run(%s, %v) = %v, want error containing %q", tt.entry, tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("run(%s, %v) = %v", tt.entry, tt.args, err)
+			continue
+		}
+		if !strings.Contains(out.String(), tt.want) {
+			t.Errorf("run(%s, %v) printed %q, want %q", tt.entry, tt.args, out.String(), tt.want)
+		}
+		if tt.file != "" {
+			if _, err := os.Stat(filepath.Join(entries, tt.file)); err != nil {
+				t.Errorf("run(%s, %v): %v", tt.entry, tt.args, err)
+			}
+		}
+	}
+}
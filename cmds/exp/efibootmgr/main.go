@@ -0,0 +1,299 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// efibootmgr lists and changes the UEFI boot entries, boot order, next boot
+// entry and timeout, like its Linux namesake.
+//
+// Synopsis:
+//	efibootmgr [-v]
+//	efibootmgr -c [-d DISK] [-p PART] [-l LOADER] [-L LABEL] [-u] [ARGS...]
+//	efibootmgr -b XXXX [-B | -a | -A]
+//	efibootmgr [-o XXXX,YYYY,... | -O] [-n XXXX | -N] [-t SECONDS | -T]
+//
+// Description:
+//	Without options, the boot entries are listed; entries marked with * are
+//	active. Changes are written through efivarfs, which must be mounted at
+//	/sys/firmware/efi/efivars.
+//
+//	New entries are added to the front of BootOrder. Only GPT disks are
+//	supported. ARGS are passed to the loader, e.g. as kernel command line.
+//
+// Options:
+//	-c: create a new boot entry
+//	-d: disk containing the loader
+//	-p: partition number of the loader
+//	-l: path of the loader, relative to the partition
+//	-L: description of the new entry
+//	-u: pass ARGS as UCS-2 instead of ASCII
+//	-b: boot entry to modify
+//	-B: delete the boot entry
+//	-a: activate the boot entry
+//	-A: inactivate the boot entry
+//	-o: set BootOrder
+//	-O: delete BootOrder
+//	-n: set BootNext
+//	-N: delete BootNext
+//	-t: set Timeout, in seconds
+//	-T: delete Timeout
+//	-v: print the device path and arguments of entries
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/mount/block"
+	"github.com/u-root/u-root/pkg/uefivars"
+	"github.com/u-root/u-root/pkg/uefivars/boot"
+)
+
+var (
+	create      = flag.Bool("c", false, "create a new boot entry")
+	disk        = flag.String("d", "/dev/sda", "disk containing the loader")
+	part        = flag.Int("p", 1, "partition number of the loader")
+	loader      = flag.String("l", `\EFI\BOOT\BOOTX64.EFI`, "path of the loader, relative to the partition")
+	label       = flag.String("L", "Linux", "description of the new entry")
+	unicode     = flag.Bool("u", false, "pass extra arguments as UCS-2 instead of ASCII")
+	bootNum     = flag.String("b", "", "boot entry to modify, in hex")
+	deleteEntry = flag.Bool("B", false, "delete the boot entry")
+	active      = flag.Bool("a", false, "activate the boot entry")
+	inactive    = flag.Bool("A", false, "inactivate the boot entry")
+	order       = flag.String("o", "", "set BootOrder, a comma separated list of hex entry numbers")
+	deleteOrder = flag.Bool("O", false, "delete BootOrder")
+	next        = flag.String("n", "", "set BootNext, in hex")
+	deleteNext  = flag.Bool("N", false, "delete BootNext")
+	timeout     = flag.Int("t", -1, "set Timeout, in seconds")
+	deleteTO    = flag.Bool("T", false, "delete Timeout")
+	verbose     = flag.Bool("v", false, "print device paths and arguments")
+)
+
+// parseNum parses a boot entry number, which is hexadecimal.
+func parseNum(s string) (uint16, error) {
+	n, err := strconv.ParseUint(s, 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid boot entry number %q", s)
+	}
+	return uint16(n), nil
+}
+
+// parseOrder parses a comma separated list of boot entry numbers.
+func parseOrder(s string) ([]uint16, error) {
+	var order []uint16
+	for _, f := range strings.Split(s, ",") {
+		n, err := parseNum(f)
+		if err != nil {
+			return nil, err
+		}
+		order = append(order, n)
+	}
+	return order, nil
+}
+
+// optionalData encodes the arguments passed to the loader.
+func optionalData(args []string, unicode bool) []byte {
+	if len(args) == 0 {
+		return nil
+	}
+	s := strings.Join(args, " ")
+	if unicode {
+		return append(uefivars.EncodeUTF16(s), 0, 0)
+	}
+	return []byte(s)
+}
+
+// hddPath returns the device path of the loader on partition part of disk.
+func hddPath(disk string, part int, loader string) (boot.EfiDevicePathProtocolList, error) {
+	dev, err := block.Device(disk)
+	if err != nil {
+		return nil, err
+	}
+	table, err := dev.GPTTable()
+	if err != nil {
+		return nil, fmt.Errorf("%s: only GPT disks are supported: %v", disk, err)
+	}
+	if part < 1 || part > len(table.Partitions) || table.Partitions[part-1].IsEmpty() {
+		return nil, fmt.Errorf("%s: no partition %d", disk, part)
+	}
+	p := table.Partitions[part-1]
+	hdd := boot.NewDppMediaHDD(uint32(part), p.FirstLBA, p.LastLBA-p.FirstLBA+1, uefivars.MixedGUID(p.Id))
+	file := boot.NewDppMediaFilePath(strings.Replace(loader, `\`, "/", -1))
+	return boot.EfiDevicePathProtocolList{hdd, file}, nil
+}
+
+// createEntry writes a new active boot entry with the lowest free number and
+// adds it to the front of BootOrder.
+func createEntry(label string, path boot.EfiDevicePathProtocolList, data []byte) (uint16, error) {
+	num, err := boot.FreeBootNumber()
+	if err != nil {
+		return 0, err
+	}
+	e := &boot.BootEntryVar{
+		Number: num,
+		EfiLoadOption: boot.EfiLoadOption{
+			Attributes:   boot.LoadOptionActive,
+			Description:  label,
+			FilePathList: path,
+			OptionalData: data,
+		},
+	}
+	if err := boot.WriteBootVar(e); err != nil {
+		return 0, err
+	}
+	order, err := boot.ReadBootOrder()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	return num, boot.WriteBootOrder(append([]uint16{num}, order...))
+}
+
+// removeEntry deletes a boot entry and removes it from BootOrder.
+func removeEntry(num uint16) error {
+	if err := boot.RemoveBootVar(num); err != nil {
+		return err
+	}
+	order, err := boot.ReadBootOrder()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var newOrder []uint16
+	for _, n := range order {
+		if n != num {
+			newOrder = append(newOrder, n)
+		}
+	}
+	return boot.WriteBootOrder(newOrder)
+}
+
+// setActive sets or clears the active attribute of a boot entry.
+func setActive(num uint16, active bool) error {
+	e, err := boot.ReadBootVar(num)
+	if err != nil {
+		return err
+	}
+	attrs := e.Attributes &^ boot.LoadOptionActive
+	if active {
+		attrs |= boot.LoadOptionActive
+	}
+	return boot.SetBootVarAttributes(num, attrs)
+}
+
+// list prints the boot vars as efibootmgr does.
+func list(w io.Writer, verbose bool) {
+	if c := boot.ReadBootCurrent(); c != nil {
+		fmt.Fprintf(w, "BootCurrent: %04X\n", c.Current)
+	}
+	if n, err := boot.ReadBootNext(); err == nil {
+		fmt.Fprintf(w, "BootNext: %04X\n", n)
+	}
+	if t, err := boot.ReadTimeout(); err == nil {
+		fmt.Fprintf(w, "Timeout: %d seconds\n", t)
+	}
+	if order, err := boot.ReadBootOrder(); err == nil {
+		var s []string
+		for _, n := range order {
+			s = append(s, fmt.Sprintf("%04X", n))
+		}
+		fmt.Fprintf(w, "BootOrder: %s\n", strings.Join(s, ","))
+	}
+	for _, e := range boot.AllBootEntryVars() {
+		mark := " "
+		if e.Active() {
+			mark = "*"
+		}
+		fmt.Fprintf(w, "Boot%04X%s %s", e.Number, mark, e.Description)
+		if verbose {
+			fmt.Fprintf(w, "\t%s", e.FilePathList)
+			if opts, err := uefivars.DecodeUTF16(e.OptionalData); err == nil && len(e.OptionalData) > 0 {
+				fmt.Fprintf(w, " %q", strings.TrimRight(opts, "\x00"))
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func run() error {
+	if *create {
+		path, err := hddPath(*disk, *part, *loader)
+		if err != nil {
+			return err
+		}
+		if _, err := createEntry(*label, path, optionalData(flag.Args(), *unicode)); err != nil {
+			return err
+		}
+	}
+	if *bootNum != "" {
+		num, err := parseNum(*bootNum)
+		if err != nil {
+			return err
+		}
+		switch {
+		case *deleteEntry:
+			err = removeEntry(num)
+		case *active, *inactive:
+			err = setActive(num, *active)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if *order != "" {
+		o, err := parseOrder(*order)
+		if err != nil {
+			return err
+		}
+		if err := boot.WriteBootOrder(o); err != nil {
+			return err
+		}
+	}
+	if *deleteOrder {
+		if err := boot.RemoveBootOrder(); err != nil {
+			return err
+		}
+	}
+	if *next != "" {
+		n, err := parseNum(*next)
+		if err != nil {
+			return err
+		}
+		if err := boot.WriteBootNext(n); err != nil {
+			return err
+		}
+	}
+	if *deleteNext {
+		if err := boot.RemoveBootNext(); err != nil {
+			return err
+		}
+	}
+	if *timeout >= 0 {
+		if *timeout > 0xffff {
+			return fmt.Errorf("invalid timeout %d", *timeout)
+		}
+		if err := boot.WriteTimeout(uint16(*timeout)); err != nil {
+			return err
+		}
+	}
+	if *deleteTO {
+		if err := boot.RemoveTimeout(); err != nil {
+			return err
+		}
+	}
+	list(os.Stdout, *verbose)
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uefivars"
+	"github.com/u-root/u-root/pkg/uefivars/boot"
+)
+
+// setupVarFs points uefivars at an empty fake efivarfs until the returned
+// function is called.
+func setupVarFs(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "efivarfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldFs, oldDir := uefivars.EfiVarFs, uefivars.EfiVarDir
+	uefivars.EfiVarFs, uefivars.EfiVarDir = dir, filepath.Join(dir, "does-not-exist")
+	return func() {
+		uefivars.EfiVarFs, uefivars.EfiVarDir = oldFs, oldDir
+		os.RemoveAll(dir)
+	}
+}
+
+func TestParseOrder(t *testing.T) {
+	got, err := parseOrder("0001,000A,1f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint16{1, 10, 0x1f}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseOrder = %v, want %v", got, want)
+	}
+	if _, err := parseOrder("1,,2"); err == nil {
+		t.Error("parseOrder(1,,2) succeeded, want error")
+	}
+}
+
+func TestEntries(t *testing.T) {
+	defer setupVarFs(t)()
+
+	if err := boot.WriteBootOrder([]uint16{5}); err != nil {
+		t.Fatal(err)
+	}
+	path := boot.EfiDevicePathProtocolList{boot.NewDppMediaFilePath("/EFI/Linux/vmlinuz.efi")}
+	for _, label := range []string{"first", "second"} {
+		if _, err := createEntry(label, path, optionalData([]string{"root=/dev/sda2", "ro"}, true)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := setActive(0, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := boot.WriteBootNext(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := boot.WriteTimeout(3); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	list(&b, true)
+	want := `BootNext: 0001
+Timeout: 3 seconds
+BootOrder: 0001,0000,0005
+Boot0000  first	File(/EFI/Linux/vmlinuz.efi) "root=/dev/sda2 ro"
+Boot0001* second	File(/EFI/Linux/vmlinuz.efi) "root=/dev/sda2 ro"
+`
+	if b.String() != want {
+		t.Errorf("list =\n%s\nwant\n%s", b.String(), want)
+	}
+
+	if err := removeEntry(0); err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	list(&b, false)
+	if strings.Contains(b.String(), "Boot0000") || !strings.Contains(b.String(), "BootOrder: 0001,0005\n") {
+		t.Errorf("after removing Boot0000:\n%s", b.String())
+	}
+}
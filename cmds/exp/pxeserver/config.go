@@ -0,0 +1,167 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// config is the JSON config file of pxeserver, e.g.
+//
+//	{
+//	  "pool_start": "192.168.0.100",
+//	  "pool_end": "192.168.0.200",
+//	  "netmask": "255.255.255.0",
+//	  "router": "192.168.0.1",
+//	  "dns": ["192.168.0.1"],
+//	  "lease_time": "1h",
+//	  "bootfiles": {
+//	    "bios": "pxelinux.0",
+//	    "x86_64-efi": "syslinux.efi",
+//	    "arm64-efi": "grubaa64.efi"
+//	  },
+//	  "reservations": [
+//	    {"mac": "52:54:00:12:34:56", "ip": "192.168.0.10", "bootfile": "ipxe.efi"}
+//	  ]
+//	}
+//
+// All fields are optional. Without a pool, the address from -your-ip is
+// handed out; bootfiles missing for an architecture default to -bootfilename.
+type config struct {
+	// PoolStart and PoolEnd are the first and last address handed out.
+	PoolStart string `json:"pool_start,omitempty"`
+	PoolEnd   string `json:"pool_end,omitempty"`
+
+	Netmask string   `json:"netmask,omitempty"`
+	Router  string   `json:"router,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+
+	// LeaseTime is a duration such as "12h".
+	LeaseTime string `json:"lease_time,omitempty"`
+
+	// Bootfiles maps the architectures in archNames to the file they
+	// boot.
+	Bootfiles map[string]string `json:"bootfiles,omitempty"`
+
+	RootPath string `json:"rootpath,omitempty"`
+
+	Reservations []reservation `json:"reservations,omitempty"`
+}
+
+// reservation is the address and boot file of a single client.
+type reservation struct {
+	MAC string `json:"mac"`
+	IP  string `json:"ip,omitempty"`
+
+	// Bootfile overrides the architecture's boot file.
+	Bootfile string `json:"bootfile,omitempty"`
+}
+
+// defaultLeaseTime is used if the config does not set a lease time.
+const defaultLeaseTime = time.Hour
+
+// archNames maps the client architectures of option 93 (RFC 4578 and the
+// IANA registry) to the keys of config.Bootfiles.
+var archNames = map[iana.Arch]string{
+	iana.INTEL_X86PC: "bios",
+	iana.EFI_IA32:    "ia32-efi",
+	iana.EFI_BC:      "x86_64-efi",
+	iana.EFI_X86_64:  "x86_64-efi",
+	0x0b:             "arm64-efi",
+}
+
+func readConfig(path string) (*config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return &c, nil
+}
+
+func parseIPs(ss []string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, s := range ss {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// newPool returns the address pool of c, or nil if it has none.
+func (c *config) newPool() (*pool, error) {
+	if c.PoolStart == "" && c.PoolEnd == "" {
+		return nil, nil
+	}
+	start, end := net.ParseIP(c.PoolStart).To4(), net.ParseIP(c.PoolEnd).To4()
+	if start == nil || end == nil {
+		return nil, fmt.Errorf("invalid pool %q-%q", c.PoolStart, c.PoolEnd)
+	}
+	leaseTime := defaultLeaseTime
+	if c.LeaseTime != "" {
+		d, err := time.ParseDuration(c.LeaseTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lease time: %v", err)
+		}
+		leaseTime = d
+	}
+	p, err := newPool(start, end, leaseTime)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range c.Reservations {
+		if r.IP == "" {
+			continue
+		}
+		mac, err := net.ParseMAC(r.MAC)
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(r.IP).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q reserved for %s", r.IP, mac)
+		}
+		p.reserve(mac, ip)
+	}
+	return p, nil
+}
+
+// reservation returns the reservation of mac, if any.
+func (c *config) reservation(mac net.HardwareAddr) *reservation {
+	for i, r := range c.Reservations {
+		if m, err := net.ParseMAC(r.MAC); err == nil && strings.EqualFold(m.String(), mac.String()) {
+			return &c.Reservations[i]
+		}
+	}
+	return nil
+}
+
+// bootfile returns the file the client sending m boots, or def if the config
+// does not say.
+func (c *config) bootfile(m *dhcpv4.DHCPv4, def string) string {
+	if r := c.reservation(m.ClientHWAddr); r != nil && r.Bootfile != "" {
+		return r.Bootfile
+	}
+	for _, arch := range m.ClientArch() {
+		if f, ok := c.Bootfiles[archNames[arch]]; ok {
+			return f
+		}
+	}
+	return def
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+var testConfig = &config{
+	Bootfiles: map[string]string{
+		"bios":       "pxelinux.0",
+		"x86_64-efi": "syslinux.efi",
+		"arm64-efi":  "grubaa64.efi",
+	},
+	Reservations: []reservation{
+		{MAC: "52:54:00:00:00:01", IP: "192.168.0.10", Bootfile: "ipxe.efi"},
+	},
+}
+
+func request(t *testing.T, mac string, modifiers ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	t.Helper()
+	m, err := dhcpv4.NewDiscovery(mustMAC(t, mac), modifiers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestBootfile(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		m    *dhcpv4.DHCPv4
+		want string
+	}{
+		{
+			name: "no arch",
+			m:    request(t, "52:54:00:00:00:02"),
+			want: "default",
+		},
+		{
+			name: "bios",
+			m:    request(t, "52:54:00:00:00:02", dhcpv4.WithOption(dhcpv4.OptClientArch(iana.INTEL_X86PC))),
+			want: "pxelinux.0",
+		},
+		{
+			name: "x86-64 EFI",
+			m:    request(t, "52:54:00:00:00:02", dhcpv4.WithOption(dhcpv4.OptClientArch(iana.EFI_BC))),
+			want: "syslinux.efi",
+		},
+		{
+			name: "arm64 EFI",
+			m:    request(t, "52:54:00:00:00:02", dhcpv4.WithOption(dhcpv4.OptClientArch(0x0b))),
+			want: "grubaa64.efi",
+		},
+		{
+			name: "unknown arch",
+			m:    request(t, "52:54:00:00:00:02", dhcpv4.WithOption(dhcpv4.OptClientArch(iana.EFI_ITANIUM))),
+			want: "default",
+		},
+		{
+			name: "reservation",
+			m:    request(t, "52:54:00:00:00:01", dhcpv4.WithOption(dhcpv4.OptClientArch(iana.INTEL_X86PC))),
+			want: "ipxe.efi",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testConfig.bootfile(tt.m, "default"); got != tt.want {
+				t.Errorf("bootfile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPool(t *testing.T) {
+	c := *testConfig
+	c.PoolStart, c.PoolEnd = "192.168.0.100", "192.168.0.200"
+	p, err := c.newPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := p.offer(mustMAC(t, "52:54:00:00:00:01"), nil); err != nil || !ip.Equal(net.ParseIP("192.168.0.10")) {
+		t.Errorf("offer() to reserved client = %v, %v, want 192.168.0.10", ip, err)
+	}
+
+	if p, err := testConfig.newPool(); p != nil || err != nil {
+		t.Errorf("newPool() without pool = %v, %v, want nil, nil", p, err)
+	}
+	c.LeaseTime = "forever"
+	if _, err := c.newPool(); err == nil {
+		t.Error("newPool() with invalid lease time succeeded")
+	}
+}
+
+func TestProxyReply(t *testing.T) {
+	s := &dserver4{
+		self:         net.ParseIP("192.168.0.1"),
+		bootfilename: "default",
+		conf:         testConfig,
+	}
+	if reply := s.proxyReply(request(t, "52:54:00:00:00:02"), dhcpv4.MessageTypeOffer); reply != nil {
+		t.Errorf("proxyReply() to non-PXE client = %v, want nil", reply)
+	}
+
+	m := request(t, "52:54:00:00:00:02",
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient:Arch:00007:UNDI:003016")),
+		dhcpv4.WithOption(dhcpv4.OptClientArch(iana.EFI_BC)))
+	reply := s.proxyReply(m, dhcpv4.MessageTypeOffer)
+	if reply == nil {
+		t.Fatal("proxyReply() = nil")
+	}
+	if reply.BootFileName != "syslinux.efi" {
+		t.Errorf("BootFileName = %q, want syslinux.efi", reply.BootFileName)
+	}
+	if !reply.YourIPAddr.Equal(net.IPv4zero) {
+		t.Errorf("YourIPAddr = %v, want 0.0.0.0", reply.YourIPAddr)
+	}
+	if !reply.ServerIPAddr.Equal(s.self) {
+		t.Errorf("ServerIPAddr = %v, want %v", reply.ServerIPAddr, s.self)
+	}
+	if got := reply.ClassIdentifier(); got != "PXEClient" {
+		t.Errorf("ClassIdentifier = %q, want PXEClient", got)
+	}
+}
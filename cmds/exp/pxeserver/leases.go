@@ -0,0 +1,167 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// offerTime is how long an offered address is kept for the client to
+// request it.
+const offerTime = time.Minute
+
+var errNoAddress = errors.New("no address available")
+
+// lease is an address handed out to a client.
+type lease struct {
+	// mac is the client's hardware address, or "" for a declined address.
+	mac    string
+	expiry time.Time
+}
+
+// pool hands out the IPv4 addresses from start to end, and keeps track of
+// their leases in memory.
+type pool struct {
+	start, end uint32
+	leaseTime  time.Duration
+
+	mu sync.Mutex
+	// leases are the current leases, by address.
+	leases map[uint32]*lease
+	// reserved maps hardware addresses to their fixed addresses, which
+	// may lie outside of the pool.
+	reserved   map[string]uint32
+	reservedIP map[uint32]bool
+
+	now func() time.Time
+}
+
+func ip4(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func ipFrom(u uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, u)
+	return ip
+}
+
+func newPool(start, end net.IP, leaseTime time.Duration) (*pool, error) {
+	if start.To4() == nil || end.To4() == nil || ip4(start) > ip4(end) {
+		return nil, fmt.Errorf("invalid pool %s-%s", start, end)
+	}
+	return &pool{
+		start:      ip4(start),
+		end:        ip4(end),
+		leaseTime:  leaseTime,
+		leases:     make(map[uint32]*lease),
+		reserved:   make(map[string]uint32),
+		reservedIP: make(map[uint32]bool),
+		now:        time.Now,
+	}, nil
+}
+
+// reserve always hands out ip to mac.
+func (p *pool) reserve(mac net.HardwareAddr, ip net.IP) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reserved[mac.String()] = ip4(ip)
+	p.reservedIP[ip4(ip)] = true
+}
+
+// free returns whether mac may have the address a.
+func (p *pool) free(mac string, a uint32) bool {
+	if a < p.start || a > p.end || p.reservedIP[a] {
+		return false
+	}
+	l, ok := p.leases[a]
+	return !ok || l.mac == mac || p.now().After(l.expiry)
+}
+
+// find returns the address mac has or should have, preferring requested.
+func (p *pool) find(mac string, requested net.IP) (uint32, bool) {
+	if a, ok := p.reserved[mac]; ok {
+		return a, true
+	}
+	for a, l := range p.leases {
+		if l.mac == mac && !p.now().After(l.expiry) {
+			return a, true
+		}
+	}
+	if requested.To4() != nil && p.free(mac, ip4(requested)) {
+		return ip4(requested), true
+	}
+	for a := p.start; a <= p.end && a >= p.start; a++ {
+		if p.free(mac, a) {
+			return a, true
+		}
+	}
+	return 0, false
+}
+
+// offer returns the address to offer to mac, which holds it for a while.
+func (p *pool) offer(mac net.HardwareAddr, requested net.IP) (net.IP, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	a, ok := p.find(mac.String(), requested)
+	if !ok {
+		return nil, errNoAddress
+	}
+	if !p.reservedIP[a] {
+		if l, ok := p.leases[a]; !ok || l.mac != mac.String() || l.expiry.Before(p.now().Add(offerTime)) {
+			p.leases[a] = &lease{mac: mac.String(), expiry: p.now().Add(offerTime)}
+		}
+	}
+	return ipFrom(a), nil
+}
+
+// ack leases ip to mac, if it may have it.
+func (p *pool) ack(mac net.HardwareAddr, ip net.IP) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ip.To4() == nil {
+		return errNoAddress
+	}
+	a := ip4(ip)
+	if r, ok := p.reserved[mac.String()]; ok {
+		if r != a {
+			return fmt.Errorf("%s is reserved %s", mac, ipFrom(r))
+		}
+		return nil
+	}
+	if !p.free(mac.String(), a) {
+		return fmt.Errorf("%s is not available to %s", ip, mac)
+	}
+	p.leases[a] = &lease{mac: mac.String(), expiry: p.now().Add(p.leaseTime)}
+	return nil
+}
+
+// release ends the lease of ip to mac.
+func (p *pool) release(mac net.HardwareAddr, ip net.IP) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ip.To4() == nil {
+		return
+	}
+	if l, ok := p.leases[ip4(ip)]; ok && l.mac == mac.String() {
+		delete(p.leases, ip4(ip))
+	}
+}
+
+// decline stops handing out ip for a lease time, as a client found it in
+// use.
+func (p *pool) decline(ip net.IP) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ip.To4() == nil || ip4(ip) < p.start || ip4(ip) > p.end {
+		return
+	}
+	p.leases[ip4(ip)] = &lease{expiry: p.now().Add(p.leaseTime)}
+}
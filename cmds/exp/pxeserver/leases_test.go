@@ -0,0 +1,122 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func mustMAC(t *testing.T, s string) net.HardwareAddr {
+	t.Helper()
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mac
+}
+
+func testPool(t *testing.T, start, end string) (*pool, *time.Time) {
+	t.Helper()
+	p, err := newPool(net.ParseIP(start), net.ParseIP(end), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	p.now = func() time.Time { return now }
+	return p, &now
+}
+
+func TestPoolOfferAck(t *testing.T) {
+	p, now := testPool(t, "10.0.0.10", "10.0.0.11")
+	a := mustMAC(t, "52:54:00:00:00:01")
+	b := mustMAC(t, "52:54:00:00:00:02")
+	c := mustMAC(t, "52:54:00:00:00:03")
+
+	ipA, err := p.offer(a, nil)
+	if err != nil || !ipA.Equal(net.ParseIP("10.0.0.10")) {
+		t.Fatalf("offer(a) = %v, %v, want 10.0.0.10", ipA, err)
+	}
+	// Offers are held for the client.
+	if ip, err := p.offer(a, nil); err != nil || !ip.Equal(ipA) {
+		t.Errorf("second offer(a) = %v, %v, want %v", ip, err, ipA)
+	}
+	ipB, err := p.offer(b, ipA)
+	if err != nil || !ipB.Equal(net.ParseIP("10.0.0.11")) {
+		t.Fatalf("offer(b) = %v, %v, want 10.0.0.11", ipB, err)
+	}
+	if ip, err := p.offer(c, nil); err != errNoAddress {
+		t.Errorf("offer(c) = %v, %v, want %v", ip, err, errNoAddress)
+	}
+
+	if err := p.ack(a, ipA); err != nil {
+		t.Errorf("ack(a) = %v", err)
+	}
+	if err := p.ack(c, ipA); err == nil {
+		t.Errorf("ack(c, %v) succeeded, want error", ipA)
+	}
+
+	// b's offer runs out, a's lease does not.
+	*now = now.Add(2 * offerTime)
+	if ip, err := p.offer(c, nil); err != nil || !ip.Equal(ipB) {
+		t.Errorf("offer(c) after b's offer expired = %v, %v, want %v", ip, err, ipB)
+	}
+	if ip, err := p.offer(a, nil); err != nil || !ip.Equal(ipA) {
+		t.Errorf("offer(a) with lease = %v, %v, want %v", ip, err, ipA)
+	}
+
+	p.release(a, ipA)
+	if err := p.ack(b, ipA); err != nil {
+		t.Errorf("ack(b) of released address = %v", err)
+	}
+}
+
+func TestPoolRequested(t *testing.T) {
+	p, _ := testPool(t, "10.0.0.10", "10.0.0.20")
+	a := mustMAC(t, "52:54:00:00:00:01")
+	b := mustMAC(t, "52:54:00:00:00:02")
+	if ip, err := p.offer(a, net.ParseIP("10.0.0.15")); err != nil || !ip.Equal(net.ParseIP("10.0.0.15")) {
+		t.Errorf("offer(a, 10.0.0.15) = %v, %v, want 10.0.0.15", ip, err)
+	}
+	// Addresses outside of the pool are not handed out.
+	if ip, err := p.offer(b, net.ParseIP("10.0.0.30")); err != nil || !ip.Equal(net.ParseIP("10.0.0.10")) {
+		t.Errorf("offer(b, 10.0.0.30) = %v, %v, want 10.0.0.10", ip, err)
+	}
+}
+
+func TestPoolReservation(t *testing.T) {
+	p, _ := testPool(t, "10.0.0.10", "10.0.0.11")
+	a := mustMAC(t, "52:54:00:00:00:01")
+	b := mustMAC(t, "52:54:00:00:00:02")
+	p.reserve(a, net.ParseIP("10.0.0.10"))
+
+	if ip, err := p.offer(b, net.ParseIP("10.0.0.10")); err != nil || !ip.Equal(net.ParseIP("10.0.0.11")) {
+		t.Errorf("offer(b) = %v, %v, want 10.0.0.11", ip, err)
+	}
+	if ip, err := p.offer(a, nil); err != nil || !ip.Equal(net.ParseIP("10.0.0.10")) {
+		t.Errorf("offer(a) = %v, %v, want 10.0.0.10", ip, err)
+	}
+	if err := p.ack(a, net.ParseIP("10.0.0.11")); err == nil {
+		t.Error("ack(a) of an address other than its reservation succeeded")
+	}
+	if err := p.ack(b, net.ParseIP("10.0.0.10")); err == nil {
+		t.Error("ack(b) of a's reservation succeeded")
+	}
+}
+
+func TestPoolDecline(t *testing.T) {
+	p, now := testPool(t, "10.0.0.10", "10.0.0.11")
+	a := mustMAC(t, "52:54:00:00:00:01")
+	p.decline(net.ParseIP("10.0.0.10"))
+	if ip, err := p.offer(a, nil); err != nil || !ip.Equal(net.ParseIP("10.0.0.11")) {
+		t.Errorf("offer(a) = %v, %v, want 10.0.0.11", ip, err)
+	}
+	p.release(a, net.ParseIP("10.0.0.11"))
+	*now = now.Add(2 * time.Hour)
+	if ip, err := p.offer(a, nil); err != nil || !ip.Equal(net.ParseIP("10.0.0.10")) {
+		t.Errorf("offer(a) after decline expired = %v, %v, want 10.0.0.10", ip, err)
+	}
+}
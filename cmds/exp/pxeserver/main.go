@@ -5,7 +5,16 @@
 // pxeserver is a test & lab PXE server that supports TFTP, HTTP, and DHCPv4.
 //
 // pxeserver can either respond to *all* DHCP requests, or a DHCP request from
-// a specific MAC. In either case, it will supply the same IP in all answers.
+// a specific MAC. Without a config file, it will supply the same IP in all
+// answers.
+//
+// The config file given by -config (see config) sets an address pool, whose
+// leases are kept in memory, addresses and boot files reserved for specific
+// MACs, and the boot file for each client architecture (DHCP option 93).
+//
+// With -proxy, pxeserver runs as a ProxyDHCP server next to the network's
+// DHCP server: it hands no addresses out, but tells PXE clients which file to
+// boot, on port 67 as well as on port 4011.
 package main
 
 import (
@@ -17,6 +26,7 @@ import (
 	"net"
 	"net/http"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,7 +38,8 @@ import (
 )
 
 var (
-	mac = flag.String("mac", "", "MAC address to respond to. Responds to all requests if unspecified.")
+	mac        = flag.String("mac", "", "MAC address to respond to. Responds to all requests if unspecified.")
+	configFile = flag.String("config", "", "JSON config file with address pool, reservations and boot files per architecture")
 
 	// DHCPv4-specific
 	ipv4         = flag.Bool("4", true, "IPv4 DHCP server")
@@ -37,6 +48,7 @@ var (
 	rootpath     = flag.String("rootpath", "", "RootPath option to serve via DHCPv4")
 	bootfilename = flag.String("bootfilename", "pxelinux.0", "Boot file to serve via DHCPv4")
 	inf          = flag.String("interface", "eth0", "Interface to serve DHCPv4 on")
+	proxy        = flag.Bool("proxy", false, "Only serve boot files as ProxyDHCP server, next to another DHCPv4 server")
 
 	// DHCPv6-specific
 	ipv6           = flag.Bool("6", false, "DHCPv6 server")
@@ -57,8 +69,30 @@ type dserver4 struct {
 	self         net.IP
 	bootfilename string
 	rootpath     string
+
+	// conf is the config file; it is empty if there is none.
+	conf *config
+	// pool hands out addresses; if it is nil, yourIP is handed out.
+	pool *pool
 }
 
+// PXE vendor options (option 43), see the PXE specification, section 2.4.
+const (
+	pxeDiscoveryControl = 6
+
+	// discoveryBootfile tells clients to boot the file in the reply
+	// instead of discovering boot servers.
+	discoveryBootfile = 0x08
+)
+
+const (
+	// pxeClient is the vendor class of PXE clients.
+	pxeClient = "PXEClient"
+
+	// pxePort is the port of PXE boot servers.
+	pxePort = 4011
+)
+
 func (s *dserver4) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
 	log.Printf("Handling request %v for peer %v", m, peer)
 
@@ -68,6 +102,16 @@ func (s *dserver4) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHC
 		replyType = dhcpv4.MessageTypeOffer
 	case dhcpv4.MessageTypeRequest:
 		replyType = dhcpv4.MessageTypeAck
+	case dhcpv4.MessageTypeRelease:
+		if s.pool != nil {
+			s.pool.release(m.ClientHWAddr, m.ClientIPAddr)
+		}
+		return
+	case dhcpv4.MessageTypeDecline:
+		if s.pool != nil {
+			s.pool.decline(m.RequestedIPAddress())
+		}
+		return
 	default:
 		log.Printf("Can't handle type %v", mt)
 		return
@@ -76,32 +120,72 @@ func (s *dserver4) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHC
 		log.Printf("Not responding to DHCP request for mac %s, which does not match %s", m.ClientHWAddr, s.mac)
 		return
 	}
+	// A client requesting an address from another server has declined
+	// our offer.
+	if sid := m.ServerIdentifier(); replyType == dhcpv4.MessageTypeAck && sid != nil && !sid.Equal(s.self) {
+		if s.pool != nil {
+			s.pool.release(m.ClientHWAddr, m.RequestedIPAddress())
+		}
+		return
+	}
+
+	yourIP, submask, leaseTime := s.yourIP, s.submask, dhcpv4.MaxLeaseTime
+	if s.pool != nil {
+		leaseTime = s.pool.leaseTime
+		var err error
+		if replyType == dhcpv4.MessageTypeOffer {
+			yourIP, err = s.pool.offer(m.ClientHWAddr, m.RequestedIPAddress())
+		} else {
+			yourIP = m.RequestedIPAddress()
+			if yourIP == nil {
+				// Renewing clients send their address as ciaddr.
+				yourIP = m.ClientIPAddr
+			}
+			err = s.pool.ack(m.ClientHWAddr, yourIP)
+		}
+		if err != nil {
+			log.Printf("No address for %s: %v", m.ClientHWAddr, err)
+			if replyType == dhcpv4.MessageTypeAck {
+				s.nak(conn, peer, m)
+			}
+			return
+		}
+	} else if r := s.conf.reservation(m.ClientHWAddr); r != nil && r.IP != "" {
+		yourIP = net.ParseIP(r.IP)
+	}
 
+	router := s.self
+	if s.conf.Router != "" {
+		router = net.ParseIP(s.conf.Router)
+	}
 	reply, err := dhcpv4.NewReplyFromRequest(m,
 		dhcpv4.WithMessageType(replyType),
 		dhcpv4.WithServerIP(s.self),
-		dhcpv4.WithRouter(s.self),
-		dhcpv4.WithNetmask(s.submask),
-		dhcpv4.WithYourIP(s.yourIP),
+		dhcpv4.WithRouter(router),
+		dhcpv4.WithNetmask(submask),
+		dhcpv4.WithYourIP(yourIP),
 		// RFC 2131, Section 4.3.1. Server Identifier: MUST
 		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.self)),
 		// RFC 2131, Section 4.3.1. IP lease time: MUST
-		dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(dhcpv4.MaxLeaseTime)),
+		dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(leaseTime)),
 	)
+	if err != nil {
+		log.Printf("Could not create reply for %v: %v", m, err)
+		return
+	}
 	// RFC 6842, MUST include Client Identifier if client specified one.
 	if val := m.Options.Get(dhcpv4.OptionClientIdentifier); len(val) > 0 {
 		reply.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionClientIdentifier, val))
 	}
-	if len(s.bootfilename) > 0 {
-		reply.BootFileName = s.bootfilename
+	if dns, err := parseIPs(s.conf.DNS); err == nil && len(dns) > 0 {
+		reply.UpdateOption(dhcpv4.OptDNS(dns...))
+	}
+	if bootfile := s.conf.bootfile(m, s.bootfilename); len(bootfile) > 0 {
+		reply.BootFileName = bootfile
 	}
 	if len(s.rootpath) > 0 {
 		reply.UpdateOption(dhcpv4.OptRootPath(s.rootpath))
 	}
-	if err != nil {
-		log.Printf("Could not create reply for %v: %v", m, err)
-		return
-	}
 
 	// Experimentally determined. You can't just blindly send a broadcast packet
 	// with the broadcast address. You can, however, send a broadcast packet
@@ -112,7 +196,7 @@ func (s *dserver4) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHC
 	// because this is not that expensive and it's just a tiny bit easier to
 	// follow IMHO.
 	if runtime.GOOS == "darwin" {
-		p := &net.UDPAddr{IP: s.yourIP.Mask(s.submask), Port: 68}
+		p := &net.UDPAddr{IP: yourIP.Mask(submask), Port: 68}
 		log.Printf("Changing %v to %v", peer, p)
 		peer = p
 	}
@@ -123,6 +207,98 @@ func (s *dserver4) dhcpHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHC
 	}
 }
 
+// nak refuses the request m.
+func (s *dserver4) nak(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
+	reply, err := dhcpv4.NewReplyFromRequest(m,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeNak),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.self)),
+	)
+	if err != nil {
+		log.Printf("Could not create NAK for %v: %v", m, err)
+		return
+	}
+	// RFC 2131, Section 4.3.2: NAKs are broadcast unless relayed.
+	if m.GatewayIPAddr == nil || m.GatewayIPAddr.IsUnspecified() {
+		peer = &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+	}
+	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
+		log.Printf("Could not write %v: %v", reply, err)
+	}
+}
+
+// proxyReply returns the ProxyDHCP reply of type mt to m: the boot file
+// without an address, for PXE clients that get their address from another
+// DHCP server. It returns nil for other clients.
+//
+// See the PXE specification, section 2.2.5.
+func (s *dserver4) proxyReply(m *dhcpv4.DHCPv4, mt dhcpv4.MessageType) *dhcpv4.DHCPv4 {
+	if !strings.HasPrefix(m.ClassIdentifier(), pxeClient) {
+		log.Printf("Not responding to %s, which is not a PXE client", m.ClientHWAddr)
+		return nil
+	}
+	if s.mac != nil && !bytes.Equal(m.ClientHWAddr, s.mac) {
+		log.Printf("Not responding to DHCP request for mac %s, which does not match %s", m.ClientHWAddr, s.mac)
+		return nil
+	}
+	reply, err := dhcpv4.NewReplyFromRequest(m,
+		dhcpv4.WithMessageType(mt),
+		dhcpv4.WithServerIP(s.self),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.self)),
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier(pxeClient)),
+		dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation,
+			[]byte{pxeDiscoveryControl, 1, discoveryBootfile, 0xff})),
+	)
+	if err != nil {
+		log.Printf("Could not create reply for %v: %v", m, err)
+		return nil
+	}
+	// The client keeps the address the DHCP server gave it.
+	reply.YourIPAddr = net.IPv4zero
+	reply.BootFileName = s.conf.bootfile(m, s.bootfilename)
+	if len(s.rootpath) > 0 {
+		reply.UpdateOption(dhcpv4.OptRootPath(s.rootpath))
+	}
+	// Clients identify the reply by their UUID (option 97).
+	if val := m.Options.Get(dhcpv4.OptionClientMachineIdentifier); len(val) > 0 {
+		reply.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionClientMachineIdentifier, val))
+	}
+	return reply
+}
+
+// proxyHandler answers the DHCP discovery of PXE clients on port 67
+// alongside the network's DHCP server.
+func (s *dserver4) proxyHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
+	if m.MessageType() != dhcpv4.MessageTypeDiscover {
+		return
+	}
+	reply := s.proxyReply(m, dhcpv4.MessageTypeOffer)
+	if reply == nil {
+		return
+	}
+	log.Printf("Sending ProxyDHCP %v to %v", reply.Summary(), peer)
+	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
+		log.Printf("Could not write %v: %v", reply, err)
+	}
+}
+
+// pxeHandler answers the boot server requests PXE clients send to port 4011
+// after they got their address.
+func (s *dserver4) pxeHandler(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
+	switch m.MessageType() {
+	case dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeInform:
+	default:
+		return
+	}
+	reply := s.proxyReply(m, dhcpv4.MessageTypeAck)
+	if reply == nil {
+		return
+	}
+	log.Printf("Sending PXE boot server %v to %v", reply.Summary(), peer)
+	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
+		log.Printf("Could not write %v: %v", reply, err)
+	}
+}
+
 type dserver6 struct {
 	mac         net.HardwareAddr
 	yourIP      net.IP
@@ -199,6 +375,24 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	conf := &config{}
+	if len(*configFile) > 0 {
+		if conf, err = readConfig(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	pool, err := conf.newPool()
+	if err != nil {
+		log.Fatal(err)
+	}
+	submask := yourNet.Mask
+	if len(conf.Netmask) > 0 {
+		m := net.ParseIP(conf.Netmask).To4()
+		if m == nil {
+			log.Fatalf("Invalid netmask %q", conf.Netmask)
+		}
+		submask = net.IPMask(m)
+	}
 
 	var wg sync.WaitGroup
 	if len(*tftpDir) != 0 {
@@ -232,13 +426,34 @@ func main() {
 				mac:          maca,
 				self:         net.ParseIP(*selfIP),
 				yourIP:       yourIP,
-				submask:      yourNet.Mask,
+				submask:      submask,
 				bootfilename: *bootfilename,
 				rootpath:     *rootpath,
+				conf:         conf,
+				pool:         pool,
+			}
+			if len(conf.RootPath) > 0 {
+				s.rootpath = conf.RootPath
+			}
+
+			handler := s.dhcpHandler
+			if *proxy {
+				handler = s.proxyHandler
+				go func() {
+					laddr := &net.UDPAddr{Port: pxePort}
+					server, err := server4.NewServer(*inf, laddr, s.pxeHandler)
+					if err != nil {
+						log.Fatal(err)
+					}
+					log.Println("starting PXE boot server")
+					if err := server.Serve(); err != nil {
+						log.Fatal(err)
+					}
+				}()
 			}
 
 			laddr := &net.UDPAddr{Port: dhcpv4.ServerPort}
-			server, err := server4.NewServer(*inf, laddr, s.dhcpHandler)
+			server, err := server4.NewServer(*inf, laddr, handler)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -0,0 +1,191 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// entry is an entry of a JSON directory listing.
+type entry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mod_time"`
+	IsDir   bool      `json:"is_dir"`
+}
+
+// fileHandler serves the files in dir, and stores files PUT into it if
+// upload is set.
+type fileHandler struct {
+	dir    string
+	upload bool
+
+	// tokens maps user names to the tokens they authenticate with, using
+	// HTTP basic authentication. If it is empty, anyone may access dir.
+	tokens map[string]string
+
+	files http.Handler
+}
+
+func newFileHandler(dir string, upload bool, tokens map[string]string) *fileHandler {
+	return &fileHandler{
+		dir:    dir,
+		upload: upload,
+		tokens: tokens,
+		files:  maxAgeHandler(http.FileServer(http.Dir(dir))),
+	}
+}
+
+// authorized checks the basic authentication credentials of r.
+func (h *fileHandler) authorized(r *http.Request) bool {
+	if len(h.tokens) == 0 {
+		return true
+	}
+	user, token, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	want, ok := h.tokens[user]
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+// localPath returns the file name of the URL path p within dir.
+func (h *fileHandler) localPath(p string) string {
+	return filepath.Join(h.dir, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+func (h *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="srvfiles"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if wantsJSON(r) {
+			h.serveJSON(w, r)
+			return
+		}
+		h.files.ServeHTTP(w, r)
+
+	case http.MethodPut:
+		if !h.upload {
+			http.Error(w, "uploads are disabled", http.StatusMethodNotAllowed)
+			return
+		}
+		h.put(w, r)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// wantsJSON returns whether r asks for a JSON directory listing, with
+// ?format=json or by accepting application/json.
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// serveJSON serves the listing of a directory as JSON, and files as usual.
+func (h *fileHandler) serveJSON(w http.ResponseWriter, r *http.Request) {
+	name := h.localPath(r.URL.Path)
+	fi, err := os.Stat(name)
+	if err != nil || !fi.IsDir() {
+		h.files.ServeHTTP(w, r)
+		return
+	}
+	fis, err := ioutil.ReadDir(name)
+	if err != nil {
+		http.Error(w, "cannot read directory", http.StatusInternalServerError)
+		return
+	}
+	entries := make([]entry, 0, len(fis))
+	for _, fi := range fis {
+		entries = append(entries, entry{
+			Name:    fi.Name(),
+			Size:    fi.Size(),
+			Mode:    fi.Mode().String(),
+			ModTime: fi.ModTime(),
+			IsDir:   fi.IsDir(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		log.Printf("Writing listing of %s: %v", r.URL.Path, err)
+	}
+}
+
+// put stores the request body as the file named by the URL, creating the
+// directories leading to it, so that directories can be uploaded one file
+// at a time. A URL ending in a slash creates a directory.
+//
+// The file is replaced only once the body is complete.
+func (h *fileHandler) put(w http.ResponseWriter, r *http.Request) {
+	name := h.localPath(r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") {
+		if err := os.MkdirAll(name, 0755); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	if name == filepath.Clean(h.dir) {
+		http.Error(w, "cannot replace the served directory", http.StatusBadRequest)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".srvfiles-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r.Body); err != nil {
+		tmp.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusCreated
+	if _, err := os.Stat(name); err == nil {
+		status = http.StatusNoContent
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Stored %s", r.URL.Path)
+	w.WriteHeader(status)
+}
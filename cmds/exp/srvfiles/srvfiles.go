@@ -5,32 +5,66 @@
 // Serve files on the network.
 //
 // Synopsis:
-//     srvfiles [--h=HOST] [--p=PORT] [--d=DIR]
+//     srvfiles [--h=HOST] [--p=PORT] [--d=DIR] [--tls [--cert=FILE --key=FILE] [--client-ca=FILE]] [--tokens=FILE] [--upload]
+//
+// Description:
+//     Files are served with range requests, so that interrupted downloads
+//     can be resumed. Directories are listed as JSON if the request has
+//     ?format=json or accepts application/json.
+//
+//     With --tls, files are served over HTTPS. Without a certificate, a
+//     self-signed one is made, and the SHA-256 pin of its public key is
+//     printed for clients to verify it with (see curl.TLSOptions).
+//
+//     With --upload, files are stored with PUT requests; missing
+//     directories are created, and a URL ending in a slash creates a
+//     directory.
 //
 // Options:
-//     --h: hostname (default: 127.0.0.1)
-//     --p: port number (default: 8080)
-//     --d: directory to serve (default: .)
+//     --h:         hostname (default: 127.0.0.1)
+//     --p:         port number (default: 8080)
+//     --d:         directory to serve (default: .)
+//     --tls:       serve HTTPS
+//     --cert:      PEM certificate file to serve HTTPS with
+//     --key:       PEM key file of the certificate
+//     --client-ca: PEM file of CAs that client certificates must be signed by
+//     --tokens:    file of user:token lines that clients must authenticate
+//                  with using HTTP basic authentication
+//     --upload:    allow storing files with PUT
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/curl"
 )
 
 var (
-	host = flag.String("h", "127.0.0.1", "hostname")
-	port = flag.String("p", "8080", "port number")
-	dir  = flag.String("d", ".", "directory to serve")
+	host     = flag.String("h", "127.0.0.1", "hostname")
+	port     = flag.String("p", "8080", "port number")
+	dir      = flag.String("d", ".", "directory to serve")
+	useTLS   = flag.Bool("tls", false, "serve HTTPS")
+	certFile = flag.String("cert", "", "PEM certificate file; a self-signed certificate is made if empty")
+	keyFile  = flag.String("key", "", "PEM key file of the certificate")
+	clientCA = flag.String("client-ca", "", "PEM file of the CAs that client certificates must be signed by")
+	tokens   = flag.String("tokens", "", "file of user:token lines for HTTP basic authentication")
+	upload   = flag.Bool("upload", false, "allow storing files with PUT")
 )
 
+// cacheHeaders are removed from requests, so that files are always served.
+// If-Range is kept, so that a resumed download is not continued with a
+// changed file.
 var cacheHeaders = []string{
 	"ETag",
 	"If-Modified-Since",
 	"If-None-Match",
-	"If-Range",
 	"If-Unmodified-Since",
 }
 
@@ -47,8 +81,52 @@ func maxAgeHandler(h http.Handler) http.Handler {
 	})
 }
 
+// readTokens reads the user:token lines of name.
+func readTokens(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("%s: line %q is not user:token", name, line)
+		}
+		t[line[:i]] = line[i+1:]
+	}
+	return t, s.Err()
+}
+
 func main() {
 	flag.Parse()
-	http.Handle("/", maxAgeHandler(http.FileServer(http.Dir(*dir))))
-	log.Fatal(http.ListenAndServe(net.JoinHostPort(*host, *port), nil))
+	var t map[string]string
+	if *tokens != "" {
+		var err error
+		if t, err = readTokens(*tokens); err != nil {
+			log.Fatal(err)
+		}
+	}
+	http.Handle("/", newFileHandler(*dir, *upload, t))
+	addr := net.JoinHostPort(*host, *port)
+
+	if !*useTLS {
+		log.Fatal(http.ListenAndServe(addr, nil))
+	}
+	c, err := tlsConfig(*host, *certFile, *keyFile, *clientCA)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Certificate public key pin (SHA-256): %s", curl.PublicKeyPin(c.Certificates[0].Leaf))
+	s := &http.Server{
+		Addr:      addr,
+		TLSConfig: c,
+	}
+	log.Fatal(s.ListenAndServeTLS("", ""))
 }
@@ -0,0 +1,207 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/curl"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+func testDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "srvfiles-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "disk.img"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func do(t *testing.T, method, u string, body string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, u, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+func TestRange(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	ts := httptest.NewServer(newFileHandler(dir, false, nil))
+	defer ts.Close()
+
+	resp, body := do(t, http.MethodGet, ts.URL+"/disk.img", "", http.Header{"Range": {"bytes=4-"}})
+	if resp.StatusCode != http.StatusPartialContent || body != "456789" {
+		t.Errorf("GET with range = %d %q, want %d %q", resp.StatusCode, body, http.StatusPartialContent, "456789")
+	}
+}
+
+func TestJSONListing(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	ts := httptest.NewServer(newFileHandler(dir, false, nil))
+	defer ts.Close()
+
+	for _, h := range []http.Header{
+		{"Accept": {"application/json"}},
+		nil,
+	} {
+		u := ts.URL + "/"
+		if h == nil {
+			u += "?format=json"
+		}
+		resp, body := do(t, http.MethodGet, u, "", h)
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("Content-Type = %q, want application/json", ct)
+		}
+		var entries []entry
+		if err := json.Unmarshal([]byte(body), &entries); err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 {
+			t.Fatalf("listing = %v, want 2 entries", entries)
+		}
+		if e := entries[0]; e.Name != "disk.img" || e.Size != 10 || e.IsDir {
+			t.Errorf("entries[0] = %+v, want disk.img of 10 bytes", e)
+		}
+		if e := entries[1]; e.Name != "sub" || !e.IsDir {
+			t.Errorf("entries[1] = %+v, want directory sub", e)
+		}
+	}
+}
+
+func TestPut(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewServer(newFileHandler(dir, false, nil))
+	if resp, _ := do(t, http.MethodPut, ts.URL+"/new", "data", nil); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("PUT without -upload = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+	ts.Close()
+
+	ts = httptest.NewServer(newFileHandler(dir, true, nil))
+	defer ts.Close()
+	for _, tt := range []struct {
+		path   string
+		body   string
+		status int
+		file   string
+	}{
+		{path: "/images/a/disk.img", body: "image", status: http.StatusCreated, file: "images/a/disk.img"},
+		{path: "/images/a/disk.img", body: "image2", status: http.StatusNoContent, file: "images/a/disk.img"},
+		{path: "/empty/", status: http.StatusCreated, file: "empty"},
+		// Stays within dir.
+		{path: "/../../escape", body: "x", status: http.StatusCreated, file: "escape"},
+	} {
+		resp, _ := do(t, http.MethodPut, ts.URL+tt.path, tt.body, nil)
+		if resp.StatusCode != tt.status {
+			t.Errorf("PUT %s = %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+		fi, err := os.Stat(filepath.Join(dir, tt.file))
+		if err != nil {
+			t.Errorf("PUT %s: %v", tt.path, err)
+			continue
+		}
+		if fi.IsDir() {
+			continue
+		}
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, tt.file)); string(b) != tt.body {
+			t.Errorf("PUT %s stored %q, want %q", tt.path, b, tt.body)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	ts := httptest.NewServer(newFileHandler(dir, false, map[string]string{"alice": "secret"}))
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		user, token string
+		status      int
+	}{
+		{status: http.StatusUnauthorized},
+		{user: "alice", token: "wrong", status: http.StatusUnauthorized},
+		{user: "bob", token: "secret", status: http.StatusUnauthorized},
+		{user: "alice", token: "secret", status: http.StatusOK},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/disk.img", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET as %q:%q = %d, want %d", tt.user, tt.token, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestSelfSignedPin(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	c, err := tlsConfig("127.0.0.1", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(newFileHandler(dir, false, nil))
+	ts.TLS = c
+	ts.StartTLS()
+	defer ts.Close()
+
+	client, err := curl.NewHTTPSClient(curl.TLSOptions{Pins: []string{curl.PublicKeyPin(c.Certificates[0].Leaf)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(ts.URL + "/disk.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := client.Fetch(context.Background(), u)
+	if err != nil {
+		t.Fatalf("Fetch = %v", err)
+	}
+	if b, err := uio.ReadAll(r); err != nil || string(b) != "0123456789" {
+		t.Errorf("Fetch = %q, %v, want 0123456789", b, err)
+	}
+}
@@ -85,6 +85,16 @@ func getBBLock(bblock string) (*lockfile.Lockfile, error) {
 // pkgs is a list of Go import paths. If nil is returned, binaryPath will hold
 // the busybox-style binary.
 func BuildBusybox(env golang.Environ, pkgs []string, binaryPath string) error {
+	return buildBusybox(env, pkgs, binaryPath, nil)
+}
+
+// buildBusybox builds a busybox, using and filling c if it is not nil.
+func buildBusybox(env golang.Environ, pkgs []string, binaryPath string, c *Cache) error {
+	const (
+		bbImportPath         = "github.com/u-root/u-root/pkg/bb/bbmain"
+		bbTemplateImportPath = "github.com/u-root/u-root/pkg/bb/bbmain/cmd"
+	)
+
 	urootPkg, err := env.Package("github.com/u-root/u-root")
 	if err != nil {
 		return err
@@ -108,6 +118,57 @@ func BuildBusybox(env golang.Environ, pkgs []string, binaryPath string) error {
 	}
 	defer l.Unlock()
 
+	var cmdPkgs []string
+	seenPackages := map[string]bool{}
+	for _, pkg := range pkgs {
+		basePkg := path.Base(pkg)
+		if _, ok := skip[basePkg]; ok {
+			continue
+		}
+		if _, ok := seenPackages[path.Base(pkg)]; ok {
+			return fmt.Errorf("failed to build with bb: found duplicate pkgs %s", basePkg)
+		}
+		seenPackages[basePkg] = true
+		cmdPkgs = append(cmdPkgs, pkg)
+	}
+
+	// With a cache, look for the busybox of these exact sources first.
+	var (
+		keys      []string
+		binaryKey string
+	)
+	if c != nil {
+		k, err := newKeyer(env)
+		if err != nil {
+			return err
+		}
+		for _, pkg := range cmdPkgs {
+			p, err := env.Package(pkg)
+			if err != nil {
+				return err
+			}
+			key, err := k.packageKey(p, bbImportPath)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		template, err := env.Package(bbTemplateImportPath)
+		if err != nil {
+			return err
+		}
+		if binaryKey, err = k.binaryKey(template, cmdPkgs, keys); err != nil {
+			return err
+		}
+		if ok, err := c.getBinary(binaryKey, binaryPath); err != nil {
+			return err
+		} else if ok {
+			// No package needed rewriting.
+			c.Stats.PackageHits += len(keys)
+			return nil
+		}
+	}
+
 	bbDir := filepath.Join(urootPkg.Dir, "bb")
 	// Blow bb away before trying to re-create it.
 	if err := os.RemoveAll(bbDir); err != nil {
@@ -120,26 +181,36 @@ func BuildBusybox(env golang.Environ, pkgs []string, binaryPath string) error {
 	var bbPackages []string
 	// Move and rewrite package files.
 	importer := importer.For("source", nil)
-	seenPackages := map[string]bool{}
-	for _, pkg := range pkgs {
-		basePkg := path.Base(pkg)
-		if _, ok := skip[basePkg]; ok {
+	for i, pkg := range cmdPkgs {
+		bbPackages = append(bbPackages, path.Join(pkg, ".bb"))
+
+		if c == nil {
+			// TODO: use bbDir to derive import path below or vice versa.
+			if err := RewritePackage(env, pkg, bbImportPath, importer); err != nil {
+				return err
+			}
 			continue
 		}
-		if _, ok := seenPackages[path.Base(pkg)]; ok {
-			return fmt.Errorf("failed to build with bb: found duplicate pkgs %s", basePkg)
-		}
-		seenPackages[basePkg] = true
 
-		// TODO: use bbDir to derive import path below or vice versa.
-		if err := RewritePackage(env, pkg, "github.com/u-root/u-root/pkg/bb/bbmain", importer); err != nil {
+		p, err := env.Package(pkg)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(p.Dir, ".bb")
+		if ok, err := c.getPackage(keys[i], dest); err != nil {
+			return err
+		} else if ok {
+			continue
+		}
+		if err := RewritePackage(env, pkg, bbImportPath, importer); err != nil {
+			return err
+		}
+		if err := c.putPackage(keys[i], dest); err != nil {
 			return err
 		}
-
-		bbPackages = append(bbPackages, path.Join(pkg, ".bb"))
 	}
 
-	bb, err := NewPackageFromEnv(env, "github.com/u-root/u-root/pkg/bb/bbmain/cmd", importer)
+	bb, err := NewPackageFromEnv(env, bbTemplateImportPath, importer)
 	if err != nil {
 		return err
 	}
@@ -155,7 +226,13 @@ func BuildBusybox(env golang.Environ, pkgs []string, binaryPath string) error {
 	}
 
 	// Compile bb.
-	return env.Build("github.com/u-root/u-root/bb", binaryPath, golang.BuildOpts{})
+	if err := env.Build("github.com/u-root/u-root/bb", binaryPath, golang.BuildOpts{}); err != nil {
+		return err
+	}
+	if c != nil {
+		return c.putBinary(binaryKey, binaryPath)
+	}
+	return nil
 }
 
 // CreateBBMainSource creates a bb Go command that imports all given pkgs.
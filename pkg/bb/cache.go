@@ -0,0 +1,311 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/u-root/u-root/pkg/cp"
+	"github.com/u-root/u-root/pkg/golang"
+)
+
+// cacheVersion is part of every cache key. Change it whenever the rewrite or
+// the way the busybox is compiled changes, so old entries are not used.
+const cacheVersion = "u-root bb cache 1"
+
+// buildEnv are the variables of the process environment that change what
+// `go build` produces.
+var buildEnv = []string{
+	"GO111MODULE",
+	"GO386",
+	"GOAMD64",
+	"GOARM",
+	"GOEXPERIMENT",
+	"GOFLAGS",
+	"GOMIPS",
+	"GOMIPS64",
+	"GOPPC64",
+}
+
+// Cache is a content-addressed cache of rewritten command packages and
+// busybox binaries.
+//
+// A rewritten package is keyed on the Go environment and the sources of the
+// package and of all the packages it depends on outside of GOROOT. A busybox
+// binary is keyed on the keys of its packages. Only commands whose sources or
+// dependencies changed are rewritten again, and a busybox of unchanged
+// commands is not compiled again.
+//
+// Entries are never modified once written, so several builds may share a
+// Cache directory.
+type Cache struct {
+	// Dir is the cache directory.
+	Dir string
+
+	// Stats counts the hits and misses of all builds using this Cache.
+	Stats CacheStats
+}
+
+// CacheStats are the hits and misses of a Cache.
+//
+// A package hit is a command that was not rewritten, including those of a
+// busybox binary hit.
+type CacheStats struct {
+	PackageHits   int
+	PackageMisses int
+	BinaryHits    int
+	BinaryMisses  int
+}
+
+// PackageHitRate is the fraction of commands that were not rewritten.
+func (s CacheStats) PackageHitRate() float64 {
+	return rate(s.PackageHits, s.PackageMisses)
+}
+
+// BinaryHitRate is the fraction of busybox binaries found in the cache.
+func (s CacheStats) BinaryHitRate() float64 {
+	return rate(s.BinaryHits, s.BinaryMisses)
+}
+
+func rate(hits, misses int) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+func (s CacheStats) String() string {
+	return fmt.Sprintf("packages: %d hits, %d misses (%.0f%%); binaries: %d hits, %d misses (%.0f%%)",
+		s.PackageHits, s.PackageMisses, 100*s.PackageHitRate(),
+		s.BinaryHits, s.BinaryMisses, 100*s.BinaryHitRate())
+}
+
+// DefaultCacheDir is the directory of the bb cache in the user's cache
+// directory, e.g. $HOME/.cache/u-root/bb.
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "u-root", "bb"), nil
+}
+
+// NewCache returns a Cache in dir, creating dir if it does not exist.
+func NewCache(dir string) (*Cache, error) {
+	for _, d := range []string{"pkg", "bin"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, fmt.Errorf("bb cache: %v", err)
+		}
+	}
+	return &Cache{Dir: dir}, nil
+}
+
+// BuildBusybox is BuildBusybox using and filling the cache.
+func (c *Cache) BuildBusybox(env golang.Environ, pkgs []string, binaryPath string) error {
+	return buildBusybox(env, pkgs, binaryPath, c)
+}
+
+// keyer computes cache keys in one Go environment.
+type keyer struct {
+	env golang.Environ
+	key []byte
+
+	// digests are the digests of packages by directory, as many commands
+	// share dependencies.
+	digests map[string][]byte
+}
+
+func newKeyer(env golang.Environ) (*keyer, error) {
+	v, err := env.Version()
+	if err != nil {
+		return nil, fmt.Errorf("bb cache: %v", err)
+	}
+	h := sha256.New()
+	fmt.Fprintln(h, cacheVersion)
+	fmt.Fprintln(h, v)
+	fmt.Fprintln(h, env.Env())
+	fmt.Fprintln(h, env.BuildTags)
+	for _, k := range buildEnv {
+		fmt.Fprintf(h, "%s=%s\n", k, os.Getenv(k))
+	}
+	return &keyer{
+		env:     env,
+		key:     h.Sum(nil),
+		digests: make(map[string][]byte),
+	}, nil
+}
+
+// digest hashes the build inputs of p and of all its dependencies outside of
+// GOROOT: Go, cgo, C, C++, Objective-C, Fortran, assembly, header, SWIG and
+// syso files. The Go version in the environment key covers GOROOT.
+func (k *keyer) digest(p *build.Package) ([]byte, error) {
+	if d, ok := k.digests[p.Dir]; ok {
+		return d, nil
+	}
+	h := sha256.New()
+	fmt.Fprintln(h, p.ImportPath)
+
+	var files []string
+	for _, fs := range [][]string{
+		p.GoFiles, p.CgoFiles, p.CFiles, p.CXXFiles, p.MFiles, p.HFiles,
+		p.FFiles, p.SFiles, p.SwigFiles, p.SwigCXXFiles, p.SysoFiles,
+	} {
+		files = append(files, fs...)
+	}
+	sort.Strings(files)
+	for _, name := range files {
+		f, err := os.Open(filepath.Join(p.Dir, name))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintln(h, name)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// p.Imports is sorted.
+	for _, imp := range p.Imports {
+		if imp == "C" || imp == "unsafe" {
+			continue
+		}
+		dep, err := k.env.Context.Import(imp, p.Dir, 0)
+		if err != nil {
+			return nil, err
+		}
+		if dep.Goroot {
+			continue
+		}
+		d, err := k.digest(dep)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(d)
+	}
+	d := h.Sum(nil)
+	k.digests[p.Dir] = d
+	return d, nil
+}
+
+// packageKey is the key of p rewritten to register with bbImportPath.
+func (k *keyer) packageKey(p *build.Package, bbImportPath string) (string, error) {
+	d, err := k.digest(p)
+	if err != nil {
+		return "", fmt.Errorf("bb cache: hashing %s: %v", p.ImportPath, err)
+	}
+	h := sha256.New()
+	h.Write(k.key)
+	fmt.Fprintln(h, bbImportPath)
+	fmt.Fprintln(h, filepath.Base(p.Dir))
+	h.Write(d)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// binaryKey is the key of the busybox of template and the packages with
+// pkgKeys, in order.
+func (k *keyer) binaryKey(template *build.Package, pkgs, pkgKeys []string) (string, error) {
+	d, err := k.digest(template)
+	if err != nil {
+		return "", fmt.Errorf("bb cache: hashing %s: %v", template.ImportPath, err)
+	}
+	h := sha256.New()
+	h.Write(k.key)
+	h.Write(d)
+	for i, pkg := range pkgs {
+		fmt.Fprintln(h, pkg, pkgKeys[i])
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *Cache) packagePath(key string) string {
+	return filepath.Join(c.Dir, "pkg", key)
+}
+
+func (c *Cache) binaryPath(key string) string {
+	return filepath.Join(c.Dir, "bin", key)
+}
+
+// getPackage copies the rewritten package with key to dest. An entry with no
+// files is a package without a main function, which is not rewritten.
+func (c *Cache) getPackage(key, dest string) (bool, error) {
+	entry := c.packagePath(key)
+	files, err := ioutil.ReadDir(entry)
+	if os.IsNotExist(err) {
+		c.Stats.PackageMisses++
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	c.Stats.PackageHits++
+
+	if err := os.RemoveAll(dest); err != nil {
+		return false, fmt.Errorf("error removing stale directory %q: %v", dest, err)
+	}
+	if len(files) == 0 {
+		return true, nil
+	}
+	return true, cp.CopyTree(entry, dest)
+}
+
+// putPackage adds the package rewritten into dir with key.
+func (c *Cache) putPackage(key, dir string) error {
+	return c.put(c.packagePath(key), func(tmp string) error {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return os.Mkdir(tmp, 0755)
+		}
+		return cp.CopyTree(dir, tmp)
+	})
+}
+
+// getBinary copies the busybox with key to binaryPath.
+func (c *Cache) getBinary(key, binaryPath string) (bool, error) {
+	entry := c.binaryPath(key)
+	if _, err := os.Stat(entry); os.IsNotExist(err) {
+		c.Stats.BinaryMisses++
+		return false, nil
+	}
+	c.Stats.BinaryHits++
+	return true, cp.Copy(entry, binaryPath)
+}
+
+// putBinary adds the busybox at binaryPath with key.
+func (c *Cache) putBinary(key, binaryPath string) error {
+	return c.put(c.binaryPath(key), func(tmp string) error {
+		return cp.Copy(binaryPath, tmp)
+	})
+}
+
+// put creates entry by writing it to a temporary path with write and renaming
+// that, so that no build sees half an entry.
+func (c *Cache) put(entry string, write func(tmp string) error) error {
+	dir, err := ioutil.TempDir(c.Dir, "tmp-")
+	if err != nil {
+		return fmt.Errorf("bb cache: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "entry")
+	if err := write(tmp); err != nil {
+		return fmt.Errorf("bb cache: %v", err)
+	}
+	if err := os.Rename(tmp, entry); err != nil {
+		// Another build may have added the same entry.
+		if _, serr := os.Stat(entry); serr == nil {
+			return nil
+		}
+		return fmt.Errorf("bb cache: %v", err)
+	}
+	return nil
+}
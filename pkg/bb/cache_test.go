@@ -0,0 +1,125 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/golang"
+)
+
+func TestCacheBuildBusybox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "u-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs := []string{"github.com/u-root/u-root/pkg/uroot/test/foo"}
+	build := func(want CacheStats) {
+		bin := filepath.Join(dir, "foo")
+		os.Remove(bin)
+		if err := c.BuildBusybox(golang.Default(), pkgs, bin); err != nil {
+			t.Fatal(err)
+		}
+		if c.Stats != want {
+			t.Errorf("Stats = %+v, want %+v", c.Stats, want)
+		}
+		if o, err := exec.Command(bin).CombinedOutput(); err != nil {
+			t.Fatalf("foo failed: %v %v", string(o), err)
+		}
+	}
+
+	build(CacheStats{PackageMisses: 1, BinaryMisses: 1})
+	build(CacheStats{PackageMisses: 1, PackageHits: 1, BinaryMisses: 1, BinaryHits: 1})
+
+	// Without the binary, the rewritten package is still used.
+	if err := os.RemoveAll(filepath.Join(c.Dir, "bin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(c.Dir, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	build(CacheStats{PackageMisses: 1, PackageHits: 2, BinaryMisses: 2, BinaryHits: 1})
+}
+
+func TestCacheKeys(t *testing.T) {
+	gopath, err := ioutil.TempDir("", "u-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gopath)
+
+	write := func(name, content string) {
+		p := filepath.Join(gopath, "src", name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("example.com/cmds/hello/main.go", "package main\n\nimport \"example.com/lib\"\n\nfunc main() { lib.Hello() }\n")
+	write("example.com/lib/lib.go", "package lib\n\nfunc Hello() {}\n")
+	write("example.com/other/other.go", "package other\n")
+
+	env := golang.Default()
+	env.GOPATH = gopath
+	key := func(env golang.Environ) string {
+		k, err := newKeyer(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := env.Package("example.com/cmds/hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := k.packageKey(p, "github.com/u-root/u-root/pkg/bb/bbmain")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	first := key(env)
+	if k := key(env); k != first {
+		t.Errorf("key of unchanged package = %s, want %s", k, first)
+	}
+
+	write("example.com/other/other.go", "package other\n\nvar X = 1\n")
+	if k := key(env); k != first {
+		t.Errorf("key changed with a package that is not a dependency")
+	}
+
+	write("example.com/lib/lib.go", "package lib\n\nfunc Hello() int { return 1 }\n")
+	second := key(env)
+	if second == first {
+		t.Errorf("key did not change with a dependency")
+	}
+
+	// Non-Go files are built into the package, too.
+	for _, name := range []string{"hello.s", "hello.h", "data.syso"} {
+		write("example.com/lib/"+name, "// "+name+"\n")
+		k := key(env)
+		if k == second {
+			t.Errorf("key did not change with %s of a dependency", name)
+		}
+		second = k
+	}
+
+	arm := env
+	arm.GOARCH = "arm"
+	if key(arm) == second {
+		t.Errorf("key did not change with GOARCH")
+	}
+}
@@ -4,9 +4,8 @@
 
 // Package bls parses systemd Boot Loader Spec config files.
 //
-// See spec at https://systemd.io/BOOT_LOADER_SPECIFICATION. Only Type #1 BLS
-// entries are supported at the moment, while Type #2 EFI entries are left
-// unimplemented awaiting EFI boot support in u-root/LinuxBoot.
+// See spec at https://systemd.io/BOOT_LOADER_SPECIFICATION. Type #1 BLS
+// entries and Type #2 EFI Unified Kernel Images are supported.
 //
 // This package also supports the systemd-boot loader.conf as described in
 // https://www.freedesktop.org/software/systemd/man/loader.conf.html. Only the
@@ -29,11 +28,47 @@ const (
 	blsEntriesDir = "loader/entries"
 )
 
-func cutConf(s string) string {
-	if strings.HasSuffix(s, ".conf") {
-		return s[:len(s)-6]
+// entry is a boot entry, with the attributes it is sorted by.
+type entry struct {
+	// ident is the file name of the entry, without extension.
+	ident     string
+	sortKey   string
+	machineID string
+	version   string
+	img       boot.OSImage
+
+	// count is the boot counter of the entry, if any.
+	count *BootCount
+}
+
+// ident returns the file name of the entry at path without extension and
+// boot counter.
+func ident(path string) string {
+	if b := ParseBootCount(path); b != nil {
+		path = b.name()
+	}
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// countBoots sets up counting the boot attempts of e, if its file name has a
+// boot counter. The attempt is counted once the image is loaded, and the
+// entry is passed to the booted OS in the EntryParam kernel parameter.
+func countBoots(fsRoot, path string, e *entry) {
+	b := ParseBootCount(path)
+	if b == nil {
+		return
+	}
+	e.count = b
+	li, ok := e.img.(*boot.LinuxImage)
+	if !ok {
+		return
+	}
+	rel, err := filepath.Rel(fsRoot, b.name())
+	if err != nil {
+		return
 	}
-	return s
+	li.Cmdline = strings.TrimSpace(fmt.Sprintf("%s %s=%s", li.Cmdline, EntryParam, filepath.ToSlash(rel)))
+	li.Loaded = b.Decrement
 }
 
 // ScanBLSEntries scans the filesystem root for valid BLS entries.
@@ -56,56 +91,78 @@ func ScanBLSEntries(log ulog.Logger, fsRoot string) ([]boot.OSImage, error) {
 		loaderConf = make(map[string]string)
 	}
 
-	// TODO: Rank entries by version or machine-id attribute as suggested
-	// in the spec (but not mandated, surprisingly).
-	imgs := make(map[string]boot.OSImage)
+	var entries []*entry
 	for _, f := range files {
-		identifier := cutConf(filepath.Base(f))
-
-		img, err := parseBLSEntry(f, fsRoot)
+		e, err := parseEntry(f, fsRoot)
 		if err != nil {
 			log.Printf("BootLoaderSpec skipping entry %s: %v", f, err)
 			continue
 		}
-		imgs[identifier] = img
+		countBoots(fsRoot, f, e)
+		entries = append(entries, e)
 	}
 
-	return sortImages(loaderConf, imgs), nil
-}
+	ukis, err := filepath.Glob(filepath.Join(fsRoot, ukiDir, "*.efi"))
+	if err != nil {
+		return nil, fmt.Errorf("no BootLoaderSpec entries found: %w", err)
+	}
+	for _, f := range ukis {
+		e, err := parseUKIEntry(f)
+		if err != nil {
+			log.Printf("BootLoaderSpec skipping unified kernel image %s: %v", f, err)
+			continue
+		}
+		countBoots(fsRoot, f, e)
+		entries = append(entries, e)
+	}
 
-func sortImages(loaderConf map[string]string, imgs map[string]boot.OSImage) []boot.OSImage {
-	// rankedImages = sort(default-images) + sort(remaining images)
-	var rankedImages []boot.OSImage
+	return sortImages(loaderConf, entries), nil
+}
 
+// sortImages ranks entries as the spec suggests, except that bad entries with
+// no tries left come last, and those matching the loader.conf default come
+// first otherwise: entries with a sort-key come first,
+// ordered by sort-key, machine-id, and newest version. The rest are ordered
+// by newest file name, using version comparison as well.
+func sortImages(loaderConf map[string]string, entries []*entry) []boot.OSImage {
 	pattern, ok := loaderConf["default"]
 	if !ok {
 		// All images are default.
 		pattern = "*"
 	}
-
-	var defaultIdents []string
-	var otherIdents []string
-
-	// Find default and non-default identifiers.
-	for ident := range imgs {
-		ok, err := filepath.Match(pattern, ident)
-		if err != nil && ok {
-			defaultIdents = append(defaultIdents, ident)
-		} else {
-			otherIdents = append(otherIdents, ident)
-		}
+	isDefault := func(e *entry) bool {
+		ok, err := filepath.Match(pattern, e.ident)
+		return err == nil && ok
 	}
 
-	// Sort them in the order we want them.
-	sort.Sort(sort.Reverse(sort.StringSlice(defaultIdents)))
-	sort.Sort(sort.Reverse(sort.StringSlice(otherIdents)))
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if ba, bb := a.count != nil && a.count.Bad(), b.count != nil && b.count.Bad(); ba != bb {
+			return bb
+		}
+		if da, db := isDefault(a), isDefault(b); da != db {
+			return da
+		}
+		if (a.sortKey != "") != (b.sortKey != "") {
+			return a.sortKey != ""
+		}
+		if a.sortKey != "" {
+			if a.sortKey != b.sortKey {
+				return a.sortKey < b.sortKey
+			}
+			if a.machineID != b.machineID {
+				return a.machineID < b.machineID
+			}
+			if r := compareVersions(a.version, b.version); r != 0 {
+				return r > 0
+			}
+		}
+		return compareVersions(a.ident, b.ident) > 0
+	})
 
-	// Add images to rankedImages in that sorted order, defaults first.
-	for _, ident := range defaultIdents {
-		rankedImages = append(rankedImages, imgs[ident])
-	}
-	for _, ident := range otherIdents {
-		rankedImages = append(rankedImages, imgs[ident])
+	var rankedImages []boot.OSImage
+	for _, e := range entries {
+		rankedImages = append(rankedImages, e.img)
 	}
 	return rankedImages
 }
@@ -202,6 +259,16 @@ func parseLinuxImage(vals map[string]string, fsRoot string) (boot.OSImage, error
 // returns a LinuxImage.
 // An error is returned if the syntax is wrong or required keys are missing.
 func parseBLSEntry(entryPath, fsRoot string) (boot.OSImage, error) {
+	e, err := parseEntry(entryPath, fsRoot)
+	if err != nil {
+		return nil, err
+	}
+	return e.img, nil
+}
+
+// parseEntry parses a Type #1 BLS entry like parseBLSEntry, and returns it
+// with the attributes it is sorted by.
+func parseEntry(entryPath, fsRoot string) (*entry, error) {
 	vals, err := parseConf(entryPath)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing config in %s: %w", entryPath, err)
@@ -219,5 +286,11 @@ func parseBLSEntry(entryPath, fsRoot string) (boot.OSImage, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error parsing config in %s: %w", entryPath, err)
 	}
-	return img, nil
+	return &entry{
+		ident:     ident(entryPath),
+		sortKey:   vals["sort-key"],
+		machineID: vals["machine-id"],
+		version:   vals["version"],
+		img:       img,
+	}, nil
 }
@@ -0,0 +1,158 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bls
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/mount"
+)
+
+// EntryParam is the kernel command line parameter that names the counted
+// entry that was booted, relative to the boot partition and without its boot
+// counter, e.g. bls.entry=loader/entries/fedora.conf.
+const EntryParam = "bls.entry"
+
+// ErrNotCounted is returned for entries without a boot counter.
+var ErrNotCounted = errors.New("entry has no boot counter")
+
+// BootCount is the boot counter of an entry, which is part of its file name:
+// "fedora+3-1.conf" has 3 tries left and 1 done. An entry with no tries left
+// is bad, and is booted only if all others fail. The booted OS removes the
+// counter of a good entry.
+//
+// See https://systemd.io/AUTOMATIC_BOOT_ASSESSMENT.
+type BootCount struct {
+	// Path is the path of the entry, including the counter.
+	Path string
+
+	Left int
+	Done int
+}
+
+// name returns path without the boot counter.
+func (b *BootCount) name() string {
+	dir, file := filepath.Split(b.Path)
+	ext := filepath.Ext(file)
+	i := strings.LastIndex(file, "+")
+	return filepath.Join(dir, file[:i]+ext)
+}
+
+// Bad returns true if the entry has no tries left.
+func (b *BootCount) Bad() bool {
+	return b.Left == 0
+}
+
+// String implements fmt.Stringer.
+func (b *BootCount) String() string {
+	return fmt.Sprintf("%s: %d tries left, %d done", b.Path, b.Left, b.Done)
+}
+
+// rename renames the entry to path. The boot partition is usually mounted
+// read-only, so it is remounted read-write for the rename.
+func (b *BootCount) rename(path string) (err error) {
+	restore, err := mount.RemountWritable(b.Path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := restore(); err == nil {
+			err = rerr
+		}
+	}()
+
+	if err := os.Rename(b.Path, path); err != nil {
+		return err
+	}
+	b.Path = path
+	return nil
+}
+
+func (b *BootCount) counted(left, done int) string {
+	name := b.name()
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s+%d-%d%s", strings.TrimSuffix(name, ext), left, done, ext)
+}
+
+// Decrement counts a boot attempt. Bad entries are left as they are.
+func (b *BootCount) Decrement() error {
+	if b.Bad() {
+		return nil
+	}
+	if err := b.rename(b.counted(b.Left-1, b.Done+1)); err != nil {
+		return err
+	}
+	b.Left--
+	b.Done++
+	return nil
+}
+
+// MarkGood removes the boot counter, as the entry booted successfully.
+func (b *BootCount) MarkGood() error {
+	return b.rename(b.name())
+}
+
+// MarkBad sets the tries left to 0.
+func (b *BootCount) MarkBad() error {
+	if err := b.rename(b.counted(0, b.Done)); err != nil {
+		return err
+	}
+	b.Left = 0
+	return nil
+}
+
+// ParseBootCount returns the boot counter in the file name of the entry at
+// path, or nil if it has none.
+func ParseBootCount(path string) *BootCount {
+	file := filepath.Base(path)
+	ext := filepath.Ext(file)
+	i := strings.LastIndex(file, "+")
+	if i < 0 {
+		return nil
+	}
+	counter := strings.SplitN(strings.TrimSuffix(file[i+1:], ext), "-", 2)
+	left, err := strconv.ParseUint(counter[0], 10, 32)
+	if err != nil {
+		return nil
+	}
+	var done uint64
+	if len(counter) == 2 {
+		if done, err = strconv.ParseUint(counter[1], 10, 32); err != nil {
+			return nil
+		}
+	}
+	return &BootCount{
+		Path: path,
+		Left: int(left),
+		Done: int(done),
+	}
+}
+
+// FindBootCount returns the boot counter of entry, which is relative to the
+// boot partition mounted at fsRoot and is named without counter, as in the
+// EntryParam kernel parameter. ErrNotCounted is returned if the entry exists
+// but is not counted.
+func FindBootCount(fsRoot, entry string) (*BootCount, error) {
+	path := filepath.Join(fsRoot, entry)
+	if _, err := os.Stat(path); err == nil {
+		return nil, ErrNotCounted
+	}
+	ext := filepath.Ext(path)
+	matches, err := filepath.Glob(strings.TrimSuffix(path, ext) + "+*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range matches {
+		if b := ParseBootCount(m); b != nil && b.name() == path {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", path, os.ErrNotExist)
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bls
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/testutil"
+	"github.com/u-root/u-root/pkg/ulog/ulogtest"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseBootCount(t *testing.T) {
+	for _, tt := range []struct {
+		path string
+		want *BootCount
+	}{
+		{path: "a/fedora.conf"},
+		{path: "a/fedora+.conf"},
+		{path: "a/fedora+x-1.conf"},
+		{path: "a/fedora+3-x.conf"},
+		{path: "a/fedora+-3.conf"},
+		{path: "a/fedora+3.conf", want: &BootCount{Path: "a/fedora+3.conf", Left: 3}},
+		{path: "a/fedora+2-1.conf", want: &BootCount{Path: "a/fedora+2-1.conf", Left: 2, Done: 1}},
+		{path: "a/fe+do+ra+0-3.efi", want: &BootCount{Path: "a/fe+do+ra+0-3.efi", Done: 3}},
+	} {
+		if got := ParseBootCount(tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseBootCount(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func touch(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestBootCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entries := filepath.Join(dir, blsEntriesDir)
+	touch(t, filepath.Join(entries, "new+1.conf"), "title New\nlinux /vmlinuz\noptions ro\n")
+	touch(t, filepath.Join(entries, "old.conf"), "title Old\nlinux /vmlinuz\n")
+	touch(t, filepath.Join(entries, "z-bad+0-3.conf"), "title Bad\nlinux /vmlinuz\n")
+	touch(t, filepath.Join(dir, "vmlinuz"), "")
+
+	imgs, err := ScanBLSEntries(ulogtest.Logger{TB: t}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, img := range imgs {
+		names = append(names, img.Label())
+	}
+	// Bad entries come last, even if they sort first otherwise.
+	if want := []string{"Old", "New", "Bad"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("ScanBLSEntries = %q, want %q", names, want)
+	}
+
+	li := imgs[1].(*boot.LinuxImage)
+	if want := "ro bls.entry=loader/entries/new.conf"; li.Cmdline != want {
+		t.Errorf("Cmdline = %q, want %q", li.Cmdline, want)
+	}
+	if imgs[0].(*boot.LinuxImage).Loaded != nil {
+		t.Errorf("uncounted entry counts boots")
+	}
+
+	// A boot attempt is counted after the image is loaded.
+	if err := li.Loaded(); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(filepath.Join(entries, "new+0-1.conf")) {
+		t.Errorf("boot attempt was not counted")
+	}
+
+	// The booted OS finds the entry by the kernel parameter.
+	b, err := FindBootCount(dir, "loader/entries/new.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Left != 0 || b.Done != 1 || !b.Bad() {
+		t.Errorf("FindBootCount = %v, want 0 tries left and 1 done", b)
+	}
+	if err := b.MarkGood(); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(filepath.Join(entries, "new.conf")) {
+		t.Errorf("MarkGood did not remove the boot counter")
+	}
+	if _, err := FindBootCount(dir, "loader/entries/new.conf"); !errors.Is(err, ErrNotCounted) {
+		t.Errorf("FindBootCount = %v, want %v", err, ErrNotCounted)
+	}
+	if _, err := FindBootCount(dir, "loader/entries/gone.conf"); !os.IsNotExist(errors.Unwrap(err)) {
+		t.Errorf("FindBootCount = %v, want not exist", err)
+	}
+
+	b, err = FindBootCount(dir, "loader/entries/z-bad.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Bad entries are not counted anymore.
+	if err := b.Decrement(); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(filepath.Join(entries, "z-bad+0-3.conf")) {
+		t.Errorf("Decrement renamed a bad entry")
+	}
+}
+
+func TestBootCountReadOnly(t *testing.T) {
+	testutil.SkipIfNotRoot(t)
+
+	dir, err := ioutil.TempDir("", "bls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mp, err := mount.Mount("tmpfs", dir, "tmpfs", "", 0)
+	if err != nil {
+		t.Skipf("cannot mount tmpfs: %v", err)
+	}
+	defer mp.Unmount(mount.MNT_DETACH)
+
+	entries := filepath.Join(dir, blsEntriesDir)
+	touch(t, filepath.Join(entries, "new+2.conf"), "title New\nlinux /vmlinuz\n")
+	touch(t, filepath.Join(dir, "vmlinuz"), "")
+	// This is how localboot mounts partitions.
+	if err := unix.Mount("", dir, "", unix.MS_REMOUNT|mount.ReadOnly, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	imgs, err := ScanBLSEntries(ulogtest.Logger{TB: t}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imgs) != 1 {
+		t.Fatalf("ScanBLSEntries = %v, want 1 image", imgs)
+	}
+	if err := imgs[0].(*boot.LinuxImage).Loaded(); err != nil {
+		t.Fatalf("Loaded() = %v", err)
+	}
+	if !exists(filepath.Join(entries, "new+1-1.conf")) {
+		t.Errorf("boot attempt was not counted")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "vmlinuz"), nil, 0644); err == nil {
+		t.Errorf("the file system is still writable after Loaded()")
+	}
+}
+
+func TestMarkBad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "EFI/Linux/fedora+2-1.efi")
+	touch(t, path, "")
+	b := ParseBootCount(path)
+	if err := b.MarkBad(); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "EFI/Linux/fedora+0-1.efi"); b.Path != want || !exists(want) {
+		t.Errorf("MarkBad renamed to %s, want %s", b.Path, want)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bls
+
+import (
+	"bufio"
+	"bytes"
+	"debug/pe"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+)
+
+const (
+	// ukiDir holds Type #2 entries, relative to the boot partition.
+	ukiDir = "EFI/Linux"
+)
+
+// section is a section of a unified kernel image.
+type section struct {
+	*io.SectionReader
+	name string
+}
+
+// String implements fmt.Stringer.
+func (s section) String() string {
+	return s.name
+}
+
+// ukiSection returns the contents of the named section of f, or nil if f
+// has no such section.
+func ukiSection(path string, f io.ReaderAt, p *pe.File, name string) *section {
+	s := p.Section(name)
+	if s == nil {
+		return nil
+	}
+	// The raw data of a section is padded to the file alignment.
+	size := s.Size
+	if s.VirtualSize != 0 && s.VirtualSize < size {
+		size = s.VirtualSize
+	}
+	return &section{
+		SectionReader: io.NewSectionReader(f, int64(s.Offset), int64(size)),
+		name:          fmt.Sprintf("%s(%s)", path, name),
+	}
+}
+
+func readSection(s *section) (string, error) {
+	if s == nil {
+		return "", nil
+	}
+	b := make([]byte, s.Size())
+	if _, err := s.ReadAt(b, 0); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bytes.TrimRight(b, "\x00"))), nil
+}
+
+// ParseUKI parses the Type #2 entry at path, an EFI unified kernel image,
+// whose kernel, initrd, command line and os-release are sections.
+func ParseUKI(path string) (*boot.LinuxImage, error) {
+	e, err := parseUKIEntry(path)
+	if err != nil {
+		return nil, err
+	}
+	return e.img.(*boot.LinuxImage), nil
+}
+
+// ReadUKI is like ParseUKI, but reads the unified kernel image from r. name
+// only describes it, e.g. the URL it was fetched from.
+func ReadUKI(name string, r io.ReaderAt) (*boot.LinuxImage, error) {
+	e, err := parseUKI(name, r)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing unified kernel image %s: %w", name, err)
+	}
+	return e.img.(*boot.LinuxImage), nil
+}
+
+func parseUKIEntry(path string) (*entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	e, err := parseUKI(path, f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error parsing unified kernel image %s: %w", path, err)
+	}
+	return e, nil
+}
+
+func parseUKI(path string, f io.ReaderAt) (*entry, error) {
+	p, err := pe.NewFile(f)
+	if err != nil {
+		return nil, err
+	}
+	kernel := ukiSection(path, f, p, ".linux")
+	if kernel == nil {
+		return nil, fmt.Errorf("no .linux section")
+	}
+	cmdline, err := readSection(ukiSection(path, f, p, ".cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	osrel, err := readSection(ukiSection(path, f, p, ".osrel"))
+	if err != nil {
+		return nil, err
+	}
+	uname, err := readSection(ukiSection(path, f, p, ".uname"))
+	if err != nil {
+		return nil, err
+	}
+	vals := parseOSRelease(osrel)
+
+	li := &boot.LinuxImage{
+		Kernel:  kernel,
+		Cmdline: cmdline,
+	}
+	if initrd := ukiSection(path, f, p, ".initrd"); initrd != nil {
+		li.Initrd = initrd
+	}
+
+	id := ident(path)
+	// Attributes are taken from os-release as systemd-boot does.
+	title := first(vals["PRETTY_NAME"], vals["IMAGE_ID"], vals["NAME"], vals["ID"], id)
+	version := first(uname, vals["IMAGE_VERSION"], vals["VERSION_ID"], vals["BUILD_ID"])
+	li.Name = strings.TrimSpace(title + " " + version)
+
+	return &entry{
+		ident:   id,
+		sortKey: first(vals["IMAGE_ID"], vals["ID"]),
+		version: version,
+		img:     li,
+	}, nil
+}
+
+// first returns the first non-empty string.
+func first(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseOSRelease parses the KEY=value assignments of an os-release file.
+func parseOSRelease(s string) map[string]string {
+	vals := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		val := kv[1]
+		if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+			if uq, err := strconv.Unquote(val); err == nil {
+				val = uq
+			} else {
+				val = val[1 : len(val)-1]
+			}
+		} else if len(val) >= 2 && val[0] == '\'' && val[len(val)-1] == '\'' {
+			val = val[1 : len(val)-1]
+		}
+		vals[kv[0]] = val
+	}
+	return vals
+}
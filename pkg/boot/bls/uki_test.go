@@ -0,0 +1,211 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bls
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/uio"
+	"github.com/u-root/u-root/pkg/ulog/ulogtest"
+)
+
+type peSection struct {
+	name string
+	data string
+}
+
+// writeUKI writes a PE file with the given sections, padded to 512 bytes as
+// real unified kernel images are.
+func writeUKI(t *testing.T, path string, sections ...peSection) {
+	le := binary.LittleEndian
+	hdr := make([]byte, 0x40+24+40*len(sections))
+	copy(hdr, "MZ")
+	le.PutUint32(hdr[0x3c:], 0x40)
+	copy(hdr[0x40:], "PE\x00\x00")
+	le.PutUint16(hdr[0x44:], 0x8664)
+	le.PutUint16(hdr[0x46:], uint16(len(sections)))
+
+	var data []byte
+	off := (len(hdr) + 511) &^ 511
+	for i, s := range sections {
+		sh := hdr[0x40+24+40*i:]
+		copy(sh, s.name)
+		raw := (len(s.data) + 511) &^ 511
+		le.PutUint32(sh[8:], uint32(len(s.data)))
+		le.PutUint32(sh[16:], uint32(raw))
+		le.PutUint32(sh[20:], uint32(off+len(data)))
+		padded := make([]byte, raw)
+		copy(padded, s.data)
+		data = append(data, padded...)
+	}
+	b := make([]byte, off)
+	copy(b, hdr)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, append(b, data...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readAll(t *testing.T, r interface{}) string {
+	ra, ok := r.(interface {
+		ReadAt([]byte, int64) (int, error)
+	})
+	if !ok || r == nil {
+		return ""
+	}
+	b, err := uio.ReadAll(ra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestParseUKI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "fedora.efi")
+	writeUKI(t, path,
+		peSection{".osrel", "NAME=Fedora\nID=fedora\nVERSION_ID=33\nPRETTY_NAME=\"Fedora 33 (Thirty Three)\"\n"},
+		peSection{".cmdline", "root=/dev/sda3 ro\n\x00"},
+		peSection{".linux", "kernel"},
+		peSection{".initrd", "initrd"},
+	)
+	li, err := ParseUKI(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, li.Kernel); got != "kernel" {
+		t.Errorf("kernel = %q, want kernel", got)
+	}
+	if got := readAll(t, li.Initrd); got != "initrd" {
+		t.Errorf("initrd = %q, want initrd", got)
+	}
+	if li.Cmdline != "root=/dev/sda3 ro" {
+		t.Errorf("cmdline = %q, want %q", li.Cmdline, "root=/dev/sda3 ro")
+	}
+	if li.Name != "Fedora 33 (Thirty Three) 33" {
+		t.Errorf("name = %q", li.Name)
+	}
+
+	noKernel := filepath.Join(dir, "nokernel.efi")
+	writeUKI(t, noKernel, peSection{".osrel", "ID=fedora\n"})
+	if _, err := ParseUKI(noKernel); err == nil {
+		t.Errorf("ParseUKI(%s) succeeded, want error", noKernel)
+	}
+}
+
+func TestScanBLSEntriesUKI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	osrel := "ID=fedora\nPRETTY_NAME=Fedora\n"
+	for _, uki := range []struct {
+		name, uname string
+	}{
+		{"fedora-5.8.15", "5.8.15-301.fc33.x86_64"},
+		{"fedora-5.10.0", "5.10.0-1.fc33.x86_64"},
+		{"fedora-5.10.0~rc7", "5.10.0-0.rc7.fc33.x86_64"},
+	} {
+		writeUKI(t, filepath.Join(dir, ukiDir, uki.name+".efi"),
+			peSection{".osrel", osrel},
+			peSection{".uname", uki.uname},
+			peSection{".linux", uki.name},
+		)
+	}
+	writeUKI(t, filepath.Join(dir, ukiDir, "debian.efi"),
+		peSection{".osrel", "ID=debian\nPRETTY_NAME=Debian\nVERSION_ID=10\n"},
+		peSection{".linux", "debian"},
+	)
+	// Not a UKI.
+	if err := ioutil.WriteFile(filepath.Join(dir, ukiDir, "memtest.efi"), []byte("MZ"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, blsEntriesDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, conf := range map[string]string{
+		"arch.conf":      "title Arch\nsort-key arch\nversion 5.9\nlinux /vmlinuz-arch\n",
+		"custom-2.conf":  "title Custom 2\nlinux /vmlinuz-custom\n",
+		"custom-10.conf": "title Custom 10\nlinux /vmlinuz-custom\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, blsEntriesDir, name), []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"vmlinuz-arch", "vmlinuz-custom"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	imgs, err := ScanBLSEntries(ulogtest.Logger{TB: t}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, img := range imgs {
+		got = append(got, img.(*boot.LinuxImage).Name)
+	}
+	// Sorted by sort-key, then newest version. Entries without sort-key
+	// come last, by newest file name.
+	want := []string{
+		"Arch 5.9",
+		"Debian 10",
+		"Fedora 5.10.0-1.fc33.x86_64",
+		"Fedora 5.10.0-0.rc7.fc33.x86_64",
+		"Fedora 5.8.15-301.fc33.x86_64",
+		"Custom 10",
+		"Custom 2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ScanBLSEntries = %q, want %q", got, want)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	// Each version is older than the next.
+	for _, versions := range [][]string{
+		{"", "0", "1", "2", "10", "011", "0100"},
+		{"122", "123~rc1", "123"},
+		{"123", "123-a", "123-1", "123.a", "123.1"},
+		{"123-1", "123^1", "123.1"},
+		{"5.8.15", "5.10.0~rc7", "5.10.0"},
+		{"abc", "abcde", "abd", "1"},
+	} {
+		for i := 0; i+1 < len(versions); i++ {
+			a, b := versions[i], versions[i+1]
+			if r := compareVersions(a, b); r != -1 {
+				t.Errorf("compareVersions(%q, %q) = %d, want -1", a, b, r)
+			}
+			if r := compareVersions(b, a); r != 1 {
+				t.Errorf("compareVersions(%q, %q) = %d, want 1", b, a, r)
+			}
+		}
+	}
+	for _, v := range [][2]string{
+		{"123", "123"},
+		{"0123", "123"},
+		{"1.2", "1_.2"},
+	} {
+		if r := compareVersions(v[0], v[1]); r != 0 {
+			t.Errorf("compareVersions(%q, %q) = %d, want 0", v[0], v[1], r)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bls
+
+import "strings"
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isAlpha(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+
+func isVersionChar(c byte) bool {
+	return isDigit(c) || isAlpha(c) || strings.IndexByte("~-^.", c) >= 0
+}
+
+// cmpBool returns -1 if only b is set, 1 if only a is set, and 0 otherwise.
+func cmpBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
+
+func cmpInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// compareVersions compares two versions as the Boot Loader Specification
+// requires, and returns -1, 0 or 1 if a is older, equal to or newer than b.
+//
+// This is the algorithm of systemd's strverscmp_improved: versions are
+// compared segment by segment, numerically for digits and alphabetically
+// otherwise. A segment prefixed with "~" is older than any other, e.g. a
+// pre-release, and "-", "^" and "." order the release, patch and point
+// release parts.
+func compareVersions(a, b string) int {
+	if a == "" || b == "" {
+		return strings.Compare(a, b)
+	}
+	for {
+		for len(a) > 0 && !isVersionChar(a[0]) {
+			a = a[1:]
+		}
+		for len(b) > 0 && !isVersionChar(b[0]) {
+			b = b[1:]
+		}
+
+		// '~' marks a pre-release, which is older.
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if r := cmpBool(!strings.HasPrefix(a, "~"), !strings.HasPrefix(b, "~")); r != 0 {
+				return r
+			}
+			a, b = a[1:], b[1:]
+		}
+
+		// Otherwise, the version with more segments is newer.
+		if a == "" || b == "" {
+			return strings.Compare(a, b)
+		}
+
+		// The version prefixed with a separator is older, e.g. 123-9
+		// is older than 123.1-1.
+		for _, sep := range "-^." {
+			s := string(sep)
+			if strings.HasPrefix(a, s) || strings.HasPrefix(b, s) {
+				if r := cmpBool(!strings.HasPrefix(a, s), !strings.HasPrefix(b, s)); r != 0 {
+					return r
+				}
+				a, b = a[1:], b[1:]
+			}
+		}
+
+		var i, j int
+		if (len(a) > 0 && isDigit(a[0])) || (len(b) > 0 && isDigit(b[0])) {
+			// Numeric segments are newer than alphabetic ones.
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			if r := cmpBool(i > 0, j > 0); r != 0 {
+				return r
+			}
+			na := strings.TrimLeft(a[:i], "0")
+			nb := strings.TrimLeft(b[:j], "0")
+			if r := cmpInt(len(na), len(nb)); r != 0 {
+				return r
+			}
+			if r := strings.Compare(na, nb); r != 0 {
+				return r
+			}
+		} else {
+			for i < len(a) && isAlpha(a[i]) {
+				i++
+			}
+			for j < len(b) && isAlpha(b[j]) {
+				j++
+			}
+			n := i
+			if j < n {
+				n = j
+			}
+			if r := strings.Compare(a[:n], b[:n]); r != 0 {
+				return r
+			}
+			// The longer segment is newer, e.g. abcde is newer
+			// than abc.
+			if r := cmpInt(i, j); r != 0 {
+				return r
+			}
+		}
+		a, b = a[i:], b[j:]
+	}
+}
@@ -9,28 +9,83 @@ package bootcmd
 import (
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/u-root/u-root/pkg/boot/menu"
+	"github.com/u-root/u-root/pkg/cmdline"
 	"github.com/u-root/u-root/pkg/mount"
 )
 
+// NewMenu returns the boot menu of entries, configured by kernel parameters.
+//
+// uroot.bootmenu.timeout=SECONDS is how long the user has to choose an entry.
+// 0 boots the default entry right away, and a negative timeout waits for the
+// user.
+//
+// uroot.bootmenu.default=LABEL is the label of the entry to boot by default,
+// which may be in a submenu. Labels with spaces are quoted, e.g.
+// uroot.bootmenu.default="Debian GNU/Linux".
+//
+// uroot.bootmenu.edit=1 lets the user edit kernel command lines.
+func NewMenu(entries []menu.Entry) *menu.Menu {
+	m := menu.New(entries...)
+	if t, ok := cmdline.Flag("uroot.bootmenu.timeout"); ok {
+		if s, err := strconv.Atoi(t); err != nil {
+			log.Printf("Ignoring uroot.bootmenu.timeout=%s: %v", t, err)
+		} else {
+			m.Timeout = time.Duration(s) * time.Second
+		}
+	}
+	if d, ok := cmdline.Flag("uroot.bootmenu.default"); ok {
+		m.Default = d
+	}
+	if e, ok := cmdline.Flag("uroot.bootmenu.edit"); ok {
+		if edit, err := strconv.ParseBool(e); err != nil {
+			log.Printf("Ignoring uroot.bootmenu.edit=%s: %v", e, err)
+		} else {
+			m.Edit = edit
+		}
+	}
+	return m
+}
+
 // ShowMenuAndBoot handles common cleanup functions and flags that all boot
 // commands should support.
 //
+// It shows the menu of NewMenu. See ShowAndBoot.
+func ShowMenuAndBoot(entries []menu.Entry, mps []*mount.MountPoint, noLoad, noExec bool) {
+	ShowAndBoot(NewMenu(entries), mps, noLoad, noExec)
+}
+
+// printEntries logs entries and the entries of their submenus.
+func printEntries(entries []menu.Entry, indent string) {
+	for i, entry := range entries {
+		log.Printf("%s%d. %s", indent, i+1, entry.Label())
+		if sub, ok := entry.(*menu.Submenu); ok {
+			printEntries(sub.Entries, indent+"  ")
+			continue
+		}
+		log.Printf("%s=> %s", indent, entry)
+	}
+}
+
+// ShowAndBoot shows m and boots the entry the user chose, or the default.
+//
 // mps are mounts to unmount before kexecing. noLoad prints the list of entries
-// and exits. If noLoad is false, a boot menu is shown to the user. The
+// and exits. If noLoad is false, the boot menu is shown to the user. The
 // user-chosen boot entry will be kexec'd unless noExec is true.
-func ShowMenuAndBoot(entries []menu.Entry, mps []*mount.MountPoint, noLoad, noExec bool) {
+func ShowAndBoot(m *menu.Menu, mps []*mount.MountPoint, noLoad, noExec bool) {
 	if noLoad {
 		log.Print("Not loading menu or kernel. Options:")
-		for i, entry := range entries {
-			log.Printf("%d. %s", i+1, entry.Label())
-			log.Printf("=> %s", entry)
+		printEntries(m.Entries, "")
+		if m.Default != "" {
+			log.Printf("Default: %s", m.Default)
 		}
 		os.Exit(0)
 	}
 
-	loadedEntry := menu.ShowMenuAndLoad(os.Stdin, entries...)
+	loadedEntry := m.Load(menu.NewFrontend(os.Stdin))
 
 	// Clean up.
 	for _, mp := range mps {
@@ -40,6 +40,16 @@ func module(r io.ReaderAt) map[string]interface{} {
 	return m
 }
 
+// submenu is the JSON-like representation of the titles of submenus, which
+// compares equal to what json.Unmarshal decodes.
+func submenu(titles []string) []interface{} {
+	var s []interface{}
+	for _, t := range titles {
+		s = append(s, t)
+	}
+	return s
+}
+
 // CompareImagesToJSON compares the names, cmdlines, and file URLs in imgs to
 // the ones stored in jsonEncoded.
 //
@@ -96,6 +106,9 @@ func LinuxImageToJSON(li *boot.LinuxImage) map[string]interface{} {
 	m := make(map[string]interface{})
 	m["image_type"] = "linux"
 	m["name"] = li.Name
+	if len(li.Submenu) > 0 {
+		m["submenu"] = submenu(li.Submenu)
+	}
 	m["cmdline"] = li.Cmdline
 	if li.Kernel != nil {
 		m["kernel"] = module(li.Kernel)
@@ -114,6 +127,9 @@ func MultibootImageToJSON(mi *boot.MultibootImage) map[string]interface{} {
 	m := make(map[string]interface{})
 	m["image_type"] = "multiboot"
 	m["name"] = mi.Name
+	if len(mi.Submenu) > 0 {
+		m["submenu"] = submenu(mi.Submenu)
+	}
 	m["cmdline"] = mi.Cmdline
 	if mi.Kernel != nil {
 		m["kernel"] = module(mi.Kernel)
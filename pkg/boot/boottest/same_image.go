@@ -23,6 +23,18 @@ func mustReadAll(r io.ReaderAt) string {
 	return string(b)
 }
 
+func sameSubmenu(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // SameBootImage compares the contents of given boot images, but not the
 // underlying URLs.
 //
@@ -52,6 +64,11 @@ func SameBootImage(got, want boot.OSImage) error {
 		if gotLinux.Cmdline != wantLinux.Cmdline {
 			return fmt.Errorf("got cmdline %s, want %s", gotLinux.Cmdline, wantLinux.Cmdline)
 		}
+
+		// Same submenu?
+		if !sameSubmenu(gotLinux.Submenu, wantLinux.Submenu) {
+			return fmt.Errorf("got submenu %q, want %q", gotLinux.Submenu, wantLinux.Submenu)
+		}
 		return nil
 	}
 
@@ -71,6 +88,11 @@ func SameBootImage(got, want boot.OSImage) error {
 			return fmt.Errorf("got cmdline %s, want %s", gotMB.Cmdline, wantMB.Cmdline)
 		}
 
+		// Same submenu?
+		if !sameSubmenu(gotMB.Submenu, wantMB.Submenu) {
+			return fmt.Errorf("got submenu %q, want %q", gotMB.Submenu, wantMB.Submenu)
+		}
+
 		if len(gotMB.Modules) != len(wantMB.Modules) {
 			return fmt.Errorf("got %d modules, want %d modules", len(gotMB.Modules), len(wantMB.Modules))
 		}
@@ -0,0 +1,270 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/multiboot"
+)
+
+// builtin is a GRUB command implemented by the interpreter.
+//
+// name is the name the command was invoked as. A non-nil error sets the exit
+// status to 1.
+type builtin func(ctx context.Context, c *parser, name string, args []string) error
+
+var builtins map[string]builtin
+
+func init() {
+	builtins = map[string]builtin{
+		"[":        cmdTest,
+		"break":    cmdBreak,
+		"continue": cmdContinue,
+		"echo":     cmdEcho,
+		"export":   cmdExport,
+		"false":    cmdFalse,
+		"return":   cmdReturn,
+		"set":      cmdSet,
+		"test":     cmdTest,
+		"true":     cmdNop,
+		"unset":    cmdUnset,
+
+		"configfile": cmdConfigfile,
+		"source":     cmdSource,
+
+		"load_env": cmdLoadEnv,
+		"save_env": cmdSaveEnv,
+
+		"search":          cmdSearch,
+		"search.file":     cmdSearch,
+		"search.fs_label": cmdSearch,
+		"search.fs_uuid":  cmdSearch,
+
+		"initrd":          cmdInitrd,
+		"initrd16":        cmdInitrd,
+		"initrdefi":       cmdInitrd,
+		"linux":           cmdLinux,
+		"linux16":         cmdLinux,
+		"linuxefi":        cmdLinux,
+		"module":          cmdModule,
+		"multiboot":       cmdMultiboot,
+		"boot":            cmdNop,
+		"clear":           cmdNop,
+		"insmod":          cmdNop,
+		"play":            cmdNop,
+		"serial":          cmdNop,
+		"terminal":        cmdNop,
+		"terminal_input":  cmdNop,
+		"terminal_output": cmdNop,
+	}
+}
+
+func cmdNop(ctx context.Context, c *parser, name string, args []string) error {
+	return nil
+}
+
+func cmdFalse(ctx context.Context, c *parser, name string, args []string) error {
+	return errors.New("false")
+}
+
+func cmdEcho(ctx context.Context, c *parser, name string, args []string) error {
+	// Used by tests.
+	if c.W != nil {
+		fmt.Fprintf(c.W, "echo:%#v\n", args)
+	}
+	return nil
+}
+
+func cmdSet(ctx context.Context, c *parser, name string, args []string) error {
+	for _, arg := range args {
+		vals := strings.SplitN(arg, "=", 2)
+		if len(vals) != 2 {
+			continue
+		}
+		if !isName(vals[0]) {
+			return fmt.Errorf("invalid variable name %q", vals[0])
+		}
+		c.env.set(vals[0], vals[1])
+	}
+	return nil
+}
+
+func cmdUnset(ctx context.Context, c *parser, name string, args []string) error {
+	for _, arg := range args {
+		c.env.unset(arg)
+	}
+	return nil
+}
+
+func cmdExport(ctx context.Context, c *parser, name string, args []string) error {
+	for _, arg := range args {
+		c.env.export(arg)
+	}
+	return nil
+}
+
+func loopCount(args []string) (int, error) {
+	if len(args) == 0 {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid loop count %q", args[0])
+	}
+	return n, nil
+}
+
+func cmdBreak(ctx context.Context, c *parser, name string, args []string) error {
+	n, err := loopCount(args)
+	if err != nil {
+		return err
+	}
+	return breakError{n}
+}
+
+func cmdContinue(ctx context.Context, c *parser, name string, args []string) error {
+	n, err := loopCount(args)
+	if err != nil {
+		return err
+	}
+	return continueError{n}
+}
+
+func cmdReturn(ctx context.Context, c *parser, name string, args []string) error {
+	status := c.status
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid return status %q", args[0])
+		}
+		status = n
+	}
+	return returnError{status}
+}
+
+func cmdSource(ctx context.Context, c *parser, name string, args []string) error {
+	if len(args) < 1 {
+		return errors.New("filename expected")
+	}
+	return c.sourceFile(ctx, args[0])
+}
+
+func cmdConfigfile(ctx context.Context, c *parser, name string, args []string) error {
+	if len(args) < 1 {
+		return errors.New("filename expected")
+	}
+
+	// configfile runs the file in a new context, which only inherits
+	// exported variables. Its menu entries are added to ours.
+	saved := c.env
+	c.env = c.env.clone(true)
+	defer func() { c.env = saved }()
+	return c.sourceFile(ctx, args[0])
+}
+
+// cmdLinux implements linux, linux16 and linuxefi.
+func cmdLinux(ctx context.Context, c *parser, name string, args []string) error {
+	if len(args) < 1 {
+		return errors.New("filename expected")
+	}
+	if c.cur == nil {
+		return errors.New("kernels can only be loaded from menu entries")
+	}
+	k, err := c.getFile(args[0])
+	if err != nil {
+		return err
+	}
+	// from grub manual: "Any initrd must be reloaded after using this
+	// command" so we can replace the image.
+	c.cur.image = &boot.LinuxImage{
+		Kernel:  k,
+		Cmdline: cmdlineQuote(args[1:]),
+	}
+	return nil
+}
+
+// cmdInitrd implements initrd, initrd16 and initrdefi.
+func cmdInitrd(ctx context.Context, c *parser, name string, args []string) error {
+	if len(args) < 1 {
+		return errors.New("filename expected")
+	}
+	if c.cur == nil {
+		return errors.New("kernels can only be loaded from menu entries")
+	}
+	li, ok := c.cur.image.(*boot.LinuxImage)
+	if !ok {
+		return errors.New("you need to load the kernel first")
+	}
+
+	var initrds []io.ReaderAt
+	for _, arg := range args {
+		i, err := c.getFile(arg)
+		if err != nil {
+			return err
+		}
+		initrds = append(initrds, i)
+	}
+	if len(initrds) == 1 {
+		li.Initrd = initrds[0]
+	} else {
+		li.Initrd = boot.CatInitrds(initrds...)
+	}
+	return nil
+}
+
+func cmdMultiboot(ctx context.Context, c *parser, name string, args []string) error {
+	if c.cur == nil {
+		return errors.New("kernels can only be loaded from menu entries")
+	}
+	// Skip --quirk-* arguments.
+	for len(args) > 0 && strings.HasPrefix(args[0], "--quirk-") {
+		args = args[1:]
+	}
+	if len(args) < 1 {
+		return errors.New("filename expected")
+	}
+	k, err := c.getFile(args[0])
+	if err != nil {
+		return err
+	}
+	c.cur.image = &boot.MultibootImage{
+		Kernel:  k,
+		Cmdline: cmdlineQuote(args[1:]),
+	}
+	return nil
+}
+
+func cmdModule(ctx context.Context, c *parser, name string, args []string) error {
+	if c.cur == nil {
+		return errors.New("kernels can only be loaded from menu entries")
+	}
+	mb, ok := c.cur.image.(*boot.MultibootImage)
+	if !ok {
+		return errors.New("you need to load the multiboot kernel first")
+	}
+	// TODO: honor --nounzip once modules are decompressed.
+	if len(args) > 0 && args[0] == "--nounzip" {
+		args = args[1:]
+	}
+	if len(args) < 1 {
+		return errors.New("filename expected")
+	}
+	m, err := c.getFile(args[0])
+	if err != nil {
+		return err
+	}
+	mb.Modules = append(mb.Modules, multiboot.Module{
+		Module:  m,
+		Cmdline: cmdlineQuote(args),
+	})
+	return nil
+}
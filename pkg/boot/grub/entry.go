@@ -5,87 +5,51 @@
 package grub
 
 import (
-	"bufio"
-	"bytes"
-	"fmt"
 	"io"
-	"sort"
-	"strings"
-)
 
-// GRUB block size.
-const blockSize = 1024
+	"github.com/u-root/u-root/pkg/boot/grub/grubenv"
+)
 
 // EnvFile is a GRUB environment file consisting of key-value pairs akin to the
 // GRUB commands load_env and save_env.
+//
+// Deprecated: use grubenv.Env.
 type EnvFile struct {
 	Vars map[string]string
 }
 
 // NewEnvFile allocates a new env file.
+//
+// Deprecated: use grubenv.New.
 func NewEnvFile() *EnvFile {
 	return &EnvFile{
 		Vars: make(map[string]string),
 	}
 }
 
-// WriteTo writes key-value pairs to a file, padded to 1024 bytes, as save_env does.
+// WriteTo writes key-value pairs to a file, padded to a multiple of 1024
+// bytes, as save_env does. Variables with empty values are left out.
+//
+// Deprecated: use grubenv.Env.WriteTo.
 func (env *EnvFile) WriteTo(w io.Writer) (int64, error) {
-	var b bytes.Buffer
-	b.WriteString("# GRUB Environment Block\n")
-
-	// Sort keys so order is deterministic.
-	keys := make([]string, 0, len(env.Vars))
-	for k := range env.Vars {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-
-	for _, k := range keys {
-		if len(env.Vars[k]) > 0 {
-			b.WriteString(k)
-			b.WriteString("=")
-			b.WriteString(env.Vars[k])
-			b.WriteString("\n")
+	e := grubenv.New()
+	for k, v := range env.Vars {
+		if len(v) > 0 {
+			e.Vars[k] = v
 		}
 	}
-	length := b.Len()
-
-	// Fill up the file with # until 1024 bytes to make the file size a
-	// multiple of the block size.
-	remainder := blockSize - length%blockSize
-	for i := 0; i < remainder; i++ {
-		b.WriteByte('#')
-	}
-
-	return b.WriteTo(w)
+	return e.WriteTo(w)
 }
 
 // ParseEnvFile reads a key-value pair GRUB environment file.
 //
 // ParseEnvFile accepts incorrectly padded GRUB env files, as opposed to GRUB.
+//
+// Deprecated: use grubenv.Parse.
 func ParseEnvFile(r io.Reader) (*EnvFile, error) {
-	s := bufio.NewScanner(r)
-	conf := NewEnvFile()
-	// Best lexer & parser in the world.
-	for s.Scan() {
-		if len(s.Text()) == 0 {
-			continue
-		}
-		// Comments.
-		if s.Text()[0] == '#' {
-			continue
-		}
-
-		tokens := strings.SplitN(s.Text(), "=", 2)
-		if len(tokens) != 2 {
-			return nil, fmt.Errorf("error parsing %q: must find = or # in each line", s.Text())
-		}
-		key, value := tokens[0], tokens[1]
-		conf.Vars[key] = value
-	}
-	if err := s.Err(); err != nil {
+	env, err := grubenv.Parse(r)
+	if err != nil {
 		return nil, err
 	}
-	return conf, nil
+	return &EnvFile{Vars: env.Vars}, nil
 }
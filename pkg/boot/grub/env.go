@@ -0,0 +1,182 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/grub/grubenv"
+	"github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// envFile parses the options of load_env and save_env. It returns the URL of
+// the environment block, which defaults to $prefix/grubenv, and the
+// remaining arguments.
+func (c *parser) envFile(args []string) (*url.URL, []string, error) {
+	var name string
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-f" || arg == "--file":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("option %s requires an argument", arg)
+			}
+			i++
+			name = args[i]
+		case strings.HasPrefix(arg, "--file="):
+			name = strings.TrimPrefix(arg, "--file=")
+		case arg == "-s" || arg == "--skip-sig":
+			// We do not check signatures of the environment block.
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	if len(name) == 0 {
+		prefix, _ := c.env.get("prefix")
+		name = prefix + "/grubenv"
+	}
+	u, err := c.resolve(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, rest, nil
+}
+
+// cmdLoadEnv implements load_env.
+//
+// See https://www.gnu.org/software/grub/manual/grub/html_node/load_005fenv.html
+func cmdLoadEnv(ctx context.Context, c *parser, name string, args []string) error {
+	u, whitelist, err := c.envFile(args)
+	if err != nil {
+		return err
+	}
+	r, err := c.schemes.Fetch(ctx, u)
+	if err != nil {
+		return err
+	}
+	env, err := grubenv.Parse(uio.Reader(r))
+	if err != nil {
+		return fmt.Errorf("%s: %v", u, err)
+	}
+
+	if len(whitelist) == 0 {
+		for k, v := range env.Vars {
+			c.env.set(k, v)
+		}
+		return nil
+	}
+	for _, k := range whitelist {
+		if v, ok := env.Vars[k]; ok {
+			c.env.set(k, v)
+		}
+	}
+	return nil
+}
+
+// envSave is a save_env command, which is deferred until an image is booted.
+type envSave struct {
+	// path is the local file of the environment block.
+	path string
+
+	// vars are the saved variables with their values at the time of the
+	// command; nil values are unset variables, which are removed.
+	vars map[string]*string
+}
+
+// cmdSaveEnv implements save_env.
+//
+// See https://www.gnu.org/software/grub/manual/grub/html_node/save_005fenv.html
+//
+// The environment block can only be written if it is a local file. As the
+// config is evaluated to find out what it would boot, rather than to boot
+// it, the block is not written right away. It is written once the image of
+// the menu entry the user chooses is loaded: save_env at the top level of the
+// config, such as clearing a one-time next_entry, applies to every entry, and
+// save_env in an entry, such as savedefault, only to that entry.
+func cmdSaveEnv(ctx context.Context, c *parser, name string, args []string) error {
+	u, vars, err := c.envFile(args)
+	if err != nil {
+		return err
+	}
+	if len(vars) == 0 {
+		return errors.New("no variables specified")
+	}
+	if u.Scheme != "file" {
+		return fmt.Errorf("cannot write environment block to %s", u)
+	}
+
+	save := envSave{
+		path: u.Path,
+		vars: make(map[string]*string),
+	}
+	for _, k := range vars {
+		if v, ok := c.env.get(k); ok {
+			save.vars[k] = &v
+		} else {
+			save.vars[k] = nil
+		}
+	}
+	if c.cur != nil {
+		c.cur.saves = append(c.cur.saves, save)
+	} else {
+		c.saves = append(c.saves, save)
+	}
+	return nil
+}
+
+// saveEnvOnLoad makes img write the environment blocks of saves, in order,
+// once it is loaded.
+func saveEnvOnLoad(img boot.OSImage, saves []envSave) {
+	if len(saves) == 0 {
+		return
+	}
+	loaded := func() error {
+		for _, s := range saves {
+			if err := s.write(); err != nil {
+				return fmt.Errorf("save_env: %v", err)
+			}
+		}
+		return nil
+	}
+	switch i := img.(type) {
+	case *boot.LinuxImage:
+		i.Loaded = loaded
+	case *boot.MultibootImage:
+		i.Loaded = loaded
+	}
+}
+
+// write updates the environment block. Its file system is usually mounted
+// read-only, so it is remounted read-write for as long as it takes.
+func (s envSave) write() (err error) {
+	restore, err := mount.RemountWritable(s.path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := restore(); err == nil {
+			err = rerr
+		}
+	}()
+
+	env, err := grubenv.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	for k, v := range s.vars {
+		if v != nil {
+			env.Vars[k] = *v
+		} else {
+			delete(env.Vars, k)
+		}
+	}
+	return env.WriteFile(s.path)
+}
@@ -0,0 +1,376 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Debug can be set to a logging function to see why GRUB commands fail.
+var Debug = func(string, ...interface{}) {}
+
+const (
+	// maxDepth limits the nesting of function calls and sourced files.
+	maxDepth = 64
+
+	// maxIterations limits the number of iterations of while and until
+	// loops, since we evaluate scripts unattended.
+	maxIterations = 10000
+)
+
+var errTooDeep = errors.New("maximum function or source nesting depth exceeded")
+
+// Control flow is implemented by returning these errors from exec functions.
+type (
+	breakError    struct{ n int }
+	continueError struct{ n int }
+	returnError   struct{ status int }
+)
+
+func (breakError) Error() string    { return "break outside of a loop" }
+func (continueError) Error() string { return "continue outside of a loop" }
+func (returnError) Error() string   { return "return outside of a function" }
+
+// variable is a GRUB environment variable.
+type variable struct {
+	value    string
+	exported bool
+}
+
+// environment is a GRUB variable context.
+//
+// GRUB opens a new context for submenus and configfile, and only exported
+// variables are copied into the new context.
+type environment struct {
+	vars map[string]*variable
+}
+
+func newEnvironment() *environment {
+	return &environment{vars: make(map[string]*variable)}
+}
+
+func (e *environment) get(name string) (string, bool) {
+	if v, ok := e.vars[name]; ok {
+		return v.value, true
+	}
+	return "", false
+}
+
+func (e *environment) set(name, value string) {
+	if v, ok := e.vars[name]; ok {
+		v.value = value
+		return
+	}
+	e.vars[name] = &variable{value: value}
+}
+
+func (e *environment) unset(name string) {
+	delete(e.vars, name)
+}
+
+func (e *environment) export(name string) {
+	if v, ok := e.vars[name]; ok {
+		v.exported = true
+		return
+	}
+	e.vars[name] = &variable{exported: true}
+}
+
+// clone copies the environment. If exportedOnly is set, only exported
+// variables are copied, as GRUB does when opening a new context.
+func (e *environment) clone(exportedOnly bool) *environment {
+	n := newEnvironment()
+	for name, v := range e.vars {
+		if exportedOnly && !v.exported {
+			continue
+		}
+		nv := *v
+		n.vars[name] = &nv
+	}
+	return n
+}
+
+// isName returns true if s is a valid variable name.
+func isName(s string) bool {
+	if len(s) == 0 || ('0' <= s[0] && s[0] <= '9') {
+		return false
+	}
+	for _, r := range s {
+		if !isNameRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the value of the variable `name`, including positional and
+// special parameters.
+func (c *parser) lookup(name string) string {
+	switch name {
+	case "?":
+		return strconv.Itoa(c.status)
+	case "#":
+		return strconv.Itoa(len(c.positional))
+	case "@", "*":
+		return strings.Join(c.positional, " ")
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		if n >= 1 && n <= len(c.positional) {
+			return c.positional[n-1]
+		}
+		return ""
+	}
+	v, _ := c.env.get(name)
+	return v
+}
+
+// expand expands words into fields.
+//
+// Unquoted variable values are split on blanks; quoted parts never are. A
+// word that expands to nothing unquoted produces no field at all.
+func (c *parser) expand(words []word) []string {
+	var fields []string
+	for _, w := range words {
+		var cur strings.Builder
+		started := false
+		for _, p := range w {
+			if !p.isVar {
+				cur.WriteString(p.text)
+				started = true
+				continue
+			}
+
+			val := c.lookup(p.text)
+			if p.quoted {
+				cur.WriteString(val)
+				started = true
+				continue
+			}
+
+			// Field splitting.
+			startsBlank := len(val) > 0 && strings.ContainsRune(" \t\n", rune(val[0]))
+			pieces := strings.Fields(val)
+			if len(pieces) == 0 {
+				if startsBlank && started {
+					fields = append(fields, cur.String())
+					cur.Reset()
+					started = false
+				}
+				continue
+			}
+			if startsBlank && started {
+				fields = append(fields, cur.String())
+				cur.Reset()
+			}
+			for i, piece := range pieces {
+				if i > 0 {
+					fields = append(fields, cur.String())
+					cur.Reset()
+				}
+				cur.WriteString(piece)
+			}
+			started = true
+			if strings.ContainsRune(" \t\n", rune(val[len(val)-1])) {
+				fields = append(fields, cur.String())
+				cur.Reset()
+				started = false
+			}
+		}
+		if started {
+			fields = append(fields, cur.String())
+		}
+	}
+	return fields
+}
+
+// expandWord expands a single word without field splitting, as is done for
+// the value of an assignment.
+func (c *parser) expandWord(w word) string {
+	var s strings.Builder
+	for _, p := range w {
+		if p.isVar {
+			s.WriteString(c.lookup(p.text))
+		} else {
+			s.WriteString(p.text)
+		}
+	}
+	return s.String()
+}
+
+// assignment returns the name and value word if w is of the form name=value.
+func assignment(w word) (string, word, bool) {
+	if len(w) == 0 || w[0].isVar || w[0].quoted {
+		return "", nil, false
+	}
+	i := strings.IndexByte(w[0].text, '=')
+	if i < 0 || !isName(w[0].text[:i]) {
+		return "", nil, false
+	}
+	value := append(word{}, w[1:]...)
+	if rest := w[0].text[i+1:]; len(rest) > 0 {
+		value = append(word{{text: rest}}, value...)
+	}
+	return w[0].text[:i], value, true
+}
+
+// execScript executes a list of commands.
+func (c *parser) execScript(ctx context.Context, sc script) error {
+	for _, cmd := range sc {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := c.exec(ctx, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *parser) exec(ctx context.Context, cmd command) error {
+	switch cmd := cmd.(type) {
+	case *simpleCommand:
+		return c.execSimple(ctx, cmd)
+
+	case *ifCommand:
+		for i, cond := range cmd.conds {
+			if err := c.execScript(ctx, cond); err != nil {
+				return err
+			}
+			if c.status == 0 {
+				return c.execScript(ctx, cmd.bodies[i])
+			}
+		}
+		c.status = 0
+		return c.execScript(ctx, cmd.otherwise)
+
+	case *forCommand:
+		c.status = 0
+		for _, val := range c.expand(cmd.words) {
+			c.env.set(cmd.name, val)
+			if stop, err := loopControl(c.execScript(ctx, cmd.body)); stop || err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case *whileCommand:
+		for i := 0; ; i++ {
+			if i >= maxIterations {
+				return fmt.Errorf("line %d: loop did not terminate after %d iterations", cmd.line, maxIterations)
+			}
+			if err := c.execScript(ctx, cmd.cond); err != nil {
+				return err
+			}
+			if (c.status == 0) == cmd.until {
+				c.status = 0
+				return nil
+			}
+			if stop, err := loopControl(c.execScript(ctx, cmd.body)); stop || err != nil {
+				return err
+			}
+		}
+
+	case *functionCommand:
+		c.functions[cmd.name] = cmd
+		c.status = 0
+		return nil
+
+	case *menuCommand:
+		return c.addMenuEntry(cmd)
+	}
+	return fmt.Errorf("line %d: unknown command type %T", cmd.Line(), cmd)
+}
+
+// loopControl interprets the error returned by a loop body. stop is true if
+// the loop should be exited, and err is the error to pass on to the caller.
+func loopControl(err error) (stop bool, _ error) {
+	switch e := err.(type) {
+	case nil:
+		return false, nil
+	case breakError:
+		if e.n > 1 {
+			return true, breakError{e.n - 1}
+		}
+		return true, nil
+	case continueError:
+		if e.n > 1 {
+			return true, continueError{e.n - 1}
+		}
+		return false, nil
+	}
+	return true, err
+}
+
+func (c *parser) execSimple(ctx context.Context, cmd *simpleCommand) error {
+	args := cmd.args
+	for len(args) > 0 {
+		name, value, ok := assignment(args[0])
+		if !ok {
+			break
+		}
+		c.env.set(name, c.expandWord(value))
+		c.status = 0
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	fields := c.expand(args)
+	if len(fields) == 0 {
+		return nil
+	}
+	name, fargs := fields[0], fields[1:]
+
+	if b, ok := builtins[name]; ok {
+		err := b(ctx, c, name, fargs)
+		switch err.(type) {
+		case nil:
+			c.status = 0
+		case breakError, continueError, returnError:
+			return err
+		default:
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			Debug("[grub] line %d: %s: %v", cmd.line, name, err)
+			c.status = 1
+		}
+		return nil
+	}
+
+	if f, ok := c.functions[name]; ok {
+		return c.call(ctx, f, fargs)
+	}
+
+	Debug("[grub] line %d: can't find command %q", cmd.line, name)
+	c.status = 1
+	return nil
+}
+
+// call executes function f with positional parameters args.
+func (c *parser) call(ctx context.Context, f *functionCommand, args []string) error {
+	if c.depth >= maxDepth {
+		return errTooDeep
+	}
+	c.depth++
+	saved := c.positional
+	c.positional = args
+	defer func() {
+		c.positional = saved
+		c.depth--
+	}()
+
+	err := c.execScript(ctx, f.body)
+	if r, ok := err.(returnError); ok {
+		c.status = r.status
+		return nil
+	}
+	return err
+}
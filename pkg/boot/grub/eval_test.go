@@ -0,0 +1,536 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/boottest"
+	"github.com/u-root/u-root/pkg/boot/grub/grubenv"
+	"github.com/u-root/u-root/pkg/boot/multiboot"
+	"github.com/u-root/u-root/pkg/curl"
+	"github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/mount/block"
+	"github.com/u-root/u-root/pkg/testutil"
+	"golang.org/x/sys/unix"
+)
+
+func TestEval(t *testing.T) {
+	for _, tt := range []struct {
+		desc   string
+		script string
+		want   string
+	}{
+		{
+			desc:   "variables",
+			script: `set a=foo; b="bar baz"; echo $a ${a}x "$b" $b "" $unset`,
+			want:   `echo:[]string{"foo", "foox", "bar baz", "bar", "baz", ""}`,
+		},
+		{
+			desc:   "set with quoted value",
+			script: `set default="1>0"; echo "$default"`,
+			want:   `echo:[]string{"1>0"}`,
+		},
+		{
+			desc:   "unset",
+			script: `set a=foo; unset a; echo x$a`,
+			want:   `echo:[]string{"x"}`,
+		},
+		{
+			desc: "if elif else",
+			script: `
+				for v in 1 2 3; do
+					if [ $v = 1 ]; then echo one
+					elif [ $v -eq 2 ]; then echo two
+					else echo other; fi
+				done`,
+			want: `echo:[]string{"one"}
+echo:[]string{"two"}
+echo:[]string{"other"}`,
+		},
+		{
+			desc: "test operators",
+			script: `
+				if [ -n "" -o -z "" ]; then echo or; fi
+				if [ a != b -a ! a = b ]; then echo and; fi
+				if [ "$empty" ]; then echo nonempty; fi
+				if [ ( 1 -lt 2 ) ]; then echo paren; fi
+				if test x$feature_menuentry_id = xy; then echo feature; fi`,
+			want: `echo:[]string{"or"}
+echo:[]string{"and"}
+echo:[]string{"paren"}
+echo:[]string{"feature"}`,
+		},
+		{
+			desc: "functions",
+			script: `
+				function f {
+					echo $# "$1" $2
+					return 3
+					echo unreachable
+				}
+				f "a b" c
+				echo $?`,
+			want: `echo:[]string{"2", "a b", "c"}
+echo:[]string{"3"}`,
+		},
+		{
+			desc: "loops",
+			script: `
+				for i in a b c d; do
+					if [ $i = b ]; then continue; fi
+					if [ $i = d ]; then break; fi
+					echo $i
+				done
+				n=x
+				while [ $n != xxx ]; do n=x$n; done
+				echo $n`,
+			want: `echo:[]string{"a"}
+echo:[]string{"c"}
+echo:[]string{"xxx"}`,
+		},
+		{
+			desc:   "unknown commands fail",
+			script: `if loadfont unicode; then echo loaded; else echo failed; fi`,
+			want:   `echo:[]string{"failed"}`,
+		},
+		{
+			desc:   "keywords are words after the command",
+			script: `echo if then else fi for do done`,
+			want:   `echo:[]string{"if", "then", "else", "fi", "for", "do", "done"}`,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			var b bytes.Buffer
+			c := newParser(&url.URL{Scheme: "file", Path: "/"}, curl.DefaultSchemes)
+			c.W = &b
+			if err := c.append(context.Background(), tt.script); err != nil {
+				t.Fatalf("append() = %v", err)
+			}
+			if got := strings.TrimSpace(b.String()); got != tt.want {
+				t.Errorf("output:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalInfiniteLoop(t *testing.T) {
+	c := newParser(&url.URL{Scheme: "file", Path: "/"}, curl.DefaultSchemes)
+	if err := c.append(context.Background(), `while true; do echo; done`); err == nil {
+		t.Errorf("append(infinite loop) = nil, want error")
+	}
+	if err := c.append(context.Background(), `function f { f; }; f`); err != errTooDeep {
+		t.Errorf("append(infinite recursion) = %v, want %v", err, errTooDeep)
+	}
+}
+
+func TestMenu(t *testing.T) {
+	fs := curl.NewMockScheme("tftp")
+	fs.Add("1.2.3.4", "/boot/vmlinuz", "kernel")
+	fs.Add("1.2.3.4", "/boot/vmlinuz-old", "old kernel")
+	fs.Add("1.2.3.4", "/boot/initrd", "initrd")
+	fs.Add("1.2.3.4", "/boot/ucode", "ucode")
+	fs.Add("1.2.3.4", "/boot/xen", "xen")
+	fs.Add("1.2.3.4", "/common.cfg", `
+		function load_linux {
+			linux /boot/$1 root=$rootdev $extra
+		}
+	`)
+	s := make(curl.Schemes)
+	s.Register(fs.Scheme, fs)
+
+	for _, tt := range []struct {
+		desc   string
+		config string
+		want   []boot.OSImage
+	}{
+		{
+			desc: "submenus and default",
+			config: `
+				set default="1>old"
+				menuentry 'Linux' --class os --id linux {
+					linux /boot/vmlinuz ro
+					initrd /boot/initrd
+				}
+				submenu 'Advanced' {
+					menuentry 'Old Linux' --id=old {
+						linux /boot/vmlinuz-old ro single
+					}
+					menuentry 'Xen' {
+						multiboot /boot/xen dom0_mem=1G
+						module /boot/vmlinuz console=hvc0
+						module --nounzip /boot/initrd
+					}
+				}
+				menuentry 'No kernel' {
+					echo nothing to see here
+				}
+			`,
+			want: []boot.OSImage{
+				&boot.LinuxImage{
+					Name:    "Old Linux",
+					Submenu: []string{"Advanced"},
+					Kernel:  strings.NewReader("old kernel"),
+					Cmdline: "ro single",
+				},
+				&boot.LinuxImage{
+					Name:    "Linux",
+					Kernel:  strings.NewReader("kernel"),
+					Initrd:  strings.NewReader("initrd"),
+					Cmdline: "ro",
+				},
+				&boot.MultibootImage{
+					Name:    "Xen",
+					Submenu: []string{"Advanced"},
+					Kernel:  strings.NewReader("xen"),
+					Cmdline: "dom0_mem=1G",
+					Modules: []multiboot.Module{
+						{
+							Module:  strings.NewReader("kernel"),
+							Cmdline: "/boot/vmlinuz console=hvc0",
+						},
+						{
+							Module:  strings.NewReader("initrd"),
+							Cmdline: "/boot/initrd",
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "entries see the final state of the config",
+			config: `
+				source /common.cfg
+				set rootdev=/dev/sda1
+				menuentry 'A' {
+					set extra="quiet splash"
+					load_linux vmlinuz
+					initrd /boot/ucode /boot/initrd
+				}
+				menuentry 'B' {
+					load_linux vmlinuz
+				}
+				set rootdev=/dev/sda2
+				set default=B
+			`,
+			want: []boot.OSImage{
+				&boot.LinuxImage{
+					Name:    "B",
+					Kernel:  strings.NewReader("kernel"),
+					Cmdline: "root=/dev/sda2",
+				},
+				&boot.LinuxImage{
+					Name:    "A",
+					Kernel:  strings.NewReader("kernel"),
+					Initrd:  boot.CatInitrds(strings.NewReader("ucode"), strings.NewReader("initrd")),
+					Cmdline: "root=/dev/sda2 quiet splash",
+				},
+			},
+		},
+		{
+			desc: "submenus only inherit exported variables",
+			config: `
+				set exported=yes
+				set private=yes
+				export exported
+				submenu 'S' {
+					menuentry 'E' {
+						linux /boot/vmlinuz e=$exported p=$private
+					}
+				}
+			`,
+			want: []boot.OSImage{
+				&boot.LinuxImage{
+					Name:    "E",
+					Submenu: []string{"S"},
+					Kernel:  strings.NewReader("kernel"),
+					Cmdline: "e=yes p=",
+				},
+			},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			fs.Add("1.2.3.4", "/grub/grub.cfg", tt.config)
+			wd := &url.URL{Scheme: "tftp", Host: "1.2.3.4", Path: "/"}
+			got, err := ParseConfigFile(context.Background(), s, "grub/grub.cfg", wd)
+			if err != nil {
+				t.Fatalf("ParseConfigFile() = %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseConfigFile() = %d images, want %d: %v", len(got), len(tt.want), got)
+			}
+			for i := range tt.want {
+				if err := boottest.SameBootImage(got[i], tt.want[i]); err != nil {
+					t.Errorf("image %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestFindEntry(t *testing.T) {
+	entries := []*bootEntry{
+		{titles: []string{"Linux"}, ids: []string{"linux"}, indices: []int{0}},
+		{titles: []string{"Advanced", "Old"}, ids: []string{"adv", "old"}, indices: []int{1, 0}},
+		{titles: []string{"a>b", "c"}, ids: []string{"", ""}, indices: []int{2, 0}},
+	}
+	for _, tt := range []struct {
+		spec string
+		want int
+	}{
+		{"", -1},
+		{"0", 0},
+		{"linux", 0},
+		{"Linux", 0},
+		{"1", 1},
+		{"1>0", 1},
+		{"Advanced>Old", 1},
+		{"adv>0", 1},
+		{"a>>b>c", 2},
+		{"3", -1},
+		{"Advanced>New", -1},
+	} {
+		if got := findEntry(entries, tt.spec); got != tt.want {
+			t.Errorf("findEntry(%q) = %d, want %d", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	// The kernel lives on another "partition", which we pretend is already
+	// mounted by adding it to the pool.
+	dir, err := ioutil.TempDir("", "grub-search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	boot1 := filepath.Join(dir, "boot1")
+	os.MkdirAll(filepath.Join(boot1, "grub"), 0755)
+	efi := filepath.Join(dir, "efi")
+	os.MkdirAll(filepath.Join(efi, "EFI", "distro"), 0755)
+
+	if err := ioutil.WriteFile(filepath.Join(boot1, "vmlinuz"), []byte("kernel"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(boot1, "grub", "grub.cfg"), []byte(`
+		menuentry 'Linux' {
+			linux /vmlinuz root=$root
+		}
+	`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(efi, "EFI", "distro", "grub.cfg"), []byte(`
+		search --no-floppy --fs-uuid --set=root --hint-efi=hd0,gpt2 0C1C-3DF0
+		set prefix=($root)/grub
+		configfile $prefix/grub.cfg
+	`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	devices := block.BlockDevices{
+		{Name: "sda1", FsUUID: "0123"},
+		{Name: "sda2", FsUUID: "0c1c-3df0"},
+	}
+	var pool mount.Pool
+	pool.Add(&mount.MountPoint{Device: "/dev/sda1", Path: efi})
+	pool.Add(&mount.MountPoint{Device: "/dev/sda2", Path: boot1})
+
+	got, err := ParseLocalConfigWithDevices(context.Background(), efi, devices, &pool)
+	if err != nil {
+		t.Fatalf("ParseLocalConfigWithDevices() = %v", err)
+	}
+	want := []boot.OSImage{
+		&boot.LinuxImage{
+			Name:    "Linux",
+			Kernel:  strings.NewReader("kernel"),
+			Cmdline: "root=sda2",
+		},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("ParseLocalConfigWithDevices() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if err := boottest.SameBootImage(got[i], want[i]); err != nil {
+			t.Errorf("image %d: %v", i, err)
+		}
+	}
+	if k := got[0].(*boot.LinuxImage).Kernel.(fmt.Stringer).String(); k != "file://"+filepath.Join(boot1, "vmlinuz") {
+		t.Errorf("kernel is %s, want it on %s", k, boot1)
+	}
+}
+
+func TestGrubenv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grub-env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "boot", "grub"), 0755)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// This is what grub-mkconfig generates for GRUB_DEFAULT=saved and
+	// GRUB_SAVEDEFAULT=true.
+	if err := ioutil.WriteFile(filepath.Join(dir, "boot", "grub", "grub.cfg"), []byte(`
+		if [ -s $prefix/grubenv ]; then
+			set have_grubenv=true
+			load_env
+		fi
+		if [ "${next_entry}" ] ; then
+			set default="${next_entry}"
+			set next_entry=
+			save_env next_entry
+			set boot_once=true
+		else
+			set default="${saved_entry}"
+		fi
+		function savedefault {
+			if [ -z "${boot_once}" ]; then
+				saved_entry="${chosen}"
+				save_env saved_entry
+			fi
+		}
+		menuentry 'A' { savedefault; linux /a }
+		menuentry 'B' { savedefault; linux /b }
+		menuentry 'C' { savedefault; linux /c }
+	`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	envFile := filepath.Join(dir, "boot", "grub", "grubenv")
+	env := &grubenv.Env{Vars: map[string]string{
+		"saved_entry": "C",
+		"next_entry":  "B",
+	}}
+	f, err := os.Create(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.WriteTo(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// Parsing does not write anything, booting an entry does: next_entry
+	// is cleared after it is booted once, and then entries save themselves
+	// as the default.
+	for i, tt := range []struct {
+		first string
+		boot  string
+		vars  map[string]string
+	}{
+		{"B", "B", map[string]string{"saved_entry": "C", "next_entry": ""}},
+		{"C", "A", map[string]string{"saved_entry": "A", "next_entry": ""}},
+		{"A", "", nil},
+	} {
+		before, err := ioutil.ReadFile(envFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ParseLocalConfig(context.Background(), dir)
+		if err != nil {
+			t.Fatalf("ParseLocalConfig() = %v", err)
+		}
+		if len(got) != 3 || got[0].Label() != tt.first {
+			t.Fatalf("boot %d: ParseLocalConfig() = %v, want %s first", i, got, tt.first)
+		}
+		if after, err := ioutil.ReadFile(envFile); err != nil || !bytes.Equal(after, before) {
+			t.Errorf("boot %d: ParseLocalConfig() wrote grubenv", i)
+		}
+		if tt.boot == "" {
+			continue
+		}
+
+		for _, img := range got {
+			if img.Label() != tt.boot {
+				continue
+			}
+			if err := img.(*boot.LinuxImage).Loaded(); err != nil {
+				t.Fatalf("boot %d: Loaded() = %v", i, err)
+			}
+		}
+		env, err := grubenv.ReadFile(envFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(env.Vars, tt.vars) {
+			t.Errorf("boot %d: grubenv = %v, want %v", i, env.Vars, tt.vars)
+		}
+	}
+}
+
+func TestGrubenvReadOnly(t *testing.T) {
+	testutil.SkipIfNotRoot(t)
+
+	dir, err := ioutil.TempDir("", "grub-env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mp, err := mount.Mount("tmpfs", dir, "tmpfs", "", 0)
+	if err != nil {
+		t.Skipf("cannot mount tmpfs: %v", err)
+	}
+	defer mp.Unmount(mount.MNT_DETACH)
+
+	os.MkdirAll(filepath.Join(dir, "boot", "grub"), 0755)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "boot", "grub", "grub.cfg"), []byte(`
+		load_env
+		set next_entry=
+		save_env next_entry
+		menuentry 'A' { linux /a }
+	`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	envFile := filepath.Join(dir, "boot", "grub", "grubenv")
+	b, err := (&grubenv.Env{Vars: map[string]string{"next_entry": "A"}}).Encode(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(envFile, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// This is how localboot mounts partitions.
+	if err := unix.Mount("", dir, "", unix.MS_REMOUNT|mount.ReadOnly, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ParseLocalConfig(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("ParseLocalConfig() = %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("ParseLocalConfig() = %v, want 1 image", got)
+	}
+	if err := got[0].(*boot.LinuxImage).Loaded(); err != nil {
+		t.Fatalf("Loaded() = %v", err)
+	}
+
+	env, err := grubenv.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"next_entry": ""}; !reflect.DeepEqual(env.Vars, want) {
+		t.Errorf("grubenv = %v, want %v", env.Vars, want)
+	}
+	if err := ioutil.WriteFile(envFile, nil, 0644); err == nil {
+		t.Errorf("the file system is still writable after Loaded()")
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// cmdTest implements the test and [ commands.
+//
+// See https://www.gnu.org/software/grub/manual/grub/html_node/test.html
+func cmdTest(ctx context.Context, c *parser, name string, args []string) error {
+	if name == "[" {
+		if len(args) == 0 || args[len(args)-1] != "]" {
+			return errors.New("missing ]")
+		}
+		args = args[:len(args)-1]
+	}
+
+	e := &testExpr{c: c, args: args}
+	ok, err := e.or()
+	if err != nil {
+		return err
+	}
+	if e.pos < len(e.args) {
+		return fmt.Errorf("unexpected argument %q", e.args[e.pos])
+	}
+	if !ok {
+		return errors.New("false")
+	}
+	return nil
+}
+
+// testExpr evaluates the arguments of test with the usual precedence of
+// ! over -a over -o.
+type testExpr struct {
+	c    *parser
+	args []string
+	pos  int
+}
+
+func (e *testExpr) peek(i int) (string, bool) {
+	if e.pos+i < len(e.args) {
+		return e.args[e.pos+i], true
+	}
+	return "", false
+}
+
+func (e *testExpr) or() (bool, error) {
+	v, err := e.and()
+	if err != nil {
+		return false, err
+	}
+	for {
+		if op, _ := e.peek(0); op != "-o" {
+			return v, nil
+		}
+		e.pos++
+		w, err := e.and()
+		if err != nil {
+			return false, err
+		}
+		v = v || w
+	}
+}
+
+func (e *testExpr) and() (bool, error) {
+	v, err := e.not()
+	if err != nil {
+		return false, err
+	}
+	for {
+		if op, _ := e.peek(0); op != "-a" {
+			return v, nil
+		}
+		e.pos++
+		w, err := e.not()
+		if err != nil {
+			return false, err
+		}
+		v = v && w
+	}
+}
+
+func (e *testExpr) not() (bool, error) {
+	if op, _ := e.peek(0); op == "!" {
+		e.pos++
+		v, err := e.not()
+		return !v, err
+	}
+	return e.primary()
+}
+
+var binaryOps = map[string]bool{
+	"=": true, "==": true, "!=": true,
+	"<": true, "<=": true, ">": true, ">=": true,
+	"-eq": true, "-ne": true, "-lt": true, "-le": true, "-gt": true, "-ge": true,
+}
+
+func (e *testExpr) primary() (bool, error) {
+	a, ok := e.peek(0)
+	if !ok {
+		// An empty expression is false.
+		return false, nil
+	}
+
+	if op, ok := e.peek(1); ok && binaryOps[op] {
+		b, ok := e.peek(2)
+		if !ok {
+			return false, fmt.Errorf("missing operand after %q", op)
+		}
+		e.pos += 3
+		return compare(a, op, b)
+	}
+
+	if a == "(" {
+		e.pos++
+		v, err := e.or()
+		if err != nil {
+			return false, err
+		}
+		if p, _ := e.peek(0); p != ")" {
+			return false, errors.New("missing )")
+		}
+		e.pos++
+		return v, nil
+	}
+
+	switch a {
+	case "-n", "-z", "-e", "-f", "-d", "-s":
+		b, ok := e.peek(1)
+		if !ok {
+			// A lone "-n" is just a non-empty string.
+			e.pos++
+			return true, nil
+		}
+		e.pos += 2
+		switch a {
+		case "-n":
+			return len(b) > 0, nil
+		case "-z":
+			return len(b) == 0, nil
+		default:
+			return e.c.fileTest(a, b), nil
+		}
+	}
+
+	e.pos++
+	return len(a) > 0, nil
+}
+
+func compare(a, op, b string) (bool, error) {
+	switch op {
+	case "=", "==":
+		return a == b, nil
+	case "!=":
+		return a != b, nil
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case ">":
+		return a > b, nil
+	case ">=":
+		return a >= b, nil
+	}
+
+	x, err := strconv.ParseInt(a, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("%q is not a number", a)
+	}
+	y, err := strconv.ParseInt(b, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("%q is not a number", b)
+	}
+	switch op {
+	case "-eq":
+		return x == y, nil
+	case "-ne":
+		return x != y, nil
+	case "-lt":
+		return x < y, nil
+	case "-le":
+		return x <= y, nil
+	case "-gt":
+		return x > y, nil
+	case "-ge":
+		return x >= y, nil
+	}
+	return false, fmt.Errorf("unknown operator %q", op)
+}
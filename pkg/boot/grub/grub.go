@@ -10,8 +10,11 @@
 // - https://www.gnu.org/software/grub/manual/grub/html_node/Shell_002dlike-scripting.html
 // - https://www.gnu.org/software/grub/manual/grub/html_node/Commands.html
 //
-// Currently, only the linux[16|efi], initrd[16|efi], menuentry and set
-// directives are partially supported.
+// The config is interpreted as a GRUB script: variables, conditionals, loops,
+// functions, menu entries and submenus are supported, as well as the search,
+// source and configfile commands. Commands that only make sense in GRUB
+// itself (insmod, terminal_output, ...) are ignored, and unknown commands
+// fail, just as they would in GRUB.
 package grub
 
 import (
@@ -20,14 +23,14 @@ import (
 	"io"
 	"log"
 	"net/url"
+	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 
 	"github.com/u-root/u-root/pkg/boot"
-	"github.com/u-root/u-root/pkg/boot/multiboot"
 	"github.com/u-root/u-root/pkg/curl"
-	"github.com/u-root/u-root/pkg/shlex"
+	"github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/mount/block"
 	"github.com/u-root/u-root/pkg/uio"
 )
 
@@ -41,10 +44,22 @@ var probeGrubFiles = []string{
 // ParseLocalConfig looks for a GRUB config in the disk partition mounted at
 // diskDir and parses out OSes to boot.
 //
-// This... is at best crude, at worst totally wrong, since we fundamentally
-// assume that the kernels we boot are only on this one partition. But so is
-// this whole parser.
+// Files named without a device are assumed to be on the partition mounted at
+// diskDir.
+//
+// The config's load_env and save_env commands read and write the GRUB
+// environment block, so that a one-time next_entry (see grub-reboot) or
+// saved_entry (see grub-set-default) is booted first and next_entry is
+// cleared, as GRUB does. The block is written once the chosen image is
+// loaded, remounting diskDir read-write for it if needed.
 func ParseLocalConfig(ctx context.Context, diskDir string) ([]boot.OSImage, error) {
+	return ParseLocalConfigWithDevices(ctx, diskDir, nil, nil)
+}
+
+// ParseLocalConfigWithDevices is like ParseLocalConfig, but if the config
+// searches for another partition, it is looked up in devices and mounted
+// using mountPool.
+func ParseLocalConfigWithDevices(ctx context.Context, diskDir string, devices block.BlockDevices, mountPool *mount.Pool) ([]boot.OSImage, error) {
 	wd := &url.URL{
 		Scheme: "file",
 		Path:   diskDir,
@@ -69,8 +84,34 @@ func ParseLocalConfig(ctx context.Context, diskDir string) ([]boot.OSImage, erro
 		}
 	}
 
-	for _, relname := range append(relNames, probeGrubFiles...) {
-		c, err := ParseConfigFile(ctx, curl.DefaultSchemes, relname, wd)
+	return parseFirst(ctx, curl.DefaultSchemes, append(relNames, probeGrubFiles...), wd, devices, mountPool)
+}
+
+// ParseRootConfig looks for a GRUB config at the usual places under wd, and
+// parses out OSes to boot. Files are fetched using s, so wd need not be a
+// mounted partition, e.g. it can be the root of an ISO image.
+func ParseRootConfig(ctx context.Context, s curl.Schemes, wd *url.URL) ([]boot.OSImage, error) {
+	return parseFirst(ctx, s, append([]string{"EFI/BOOT/grub.cfg"}, probeGrubFiles...), wd, nil, nil)
+}
+
+// ParseLoopbackConfig parses the boot/grub/loopback.cfg of an ISO image
+// whose root is wd. GRUB reads this config when booting the image from
+// isoPath, the path of the image file on its partition; the config passes it
+// on to the kernel, so that the live system can find its image.
+//
+// See https://www.supergrubdisk.org/wiki/Loopback.cfg.
+func ParseLoopbackConfig(ctx context.Context, s curl.Schemes, wd *url.URL, isoPath string) ([]boot.OSImage, error) {
+	p := newParser(wd, s)
+	p.env.set("iso_path", isoPath)
+	p.env.export("iso_path")
+	return p.parseConfigFile(ctx, "boot/grub/loopback.cfg")
+}
+
+// parseFirst parses the first of the configs named relative to wd that
+// exists.
+func parseFirst(ctx context.Context, s curl.Schemes, relNames []string, wd *url.URL, devices block.BlockDevices, mountPool *mount.Pool) ([]boot.OSImage, error) {
+	for _, relname := range relNames {
+		c, err := ParseConfigFileWithDevices(ctx, s, relname, wd, devices, mountPool)
 		if curl.IsURLError(err) {
 			continue
 		}
@@ -82,67 +123,112 @@ func ParseLocalConfig(ctx context.Context, diskDir string) ([]boot.OSImage, erro
 // ParseConfigFile parses a grub configuration as specified in
 // https://www.gnu.org/software/grub/manual/grub/
 //
-// Currently, only the linux[16|efi], initrd[16|efi], menuentry and set
-// directives are partially supported.
+// The config is evaluated as a GRUB script: variables are expanded,
+// conditionals, loops and functions are executed, and each menu entry is run
+// to find out which kernel, initrd and command line it would boot. Entries in
+// submenus are flattened; the titles of their enclosing submenus are their
+// Submenu, so that boot menus can show them in the same submenus. The default
+// entry is returned first.
 //
 // `wd` is the default scheme, host, and path for any files named as a
 // relative path - e.g. kernel, include, and initramfs paths are requested
 // relative to the wd.
+//
+// The search command never finds a device.
 func ParseConfigFile(ctx context.Context, s curl.Schemes, configFile string, wd *url.URL) ([]boot.OSImage, error) {
+	return ParseConfigFileWithDevices(ctx, s, configFile, wd, nil, nil)
+}
+
+// ParseConfigFileWithDevices is like ParseConfigFile, but the search command
+// looks for partitions in devices, and mounts them using mountPool.
+func ParseConfigFileWithDevices(ctx context.Context, s curl.Schemes, configFile string, wd *url.URL, devices block.BlockDevices, mountPool *mount.Pool) ([]boot.OSImage, error) {
 	p := newParser(wd, s)
-	if err := p.appendFile(ctx, configFile); err != nil {
+	p.devices = devices
+	p.mountPool = mountPool
+	return p.parseConfigFile(ctx, configFile)
+}
+
+// parseConfigFile evaluates configFile and returns the images of its menu
+// entries, the default entry first.
+func (c *parser) parseConfigFile(ctx context.Context, configFile string) ([]boot.OSImage, error) {
+	// $prefix is the GRUB directory the config was loaded from.
+	prefix := path.Dir(path.Join("/", filepath.ToSlash(configFile)))
+	c.env.set("prefix", prefix)
+	c.env.export("prefix")
+	c.env.set("config_directory", prefix)
+	c.env.set("config_file", path.Join("/", filepath.ToSlash(configFile)))
+
+	if err := c.appendFile(ctx, configFile); err != nil {
 		return nil, err
 	}
-
-	// Don't add entries twice.
-	//
-	// Multiple labels can refer to the same image, so we have to dedup by pointer.
-	seenLinux := make(map[*boot.LinuxImage]struct{})
-	seenMB := make(map[*boot.MultibootImage]struct{})
-
-	if len(p.defaultEntry) > 0 {
-		p.labelOrder = append([]string{p.defaultEntry}, p.labelOrder...)
+	entries, err := c.bootEntries(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	var images []boot.OSImage
-	for _, label := range p.labelOrder {
-		if img, ok := p.linuxEntries[label]; ok {
-			if _, ok := seenLinux[img]; !ok {
-				images = append(images, img)
-				seenLinux[img] = struct{}{}
-			}
-		}
-
-		if img, ok := p.mbEntries[label]; ok {
-			if _, ok := seenMB[img]; !ok {
-				images = append(images, img)
-				seenMB[img] = struct{}{}
-			}
-		}
+	defaultEntry, _ := c.env.get("default")
+	if i := findEntry(entries, defaultEntry); i >= 0 {
+		images = append(images, entries[i].image)
+		entries = append(entries[:i:i], entries[i+1:]...)
+	}
+	for _, e := range entries {
+		images = append(images, e.image)
 	}
 	return images, nil
 }
 
+// features are set by GRUB to tell grub-mkconfig generated configs which
+// features it supports.
+var features = []string{
+	"feature_200_final",
+	"feature_all_video_module",
+	"feature_chainloader_bpb",
+	"feature_default_font_path",
+	"feature_menuentry_id",
+	"feature_menuentry_options",
+	"feature_nativedisk_cmd",
+	"feature_ntldr",
+	"feature_platform_search_hint",
+	"feature_timeout_style",
+}
+
 type parser struct {
-	linuxEntries map[string]*boot.LinuxImage
-	mbEntries    map[string]*boot.MultibootImage
+	W io.Writer
 
-	labelOrder   []string
-	defaultEntry string
+	// env is the current variable context.
+	env *environment
 
-	W io.Writer
+	// functions are the functions defined so far, by name.
+	functions map[string]*functionCommand
+
+	// positional are the positional parameters $1, $2, ... of the function
+	// being executed.
+	positional []string
 
-	// parser internals.
-	numEntry int
+	// status is the exit status of the last command, $?.
+	status int
 
-	// curEntry is the current entry number as a string.
-	curEntry string
+	// depth is the current function call and source nesting depth.
+	depth int
 
-	// curLabel is the last parsed label from a "menuentry".
-	curLabel string
+	// menu collects the menu entries of the script being evaluated.
+	menu *menu
 
-	wd      *url.URL
-	schemes curl.Schemes
+	// cur is the menu entry being executed, or nil at the top level.
+	cur *entryState
+
+	// saves are the save_env commands executed outside of menu entries.
+	saves []envSave
+
+	// deviceURLs maps names of devices found by search to the URL they
+	// are mounted at.
+	deviceURLs map[string]*url.URL
+
+	wd        *url.URL
+	schemes   curl.Schemes
+	devices   block.BlockDevices
+	mountPool *mount.Pool
 }
 
 // newParser returns a new grub parser using working directory `wd`
@@ -154,12 +240,20 @@ type parser struct {
 //
 // `s` is used to get files referred to by URLs.
 func newParser(wd *url.URL, s curl.Schemes) *parser {
-	return &parser{
-		linuxEntries: make(map[string]*boot.LinuxImage),
-		mbEntries:    make(map[string]*boot.MultibootImage),
-		wd:           wd,
-		schemes:      s,
+	p := &parser{
+		env:        newEnvironment(),
+		functions:  make(map[string]*functionCommand),
+		menu:       &menu{},
+		deviceURLs: make(map[string]*url.URL),
+		wd:         wd,
+		schemes:    s,
+	}
+	for _, f := range features {
+		p.env.set(f, "y")
+		p.env.export(f)
 	}
+	p.env.export("root")
+	return p
 }
 
 func parseURL(surl string, wd *url.URL) (*url.URL, error) {
@@ -180,28 +274,31 @@ func parseURL(surl string, wd *url.URL) (*url.URL, error) {
 	return u, nil
 }
 
-// getFile parses `url` relative to the config's working directory and returns
-// an io.Reader for the requested url.
-//
-// If url is just a relative path and not a full URL, c.wd is used as the
-// "working directory" of that relative path; the resulting URL is roughly
-// path.Join(wd.String(), url).
-func (c *parser) getFile(url string) (io.ReaderAt, error) {
+// appendFile parses the config file downloaded from `url` and adds it to `c`.
+func (c *parser) appendFile(ctx context.Context, url string) error {
 	u, err := parseURL(url, c.wd)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	return c.schemes.LazyFetch(u)
+	return c.fetchAndRun(ctx, u)
 }
 
-// appendFile parses the config file downloaded from `url` and adds it to `c`.
-func (c *parser) appendFile(ctx context.Context, url string) error {
-	u, err := parseURL(url, c.wd)
+// sourceFile runs the GRUB file `name` in the current context, as the source
+// command does.
+func (c *parser) sourceFile(ctx context.Context, name string) error {
+	u, err := c.resolve(name)
 	if err != nil {
 		return err
 	}
+	if c.depth >= maxDepth {
+		return errTooDeep
+	}
+	c.depth++
+	defer func() { c.depth-- }()
+	return c.fetchAndRun(ctx, u)
+}
 
+func (c *parser) fetchAndRun(ctx context.Context, u *url.URL) error {
 	r, err := c.schemes.Fetch(ctx, u)
 	if err != nil {
 		return err
@@ -218,7 +315,10 @@ func (c *parser) appendFile(ctx context.Context, url string) error {
 	} else {
 		log.Printf("[grub] Got config file %s:\n%s\n", r, string(config))
 	}
-	return c.append(ctx, string(config))
+	if err := c.append(ctx, string(config)); err != nil {
+		return fmt.Errorf("%s: %v", u, err)
+	}
+	return nil
 }
 
 // CmdlineQuote quotes the command line as grub-core/lib/cmdline.c does
@@ -236,113 +336,20 @@ func cmdlineQuote(args []string) string {
 	return strings.Join(q, " ")
 }
 
-// append parses `config` and adds the respective configuration to `c`.
-//
-// NOTE: This parser has outlived its usefulness already, given that it doesn't
-// even understand the {} scoping in GRUB. But let's get the tests to pass, and
-// then we can do a rewrite.
+// append parses `config` and evaluates it in the current context.
 func (c *parser) append(ctx context.Context, config string) error {
-	// Here's a shitty parser.
-	for _, line := range strings.Split(config, "\n") {
-		kv := shlex.Argv(line)
-		if len(kv) < 1 {
-			continue
-		}
-		directive := strings.ToLower(kv[0])
-		// Used by tests (allow no parameters here)
-		if c.W != nil && directive == "echo" {
-			fmt.Fprintf(c.W, "echo:%#v\n", kv[1:])
-		}
-
-		if len(kv) <= 1 {
-			continue
-		}
-		arg := kv[1]
-
-		switch directive {
-		case "set":
-			vals := strings.SplitN(arg, "=", 2)
-			if len(vals) == 2 {
-				//TODO handle vars? bootVars[vals[0]] = vals[1]
-				//log.Printf("grubvar: %s=%s", vals[0], vals[1])
-				if vals[0] == "default" {
-					c.defaultEntry = vals[1]
-				}
-			}
-
-		case "configfile":
-			// TODO test that
-			if err := c.appendFile(ctx, arg); err != nil {
-				return err
-			}
-
-		case "menuentry":
-			c.curEntry = strconv.Itoa(c.numEntry)
-			c.curLabel = arg
-			c.numEntry++
-			c.labelOrder = append(c.labelOrder, c.curEntry, c.curLabel)
-
-		case "linux", "linux16", "linuxefi":
-			k, err := c.getFile(arg)
-			if err != nil {
-				return err
-			}
-			// from grub manual: "Any initrd must be reloaded after using this command" so we can replace the entry
-			entry := &boot.LinuxImage{
-				Name:    c.curLabel,
-				Kernel:  k,
-				Cmdline: cmdlineQuote(kv[2:]),
-			}
-			c.linuxEntries[c.curEntry] = entry
-			c.linuxEntries[c.curLabel] = entry
-
-		case "initrd", "initrd16", "initrdefi":
-			if e, ok := c.linuxEntries[c.curEntry]; ok {
-				i, err := c.getFile(arg)
-				if err != nil {
-					return err
-				}
-				e.Initrd = i
-			}
-
-		case "multiboot":
-			// TODO handle --quirk-* arguments ? (change parsing)
-			k, err := c.getFile(arg)
-			if err != nil {
-				return err
-			}
-			// from grub manual: "Any initrd must be reloaded after using this command" so we can replace the entry
-			entry := &boot.MultibootImage{
-				Name:    c.curLabel,
-				Kernel:  k,
-				Cmdline: cmdlineQuote(kv[2:]),
-			}
-			c.mbEntries[c.curEntry] = entry
-			c.mbEntries[c.curLabel] = entry
-
-		case "module":
-			// TODO handle --nounzip arguments ? (change parsing)
-			if e, ok := c.mbEntries[c.curEntry]; ok {
-				// The only allowed arg
-				cmdline := kv[1:]
-				if arg == "--nounzip" {
-					arg = kv[2]
-					cmdline = kv[2:]
-				}
-
-				m, err := c.getFile(arg)
-				if err != nil {
-					return err
-				}
-				// TODO: Lasy tryGzipFilter(m)
-				mod := multiboot.Module{
-					Module:  m,
-					Cmdline: cmdlineQuote(cmdline),
-				}
-				e.Modules = append(e.Modules, mod)
-			}
-		}
+	sc, err := parseScript(config)
+	if err != nil {
+		return err
 	}
-	return nil
-
+	err = c.execScript(ctx, sc)
+	switch err.(type) {
+	case breakError, continueError:
+		// GRUB ignores stray break and continue.
+		return nil
+	case returnError:
+		// return ends a sourced file.
+		return nil
+	}
+	return err
 }
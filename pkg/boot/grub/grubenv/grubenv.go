@@ -0,0 +1,182 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package grubenv reads and writes GRUB environment blocks.
+//
+// An environment block is the file GRUB's load_env and save_env commands and
+// grub-editenv operate on, usually /boot/grub/grubenv. It consists of a
+// header line and name=value lines, padded with '#' to a fixed size. GRUB
+// writes the block in place without the help of a file system driver, so the
+// size of the file never changes once it was created.
+package grubenv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	// Size is the size of an environment block as created by
+	// grub-editenv.
+	Size = 1024
+
+	header = "# GRUB Environment Block\n"
+)
+
+// ErrTooLarge is returned when the variables do not fit into the block.
+var ErrTooLarge = errors.New("environment block too small")
+
+// Env is a GRUB environment block.
+type Env struct {
+	Vars map[string]string
+}
+
+// New allocates a new, empty environment block.
+func New() *Env {
+	return &Env{
+		Vars: make(map[string]string),
+	}
+}
+
+// Parse reads an environment block.
+//
+// Parse accepts blocks that lack the header or are incorrectly padded, as
+// opposed to GRUB.
+func Parse(r io.Reader) (*Env, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	env := New()
+	for len(b) > 0 {
+		line, rest := splitLine(b)
+		b = rest
+		// Empty lines, the header and padding.
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		i := bytes.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("error parsing %q: must find = or # in each line", line)
+		}
+		env.Vars[string(line[:i])] = unescape(line[i+1:])
+	}
+	return env, nil
+}
+
+// splitLine returns the first line of b, in which newlines may be escaped
+// with a backslash, and the rest of b.
+func splitLine(b []byte) ([]byte, []byte) {
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '\n':
+			return b[:i], b[i+1:]
+		}
+	}
+	return b, nil
+}
+
+func unescape(b []byte) string {
+	var s strings.Builder
+	for i := 0; i < len(b); i++ {
+		if b[i] == '\\' && i+1 < len(b) {
+			i++
+		}
+		s.WriteByte(b[i])
+	}
+	return s.String()
+}
+
+func escape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return strings.Replace(s, "\n", "\\\n", -1)
+}
+
+// ReadFile reads the environment block in file name.
+func ReadFile(name string) (*Env, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Encode returns the environment block padded with '#' to size bytes, or
+// ErrTooLarge if the variables do not fit.
+func (env *Env) Encode(size int) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(header)
+
+	// Sort keys so order is deterministic.
+	keys := make([]string, 0, len(env.Vars))
+	for k := range env.Vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(escape(env.Vars[k]))
+		b.WriteString("\n")
+	}
+	if b.Len() > size {
+		return nil, ErrTooLarge
+	}
+	b.Write(bytes.Repeat([]byte{'#'}, size-b.Len()))
+	return b.Bytes(), nil
+}
+
+// WriteTo writes the environment block, padded to a multiple of Size bytes,
+// as grub-editenv does when creating a new block.
+func (env *Env) WriteTo(w io.Writer) (int64, error) {
+	// Grow the block until the variables fit.
+	size := Size
+	b, err := env.Encode(size)
+	for err == ErrTooLarge {
+		size += Size
+		b, err = env.Encode(size)
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// WriteFile overwrites the existing environment block in file name, as
+// save_env does.
+//
+// Like GRUB, WriteFile never changes the size of the file, and fails with
+// ErrTooLarge if the variables do not fit.
+func (env *Env) WriteFile(name string) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	b, err := env.Encode(int(fi.Size()))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt(b, 0); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
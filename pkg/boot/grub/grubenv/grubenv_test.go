@@ -0,0 +1,131 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grubenv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteTo(t *testing.T) {
+	env := &Env{map[string]string{
+		"kernel": "bzImage",
+		"initrd": "initramfs.cpio",
+	}}
+	buf := &bytes.Buffer{}
+	_, err := env.WriteTo(buf)
+	if err != nil {
+		t.Errorf("env.WriteTo(%v) error %v", env, err)
+	}
+	gotFile := buf.String()
+	wantFile := `# GRUB Environment Block
+initrd=initramfs.cpio
+kernel=bzImage
+##################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################################`
+	if diff := cmp.Diff(wantFile, gotFile); diff != "" {
+		t.Errorf("env.WriteTo(%v) diff(-want, +got) = \n%s", env, diff)
+	}
+}
+
+func TestWriteToLarge(t *testing.T) {
+	env := &Env{map[string]string{
+		"large": strings.Repeat("x", Size),
+	}}
+	buf := &bytes.Buffer{}
+	if _, err := env.WriteTo(buf); err != nil {
+		t.Fatalf("env.WriteTo() error %v", err)
+	}
+	if buf.Len() != 2*Size {
+		t.Errorf("env.WriteTo() wrote %d bytes, want %d", buf.Len(), 2*Size)
+	}
+}
+
+func TestParse(t *testing.T) {
+	file := `kernel=bzImage
+initrd=initramfs.cpio
+`
+	gotEnv, err := Parse(bytes.NewBufferString(file))
+	if err != nil {
+		t.Errorf("Parse(%q) error %v", file, err)
+	}
+	wantEnv := &Env{map[string]string{
+		"kernel": "bzImage",
+		"initrd": "initramfs.cpio",
+	}}
+	if diff := cmp.Diff(wantEnv, gotEnv); diff != "" {
+		t.Errorf("Parse(%q) diff(-want, +got) = \n%s", file, diff)
+	}
+
+	if _, err := Parse(bytes.NewBufferString("foo\n")); err == nil {
+		t.Errorf("Parse(%q) = nil, want error", "foo\n")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	env := &Env{map[string]string{
+		"saved_entry": "Advanced>Linux 5.4",
+		"next_entry":  "",
+		"escaped":     "a\\b\nc",
+	}}
+	var buf bytes.Buffer
+	if _, err := env.WriteTo(&buf); err != nil {
+		t.Fatalf("env.WriteTo() error %v", err)
+	}
+	got, err := Parse(&buf)
+	if err != nil {
+		t.Fatalf("Parse() error %v", err)
+	}
+	if diff := cmp.Diff(env, got); diff != "" {
+		t.Errorf("Parse(WriteTo()) diff(-want, +got) = \n%s", diff)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grubenv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "grubenv")
+
+	// GRUB never creates the file.
+	if err := New().WriteFile(name); !os.IsNotExist(err) {
+		t.Errorf("WriteFile(nonexistent) = %v, want not exist error", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := New().WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	env := &Env{map[string]string{"saved_entry": "1"}}
+	if err := env.WriteFile(name); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+	got, err := ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile() = %v", err)
+	}
+	if diff := cmp.Diff(env, got); diff != "" {
+		t.Errorf("ReadFile() diff(-want, +got) = \n%s", diff)
+	}
+	if fi, err := os.Stat(name); err != nil || fi.Size() != Size {
+		t.Errorf("file size changed: %v, %v", fi, err)
+	}
+
+	large := &Env{map[string]string{"large": strings.Repeat("x", Size)}}
+	if err := large.WriteFile(name); err != ErrTooLarge {
+		t.Errorf("WriteFile(too large) = %v, want %v", err, ErrTooLarge)
+	}
+}
@@ -0,0 +1,380 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tokenKind is the kind of a lexical token in a GRUB script.
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokNewline
+	tokSemicolon
+	tokLBrace
+	tokRBrace
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokEOF:
+		return "end of file"
+	case tokWord:
+		return "word"
+	case tokNewline:
+		return "newline"
+	case tokSemicolon:
+		return "';'"
+	case tokLBrace:
+		return "'{'"
+	case tokRBrace:
+		return "'}'"
+	}
+	return fmt.Sprintf("token(%d)", int(k))
+}
+
+// wordPart is a piece of a word: either literal text or a variable reference.
+type wordPart struct {
+	// text is the literal text, or the variable name if isVar is set.
+	text  string
+	isVar bool
+
+	// quoted parts are not subject to field splitting.
+	quoted bool
+}
+
+// word is a single shell word, made of literal and variable parts that are
+// concatenated after expansion.
+type word []wordPart
+
+// literal returns the word's text and true if the word consists only of
+// unquoted literal text, i.e. if it could be a keyword.
+func (w word) literal() (string, bool) {
+	if len(w) != 1 || w[0].isVar || w[0].quoted {
+		return "", false
+	}
+	return w[0].text, true
+}
+
+// String prints the word roughly as it was written.
+func (w word) String() string {
+	var s strings.Builder
+	for _, p := range w {
+		if p.isVar {
+			s.WriteString("${" + p.text + "}")
+		} else {
+			s.WriteString(p.text)
+		}
+	}
+	return s.String()
+}
+
+type token struct {
+	kind tokenKind
+	word word
+	line int
+}
+
+// lexer splits a GRUB script into tokens.
+//
+// The rules follow grub-core/script/yylex.l: words are separated by blanks,
+// commands by newlines or ';', and '{' and '}' are always tokens of their own
+// when unquoted. '#' starts a comment only at the beginning of a word.
+//
+// GRUB does not support pipes or redirections, so unlike a POSIX shell '|',
+// '&', '<' and '>' are ordinary characters here.
+type lexer struct {
+	in   []rune
+	pos  int
+	line int
+}
+
+func newLexer(script string) *lexer {
+	return &lexer{in: []rune(script), line: 1}
+}
+
+func (l *lexer) peek() (rune, bool) {
+	if l.pos >= len(l.in) {
+		return 0, false
+	}
+	return l.in[l.pos], true
+}
+
+func (l *lexer) errorf(format string, v ...interface{}) error {
+	return fmt.Errorf("line %d: %s", l.line, fmt.Sprintf(format, v...))
+}
+
+func isBlank(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\r'
+}
+
+// isWordBreak returns true for runes that end an unquoted word.
+func isWordBreak(r rune) bool {
+	return isBlank(r) || r == '\n' || r == ';' || r == '{' || r == '}'
+}
+
+func isNameRune(r rune) bool {
+	return r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9')
+}
+
+// tokens lexes the entire input.
+func (l *lexer) tokens() ([]token, error) {
+	var toks []token
+	for {
+		t, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		toks = append(toks, t)
+		if t.kind == tokEOF {
+			return toks, nil
+		}
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	for {
+		r, ok := l.peek()
+		if !ok {
+			return token{kind: tokEOF, line: l.line}, nil
+		}
+		switch {
+		case isBlank(r):
+			l.pos++
+
+		case r == '\\' && l.pos+1 < len(l.in) && l.in[l.pos+1] == '\n':
+			// Line continuation.
+			l.pos += 2
+			l.line++
+
+		case r == '#':
+			// Comment until the end of the line.
+			for r, ok := l.peek(); ok && r != '\n'; r, ok = l.peek() {
+				l.pos++
+			}
+
+		case r == '\n':
+			l.pos++
+			l.line++
+			return token{kind: tokNewline, line: l.line - 1}, nil
+
+		case r == ';':
+			l.pos++
+			return token{kind: tokSemicolon, line: l.line}, nil
+
+		case r == '{':
+			l.pos++
+			return token{kind: tokLBrace, line: l.line}, nil
+
+		case r == '}':
+			l.pos++
+			return token{kind: tokRBrace, line: l.line}, nil
+
+		default:
+			line := l.line
+			w, err := l.word()
+			if err != nil {
+				return token{}, err
+			}
+			return token{kind: tokWord, word: w, line: line}, nil
+		}
+	}
+}
+
+// word lexes one word, including quoted strings and variable references.
+func (l *lexer) word() (word, error) {
+	var w word
+	var lit strings.Builder
+	var litQuoted bool
+
+	flush := func() {
+		if lit.Len() > 0 {
+			w = append(w, wordPart{text: lit.String(), quoted: litQuoted})
+			lit.Reset()
+		}
+	}
+	addLiteral := func(s string, quoted bool) {
+		if lit.Len() > 0 && litQuoted != quoted {
+			flush()
+		}
+		litQuoted = quoted
+		lit.WriteString(s)
+	}
+	addVar := func(name string, quoted bool) {
+		flush()
+		w = append(w, wordPart{text: name, isVar: true, quoted: quoted})
+	}
+
+	for {
+		r, ok := l.peek()
+		if !ok || isWordBreak(r) {
+			flush()
+			return w, nil
+		}
+
+		switch r {
+		case '\\':
+			l.pos++
+			r, ok := l.peek()
+			if !ok {
+				addLiteral(`\`, false)
+				continue
+			}
+			l.pos++
+			if r == '\n' {
+				l.line++
+				continue
+			}
+			addLiteral(string(r), true)
+
+		case '\'':
+			l.pos++
+			start := l.pos
+			for r, ok := l.peek(); ok && r != '\''; r, ok = l.peek() {
+				if r == '\n' {
+					l.line++
+				}
+				l.pos++
+			}
+			if l.pos >= len(l.in) {
+				return nil, l.errorf("unterminated single quote")
+			}
+			// An empty '' still yields a (quoted, empty) part so that
+			// it counts as an argument.
+			s := string(l.in[start:l.pos])
+			if len(s) == 0 {
+				flush()
+				w = append(w, wordPart{quoted: true})
+			} else {
+				addLiteral(s, true)
+			}
+			l.pos++
+
+		case '"':
+			l.pos++
+			empty := true
+			for {
+				r, ok := l.peek()
+				if !ok {
+					return nil, l.errorf("unterminated double quote")
+				}
+				if r == '"' {
+					l.pos++
+					break
+				}
+				empty = false
+				switch r {
+				case '\\':
+					// Within double quotes, backslash only escapes
+					// '$', '"', '\' and newline.
+					if l.pos+1 < len(l.in) {
+						switch n := l.in[l.pos+1]; n {
+						case '$', '"', '\\':
+							addLiteral(string(n), true)
+							l.pos += 2
+							continue
+						case '\n':
+							l.pos += 2
+							l.line++
+							continue
+						}
+					}
+					addLiteral(`\`, true)
+					l.pos++
+
+				case '$':
+					name, ok, err := l.variable()
+					if err != nil {
+						return nil, err
+					}
+					if ok {
+						addVar(name, true)
+					} else {
+						addLiteral("$", true)
+					}
+
+				default:
+					if r == '\n' {
+						l.line++
+					}
+					addLiteral(string(r), true)
+					l.pos++
+				}
+			}
+			if empty {
+				flush()
+				w = append(w, wordPart{quoted: true})
+			}
+
+		case '$':
+			name, ok, err := l.variable()
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				addVar(name, false)
+			} else {
+				addLiteral("$", false)
+			}
+
+		default:
+			addLiteral(string(r), false)
+			l.pos++
+		}
+	}
+}
+
+// variable lexes a variable reference starting at '$'.
+//
+// It returns false if the '$' does not start a variable reference, in which
+// case it is a literal '$'.
+func (l *lexer) variable() (string, bool, error) {
+	// Skip '$'.
+	l.pos++
+	r, ok := l.peek()
+	if !ok {
+		return "", false, nil
+	}
+
+	switch {
+	case r == '{':
+		start := l.pos + 1
+		end := start
+		for end < len(l.in) && l.in[end] != '}' {
+			if l.in[end] == '\n' {
+				return "", false, l.errorf("unterminated variable reference")
+			}
+			end++
+		}
+		if end >= len(l.in) {
+			return "", false, l.errorf("unterminated variable reference")
+		}
+		l.pos = end + 1
+		return string(l.in[start:end]), true, nil
+
+	case r == '?' || r == '#' || r == '@' || r == '*':
+		l.pos++
+		return string(r), true, nil
+
+	case '0' <= r && r <= '9':
+		start := l.pos
+		for r, ok := l.peek(); ok && '0' <= r && r <= '9'; r, ok = l.peek() {
+			l.pos++
+		}
+		return string(l.in[start:l.pos]), true, nil
+
+	case isNameRune(r):
+		start := l.pos
+		for r, ok := l.peek(); ok && isNameRune(r); r, ok = l.peek() {
+			l.pos++
+		}
+		return string(l.in[start:l.pos]), true, nil
+	}
+	return "", false, nil
+}
@@ -0,0 +1,239 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+)
+
+// menuEntry is an entry registered by menuentry or submenu.
+type menuEntry struct {
+	title   string
+	id      string
+	submenu bool
+
+	// args are the positional parameters the body is executed with.
+	args []string
+	body script
+
+	// env is the context the entry was defined in. GRUB executes entries
+	// after the whole config ran, so the entry sees the final state of
+	// this context.
+	env *environment
+}
+
+// menu is a list of menu entries.
+type menu struct {
+	entries []*menuEntry
+}
+
+// entryState collects what a menu entry loads while it is executed.
+type entryState struct {
+	image boot.OSImage
+
+	// saves are the entry's save_env commands.
+	saves []envSave
+}
+
+// bootEntry is a bootable, flattened menu entry.
+type bootEntry struct {
+	// titles, ids and indices describe the position of the entry in the
+	// menu hierarchy, from the top-level menu down.
+	titles  []string
+	ids     []string
+	indices []int
+
+	image boot.OSImage
+}
+
+// menuOptions take a value.
+var menuOptions = map[string]bool{
+	"--class":  true,
+	"--hotkey": true,
+	"--id":     true,
+	"--users":  true,
+}
+
+// addMenuEntry implements the menuentry and submenu commands.
+//
+// See https://www.gnu.org/software/grub/manual/grub/html_node/menuentry.html
+func (c *parser) addMenuEntry(cmd *menuCommand) error {
+	e := &menuEntry{
+		submenu: cmd.submenu,
+		body:    cmd.body,
+		env:     c.env,
+	}
+
+	var positional []string
+	args := c.expand(cmd.args)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") || len(arg) == 2 {
+			positional = append(positional, arg)
+			continue
+		}
+		opt := arg
+		var value string
+		if j := strings.IndexByte(arg, '='); j >= 0 {
+			opt, value = arg[:j], arg[j+1:]
+		} else if menuOptions[opt] && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		if opt == "--id" {
+			e.id = value
+		}
+	}
+	if len(positional) == 0 {
+		Debug("[grub] line %d: menu entry without a title", cmd.line)
+		c.status = 1
+		return nil
+	}
+	e.title = positional[0]
+	e.args = positional[1:]
+
+	c.menu.entries = append(c.menu.entries, e)
+	c.status = 0
+	return nil
+}
+
+// bootEntries executes all menu entries collected so far and returns the
+// bootable ones, with submenus flattened.
+func (c *parser) bootEntries(ctx context.Context) ([]*bootEntry, error) {
+	return c.runMenu(ctx, c.menu, nil)
+}
+
+func (c *parser) runMenu(ctx context.Context, m *menu, parent *bootEntry) ([]*bootEntry, error) {
+	var entries []*bootEntry
+	for i, e := range m.entries {
+		be := &bootEntry{}
+		if parent != nil {
+			be.titles = append(be.titles, parent.titles...)
+			be.ids = append(be.ids, parent.ids...)
+			be.indices = append(be.indices, parent.indices...)
+		}
+		be.titles = append(be.titles, e.title)
+		be.ids = append(be.ids, e.id)
+		be.indices = append(be.indices, i)
+
+		sub, err := c.runEntry(ctx, e, be)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, sub...)
+	}
+	return entries, nil
+}
+
+// runEntry executes menu entry e as if it had been chosen in the GRUB menu.
+func (c *parser) runEntry(ctx context.Context, e *menuEntry, be *bootEntry) ([]*bootEntry, error) {
+	if c.depth >= maxDepth {
+		return nil, errTooDeep
+	}
+
+	// Every entry is run on a fresh copy of its context, so that entries
+	// do not see each other's side effects. Submenus open a new context.
+	savedEnv, savedMenu, savedCur, savedPositional := c.env, c.menu, c.cur, c.positional
+	c.depth++
+	defer func() {
+		c.env, c.menu, c.cur, c.positional = savedEnv, savedMenu, savedCur, savedPositional
+		c.depth--
+	}()
+	c.env = e.env.clone(e.submenu)
+	c.env.set("chosen", strings.Join(be.titles, ">"))
+	c.positional = e.args
+
+	if e.submenu {
+		c.menu = &menu{}
+		c.cur = nil
+	} else {
+		c.cur = &entryState{}
+	}
+
+	err := c.execScript(ctx, e.body)
+	switch err.(type) {
+	case nil, breakError, continueError, returnError:
+	default:
+		if ctx.Err() != nil || err == errTooDeep {
+			return nil, err
+		}
+		Debug("[grub] menu entry %q: %v", e.title, err)
+	}
+
+	if e.submenu {
+		return c.runMenu(ctx, c.menu, be)
+	}
+	if c.cur.image == nil {
+		return nil, nil
+	}
+
+	title, submenu := be.titles[len(be.titles)-1], be.titles[:len(be.titles)-1]
+	switch img := c.cur.image.(type) {
+	case *boot.LinuxImage:
+		img.Name, img.Submenu = title, submenu
+	case *boot.MultibootImage:
+		img.Name, img.Submenu = title, submenu
+	}
+	// The config's own save_env commands ran before the menu is shown.
+	saveEnvOnLoad(c.cur.image, append(append([]envSave{}, c.saves...), c.cur.saves...))
+	be.image = c.cur.image
+	return []*bootEntry{be}, nil
+}
+
+// findEntry returns the index of the entry selected by the GRUB entry
+// specifier spec, or -1 if none matches.
+//
+// spec is a ">"-separated path of menu entries; each element may be the
+// entry's index, title, or id, and a literal ">" is written as ">>". If spec
+// names a submenu, its first bootable entry is selected.
+func findEntry(entries []*bootEntry, spec string) int {
+	if len(spec) == 0 {
+		return -1
+	}
+	path := splitEntrySpec(spec)
+	for i, e := range entries {
+		if matchEntry(e, path) {
+			return i
+		}
+	}
+	return -1
+}
+
+// splitEntrySpec splits an entry specifier at ">", treating ">>" as a literal
+// ">".
+func splitEntrySpec(spec string) []string {
+	var path []string
+	var cur strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '>' {
+			cur.WriteByte(spec[i])
+			continue
+		}
+		if i+1 < len(spec) && spec[i+1] == '>' {
+			cur.WriteByte('>')
+			i++
+			continue
+		}
+		path = append(path, cur.String())
+		cur.Reset()
+	}
+	return append(path, cur.String())
+}
+
+func matchEntry(e *bootEntry, path []string) bool {
+	if len(path) > len(e.titles) {
+		return false
+	}
+	for i, p := range path {
+		if p != strconv.Itoa(e.indices[i]) && p != e.titles[i] && (len(e.ids[i]) == 0 || p != e.ids[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,364 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"fmt"
+)
+
+// command is a node of a parsed GRUB script. It is one of *simpleCommand,
+// *ifCommand, *forCommand, *whileCommand, *functionCommand or *menuCommand.
+type command interface {
+	// Line is the line the command starts on.
+	Line() int
+}
+
+// script is a list of commands.
+type script []command
+
+// simpleCommand is a command name followed by arguments, e.g. `linux /vmlinuz
+// ro`, or a variable assignment `foo=bar`.
+type simpleCommand struct {
+	line int
+	args []word
+}
+
+// Line implements command.
+func (c *simpleCommand) Line() int { return c.line }
+
+// ifCommand is `if cond; then body; [elif cond; then body;]... [else body;] fi`.
+type ifCommand struct {
+	line int
+
+	// conds and bodies have the same length: the first body whose
+	// condition succeeds is executed.
+	conds  []script
+	bodies []script
+
+	// otherwise is the else body, if any.
+	otherwise script
+}
+
+// Line implements command.
+func (c *ifCommand) Line() int { return c.line }
+
+// forCommand is `for name in words; do body; done`.
+type forCommand struct {
+	line  int
+	name  string
+	words []word
+	body  script
+}
+
+// Line implements command.
+func (c *forCommand) Line() int { return c.line }
+
+// whileCommand is `while cond; do body; done` or `until cond; do body;
+// done`.
+type whileCommand struct {
+	line  int
+	until bool
+	cond  script
+	body  script
+}
+
+// Line implements command.
+func (c *whileCommand) Line() int { return c.line }
+
+// functionCommand is `function name { body }`.
+type functionCommand struct {
+	line int
+	name string
+	body script
+}
+
+// Line implements command.
+func (c *functionCommand) Line() int { return c.line }
+
+// menuCommand is `menuentry args... { body }` or `submenu args... { body }`.
+type menuCommand struct {
+	line    int
+	submenu bool
+	args    []word
+	body    script
+}
+
+// Line implements command.
+func (c *menuCommand) Line() int { return c.line }
+
+// scriptParser is a recursive-descent parser for GRUB scripts.
+//
+// See https://www.gnu.org/software/grub/manual/grub/html_node/Shell_002dlike-scripting.html
+type scriptParser struct {
+	toks []token
+	pos  int
+}
+
+// parseScript lexes and parses a GRUB script.
+func parseScript(s string) (script, error) {
+	toks, err := newLexer(s).tokens()
+	if err != nil {
+		return nil, err
+	}
+	p := &scriptParser{toks: toks}
+	sc, err := p.list()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.unexpected(t)
+	}
+	return sc, nil
+}
+
+func (p *scriptParser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *scriptParser) advance() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *scriptParser) unexpected(t token) error {
+	if t.kind == tokWord {
+		return fmt.Errorf("line %d: syntax error: unexpected %q", t.line, t.word)
+	}
+	return fmt.Errorf("line %d: syntax error: unexpected %s", t.line, t.kind)
+}
+
+// peekKeyword returns the keyword at the current position, if any.
+func (p *scriptParser) peekKeyword() string {
+	t := p.peek()
+	if t.kind != tokWord {
+		return ""
+	}
+	if s, ok := t.word.literal(); ok {
+		return s
+	}
+	return ""
+}
+
+func (p *scriptParser) skipSeparators() {
+	for k := p.peek().kind; k == tokNewline || k == tokSemicolon; k = p.peek().kind {
+		p.advance()
+	}
+}
+
+func (p *scriptParser) skipNewlines() {
+	for p.peek().kind == tokNewline {
+		p.advance()
+	}
+}
+
+func (p *scriptParser) expectKeyword(kw string) error {
+	p.skipSeparators()
+	if p.peekKeyword() != kw {
+		t := p.peek()
+		if t.kind == tokEOF {
+			return fmt.Errorf("line %d: syntax error: missing %q", t.line, kw)
+		}
+		return p.unexpected(t)
+	}
+	p.advance()
+	return nil
+}
+
+// terminators end a command list.
+var terminators = map[string]bool{
+	"then": true,
+	"elif": true,
+	"else": true,
+	"fi":   true,
+	"do":   true,
+	"done": true,
+}
+
+// list parses commands until EOF, '}' or a terminating keyword.
+func (p *scriptParser) list() (script, error) {
+	var sc script
+	for {
+		p.skipSeparators()
+		t := p.peek()
+		if t.kind == tokEOF || t.kind == tokRBrace || terminators[p.peekKeyword()] {
+			return sc, nil
+		}
+		c, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		sc = append(sc, c)
+
+		// Commands must be separated.
+		switch t := p.peek(); t.kind {
+		case tokNewline, tokSemicolon, tokEOF, tokRBrace:
+		default:
+			return nil, p.unexpected(t)
+		}
+	}
+}
+
+func (p *scriptParser) command() (command, error) {
+	switch p.peekKeyword() {
+	case "if":
+		return p.ifCommand()
+	case "for":
+		return p.forCommand()
+	case "while", "until":
+		return p.whileCommand()
+	case "function":
+		return p.functionCommand()
+	case "menuentry", "submenu":
+		return p.menuCommand()
+	}
+
+	t := p.peek()
+	if t.kind != tokWord {
+		return nil, p.unexpected(t)
+	}
+	c := &simpleCommand{line: t.line}
+	for p.peek().kind == tokWord {
+		c.args = append(c.args, p.advance().word)
+	}
+	return c, nil
+}
+
+func (p *scriptParser) ifCommand() (command, error) {
+	c := &ifCommand{line: p.advance().line}
+	for {
+		cond, err := p.list()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("then"); err != nil {
+			return nil, err
+		}
+		body, err := p.list()
+		if err != nil {
+			return nil, err
+		}
+		c.conds = append(c.conds, cond)
+		c.bodies = append(c.bodies, body)
+
+		switch p.peekKeyword() {
+		case "elif":
+			p.advance()
+			continue
+
+		case "else":
+			p.advance()
+			if c.otherwise, err = p.list(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expectKeyword("fi"); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+func (p *scriptParser) forCommand() (command, error) {
+	c := &forCommand{line: p.advance().line}
+	t := p.advance()
+	name, ok := t.word.literal()
+	if t.kind != tokWord || !ok {
+		return nil, p.unexpected(t)
+	}
+	c.name = name
+
+	if p.peekKeyword() == "in" {
+		p.advance()
+		for p.peek().kind == tokWord {
+			c.words = append(c.words, p.advance().word)
+		}
+	}
+	if err := p.expectKeyword("do"); err != nil {
+		return nil, err
+	}
+	body, err := p.list()
+	if err != nil {
+		return nil, err
+	}
+	c.body = body
+	if err := p.expectKeyword("done"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *scriptParser) whileCommand() (command, error) {
+	t := p.advance()
+	c := &whileCommand{line: t.line}
+	c.until = t.word[0].text == "until"
+
+	cond, err := p.list()
+	if err != nil {
+		return nil, err
+	}
+	c.cond = cond
+	if err := p.expectKeyword("do"); err != nil {
+		return nil, err
+	}
+	body, err := p.list()
+	if err != nil {
+		return nil, err
+	}
+	c.body = body
+	if err := p.expectKeyword("done"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// block parses `{ list }`, allowing newlines before the '{'.
+func (p *scriptParser) block() (script, error) {
+	p.skipNewlines()
+	if t := p.advance(); t.kind != tokLBrace {
+		return nil, p.unexpected(t)
+	}
+	body, err := p.list()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.advance(); t.kind != tokRBrace {
+		return nil, p.unexpected(t)
+	}
+	return body, nil
+}
+
+func (p *scriptParser) functionCommand() (command, error) {
+	c := &functionCommand{line: p.advance().line}
+	t := p.advance()
+	name, ok := t.word.literal()
+	if t.kind != tokWord || !ok {
+		return nil, p.unexpected(t)
+	}
+	c.name = name
+
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	c.body = body
+	return c, nil
+}
+
+func (p *scriptParser) menuCommand() (command, error) {
+	t := p.advance()
+	c := &menuCommand{line: t.line, submenu: t.word[0].text == "submenu"}
+	for p.peek().kind == tokWord {
+		c.args = append(c.args, p.advance().word)
+	}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	c.body = body
+	return c, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLexer(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want []string
+	}{
+		{
+			in:   `echo foo   bar`,
+			want: []string{"echo", "foo", "bar", "EOF"},
+		},
+		{
+			in:   "set a=b; menuentry 'x y' {\n}",
+			want: []string{"set", "a=b", ";", "menuentry", "x y", "{", "\\n", "}", "EOF"},
+		},
+		{
+			in:   `linux (hd0,gpt1)/vmlinuz ro${opts}"$x"end`,
+			want: []string{"linux", "(hd0,gpt1)/vmlinuz", "ro${opts}${x}end", "EOF"},
+		},
+		{
+			in:   "echo a# #b\necho \\# '\\#' \"\\#\" \"\\$x\"",
+			want: []string{"echo", "a#", "\\n", "echo", "#", `\#`, `\#`, "$x", "EOF"},
+		},
+		{
+			in:   "echo foo \\\n  bar",
+			want: []string{"echo", "foo", "bar", "EOF"},
+		},
+		{
+			in:   `echo $1 ${10} $? $# $ x`,
+			want: []string{"echo", "${1}", "${10}", "${?}", "${#}", "$", "x", "EOF"},
+		},
+	} {
+		t.Run(tt.in, func(t *testing.T) {
+			toks, err := newLexer(tt.in).tokens()
+			if err != nil {
+				t.Fatalf("tokens() = %v", err)
+			}
+			var got []string
+			for _, tok := range toks {
+				switch tok.kind {
+				case tokWord:
+					got = append(got, tok.word.String())
+				case tokNewline:
+					got = append(got, "\\n")
+				case tokSemicolon:
+					got = append(got, ";")
+				case tokLBrace:
+					got = append(got, "{")
+				case tokRBrace:
+					got = append(got, "}")
+				case tokEOF:
+					got = append(got, "EOF")
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tokens() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLexerErrors(t *testing.T) {
+	for _, in := range []string{
+		`echo 'foo`,
+		`echo "foo`,
+		`echo ${foo`,
+	} {
+		if _, err := newLexer(in).tokens(); err == nil {
+			t.Errorf("tokens(%q) = nil, want error", in)
+		}
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	sc, err := parseScript(`
+function f {
+	echo $1
+}
+if [ a = b ]; then
+	f x
+elif true; then echo y
+else
+	echo z
+fi
+for i in 1 2 3; do echo $i; done
+while false; do echo never; done
+submenu 'sub' {
+	menuentry 'entry' --id e { linux /vmlinuz }
+}
+`)
+	if err != nil {
+		t.Fatalf("parseScript() = %v", err)
+	}
+
+	var kinds []string
+	for _, c := range sc {
+		kinds = append(kinds, strings.TrimPrefix(reflect.TypeOf(c).String(), "*grub."))
+	}
+	want := []string{"functionCommand", "ifCommand", "forCommand", "whileCommand", "menuCommand"}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("parseScript() = %v, want %v", kinds, want)
+	}
+
+	ifc := sc[1].(*ifCommand)
+	if len(ifc.conds) != 2 || len(ifc.otherwise) != 1 {
+		t.Errorf("if command has %d conditions and %d else commands, want 2 and 1", len(ifc.conds), len(ifc.otherwise))
+	}
+	sub := sc[4].(*menuCommand)
+	if !sub.submenu || len(sub.body) != 1 {
+		t.Errorf("submenu = %+v, want submenu with one entry", sub)
+	}
+}
+
+func TestParseScriptErrors(t *testing.T) {
+	for _, in := range []string{
+		"if true; then echo",
+		"if true; echo; fi",
+		"for do; done",
+		"while true; do echo",
+		"menuentry foo",
+		"menuentry foo {",
+		"function { }",
+		"echo }",
+		"}",
+		"fi",
+	} {
+		if _, err := parseScript(in); err == nil {
+			t.Errorf("parseScript(%q) = nil, want error", in)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/mount/block"
+)
+
+// splitDevice splits a GRUB file name like "(hd0,gpt1)/boot/vmlinuz" into
+// device "hd0,gpt1" and path "/boot/vmlinuz".
+//
+// If the file name does not name a device, the device is empty.
+func splitDevice(name string) (string, string) {
+	if !strings.HasPrefix(name, "(") {
+		return "", name
+	}
+	i := strings.IndexByte(name, ')')
+	if i < 0 {
+		return "", name
+	}
+	return name[1:i], name[i+1:]
+}
+
+// deviceURL returns the base URL of a GRUB device, or nil if it is unknown.
+//
+// Devices are known if they were found by search, or if they name a network
+// protocol and host, e.g. (http,192.168.0.1).
+func (c *parser) deviceURL(dev string) *url.URL {
+	if u, ok := c.deviceURLs[dev]; ok {
+		return u
+	}
+	if proto := strings.SplitN(dev, ",", 2); len(proto) == 2 {
+		switch proto[0] {
+		case "http", "https", "tftp":
+			return &url.URL{Scheme: proto[0], Host: proto[1], Path: "/"}
+		}
+	}
+	return nil
+}
+
+// resolve turns a GRUB file name into a URL.
+//
+// File names without a device are relative to $root. Devices we do not know
+// (e.g. "hd0,msdos1" when search did not find anything) are assumed to be the
+// partition the config file was found on, i.e. the working directory.
+func (c *parser) resolve(name string) (*url.URL, error) {
+	dev, p := splitDevice(name)
+	if len(dev) == 0 && !strings.HasPrefix(name, "(") {
+		dev, _ = c.env.get("root")
+	}
+	wd := c.wd
+	if u := c.deviceURL(dev); u != nil {
+		wd = u
+	}
+	return parseURL(p, wd)
+}
+
+// getFile parses `name` relative to the config's working directory and
+// returns an io.ReaderAt for the requested file.
+func (c *parser) getFile(name string) (io.ReaderAt, error) {
+	u, err := c.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.schemes.LazyFetch(u)
+}
+
+// fileTest implements the -e, -f, -d and -s file tests.
+func (c *parser) fileTest(op, name string) bool {
+	u, err := c.resolve(name)
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "file" {
+		fi, err := os.Stat(u.Path)
+		if err != nil {
+			return false
+		}
+		switch op {
+		case "-f":
+			return fi.Mode().IsRegular()
+		case "-d":
+			return fi.IsDir()
+		case "-s":
+			return fi.Size() > 0
+		}
+		return true
+	}
+
+	// We have no way of listing directories on network schemes, so just
+	// try to fetch the file.
+	if op == "-d" {
+		return false
+	}
+	r, err := c.schemes.LazyFetch(u)
+	if err != nil {
+		return false
+	}
+	var b [1]byte
+	n, err := r.ReadAt(b[:], 0)
+	if op == "-s" {
+		return n > 0
+	}
+	return err == nil || err == io.EOF
+}
+
+// mountDevice returns a URL for the root of the file system on dev, mounting
+// it if necessary.
+func (c *parser) mountDevice(dev *block.BlockDev) (*url.URL, error) {
+	if c.mountPool == nil {
+		return nil, errors.New("no mount pool to mount devices")
+	}
+	mp, err := c.mountPool.Mount(dev, mount.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &url.URL{Scheme: "file", Path: mp.Path}, nil
+}
+
+// cmdSearch implements search, search.file, search.fs_uuid and
+// search.fs_label.
+//
+// See https://www.gnu.org/software/grub/manual/grub/html_node/search.html
+//
+// The device found is named after its Linux block device name (e.g. sda1),
+// and is mounted through the mount pool so that files on it can be accessed.
+func cmdSearch(ctx context.Context, c *parser, name string, args []string) error {
+	mode := strings.TrimPrefix(name, "search.")
+	if mode == "search" {
+		mode = "file"
+	}
+	variable := ""
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-f" || arg == "--file":
+			mode = "file"
+		case arg == "-u" || arg == "--fs-uuid":
+			mode = "fs_uuid"
+		case arg == "-l" || arg == "--label":
+			mode = "fs_label"
+		case arg == "-s" || arg == "--set":
+			variable = "root"
+			// -s optionally takes the variable name as the next
+			// argument, but only if a search term follows it.
+			if i+2 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				variable = args[i]
+			}
+		case strings.HasPrefix(arg, "--set="):
+			variable = strings.TrimPrefix(arg, "--set=")
+		case strings.HasPrefix(arg, "-"):
+			// --no-floppy, --hint*, etc.
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) == 0 {
+		return errors.New("one argument expected")
+	}
+	// search.fs_uuid UUID VAR is the short form of --set=VAR.
+	if name != "search" && len(positional) > 1 && len(variable) == 0 {
+		variable = positional[1]
+	}
+
+	dev, u, err := c.findDevice(mode, positional[0])
+	if err != nil {
+		return err
+	}
+	c.deviceURLs[dev.Name] = u
+	if len(variable) > 0 {
+		c.env.set(variable, dev.Name)
+	}
+	return nil
+}
+
+// findDevice finds the first block device matching term.
+func (c *parser) findDevice(mode, term string) (*block.BlockDev, *url.URL, error) {
+	switch mode {
+	case "fs_uuid":
+		for _, dev := range c.devices {
+			if strings.EqualFold(dev.FsUUID, term) {
+				u, err := c.mountDevice(dev)
+				if err != nil {
+					return nil, nil, err
+				}
+				return dev, u, nil
+			}
+		}
+
+	case "file":
+		for _, dev := range c.devices {
+			u, err := c.mountDevice(dev)
+			if err != nil {
+				continue
+			}
+			if _, err := os.Stat(path.Join(u.Path, term)); err == nil {
+				return dev, u, nil
+			}
+		}
+
+	default:
+		return nil, nil, fmt.Errorf("search by %s is not supported", mode)
+	}
+	return nil, nil, fmt.Errorf("no such device: %s", term)
+}
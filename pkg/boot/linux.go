@@ -12,17 +12,45 @@ import (
 	"log"
 	"os"
 
+	"github.com/u-root/u-root/pkg/boot/ibft"
 	"github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/boot/linux"
 	"github.com/u-root/u-root/pkg/uio"
+	"golang.org/x/sys/unix"
 )
 
 // LinuxImage implements OSImage for a Linux kernel + initramfs.
 type LinuxImage struct {
 	Name string
 
+	// Submenu are the titles of the submenus of the boot loader config
+	// that the image is in, outermost first. Boot menus show the image in
+	// the same submenus.
+	Submenu []string
+
 	Kernel  io.ReaderAt
 	Initrd  io.ReaderAt
 	Cmdline string
+
+	// IBFT, if set, tells the kernel which iSCSI target it was booted
+	// from. It requires kexec_load, as kexec_file_load cannot pass it.
+	IBFT *ibft.IBFT
+
+	// Verifier, if set, checks the kernel and initrd before they are
+	// loaded. See Verify.
+	Verifier Verifier
+
+	// KexecLoadFallback, if set, loads the kernel with kexec_load when the
+	// running kernel has no kexec_file_load or cannot load the kernel's
+	// format with it. kexec_load does not check the kernel's signature,
+	// even if the running kernel enforces signatures, so it must be
+	// asked for.
+	KexecLoadFallback bool
+
+	// Loaded, if set, is called once the image is loaded and only
+	// remains to be executed, e.g. to count the boot attempt. If it fails,
+	// so does Load.
+	Loaded func() error
 }
 
 var _ OSImage = &LinuxImage{}
@@ -70,7 +98,37 @@ func copyToFile(r io.Reader) (*os.File, error) {
 	return readOnlyF, nil
 }
 
+// fileLoadUnsupported are the errors of kexec_file_load for which Load may
+// fall back to kexec_load: it does not exist or cannot load the kernel
+// format. A rejected signature is not one of them.
+var fileLoadUnsupported = []error{
+	unix.ENOSYS,
+	unix.ENOEXEC,
+	unix.EOPNOTSUPP,
+}
+
+func kexecLoad(kernel, ramfs *os.File, cmdline string, ibft *ibft.IBFT, fallback bool) error {
+	if ibft != nil {
+		return linux.KexecLoad(kernel, ramfs, cmdline, ibft)
+	}
+	err := kexec.FileLoad(kernel, ramfs, cmdline)
+	if err == nil || !fallback {
+		return err
+	}
+	for _, e := range fileLoadUnsupported {
+		if errors.Is(err, e) {
+			log.Printf("kexec_file_load failed, falling back to kexec_load: %v", err)
+			return linux.KexecLoad(kernel, ramfs, cmdline, nil)
+		}
+	}
+	return err
+}
+
 // Load implements OSImage.Load and kexec_load's the kernel with its initramfs.
+//
+// The kernel is loaded with kexec_file_load, or with kexec_load if an iBFT is
+// passed on or if KexecLoadFallback is set and the running kernel cannot
+// kexec_file_load the image.
 func (li *LinuxImage) Load(verbose bool) error {
 	if li.Kernel == nil {
 		return errors.New("LinuxImage.Kernel must be non-nil")
@@ -113,10 +171,41 @@ func (li *LinuxImage) Load(verbose bool) error {
 		defer i.Close()
 	}
 
+	// Verify the copies that are loaded, as the originals may change.
+	if li.Verifier != nil {
+		var ir io.ReaderAt
+		if i != nil {
+			ir = i
+		}
+		if err := li.Verifier.Verify(li, k, ir); err != nil {
+			return &VerifyError{Image: li.Label(), Err: err}
+		}
+	}
+
 	log.Printf("Kernel: %s", k.Name())
 	if i != nil {
 		log.Printf("Initrd: %s", i.Name())
 	}
 	log.Printf("Command line: %s", li.Cmdline)
-	return kexec.FileLoad(k, i, li.Cmdline)
+	if li.IBFT != nil {
+		log.Printf("iBFT: %s", li.IBFT)
+	}
+	if err := kexecLoad(k, i, li.Cmdline, li.IBFT, li.KexecLoadFallback); err != nil {
+		return err
+	}
+	if li.Loaded != nil {
+		if err := li.Loaded(); err != nil {
+			return fmt.Errorf("%s: %v", li.Label(), err)
+		}
+	}
+	return nil
+}
+
+// AllowKexecLoadFallback sets KexecLoadFallback on the LinuxImages of imgs.
+func AllowKexecLoadFallback(imgs ...OSImage) {
+	for _, img := range imgs {
+		if li, ok := img.(*LinuxImage); ok {
+			li.KexecLoadFallback = true
+		}
+	}
 }
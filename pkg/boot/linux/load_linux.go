@@ -0,0 +1,324 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package linux loads x86 Linux bzImage kernels with the kexec_load system
+// call, for kernels that lack kexec_file_load or refuse it.
+//
+// kexec_load does not know about kernel formats, so the boot protocol is laid
+// out in memory here: the protected-mode kernel, the zero page with the setup
+// header and e820 memory map, the command line, the initrd, and a purgatory
+// that jumps to the 64-bit entry point of the kernel. An iBFT may be placed
+// where the kernel looks for one, for booting from iSCSI.
+//
+// See https://www.kernel.org/doc/html/latest/x86/boot.html.
+package linux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+
+	"github.com/u-root/u-root/pkg/acpi"
+	"github.com/u-root/u-root/pkg/boot/bzimage"
+	"github.com/u-root/u-root/pkg/boot/ibft"
+	"github.com/u-root/u-root/pkg/boot/kexec"
+)
+
+const (
+	// zeroPageSize is the size of the zero page, struct boot_params.
+	zeroPageSize = 0x1000
+
+	// acpiRSDPAddr is the offset of acpi_rsdp_addr in the zero page.
+	acpiRSDPAddr = 0x070
+
+	// headerLength is the offset of the byte that, plus 0x202, is the
+	// end of the setup header.
+	headerLength = 0x201
+
+	// loaderType is the type_of_loader of boot loaders without an
+	// assigned ID.
+	loaderType = 0xff
+
+	// minProtocol is the first boot protocol version with xloadflags.
+	minProtocol = 0x020c
+
+	// xlfKernel64 is set in xloadflags if the kernel has the 64-bit entry
+	// point at its load address + 0x200.
+	xlfKernel64    = 1 << 0
+	entry64Offset  = 0x200
+	defaultSetup   = 4
+	sectorSize     = 512
+	defaultLoadAdr = 0x100000
+)
+
+// below4G is the range from start to 4 GiB, the most 32-bit boot protocol
+// fields can address. On 32-bit systems, it ends at the end of memory.
+func below4G(start uintptr) kexec.Range {
+	end := uint64(1) << 32
+	if uint64(^uintptr(0)) < end {
+		return kexec.RangeFromInterval(start, ^uintptr(0))
+	}
+	return kexec.RangeFromInterval(start, uintptr(end))
+}
+
+// ibftRange is where the kernel scans for an iBFT on systems without ACPI or
+// UEFI to provide one.
+var ibftRange = kexec.RangeFromInterval(0x80000, 0x100000)
+
+var (
+	// ErrNotBzImage is returned for kernels that are not x86 bzImages.
+	ErrNotBzImage = errors.New("not a bzImage")
+
+	// ErrUnsupported is returned for kernels that cannot be loaded with
+	// kexec_load by this package.
+	ErrUnsupported = errors.New("kernel does not support the 64-bit boot protocol")
+)
+
+// KexecLoad loads the bzImage kernel with initramfs ramfs, which may be nil,
+// and cmdline, using kexec_load. The loaded kernel is executed by
+// kexec.Reboot.
+//
+// If ibft is not nil, it is passed on to the kernel in low memory. Kernels
+// booted through UEFI do not look for it there.
+func KexecLoad(kernel, ramfs *os.File, cmdline string, ibft *ibft.IBFT) error {
+	if runtime.GOARCH != "amd64" {
+		return fmt.Errorf("kexec_load of Linux kernels is not supported on %s", runtime.GOARCH)
+	}
+	k, err := ioutil.ReadAll(kernel)
+	if err != nil {
+		return err
+	}
+	var initrd []byte
+	if ramfs != nil {
+		if initrd, err = ioutil.ReadAll(ramfs); err != nil {
+			return err
+		}
+	}
+
+	var mem kexec.Memory
+	if err := mem.ParseMemoryMap(); err != nil {
+		return fmt.Errorf("reading memory map: %v", err)
+	}
+	// On UEFI systems, the new kernel cannot find the ACPI tables by
+	// itself.
+	var rsdp uint64
+	if r, err := acpi.GetRSDP(); err == nil {
+		rsdp = uint64(r.RSDPAddr())
+	}
+
+	var table []byte
+	if ibft != nil {
+		table = ibft.Marshal()
+	}
+	entry, err := layout(&mem, k, initrd, cmdline, rsdp, table)
+	if err != nil {
+		return err
+	}
+	return kexec.Load(entry, mem.Segments, 0)
+}
+
+// parseHeader returns the setup header of kernel.
+func parseHeader(kernel []byte) (*bzimage.LinuxHeader, error) {
+	var h bzimage.LinuxHeader
+	if err := binary.Read(bytes.NewReader(kernel), binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotBzImage, err)
+	}
+	if h.HeaderMagic != bzimage.HeaderMagic {
+		return nil, fmt.Errorf("%w: magic is %q", ErrNotBzImage, h.HeaderMagic)
+	}
+	if h.Protocolversion < minProtocol {
+		return nil, fmt.Errorf("%w: boot protocol %d.%02d is older than 2.12", ErrUnsupported, h.Protocolversion>>8, h.Protocolversion&0xff)
+	}
+	if h.XLoadFlags&xlfKernel64 == 0 {
+		return nil, fmt.Errorf("%w: no 64-bit entry point", ErrUnsupported)
+	}
+	return &h, nil
+}
+
+// e820Map returns the e820 entries of the memory map, merging adjacent ranges
+// of the same type.
+func e820Map(phys kexec.MemoryMap) ([]bzimage.E820Entry, error) {
+	sorted := append(kexec.MemoryMap(nil), phys...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	var e820 []bzimage.E820Entry
+	for _, r := range sorted {
+		typ := bzimage.Reserved
+		switch r.Type {
+		case kexec.RangeRAM:
+			typ = bzimage.Ram
+		case kexec.RangeACPI:
+			typ = bzimage.ACPI
+		case kexec.RangeNVS:
+			typ = bzimage.NVS
+		}
+		if n := len(e820); n > 0 {
+			last := &e820[n-1]
+			if last.MemType == typ && last.Addr+last.Size == uint64(r.Start) {
+				last.Size += uint64(r.Size)
+				continue
+			}
+		}
+		e820 = append(e820, bzimage.E820Entry{
+			Addr:    uint64(r.Start),
+			Size:    uint64(r.Size),
+			MemType: typ,
+		})
+	}
+	if len(e820) > bzimage.E820Max {
+		return nil, fmt.Errorf("memory map has %d entries, more than %d", len(e820), bzimage.E820Max)
+	}
+	return e820, nil
+}
+
+// findSpace returns the lowest available range of sz bytes in mem that is
+// aligned to align and within limit.
+func findSpace(mem *kexec.Memory, sz uint, align uintptr, limit kexec.Range) (kexec.Range, error) {
+	ram := mem.AvailableRAM()
+	ram.Sort()
+	for _, r := range ram {
+		o := r.Intersect(limit)
+		if o == nil {
+			continue
+		}
+		start := (o.Start + align - 1) &^ (align - 1)
+		if start >= o.Start && start < o.End() && uint(o.End()-start) >= sz {
+			return kexec.Range{Start: start, Size: sz}, nil
+		}
+	}
+	return kexec.Range{}, kexec.ErrNotEnoughSpace{Size: sz}
+}
+
+// layout adds the segments to boot kernel to mem, and returns the entry point
+// of the purgatory. rsdp is the address of the ACPI RSDP, or 0. ibft is the
+// marshaled iBFT, or nil.
+func layout(mem *kexec.Memory, kernel, initrd []byte, cmdline string, rsdp uint64, ibft []byte) (uintptr, error) {
+	h, err := parseHeader(kernel)
+	if err != nil {
+		return 0, err
+	}
+
+	// The iBFT is the most restricted allocation. It is reserved in the
+	// memory map, so that the kernel does not use it before it is found.
+	if len(ibft) > 0 {
+		if _, err := mem.AddPhysSegment(ibft, ibftRange); err != nil {
+			return 0, fmt.Errorf("no space for the iBFT in %s: %v", ibftRange, err)
+		}
+	}
+
+	// The memory map is otherwise passed on as the firmware provided it.
+	e820, err := e820Map(mem.Phys)
+	if err != nil {
+		return 0, err
+	}
+
+	setupSects := int(h.SetupSects)
+	if setupSects == 0 {
+		setupSects = defaultSetup
+	}
+	codeOff := (setupSects + 1) * sectorSize
+	if len(kernel) <= codeOff {
+		return 0, fmt.Errorf("%w: kernel is truncated", ErrNotBzImage)
+	}
+	code := kernel[codeOff:]
+
+	// The kernel decompresses itself in place, and needs InitSize bytes
+	// to do so. Relocatable kernels are loaded at or above their
+	// preferred address, as they would move there otherwise.
+	size := uint(len(code))
+	if uint(h.InitSize) > size {
+		size = uint(h.InitSize)
+	}
+	size = (size + zeroPageSize - 1) &^ (zeroPageSize - 1)
+	loadAddr := uintptr(h.PrefAddress)
+	if loadAddr == 0 {
+		loadAddr = defaultLoadAdr
+	}
+	var kr kexec.Range
+	if h.RelocatableKernel != 0 {
+		align := uintptr(h.Kernelalignment)
+		if align < zeroPageSize {
+			align = zeroPageSize
+		}
+		kr, err = findSpace(mem, size, align, below4G(loadAddr))
+	} else {
+		kr, err = findSpace(mem, size, zeroPageSize, kexec.Range{Start: loadAddr, Size: size})
+	}
+	if err != nil {
+		return 0, fmt.Errorf("no space for the kernel: %v", err)
+	}
+	mem.Segments.Insert(kexec.NewSegment(code, kr))
+
+	low := below4G(kexec.M1)
+	if h.CmdLineSize != 0 && len(cmdline) > int(h.CmdLineSize) {
+		return 0, fmt.Errorf("command line is %d bytes, longer than %d", len(cmdline), h.CmdLineSize)
+	}
+	cmdlineRange, err := mem.AddPhysSegment(append([]byte(cmdline), 0), low)
+	if err != nil {
+		return 0, fmt.Errorf("no space for the command line: %v", err)
+	}
+
+	var initrdRange kexec.Range
+	if len(initrd) > 0 {
+		initrdMax := uintptr(h.InitrdAddrMax)
+		if initrdMax == 0 {
+			initrdMax = bzimage.DefaultInitrdAddrMax
+		}
+		initrdRange, err = mem.AddPhysSegment(initrd, kexec.RangeFromInterval(kexec.M1, initrdMax+1))
+		if err != nil {
+			return 0, fmt.Errorf("no space for the initrd: %v", err)
+		}
+	}
+
+	// The zero page starts out with the setup header of the kernel. The
+	// rest of the first sector is boot sector code, which is cleared.
+	h.MBRCode = [len(h.MBRCode)]uint8{}
+	h.O = [len(h.O)]uint8{}
+	h.TypeOfLoader = loaderType
+	h.Cmdlineptr = uint32(cmdlineRange.Start)
+	h.ExtCmdlinePtr = uint32(uint64(cmdlineRange.Start) >> 32)
+	h.RamDiskImage = uint32(initrdRange.Start)
+	h.ExtRamdiskImage = uint32(uint64(initrdRange.Start) >> 32)
+	h.RamDiskSize = uint32(len(initrd))
+	h.ExtRamdiskSize = uint32(uint64(len(initrd)) >> 32)
+
+	var params bytes.Buffer
+	if err := binary.Write(&params, binary.LittleEndian, h); err != nil {
+		return 0, err
+	}
+	zeroPage := make([]byte, zeroPageSize)
+	n := copy(zeroPage, params.Bytes())
+	// Newer setup headers are longer than LinuxHeader.
+	if end := 0x202 + int(kernel[headerLength]); end > n && end <= len(kernel) {
+		copy(zeroPage[n:end], kernel[n:end])
+	}
+	binary.LittleEndian.PutUint64(zeroPage[acpiRSDPAddr:], rsdp)
+
+	var e bytes.Buffer
+	if err := binary.Write(&e, binary.LittleEndian, e820); err != nil {
+		return 0, err
+	}
+	copy(zeroPage[bzimage.E820Map:], e.Bytes())
+	zeroPage[bzimage.E820NR] = uint8(len(e820))
+
+	paramsRange, err := mem.AddPhysSegment(zeroPage, low)
+	if err != nil {
+		return 0, fmt.Errorf("no space for the zero page: %v", err)
+	}
+
+	p := make([]byte, purgatorySize)
+	copy(p, purgatoryCode(paramsRange.Start, kr.Start+entry64Offset))
+	purgatoryRange, err := mem.AddPhysSegment(p, low)
+	if err != nil {
+		return 0, fmt.Errorf("no space for the purgatory: %v", err)
+	}
+	return purgatoryRange.Start, nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/u-root/u-root/pkg/boot/bzimage"
+	"github.com/u-root/u-root/pkg/boot/ibft"
+	"github.com/u-root/u-root/pkg/boot/kexec"
+)
+
+// bzImage returns a fake bzImage with 2 setup sectors, protocol version and
+// xloadflags.
+func bzImage(version, xloadflags uint16) []byte {
+	k := make([]byte, 3*sectorSize+0x3000)
+	k[0x1f1] = 2
+	copy(k[0x202:], bzimage.HeaderMagic[:])
+	binary.LittleEndian.PutUint16(k[0x206:], version)
+	// Header length, as in the jump at 0x200.
+	k[headerLength] = 0x6a
+	binary.LittleEndian.PutUint32(k[0x22c:], 0x7fffffff)
+	binary.LittleEndian.PutUint32(k[0x230:], 0x200000)
+	k[0x234] = 1
+	binary.LittleEndian.PutUint16(k[0x236:], xloadflags)
+	binary.LittleEndian.PutUint32(k[0x238:], 2047)
+	binary.LittleEndian.PutUint64(k[0x258:], 0x1000000)
+	binary.LittleEndian.PutUint32(k[0x260:], 0x1000000)
+	// kernel_info_offset, past LinuxHeader.
+	binary.LittleEndian.PutUint32(k[0x268:], 0xabcd)
+	copy(k[3*sectorSize:], "kernel")
+	return k
+}
+
+func testMemory() *kexec.Memory {
+	return &kexec.Memory{
+		Phys: kexec.MemoryMap{
+			{Range: kexec.RangeFromInterval(0, 0x9f000), Type: kexec.RangeRAM},
+			{Range: kexec.RangeFromInterval(0x9f000, 0x100000), Type: kexec.RangeReserved},
+			{Range: kexec.RangeFromInterval(0x100000, 0x1080000), Type: kexec.RangeRAM},
+			{Range: kexec.RangeFromInterval(0x1080000, 0x1100000), Type: kexec.RangeReserved},
+			{Range: kexec.RangeFromInterval(0x1100000, 0x4000000), Type: kexec.RangeRAM},
+			{Range: kexec.RangeFromInterval(0x4000000, 0x8000000), Type: kexec.RangeRAM},
+			{Range: kexec.RangeFromInterval(0x8000000, 0x8010000), Type: kexec.RangeACPI},
+		},
+	}
+}
+
+func segment(t *testing.T, mem *kexec.Memory, addr uintptr) []byte {
+	t.Helper()
+	for _, s := range mem.Segments {
+		if s.Phys.Start == addr {
+			var b []byte
+			sh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+			sh.Data = s.Buf.Start
+			sh.Len = int(s.Buf.Size)
+			sh.Cap = int(s.Buf.Size)
+			return b
+		}
+	}
+	t.Fatalf("no segment at %#x in %v", addr, mem.Segments)
+	return nil
+}
+
+func TestLayout(t *testing.T) {
+	mem := testMemory()
+	kernel := bzImage(0x20f, xlfKernel64)
+	entry, err := layout(mem, kernel, []byte("initrd"), "console=ttyS0", 0xf0000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := segment(t, mem, entry)
+	if len(p) != purgatorySize || !bytes.Equal(p[:purgatoryParams], purgatory[:purgatoryParams]) {
+		t.Fatalf("purgatory is not at the entry point %#x", entry)
+	}
+	params := uintptr(binary.LittleEndian.Uint64(p[purgatoryParams:]))
+	kernelEntry := uintptr(binary.LittleEndian.Uint64(p[purgatoryEntry:]))
+
+	// The kernel does not fit at its preferred address, and is aligned
+	// above it.
+	if want := uintptr(0x1200000 + entry64Offset); kernelEntry != want {
+		t.Errorf("kernel entry = %#x, want %#x", kernelEntry, want)
+	}
+	if k := segment(t, mem, kernelEntry-entry64Offset); !bytes.HasPrefix(k, []byte("kernel")) {
+		t.Errorf("kernel segment starts with %q", k[:6])
+	}
+
+	zp := segment(t, mem, params)
+	if len(zp) != zeroPageSize {
+		t.Fatalf("zero page is %d bytes", len(zp))
+	}
+	if zp[0x210] != loaderType {
+		t.Errorf("type_of_loader = %#x, want %#x", zp[0x210], loaderType)
+	}
+	if got := binary.LittleEndian.Uint64(zp[acpiRSDPAddr:]); got != 0xf0000 {
+		t.Errorf("acpi_rsdp_addr = %#x, want 0xf0000", got)
+	}
+	if got := binary.LittleEndian.Uint32(zp[0x268:]); got != 0xabcd {
+		t.Errorf("setup header past LinuxHeader was not copied: %#x", got)
+	}
+
+	cmdline := segment(t, mem, uintptr(binary.LittleEndian.Uint32(zp[0x228:])))
+	if !bytes.HasPrefix(cmdline, []byte("console=ttyS0\x00")) {
+		t.Errorf("command line = %q", cmdline)
+	}
+	initrd := segment(t, mem, uintptr(binary.LittleEndian.Uint32(zp[0x218:])))
+	if size := binary.LittleEndian.Uint32(zp[0x21c:]); size != 6 || !bytes.HasPrefix(initrd, []byte("initrd")) {
+		t.Errorf("initrd = %q, size %d", initrd, size)
+	}
+
+	// Adjacent RAM ranges are merged, and allocations do not show up.
+	want := []bzimage.E820Entry{
+		{Addr: 0, Size: 0x9f000, MemType: bzimage.Ram},
+		{Addr: 0x9f000, Size: 0x61000, MemType: bzimage.Reserved},
+		{Addr: 0x100000, Size: 0xf80000, MemType: bzimage.Ram},
+		{Addr: 0x1080000, Size: 0x80000, MemType: bzimage.Reserved},
+		{Addr: 0x1100000, Size: 0x6f00000, MemType: bzimage.Ram},
+		{Addr: 0x8000000, Size: 0x10000, MemType: bzimage.ACPI},
+	}
+	if n := int(zp[bzimage.E820NR]); n != len(want) {
+		t.Fatalf("e820 has %d entries, want %d", n, len(want))
+	}
+	got := make([]bzimage.E820Entry, len(want))
+	if err := binary.Read(bytes.NewReader(zp[bzimage.E820Map:]), binary.LittleEndian, got); err != nil {
+		t.Fatal(err)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("e820[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLayoutIBFT(t *testing.T) {
+	mem := testMemory()
+	table := (&ibft.IBFT{}).Marshal()
+	entry, err := layout(mem, bzImage(0x20f, xlfKernel64), nil, "", 0, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := segment(t, mem, 0x80000); !bytes.HasPrefix(got, table) {
+		t.Errorf("no iBFT at 0x80000")
+	}
+
+	// The iBFT is reserved in the memory map.
+	p := segment(t, mem, entry)
+	zp := segment(t, mem, uintptr(binary.LittleEndian.Uint64(p[purgatoryParams:])))
+	e820 := make([]bzimage.E820Entry, zp[bzimage.E820NR])
+	if err := binary.Read(bytes.NewReader(zp[bzimage.E820Map:]), binary.LittleEndian, e820); err != nil {
+		t.Fatal(err)
+	}
+	want := []bzimage.E820Entry{
+		{Addr: 0, Size: 0x80000, MemType: bzimage.Ram},
+		{Addr: 0x80000, Size: 0x1000, MemType: bzimage.Reserved},
+		{Addr: 0x81000, Size: 0x1e000, MemType: bzimage.Ram},
+	}
+	if len(e820) < len(want) || !reflect.DeepEqual(e820[:len(want)], want) {
+		t.Errorf("e820 starts with %+v, want %+v", e820, want)
+	}
+}
+
+func TestLayoutErrors(t *testing.T) {
+	long := make([]byte, 2048)
+	for i := range long {
+		long[i] = 'a'
+	}
+	for _, tt := range []struct {
+		name    string
+		kernel  []byte
+		cmdline string
+		want    error
+	}{
+		{name: "not a bzImage", kernel: make([]byte, 0x1000), want: ErrNotBzImage},
+		{name: "truncated", kernel: bzImage(0x20f, xlfKernel64)[:0x300], want: ErrNotBzImage},
+		{name: "old protocol", kernel: bzImage(0x20a, xlfKernel64), want: ErrUnsupported},
+		{name: "32-bit", kernel: bzImage(0x20f, 0), want: ErrUnsupported},
+		{name: "long command line", kernel: bzImage(0x20f, xlfKernel64), cmdline: string(long)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := layout(testMemory(), tt.kernel, nil, tt.cmdline, 0, nil)
+			if err == nil {
+				t.Fatalf("layout succeeded")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("layout = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linux
+
+import "encoding/binary"
+
+// purgatory is the x86-64 code that kexec jumps to, in 64-bit mode with
+// identity mapped memory. It loads a GDT as the 64-bit boot protocol
+// requires, and jumps to the kernel with %rsi pointing to the zero page.
+//
+// It is assembled from the following GNU as source. params and entry are
+// patched in by purgatoryCode. The stack is zeroed by kexec.
+//
+//		.code64
+//	start:
+//		cli
+//		lea	gdt(%rip), %rax
+//		mov	%rax, gdtr+2(%rip)
+//		lgdt	gdtr(%rip)
+//		lea	stack_end(%rip), %rsp
+//		mov	$0x18, %eax	// __BOOT_DS
+//		mov	%eax, %ds
+//		mov	%eax, %es
+//		mov	%eax, %ss
+//		mov	%eax, %fs
+//		mov	%eax, %gs
+//		lea	1f(%rip), %rax
+//		pushq	$0x10		// __BOOT_CS
+//		push	%rax
+//		lretq
+//	1:
+//		mov	params(%rip), %rsi
+//		mov	entry(%rip), %rax
+//		xor	%ebp, %ebp
+//		xor	%edi, %edi
+//		xor	%ebx, %ebx
+//		jmp	*%rax
+//		.balign	16
+//	gdt:
+//		.quad	0
+//		.quad	0
+//		.quad	0x00af9a000000ffff
+//		.quad	0x00cf92000000ffff
+//	gdtr:
+//		.word	gdtr - gdt - 1
+//		.quad	0
+//		.balign	8
+//	params:
+//		.quad	0
+//	entry:
+//		.quad	0
+//	stack:
+//		.fill	256, 1, 0
+//	stack_end:
+var purgatory = []byte{
+	0xfa, 0x48, 0x8d, 0x05, 0x48, 0x00, 0x00, 0x00,
+	0x48, 0x89, 0x05, 0x63, 0x00, 0x00, 0x00, 0x0f,
+	0x01, 0x15, 0x5a, 0x00, 0x00, 0x00, 0x48, 0x8d,
+	0x25, 0x73, 0x01, 0x00, 0x00, 0xb8, 0x18, 0x00,
+	0x00, 0x00, 0x8e, 0xd8, 0x8e, 0xc0, 0x8e, 0xd0,
+	0x8e, 0xe0, 0x8e, 0xe8, 0x48, 0x8d, 0x05, 0x05,
+	0x00, 0x00, 0x00, 0x6a, 0x10, 0x50, 0x48, 0xcb,
+	0x48, 0x8b, 0x35, 0x41, 0x00, 0x00, 0x00, 0x48,
+	0x8b, 0x05, 0x42, 0x00, 0x00, 0x00, 0x31, 0xed,
+	0x31, 0xff, 0x31, 0xdb, 0xff, 0xe0, 0x66, 0x90,
+	// gdt
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0x00, 0x00, 0x00, 0x9a, 0xaf, 0x00,
+	0xff, 0xff, 0x00, 0x00, 0x00, 0x92, 0xcf, 0x00,
+	// gdtr
+	0x1f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x66, 0x0f, 0x1f, 0x44, 0x00, 0x00,
+	// params, entry
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+const (
+	purgatoryParams = 0x80
+	purgatoryEntry  = 0x88
+
+	// purgatorySize includes the stack.
+	purgatorySize = 0x190
+)
+
+// purgatoryCode returns the purgatory, which jumps to the kernel at entry
+// with the zero page at params.
+func purgatoryCode(params, entry uintptr) []byte {
+	p := append([]byte(nil), purgatory...)
+	binary.LittleEndian.PutUint64(p[purgatoryParams:], uint64(params))
+	binary.LittleEndian.PutUint64(p[purgatoryEntry:], uint64(entry))
+	return p
+}
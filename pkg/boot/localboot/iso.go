@@ -0,0 +1,98 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localboot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/grub"
+	"github.com/u-root/u-root/pkg/boot/syslinux"
+	"github.com/u-root/u-root/pkg/curl"
+	"github.com/u-root/u-root/pkg/iso9660"
+	"github.com/u-root/u-root/pkg/ulog"
+)
+
+// isoDirs are the directories of a partition searched for ISO images, as
+// used by e.g. GRUB's and Ventoy's ISO boot setups.
+var isoDirs = []string{"", "iso", "isos", "boot/iso"}
+
+// ParseISO returns the images of the GRUB and isolinux configs in the ISO
+// 9660 image r, without mounting it.
+//
+// isoPath is the path of the image file on its partition, if it is on one. It
+// is passed to the image's GRUB loopback.cfg, which tells live systems where
+// to find their image, and which is preferred over the other configs.
+func ParseISO(l ulog.Logger, r io.ReaderAt, isoPath string) ([]boot.OSImage, error) {
+	fs, err := iso9660.Open(r)
+	if err != nil {
+		return nil, err
+	}
+	s := make(curl.Schemes)
+	for scheme, fetcher := range curl.DefaultSchemes {
+		s[scheme] = fetcher
+	}
+	s.Register("iso", fs)
+	wd := &url.URL{Scheme: "iso", Path: "/"}
+
+	ctx := context.Background()
+	if isoPath != "" {
+		imgs, err := grub.ParseLoopbackConfig(ctx, s, wd, isoPath)
+		if err == nil && len(imgs) > 0 {
+			return imgs, nil
+		}
+		if err != nil && !curl.IsURLError(err) {
+			l.Printf("Parsing loopback.cfg of %s: %v", isoPath, err)
+		}
+	}
+
+	// Live CDs mostly boot BIOS machines with isolinux and EFI machines
+	// with GRUB, both with the same entries.
+	imgs, err := syslinux.ParseRootConfig(ctx, s, wd)
+	if err == nil && len(imgs) > 0 {
+		return imgs, nil
+	}
+	imgs, err = grub.ParseRootConfig(ctx, s, wd)
+	if err != nil {
+		return nil, err
+	}
+	if len(imgs) == 0 {
+		return nil, fmt.Errorf("no boot configuration found in ISO image %q", fs.VolumeID)
+	}
+	return imgs, nil
+}
+
+// parseISOs returns the images of the ISO images in the usual places of the
+// file system at mountDir. The image files are kept open.
+func parseISOs(l ulog.Logger, device string, mountDir string) []boot.OSImage {
+	var imgs []boot.OSImage
+	for _, dir := range isoDirs {
+		isos, _ := filepath.Glob(filepath.Join(mountDir, dir, "*.iso"))
+		for _, iso := range isos {
+			rel, err := filepath.Rel(mountDir, iso)
+			if err != nil {
+				continue
+			}
+			f, err := os.Open(iso)
+			if err != nil {
+				l.Printf("Opening ISO image %s on %s: %v", rel, device, err)
+				continue
+			}
+			isoImgs, err := ParseISO(l, f, "/"+filepath.ToSlash(rel))
+			if err != nil {
+				l.Printf("No boot configs found in ISO image %s on %s: %v", rel, device, err)
+				f.Close()
+				continue
+			}
+			imgs = append(imgs, isoImgs...)
+		}
+	}
+	return imgs
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localboot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/uio"
+	"github.com/u-root/u-root/pkg/ulog/ulogtest"
+)
+
+// readImage returns the contents of the ISO images of the iso9660 package's
+// tests, which have an isolinux and a GRUB config.
+func readImage(t *testing.T, name string) []byte {
+	t.Helper()
+	f, err := os.Open(filepath.Join("..", "..", "iso9660", "testdata", name+".iso.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func readAll(t *testing.T, r io.ReaderAt) string {
+	t.Helper()
+	b, err := uio.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func checkLiveImage(t *testing.T, img boot.OSImage, name, cmdline string) {
+	t.Helper()
+	li, ok := img.(*boot.LinuxImage)
+	if !ok {
+		t.Fatalf("image is %T, want *boot.LinuxImage", img)
+	}
+	if li.Name != name {
+		t.Errorf("Name = %q, want %q", li.Name, name)
+	}
+	if li.Cmdline != cmdline {
+		t.Errorf("Cmdline = %q, want %q", li.Cmdline, cmdline)
+	}
+	if got := readAll(t, li.Kernel); got != "kernel" {
+		t.Errorf("Kernel = %q, want %q", got, "kernel")
+	}
+	if got := readAll(t, li.Initrd); got != "initrd" {
+		t.Errorf("Initrd = %q, want %q", got, "initrd")
+	}
+}
+
+func TestParseISO(t *testing.T) {
+	for _, tt := range []struct {
+		image   string
+		isoPath string
+		name    string
+		cmdline string
+	}{
+		{
+			image:   "rr",
+			name:    "Live system",
+			cmdline: "boot=casper quiet",
+		},
+		{
+			image:   "joliet",
+			name:    "Live system",
+			cmdline: "boot=casper quiet",
+		},
+		{
+			image:   "plain",
+			name:    "Live system",
+			cmdline: "boot=casper quiet",
+		},
+		{
+			image:   "rr",
+			isoPath: "/isos/live.iso",
+			name:    "Live system from ISO",
+			cmdline: "boot=casper iso-scan/filename=/isos/live.iso quiet",
+		},
+	} {
+		t.Run(tt.image+tt.isoPath, func(t *testing.T) {
+			imgs, err := ParseISO(ulogtest.Logger{TB: t}, bytes.NewReader(readImage(t, tt.image)), tt.isoPath)
+			if err != nil {
+				t.Fatalf("ParseISO = %v", err)
+			}
+			if len(imgs) == 0 {
+				t.Fatal("ParseISO returned no images")
+			}
+			checkLiveImage(t, imgs[0], tt.name, tt.cmdline)
+		})
+	}
+}
+
+func TestParseISONotISO(t *testing.T) {
+	if _, err := ParseISO(ulogtest.Logger{TB: t}, bytes.NewReader(make([]byte, 64<<10)), ""); err == nil {
+		t.Error("ParseISO of zeros succeeded, want error")
+	}
+}
+
+func TestParseDirISO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localboot-iso-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "isos"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "isos", "live.iso"), readImage(t, "rr"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	imgs := ParseDir(ulogtest.Logger{TB: t}, dir)
+	if len(imgs) == 0 {
+		t.Fatal("ParseDir found no images")
+	}
+	checkLiveImage(t, imgs[0], "Live system from ISO", "boot=casper iso-scan/filename=/isos/live.iso quiet")
+}
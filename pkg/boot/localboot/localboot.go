@@ -7,10 +7,6 @@ package localboot
 
 import (
 	"context"
-	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
 
 	"github.com/u-root/u-root/pkg/boot"
 	"github.com/u-root/u-root/pkg/boot/bls"
@@ -22,14 +18,18 @@ import (
 	"github.com/u-root/u-root/pkg/ulog"
 )
 
-// parse treats device as a block device with a file system.
-func parse(l ulog.Logger, device *block.BlockDev, mountDir string) []boot.OSImage {
+// parse treats mountDir as the file system of device, which names it in log
+// messages. ISO images on it are booted as well.
+//
+// devices and mountPool are used to find and mount other partitions that a
+// GRUB config searches for.
+func parse(l ulog.Logger, device string, devices block.BlockDevices, mountDir string, mountPool *mount.Pool) []boot.OSImage {
 	imgs, err := bls.ScanBLSEntries(l, mountDir)
 	if err != nil {
 		l.Printf("No systemd-boot BootLoaderSpec configs found on %s, trying another format...: %v", device, err)
 	}
 
-	grubImgs, err := grub.ParseLocalConfig(context.Background(), mountDir)
+	grubImgs, err := grub.ParseLocalConfigWithDevices(context.Background(), mountDir, devices, mountPool)
 	if err != nil {
 		l.Printf("No GRUB configs found on %s, trying another format...: %v", device, err)
 	}
@@ -41,9 +41,16 @@ func parse(l ulog.Logger, device *block.BlockDev, mountDir string) []boot.OSImag
 	}
 	imgs = append(imgs, syslinuxImgs...)
 
+	imgs = append(imgs, parseISOs(l, device, mountDir)...)
 	return imgs
 }
 
+// ParseDir returns the images of the BootLoaderSpec, GRUB and syslinux
+// configs and of the ISO images in dir, e.g. where a disk image is mounted or extracted.
+func ParseDir(l ulog.Logger, dir string) []boot.OSImage {
+	return parse(l, dir, nil, dir, &mount.Pool{})
+}
+
 // parseUnmounted treats device as unmounted, with or without partitions.
 func parseUnmounted(l ulog.Logger, device *block.BlockDev) ([]boot.OSImage, []*mount.MountPoint) {
 	// This will try to mount device partition 5 and 6.
@@ -71,32 +78,22 @@ func parseUnmounted(l ulog.Logger, device *block.BlockDev) ([]boot.OSImage, []*m
 
 // Localboot tries to boot from any local filesystem by parsing grub configuration
 func Localboot(l ulog.Logger, blockDevs block.BlockDevices) ([]boot.OSImage, []*mount.MountPoint, error) {
-	mountPoints, err := ioutil.TempDir("", "u-root-boot")
-	if err != nil {
-		return nil, nil, fmt.Errorf("cannot create tmpdir: %v", err)
-	}
-
 	var images []boot.OSImage
-	var mps []*mount.MountPoint
+	var mountPool mount.Pool
 	for _, device := range blockDevs {
-		imgs, mmps := parseUnmounted(l, device)
+		imgs, mps := parseUnmounted(l, device)
 		if len(imgs) > 0 {
 			images = append(images, imgs...)
-			mps = append(mps, mmps...)
+			mountPool.Add(mps...)
 		} else {
-			dir := filepath.Join(mountPoints, device.Name)
-
-			os.MkdirAll(dir, 0777)
-			mp, err := device.Mount(dir, mount.ReadOnly)
+			mp, err := mountPool.Mount(device, mount.ReadOnly)
 			if err != nil {
-				os.RemoveAll(dir)
 				continue
 			}
 
-			imgs = parse(l, device, dir)
+			imgs = parse(l, device.String(), blockDevs, mp.Path, &mountPool)
 			images = append(images, imgs...)
-			mps = append(mps, mp)
 		}
 	}
-	return images, mps, nil
+	return images, mountPool.MountPoints, nil
 }
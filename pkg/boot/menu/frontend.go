@@ -0,0 +1,380 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package menu
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/u-root/u-root/pkg/cmdline"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Frontend presents a Menu to the user and reads their commands.
+//
+// Show, Countdown and Printf may be called while Read is in progress.
+type Frontend interface {
+	// Show shows a menu.
+	Show(v *View)
+
+	// Countdown shows the time left until the default entry is loaded.
+	// left is 0 once the user has interrupted the countdown.
+	Countdown(left time.Duration)
+
+	// Read returns the next command of the user, for the menu v. touch
+	// is called when the user starts typing, to interrupt the countdown.
+	Read(v *View, touch func()) (*Command, error)
+
+	// Printf shows a message to the user.
+	Printf(format string, v ...interface{})
+}
+
+// View is a menu as shown by a Frontend.
+type View struct {
+	Title string
+
+	// Entries are the entries shown, numbered from 1.
+	Entries []Entry
+
+	// Default is the index of the entry loaded by default in Entries, or
+	// -1 if it is not in this menu.
+	Default int
+
+	// Submenu is true if the user can go back to the parent menu.
+	Submenu bool
+
+	// Edit is true if the user can edit kernel command lines.
+	Edit bool
+
+	// all includes hidden entries.
+	all []Entry
+}
+
+// Lookup returns the entry with the given number or label. Hidden entries
+// can only be looked up by label.
+func (v *View) Lookup(entry string) (Entry, error) {
+	if num, err := strconv.Atoi(entry); err == nil {
+		if num < 1 || num > len(v.Entries) {
+			return nil, fmt.Errorf("%s is not a valid entry number", entry)
+		}
+		return v.Entries[num-1], nil
+	}
+	for _, e := range v.all {
+		if e.Label() == entry {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not a valid entry number or label", entry)
+}
+
+// Action is what the user asks the menu to do.
+type Action string
+
+// Actions of a Command.
+const (
+	// ActionDefault loads the default entries.
+	ActionDefault Action = "default"
+
+	// ActionChoose chooses an entry, or opens a submenu.
+	ActionChoose Action = "choose"
+
+	// ActionEdit chooses an entry with a new kernel command line.
+	ActionEdit Action = "edit"
+
+	// ActionBack goes back from a submenu to its parent.
+	ActionBack Action = "back"
+)
+
+// Command is a command of the user.
+type Command struct {
+	Action Action `json:"action"`
+
+	// Entry is the number or label of the entry, as in View.Lookup.
+	Entry string `json:"entry,omitempty"`
+
+	// Cmdline is the new kernel command line for ActionEdit.
+	Cmdline string `json:"cmdline,omitempty"`
+}
+
+// parseCommand parses a command typed by the user: nothing for the default
+// entries, "0" to go back from a submenu, "e" and an entry to edit it, or an
+// entry to choose it.
+func parseCommand(line string) *Command {
+	line = strings.TrimSpace(line)
+	switch {
+	case line == "":
+		return &Command{Action: ActionDefault}
+	case line == "0":
+		return &Command{Action: ActionBack}
+	case strings.HasPrefix(line, "e "):
+		return &Command{Action: ActionEdit, Entry: strings.TrimSpace(line[2:])}
+	}
+	return &Command{Action: ActionChoose, Entry: line}
+}
+
+// showText lists the entries of v on w.
+func showText(w io.Writer, v *View) {
+	if v.Title != "" {
+		fmt.Fprintf(w, "\n%s\n\n", v.Title)
+	}
+	fmt.Fprintf(w, "Enter a number to boot a kernel:\n\n")
+	for i, e := range v.Entries {
+		var suffix string
+		if _, ok := e.(*Submenu); ok {
+			suffix = " >"
+		}
+		if i == v.Default {
+			suffix += " (default)"
+		}
+		fmt.Fprintf(w, "%02d. %s%s\n\n", i+1, e.Label(), suffix)
+	}
+	var help []string
+	if v.Edit {
+		help = append(help, "Enter e and a number to edit its kernel command line.")
+	}
+	if v.Submenu {
+		help = append(help, "Enter 0 to go back.")
+	}
+	if len(help) > 0 {
+		fmt.Fprintf(w, "%s\n\n", strings.Join(help, " "))
+	}
+}
+
+// seconds returns d in whole seconds, rounded up.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// prompt returns the prompt for choosing an entry of v.
+func prompt(v *View) string {
+	if v.Default < 0 {
+		return "Choose a menu option (hit enter to boot the default) > "
+	}
+	return fmt.Sprintf("Choose a menu option (hit enter to boot the default - %02d is the default option) > ", v.Default+1)
+}
+
+// editable returns the entry to edit for cmd, and its command line.
+func editable(v *View, cmd *Command) (Entry, string, error) {
+	e, err := v.Lookup(cmd.Entry)
+	if err != nil {
+		return nil, "", err
+	}
+	cmdline, ok := entryCmdline(e)
+	if !ok {
+		return nil, "", fmt.Errorf("%s cannot be edited", e.Label())
+	}
+	return e, cmdline, nil
+}
+
+// NewFrontend returns the frontend for the console f: a terminal frontend if
+// f is a terminal, or a line frontend otherwise, e.g. if f is a pipe. The
+// JSON frontend is used if the kernel parameter uroot.bootmenu=json is set.
+func NewFrontend(f *os.File) Frontend {
+	if fe, ok := cmdline.Flag("uroot.bootmenu"); ok && fe == "json" {
+		return NewJSON(f, f)
+	}
+	if terminal.IsTerminal(int(f.Fd())) {
+		return NewTerminal(f)
+	}
+	return NewLine(f, f)
+}
+
+// prefillReader reads prefill before the terminal input, so that it appears
+// as typed by the user, ready to be edited.
+type prefillReader struct {
+	*os.File
+	prefill []byte
+}
+
+func (p *prefillReader) Read(b []byte) (int, error) {
+	if len(p.prefill) > 0 {
+		n := copy(b, p.prefill)
+		p.prefill = p.prefill[n:]
+		return n, nil
+	}
+	return p.File.Read(b)
+}
+
+// terminalFrontend is a Frontend on a terminal, which is switched to raw mode
+// for line editing while commands are read.
+type terminalFrontend struct {
+	f       *prefillReader
+	term    *terminal.Terminal
+	prompt  string
+	cleared bool
+}
+
+// NewTerminal returns a frontend on the terminal f, e.g. a VT or a serial
+// console.
+func NewTerminal(f *os.File) Frontend {
+	p := &prefillReader{File: f}
+	return &terminalFrontend{
+		f:    p,
+		term: terminal.NewTerminal(p, ""),
+	}
+}
+
+// Show implements Frontend.Show.
+func (t *terminalFrontend) Show(v *View) {
+	if !t.cleared {
+		// Clear the screen (ANSI terminal escape code for screen clear).
+		fmt.Fprintf(t.term, "\033[1;1H\033[2J\n")
+		t.cleared = true
+	}
+	showText(t.term, v)
+	t.prompt = prompt(v)
+	t.term.SetPrompt(t.prompt)
+}
+
+// Countdown implements Frontend.Countdown by showing it in the prompt.
+func (t *terminalFrontend) Countdown(left time.Duration) {
+	if left > 0 {
+		t.term.SetPrompt(fmt.Sprintf("Booting the default in %ds. %s", seconds(left), t.prompt))
+	} else {
+		t.term.SetPrompt(t.prompt)
+	}
+	// Repaint the prompt.
+	t.term.Write(nil)
+}
+
+// Printf implements Frontend.Printf.
+func (t *terminalFrontend) Printf(format string, v ...interface{}) {
+	fmt.Fprintf(t.term, format+"\n", v...)
+}
+
+// Read implements Frontend.Read.
+func (t *terminalFrontend) Read(v *View, touch func()) (*Command, error) {
+	fd := int(t.f.Fd())
+	oldState, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return nil, fmt.Errorf("cannot let you choose from menu (MakeRaw failed): %v", err)
+	}
+	defer terminal.Restore(fd, oldState)
+
+	t.term.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		// We ain't gonna autocomplete, but we'll reset the countdown
+		// timer when you press a key.
+		touch()
+		return "", 0, false
+	}
+	defer func() { t.term.AutoCompleteCallback = nil }()
+
+	for {
+		line, err := t.term.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		cmd := parseCommand(line)
+		if cmd.Action != ActionEdit {
+			return cmd, nil
+		}
+		if !v.Edit {
+			t.Printf("Editing is disabled.")
+			continue
+		}
+		e, cmdline, err := editable(v, cmd)
+		if err != nil {
+			t.Printf("%v.", err)
+			continue
+		}
+
+		t.Printf("Editing %s. Hit enter to boot it, or clear the line to cancel.", e.Label())
+		t.f.prefill = []byte(cmdline)
+		t.term.SetPrompt("> ")
+		cmd.Cmdline, err = t.term.ReadLine()
+		t.term.SetPrompt(t.prompt)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(cmd.Cmdline) != "" {
+			return cmd, nil
+		}
+	}
+}
+
+// lineFrontend is a Frontend that reads commands line by line, without
+// terminal support.
+type lineFrontend struct {
+	r         *bufio.Reader
+	w         io.Writer
+	countdown bool
+}
+
+// NewLine returns a frontend that reads lines from r, e.g. a pipe or a
+// serial console without terminal support, and writes to w.
+func NewLine(r io.Reader, w io.Writer) Frontend {
+	return &lineFrontend{
+		r: bufio.NewReader(r),
+		w: w,
+	}
+}
+
+// Show implements Frontend.Show.
+func (l *lineFrontend) Show(v *View) {
+	showText(l.w, v)
+	fmt.Fprint(l.w, prompt(v))
+	l.countdown = true
+}
+
+// Countdown implements Frontend.Countdown. It is only shown once per menu,
+// as lines cannot be redrawn.
+func (l *lineFrontend) Countdown(left time.Duration) {
+	if l.countdown && left > 0 {
+		fmt.Fprintf(l.w, "\nBooting the default in %ds.\n", seconds(left))
+	}
+	l.countdown = false
+}
+
+// Printf implements Frontend.Printf.
+func (l *lineFrontend) Printf(format string, v ...interface{}) {
+	fmt.Fprintf(l.w, format+"\n", v...)
+}
+
+func (l *lineFrontend) readLine() (string, error) {
+	line, err := l.r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// Read implements Frontend.Read.
+func (l *lineFrontend) Read(v *View, touch func()) (*Command, error) {
+	for {
+		line, err := l.readLine()
+		if err != nil {
+			return nil, err
+		}
+		touch()
+		cmd := parseCommand(line)
+		if cmd.Action != ActionEdit {
+			return cmd, nil
+		}
+		if !v.Edit {
+			l.Printf("Editing is disabled.")
+			continue
+		}
+		e, cmdline, err := editable(v, cmd)
+		if err != nil {
+			l.Printf("%v.", err)
+			continue
+		}
+
+		l.Printf("The kernel command line of %s is:\n%s", e.Label(), cmdline)
+		fmt.Fprint(l.w, "Enter the new command line, or nothing to cancel > ")
+		cmd.Cmdline, err = l.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(cmd.Cmdline) != "" {
+			return cmd, nil
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package menu
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event is written by the JSON frontend, one per line.
+type Event struct {
+	// Event is "menu", "countdown" or "message".
+	Event string `json:"event"`
+
+	// Title, Entries and Submenu describe a menu.
+	Title   string       `json:"title,omitempty"`
+	Entries []EventEntry `json:"entries,omitempty"`
+	Submenu bool         `json:"submenu,omitempty"`
+
+	// Seconds left until the default entry is loaded, or 0 if the
+	// countdown was interrupted.
+	Seconds int `json:"seconds,omitempty"`
+
+	Message string `json:"message,omitempty"`
+}
+
+// EventEntry is a menu entry in an Event.
+type EventEntry struct {
+	Number  int     `json:"number"`
+	Label   string  `json:"label"`
+	Default bool    `json:"default,omitempty"`
+	Submenu bool    `json:"submenu,omitempty"`
+	Cmdline *string `json:"cmdline,omitempty"`
+}
+
+// jsonFrontend is a Frontend for programs, e.g. automated tests. It reads a
+// Command and writes an Event per line.
+type jsonFrontend struct {
+	r *bufio.Scanner
+
+	mu sync.Mutex
+	w  *json.Encoder
+}
+
+// NewJSON returns a frontend that reads commands from r and writes events to
+// w as JSON lines, e.g.
+//
+//	{"event":"menu","entries":[{"number":1,"label":"Linux","default":true,"cmdline":"ro"}]}
+//	{"action":"edit","entry":"1","cmdline":"ro quiet"}
+//	{"event":"message","message":"Chosen option Linux."}
+func NewJSON(r io.Reader, w io.Writer) Frontend {
+	return &jsonFrontend{
+		r: bufio.NewScanner(r),
+		w: json.NewEncoder(w),
+	}
+}
+
+func (j *jsonFrontend) write(e *Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.w.Encode(e)
+}
+
+// Show implements Frontend.Show.
+func (j *jsonFrontend) Show(v *View) {
+	e := &Event{
+		Event:   "menu",
+		Title:   v.Title,
+		Submenu: v.Submenu,
+	}
+	for i, entry := range v.Entries {
+		ee := EventEntry{
+			Number:  i + 1,
+			Label:   entry.Label(),
+			Default: i == v.Default,
+		}
+		if _, ok := entry.(*Submenu); ok {
+			ee.Submenu = true
+		}
+		if cmdline, ok := entryCmdline(entry); ok && v.Edit {
+			ee.Cmdline = &cmdline
+		}
+		e.Entries = append(e.Entries, ee)
+	}
+	j.write(e)
+}
+
+// Countdown implements Frontend.Countdown.
+func (j *jsonFrontend) Countdown(left time.Duration) {
+	j.write(&Event{
+		Event:   "countdown",
+		Seconds: seconds(left),
+	})
+}
+
+// Printf implements Frontend.Printf.
+func (j *jsonFrontend) Printf(format string, v ...interface{}) {
+	j.write(&Event{
+		Event:   "message",
+		Message: fmt.Sprintf(format, v...),
+	})
+}
+
+// Read implements Frontend.Read.
+func (j *jsonFrontend) Read(v *View, touch func()) (*Command, error) {
+	for j.r.Scan() {
+		touch()
+		var cmd Command
+		if err := json.Unmarshal(j.r.Bytes(), &cmd); err != nil {
+			j.Printf("Invalid command %q: %v.", j.r.Text(), err)
+			continue
+		}
+		return &cmd, nil
+	}
+	if err := j.r.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
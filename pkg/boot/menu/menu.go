@@ -4,21 +4,25 @@
 
 // Package menu displays a Terminal UI based text menu to choose boot options
 // from.
+//
+// A Menu has a default entry and a timeout, and may have hidden entries and
+// submenus. Kernel command lines can be edited before booting. Menus are
+// shown by a Frontend: a terminal, a line-based console, or a JSON line
+// protocol for automated tests.
 package menu
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/u-root/u-root/pkg/boot"
 	"github.com/u-root/u-root/pkg/sh"
-	"golang.org/x/crypto/ssh/terminal"
 	"golang.org/x/sys/unix"
 )
 
@@ -46,92 +50,340 @@ type Entry interface {
 	IsDefault() bool
 }
 
-// Choose presents the user a menu on input to choose an entry from and returns that entry.
-func Choose(input *os.File, entries ...Entry) Entry {
-	fmt.Println("")
-	for i, e := range entries {
-		fmt.Printf("%02d. %s\n\n", i+1, e.Label())
+// Editable is implemented by entries whose kernel command line can be edited
+// before they are loaded.
+type Editable interface {
+	// Cmdline returns the command line, and false if it cannot be edited.
+	Cmdline() (string, bool)
+
+	// SetCmdline changes the command line.
+	SetCmdline(cmdline string)
+}
+
+func entryCmdline(e Entry) (string, bool) {
+	if ed, ok := e.(Editable); ok {
+		return ed.Cmdline()
 	}
-	fmt.Println("\r")
+	return "", false
+}
 
-	oldState, err := terminal.MakeRaw(int(input.Fd()))
-	if err != nil {
-		log.Printf("BUG: Please report: We cannot actually let you choose from menu (MakeRaw failed): %v", err)
-		return nil
+func setEntryCmdline(e Entry, cmdline string) bool {
+	if _, ok := entryCmdline(e); !ok {
+		return false
 	}
-	defer terminal.Restore(int(input.Fd()), oldState)
+	e.(Editable).SetCmdline(cmdline)
+	return true
+}
+
+// Submenu is an Entry that opens a nested menu.
+type Submenu struct {
+	Name    string
+	Entries []Entry
+}
 
-	// TODO(chrisko): reduce this timeout a la GRUB. 3 seconds, and hitting
-	// any button resets the timeout. We could save 7 seconds here.
-	t := time.NewTimer(initialTimeout)
+// Label is the label to show to the user.
+func (s *Submenu) Label() string {
+	return s.Name
+}
+
+// Load returns an error, as a submenu cannot be loaded.
+func (s *Submenu) Load() error {
+	return fmt.Errorf("%s is a submenu", s.Name)
+}
+
+// Exec returns an error, as a submenu cannot be executed.
+func (s *Submenu) Exec() error {
+	return fmt.Errorf("%s is a submenu", s.Name)
+}
 
-	boot := make(chan Entry, 1)
+// IsDefault indicates that this should not be run as a default action.
+func (*Submenu) IsDefault() bool { return false }
 
-	go func() {
-		// Read exactly one line.
-		term := terminal.NewTerminal(input, "Choose a menu option (hit enter to boot the default - 01 is the default option) > ")
+// Hidden returns an entry that is not shown in the menu, but can still be
+// chosen by typing its label, and is loaded by default like e.
+func Hidden(e Entry) Entry {
+	return &hiddenEntry{e}
+}
+
+type hiddenEntry struct {
+	Entry
+}
 
-		term.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
-			// We ain't gonna autocomplete, but we'll reset the countdown timer when you press a key.
-			t.Reset(subsequentTimeout)
-			return "", 0, false
+func (h *hiddenEntry) String() string            { return fmt.Sprint(h.Entry) }
+func (h *hiddenEntry) Cmdline() (string, bool)   { return entryCmdline(h.Entry) }
+func (h *hiddenEntry) SetCmdline(cmdline string) { setEntryCmdline(h.Entry, cmdline) }
+
+func isHidden(e Entry) bool {
+	_, ok := e.(*hiddenEntry)
+	return ok
+}
+
+// Menu is a boot menu, which may have submenus.
+type Menu struct {
+	// Title is shown above the entries.
+	Title string
+
+	Entries []Entry
+
+	// Default is the label of the entry to load if the user does not
+	// choose one, which may be in a submenu. If it is empty or no entry has
+	// this label, the first entry whose IsDefault is true is loaded.
+	Default string
+
+	// Timeout is how long the user has to choose an entry. It is counted
+	// down until the user starts typing. A zero Timeout loads the default
+	// entry right away, a negative one waits for the user.
+	Timeout time.Duration
+
+	// Edit lets the user edit kernel command lines. The command lines of
+	// images with a boot.Verifier cannot be edited even so, as signatures
+	// do not cover them.
+	Edit bool
+}
+
+// findDefault returns the entry labeled m.Default in entries or their
+// submenus.
+func (m *Menu) findDefault(entries []Entry) (Entry, bool) {
+	if m.Default == "" {
+		return nil, false
+	}
+	for _, e := range entries {
+		if sub, ok := e.(*Submenu); ok {
+			if d, ok := m.findDefault(sub.Entries); ok {
+				return d, true
+			}
+			continue
 		}
+		if e.Label() == m.Default {
+			return e, true
+		}
+	}
+	return nil, false
+}
 
-		for {
-			choice, err := term.ReadLine()
-			if err != nil {
-				if err != io.EOF {
-					fmt.Printf("BUG: Please report: Terminal read error: %v.\r\n", err)
-				}
-				boot <- nil
-				return
+// view returns the view of entries, a submenu of m if sub is true.
+func (m *Menu) view(title string, entries []Entry, sub bool) *View {
+	v := &View{
+		Title:   title,
+		Default: -1,
+		Submenu: sub,
+		Edit:    m.Edit,
+		all:     entries,
+	}
+	_, hasDefault := m.findDefault(m.Entries)
+	for _, e := range entries {
+		if isHidden(e) {
+			continue
+		}
+		if v.Default < 0 {
+			_, isSub := e.(*Submenu)
+			if (hasDefault && !isSub && e.Label() == m.Default) || (!hasDefault && !sub && e.IsDefault()) {
+				v.Default = len(v.Entries)
 			}
+		}
+		v.Entries = append(v.Entries, e)
+	}
+	return v
+}
+
+type readResult struct {
+	cmd *Command
+	err error
+}
+
+// session reads commands from a frontend one at a time, across the menus
+// shown to the user.
+type session struct {
+	f       Frontend
+	pending chan readResult
+	touched chan struct{}
+}
+
+func newSession(f Frontend) *session {
+	return &session{
+		f:       f,
+		touched: make(chan struct{}, 1),
+	}
+}
+
+// touch is called by the frontend when the user interacts with the menu.
+func (s *session) touch() {
+	select {
+	case s.touched <- struct{}{}:
+	default:
+	}
+}
 
-			if choice == "" {
-				// nil will result in the default order.
-				boot <- nil
-				return
+// read reads the next command, unless a read is still pending from a
+// previous menu.
+func (s *session) read(v *View) <-chan readResult {
+	if s.pending == nil {
+		c := make(chan readResult, 1)
+		go func() {
+			cmd, err := s.f.Read(v, s.touch)
+			c <- readResult{cmd, err}
+		}()
+		s.pending = c
+	}
+	return s.pending
+}
+
+// Choose shows the menu on f and returns the entry the user chose, or nil if
+// the default entries should be loaded.
+func (m *Menu) Choose(f Frontend) Entry {
+	return m.choose(newSession(f))
+}
+
+func (m *Menu) choose(s *session) Entry {
+	type level struct {
+		title   string
+		entries []Entry
+	}
+	levels := []level{{m.Title, m.Entries}}
+
+	var timeout <-chan time.Time
+	var ticks <-chan time.Time
+	var timer *time.Timer
+	deadline := time.Now().Add(m.Timeout)
+	if m.Timeout >= 0 {
+		timer = time.NewTimer(m.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	// Forget about interactions with previous menus.
+	select {
+	case <-s.touched:
+	default:
+	}
+
+	show := true
+	for {
+		lv := levels[len(levels)-1]
+		v := m.view(lv.title, lv.entries, len(levels) > 1)
+		if show {
+			s.f.Show(v)
+			if ticks != nil {
+				s.f.Countdown(time.Until(deadline))
 			}
-			num, err := strconv.Atoi(choice)
-			if err != nil {
-				fmt.Printf("%s is not a valid entry number: %v.\r\n", choice, err)
-				continue
+			show = false
+		}
+
+		select {
+		case <-timeout:
+			return nil
+
+		case <-ticks:
+			s.f.Countdown(time.Until(deadline))
+
+		case <-s.touched:
+			if ticks != nil {
+				ticks = nil
+				s.f.Countdown(0)
 			}
-			if num-1 < 0 || num > len(entries) {
-				fmt.Printf("%s is not a valid entry number.\r\n", choice)
-				continue
+			// The user gets more time once they start typing.
+			if timer != nil {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(subsequentTimeout)
 			}
-			boot <- entries[num-1]
-			return
-		}
-	}()
 
-	select {
-	case entry := <-boot:
-		if entry != nil {
-			fmt.Printf("Chosen option %s.\r\n\r\n", entry.Label())
+		case r := <-s.read(v):
+			s.pending = nil
+			if r.err != nil {
+				if r.err != io.EOF {
+					s.f.Printf("BUG: Please report: Terminal read error: %v.", r.err)
+				}
+				return nil
+			}
+			cmd := r.cmd
+			switch cmd.Action {
+			case ActionDefault:
+				return nil
+
+			case ActionBack:
+				if len(levels) == 1 {
+					s.f.Printf("Not in a submenu.")
+					continue
+				}
+				levels = levels[:len(levels)-1]
+				show = true
+
+			case ActionChoose, ActionEdit:
+				e, err := v.Lookup(cmd.Entry)
+				if err != nil {
+					s.f.Printf("%v.", err)
+					continue
+				}
+				if sub, ok := e.(*Submenu); ok {
+					if cmd.Action == ActionEdit {
+						s.f.Printf("%s is a submenu and cannot be edited.", sub.Label())
+						continue
+					}
+					levels = append(levels, level{sub.Name, sub.Entries})
+					show = true
+					continue
+				}
+				if cmd.Action == ActionEdit {
+					if !m.Edit {
+						s.f.Printf("Editing is disabled.")
+						continue
+					}
+					if !setEntryCmdline(e, cmd.Cmdline) {
+						s.f.Printf("%s cannot be edited.", e.Label())
+						continue
+					}
+				}
+				s.f.Printf("Chosen option %s.", e.Label())
+				return e
+
+			default:
+				s.f.Printf("Unknown action %q.", cmd.Action)
+			}
 		}
-		return entry
+	}
+}
 
-	case <-t.C:
-		return nil
+// defaults returns the entries to load if the user does not choose one: the
+// entry labeled m.Default, then those whose IsDefault is true, in order,
+// including those in submenus.
+func (m *Menu) defaults() []Entry {
+	var entries []Entry
+	def, ok := m.findDefault(m.Entries)
+	if ok {
+		entries = append(entries, def)
 	}
+	var add func([]Entry)
+	add = func(es []Entry) {
+		for _, e := range es {
+			if sub, isSub := e.(*Submenu); isSub {
+				add(sub.Entries)
+			} else if e.IsDefault() && (!ok || e.Label() != m.Default) {
+				entries = append(entries, e)
+			}
+		}
+	}
+	add(m.Entries)
+	return entries
 }
 
-// ShowMenuAndLoad lets the user choose one of entries and loads it. If no
-// entry is chosen by the user, an entry whose IsDefault() is true will be
-// returned.
+// Load lets the user choose one of the entries on f and loads it. If no
+// entry is chosen by the user, the default entries are loaded until one
+// succeeds, and it is returned.
 //
 // The user is left to call Entry.Exec when this function returns.
-func ShowMenuAndLoad(input *os.File, entries ...Entry) Entry {
-	// Clear the screen (ANSI terminal escape code for screen clear).
-	fmt.Printf("\033[1;1H\033[2J\n\n")
-	fmt.Printf("Welcome to NERF's Boot Menu\n\n")
-	fmt.Printf("Enter a number to boot a kernel:\n")
-
+func (m *Menu) Load(f Frontend) Entry {
+	s := newSession(f)
 	for {
 		// Allow the user to choose.
-		entry := Choose(input, entries...)
+		entry := m.choose(s)
 		if entry == nil {
 			// This only returns something if the user explicitly
 			// entered something.
@@ -140,7 +392,7 @@ func ShowMenuAndLoad(input *os.File, entries ...Entry) Entry {
 			break
 		}
 		if err := entry.Load(); err != nil {
-			log.Printf("Failed to load %s: %v", entry.Label(), err)
+			loadFailed(f, entry, err)
 			continue
 		}
 
@@ -150,36 +402,76 @@ func ShowMenuAndLoad(input *os.File, entries ...Entry) Entry {
 		return entry
 	}
 
-	fmt.Println("")
-
 	// We only get one shot at actually booting, so boot the first kernel
 	// that can be loaded correctly.
-	for _, e := range entries {
-		// Only perform actions that are default actions. I.e. don't
-		// drop to shell.
-		if e.IsDefault() {
-			fmt.Printf("Attempting to boot %s.\n\n", e)
-
-			if err := e.Load(); err != nil {
-				log.Printf("Failed to load %s: %v", e.Label(), err)
-				continue
-			}
+	for _, e := range m.defaults() {
+		f.Printf("Attempting to boot %s.", e)
 
-			// Entry was successfully loaded. Leave it to the
-			// caller to exec, so the caller can clean up the OS
-			// before rebooting or kexecing (e.g. unmount file
-			// systems).
-			return e
+		if err := e.Load(); err != nil {
+			loadFailed(f, e, err)
+			continue
 		}
+
+		// Entry was successfully loaded. Leave it to the caller to
+		// exec, so the caller can clean up the OS before rebooting or
+		// kexecing (e.g. unmount file systems).
+		return e
 	}
 	return nil
 }
 
-// OSImages returns menu entries for the given OSImages.
+// New returns the boot menu of entries, with the default title and timeout.
+func New(entries ...Entry) *Menu {
+	return &Menu{
+		Title:   "Welcome to NERF's Boot Menu",
+		Entries: entries,
+		Timeout: initialTimeout,
+	}
+}
+
+// Choose presents the user a menu on input to choose an entry from and returns that entry.
+func Choose(input *os.File, entries ...Entry) Entry {
+	m := &Menu{
+		Entries: entries,
+		Timeout: initialTimeout,
+	}
+	return m.Choose(NewFrontend(input))
+}
+
+// ShowMenuAndLoad lets the user choose one of entries and loads it. If no
+// entry is chosen by the user, an entry whose IsDefault() is true will be
+// returned.
+//
+// The user is left to call Entry.Exec when this function returns.
+func ShowMenuAndLoad(input *os.File, entries ...Entry) Entry {
+	return New(entries...).Load(NewFrontend(input))
+}
+
+// loadFailed reports that entry could not be loaded. Entries refused by a
+// boot.Verifier are reported on the console as well, as the user may have
+// to fix the signatures.
+func loadFailed(f Frontend, entry Entry, err error) {
+	var verr *boot.VerifyError
+	if errors.As(err, &verr) {
+		f.Printf("Refusing to boot %s: signature verification failed: %v", entry.Label(), verr.Err)
+	}
+	log.Printf("Failed to load %s: %v", entry.Label(), err)
+}
+
+// OSImages returns menu entries for the given OSImages. Images that are in
+// submenus of their boot loader config are put in submenus of the same
+// titles.
 func OSImages(verbose bool, imgs ...boot.OSImage) []Entry {
 	var menu []Entry
 	for _, img := range imgs {
-		menu = append(menu, &OSImageAction{
+		var submenu []string
+		switch img := img.(type) {
+		case *boot.LinuxImage:
+			submenu = img.Submenu
+		case *boot.MultibootImage:
+			submenu = img.Submenu
+		}
+		menu = addEntry(menu, submenu, &OSImageAction{
 			OSImage: img,
 			Verbose: verbose,
 		})
@@ -187,6 +479,93 @@ func OSImages(verbose bool, imgs ...boot.OSImage) []Entry {
 	return menu
 }
 
+// addEntry adds e to the submenu of entries with the titles in path,
+// creating submenus that do not exist yet.
+func addEntry(entries []Entry, path []string, e Entry) []Entry {
+	if len(path) == 0 {
+		return append(entries, e)
+	}
+	for _, entry := range entries {
+		if sub, ok := entry.(*Submenu); ok && sub.Name == path[0] {
+			sub.Entries = addEntry(sub.Entries, path[1:], e)
+			return entries
+		}
+	}
+	return append(entries, &Submenu{
+		Name:    path[0],
+		Entries: addEntry(nil, path[1:], e),
+	})
+}
+
+// Retry returns entries that are each loaded up to tries times, delay apart,
+// before the menu falls back to the next entry, e.g. as images fetched from
+// the network may fail to load for a while. Entries in submenus are retried,
+// too.
+func Retry(tries int, delay time.Duration, entries ...Entry) []Entry {
+	var menu []Entry
+	for _, e := range entries {
+		if sub, ok := e.(*Submenu); ok {
+			menu = append(menu, &Submenu{
+				Name:    sub.Name,
+				Entries: Retry(tries, delay, sub.Entries...),
+			})
+			continue
+		}
+		menu = append(menu, &RetryEntry{
+			Entry: e,
+			Tries: tries,
+			Delay: delay,
+		})
+	}
+	return menu
+}
+
+// RetryEntry is a menu.Entry that retries loading Entry.
+type RetryEntry struct {
+	Entry
+
+	// Tries is how many times Entry is loaded at most.
+	Tries int
+
+	// Delay is the time between tries.
+	Delay time.Duration
+}
+
+// Load implements Entry.Load by loading Entry up to Tries times. Entries
+// refused by a boot.Verifier are not retried.
+func (r *RetryEntry) Load() error {
+	var err error
+	for i := 0; i < r.Tries || i == 0; i++ {
+		if i > 0 {
+			log.Printf("Failed to load %s (try %d of %d): %v", r.Label(), i, r.Tries, err)
+			time.Sleep(r.Delay)
+		}
+		if err = r.Entry.Load(); err == nil {
+			return nil
+		}
+		var verr *boot.VerifyError
+		if errors.As(err, &verr) {
+			return err
+		}
+	}
+	return err
+}
+
+// String implements fmt.Stringer.
+func (r *RetryEntry) String() string {
+	return fmt.Sprint(r.Entry)
+}
+
+// Cmdline implements Editable.Cmdline.
+func (r *RetryEntry) Cmdline() (string, bool) {
+	return entryCmdline(r.Entry)
+}
+
+// SetCmdline implements Editable.SetCmdline.
+func (r *RetryEntry) SetCmdline(cmdline string) {
+	setEntryCmdline(r.Entry, cmdline)
+}
+
 // OSImageAction is a menu.Entry that boots an OSImage.
 type OSImageAction struct {
 	boot.OSImage
@@ -196,11 +575,33 @@ type OSImageAction struct {
 // Load implements Entry.Load by loading the OS image into memory.
 func (oia OSImageAction) Load() error {
 	if err := oia.OSImage.Load(oia.Verbose); err != nil {
-		return fmt.Errorf("could not load image %s: %v", oia.OSImage, err)
+		return fmt.Errorf("could not load image %s: %w", oia.OSImage, err)
 	}
 	return nil
 }
 
+// Cmdline implements Editable.Cmdline for Linux and multiboot images. The
+// command line of a LinuxImage with a Verifier cannot be edited.
+func (oia OSImageAction) Cmdline() (string, bool) {
+	switch img := oia.OSImage.(type) {
+	case *boot.LinuxImage:
+		return img.Cmdline, img.Verifier == nil
+	case *boot.MultibootImage:
+		return img.Cmdline, true
+	}
+	return "", false
+}
+
+// SetCmdline implements Editable.SetCmdline.
+func (oia OSImageAction) SetCmdline(cmdline string) {
+	switch img := oia.OSImage.(type) {
+	case *boot.LinuxImage:
+		img.Cmdline = cmdline
+	case *boot.MultibootImage:
+		img.Cmdline = cmdline
+	}
+}
+
 // Exec executes the loaded image.
 func (oia OSImageAction) Exec() error {
 	return boot.Execute()
@@ -5,13 +5,19 @@
 package menu
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/goterm/term"
+	"github.com/u-root/u-root/pkg/boot"
 	"github.com/u-root/u-root/pkg/testutil"
 )
 
@@ -269,3 +275,378 @@ func TestShowMenuAndLoad(t *testing.T) {
 		})
 	}
 }
+
+type flakyEntry struct {
+	testEntry
+	failures int
+	loads    int
+}
+
+func (f *flakyEntry) Load() error {
+	f.loads++
+	if f.loads <= f.failures {
+		return fmt.Errorf("try %d failed", f.loads)
+	}
+	return nil
+}
+
+func TestRetry(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		failures  int
+		tries     int
+		wantLoads int
+		wantErr   bool
+	}{
+		{name: "first try", failures: 0, tries: 3, wantLoads: 1},
+		{name: "last try", failures: 2, tries: 3, wantLoads: 3},
+		{name: "out of tries", failures: 3, tries: 3, wantLoads: 3, wantErr: true},
+		{name: "no tries", failures: 1, tries: 0, wantLoads: 1, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &flakyEntry{failures: tt.failures}
+			entries := Retry(tt.tries, time.Millisecond, e)
+			if err := entries[0].Load(); (err != nil) != tt.wantErr {
+				t.Errorf("Load() = %v, want error %t", err, tt.wantErr)
+			}
+			if e.loads != tt.wantLoads {
+				t.Errorf("Load() loaded %d times, want %d", e.loads, tt.wantLoads)
+			}
+		})
+	}
+}
+
+func TestRetryVerifyError(t *testing.T) {
+	e := &testEntry{load: &boot.VerifyError{Image: "1", Err: fmt.Errorf("bad signature")}}
+	loads := 0
+	entries := Retry(3, time.Millisecond, &countingEntry{Entry: e, loads: &loads})
+	if err := entries[0].Load(); err == nil {
+		t.Errorf("Load() succeeded, want error")
+	}
+	if loads != 1 {
+		t.Errorf("Load() loaded %d times, want 1", loads)
+	}
+}
+
+type countingEntry struct {
+	Entry
+	loads *int
+}
+
+func (c *countingEntry) Load() error {
+	*c.loads++
+	return c.Entry.Load()
+}
+
+type editEntry struct {
+	testEntry
+	cmdline string
+}
+
+func (e *editEntry) Cmdline() (string, bool)   { return e.cmdline, true }
+func (e *editEntry) SetCmdline(cmdline string) { e.cmdline = cmdline }
+
+func readEvents(t *testing.T, r io.Reader) []Event {
+	var events []Event
+	dec := json.NewDecoder(r)
+	for {
+		var e Event
+		if err := dec.Decode(&e); err == io.EOF {
+			return events
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+}
+
+func TestMenuJSON(t *testing.T) {
+	linux := &editEntry{testEntry: testEntry{label: "Linux", isDefault: true}, cmdline: "ro"}
+	rescue := &editEntry{testEntry: testEntry{label: "Rescue"}, cmdline: "single"}
+	shell := &testEntry{label: "Shell"}
+	m := &Menu{
+		Title: "Boot",
+		Entries: []Entry{
+			linux,
+			&Submenu{Name: "Advanced", Entries: []Entry{rescue}},
+			Hidden(shell),
+		},
+		Timeout: -1,
+		Edit:    true,
+	}
+
+	for _, tt := range []struct {
+		name     string
+		commands string
+		want     Entry
+		cmdline  string
+		messages []string
+	}{
+		{
+			name:     "default",
+			commands: `{"action":"default"}`,
+		},
+		{
+			name:     "choose",
+			commands: `{"action":"choose","entry":"1"}`,
+			want:     linux,
+			messages: []string{"Chosen option Linux."},
+		},
+		{
+			name:     "submenu",
+			commands: `{"action":"choose","entry":"2"}` + "\n" + `{"action":"choose","entry":"1"}`,
+			want:     rescue,
+		},
+		{
+			name:     "back",
+			commands: `{"action":"choose","entry":"2"}` + "\n" + `{"action":"back"}` + "\n" + `{"action":"choose","entry":"1"}`,
+			want:     linux,
+		},
+		{
+			name:     "hidden",
+			commands: `{"action":"choose","entry":"3"}` + "\n" + `{"action":"choose","entry":"Shell"}`,
+			want:     shell,
+			messages: []string{"3 is not a valid entry number.", "Chosen option Shell."},
+		},
+		{
+			name:     "edit",
+			commands: `{"action":"edit","entry":"Linux","cmdline":"ro quiet"}`,
+			want:     linux,
+			cmdline:  "ro quiet",
+		},
+		{
+			name:     "edit submenu",
+			commands: `{"action":"edit","entry":"2","cmdline":"x"}` + "\n" + `{"action":"edit","entry":"3"}` + "\n" + `garbage`,
+			messages: []string{"Advanced is a submenu and cannot be edited.", "3 is not a valid entry number."},
+		},
+		{
+			name:     "back at top",
+			commands: `{"action":"back"}` + "\n" + `{"action":"frob"}`,
+			messages: []string{"Not in a submenu.", `Unknown action "frob".`},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			linux.cmdline = "ro"
+			var out bytes.Buffer
+			got := m.Choose(NewJSON(strings.NewReader(tt.commands), &out))
+			// Hidden entries are wrapped.
+			if (got == nil) != (tt.want == nil) || (got != nil && got.Label() != tt.want.Label()) {
+				t.Errorf("Choose() = %v, want %v", got, tt.want)
+			}
+			if tt.cmdline != "" && linux.cmdline != tt.cmdline {
+				t.Errorf("cmdline = %q, want %q", linux.cmdline, tt.cmdline)
+			}
+
+			events := readEvents(t, &out)
+			if len(events) == 0 || events[0].Event != "menu" {
+				t.Fatalf("events = %v, want menu first", events)
+			}
+			ro := "ro"
+			want := []EventEntry{
+				{Number: 1, Label: "Linux", Default: true, Cmdline: &ro},
+				{Number: 2, Label: "Advanced", Submenu: true},
+			}
+			if !reflect.DeepEqual(events[0].Entries, want) {
+				t.Errorf("menu entries = %v, want %v", events[0].Entries, want)
+			}
+			var messages []string
+			for _, e := range events {
+				if e.Event == "message" && !strings.HasPrefix(e.Message, "Invalid command") {
+					messages = append(messages, e.Message)
+				}
+			}
+			if tt.messages != nil && !reflect.DeepEqual(messages, tt.messages) {
+				t.Errorf("messages = %q, want %q", messages, tt.messages)
+			}
+		})
+	}
+}
+
+func TestMenuCountdown(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+
+	var out bytes.Buffer
+	m := &Menu{
+		Entries: []Entry{&testEntry{label: "1", isDefault: true}},
+		Timeout: 1500 * time.Millisecond,
+	}
+	if got := m.Choose(NewJSON(r, &out)); got != nil {
+		t.Errorf("Choose() = %v, want nil", got)
+	}
+	var seconds []int
+	for _, e := range readEvents(t, &out) {
+		if e.Event == "countdown" {
+			seconds = append(seconds, e.Seconds)
+		}
+	}
+	if want := []int{2, 1}; !reflect.DeepEqual(seconds, want) {
+		t.Errorf("countdown = %v, want %v", seconds, want)
+	}
+}
+
+func TestMenuLoad(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		def      string
+		commands string
+		entries  []*testEntry
+		sub      []*testEntry
+		called   []string
+	}{
+		{
+			name: "default label",
+			def:  "3",
+			entries: []*testEntry{
+				{label: "1", isDefault: true},
+				{label: "2", isDefault: true},
+				{label: "3", isDefault: true, load: fmt.Errorf("borked")},
+			},
+			called: []string{"3", "1"},
+		},
+		{
+			name: "default in submenu",
+			def:  "s",
+			entries: []*testEntry{
+				{label: "1", isDefault: true},
+			},
+			sub:    []*testEntry{{label: "s"}},
+			called: []string{"s"},
+		},
+		{
+			name:     "chosen but broken",
+			commands: "2\n",
+			entries: []*testEntry{
+				{label: "1", isDefault: true},
+				{label: "2", load: fmt.Errorf("borked")},
+			},
+			called: []string{"2", "1"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var entries, sub []Entry
+			for _, e := range tt.entries {
+				entries = append(entries, e)
+			}
+			for _, e := range tt.sub {
+				sub = append(sub, e)
+			}
+			if sub != nil {
+				entries = append(entries, &Submenu{Name: "sub", Entries: sub})
+			}
+			m := &Menu{
+				Entries: entries,
+				Default: tt.def,
+				Timeout: -1,
+			}
+			var out bytes.Buffer
+			got := m.Load(NewLine(strings.NewReader(tt.commands), &out))
+			if want := tt.called[len(tt.called)-1]; got == nil || got.Label() != want {
+				t.Errorf("Load() = %v, want %s", got, want)
+			}
+			for _, e := range append(tt.entries, tt.sub...) {
+				if want := contains(tt.called, e.label); want != e.LoadCalled() {
+					t.Errorf("Entry %s loaded %t, want %t", e.label, e.LoadCalled(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestLineEdit(t *testing.T) {
+	linux := &editEntry{testEntry: testEntry{label: "Linux"}, cmdline: "ro"}
+	m := &Menu{Entries: []Entry{linux}, Timeout: -1}
+
+	// Editing is disabled unless asked for.
+	var out bytes.Buffer
+	if got := m.Choose(NewLine(strings.NewReader("e 1\n"), &out)); got != nil {
+		t.Errorf("Choose() = %v, want nil", got)
+	}
+	if !strings.Contains(out.String(), "Editing is disabled.") {
+		t.Errorf("Choose() printed %q, want editing disabled", out.String())
+	}
+
+	m.Edit = true
+	out.Reset()
+	got := m.Choose(NewLine(strings.NewReader("e 1\n\ne 1\nro quiet\n"), &out))
+	if got != linux {
+		t.Errorf("Choose() = %v, want Linux", got)
+	}
+	if linux.cmdline != "ro quiet" {
+		t.Errorf("cmdline = %q, want %q", linux.cmdline, "ro quiet")
+	}
+}
+
+type testVerifier struct{}
+
+func (testVerifier) Verify(*boot.LinuxImage, io.ReaderAt, io.ReaderAt) error { return nil }
+
+func TestEditVerified(t *testing.T) {
+	img := &boot.LinuxImage{Name: "Linux", Cmdline: "ro"}
+	signed := boot.Verify(testVerifier{}, &boot.LinuxImage{Name: "Signed", Cmdline: "ro"})[0].(*boot.LinuxImage)
+	m := &Menu{
+		Entries: Retry(1, 0, OSImages(false, img, signed)...),
+		Timeout: -1,
+		Edit:    true,
+	}
+
+	var out bytes.Buffer
+	if got := m.Choose(NewLine(strings.NewReader("e 2\n"), &out)); got != nil {
+		t.Errorf("Choose() = %v, want nil", got)
+	}
+	if !strings.Contains(out.String(), "Signed cannot be edited.") {
+		t.Errorf("Choose() printed %q, want Signed cannot be edited", out.String())
+	}
+	if signed.Cmdline != "ro" {
+		t.Errorf("cmdline = %q, want %q", signed.Cmdline, "ro")
+	}
+
+	out.Reset()
+	if got := m.Choose(NewLine(strings.NewReader("e 1\nro quiet\n"), &out)); got == nil || got.Label() != "Linux" {
+		t.Errorf("Choose() = %v, want Linux", got)
+	}
+	if img.Cmdline != "ro quiet" {
+		t.Errorf("cmdline = %q, want %q", img.Cmdline, "ro quiet")
+	}
+}
+
+// labels describes entries and their submenus, e.g. "a Adv[b c]".
+func labels(entries []Entry) string {
+	var s []string
+	for _, e := range entries {
+		if sub, ok := e.(*Submenu); ok {
+			s = append(s, fmt.Sprintf("%s[%s]", sub.Name, labels(sub.Entries)))
+		} else {
+			s = append(s, e.Label())
+		}
+	}
+	return strings.Join(s, " ")
+}
+
+func TestOSImagesSubmenus(t *testing.T) {
+	entries := OSImages(false,
+		&boot.LinuxImage{Name: "a"},
+		&boot.LinuxImage{Name: "b", Submenu: []string{"Adv"}},
+		&boot.MultibootImage{Name: "c", Submenu: []string{"Adv", "Old"}},
+		&boot.LinuxImage{Name: "d", Submenu: []string{"Adv"}},
+		&boot.LinuxImage{Name: "e", Submenu: []string{"Other"}},
+	)
+	want := "a Adv[b Old[c] d] Other[e]"
+	if got := labels(entries); got != want {
+		t.Errorf("OSImages() = %s, want %s", got, want)
+	}
+	entries = Retry(2, 0, entries...)
+	if got := labels(entries); got != want {
+		t.Errorf("Retry(OSImages()) = %s, want %s", got, want)
+	}
+
+	// Entries in submenus are loaded by default, too.
+	m := &Menu{Entries: entries}
+	if got := labels(m.defaults()); got != "a b c d e" {
+		t.Errorf("defaults() = %s, want a b c d e", got)
+	}
+	m.Default = "c"
+	if got := labels(m.defaults()); got != "c a b d e" {
+		t.Errorf("defaults() with default c = %s, want c a b d e", got)
+	}
+}
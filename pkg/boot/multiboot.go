@@ -18,10 +18,19 @@ import (
 type MultibootImage struct {
 	Name string
 
+	// Submenu are the titles of the submenus of the boot loader config
+	// that the image is in, outermost first. Boot menus show the image in
+	// the same submenus.
+	Submenu []string
+
 	Kernel  io.ReaderAt
 	Cmdline string
 	Modules []multiboot.Module
 	IBFT    *ibft.IBFT
+
+	// Loaded, if set, is called once the image is loaded and only
+	// remains to be executed. If it fails, so does Load.
+	Loaded func() error
 }
 
 var _ OSImage = &MultibootImage{}
@@ -36,7 +45,15 @@ func (mi *MultibootImage) Label() string {
 
 // Load implements OSImage.Load.
 func (mi *MultibootImage) Load(verbose bool) error {
-	return multiboot.Load(verbose, mi.Kernel, mi.Cmdline, mi.Modules, mi.IBFT)
+	if err := multiboot.Load(verbose, mi.Kernel, mi.Cmdline, mi.Modules, mi.IBFT); err != nil {
+		return err
+	}
+	if mi.Loaded != nil {
+		if err := mi.Loaded(); err != nil {
+			return fmt.Errorf("%s: %v", mi.Label(), err)
+		}
+	}
+	return nil
 }
 
 // String implements fmt.Stringer.
@@ -0,0 +1,179 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netboot
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/boot/stboot"
+	"github.com/u-root/u-root/pkg/curl"
+	"github.com/u-root/u-root/pkg/ulog/ulogtest"
+)
+
+// testPKI is a root certificate and a signing key certified by it.
+type testPKI struct {
+	rootPEM  []byte
+	keyFile  string
+	certFile string
+}
+
+func newTestPKI(t *testing.T, dir string) *testPKI {
+	write := func(name, typ string, b []byte) string {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	cert := func(tmpl, parent *x509.Certificate, pub *rsa.PublicKey, priv *rsa.PrivateKey) []byte {
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+		tmpl.NotAfter = time.Now().Add(time.Hour)
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+	key := func() *rsa.PrivateKey {
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	rootKey := key()
+	rootTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER := cert(rootTmpl, rootTmpl, &rootKey.PublicKey, rootKey)
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingKey := key()
+	signingDER := cert(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "signing key"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}, root, &signingKey.PublicKey, rootKey)
+
+	return &testPKI{
+		rootPEM:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER}),
+		keyFile:  write("signing.key", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(signingKey)),
+		certFile: write("signing.cert", "CERTIFICATE", signingDER),
+	}
+}
+
+// signedBootBall returns a bootball with one boot configuration that is
+// signed by pki and carries pki's root certificate.
+func signedBootBall(t *testing.T, dir string, pki *testPKI) []byte {
+	for name, content := range map[string][]byte{
+		"stconfig.json":     []byte(`{"boot_configs": [{"name": "signed", "kernel": "kernels/vmlinuz", "kernel_args": "quiet"}], "root_cert": "signing/root.cert"}`),
+		"kernels/vmlinuz":   []byte("kernel"),
+		"signing/root.cert": pki.rootPEM,
+	} {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ball, err := stboot.BootBallFromConfig(filepath.Join(dir, "stconfig.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ball.Clean()
+	if err := ball.Sign(pki.keyFile, pki.certFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := ball.Pack(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(ball.Archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestFileImagesBootBall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netboot-bootball-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkiDir := filepath.Join(dir, "trusted")
+	otherDir := filepath.Join(dir, "other")
+	for _, d := range []string{pkiDir, otherDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trusted := newTestPKI(t, pkiDir)
+	other := newTestPKI(t, otherDir)
+
+	fs := curl.NewMockScheme("http")
+	fs.Add("server", "/trusted.zip", string(signedBootBall(t, pkiDir, trusted)))
+	// Signed by a key certified by the root certificate it carries.
+	fs.Add("server", "/other.zip", string(signedBootBall(t, otherDir, other)))
+	fetch := func(path string) curl.File {
+		f, err := curl.Schemes{"http": fs}.Fetch(context.Background(), &url.URL{Scheme: "http", Host: "server", Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	for _, tt := range []struct {
+		name    string
+		path    string
+		roots   []byte
+		want    int
+		wantErr string
+	}{
+		{"no roots", "/trusted.zip", nil, 0, "no trusted root certificates"},
+		{"self-signed", "/other.zip", trusted.rootPEM, 0, "no boot configuration"},
+		{"trusted", "/trusted.zip", trusted.rootPEM, 1, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			imgs, err := fileImages(ulogtest.Logger{TB: t}, fetch(tt.path), "", Config{BootBallRoots: tt.roots})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("fileImages() = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fileImages() = %v", err)
+			}
+			if len(imgs) != tt.want {
+				t.Errorf("fileImages() = %v, want %d images", imgs, tt.want)
+			}
+		})
+	}
+}
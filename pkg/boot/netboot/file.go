@@ -0,0 +1,324 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netboot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/bls"
+	"github.com/u-root/u-root/pkg/boot/esxi"
+	"github.com/u-root/u-root/pkg/boot/localboot"
+	"github.com/u-root/u-root/pkg/boot/multiboot"
+	"github.com/u-root/u-root/pkg/boot/stboot"
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/curl"
+	"github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/mount/loop"
+	"github.com/u-root/u-root/pkg/uio"
+	"github.com/u-root/u-root/pkg/ulog"
+)
+
+// format is the format of a file the boot URI points at.
+type format int
+
+const (
+	unknownFormat format = iota
+
+	// linuxKernel is an x86 bzImage or an arm64 Image, with or
+	// without an EFI stub.
+	linuxKernel
+
+	// unifiedKernel is an EFI application with the kernel, initrd and
+	// command line in its sections.
+	unifiedKernel
+
+	// multibootKernel is an ELF or a.out kludge multiboot kernel.
+	multibootKernel
+
+	// isoImage is an ISO 9660 image, e.g. an installer CD.
+	isoImage
+
+	// cpioArchive is a newc cpio archive of a file system tree.
+	cpioArchive
+
+	// bootBall is a signed System Transparency bootball.
+	bootBall
+)
+
+var formatNames = map[format]string{
+	unknownFormat:   "unknown",
+	linuxKernel:     "Linux kernel",
+	unifiedKernel:   "unified kernel image",
+	multibootKernel: "multiboot kernel",
+	isoImage:        "ISO image",
+	cpioArchive:     "cpio archive",
+	bootBall:        "bootball",
+}
+
+func (f format) String() string {
+	return formatNames[f]
+}
+
+// errUnknownFormat is returned by fileImages for files that are not booted
+// directly, e.g. configuration scripts.
+var errUnknownFormat = errors.New("not a kernel or image format")
+
+// sniffLen is how much of a file sniff looks at. The ISO 9660 volume
+// descriptors start at 32K.
+const sniffLen = 0x8006
+
+// sniff returns the format of the file r by looking at its magic numbers.
+func sniff(r io.ReaderAt) format {
+	hdr := make([]byte, sniffLen)
+	n, err := r.ReadAt(hdr, 0)
+	if err != nil && err != io.EOF {
+		return unknownFormat
+	}
+	hdr = hdr[:n]
+	at := func(off int, magic string) bool {
+		return len(hdr) >= off+len(magic) && string(hdr[off:off+len(magic)]) == magic
+	}
+
+	switch {
+	case at(0x8001, "CD001"):
+		return isoImage
+	case at(0x202, "HdrS") || at(0x38, "ARM\x64"):
+		return linuxKernel
+	case at(0, "MZ"):
+		return unifiedKernel
+	case at(0, "070701") || at(0, "070702"):
+		return cpioArchive
+	case at(0, "PK\x03\x04"):
+		return bootBall
+	}
+	if multiboot.Probe(bytes.NewReader(hdr)) == nil {
+		return multibootKernel
+	}
+	return unknownFormat
+}
+
+// fileImages returns the images booting the file f directly, if it is a
+// kernel or an image with boot configurations rather than a configuration
+// script. Kernels without an embedded command line are booted with cmdline.
+//
+// Files that images are found in, as well as ISO images' mount points, are
+// kept around for as long as the process runs.
+func fileImages(l ulog.Logger, f curl.File, cmdline string, c Config) ([]boot.OSImage, error) {
+	name := f.URL().String()
+	typ := sniff(f)
+	if typ == unknownFormat {
+		return nil, errUnknownFormat
+	}
+	l.Printf("%s is a %s", name, typ)
+
+	switch typ {
+	case linuxKernel:
+		return []boot.OSImage{&boot.LinuxImage{
+			Name:    name,
+			Kernel:  f,
+			Cmdline: cmdline,
+		}}, nil
+
+	case unifiedKernel:
+		img, err := bls.ReadUKI(name, f)
+		if err != nil {
+			return nil, err
+		}
+		if img.Cmdline == "" {
+			img.Cmdline = cmdline
+		}
+		return []boot.OSImage{img}, nil
+
+	case multibootKernel:
+		return []boot.OSImage{&boot.MultibootImage{
+			Name:    name,
+			Kernel:  f,
+			Cmdline: cmdline,
+		}}, nil
+
+	case isoImage:
+		return isoImages(l, f)
+
+	case cpioArchive:
+		return cpioImages(l, f)
+
+	case bootBall:
+		return bootBallImages(l, f, c.BootBallRoots)
+	}
+	return nil, errUnknownFormat
+}
+
+// tempFile copies f into a temporary file, as loop devices and bootballs need
+// a file.
+func tempFile(f curl.File, pattern string) (string, error) {
+	tmp, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, uio.Reader(f)); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("downloading %s: %v", f.URL(), err)
+	}
+	return tmp.Name(), nil
+}
+
+// isoImages returns the images of the boot configurations on an ISO image, or
+// of an ESXi installer ISO.
+//
+// The configurations are read directly from f, so that only the files they
+// need are downloaded. The image is only downloaded completely and mounted if
+// that fails, e.g. for ESXi.
+func isoImages(l ulog.Logger, f curl.File) ([]boot.OSImage, error) {
+	imgs, err := localboot.ParseISO(l, f, "")
+	if err == nil {
+		return imgs, nil
+	}
+	l.Printf("Reading boot configurations from %s: %v; mounting it", f.URL(), err)
+
+	iso, err := tempFile(f, "netboot-*.iso")
+	if err != nil {
+		return nil, err
+	}
+	lo, err := loop.New(iso, "iso9660", "")
+	if err != nil {
+		os.Remove(iso)
+		return nil, err
+	}
+
+	if img, _, err := esxi.LoadCDROM(lo.Dev); err == nil {
+		return []boot.OSImage{img}, nil
+	}
+
+	dir, err := ioutil.TempDir("", "netboot-iso-")
+	if err != nil {
+		lo.Free()
+		os.Remove(iso)
+		return nil, err
+	}
+	mp, err := lo.Mount(dir, mount.ReadOnly)
+	if err == nil {
+		if imgs := localboot.ParseDir(l, dir); len(imgs) > 0 {
+			return imgs, nil
+		}
+		mp.Unmount(mount.MNT_DETACH)
+		err = fmt.Errorf("no boot configuration found on %s", f.URL())
+	}
+	os.Remove(dir)
+	lo.Free()
+	os.Remove(iso)
+	return nil, err
+}
+
+// cpioImages returns the images of the boot configurations in a cpio archive.
+func cpioImages(l ulog.Logger, f curl.File) ([]boot.OSImage, error) {
+	dir, err := ioutil.TempDir("", "netboot-cpio-")
+	if err != nil {
+		return nil, err
+	}
+	err = cpio.ForEachRecord(cpio.Newc.Reader(f), func(rec cpio.Record) error {
+		// Keep the archive within dir. Symlinks are not created, as later
+		// records would be written through them, and neither are devices.
+		if !localPath(rec.Name) {
+			l.Printf("Skipping %q in %s: path is outside the archive", rec.Name, f.URL())
+			return nil
+		}
+		switch rec.Mode & cpio.S_IFMT {
+		case cpio.S_IFREG, cpio.S_IFDIR:
+			return cpio.CreateFileInRoot(rec, dir, false)
+		case cpio.S_IFLNK:
+			l.Printf("Skipping symlink %q in %s", rec.Name, f.URL())
+		}
+		return nil
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("extracting %s: %v", f.URL(), err)
+	}
+	imgs := localboot.ParseDir(l, dir)
+	if len(imgs) == 0 {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("no boot configuration found in %s", f.URL())
+	}
+	return imgs, nil
+}
+
+// localPath returns whether name is relative and does not leave its root.
+func localPath(name string) bool {
+	if filepath.IsAbs(name) {
+		return false
+	}
+	for _, e := range strings.Split(filepath.ToSlash(name), "/") {
+		if e == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// bootBallImages returns the images of the boot configurations of a bootball
+// that have a valid signature.
+//
+// Signatures are checked against the PEM-encoded root certificates roots, not
+// the root certificate in the bootball itself, which anyone can replace.
+func bootBallImages(l ulog.Logger, f curl.File, roots []byte) ([]boot.OSImage, error) {
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("not booting bootball %s: no trusted root certificates", f.URL())
+	}
+	archive, err := tempFile(f, "netboot-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(archive)
+	ball, err := stboot.BootBallFromArchive(archive)
+	if err != nil {
+		return nil, err
+	}
+	ball.RootCertPEM = roots
+
+	var imgs []boot.OSImage
+	for i := 0; ; i++ {
+		bc, err := ball.GetBootConfigByIndex(i)
+		if err != nil {
+			break
+		}
+		found, valid, err := ball.VerifyBootconfigByID(bc.ID())
+		if err != nil || valid == 0 {
+			l.Printf("Skipping boot configuration %q of %s: %d signatures, %d valid: %v", bc.Name, f.URL(), found, valid, err)
+			continue
+		}
+		if bc.Multiboot != "" {
+			imgs = append(imgs, &boot.MultibootImage{
+				Name:    bc.Name,
+				Kernel:  uio.NewLazyFile(bc.Multiboot),
+				Cmdline: bc.MultibootArgs,
+				Modules: multiboot.LazyOpenModules(bc.Modules),
+			})
+			continue
+		}
+		img := &boot.LinuxImage{
+			Name:    bc.Name,
+			Kernel:  uio.NewLazyFile(bc.Kernel),
+			Cmdline: bc.KernelArgs,
+		}
+		if bc.Initramfs != "" {
+			img.Initrd = uio.NewLazyFile(bc.Initramfs)
+		}
+		imgs = append(imgs, img)
+	}
+	if len(imgs) == 0 {
+		ball.Clean()
+		return nil, fmt.Errorf("no boot configuration of %s has a valid signature", f.URL())
+	}
+	return imgs, nil
+}
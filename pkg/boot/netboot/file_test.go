@@ -0,0 +1,225 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netboot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/curl"
+	"github.com/u-root/u-root/pkg/dhclient"
+	"github.com/u-root/u-root/pkg/ulog/ulogtest"
+	"github.com/vishvananda/netlink"
+)
+
+// withMagic returns size bytes with magic at off.
+func withMagic(size, off int, magic string) []byte {
+	b := make([]byte, size)
+	copy(b[off:], magic)
+	return b
+}
+
+func multibootKernelFile() []byte {
+	b := make([]byte, 4096)
+	magic := uint32(0x1badb002)
+	binary.LittleEndian.PutUint32(b[64:], magic)
+	binary.LittleEndian.PutUint32(b[68:], 0)
+	binary.LittleEndian.PutUint32(b[72:], -magic)
+	return b
+}
+
+func cpioFile(t *testing.T, records ...cpio.Record) []byte {
+	var b bytes.Buffer
+	w := cpio.Newc.Writer(&b)
+	if err := cpio.WriteRecords(w, records); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpio.WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestSniff(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		file []byte
+		want format
+	}{
+		{"empty", nil, unknownFormat},
+		{"script", []byte("#!ipxe\nchain http://foo/bar\n"), unknownFormat},
+		{"bzImage", withMagic(1024, 0x202, "HdrS"), linuxKernel},
+		{"arm64 Image", withMagic(1024, 0x38, "ARM\x64"), linuxKernel},
+		{"EFI stub", append([]byte("MZ"), withMagic(1024, 0x200, "HdrS")...), linuxKernel},
+		{"EFI application", withMagic(1024, 0, "MZ"), unifiedKernel},
+		{"multiboot", multibootKernelFile(), multibootKernel},
+		{"ISO", withMagic(0x10000, 0x8001, "CD001"), isoImage},
+		{"cpio", cpioFile(t, cpio.StaticFile("foo", "bar", 0644)), cpioArchive},
+		{"zip", withMagic(1024, 0, "PK\x03\x04"), bootBall},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniff(bytes.NewReader(tt.file)); got != tt.want {
+				t.Errorf("sniff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBootURIImagesKernel(t *testing.T) {
+	kernel := withMagic(4096, 0x202, "HdrS")
+	fs := curl.NewMockScheme("http")
+	fs.Add("server", "/vmlinuz", string(kernel))
+	schemes := curl.Schemes{"http": fs}
+
+	uri := &url.URL{Scheme: "http", Host: "server", Path: "/vmlinuz"}
+	m, err := dhcpv6.NewMessage(
+		dhcpv6.WithOption(dhcpv6.OptBootFileURL(uri.String())),
+		dhcpv6.WithOption(dhcpv6.OptBootFileParam("console=ttyS0", "quiet")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease := dhclient.NewPacket6(&netlink.Dummy{}, m)
+
+	imgs := BootURIImages(context.Background(), ulogtest.Logger{TB: t}, schemes, uri, lease, Config{})
+	if len(imgs) != 1 {
+		t.Fatalf("BootURIImages() = %v, want 1 image", imgs)
+	}
+	li, ok := imgs[0].(*boot.LinuxImage)
+	if !ok {
+		t.Fatalf("BootURIImages() = %T, want *boot.LinuxImage", imgs[0])
+	}
+	if li.Cmdline != "console=ttyS0 quiet" {
+		t.Errorf("command line = %q, want %q", li.Cmdline, "console=ttyS0 quiet")
+	}
+	got := make([]byte, len(kernel))
+	if _, err := li.Kernel.ReadAt(got, 0); err != nil || !bytes.Equal(got, kernel) {
+		t.Errorf("kernel = %v, want the boot file", err)
+	}
+}
+
+func TestBootURIImagesIPXE(t *testing.T) {
+	fs := curl.NewMockScheme("http")
+	fs.Add("server", "/boot.ipxe", "#!ipxe\nkernel vmlinuz console=ttyS0\nboot\n")
+	fs.Add("server", "/vmlinuz", "kernel")
+	schemes := curl.Schemes{"http": fs}
+
+	uri := &url.URL{Scheme: "http", Host: "server", Path: "/boot.ipxe"}
+	m, err := dhcpv6.NewMessage(dhcpv6.WithOption(dhcpv6.OptBootFileURL(uri.String())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease := dhclient.NewPacket6(&netlink.Dummy{}, m)
+
+	imgs := BootURIImages(context.Background(), ulogtest.Logger{TB: t}, schemes, uri, lease, Config{})
+	if len(imgs) == 0 {
+		t.Fatalf("BootURIImages() = %v, want an image", imgs)
+	}
+	if li, ok := imgs[0].(*boot.LinuxImage); !ok || li.Cmdline != "console=ttyS0" {
+		t.Errorf("BootURIImages() = %v, want the kernel of the script", imgs[0])
+	}
+	// The script is not downloaded again to run it.
+	if n := fs.NumCalled(uri); n != 1 {
+		t.Errorf("%s fetched %d times, want 1", uri, n)
+	}
+}
+
+func TestFileImagesCPIO(t *testing.T) {
+	outside, err := ioutil.TempDir("", "netboot-outside-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	archive := cpioFile(t,
+		cpio.Directory("isolinux", 0755),
+		cpio.StaticFile("isolinux/isolinux.cfg", "default foo\nlabel foo\n  kernel /vmlinuz\n  append root=/dev/ram0\n", 0644),
+		cpio.StaticFile("vmlinuz", "kernel", 0644),
+		// None of these may escape the extraction directory.
+		cpio.StaticFile("../../evil", "evil", 0644),
+		cpio.StaticFile(filepath.Join(outside, "abs"), "evil", 0644),
+		cpio.Symlink("out", outside),
+		cpio.StaticFile("out/evil", "evil", 0644),
+	)
+	fs := curl.NewMockScheme("http")
+	fs.Add("server", "/boot.cpio", string(archive))
+	f, err := curl.Schemes{"http": fs}.Fetch(context.Background(), &url.URL{Scheme: "http", Host: "server", Path: "/boot.cpio"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imgs, err := fileImages(ulogtest.Logger{TB: t}, f, "", Config{})
+	if err != nil {
+		t.Fatalf("fileImages() = %v", err)
+	}
+	if len(imgs) != 1 {
+		t.Fatalf("fileImages() = %v, want 1 image", imgs)
+	}
+	li, ok := imgs[0].(*boot.LinuxImage)
+	if !ok {
+		t.Fatalf("fileImages() = %T, want *boot.LinuxImage", imgs[0])
+	}
+	if li.Name != "foo" || li.Cmdline != "root=/dev/ram0" {
+		t.Errorf("image = %s, want foo with command line root=/dev/ram0", li)
+	}
+	got := make([]byte, 6)
+	if _, err := li.Kernel.ReadAt(got, 0); err != nil || string(got) != "kernel" {
+		t.Errorf("kernel = %q, %v, want %q", got, err, "kernel")
+	}
+	if files, err := ioutil.ReadDir(outside); err != nil || len(files) != 0 {
+		t.Errorf("files written outside of the extraction directory: %v, %v", files, err)
+	}
+}
+
+func TestFileImagesISO(t *testing.T) {
+	gz, err := ioutil.ReadFile(filepath.Join("..", "..", "iso9660", "testdata", "rr.iso.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iso, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := curl.NewMockScheme("http")
+	fs.Add("server", "/live.iso", string(iso))
+	f, err := curl.Schemes{"http": fs}.Fetch(context.Background(), &url.URL{Scheme: "http", Host: "server", Path: "/live.iso"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The image is read in place, without a loop device.
+	imgs, err := fileImages(ulogtest.Logger{TB: t}, f, "", Config{})
+	if err != nil {
+		t.Fatalf("fileImages() = %v", err)
+	}
+	if len(imgs) == 0 {
+		t.Fatal("fileImages() returned no images")
+	}
+	li, ok := imgs[0].(*boot.LinuxImage)
+	if !ok {
+		t.Fatalf("fileImages() = %T, want *boot.LinuxImage", imgs[0])
+	}
+	if li.Name != "Live system" || li.Cmdline != "boot=casper quiet" {
+		t.Errorf("image = %s, want Live system with command line boot=casper quiet", li)
+	}
+	got := make([]byte, 6)
+	if _, err := li.Kernel.ReadAt(got, 0); err != nil || string(got) != "kernel" {
+		t.Errorf("kernel = %q, %v, want %q", got, err, "kernel")
+	}
+}
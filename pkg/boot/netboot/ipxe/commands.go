@@ -0,0 +1,321 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipxe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// command is an iPXE command. A non-nil error means the command failed.
+type command func(ctx context.Context, c *parser, args []string) error
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"clear":  cmdClear,
+		"echo":   cmdEcho,
+		"exit":   cmdExit,
+		"goto":   cmdGoto,
+		"inc":    cmdInc,
+		"iseq":   cmdIseq,
+		"isset":  cmdIsset,
+		"read":   cmdFail,
+		"set":    cmdSet,
+		"sleep":  cmdNop,
+		"prompt": cmdFail,
+		"shell":  cmdFail,
+
+		"chain":     cmdChain,
+		"imgexec":   cmdChain,
+		"boot":      cmdBoot,
+		"kernel":    cmdKernel,
+		"imgselect": cmdKernel,
+		"imgload":   cmdKernel,
+		"imgfetch":  cmdImgfetch,
+		"initrd":    cmdImgfetch,
+		"module":    cmdImgfetch,
+		"imgargs":   cmdImgargs,
+		"imgfree":   cmdImgfree,
+		"imgstat":   cmdNop,
+		"imgtrust":  cmdNop,
+		"imgverify": cmdUnsupported,
+		"autoboot":  cmdUnsupported,
+		"sanboot":   cmdUnsupported,
+		"sanhook":   cmdUnsupported,
+		"sanunhook": cmdUnsupported,
+
+		"menu":   cmdMenu,
+		"item":   cmdItem,
+		"choose": cmdChoose,
+
+		"poweroff": cmdExit,
+		"reboot":   cmdExit,
+
+		// We already have network configuration, and there is no
+		// console to configure.
+		"colour":  cmdNop,
+		"console": cmdNop,
+		"cpair":   cmdNop,
+		"dhcp":    cmdNop,
+		"ifclose": cmdNop,
+		"ifconf":  cmdNop,
+		"ifopen":  cmdNop,
+		"ifstat":  cmdNop,
+		"ntp":     cmdNop,
+		"param":   cmdNop,
+		"params":  cmdNop,
+		"route":   cmdNop,
+		"sync":    cmdNop,
+	}
+}
+
+func cmdNop(ctx context.Context, c *parser, args []string) error {
+	return nil
+}
+
+// cmdFail implements interactive commands, which fail as on a timeout.
+func cmdFail(ctx context.Context, c *parser, args []string) error {
+	return errors.New("not interactive")
+}
+
+func cmdUnsupported(ctx context.Context, c *parser, args []string) error {
+	return errors.New("not supported")
+}
+
+func cmdEcho(ctx context.Context, c *parser, args []string) error {
+	if len(args) > 0 && args[0] == "-n" {
+		args = args[1:]
+	}
+	c.log.Printf("iPXE: %s", strings.Join(args, " "))
+	return nil
+}
+
+func cmdExit(ctx context.Context, c *parser, args []string) error {
+	status := 0
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid exit status %q", args[0])
+		}
+		status = n
+	}
+	return exitError{status}
+}
+
+func cmdGoto(ctx context.Context, c *parser, args []string) error {
+	if len(args) != 1 {
+		return errors.New("label expected")
+	}
+	return gotoError{args[0]}
+}
+
+// settingName strips the type from a setting name like net0/mac:hexhyp.
+func settingName(name string) string {
+	if i := strings.LastIndexByte(name, ':'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+func cmdSet(ctx context.Context, c *parser, args []string) error {
+	if len(args) == 0 {
+		return errors.New("setting name expected")
+	}
+	name := settingName(args[0])
+	if len(args) == 1 {
+		delete(c.vars, name)
+		return nil
+	}
+	c.vars[name] = strings.Join(args[1:], " ")
+	return nil
+}
+
+func cmdClear(ctx context.Context, c *parser, args []string) error {
+	if len(args) != 1 {
+		return errors.New("setting name expected")
+	}
+	delete(c.vars, settingName(args[0]))
+	return nil
+}
+
+func cmdInc(ctx context.Context, c *parser, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("setting name expected")
+	}
+	inc := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid increment %q", args[1])
+		}
+		inc = n
+	}
+	name := settingName(args[0])
+	n, _ := strconv.Atoi(c.vars[name])
+	c.vars[name] = strconv.Itoa(n + inc)
+	return nil
+}
+
+// cmdIsset succeeds if its argument, usually an expanded setting, is not
+// empty.
+func cmdIsset(ctx context.Context, c *parser, args []string) error {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return errors.New("not set")
+	}
+	return nil
+}
+
+func cmdIseq(ctx context.Context, c *parser, args []string) error {
+	if len(args) != 2 {
+		return errors.New("two values expected")
+	}
+	if args[0] != args[1] {
+		return fmt.Errorf("%q is not %q", args[0], args[1])
+	}
+	return nil
+}
+
+// cmdImgfetch implements imgfetch, initrd and module.
+func cmdImgfetch(ctx context.Context, c *parser, args []string) error {
+	_, err := c.register(ctx, args)
+	return err
+}
+
+// cmdKernel implements kernel, imgselect and imgload.
+func cmdKernel(ctx context.Context, c *parser, args []string) error {
+	img, err := c.register(ctx, args)
+	if err != nil {
+		return err
+	}
+	c.selected = img
+	return nil
+}
+
+// cmdChain implements chain and imgexec.
+func cmdChain(ctx context.Context, c *parser, args []string) error {
+	if len(args) == 0 {
+		return cmdBoot(ctx, c, nil)
+	}
+	img, err := c.register(ctx, args)
+	if err != nil {
+		return err
+	}
+	c.selected = img
+	return c.exec(ctx, img)
+}
+
+func cmdBoot(ctx context.Context, c *parser, args []string) error {
+	img := c.selected
+	if len(args) > 0 {
+		img = c.find(args[0])
+	}
+	if img == nil {
+		return errors.New("no image selected")
+	}
+	return c.exec(ctx, img)
+}
+
+func cmdImgargs(ctx context.Context, c *parser, args []string) error {
+	if len(args) == 0 {
+		return errors.New("image name expected")
+	}
+	img := c.find(args[0])
+	if img == nil {
+		return fmt.Errorf("no such image %q", args[0])
+	}
+	img.cmdline = strings.Join(args[1:], " ")
+	return nil
+}
+
+func cmdImgfree(ctx context.Context, c *parser, args []string) error {
+	if len(args) == 0 {
+		c.images = nil
+		c.selected = nil
+		return nil
+	}
+	for _, name := range args {
+		c.free(name)
+	}
+	return nil
+}
+
+// menuItem is an item of a menu built with the item command.
+type menuItem struct {
+	label     string
+	isDefault bool
+}
+
+func cmdMenu(ctx context.Context, c *parser, args []string) error {
+	c.menu = nil
+	return nil
+}
+
+func cmdItem(ctx context.Context, c *parser, args []string) error {
+	var item menuItem
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; arg {
+		case "-d", "--default":
+			item.isDefault = true
+		case "-g", "--gap":
+			return nil
+		case "-k", "--key", "-m", "--menu":
+			i++
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) == 0 {
+		// A gap.
+		return nil
+	}
+	item.label = positional[0]
+	c.menu = append(c.menu, item)
+	return nil
+}
+
+// cmdChoose picks the default item of the menu, as if the menu timed out.
+func cmdChoose(ctx context.Context, c *parser, args []string) error {
+	var choice string
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; arg {
+		case "-d", "--default":
+			if i+1 < len(args) {
+				i++
+				choice = args[i]
+			}
+		case "-t", "--timeout", "-m", "--menu":
+			i++
+		case "-k", "--keep":
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) == 0 {
+		return errors.New("setting name expected")
+	}
+	if len(choice) == 0 {
+		for _, item := range c.menu {
+			if item.isDefault {
+				choice = item.label
+				break
+			}
+		}
+	}
+	if len(choice) == 0 {
+		if len(c.menu) == 0 {
+			return errors.New("empty menu")
+		}
+		choice = c.menu[0].label
+	}
+	c.vars[settingName(positional[0])] = choice
+	return nil
+}
@@ -1,11 +1,25 @@
-// Copyright 2017-2019 the u-root Authors. All rights reserved
+// Copyright 2017-2020 the u-root Authors. All rights reserved
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package ipxe implements a trivial IPXE config file parser.
+// Package ipxe implements an iPXE script interpreter.
+//
+// See https://ipxe.org/scripting and https://ipxe.org/cmd for a reference of
+// the script language and its commands.
+//
+// Scripts are executed as iPXE would, except that booting an image does not
+// stop the machine: images that would be booted are collected and returned as
+// boot.OSImages. If a boot command is followed by ||, the script continues as
+// if booting failed, so that fallback images are returned as well, in order.
+//
+// Settings such as ${ip} or ${net0/mac} are initialized from a DHCP lease,
+// see LeaseVars. Commands that configure iPXE itself (ifopen, dhcp, console,
+// ...) succeed without doing anything, and interactive commands (prompt,
+// shell, ...) fail, as they would on timeout.
 package ipxe
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -15,6 +29,7 @@ import (
 	"strings"
 
 	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/multiboot"
 	"github.com/u-root/u-root/pkg/curl"
 	"github.com/u-root/u-root/pkg/uio"
 	"github.com/u-root/u-root/pkg/ulog"
@@ -24,13 +39,52 @@ var (
 	// ErrNotIpxeScript is returned when the config file is not an
 	// ipxe script.
 	ErrNotIpxeScript = errors.New("config file is not ipxe as it does not start with #!ipxe")
+
+	// ErrNoImage is returned when a script did not boot anything.
+	ErrNoImage = errors.New("ipxe script did not boot an image")
 )
 
-// parser encapsulates a parsed ipxe configuration file.
-//
-// We currently only support kernel and initrd commands.
+const (
+	// maxSteps limits the number of commands executed, since scripts
+	// commonly retry forever.
+	maxSteps = 10000
+
+	// maxDepth limits the nesting of chained scripts.
+	maxDepth = 16
+)
+
+// image is an image registered by imgfetch, kernel, chain, etc.
+type image struct {
+	name    string
+	url     *url.URL
+	r       io.ReaderAt
+	cmdline string
+}
+
+// parser encapsulates the state of the iPXE interpreter.
 type parser struct {
-	bootImage *boot.LinuxImage
+	// vars are the iPXE settings, by name.
+	vars map[string]string
+
+	// images are the registered images, in the order they were fetched.
+	images []*image
+
+	// selected is the image selected for booting by kernel or imgselect.
+	selected *image
+
+	// booted are the images booted so far, and bootedKeys identifies them
+	// to detect retry loops.
+	booted     []boot.OSImage
+	bootedKeys map[string]bool
+
+	// orElse is set while executing a command followed by ||.
+	orElse bool
+
+	// menu collects the items of the menu being built.
+	menu []menuItem
+
+	steps int
+	depth int
 
 	// wd is the current working directory.
 	//
@@ -42,53 +96,66 @@ type parser struct {
 	schemes curl.Schemes
 }
 
-// ParseConfig returns a new configuration with the file at URL and default
-// schemes.
+// ParseConfig executes the iPXE script at configURL and returns the images it
+// boots.
+//
+// `vars` are the initial iPXE settings, e.g. from LeaseVars, and may be nil.
 //
 // `s` is used to get files referred to by URLs in the configuration.
-func ParseConfig(ctx context.Context, l ulog.Logger, configURL *url.URL, s curl.Schemes) (*boot.LinuxImage, error) {
-	c := &parser{
-		schemes: s,
-		log:     l,
-	}
-	if err := c.getAndParseFile(ctx, configURL); err != nil {
+func ParseConfig(ctx context.Context, l ulog.Logger, configURL *url.URL, s curl.Schemes, vars map[string]string) ([]boot.OSImage, error) {
+	f, err := s.Fetch(ctx, configURL)
+	if err != nil {
 		return nil, err
 	}
-	return c.bootImage, nil
+	return ParseFile(ctx, l, f, s, vars)
 }
 
-// getAndParse parses the config file downloaded from `url` and fills in `c`.
-func (c *parser) getAndParseFile(ctx context.Context, u *url.URL) error {
-	r, err := c.schemes.Fetch(ctx, u)
-	if err != nil {
-		return err
+// ParseFile is like ParseConfig, but executes the script f, which has
+// already been fetched.
+func ParseFile(ctx context.Context, l ulog.Logger, f curl.File, s curl.Schemes, vars map[string]string) ([]boot.OSImage, error) {
+	c := &parser{
+		vars:       make(map[string]string),
+		bootedKeys: make(map[string]bool),
+		schemes:    s,
+		log:        l,
+	}
+	for k, v := range defaultVars() {
+		c.vars[k] = v
+	}
+	for k, v := range vars {
+		c.vars[k] = v
 	}
-	data, err := uio.ReadAll(r)
+
+	img := &image{
+		name: path.Base(f.URL().Path),
+		url:  f.URL(),
+		r:    f,
+	}
+	data, err := uio.ReadAll(img.r)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	config := string(data)
-	if !strings.HasPrefix(config, "#!ipxe") {
-		return ErrNotIpxeScript
+	if !isScript(data) {
+		return nil, ErrNotIpxeScript
 	}
-	c.log.Printf("Got ipxe config file %s:\n%s\n", r, config)
+	c.log.Printf("Got ipxe config file %s:\n%s\n", img.r, data)
 
-	// Parent dir of the config file.
-	c.wd = &url.URL{
-		Scheme: u.Scheme,
-		Host:   u.Host,
-		Path:   path.Dir(u.Path),
+	err = c.runScript(ctx, img, string(data))
+	if len(c.booted) > 0 {
+		if err != nil && err != errBooted {
+			c.log.Printf("iPXE script failed after booting %d images: %v", len(c.booted), err)
+		}
+		return c.booted, nil
 	}
-	return c.parseIpxe(config)
+	if err != nil && err != errBooted {
+		return nil, err
+	}
+	return nil, ErrNoImage
 }
 
-// getFile parses `surl` and returns an io.Reader for the requested url.
-func (c *parser) getFile(surl string) (io.ReaderAt, error) {
-	u, err := parseURL(surl, c.wd)
-	if err != nil {
-		return nil, fmt.Errorf("could not parse URL %q: %v", surl, err)
-	}
-	return c.schemes.LazyFetch(u)
+// isScript returns true if data is an iPXE (or its predecessor gPXE) script.
+func isScript(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("#!ipxe")) || bytes.HasPrefix(data, []byte("#!gpxe"))
 }
 
 func parseURL(name string, wd *url.URL) (*url.URL, error) {
@@ -116,58 +183,186 @@ func parseURL(name string, wd *url.URL) (*url.URL, error) {
 	return u, nil
 }
 
-// parseIpxe parses `config` and constructs a BootImage for `c`.
-func (c *parser) parseIpxe(config string) error {
-	// A trivial ipxe script parser.
-	// Currently only supports kernel and initrd commands.
-	c.bootImage = &boot.LinuxImage{}
-
-	for _, line := range strings.Split(config, "\n") {
-		// Skip blank lines and comment lines.
-		line = strings.TrimSpace(line)
-		if line == "" || line[0] == '#' {
-			continue
+// fetch downloads the image at u.
+//
+// Like iPXE, we fetch images when they are registered, so that scripts can
+// react to download failures.
+func (c *parser) fetch(ctx context.Context, u *url.URL) (*image, error) {
+	r, err := c.schemes.Fetch(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	return &image{
+		name: path.Base(u.Path),
+		url:  u,
+		r:    r,
+	}, nil
+}
+
+// register fetches the image named by args, which are the arguments of
+// imgfetch and friends, and adds it to the list of images.
+func (c *parser) register(ctx context.Context, args []string) (*image, error) {
+	var name string
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-n" || arg == "--name":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("option %s requires an argument", arg)
+			}
+			i++
+			name = args[i]
+		case strings.HasPrefix(arg, "--name="):
+			name = strings.TrimPrefix(arg, "--name=")
+		case arg == "-t" || arg == "--timeout":
+			i++
+		case len(positional) == 0 && strings.HasPrefix(arg, "-") && len(arg) > 1:
+			// --autofree, --replace, etc.
+		default:
+			positional = append(positional, arg)
 		}
+	}
+	if len(positional) == 0 {
+		return nil, errors.New("image URI expected")
+	}
+
+	u, err := parseURL(positional[0], c.wd)
+	if err != nil {
+		return nil, err
+	}
+	img, err := c.fetch(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	if len(name) > 0 {
+		img.name = name
+	}
+	img.cmdline = strings.Join(positional[1:], " ")
+
+	// A new image replaces any existing image of the same name.
+	c.free(img.name)
+	c.images = append(c.images, img)
+	return img, nil
+}
 
-		args := strings.Fields(line)
-		if len(args) == 0 {
-			continue
+// find returns the registered image called name.
+func (c *parser) find(name string) *image {
+	for _, img := range c.images {
+		if img.name == name {
+			return img
 		}
-		cmd := strings.ToLower(args[0])
-
-		switch cmd {
-		case "kernel":
-			if len(args) > 1 {
-				k, err := c.getFile(args[1])
-				if err != nil {
-					return err
-				}
-				c.bootImage.Kernel = k
-			}
+	}
+	return nil
+}
 
-			// Add cmdline if there are any.
-			if len(args) > 2 {
-				c.bootImage.Cmdline = strings.Join(args[2:], " ")
+// free unregisters the image called name.
+func (c *parser) free(name string) {
+	for i, img := range c.images {
+		if img.name == name {
+			c.images = append(c.images[:i:i], c.images[i+1:]...)
+			if c.selected == img {
+				c.selected = nil
 			}
+			return
+		}
+	}
+}
 
-		case "initrd":
-			if len(args) > 1 {
-				i, err := c.getFile(args[1])
-				if err != nil {
-					return err
-				}
-				c.bootImage.Initrd = i
-			}
+// exec executes img, as imgexec does.
+//
+// Scripts are run, and everything else is booted with all other registered
+// images as initrds or multiboot modules.
+func (c *parser) exec(ctx context.Context, img *image) error {
+	var hdr [6]byte
+	n, err := img.r.ReadAt(hdr[:], 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if isScript(hdr[:n]) {
+		data, err := uio.ReadAll(img.r)
+		if err != nil {
+			return err
+		}
+		if c.depth >= maxDepth {
+			return errors.New("too many nested scripts")
+		}
+		c.depth++
+		defer func() { c.depth-- }()
 
-		case "boot":
-			// Stop parsing at this point, we should go ahead and
-			// boot.
-			return nil
+		// Like iPXE, unregister the script while it runs, so that it
+		// is not booted as an initrd.
+		c.free(img.name)
+		err = c.runScript(ctx, img, string(data))
+		if c.find(img.name) == nil {
+			c.images = append(c.images, img)
+		}
+		if e, ok := err.(exitError); ok {
+			return fmt.Errorf("%s exited with status %d", img.url, e.status)
+		}
+		return err
+	}
+	return c.boot(img)
+}
 
-		default:
-			c.log.Printf("Ignoring unsupported ipxe cmd: %s", line)
+// boot records that img and all other registered images are booted.
+func (c *parser) boot(kernel *image) error {
+	var modules []*image
+	for _, img := range c.images {
+		if img != kernel {
+			modules = append(modules, img)
 		}
 	}
 
-	return nil
+	var osImage boot.OSImage
+	if multiboot.Probe(kernel.r) == nil {
+		mb := &boot.MultibootImage{
+			Kernel:  kernel.r,
+			Cmdline: kernel.cmdline,
+		}
+		for _, m := range modules {
+			mb.Modules = append(mb.Modules, multiboot.Module{
+				Module:  m.r,
+				Cmdline: strings.TrimSpace(m.name + " " + m.cmdline),
+			})
+		}
+		osImage = mb
+	} else {
+		li := &boot.LinuxImage{
+			Kernel:  kernel.r,
+			Cmdline: kernel.cmdline,
+		}
+		var initrds []io.ReaderAt
+		for _, m := range modules {
+			initrds = append(initrds, m.r)
+		}
+		if len(initrds) == 1 {
+			li.Initrd = initrds[0]
+		} else if len(initrds) > 1 {
+			li.Initrd = boot.CatInitrds(initrds...)
+		}
+		osImage = li
+	}
+
+	// Scripts commonly retry booting forever; booting the same image
+	// again means we are done.
+	key := imageKey(kernel, modules)
+	if c.bootedKeys[key] {
+		return errBooted
+	}
+	c.bootedKeys[key] = true
+	c.booted = append(c.booted, osImage)
+	c.log.Printf("iPXE boots %s", osImage)
+
+	if c.orElse {
+		return fmt.Errorf("continuing with the fallback of booting %s", kernel.url)
+	}
+	return errBooted
+}
+
+func imageKey(kernel *image, modules []*image) string {
+	s := []string{kernel.url.String(), kernel.cmdline}
+	for _, m := range modules {
+		s = append(s, m.url.String(), m.cmdline)
+	}
+	return strings.Join(s, "\x00")
 }
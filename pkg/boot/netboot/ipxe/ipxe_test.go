@@ -5,7 +5,10 @@
 package ipxe
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
@@ -14,6 +17,7 @@ import (
 	"testing"
 
 	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/multiboot"
 	"github.com/u-root/u-root/pkg/curl"
 	"github.com/u-root/u-root/pkg/uio"
 	"github.com/u-root/u-root/pkg/ulog/ulogtest"
@@ -30,14 +34,6 @@ func mustReadAll(r io.ReaderAt) string {
 	return string(b)
 }
 
-type errorReader struct {
-	err error
-}
-
-func (e errorReader) ReadAt(p []byte, n int64) (int, error) {
-	return 0, e.err
-}
-
 func mustParseURL(s string) *url.URL {
 	u, err := url.Parse(s)
 	if err != nil {
@@ -92,7 +88,7 @@ func TestIpxeConfig(t *testing.T) {
 		desc       string
 		schemeFunc func() curl.Schemes
 		curl       *url.URL
-		want       *boot.LinuxImage
+		want       []boot.OSImage
 		err        error
 	}{
 		{
@@ -115,9 +111,11 @@ func TestIpxeConfig(t *testing.T) {
 				Host:   "someplace.com",
 				Path:   "/foobar/pxefiles/ipxeconfig",
 			},
-			want: &boot.LinuxImage{
-				Kernel: strings.NewReader(content1),
-				Initrd: strings.NewReader(content2),
+			want: []boot.OSImage{
+				&boot.LinuxImage{
+					Kernel: strings.NewReader(content1),
+					Initrd: strings.NewReader(content2),
+				},
 			},
 		},
 		{
@@ -138,8 +136,10 @@ func TestIpxeConfig(t *testing.T) {
 				Host:   "someplace.com",
 				Path:   "/foobar/pxefiles/ipxeconfig",
 			},
-			want: &boot.LinuxImage{
-				Kernel: strings.NewReader(content1),
+			want: []boot.OSImage{
+				&boot.LinuxImage{
+					Kernel: strings.NewReader(content1),
+				},
 			},
 		},
 		{
@@ -162,8 +162,10 @@ func TestIpxeConfig(t *testing.T) {
 				Host:   "someplace.com",
 				Path:   "/foobar/pxefiles/ipxeconfig",
 			},
-			want: &boot.LinuxImage{
-				Kernel: strings.NewReader(content1),
+			want: []boot.OSImage{
+				&boot.LinuxImage{
+					Kernel: strings.NewReader(content1),
+				},
 			},
 		},
 		{
@@ -183,18 +185,7 @@ func TestIpxeConfig(t *testing.T) {
 				Host:   "someplace.com",
 				Path:   "/foobar/pxefiles/ipxeconfig",
 			},
-			want: &boot.LinuxImage{
-				Kernel: errorReader{&curl.URLError{
-					URL: &url.URL{
-						Scheme: "http",
-						Host:   "someplace.com",
-						Path:   "/foobar/pxefiles/kernel",
-					},
-					Err: curl.ErrNoSuchFile,
-				}},
-				Initrd:  nil,
-				Cmdline: "",
-			},
+			err: curl.ErrNoSuchFile,
 		},
 		{
 			desc: "config file does not exist",
@@ -209,14 +200,7 @@ func TestIpxeConfig(t *testing.T) {
 				Host:   "someplace.com",
 				Path:   "/foobar/pxefiles/ipxeconfig",
 			},
-			err: &curl.URLError{
-				URL: &url.URL{
-					Scheme: "http",
-					Host:   "someplace.com",
-					Path:   "/foobar/pxefiles/ipxeconfig",
-				},
-				Err: curl.ErrNoSuchHost,
-			},
+			err: curl.ErrNoSuchHost,
 		},
 		{
 			desc: "invalid config",
@@ -249,7 +233,7 @@ func TestIpxeConfig(t *testing.T) {
 				Host:   "someplace.com",
 				Path:   "/foobar/pxefiles/ipxeconfig",
 			},
-			want: &boot.LinuxImage{},
+			err: ErrNoImage,
 		},
 		{
 			desc: "valid config with kernel cmdline args",
@@ -269,9 +253,11 @@ func TestIpxeConfig(t *testing.T) {
 				Host:   "someplace.com",
 				Path:   "/foobar/pxefiles/ipxeconfig",
 			},
-			want: &boot.LinuxImage{
-				Kernel:  strings.NewReader(content1),
-				Cmdline: "earlyprintk=ttyS0 printk=ttyS0",
+			want: []boot.OSImage{
+				&boot.LinuxImage{
+					Kernel:  strings.NewReader(content1),
+					Cmdline: "earlyprintk=ttyS0 printk=ttyS0",
+				},
 			},
 		},
 		{
@@ -299,13 +285,15 @@ func TestIpxeConfig(t *testing.T) {
 				Host:   "someplace.com",
 				Path:   "/foobar/pxefiles/ipxeconfig",
 			},
-			want: &boot.LinuxImage{
-				Kernel: strings.NewReader(content1),
-				Initrd: strings.NewReader(content2),
+			want: []boot.OSImage{
+				&boot.LinuxImage{
+					Kernel: strings.NewReader(content1),
+					Initrd: strings.NewReader(content2),
+				},
 			},
 		},
 		{
-			desc: "valid config with unsupported cmds",
+			desc: "valid config with settings",
 			schemeFunc: func() curl.Schemes {
 				s := make(curl.Schemes)
 				fs := curl.NewMockScheme("http")
@@ -325,34 +313,248 @@ func TestIpxeConfig(t *testing.T) {
 				Host:   "someplace.com",
 				Path:   "/foobar/pxefiles/ipxeconfig",
 			},
-			want: &boot.LinuxImage{
-				Kernel: strings.NewReader(content1),
-				Initrd: strings.NewReader(content2),
+			want: []boot.OSImage{
+				&boot.LinuxImage{
+					Kernel: strings.NewReader(content1),
+					Initrd: strings.NewReader(content2),
+				},
 			},
 		},
 	} {
 		t.Run(fmt.Sprintf("Test [%02d] %s", i, tt.desc), func(t *testing.T) {
-			got, err := ParseConfig(context.Background(), ulogtest.Logger{t}, tt.curl, tt.schemeFunc())
-			if !reflect.DeepEqual(err, tt.err) {
-				t.Errorf("ParseConfig() got %v, want %v", err, tt.err)
-				return
+			got, err := ParseConfig(context.Background(), ulogtest.Logger{TB: t}, tt.curl, tt.schemeFunc(), nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ParseConfig() got %v, want %v", err, tt.err)
 			} else if err != nil {
 				return
 			}
-			want := tt.want
+			sameImages(t, got, tt.want)
+		})
+	}
+}
 
-			// Same kernel?
-			if !uio.ReaderAtEqual(got.Kernel, want.Kernel) {
-				t.Errorf("got kernel %s, want %s", mustReadAll(got.Kernel), mustReadAll(want.Kernel))
+// sameImages compares the contents of images, but not their labels, which
+// contain the URLs of files.
+func sameImages(t *testing.T, got, want []boot.OSImage) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d images %v, want %d images %v", len(got), got, len(want), want)
+	}
+	for i := range want {
+		switch w := want[i].(type) {
+		case *boot.LinuxImage:
+			g, ok := got[i].(*boot.LinuxImage)
+			if !ok {
+				t.Errorf("image %d: got %T, want %T", i, got[i], w)
+				continue
+			}
+			if !uio.ReaderAtEqual(g.Kernel, w.Kernel) {
+				t.Errorf("image %d: got kernel %s, want %s", i, mustReadAll(g.Kernel), mustReadAll(w.Kernel))
+			}
+			if !uio.ReaderAtEqual(g.Initrd, w.Initrd) {
+				t.Errorf("image %d: got initrd %s, want %s", i, mustReadAll(g.Initrd), mustReadAll(w.Initrd))
+			}
+			if g.Cmdline != w.Cmdline {
+				t.Errorf("image %d: got cmdline %s, want %s", i, g.Cmdline, w.Cmdline)
+			}
+
+		case *boot.MultibootImage:
+			g, ok := got[i].(*boot.MultibootImage)
+			if !ok {
+				t.Errorf("image %d: got %T, want %T", i, got[i], w)
+				continue
+			}
+			if !uio.ReaderAtEqual(g.Kernel, w.Kernel) {
+				t.Errorf("image %d: got kernel %s, want %s", i, mustReadAll(g.Kernel), mustReadAll(w.Kernel))
+			}
+			if g.Cmdline != w.Cmdline {
+				t.Errorf("image %d: got cmdline %s, want %s", i, g.Cmdline, w.Cmdline)
+			}
+			if len(g.Modules) != len(w.Modules) {
+				t.Errorf("image %d: got %d modules, want %d", i, len(g.Modules), len(w.Modules))
+				continue
 			}
-			// Same initrd?
-			if !uio.ReaderAtEqual(got.Initrd, want.Initrd) {
-				t.Errorf("got initrd %s, want %s", mustReadAll(got.Initrd), mustReadAll(want.Initrd))
+			for j := range w.Modules {
+				if g.Modules[j].Cmdline != w.Modules[j].Cmdline {
+					t.Errorf("image %d: got module cmdline %s, want %s", i, g.Modules[j].Cmdline, w.Modules[j].Cmdline)
+				}
+				if !uio.ReaderAtEqual(g.Modules[j].Module, w.Modules[j].Module) {
+					t.Errorf("image %d: got module %s, want %s", i, mustReadAll(g.Modules[j].Module), mustReadAll(w.Modules[j].Module))
+				}
+			}
+		}
+	}
+}
+
+// multibootKernel returns a kernel with a multiboot header.
+func multibootKernel() string {
+	var b bytes.Buffer
+	const magic = 0x1BADB002
+	binary.Write(&b, binary.LittleEndian, []uint32{magic, 0, -magic & 0xffffffff})
+	b.WriteString("xen")
+	return b.String()
+}
+
+func TestScript(t *testing.T) {
+	fs := curl.NewMockScheme("http")
+	fs.Add("someplace.com", "/boot/kernel", "kernel")
+	fs.Add("someplace.com", "/boot/rescue", "rescue")
+	fs.Add("someplace.com", "/boot/initrd", "initrd")
+	fs.Add("someplace.com", "/boot/ucode", "ucode")
+	fs.Add("someplace.com", "/boot/xen", multibootKernel())
+	fs.Add("someplace.com", "/boot/menu.ipxe", `#!ipxe
+		menu Pick one
+		item rescue Rescue
+		item --default linux Linux
+		choose --timeout 3000 target && goto ${target}
+		:linux
+		kernel kernel quiet
+		initrd ucode
+		initrd initrd
+		boot || goto rescue
+		:rescue
+		imgfree
+		kernel rescue single
+		boot
+	`)
+	s := make(curl.Schemes)
+	s.Register(fs.Scheme, fs)
+
+	vars := map[string]string{
+		"net0/mac": "52:54:00:12:34:56",
+		"netX/mac": "52:54:00:12:34:56",
+		"netX/ip":  "192.168.0.2",
+	}
+
+	for _, tt := range []struct {
+		desc   string
+		script string
+		want   []boot.OSImage
+		err    error
+	}{
+		{
+			desc: "settings and conditions",
+			script: `#!ipxe
+				set base http://someplace.com/boot
+				isset ${net0/mac} || goto nomac
+				iseq ${platform} nosuch && goto wrong ||
+				iseq "${unset}" "" && set extra "a b" ||
+				kernel ${base}/kernel mac=${net0/mac:hexhyp} ip=${ip} ${extra}
+				boot
+				:nomac
+				:wrong
+				exit 1`,
+			want: []boot.OSImage{
+				&boot.LinuxImage{
+					Kernel:  strings.NewReader("kernel"),
+					Cmdline: "mac=52-54-00-12-34-56 ip=192.168.0.2 a b",
+				},
+			},
+		},
+		{
+			desc: "chained script with menu and fallback",
+			script: `#!ipxe
+				chain --autofree boot/menu.ipxe || goto failed
+				:failed
+				exit 1`,
+			want: []boot.OSImage{
+				&boot.LinuxImage{
+					Kernel:  strings.NewReader("kernel"),
+					Initrd:  boot.CatInitrds(strings.NewReader("ucode"), strings.NewReader("initrd")),
+					Cmdline: "quiet",
+				},
+				&boot.LinuxImage{
+					Kernel:  strings.NewReader("rescue"),
+					Cmdline: "single",
+				},
+			},
+		},
+		{
+			desc: "multiboot",
+			script: `#!ipxe
+				kernel boot/xen dom0_mem=1G
+				module boot/kernel console=hvc0
+				module --name ramdisk boot/initrd
+				boot`,
+			want: []boot.OSImage{
+				&boot.MultibootImage{
+					Kernel:  strings.NewReader(multibootKernel()),
+					Cmdline: "dom0_mem=1G",
+					Modules: []multiboot.Module{
+						{
+							Module:  strings.NewReader("kernel"),
+							Cmdline: "kernel console=hvc0",
+						},
+						{
+							Module:  strings.NewReader("initrd"),
+							Cmdline: "ramdisk",
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "retry loop",
+			script: `#!ipxe
+				:retry
+				dhcp || goto retry
+				chain http://someplace.com/boot/kernel || goto retry`,
+			want: []boot.OSImage{
+				&boot.LinuxImage{
+					Kernel: strings.NewReader("kernel"),
+				},
+			},
+		},
+		{
+			desc: "failed download",
+			script: `#!ipxe
+				kernel http://someplace.com/boot/nosuchkernel
+				boot`,
+			err: curl.ErrNoSuchFile,
+		},
+		{
+			desc: "infinite loop",
+			script: `#!ipxe
+				:loop
+				goto loop`,
+			err: ErrNoImage,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			fs.Add("someplace.com", "/script.ipxe", tt.script)
+			u := &url.URL{Scheme: "http", Host: "someplace.com", Path: "/script.ipxe"}
+			got, err := ParseConfig(context.Background(), ulogtest.Logger{TB: t}, u, s, vars)
+			if tt.err == ErrNoImage {
+				if err == nil {
+					t.Fatalf("ParseConfig() = %v, want error", got)
+				}
+				return
 			}
-			// Same cmdline?
-			if got.Cmdline != want.Cmdline {
-				t.Errorf("got cmdline %s, want %s", got.Cmdline, want.Cmdline)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ParseConfig() = %v, want %v", err, tt.err)
 			}
+			sameImages(t, got, tt.want)
 		})
 	}
 }
+
+func TestExpand(t *testing.T) {
+	c := &parser{vars: map[string]string{
+		"netX/mac": "52:54:00:12:34:56",
+		"idx":      "X",
+		"name":     "a b/c",
+	}}
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"${mac}", "52:54:00:12:34:56"},
+		{"${mac:hexraw}", "525400123456"},
+		{"${net${idx}/mac:hexhyp}", "52-54-00-12-34-56"},
+		{"?name=${name:uristring}", "?name=a%20b%2Fc"},
+		{"x${unset}y}", "xy}"},
+	} {
+		if got := c.expand(tt.in); got != tt.want {
+			t.Errorf("expand(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipxe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// errBooted stops the execution of all scripts after an image was booted.
+var errBooted = errors.New("booted")
+
+// Control flow is implemented by returning these errors from commands.
+type (
+	gotoError struct{ label string }
+	exitError struct{ status int }
+)
+
+func (g gotoError) Error() string { return fmt.Sprintf("goto %s outside of a script", g.label) }
+func (e exitError) Error() string { return fmt.Sprintf("exit %d", e.status) }
+
+// runScript executes the iPXE script img, whose contents are config.
+//
+// A script stops at the first failing command that is not followed by ||, as
+// in iPXE.
+func (c *parser) runScript(ctx context.Context, img *image, config string) error {
+	// Relative URIs are relative to the script.
+	c.wd = &url.URL{
+		Scheme: img.url.Scheme,
+		Host:   img.url.Host,
+		Path:   path.Dir(img.url.Path),
+	}
+
+	lines := strings.Split(config, "\n")
+	for i := 0; i < len(lines); i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c.steps++
+		if c.steps > maxSteps {
+			return fmt.Errorf("script did not terminate after %d commands", maxSteps)
+		}
+
+		err := c.runLine(ctx, lines[i])
+		switch e := err.(type) {
+		case nil:
+		case gotoError:
+			j := findLabel(lines, e.label)
+			if j < 0 {
+				return fmt.Errorf("%s: line %d: no such label %q", img.url, i+1, e.label)
+			}
+			i = j
+		case exitError:
+			if e.status != 0 {
+				return e
+			}
+			return nil
+		default:
+			if err == errBooted || ctx.Err() != nil {
+				return err
+			}
+			return fmt.Errorf("%s: line %d: %w", img.url, i+1, err)
+		}
+	}
+	return nil
+}
+
+// findLabel returns the index of the line defining label, or -1.
+func findLabel(lines []string, label string) int {
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, ":") && strings.TrimSpace(line[1:]) == label {
+			return i
+		}
+	}
+	return -1
+}
+
+// runLine executes a line of commands separated by || and &&.
+//
+// As in iPXE, settings are expanded right before each command is executed,
+// so that e.g. "choose target && goto ${target}" works.
+func (c *parser) runLine(ctx context.Context, line string) error {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' || line[0] == ':' {
+		return nil
+	}
+
+	cmds, err := splitCommands(line)
+	if err != nil {
+		return err
+	}
+
+	process := true
+	var lastErr error
+	for _, cmd := range cmds {
+		if process {
+			args, err := splitArgs(c.expand(cmd.text))
+			if err != nil {
+				return err
+			}
+			c.orElse = cmd.sep == "||"
+			lastErr = c.runCommand(ctx, args)
+			c.orElse = false
+			switch lastErr.(type) {
+			case gotoError, exitError:
+				return lastErr
+			}
+			if lastErr == errBooted || ctx.Err() != nil {
+				return lastErr
+			}
+			if lastErr != nil {
+				c.log.Printf("iPXE: %s: %v", strings.Join(args, " "), lastErr)
+			}
+		}
+		switch cmd.sep {
+		case "||":
+			process = lastErr != nil
+		case "&&":
+			process = lastErr == nil
+		}
+	}
+	return lastErr
+}
+
+// runCommand executes a single command. An empty command succeeds, so that
+// lines can end with ||.
+func (c *parser) runCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("%s: command not found", args[0])
+	}
+	return cmd(ctx, c, args[1:])
+}
+
+// separated is a command of a command line, and the separator following it.
+type separated struct {
+	text string
+	sep  string
+}
+
+// splitCommands splits a command line at unquoted || and && separators.
+func splitCommands(line string) ([]separated, error) {
+	var cmds []separated
+	cmdStart := 0
+	for i := 0; i < len(line); {
+		// Skip whitespace.
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		tokStart := i
+
+		// Find the end of the token.
+		var quote byte
+		for ; i < len(line) && (quote != 0 || !isSpace(line[i])); i++ {
+			switch ch := line[i]; {
+			case quote != 0 && ch == quote:
+				quote = 0
+			case quote == 0 && (ch == '"' || ch == '\''):
+				quote = ch
+			case ch == '\\' && quote != '\'':
+				i++
+			}
+		}
+		if quote != 0 {
+			return nil, fmt.Errorf("unterminated quote %c", quote)
+		}
+		if i > len(line) {
+			i = len(line)
+		}
+
+		if tok := line[tokStart:i]; tok == "||" || tok == "&&" {
+			cmds = append(cmds, separated{text: line[cmdStart:tokStart], sep: tok})
+			cmdStart = i
+		}
+	}
+	return append(cmds, separated{text: line[cmdStart:]}), nil
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\r'
+}
+
+// splitArgs splits a command into arguments at whitespace, and removes
+// quotes and escapes. Whitespace can be quoted with double or single quotes,
+// or escaped with a backslash.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	started := false
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case quote != 0 && ch == quote:
+			quote = 0
+		case quote == 0 && (ch == '"' || ch == '\''):
+			quote = ch
+			started = true
+		case ch == '\\' && quote != '\'' && i+1 < len(line):
+			i++
+			cur.WriteByte(line[i])
+			started = true
+		case quote == 0 && isSpace(ch):
+			if started {
+				args = append(args, cur.String())
+				cur.Reset()
+				started = false
+			}
+		default:
+			cur.WriteByte(ch)
+			started = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote %c", quote)
+	}
+	if started {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// expand expands settings of the form ${name} or ${name:type} in s.
+//
+// As in iPXE, the innermost expansion is done first, so that setting names
+// can themselves be expanded, e.g. ${net${idx}/mac}.
+func (c *parser) expand(s string) string {
+	for {
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return s
+		}
+		start := strings.LastIndex(s[:end], "${")
+		if start < 0 {
+			// A stray }; expand anything after it.
+			return s[:end+1] + c.expand(s[end+1:])
+		}
+		s = s[:start] + c.lookup(s[start+2:end]) + s[end+1:]
+	}
+}
+
+// lookup returns the value of the setting name, which may carry a type
+// suffix that determines its format.
+func (c *parser) lookup(name string) string {
+	typ := ""
+	if i := strings.LastIndexByte(name, ':'); i >= 0 {
+		name, typ = name[:i], name[i+1:]
+	}
+	v, ok := c.vars[name]
+	if !ok && !strings.Contains(name, "/") {
+		// Unscoped settings may be found on any network device.
+		v = c.vars["netX/"+name]
+	}
+	return formatValue(v, typ)
+}
+
+// formatValue formats v according to an iPXE setting type.
+func formatValue(v, typ string) string {
+	switch typ {
+	case "hexhyp":
+		return strings.Replace(v, ":", "-", -1)
+	case "hexraw":
+		return strings.Replace(v, ":", "", -1)
+	case "uristring":
+		var s strings.Builder
+		for i := 0; i < len(v); i++ {
+			ch := v[i]
+			if 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9' || strings.IndexByte("-_.~", ch) >= 0 {
+				s.WriteByte(ch)
+			} else {
+				fmt.Fprintf(&s, "%%%02X", ch)
+			}
+		}
+		return s.String()
+	}
+	return v
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipxe
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/dhclient"
+)
+
+// buildArchs maps GOARCH to iPXE's ${buildarch}.
+var buildArchs = map[string]string{
+	"386":   "i386",
+	"amd64": "x86_64",
+	"arm":   "arm32",
+	"arm64": "arm64",
+}
+
+// defaultVars returns the settings iPXE has built in.
+func defaultVars() map[string]string {
+	vars := map[string]string{
+		"buildarch": buildArchs[runtime.GOARCH],
+		"platform":  "pcbios",
+	}
+	if _, err := os.Stat("/sys/firmware/efi"); err == nil {
+		vars["platform"] = "efi"
+	}
+	return vars
+}
+
+// LeaseVars returns the iPXE settings that iPXE's dhcp command would have
+// set for lease, e.g. ${net0/ip}, ${net0/mac} or ${filename}.
+//
+// Settings are returned for the net0 and netX (the most recently opened
+// interface) scopes. Unscoped settings like ${ip} are looked up in netX.
+func LeaseVars(lease dhclient.Lease) map[string]string {
+	s := make(map[string]string)
+	if l := lease.Link(); l != nil && l.Attrs() != nil && len(l.Attrs().HardwareAddr) > 0 {
+		s["mac"] = l.Attrs().HardwareAddr.String()
+	}
+
+	p4, p6 := lease.Message()
+	if p4 != nil {
+		s["ip"] = p4.YourIPAddr.String()
+		if mask := p4.SubnetMask(); mask != nil {
+			s["netmask"] = net.IP(mask).String()
+		}
+		if r := p4.Router(); len(r) > 0 {
+			s["gateway"] = r[0].String()
+		}
+		if dns := p4.DNS(); len(dns) > 0 {
+			s["dns"] = dns[0].String()
+		}
+		s["domain"] = p4.DomainName()
+		s["hostname"] = p4.HostName()
+		s["root-path"] = p4.RootPath()
+		if ip := p4.ServerIPAddr; ip != nil && !ip.IsUnspecified() {
+			s["next-server"] = ip.String()
+		}
+		filename := strings.TrimRight(p4.BootFileNameOption(), "\x00")
+		if len(filename) == 0 {
+			filename = p4.BootFileName
+		}
+		s["filename"] = filename
+	}
+	if p6 != nil {
+		if dns := p6.Options.DNS(); len(dns) > 0 {
+			s["dns6"] = dns[0].String()
+		}
+		s["filename"] = p6.Options.BootFileURL()
+	}
+	if l, ok := lease.(*dhclient.Packet6); ok {
+		if addr := l.Lease(); addr != nil {
+			s["ip6"] = addr.IPv6Addr.String()
+		}
+	}
+
+	vars := make(map[string]string)
+	for k, v := range s {
+		if len(v) == 0 {
+			continue
+		}
+		vars["net0/"+k] = v
+		vars["netX/"+k] = v
+	}
+	return vars
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipxe
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/u-root/u-root/pkg/dhclient"
+	"github.com/vishvananda/netlink"
+)
+
+func TestLeaseVars(t *testing.T) {
+	mac := net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0", HardwareAddr: mac}}
+	p, err := dhcpv4.New(
+		dhcpv4.WithYourIP(net.IP{192, 168, 0, 2}),
+		dhcpv4.WithServerIP(net.IP{192, 168, 0, 1}),
+		dhcpv4.WithNetmask(net.IPv4Mask(255, 255, 255, 0)),
+		dhcpv4.WithRouter(net.IP{192, 168, 0, 254}),
+		dhcpv4.WithOption(dhcpv4.OptBootFileName("boot.ipxe")),
+		dhcpv4.WithOption(dhcpv4.OptHostName("node1")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars := LeaseVars(dhclient.NewPacket4(link, p))
+	for k, want := range map[string]string{
+		"net0/mac":         "52:54:00:12:34:56",
+		"net0/ip":          "192.168.0.2",
+		"netX/ip":          "192.168.0.2",
+		"net0/netmask":     "255.255.255.0",
+		"net0/gateway":     "192.168.0.254",
+		"net0/next-server": "192.168.0.1",
+		"net0/filename":    "boot.ipxe",
+		"net0/hostname":    "node1",
+	} {
+		if got := vars[k]; got != want {
+			t.Errorf("LeaseVars()[%q] = %q, want %q", k, got, want)
+		}
+	}
+	if _, ok := vars["net0/domain"]; ok {
+		t.Errorf("LeaseVars() sets empty setting net0/domain")
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netboot
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot/ibft"
+	"github.com/u-root/u-root/pkg/dhclient"
+	"github.com/u-root/u-root/pkg/iscsi"
+	"github.com/u-root/u-root/pkg/mount/block"
+	"github.com/u-root/u-root/pkg/mount/nbd"
+	"github.com/u-root/u-root/pkg/ulog"
+)
+
+// ISCSIDisk is the logical unit of an iSCSI target, attached to a network
+// block device.
+type ISCSIDisk struct {
+	// Devices are the network block device and its partitions.
+	Devices block.BlockDevices
+
+	// IBFT describes the target and the interface it is reached by. Pass
+	// it on to the kernel, so that it can use the target as well.
+	IBFT *ibft.IBFT
+
+	unit *iscsi.LUN
+	dev  *nbd.Device
+}
+
+// AttachISCSI logs into the iSCSI target that lease says to boot from, and
+// attaches its logical unit lun to network block device nbdDev, or an unused
+// one if it is empty.
+//
+// c supplies the initiator name and credentials; the target is taken from
+// the lease. The disk stays attached until it is closed.
+func AttachISCSI(ctx context.Context, l ulog.Logger, lease dhclient.Lease, c iscsi.Config, lun uint64, nbdDev string) (*ISCSIDisk, error) {
+	target, volume, err := lease.ISCSIBoot()
+	if err != nil {
+		return nil, err
+	}
+	c.Target, c.TargetName = target, volume
+	l.Printf("iSCSI target: %s at %s", volume, target)
+
+	s, err := iscsi.Dial(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	unit, err := s.OpenLUN(ctx, lun)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	if nbdDev == "" {
+		if nbdDev, err = nbd.FindDevice(); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	dev, err := nbd.Attach(nbdDev, unit, unit.Size(), unit.BlockSize())
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	l.Printf("%s is %s", unit, dev.Dev)
+	d := &ISCSIDisk{
+		IBFT: unit.IBFT(leaseNIC(lease)),
+		unit: unit,
+		dev:  dev,
+	}
+
+	name := filepath.Base(dev.Dev)
+	if bd, err := block.Device(name); err == nil {
+		if err := bd.ReadPartitionTable(); err != nil {
+			l.Printf("Reading partitions of %s: %v", dev.Dev, err)
+		}
+	}
+	devices, err := block.GetBlockDevices()
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	for _, bd := range devices {
+		if bd.Name == name || strings.HasPrefix(bd.Name, name+"p") {
+			d.Devices = append(d.Devices, bd)
+		}
+	}
+	return d, nil
+}
+
+func (d *ISCSIDisk) String() string {
+	return fmt.Sprintf("%s on %s", d.unit, d.dev.Dev)
+}
+
+// Close detaches the network block device, which must not be mounted, and
+// logs out of the target.
+func (d *ISCSIDisk) Close() error {
+	err := d.dev.Detach()
+	if cerr := d.unit.Session().Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// leaseNIC returns the iBFT description of the interface configured by lease.
+func leaseNIC(lease dhclient.Lease) ibft.NIC {
+	nic := ibft.NIC{
+		Global:     true,
+		Origin:     ibft.OriginDHCP,
+		MACAddress: lease.Link().Attrs().HardwareAddr,
+	}
+	switch p := lease.(type) {
+	case *dhclient.Packet4:
+		m, _ := p.Message()
+		nic.IPNet = p.Lease()
+		if r := m.Router(); len(r) > 0 {
+			nic.Gateway = r[0]
+		}
+		if dns := m.DNS(); len(dns) > 0 {
+			nic.PrimaryDNS = dns[0]
+			if len(dns) > 1 {
+				nic.SecondaryDNS = dns[1]
+			}
+		}
+		nic.DHCPServer = m.ServerIdentifier()
+		nic.HostName = m.HostName()
+
+	case *dhclient.Packet6:
+		if a := p.Lease(); a != nil {
+			nic.IPNet = &net.IPNet{IP: a.IPv6Addr, Mask: net.CIDRMask(128, 128)}
+		}
+		if dns := p.DNS(); len(dns) > 0 {
+			nic.PrimaryDNS = dns[0]
+			if len(dns) > 1 {
+				nic.SecondaryDNS = dns[1]
+			}
+		}
+	}
+	return nic
+}
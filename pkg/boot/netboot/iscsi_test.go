@@ -0,0 +1,52 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netboot
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/u-root/u-root/pkg/boot/ibft"
+	"github.com/u-root/u-root/pkg/dhclient"
+	"github.com/vishvananda/netlink"
+)
+
+func TestLeaseNIC(t *testing.T) {
+	mac := net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0", HardwareAddr: mac}}
+	m, err := dhcpv4.New(
+		dhcpv4.WithYourIP(net.IP{192, 168, 0, 10}),
+		dhcpv4.WithNetmask(net.CIDRMask(24, 32)),
+		dhcpv4.WithRouter(net.IP{192, 168, 0, 1}),
+		dhcpv4.WithDNS(net.IP{192, 168, 0, 2}, net.IP{192, 168, 0, 3}),
+		dhcpv4.WithServerIP(net.IP{192, 168, 0, 4}),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IP{192, 168, 0, 4})),
+		dhcpv4.WithOption(dhcpv4.OptHostName("client")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := leaseNIC(dhclient.NewPacket4(link, m))
+	want := ibft.NIC{
+		Global: true,
+		Origin: ibft.OriginDHCP,
+		IPNet: &net.IPNet{
+			IP:   net.IP{192, 168, 0, 10},
+			Mask: net.CIDRMask(24, 32),
+		},
+		Gateway:      net.IP{192, 168, 0, 1},
+		PrimaryDNS:   net.IP{192, 168, 0, 2},
+		SecondaryDNS: net.IP{192, 168, 0, 3},
+		DHCPServer:   net.IP{192, 168, 0, 4},
+		MACAddress:   mac,
+		HostName:     "client",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("leaseNIC() = %+v, want %+v", got, want)
+	}
+}
@@ -5,12 +5,10 @@
 // Package netboot provides a one-stop shop for netboot parsing needs.
 //
 // netboot can take a URL from a DHCP lease and try to detect iPXE scripts and
-// PXE scripts.
+// PXE scripts, or kernels and images that are booted without configuration,
+// as UEFI HTTP Boot clients do.
 //
-// TODO: detect multiboot and Linux kernels without configuration (URL points
-// to a single kernel file).
-//
-// TODO: detect iSCSI root paths.
+// iSCSI root paths are attached as block devices by AttachISCSI.
 package netboot
 
 import (
@@ -18,6 +16,7 @@ import (
 	"net"
 	"net/url"
 	"path"
+	"strings"
 
 	"github.com/u-root/u-root/pkg/boot"
 	"github.com/u-root/u-root/pkg/boot/netboot/ipxe"
@@ -27,22 +26,46 @@ import (
 	"github.com/u-root/u-root/pkg/ulog"
 )
 
+// Config configures how BootImagesWithConfig and BootURIImages boot files.
+type Config struct {
+	// BootBallRoots are the PEM-encoded root certificates that the
+	// signatures of bootballs are checked against. Without them, bootballs
+	// are not booted.
+	BootBallRoots []byte
+}
+
 // BootImages figure out a ranked order of images to boot from the given DHCP lease.
 //
 // Tries, in order:
 //
-// - to detect an iPXE script beginning with #!ipxe,
+// - to detect a Linux or multiboot kernel, a unified kernel image, an ISO
+//   image or cpio archive with boot configurations, or a signed bootball,
+//   which are booted without a configuration file in the middle. Kernels are
+//   booted with the DHCPv6 boot file parameters as command line,
+//
+// - to detect an iPXE script beginning with #!ipxe, which is executed with
+//   settings from the lease,
 //
 // - to detect a pxelinux.0, in which case we will ignore the pxelinux.0 and
 //   try to parse pxelinux.cfg/<files>.
 //
-// TODO: detect straight up multiboot and bzImage Linux kernel files rather
-// than just configuration scripts.
+// Bootballs are not booted; see BootImagesWithConfig.
 func BootImages(ctx context.Context, l ulog.Logger, s curl.Schemes, lease dhclient.Lease) ([]boot.OSImage, error) {
+	return BootImagesWithConfig(ctx, l, s, lease, Config{})
+}
+
+// BootImagesWithConfig is like BootImages, but boots files as configured by c.
+func BootImagesWithConfig(ctx context.Context, l ulog.Logger, s curl.Schemes, lease dhclient.Lease, c Config) ([]boot.OSImage, error) {
 	uri, err := lease.Boot()
 	if err != nil {
 		return nil, err
 	}
+	return BootURIImages(ctx, l, s, uri, lease, c), nil
+}
+
+// BootURIImages is like BootImages, but uses uri instead of the boot URI of
+// the lease, e.g. the URI of a UEFI HTTP boot entry.
+func BootURIImages(ctx context.Context, l ulog.Logger, s curl.Schemes, uri *url.URL, lease dhclient.Lease, c Config) []boot.OSImage {
 	l.Printf("Boot URI: %s", uri)
 
 	// IP only makes sense for v4 anyway, because the PXE probing of files
@@ -51,22 +74,37 @@ func BootImages(ctx context.Context, l ulog.Logger, s curl.Schemes, lease dhclie
 	if p4, ok := lease.(*dhclient.Packet4); ok {
 		ip = p4.Lease().IP
 	}
-	return getBootImages(ctx, l, s, uri, lease.Link().Attrs().HardwareAddr, ip), nil
-}
 
-// getBootImages attempts to parse the file at uri as an ipxe config and returns
-// the ipxe boot image. Otherwise falls back to pxe and uses the uri directory,
-// ip, and mac address to search for pxe configs.
-func getBootImages(ctx context.Context, l ulog.Logger, schemes curl.Schemes, uri *url.URL, mac net.HardwareAddr, ip net.IP) []boot.OSImage {
-	var images []boot.OSImage
-
-	// Attempt to read the given boot path as an ipxe config file.
-	ipc, err := ipxe.ParseConfig(ctx, l, uri, schemes)
+	var cmdline string
+	if _, p6 := lease.Message(); p6 != nil {
+		cmdline = strings.Join(p6.Options.BootFileParam(), " ")
+	}
+	f, err := s.Fetch(ctx, uri)
 	if err != nil {
-		l.Printf("Parsing boot files as iPXE failed, trying other formats...: %v", err)
+		l.Printf("Fetching %s failed, trying configuration formats...: %v", uri, err)
+	} else if imgs, err := fileImages(l, f, cmdline, c); err == nil {
+		return imgs
+	} else if err != errUnknownFormat {
+		l.Printf("Booting %s failed, trying configuration formats...: %v", uri, err)
 	}
-	if ipc != nil {
-		images = append(images, ipc)
+	return getBootImages(ctx, l, s, uri, f, lease.Link().Attrs().HardwareAddr, ip, ipxe.LeaseVars(lease))
+}
+
+// getBootImages attempts to execute f, the file at uri, as an ipxe script,
+// with settings ipxeVars, and returns the images it boots. Otherwise falls
+// back to pxe and uses the uri directory, ip, and mac address to search for
+// pxe configs.
+//
+// f is nil if the file at uri could not be fetched.
+func getBootImages(ctx context.Context, l ulog.Logger, schemes curl.Schemes, uri *url.URL, f curl.File, mac net.HardwareAddr, ip net.IP, ipxeVars map[string]string) []boot.OSImage {
+	// Attempt to read the given boot path as an ipxe config file.
+	var images []boot.OSImage
+	if f != nil {
+		var err error
+		images, err = ipxe.ParseFile(ctx, l, f, schemes, ipxeVars)
+		if err != nil {
+			l.Printf("Parsing boot files as iPXE failed, trying other formats...: %v", err)
+		}
 	}
 
 	// Fallback to pxe boot.
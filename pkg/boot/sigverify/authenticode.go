@@ -0,0 +1,355 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sigverify
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	// Register the hashes Authenticode signatures use.
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// ErrUnsigned is returned when a PE file has no Authenticode signature.
+var ErrUnsigned = errors.New("no Authenticode signature")
+
+var (
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSpcIndirectData = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+
+	// SHA-1 is not accepted.
+	hashOIDs = map[string]crypto.Hash{
+		"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+		"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+		"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+	}
+)
+
+// WIN_CERTIFICATE values, from the PE format specification.
+const (
+	winCertRevision           = 0x0200
+	winCertTypePKCSSignedData = 0x0002
+)
+
+// peImage is a PE file, with the locations of the parts excluded from its
+// Authenticode digest.
+type peImage struct {
+	b []byte
+
+	checksumOff int
+	certDirOff  int
+	certOff     int
+	certSize    int
+}
+
+func parsePE(b []byte) (*peImage, error) {
+	le := binary.LittleEndian
+	if len(b) < 0x40 || !bytes.HasPrefix(b, []byte("MZ")) {
+		return nil, errors.New("not a PE file")
+	}
+	pe := int(le.Uint32(b[0x3c:]))
+	if pe < 0 || pe+24 > len(b) || !bytes.Equal(b[pe:pe+4], []byte("PE\x00\x00")) {
+		return nil, errors.New("not a PE file")
+	}
+	optSize := int(le.Uint16(b[pe+20:]))
+	opt := pe + 24
+	if opt+optSize > len(b) || optSize < 2 {
+		return nil, errors.New("PE optional header out of bounds")
+	}
+
+	// Offsets of NumberOfRvaAndSizes and the data directories.
+	var numOff, dirOff int
+	switch magic := le.Uint16(b[opt:]); magic {
+	case 0x10b: // PE32
+		numOff, dirOff = 92, 96
+	case 0x20b: // PE32+
+		numOff, dirOff = 108, 112
+	default:
+		return nil, fmt.Errorf("unknown PE optional header magic %#x", magic)
+	}
+	if optSize < dirOff {
+		return nil, errors.New("PE optional header too short")
+	}
+
+	img := &peImage{
+		b:           b,
+		checksumOff: opt + 64,
+		// The certificate table is data directory 4.
+		certDirOff: opt + dirOff + 4*8,
+	}
+	if le.Uint32(b[opt+numOff:]) <= 4 || img.certDirOff+8 > opt+optSize {
+		return nil, ErrUnsigned
+	}
+	img.certOff = int(le.Uint32(b[img.certDirOff:]))
+	img.certSize = int(le.Uint32(b[img.certDirOff+4:]))
+	if img.certSize == 0 {
+		return nil, ErrUnsigned
+	}
+	if img.certOff < img.certDirOff+8 || img.certOff+img.certSize != len(b) {
+		return nil, errors.New("PE certificate table must be at the end of the file")
+	}
+	return img, nil
+}
+
+// digest returns the Authenticode digest of the file, which covers all of it
+// but the checksum, the certificate table and its data directory entry.
+func (img *peImage) digest(h crypto.Hash) []byte {
+	d := h.New()
+	d.Write(img.b[:img.checksumOff])
+	d.Write(img.b[img.checksumOff+4 : img.certDirOff])
+	d.Write(img.b[img.certDirOff+8 : img.certOff])
+	return d.Sum(nil)
+}
+
+// signatures returns the PKCS#7 signatures in the certificate table.
+func (img *peImage) signatures() [][]byte {
+	le := binary.LittleEndian
+	var sigs [][]byte
+	table := img.b[img.certOff:]
+	for len(table) >= 8 {
+		length := int(le.Uint32(table))
+		if length < 8 || length > len(table) {
+			break
+		}
+		if le.Uint16(table[4:]) == winCertRevision && le.Uint16(table[6:]) == winCertTypePKCSSignedData {
+			sigs = append(sigs, table[8:length])
+		}
+		// Entries are 8 byte aligned.
+		length = (length + 7) &^ 7
+		if length > len(table) {
+			break
+		}
+		table = table[length:]
+	}
+	return sigs
+}
+
+// VerifyAuthenticode checks that the PE file b has an Authenticode signature
+// of a certificate that chains to one of roots. It returns ErrUnsigned if b
+// has no signature at all.
+//
+// Like UEFI firmware, certificate expiry is not checked: the chain is
+// verified as of the time the signing certificate became valid.
+func VerifyAuthenticode(b []byte, roots *x509.CertPool) error {
+	img, err := parsePE(b)
+	if err != nil {
+		return err
+	}
+	sigs := img.signatures()
+	if len(sigs) == 0 {
+		return ErrUnsigned
+	}
+	for _, sig := range sigs {
+		if err = verifySignedData(img, sig, roots); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// PKCS#7 structures, as defined in RFC 2315, with Authenticode content.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerial           issuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type spcIndirectDataContent struct {
+	Data          asn1.RawValue
+	MessageDigest digestInfo
+}
+
+type digestInfo struct {
+	DigestAlgorithm pkix.AlgorithmIdentifier
+	Digest          []byte
+}
+
+func verifySignedData(img *peImage, der []byte, roots *x509.CertPool) error {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return fmt.Errorf("parsing PKCS#7: %v", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return fmt.Errorf("PKCS#7 content type %v is not signed data", ci.ContentType)
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return fmt.Errorf("parsing PKCS#7 signed data: %v", err)
+	}
+	if !sd.ContentInfo.ContentType.Equal(oidSpcIndirectData) {
+		return fmt.Errorf("signed content type %v is not Authenticode", sd.ContentInfo.ContentType)
+	}
+	if len(sd.SignerInfos) != 1 {
+		return fmt.Errorf("want 1 signer, got %d", len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+
+	// The signed content holds the digest of the PE file.
+	var content asn1.RawValue
+	if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &content); err != nil {
+		return fmt.Errorf("parsing Authenticode content: %v", err)
+	}
+	var idc spcIndirectDataContent
+	if _, err := asn1.Unmarshal(content.FullBytes, &idc); err != nil {
+		return fmt.Errorf("parsing Authenticode content: %v", err)
+	}
+	h, ok := hashOIDs[idc.MessageDigest.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return fmt.Errorf("unsupported digest algorithm %v", idc.MessageDigest.DigestAlgorithm.Algorithm)
+	}
+	if !bytes.Equal(img.digest(h), idc.MessageDigest.Digest) {
+		return errors.New("PE digest does not match signature")
+	}
+
+	// The signer signs the attributes, which hold the digest of the
+	// content, excluding its tag and length.
+	sh, ok := hashOIDs[si.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return fmt.Errorf("unsupported digest algorithm %v", si.DigestAlgorithm.Algorithm)
+	}
+	if len(si.AuthenticatedAttributes.FullBytes) == 0 {
+		return errors.New("signer has no authenticated attributes")
+	}
+	// The attributes are signed as a SET, not with their implicit tag.
+	signed := append([]byte{}, si.AuthenticatedAttributes.FullBytes...)
+	signed[0] = 0x31
+	var attrs []attribute
+	if _, err := asn1.UnmarshalWithParams(signed, &attrs, "set"); err != nil {
+		return fmt.Errorf("parsing authenticated attributes: %v", err)
+	}
+	if err := checkAttributes(attrs, sh, content.Bytes); err != nil {
+		return err
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return fmt.Errorf("parsing certificates: %v", err)
+	}
+	signer := findSigner(certs, si.IssuerAndSerial)
+	if signer == nil {
+		return errors.New("signing certificate not included in signature")
+	}
+	algo, err := signatureAlgorithm(signer, sh)
+	if err != nil {
+		return err
+	}
+	if err := signer.CheckSignature(algo, signed, si.EncryptedDigest); err != nil {
+		return fmt.Errorf("signature of %q: %v", signer.Subject, err)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs {
+		intermediates.AddCert(c)
+	}
+	if _, err := signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   signer.NotBefore,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return fmt.Errorf("certificate %q is not trusted: %v", signer.Subject, err)
+	}
+	return nil
+}
+
+// checkAttributes checks that the authenticated attributes contain the
+// Authenticode content type and digest of content.
+func checkAttributes(attrs []attribute, h crypto.Hash, content []byte) error {
+	var contentType, digest bool
+	for _, a := range attrs {
+		if len(a.Values) != 1 {
+			continue
+		}
+		switch {
+		case a.Type.Equal(oidContentType):
+			var oid asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(a.Values[0].FullBytes, &oid); err != nil || !oid.Equal(oidSpcIndirectData) {
+				return errors.New("signed content type is not Authenticode")
+			}
+			contentType = true
+		case a.Type.Equal(oidMessageDigest):
+			var d []byte
+			if _, err := asn1.Unmarshal(a.Values[0].FullBytes, &d); err != nil {
+				return fmt.Errorf("parsing message digest: %v", err)
+			}
+			sum := h.New()
+			sum.Write(content)
+			if !bytes.Equal(sum.Sum(nil), d) {
+				return errors.New("signed digest does not match content")
+			}
+			digest = true
+		}
+	}
+	if !contentType || !digest {
+		return errors.New("missing content type or message digest attribute")
+	}
+	return nil
+}
+
+func findSigner(certs []*x509.Certificate, is issuerAndSerial) *x509.Certificate {
+	for _, c := range certs {
+		if bytes.Equal(c.RawIssuer, is.Issuer.FullBytes) && c.SerialNumber.Cmp(is.Serial) == 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+func signatureAlgorithm(c *x509.Certificate, h crypto.Hash) (x509.SignatureAlgorithm, error) {
+	algos := map[x509.PublicKeyAlgorithm]map[crypto.Hash]x509.SignatureAlgorithm{
+		x509.RSA: {
+			crypto.SHA256: x509.SHA256WithRSA,
+			crypto.SHA384: x509.SHA384WithRSA,
+			crypto.SHA512: x509.SHA512WithRSA,
+		},
+		x509.ECDSA: {
+			crypto.SHA256: x509.ECDSAWithSHA256,
+			crypto.SHA384: x509.ECDSAWithSHA384,
+			crypto.SHA512: x509.ECDSAWithSHA512,
+		},
+	}
+	if a, ok := algos[c.PublicKeyAlgorithm][h]; ok {
+		return a, nil
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported signature algorithm %v with %v", c.PublicKeyAlgorithm, h)
+}
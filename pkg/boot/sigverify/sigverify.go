@@ -0,0 +1,196 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sigverify checks the signatures of kernels and initrds before they
+// are loaded.
+//
+// Kernels with an EFI stub may be signed with Authenticode, as for UEFI Secure
+// Boot. Any kernel and initrd may instead have a detached OpenPGP signature,
+// as GRUB's check_signatures uses, in a file next to it with ".sig" appended
+// to its name.
+//
+// Use it with boot.Verify:
+//
+//	v, err := sigverify.New("/etc/boot/db.pem", "/etc/boot/pubring.gpg")
+//	...
+//	images = boot.Verify(v, images...)
+package sigverify
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/curl"
+	"github.com/u-root/u-root/pkg/uio"
+	"golang.org/x/crypto/openpgp"
+)
+
+// ErrNoSignature is returned when the detached signature of a file cannot be
+// located.
+var ErrNoSignature = errors.New("no detached signature")
+
+// Verifier is a boot.Verifier that checks Authenticode and detached OpenPGP
+// signatures. Images are only accepted if all their parts are signed by one
+// of the trusted certificates or keys.
+type Verifier struct {
+	// Certs are trusted for Authenticode signatures of kernels. If nil,
+	// Authenticode signatures are not accepted.
+	Certs *x509.CertPool
+
+	// Keyring is trusted for detached signatures. If nil, detached
+	// signatures are not accepted.
+	Keyring openpgp.KeyRing
+
+	// UnsignedInitrd accepts initrds without a signature if the kernel
+	// has a valid Authenticode signature, as UEFI Secure Boot does.
+	UnsignedInitrd bool
+
+	// Signature returns the detached signature of the original kernel or
+	// initrd. If nil, DetachedSignature is used.
+	Signature func(r io.ReaderAt) (io.Reader, error)
+}
+
+var _ boot.Verifier = &Verifier{}
+
+// New returns a Verifier trusting the PEM encoded certificates in certsFile
+// and the OpenPGP keyring in keyringFile, which may be armored. Either may be
+// empty.
+func New(certsFile, keyringFile string) (*Verifier, error) {
+	v := &Verifier{}
+	if certsFile != "" {
+		b, err := ioutil.ReadFile(certsFile)
+		if err != nil {
+			return nil, err
+		}
+		v.Certs = x509.NewCertPool()
+		if !v.Certs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%s: no PEM certificates", certsFile)
+		}
+	}
+	if keyringFile != "" {
+		b, err := ioutil.ReadFile(keyringFile)
+		if err != nil {
+			return nil, err
+		}
+		keyring, err := readKeyRing(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", keyringFile, err)
+		}
+		v.Keyring = keyring
+	}
+	if v.Certs == nil && v.Keyring == nil {
+		return nil, errors.New("no certificates or keys to trust")
+	}
+	return v, nil
+}
+
+func readKeyRing(b []byte) (openpgp.EntityList, error) {
+	if isArmored(b) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(b))
+}
+
+func isArmored(b []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN PGP"))
+}
+
+// Verify implements boot.Verifier.Verify.
+func (v *Verifier) Verify(li *boot.LinuxImage, kernel, initrd io.ReaderAt) error {
+	k, err := uio.ReadAll(kernel)
+	if err != nil {
+		return err
+	}
+
+	var authErr error = errors.New("Authenticode signatures are not trusted")
+	if v.Certs != nil {
+		authErr = VerifyAuthenticode(k, v.Certs)
+	}
+	authenticode := authErr == nil
+	if !authenticode {
+		if err := v.verifyDetached(li.Kernel, bytes.NewReader(k)); err != nil {
+			return fmt.Errorf("kernel: %w (%v)", err, authErr)
+		}
+	}
+
+	if initrd == nil || (authenticode && v.UnsignedInitrd) {
+		return nil
+	}
+	if err := v.verifyDetached(li.Initrd, uio.Reader(initrd)); err != nil {
+		return fmt.Errorf("initrd: %w", err)
+	}
+	return nil
+}
+
+// verifyDetached checks the detached signature of orig over content.
+func (v *Verifier) verifyDetached(orig io.ReaderAt, content io.Reader) error {
+	if v.Keyring == nil {
+		return errors.New("detached signatures are not trusted")
+	}
+	signature := v.Signature
+	if signature == nil {
+		signature = DetachedSignature
+	}
+	sr, err := signature(orig)
+	if err != nil {
+		return err
+	}
+	if c, ok := sr.(io.Closer); ok {
+		defer c.Close()
+	}
+	sig, err := ioutil.ReadAll(sr)
+	if err != nil {
+		return err
+	}
+	if isArmored(sig) {
+		_, err = openpgp.CheckArmoredDetachedSignature(v.Keyring, content, bytes.NewReader(sig))
+	} else {
+		_, err = openpgp.CheckDetachedSignature(v.Keyring, content, bytes.NewReader(sig))
+	}
+	return err
+}
+
+// DetachedSignature returns the detached signature of r, the file with ".sig"
+// appended to its name. Local files and files fetched with curl are
+// supported.
+func DetachedSignature(r io.ReaderAt) (io.Reader, error) {
+	switch f := r.(type) {
+	case *os.File:
+		return os.Open(f.Name() + ".sig")
+
+	case curl.File:
+		u := *f.URL()
+		u.Path += ".sig"
+		return fetch(&u)
+
+	case fmt.Stringer:
+		// uio.NewLazyFile and curl.LazyFetch name files by path or
+		// URL.
+		name := f.String()
+		if u, err := url.Parse(name); err == nil && u.Scheme != "" {
+			u.Path += ".sig"
+			return fetch(u)
+		}
+		if _, err := os.Stat(name); err == nil {
+			return os.Open(name + ".sig")
+		}
+	}
+	return nil, ErrNoSignature
+}
+
+func fetch(u *url.URL) (io.Reader, error) {
+	f, err := curl.Fetch(context.Background(), u)
+	if err != nil {
+		return nil, err
+	}
+	return uio.Reader(f), nil
+}
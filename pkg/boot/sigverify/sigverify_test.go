@@ -0,0 +1,381 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sigverify
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"golang.org/x/crypto/openpgp"
+)
+
+var (
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSpcPEImage    = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 15}
+)
+
+// testCert returns a certificate and its key. If parent is nil, the
+// certificate is a self-signed CA.
+func testCert(t *testing.T, name string, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// testPE returns an unsigned PE32+ file.
+func testPE(payload string) []byte {
+	b := make([]byte, 0x40+24+240)
+	copy(b, "MZ")
+	binary.LittleEndian.PutUint32(b[0x3c:], 0x40)
+	copy(b[0x40:], "PE\x00\x00")
+	// SizeOfOptionalHeader, with 16 data directories.
+	binary.LittleEndian.PutUint16(b[0x40+20:], 240)
+	opt := b[0x40+24:]
+	binary.LittleEndian.PutUint16(opt, 0x20b)
+	binary.LittleEndian.PutUint32(opt[64:], 0x1234)
+	binary.LittleEndian.PutUint32(opt[108:], 16)
+	return append(b, payload...)
+}
+
+func mustMarshal(t *testing.T, v interface{}, params string) []byte {
+	b, err := asn1.MarshalWithParams(v, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// sign appends an Authenticode signature of cert to the PE file b, with
+// chain included in the signature.
+func sign(t *testing.T, b []byte, cert *x509.Certificate, key *rsa.PrivateKey, chain ...*x509.Certificate) []byte {
+	for len(b)%8 != 0 {
+		b = append(b, 0)
+	}
+	img := &peImage{
+		b:           b,
+		checksumOff: 0x40 + 24 + 64,
+		certDirOff:  0x40 + 24 + 112 + 4*8,
+		certOff:     len(b),
+	}
+	sha256 := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+
+	idc := mustMarshal(t, spcIndirectDataContent{
+		Data: asn1.RawValue{FullBytes: mustMarshal(t, struct {
+			Type asn1.ObjectIdentifier
+		}{oidSpcPEImage}, "")},
+		MessageDigest: digestInfo{
+			DigestAlgorithm: sha256,
+			Digest:          img.digest(crypto.SHA256),
+		},
+	}, "")
+	var content asn1.RawValue
+	if _, err := asn1.Unmarshal(idc, &content); err != nil {
+		t.Fatal(err)
+	}
+	h := crypto.SHA256.New()
+	h.Write(content.Bytes)
+	attrs := mustMarshal(t, []attribute{
+		{Type: oidContentType, Values: []asn1.RawValue{{FullBytes: mustMarshal(t, oidSpcIndirectData, "")}}},
+		{Type: oidMessageDigest, Values: []asn1.RawValue{{FullBytes: mustMarshal(t, h.Sum(nil), "")}}},
+	}, "set")
+	h = crypto.SHA256.New()
+	h.Write(attrs)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs[0] = 0xa0
+
+	var certs []byte
+	for _, c := range append([]*x509.Certificate{cert}, chain...) {
+		certs = append(certs, c.Raw...)
+	}
+	sd := mustMarshal(t, signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256},
+		ContentInfo: contentInfo{
+			ContentType: oidSpcIndirectData,
+			Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: idc},
+		},
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			IssuerAndSerial: issuerAndSerial{
+				Issuer: asn1.RawValue{FullBytes: cert.RawIssuer},
+				Serial: cert.SerialNumber,
+			},
+			DigestAlgorithm:           sha256,
+			AuthenticatedAttributes:   asn1.RawValue{FullBytes: attrs},
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedDigest:           sig,
+		}},
+	}, "")
+	p7 := mustMarshal(t, contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd},
+	}, "")
+
+	winCert := make([]byte, 8, 8+len(p7)+7)
+	binary.LittleEndian.PutUint32(winCert, uint32(8+len(p7)))
+	binary.LittleEndian.PutUint16(winCert[4:], winCertRevision)
+	binary.LittleEndian.PutUint16(winCert[6:], winCertTypePKCSSignedData)
+	winCert = append(winCert, p7...)
+	for len(winCert)%8 != 0 {
+		winCert = append(winCert, 0)
+	}
+
+	binary.LittleEndian.PutUint32(b[img.certDirOff:], uint32(len(b)))
+	binary.LittleEndian.PutUint32(b[img.certDirOff+4:], uint32(len(winCert)))
+	return append(b, winCert...)
+}
+
+func TestVerifyAuthenticode(t *testing.T) {
+	ca, caKey := testCert(t, "CA", nil, nil)
+	signer, signerKey := testCert(t, "signer", ca, caKey)
+	other, _ := testCert(t, "other CA", nil, nil)
+
+	trusted := x509.NewCertPool()
+	trusted.AddCert(ca)
+	untrusted := x509.NewCertPool()
+	untrusted.AddCert(other)
+	// UEFI db may hold the signing certificate itself.
+	db := x509.NewCertPool()
+	db.AddCert(signer)
+
+	signed := sign(t, testPE("kernel"), signer, signerKey, ca)
+	tampered := append([]byte{}, signed...)
+	copy(tampered[0x40+24+240:], "KERNEL")
+	// The checksum is not covered by the signature.
+	checksum := append([]byte{}, signed...)
+	checksum[0x40+24+64] = 0xff
+
+	for _, tt := range []struct {
+		name  string
+		pe    []byte
+		roots *x509.CertPool
+		ok    bool
+	}{
+		{name: "trusted CA", pe: signed, roots: trusted, ok: true},
+		{name: "trusted signer", pe: signed, roots: db, ok: true},
+		{name: "changed checksum", pe: checksum, roots: trusted, ok: true},
+		{name: "untrusted", pe: signed, roots: untrusted},
+		{name: "tampered", pe: tampered, roots: trusted},
+		{name: "trailing data", pe: append(append([]byte{}, signed...), "evil"...), roots: trusted},
+		{name: "unsigned", pe: testPE("kernel"), roots: trusted},
+		{name: "not PE", pe: []byte("kernel"), roots: trusted},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyAuthenticode(tt.pe, tt.roots)
+			if (err == nil) != tt.ok {
+				t.Errorf("VerifyAuthenticode = %v, want ok=%t", err, tt.ok)
+			}
+		})
+	}
+
+	if err := VerifyAuthenticode(testPE("kernel"), trusted); err != ErrUnsigned {
+		t.Errorf("VerifyAuthenticode(unsigned) = %v, want %v", err, ErrUnsigned)
+	}
+}
+
+// writeSigned writes content to dir/name, and its detached signature by e to
+// dir/name.sig unless e is nil.
+func writeSigned(t *testing.T, dir, name string, content []byte, e *openpgp.Entity) *os.File {
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if e != nil {
+		var sig bytes.Buffer
+		if err := openpgp.DetachSign(&sig, e, bytes.NewReader(content), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p+".sig", sig.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sigverify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, caKey := testCert(t, "CA", nil, nil)
+	certs := x509.NewCertPool()
+	certs.AddCert(ca)
+
+	pe := sign(t, testPE("kernel"), ca, caKey)
+	var (
+		kernel       = writeSigned(t, dir, "vmlinuz", []byte("kernel"), key)
+		initrd       = writeSigned(t, dir, "initrd", []byte("initrd"), key)
+		otherInitrd  = writeSigned(t, dir, "other-initrd", []byte("initrd"), otherKey)
+		unsigned     = writeSigned(t, dir, "unsigned", []byte("initrd"), nil)
+		peKernel     = writeSigned(t, dir, "vmlinuz.efi", pe, nil)
+		signedKernel = writeSigned(t, dir, "vmlinuz-signed.efi", pe, key)
+	)
+
+	for _, tt := range []struct {
+		name   string
+		v      *Verifier
+		kernel *os.File
+		initrd *os.File
+		// load is the initrd that is loaded, if it differs.
+		load []byte
+		ok   bool
+	}{
+		{
+			name:   "detached",
+			v:      &Verifier{Keyring: openpgp.EntityList{key}},
+			kernel: kernel,
+			initrd: initrd,
+			ok:     true,
+		},
+		{
+			name:   "detached without initrd",
+			v:      &Verifier{Keyring: openpgp.EntityList{key}},
+			kernel: kernel,
+			ok:     true,
+		},
+		{
+			name:   "changed initrd",
+			v:      &Verifier{Keyring: openpgp.EntityList{key}},
+			kernel: kernel,
+			initrd: initrd,
+			load:   []byte("evil"),
+		},
+		{
+			name:   "untrusted key",
+			v:      &Verifier{Keyring: openpgp.EntityList{key}},
+			kernel: kernel,
+			initrd: otherInitrd,
+		},
+		{
+			name:   "unsigned initrd",
+			v:      &Verifier{Keyring: openpgp.EntityList{key}},
+			kernel: kernel,
+			initrd: unsigned,
+		},
+		{
+			name:   "no keyring",
+			v:      &Verifier{Certs: certs},
+			kernel: kernel,
+		},
+		{
+			name:   "authenticode",
+			v:      &Verifier{Certs: certs},
+			kernel: peKernel,
+			ok:     true,
+		},
+		{
+			name:   "authenticode with unsigned initrd",
+			v:      &Verifier{Certs: certs},
+			kernel: peKernel,
+			initrd: unsigned,
+		},
+		{
+			name:   "authenticode allowing unsigned initrd",
+			v:      &Verifier{Certs: certs, UnsignedInitrd: true},
+			kernel: peKernel,
+			initrd: unsigned,
+			ok:     true,
+		},
+		{
+			name:   "authenticode and detached initrd",
+			v:      &Verifier{Certs: certs, Keyring: openpgp.EntityList{key}},
+			kernel: peKernel,
+			initrd: initrd,
+			ok:     true,
+		},
+		{
+			name:   "untrusted authenticode, trusted detached",
+			v:      &Verifier{Certs: x509.NewCertPool(), Keyring: openpgp.EntityList{key}},
+			kernel: signedKernel,
+			ok:     true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			li := &boot.LinuxImage{Kernel: tt.kernel}
+			k, err := ioutil.ReadAll(tt.kernel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tt.kernel.Seek(0, 0); err != nil {
+				t.Fatal(err)
+			}
+			var i *bytes.Reader
+			if tt.initrd != nil {
+				li.Initrd = tt.initrd
+				load := tt.load
+				if load == nil {
+					load, err = ioutil.ReadFile(tt.initrd.Name())
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				i = bytes.NewReader(load)
+			}
+
+			if i == nil {
+				err = tt.v.Verify(li, bytes.NewReader(k), nil)
+			} else {
+				err = tt.v.Verify(li, bytes.NewReader(k), i)
+			}
+			if (err == nil) != tt.ok {
+				t.Errorf("Verify = %v, want ok=%t", err, tt.ok)
+			}
+		})
+	}
+}
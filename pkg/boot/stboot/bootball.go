@@ -256,6 +256,7 @@ func (ball *BootBall) VerifyBootconfigByID(id string) (found, verified int, err
 		err = ball.Signer.Verify(sig, ball.hashes[id])
 		if err != nil {
 			log.Print(err)
+			continue
 		}
 		verified++
 	}
@@ -5,8 +5,17 @@
 package stboot
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -20,3 +29,74 @@ func TestBootBallFromConfig(t *testing.T) {
 	require.NoError(t, err)
 	// todo: test files, too
 }
+
+// writeTestPKI writes a root certificate and a signing key and certificate
+// issued by it to dir.
+func writeTestPKI(t *testing.T, dir string) (rootCert, key, cert string) {
+	writePEM := func(name, typ string, b []byte) string {
+		p := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600))
+		return p
+	}
+
+	rootKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rootTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTmpl, rootTmpl, &rootKey.PublicKey, rootKey)
+	require.NoError(t, err)
+	root, err := x509.ParseCertificate(rootDER)
+	require.NoError(t, err)
+
+	signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "signing key"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, root, &signingKey.PublicKey, rootKey)
+	require.NoError(t, err)
+
+	return writePEM("root.cert", "CERTIFICATE", rootDER),
+		writePEM("signing.key", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(signingKey)),
+		writePEM("signing.cert", "CERTIFICATE", der)
+}
+
+func TestVerifyBootconfigByIDInvalidSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stboot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	rootCert, key, cert := writeTestPKI(t, dir)
+
+	ball, err := BootBallFromConfig("testdata/testConfigDir/stconfig.json")
+	require.NoError(t, err)
+	defer ball.Clean()
+	ball.RootCertPEM, err = ioutil.ReadFile(rootCert)
+	require.NoError(t, err)
+	require.NoError(t, ball.Sign(key, cert))
+
+	bc, err := ball.GetBootConfigByIndex(0)
+	require.NoError(t, err)
+	found, verified, err := ball.VerifyBootconfigByID(bc.ID())
+	require.NoError(t, err)
+	require.Equal(t, 1, found)
+	require.Equal(t, 1, verified)
+
+	// A signature that does not match is found, but not valid.
+	ball.signatures[bc.ID()][0].Bytes[0] ^= 0xff
+	found, verified, err = ball.VerifyBootconfigByID(bc.ID())
+	require.NoError(t, err)
+	require.Equal(t, 1, found)
+	require.Equal(t, 0, verified)
+}
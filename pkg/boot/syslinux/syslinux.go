@@ -13,6 +13,7 @@ package syslinux
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -62,7 +63,18 @@ func ParseLocalConfig(ctx context.Context, diskDir string) ([]boot.OSImage, erro
 		Scheme: "file",
 		Path:   diskDir,
 	}
+	imgs, err := ParseRootConfig(ctx, curl.DefaultSchemes, rootdir)
+	if err == errNoConfig {
+		return nil, fmt.Errorf("no valid syslinux config found on %s", diskDir)
+	}
+	return imgs, err
+}
+
+var errNoConfig = errors.New("no valid syslinux config found")
 
+// ParseRootConfig is like ParseLocalConfig, but looks for the config under
+// rootdir using s, e.g. in an ISO image.
+func ParseRootConfig(ctx context.Context, s curl.Schemes, rootdir *url.URL) ([]boot.OSImage, error) {
 	for _, relname := range probeIsolinuxFiles() {
 		dir, name := filepath.Split(relname)
 
@@ -71,13 +83,13 @@ func ParseLocalConfig(ctx context.Context, diskDir string) ([]boot.OSImage, erro
 		// configuration file."
 		//
 		// https://wiki.syslinux.org/wiki/index.php?title=Config#Working_directory
-		imgs, err := ParseConfigFile(ctx, curl.DefaultSchemes, name, rootdir, dir)
+		imgs, err := ParseConfigFile(ctx, s, name, rootdir, dir)
 		if curl.IsURLError(err) {
 			continue
 		}
 		return imgs, err
 	}
-	return nil, fmt.Errorf("no valid syslinux config found on %s", diskDir)
+	return nil, errNoConfig
 }
 
 // ParseConfigFile parses a Syslinux configuration as specified in
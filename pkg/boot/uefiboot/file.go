@@ -0,0 +1,145 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uefiboot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/bls"
+	"github.com/u-root/u-root/pkg/boot/grub"
+	"github.com/u-root/u-root/pkg/curl"
+	"github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/mount/block"
+	bootvars "github.com/u-root/u-root/pkg/uefivars/boot"
+	"github.com/u-root/u-root/pkg/ulog"
+)
+
+// sdbootMagic is embedded in systemd-boot, whatever it is named.
+var sdbootMagic = []byte("#### LoaderInfo: systemd-boot")
+
+// fileImages returns the images to boot for the EFI application file, which
+// is relative to the partition mounted at root.
+func fileImages(ctx context.Context, l ulog.Logger, e *bootvars.BootEntryVar, root, file string, devices block.BlockDevices, mountPool *mount.Pool) ([]boot.OSImage, error) {
+	// A unified kernel image is a Type #2 BLS entry by itself.
+	if img, err := bls.ParseUKI(filepath.Join(root, file)); err == nil {
+		l.Printf("Boot%04X: %s is a unified kernel image", e.Number, file)
+		// As systemd-stub, load options only apply when the image
+		// has no embedded command line.
+		if img.Cmdline == "" {
+			img.Cmdline = loadOptions(e.OptionalData)
+		}
+		return []boot.OSImage{img}, nil
+	}
+
+	f, err := os.Open(filepath.Join(root, file))
+	if err != nil {
+		return nil, err
+	}
+
+	if isLinuxKernel(f) {
+		img, err := linuxImage(e, root, f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return []boot.OSImage{img}, nil
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(path.Base(file))
+	switch {
+	case strings.HasPrefix(name, "systemd-boot") || bytes.Contains(data, sdbootMagic):
+		l.Printf("Boot%04X: %s is systemd-boot", e.Number, file)
+		return bls.ScanBLSEntries(l, root)
+
+	case strings.HasPrefix(name, "grub") || strings.HasPrefix(name, "shim") || isRemovable(file):
+		l.Printf("Boot%04X: %s is GRUB", e.Number, file)
+		return grubImages(ctx, root, file, devices, mountPool)
+	}
+	return nil, fmt.Errorf("%s: unsupported EFI application", file)
+}
+
+// isRemovable returns true if file is the default boot loader of removable
+// media, which is often a copy of GRUB or shim.
+func isRemovable(file string) bool {
+	dir, name := path.Split(strings.ToLower(path.Clean("/" + file)))
+	return dir == "/efi/boot/" && strings.HasPrefix(name, "boot") && path.Ext(name) == ".efi"
+}
+
+// isLinuxKernel returns true if r is a Linux kernel with an EFI stub.
+func isLinuxKernel(r io.ReaderAt) bool {
+	var hdr [0x206]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return false
+	}
+	if !bytes.Equal(hdr[:2], []byte("MZ")) {
+		return false
+	}
+	// x86 bzImage or arm64 Image.
+	return bytes.Equal(hdr[0x202:0x206], []byte("HdrS")) || bytes.Equal(hdr[0x38:0x3c], []byte("ARM\x64"))
+}
+
+// linuxImage returns the image booting the EFI stub kernel, with the load
+// options of e as command line.
+//
+// As the EFI stub does, initrd= arguments are loaded from the partition
+// mounted at root.
+func linuxImage(e *bootvars.BootEntryVar, root string, kernel *os.File) (*boot.LinuxImage, error) {
+	var initrds []io.ReaderAt
+	var args []string
+	for _, arg := range strings.Fields(loadOptions(e.OptionalData)) {
+		if !strings.HasPrefix(arg, "initrd=") {
+			args = append(args, arg)
+			continue
+		}
+		name := strings.Replace(strings.TrimPrefix(arg, "initrd="), `\`, "/", -1)
+		f, err := os.Open(filepath.Join(root, name))
+		if err != nil {
+			return nil, err
+		}
+		initrds = append(initrds, f)
+	}
+
+	li := &boot.LinuxImage{
+		Name:    e.Description,
+		Kernel:  kernel,
+		Cmdline: strings.Join(args, " "),
+	}
+	if len(initrds) == 1 {
+		li.Initrd = initrds[0]
+	} else if len(initrds) > 1 {
+		li.Initrd = boot.CatInitrds(initrds...)
+	}
+	return li, nil
+}
+
+// grubImages returns the images of the GRUB config that the GRUB or shim
+// loader file would load, i.e. grub.cfg in the directory of the loader.
+// Otherwise the partition mounted at root is searched for any GRUB config.
+func grubImages(ctx context.Context, root, file string, devices block.BlockDevices, mountPool *mount.Pool) ([]boot.OSImage, error) {
+	config := path.Join(path.Dir(file), "grub.cfg")
+	if _, err := os.Stat(filepath.Join(root, config)); err != nil {
+		return grub.ParseLocalConfigWithDevices(ctx, root, devices, mountPool)
+	}
+	wd := &url.URL{
+		Scheme: "file",
+		Path:   root,
+	}
+	return grub.ParseConfigFileWithDevices(ctx, curl.DefaultSchemes, config, wd, devices, mountPool)
+}
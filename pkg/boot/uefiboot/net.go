@@ -0,0 +1,128 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uefiboot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/netboot"
+	"github.com/u-root/u-root/pkg/curl"
+	"github.com/u-root/u-root/pkg/dhclient"
+	"github.com/u-root/u-root/pkg/ulog"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	dhcpTimeout = 5 * time.Second
+	dhcpTries   = 3
+)
+
+// netPath describes a network boot entry.
+type netPath struct {
+	// mac is the address of the interface to boot from, or nil for any
+	// Ethernet interface.
+	mac net.HardwareAddr
+
+	// ipv4 and ipv6 select the protocol. If neither is set, both are
+	// tried.
+	ipv4, ipv6 bool
+
+	// http is set for HTTP Boot entries, which have a URI device path.
+	http bool
+
+	// uri is the file to boot, or nil if it is obtained with DHCP.
+	uri *url.URL
+}
+
+func (n netPath) String() string {
+	return fmt.Sprintf("mac=%s ipv4=%t ipv6=%t http=%t uri=%v", n.mac, n.ipv4, n.ipv6, n.http, n.uri)
+}
+
+// netbootEntry returns the images to boot for a network boot entry. It is a
+// variable so that it can be overridden for testing.
+var netbootEntry = dhcpNetboot
+
+// dhcpNetboot configures the network with DHCP and returns the images of the
+// first lease that has any.
+func dhcpNetboot(ctx context.Context, l ulog.Logger, n netPath) ([]boot.OSImage, error) {
+	ifs, err := interfaces(n.mac)
+	if err != nil {
+		return nil, err
+	}
+
+	ipv4, ipv6 := n.ipv4, n.ipv6
+	if !ipv4 && !ipv6 {
+		ipv4, ipv6 = true, true
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, (1<<dhcpTries)*dhcpTimeout)
+	defer cancel()
+	r := dhclient.SendRequests(dctx, ifs, ipv4, ipv6, dhclient.Config{
+		Timeout:  dhcpTimeout,
+		Retries:  dhcpTries,
+		HTTPBoot: n.http,
+	}, 30*time.Second)
+
+	for {
+		select {
+		case <-dctx.Done():
+			return nil, dctx.Err()
+
+		case result, ok := <-r:
+			if !ok {
+				return nil, errors.New("no DHCP lease with anything to boot")
+			}
+			iname := result.Interface.Attrs().Name
+			if result.Err != nil {
+				l.Printf("Could not configure %s for %s: %v", iname, result.Protocol, result.Err)
+				continue
+			}
+			if err := result.Lease.Configure(); err != nil {
+				l.Printf("Failed to configure lease %s: %v", result.Lease, err)
+			}
+
+			// Like firmware, do not boot bootballs, which need trusted
+			// root certificates.
+			var imgs []boot.OSImage
+			if n.uri != nil {
+				imgs = netboot.BootURIImages(ctx, l, curl.DefaultSchemes, n.uri, result.Lease, netboot.Config{})
+			} else {
+				imgs, err = netboot.BootImages(ctx, l, curl.DefaultSchemes, result.Lease)
+				if err != nil {
+					l.Printf("Failed to boot lease %s: %v", result.Lease, err)
+					continue
+				}
+			}
+			if len(imgs) > 0 {
+				return imgs, nil
+			}
+		}
+	}
+}
+
+// interfaces returns the interface with the given MAC address, or all
+// Ethernet interfaces if mac is nil.
+func interfaces(mac net.HardwareAddr) ([]netlink.Link, error) {
+	if mac == nil {
+		return dhclient.Interfaces("^e.*")
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		if bytes.Equal(link.Attrs().HardwareAddr, mac) {
+			return []netlink.Link{link}, nil
+		}
+	}
+	return nil, fmt.Errorf("no interface with MAC address %s", mac)
+}
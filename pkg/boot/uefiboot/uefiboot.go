@@ -0,0 +1,283 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package uefiboot finds OSes to boot from the UEFI boot entries, in the
+// order the firmware would try them.
+//
+// BootNext and BootOrder, as set by e.g. efibootmgr, determine the order of
+// the Boot#### entries. The device path of each entry is resolved:
+//
+//   - A file on a hard disk partition is loaded directly if it is a Linux kernel
+//     with an EFI stub, using the entry's optional data as command line. Other
+//     files are assumed to be boot loaders: systemd-boot is replaced by the
+//     BootLoaderSpec entries on its partition, and GRUB and shim by the GRUB
+//     config they would load.
+//
+//   - MAC, IPv4, IPv6 and URI device paths are booted from the network, using
+//     netboot.
+//
+// Partitions of GPT disks are found by their GUID, and partitions of MBR
+// disks by the disk signature and partition number.
+//
+// Inactive entries, firmware applications such as the setup menu, and
+// entries whose device cannot be found are skipped.
+package uefiboot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/mount/block"
+	"github.com/u-root/u-root/pkg/uefivars"
+	bootvars "github.com/u-root/u-root/pkg/uefivars/boot"
+	"github.com/u-root/u-root/pkg/ulog"
+)
+
+// removableNames are the file names of the default boot loaders of removable
+// media, which the firmware boots if a device path names no file.
+var removableNames = map[string]string{
+	"386":     "BOOTIA32.EFI",
+	"amd64":   "BOOTX64.EFI",
+	"arm":     "BOOTARM.EFI",
+	"arm64":   "BOOTAA64.EFI",
+	"riscv64": "BOOTRISCV64.EFI",
+}
+
+// BootImages returns the images to boot for the UEFI boot entries, starting
+// with the BootNext entry, followed by the entries in BootOrder. Like the
+// firmware, BootNext is only booted once: it is deleted once an image of its
+// entry is loaded.
+//
+// devices are searched for the partitions that entries refer to, which are
+// mounted using mountPool.
+func BootImages(ctx context.Context, l ulog.Logger, devices block.BlockDevices, mountPool *mount.Pool) ([]boot.OSImage, error) {
+	var nums []uint16
+	next, err := bootvars.ReadBootNext()
+	hasNext := err == nil
+	if hasNext {
+		nums = append(nums, next)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		l.Printf("Ignoring BootNext: %v", err)
+	}
+	order, err := bootvars.ReadBootOrder()
+	if err != nil && !hasNext {
+		return nil, err
+	}
+	nums = append(nums, order...)
+
+	var images []boot.OSImage
+	seen := make(map[uint16]bool)
+	for i, num := range nums {
+		if seen[num] {
+			continue
+		}
+		seen[num] = true
+
+		e, err := bootvars.ReadBootVar(num)
+		if err != nil {
+			l.Printf("Skipping Boot%04X: %v", num, err)
+			continue
+		}
+		// BootNext is booted regardless of its attributes.
+		if !(hasNext && i == 0) {
+			if !e.Active() {
+				l.Printf("Skipping inactive Boot%04X %q", num, e.Description)
+				continue
+			}
+			if e.IsApp() {
+				l.Printf("Skipping application Boot%04X %q", num, e.Description)
+				continue
+			}
+		}
+
+		imgs, err := EntryImages(ctx, l, e, devices, mountPool)
+		if err != nil {
+			l.Printf("Skipping Boot%04X %q: %v", num, e.Description, err)
+			continue
+		}
+		if hasNext && i == 0 {
+			removeBootNextOnLoad(imgs)
+		}
+		images = append(images, imgs...)
+	}
+	return images, nil
+}
+
+// removeBootNextOnLoad makes imgs delete BootNext once they are loaded, after
+// whatever else they do then.
+func removeBootNextOnLoad(imgs []boot.OSImage) {
+	for _, img := range imgs {
+		switch img := img.(type) {
+		case *boot.LinuxImage:
+			img.Loaded = thenRemoveBootNext(img.Loaded)
+		case *boot.MultibootImage:
+			img.Loaded = thenRemoveBootNext(img.Loaded)
+		}
+	}
+}
+
+func thenRemoveBootNext(loaded func() error) func() error {
+	return func() error {
+		if loaded != nil {
+			if err := loaded(); err != nil {
+				return err
+			}
+		}
+		if err := bootvars.RemoveBootNext(); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing BootNext: %v", err)
+		}
+		return nil
+	}
+}
+
+// EntryImages returns the images to boot for the boot entry e.
+//
+// devices are searched for the partition the entry refers to, which is
+// mounted using mountPool.
+func EntryImages(ctx context.Context, l ulog.Logger, e *bootvars.BootEntryVar, devices block.BlockDevices, mountPool *mount.Pool) ([]boot.OSImage, error) {
+	var (
+		hdd   *bootvars.DppMediaHDD
+		file  string
+		n     netPath
+		isNet bool
+	)
+	for _, p := range e.FilePathList {
+		switch p := p.(type) {
+		case *bootvars.DppMediaHDD:
+			hdd = p
+		case *bootvars.DppMediaFilePath:
+			// Multiple file path nodes are concatenated.
+			file = path.Join(file, p.PathNameDecoded)
+		case *bootvars.DppMsgMAC:
+			isNet = true
+			if mac := net.HardwareAddr(p.Mac[:6]); !isZero(mac) {
+				n.mac = mac
+			}
+		case *bootvars.DppMsgIP4:
+			isNet = true
+			n.ipv4 = true
+		case *bootvars.DppMsgIP6:
+			isNet = true
+			n.ipv6 = true
+		case *bootvars.DppMsgURI:
+			isNet, n.http = true, true
+			if len(p.URI) > 0 {
+				u, err := url.Parse(p.URI)
+				if err != nil {
+					return nil, err
+				}
+				n.uri = u
+			}
+		}
+	}
+
+	switch {
+	case isNet:
+		return netbootEntry(ctx, l, n)
+
+	case hdd != nil:
+		dev, err := findPartition(devices, hdd)
+		if err != nil {
+			return nil, err
+		}
+		mp, err := mountPool.Mount(dev, mount.ReadOnly)
+		if err != nil {
+			return nil, err
+		}
+		if len(file) == 0 {
+			file = path.Join("EFI", "BOOT", removableNames[runtime.GOARCH])
+		}
+		return fileImages(ctx, l, e, mp.Path, file, devices, mountPool)
+	}
+	return nil, fmt.Errorf("unsupported device path %s", e.FilePathList)
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// findPartition returns the partition described by hdd. GPT partitions are
+// found by their GUID, and MBR partitions by the signature of their disk and
+// their number.
+func findPartition(devices block.BlockDevices, hdd *bootvars.DppMediaHDD) (*block.BlockDev, error) {
+	var parts block.BlockDevices
+	switch hdd.SigType {
+	case 1:
+		parts = mbrPartitions(devices, hdd.PartSig[:4], hdd.PartNum)
+	case 2:
+		parts = devices.FilterPartID(hdd.PartSig.ToStdEnc().String())
+	default:
+		return nil, fmt.Errorf("%s: partitions without a signature cannot be identified", hdd)
+	}
+	if len(parts) != 1 {
+		return nil, fmt.Errorf("%s: %w", hdd, bootvars.ErrNotFound)
+	}
+	return parts[0], nil
+}
+
+// readDevice reads len(b) bytes at off of the device d.
+var readDevice = func(d *block.BlockDev, b []byte, off int64) error {
+	f, err := os.Open(d.DevicePath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.ReadAt(b, off)
+	return err
+}
+
+// mbrPartitions returns partition num of the disks whose MBR has the
+// signature sig at 0x1b8.
+func mbrPartitions(devices block.BlockDevices, sig []byte, num uint32) block.BlockDevices {
+	var parts block.BlockDevices
+	for _, d := range devices {
+		// Partitions of disks whose names end in a digit, such as
+		// nvme0n1, are separated by a p.
+		name := d.Name
+		if len(name) == 0 {
+			continue
+		}
+		if c := name[len(name)-1]; c >= '0' && c <= '9' {
+			name += "p"
+		}
+		part := devices.FilterName(fmt.Sprintf("%s%d", name, num))
+		if len(part) == 0 {
+			continue
+		}
+		b := make([]byte, len(sig))
+		if err := readDevice(d, b, 0x1b8); err != nil || !bytes.Equal(b, sig) {
+			continue
+		}
+		parts = append(parts, part...)
+	}
+	return parts
+}
+
+// loadOptions decodes the optional data of a boot entry, which is the command
+// line of an EFI stub kernel. Load options are UCS-2 as the spec requires,
+// but some tools write ASCII.
+func loadOptions(data []byte) string {
+	s := string(data)
+	if len(data) >= 2 && data[1] == 0 {
+		if u, err := uefivars.DecodeUTF16(data); err == nil {
+			s = u
+		}
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
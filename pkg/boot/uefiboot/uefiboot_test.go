@@ -0,0 +1,391 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uefiboot
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/mount"
+	"github.com/u-root/u-root/pkg/mount/block"
+	"github.com/u-root/u-root/pkg/uefivars"
+	bootvars "github.com/u-root/u-root/pkg/uefivars/boot"
+	"github.com/u-root/u-root/pkg/uefivars/vartest"
+	"github.com/u-root/u-root/pkg/uio"
+	"github.com/u-root/u-root/pkg/ulog"
+	"github.com/u-root/u-root/pkg/ulog/ulogtest"
+)
+
+func TestMain(m *testing.M) {
+	efiVarDir, cleanup, err := vartest.SetupVarZip("../../uefivars/testdata/sys_fw_efi_vars.zip")
+	if err != nil {
+		panic(err)
+	}
+	uefivars.EfiVarDir = efiVarDir
+	code := m.Run()
+	cleanup()
+	os.Exit(code)
+}
+
+func utf16Bytes(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(c), byte(c>>8))
+	}
+	return b
+}
+
+func TestLoadOptions(t *testing.T) {
+	for _, tt := range []struct {
+		data []byte
+		want string
+	}{
+		{data: nil, want: ""},
+		{data: []byte("SHELL=shell"), want: "SHELL=shell"},
+		{data: append(utf16Bytes("root=/dev/sda2 ro"), 0, 0), want: "root=/dev/sda2 ro"},
+	} {
+		if got := loadOptions(tt.data); got != tt.want {
+			t.Errorf("loadOptions(%q) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+// stubNetboot replaces network boot until the returned function is called,
+// and records the network boot entries.
+func stubNetboot() (*[]netPath, func()) {
+	var paths []netPath
+	old := netbootEntry
+	netbootEntry = func(ctx context.Context, l ulog.Logger, n netPath) ([]boot.OSImage, error) {
+		paths = append(paths, n)
+		return []boot.OSImage{&boot.LinuxImage{Name: "netboot"}}, nil
+	}
+	return &paths, func() { netbootEntry = old }
+}
+
+func TestFindPartitionMBR(t *testing.T) {
+	sigs := map[string][]byte{
+		"sda":     {1, 2, 3, 4},
+		"sdb":     {5, 6, 7, 8},
+		"nvme0n1": {5, 6, 7, 8},
+	}
+	defer func(f func(*block.BlockDev, []byte, int64) error) { readDevice = f }(readDevice)
+	readDevice = func(d *block.BlockDev, b []byte, off int64) error {
+		if off != 0x1b8 {
+			t.Errorf("read %s at %#x, want the MBR signature at 0x1b8", d.Name, off)
+		}
+		sig, ok := sigs[d.Name]
+		if !ok {
+			return io.EOF
+		}
+		copy(b, sig)
+		return nil
+	}
+	devices := block.BlockDevices{
+		{Name: "sda"}, {Name: "sda1"}, {Name: "sda2"},
+		{Name: "sdb"}, {Name: "sdb1"},
+		{Name: "nvme0n1"}, {Name: "nvme0n1p2"},
+	}
+
+	for _, tt := range []struct {
+		sig  []byte
+		num  uint32
+		want string
+	}{
+		{sig: []byte{1, 2, 3, 4}, num: 2, want: "sda2"},
+		{sig: []byte{5, 6, 7, 8}, num: 1, want: "sdb1"},
+		{sig: []byte{5, 6, 7, 8}, num: 2, want: "nvme0n1p2"},
+		{sig: []byte{1, 2, 3, 4}, num: 3},
+		{sig: []byte{9, 9, 9, 9}, num: 1},
+	} {
+		hdd := &bootvars.DppMediaHDD{PartNum: tt.num, PartFmt: 1, SigType: 1}
+		copy(hdd.PartSig[:], tt.sig)
+		got, err := findPartition(devices, hdd)
+		if tt.want == "" {
+			if !errors.Is(err, bootvars.ErrNotFound) {
+				t.Errorf("findPartition(%v, %d) = %v, %v, want %v", tt.sig, tt.num, got, err, bootvars.ErrNotFound)
+			}
+			continue
+		}
+		if err != nil || got.Name != tt.want {
+			t.Errorf("findPartition(%v, %d) = %v, %v, want %s", tt.sig, tt.num, got, err, tt.want)
+		}
+	}
+}
+
+func TestBootImages(t *testing.T) {
+	paths, restore := stubNetboot()
+	defer restore()
+
+	// Only Boot0006, a PXE entry, is bootable in the test data. The other
+	// entries are firmware applications, or refer to devices we do not
+	// have.
+	var pool mount.Pool
+	imgs, err := BootImages(context.Background(), ulogtest.Logger{TB: t}, nil, &pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imgs) != 1 || imgs[0].Label() != "netboot" {
+		t.Errorf("BootImages = %v, want netboot image", imgs)
+	}
+	want := []netPath{{mac: net.HardwareAddr{0x00, 0x26, 0xfd, 0x00, 0x26, 0xfd}}}
+	if !reflect.DeepEqual(*paths, want) {
+		t.Errorf("netboot entries = %v, want %v", *paths, want)
+	}
+}
+
+func TestBootNext(t *testing.T) {
+	paths, restore := stubNetboot()
+	defer restore()
+
+	// BootNext is removed through efivarfs, so move the vars needed there.
+	order, err := bootvars.ReadBootOrder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	boot6, err := uefivars.ReadVar(bootvars.BootUUID, "Boot0006")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "efivarfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldFs, oldDir := uefivars.EfiVarFs, uefivars.EfiVarDir
+	uefivars.EfiVarFs, uefivars.EfiVarDir = dir, filepath.Join(dir, "does-not-exist")
+	defer func() { uefivars.EfiVarFs, uefivars.EfiVarDir = oldFs, oldDir }()
+	if err := uefivars.WriteVar(bootvars.BootUUID, "Boot0006", uefivars.DefaultAttrs, boot6.Data); err != nil {
+		t.Fatal(err)
+	}
+	if err := bootvars.WriteBootOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	if err := bootvars.WriteBootNext(6); err != nil {
+		t.Fatal(err)
+	}
+
+	var pool mount.Pool
+	imgs, err := BootImages(context.Background(), ulogtest.Logger{TB: t}, nil, &pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Boot0006 is in BootOrder as well, but is only tried once.
+	if len(*paths) != 1 || len(imgs) != 1 {
+		t.Fatalf("netboot entries = %v, want 1", *paths)
+	}
+
+	// BootNext is only removed once its image is loaded.
+	if _, err := bootvars.ReadBootNext(); err != nil {
+		t.Errorf("ReadBootNext = %v, want BootNext to be set", err)
+	}
+	if err := imgs[0].(*boot.LinuxImage).Loaded(); err != nil {
+		t.Fatalf("Loaded() = %v", err)
+	}
+	if _, err := bootvars.ReadBootNext(); !os.IsNotExist(errors.Unwrap(err)) {
+		t.Errorf("ReadBootNext = %v, want BootNext to be removed", err)
+	}
+}
+
+func TestEntryImagesNetwork(t *testing.T) {
+	paths, restore := stubNetboot()
+	defer restore()
+
+	path := []byte{
+		// MAC(525400123456)
+		3, 11, 37, 0,
+		0x52, 0x54, 0x00, 0x12, 0x34, 0x56, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+		1,
+		// IPv4(0.0.0.0,TCP,DHCP,0.0.0.0,0.0.0.0,0.0.0.0)
+		3, 12, 27, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 6, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+	}
+	uri := "http://10.0.0.1/boot/vmlinuz"
+	path = append(path, 3, 24, byte(4+len(uri)), 0)
+	path = append(path, uri...)
+	path = append(path, 0x7f, 0xff, 4, 0)
+	list, err := bootvars.ParseFilePathList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &bootvars.BootEntryVar{
+		EfiLoadOption: bootvars.EfiLoadOption{
+			Attributes:   bootvars.LoadOptionActive,
+			Description:  "UEFI HTTPv4",
+			FilePathList: list,
+		},
+	}
+
+	if _, err := EntryImages(context.Background(), ulogtest.Logger{TB: t}, e, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(*paths) != 1 {
+		t.Fatalf("netboot entries = %v, want 1", *paths)
+	}
+	got := (*paths)[0]
+	if got.mac.String() != "52:54:00:12:34:56" || !got.ipv4 || got.ipv6 || got.uri == nil || got.uri.String() != uri {
+		t.Errorf("netboot entry = %v", got)
+	}
+}
+
+// bzImage returns the start of an x86 Linux kernel with an EFI stub.
+func bzImage() []byte {
+	b := make([]byte, 0x400)
+	copy(b, "MZ")
+	copy(b[0x202:], "HdrS")
+	return b
+}
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileImages(t *testing.T) {
+	root, err := ioutil.TempDir("", "uefiboot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	writeFiles(t, root, map[string]string{
+		"EFI/Linux/vmlinuz.efi": string(bzImage()),
+		"EFI/Linux/initrd.img":  "initrd",
+		"EFI/Linux/ucode.img":   "ucode",
+
+		"EFI/systemd/systemd-bootx64.efi": "systemd-boot",
+		"EFI/BOOT/BOOTX64.EFI":            "MZ...#### LoaderInfo: systemd-boot 245 ####...",
+		"loader/entries/fedora.conf":      "title Fedora\nlinux /vmlinuz-fedora\noptions root=/dev/sda3\n",
+		"vmlinuz-fedora":                  "fedora",
+		"EFI/fedora/shimx64.efi":          "shim",
+		"EFI/fedora/grub.cfg":             "menuentry Debian {\n linux /vmlinuz-debian root=/dev/sda4\n}\n",
+		"EFI/debian/grubx64.efi":          "grub",
+		"vmlinuz-debian":                  "debian",
+		"EFI/tools/memtest.efi":           "MZ memtest",
+	})
+
+	for _, tt := range []struct {
+		name    string
+		file    string
+		opts    []byte
+		kernel  string
+		initrd  string
+		cmdline string
+		wantErr bool
+	}{
+		{
+			name:    "efi stub",
+			file:    "EFI/Linux/vmlinuz.efi",
+			opts:    utf16Bytes(`initrd=\EFI\Linux\ucode.img initrd=\EFI\Linux\initrd.img root=/dev/sda2`),
+			kernel:  string(bzImage()),
+			initrd:  "ucodeinitrd",
+			cmdline: "root=/dev/sda2",
+		},
+		{
+			name:    "systemd-boot",
+			file:    "EFI/systemd/systemd-bootx64.efi",
+			kernel:  "fedora",
+			cmdline: "root=/dev/sda3",
+		},
+		{
+			name:    "systemd-boot as removable",
+			file:    "EFI/BOOT/BOOTX64.EFI",
+			kernel:  "fedora",
+			cmdline: "root=/dev/sda3",
+		},
+		{
+			name:    "shim",
+			file:    "EFI/fedora/shimx64.efi",
+			kernel:  "debian",
+			cmdline: "root=/dev/sda4",
+		},
+		{
+			name:    "grub without config in its directory",
+			file:    "EFI/debian/grubx64.efi",
+			kernel:  "debian",
+			cmdline: "root=/dev/sda4",
+		},
+		{
+			name:    "unknown",
+			file:    "EFI/tools/memtest.efi",
+			wantErr: true,
+		},
+		{
+			name:    "missing initrd",
+			file:    "EFI/Linux/vmlinuz.efi",
+			opts:    []byte(`initrd=\initrd.img`),
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &bootvars.BootEntryVar{
+				EfiLoadOption: bootvars.EfiLoadOption{
+					Description:  tt.name,
+					OptionalData: tt.opts,
+				},
+			}
+			imgs, err := fileImages(context.Background(), ulogtest.Logger{TB: t}, e, root, tt.file, nil, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("fileImages = %v, want error", imgs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(imgs) == 0 {
+				t.Fatal("no images")
+			}
+			li, ok := imgs[0].(*boot.LinuxImage)
+			if !ok {
+				t.Fatalf("got %T, want LinuxImage", imgs[0])
+			}
+			if got := readAll(t, li.Kernel); got != tt.kernel {
+				t.Errorf("kernel = %q, want %q", got, tt.kernel)
+			}
+			if li.Initrd != nil || len(tt.initrd) > 0 {
+				// Concatenated initrds are padded.
+				if got := strings.Replace(readAll(t, li.Initrd), "\x00", "", -1); got != tt.initrd {
+					t.Errorf("initrd = %q, want %q", got, tt.initrd)
+				}
+			}
+			if !strings.Contains(li.Cmdline, tt.cmdline) {
+				t.Errorf("cmdline = %q, want %q", li.Cmdline, tt.cmdline)
+			}
+		})
+	}
+}
+
+func readAll(t *testing.T, r io.ReaderAt) string {
+	if r == nil {
+		return ""
+	}
+	b, err := uio.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
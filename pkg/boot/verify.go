@@ -0,0 +1,73 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotVerifiable is returned when loading an image with a Verifier set
+// that cannot be verified, e.g. because its type is not supported.
+var ErrNotVerifiable = errors.New("image cannot be verified")
+
+// Verifier checks that the kernel and initrd of a LinuxImage may be booted,
+// e.g. by checking their signatures.
+type Verifier interface {
+	// Verify returns an error if the image must not be booted.
+	//
+	// kernel and initrd are the copies that are loaded if Verify returns
+	// nil; initrd is nil if the image has none. The originals in li may
+	// be used to locate detached signatures.
+	Verify(li *LinuxImage, kernel, initrd io.ReaderAt) error
+}
+
+// VerifyError is returned by Load when an image fails verification.
+type VerifyError struct {
+	Image string
+	Err   error
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("verifying %s: %v", e.Image, e.Err)
+}
+
+// Unwrap returns the error of the Verifier.
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// Verify returns imgs with v set as their Verifier, so that they fail to load
+// unless v accepts them.
+//
+// Verification fails closed: images other than LinuxImages cannot be
+// verified and always fail to load.
+func Verify(v Verifier, imgs ...OSImage) []OSImage {
+	verified := make([]OSImage, 0, len(imgs))
+	for _, img := range imgs {
+		if li, ok := img.(*LinuxImage); ok {
+			c := *li
+			c.Verifier = v
+			verified = append(verified, &c)
+		} else {
+			verified = append(verified, unverifiableImage{img})
+		}
+	}
+	return verified
+}
+
+// unverifiableImage is an OSImage that a Verifier cannot check.
+type unverifiableImage struct {
+	OSImage
+}
+
+// Load implements OSImage.Load by refusing to load the image.
+func (u unverifiableImage) Load(verbose bool) error {
+	return &VerifyError{
+		Image: u.Label(),
+		Err:   fmt.Errorf("%T: %w", u.OSImage, ErrNotVerifiable),
+	}
+}
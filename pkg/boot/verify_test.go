@@ -0,0 +1,70 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package boot
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+type testVerifier struct {
+	kernel, initrd []byte
+	err            error
+}
+
+func (v *testVerifier) Verify(li *LinuxImage, kernel, initrd io.ReaderAt) error {
+	var err error
+	if v.kernel, err = uio.ReadAll(kernel); err != nil {
+		return err
+	}
+	if initrd != nil {
+		if v.initrd, err = uio.ReadAll(initrd); err != nil {
+			return err
+		}
+	}
+	return v.err
+}
+
+func TestVerify(t *testing.T) {
+	errRejected := errors.New("rejected")
+	v := &testVerifier{err: errRejected}
+	li := &LinuxImage{
+		Name:   "linux",
+		Kernel: strings.NewReader("kernel"),
+		Initrd: strings.NewReader("initrd"),
+	}
+	mi := &MultibootImage{Name: "multiboot"}
+
+	imgs := Verify(v, li, mi)
+	if len(imgs) != 2 {
+		t.Fatalf("Verify returned %d images, want 2", len(imgs))
+	}
+	if li.Verifier != nil {
+		t.Errorf("Verify changed the original image")
+	}
+
+	// The verifier rejects the image before it is kexec'd.
+	err := imgs[0].Load(false)
+	var verr *VerifyError
+	if !errors.As(err, &verr) || !errors.Is(err, errRejected) {
+		t.Errorf("Load = %v, want VerifyError wrapping %v", err, errRejected)
+	}
+	if !bytes.Equal(v.kernel, []byte("kernel")) || !bytes.Equal(v.initrd, []byte("initrd")) {
+		t.Errorf("verified kernel %q initrd %q, want kernel and initrd", v.kernel, v.initrd)
+	}
+
+	// Images that cannot be verified fail closed.
+	if err := imgs[1].Load(false); !errors.Is(err, ErrNotVerifiable) {
+		t.Errorf("Load = %v, want %v", err, ErrNotVerifiable)
+	}
+	if imgs[1].Label() != "multiboot" {
+		t.Errorf("Label = %q, want multiboot", imgs[1].Label())
+	}
+}
@@ -188,3 +188,22 @@ func FlagsForModule(name string) string {
 	}
 	return ret
 }
+
+// Values returns all values of a flag, in order, for flags like ip= and
+// console= that may be given more than once.
+func (c CmdLine) Values(flag string) []string {
+	canonicalFlag := strings.Replace(flag, "-", "_", -1)
+	var values []string
+	doParse(c.Raw, func(flag, key, canonicalKey, value, trimmedValue string) {
+		if canonicalKey == canonicalFlag {
+			values = append(values, trimmedValue)
+		}
+	})
+	return values
+}
+
+// FlagValues returns all values of a flag given on the kernel cmdline.
+func FlagValues(flag string) []string {
+	once.Do(cmdLineOpener)
+	return procCmdLine.Values(flag)
+}
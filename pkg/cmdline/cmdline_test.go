@@ -5,6 +5,7 @@
 package cmdline
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -101,3 +102,21 @@ func TestCmdlineModules(t *testing.T) {
 		t.Errorf("my_module flags got: %v, want opt1=world opt_2=22-22 ", flags)
 	}
 }
+
+func TestCmdlineValues(t *testing.T) {
+	c := parse(strings.NewReader(`console=tty0 ip=dhcp nameserver=10.0.0.1 console=ttyS0,115200 name-server=10.0.0.2 quiet`))
+	for _, tt := range []struct {
+		flag string
+		want []string
+	}{
+		{flag: "console", want: []string{"tty0", "ttyS0,115200"}},
+		{flag: "name_server", want: []string{"10.0.0.2"}},
+		{flag: "nameserver", want: []string{"10.0.0.1"}},
+		{flag: "quiet", want: []string{"1"}},
+		{flag: "vlan"},
+	} {
+		if got := c.Values(tt.flag); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Values(%q) = %q, want %q", tt.flag, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// ErrDigestMismatch is returned when a file does not have the digest its URL
+// asks for.
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// digests are the hash algorithms a URL fragment can name.
+var digests = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Digest is the expected digest of a file.
+//
+// It is given in the fragment of the file's URL, either directly as in
+//
+//	http://server/vmlinuz#sha256=4f3c...
+//
+// or by naming the algorithm alone, as in
+//
+//	http://server/vmlinuz#sha256
+//
+// in which case it is read from the side-car file with the algorithm as
+// extension, http://server/vmlinuz.sha256 here. Side-car files may be in the
+// format of sha256sum and sha512sum.
+type Digest struct {
+	// Algorithm is "sha256" or "sha512".
+	Algorithm string
+
+	// Sum is the digest.
+	Sum []byte
+}
+
+// ParseDigest parses a digest like "sha256=4f3c...".
+func ParseDigest(s string) (*Digest, error) {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return nil, fmt.Errorf("digest %q is not algorithm=hex", s)
+	}
+	return newDigest(s[:i], s[i+1:])
+}
+
+func newDigest(alg, sum string) (*Digest, error) {
+	h, ok := digests[alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest algorithm %q", alg)
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(sum))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s digest: %v", alg, err)
+	}
+	if len(b) != h().Size() {
+		return nil, fmt.Errorf("%s digest has %d bytes, want %d", alg, len(b), h().Size())
+	}
+	return &Digest{Algorithm: alg, Sum: b}, nil
+}
+
+// String implements fmt.Stringer.
+func (d *Digest) String() string {
+	return fmt.Sprintf("%s=%x", d.Algorithm, d.Sum)
+}
+
+// Verify reads all of r and checks that it has digest d.
+func (d *Digest) Verify(r io.ReaderAt) error {
+	h := digests[d.Algorithm]()
+	if _, err := io.Copy(h, uio.Reader(r)); err != nil {
+		return err
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, d.Sum) {
+		return fmt.Errorf("%w: %s is %x, want %x", ErrDigestMismatch, d.Algorithm, sum, d.Sum)
+	}
+	return nil
+}
+
+// sidecar returns the URL of the side-car digest file of u.
+func sidecar(u *url.URL, alg string) *url.URL {
+	su := *u
+	su.Fragment = ""
+	su.Path += "." + alg
+	if su.RawPath != "" {
+		su.RawPath += "." + alg
+	}
+	return &su
+}
+
+// urlDigest returns the digest the fragment of u asks for, fetching the
+// side-car file using fs if need be. It returns nil if u has no digest.
+func urlDigest(ctx context.Context, fs FileScheme, u *url.URL) (*Digest, error) {
+	if u.Fragment == "" {
+		return nil, nil
+	}
+	alg, sum := u.Fragment, ""
+	if i := strings.IndexByte(alg, '='); i >= 0 {
+		alg, sum = alg[:i], alg[i+1:]
+	}
+	if _, ok := digests[alg]; !ok {
+		// Other fragments are none of our business.
+		return nil, nil
+	}
+	if sum != "" {
+		return newDigest(alg, sum)
+	}
+
+	su := sidecar(u, alg)
+	r, err := fs.Fetch(ctx, su)
+	if err != nil {
+		return nil, fmt.Errorf("fetching digest %s: %v", su, err)
+	}
+	b, err := uio.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("fetching digest %s: %v", su, err)
+	}
+	// sha256sum prints "<digest>  <file name>".
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("digest file %s is empty", su)
+	}
+	return newDigest(alg, fields[0])
+}
+
+// fetchVerified fetches u using fs, and checks the digest its fragment asks
+// for, if any.
+func fetchVerified(ctx context.Context, fs FileScheme, u *url.URL) (io.ReaderAt, error) {
+	d, err := urlDigest(ctx, fs, u)
+	if err != nil {
+		return nil, err
+	}
+	r, err := fs.Fetch(ctx, u)
+	if err != nil || d == nil {
+		return r, err
+	}
+	if err := d.Verify(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
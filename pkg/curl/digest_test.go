@@ -0,0 +1,100 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+func TestDigest(t *testing.T) {
+	content := "kernel"
+	sum256 := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	sum512 := fmt.Sprintf("%x", sha512.Sum512([]byte(content)))
+
+	fs := NewMockScheme("http")
+	fs.Add("server", "/vmlinuz", content)
+	fs.Add("server", "/vmlinuz.sha256", sum256+"  vmlinuz\n")
+	fs.Add("server", "/vmlinuz.sha512", sum512[:10]+"\n")
+	s := Schemes{"http": fs}
+
+	for _, tt := range []struct {
+		fragment string
+		err      bool
+	}{
+		{fragment: ""},
+		{fragment: "sha256=" + sum256},
+		{fragment: "sha512=" + sum512},
+		{fragment: "sha256"},
+		// Other fragments are ignored.
+		{fragment: "foo"},
+		{fragment: "sha256=" + sum512, err: true},
+		{fragment: "sha512=" + sum512[:len(sum512)-2] + "00", err: true},
+		{fragment: "sha256=xyz", err: true},
+		// Bad side-car file.
+		{fragment: "sha512", err: true},
+	} {
+		t.Run(tt.fragment, func(t *testing.T) {
+			u := &url.URL{Scheme: "http", Host: "server", Path: "/vmlinuz", Fragment: tt.fragment}
+			for name, fetch := range map[string]func() (File, error){
+				"Fetch": func() (File, error) { return s.Fetch(context.Background(), u) },
+				"LazyFetch": func() (File, error) {
+					f, err := s.LazyFetch(u)
+					if err != nil {
+						return nil, err
+					}
+					// Make the lazy file open.
+					if _, err := f.ReadAt(make([]byte, 1), 0); err != nil {
+						return nil, err
+					}
+					return f, nil
+				},
+			} {
+				f, err := fetch()
+				if (err != nil) != tt.err {
+					t.Fatalf("%s(%s) = %v, want error %t", name, u, err, tt.err)
+				}
+				if err != nil {
+					continue
+				}
+				if b, err := uio.ReadAll(f); err != nil || string(b) != content {
+					t.Errorf("%s(%s) = %q, %v, want %q", name, u, b, err, content)
+				}
+			}
+		})
+	}
+}
+
+func TestDigestMismatch(t *testing.T) {
+	fs := NewMockScheme("http")
+	fs.Add("server", "/vmlinuz", "evil")
+	u := &url.URL{Scheme: "http", Host: "server", Path: "/vmlinuz", Fragment: fmt.Sprintf("sha256=%x", sha256.Sum256([]byte("kernel")))}
+	if _, err := (Schemes{"http": fs}).Fetch(context.Background(), u); !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("Fetch = %v, want %v", err, ErrDigestMismatch)
+	}
+}
+
+func TestParseDigest(t *testing.T) {
+	sum := sha256.Sum256([]byte("kernel"))
+	d, err := ParseDigest(fmt.Sprintf("sha256=%x", sum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Algorithm != "sha256" || string(d.Sum) != string(sum[:]) {
+		t.Errorf("ParseDigest = %v, want sha256=%x", d, sum)
+	}
+	for _, s := range []string{"sha256", "md5=00", "sha256=00"} {
+		if _, err := ParseDigest(s); err == nil {
+			t.Errorf("ParseDigest(%q) succeeded, want error", s)
+		}
+	}
+}
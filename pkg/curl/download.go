@@ -0,0 +1,217 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resumeDelay is how long to wait before resuming a download, times the
+// number of resumes so far.
+var resumeDelay = time.Second
+
+var (
+	errNoRanges = errors.New("server does not support range requests")
+	errChanged  = errors.New("file changed while downloading")
+)
+
+// download is an HTTP download that can be resumed, or split into segments.
+type download struct {
+	ctx context.Context
+	h   *HTTPClient
+	u   *url.URL
+
+	// validator is the ETag or Last-Modified of the file, which it must
+	// still have when the download is resumed.
+	validator string
+}
+
+// validator returns the header that identifies the version of a file that
+// resp returns, for an If-Range request.
+func validator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// get requests the bytes from off up to, but excluding, end, or to the end
+// of the file if end is negative.
+func (d *download) get(off, end int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(d.ctx, "GET", d.u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if end < 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, end-1))
+	}
+	if d.validator != "" {
+		req.Header.Set("If-Range", d.validator)
+	}
+	resp, err := d.h.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		resp.Body.Close()
+		// The server ignored the range: either it does not support
+		// ranges, or If-Range did not match.
+		if d.validator != "" && resp.Header.Get("Accept-Ranges") == "bytes" {
+			return nil, errChanged
+		}
+		return nil, errNoRanges
+	default:
+		resp.Body.Close()
+		return nil, &HTTPClientCodeError{nil, resp.StatusCode}
+	}
+	if start, ok := rangeStart(resp.Header.Get("Content-Range")); !ok || start != off {
+		resp.Body.Close()
+		return nil, fmt.Errorf("server returned range %q, want bytes from %d", resp.Header.Get("Content-Range"), off)
+	}
+	return resp.Body, nil
+}
+
+// rangeStart returns the first byte of a Content-Range like
+// "bytes 100-199/1000".
+func rangeStart(cr string) (int64, bool) {
+	cr = strings.TrimPrefix(cr, "bytes ")
+	i := strings.IndexByte(cr, '-')
+	if i < 0 {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(cr[:i], 10, 64)
+	return start, err == nil
+}
+
+// reader returns a reader of body, which holds the bytes from off up to end,
+// or to the end of the file if end is negative. If body is nil, it is
+// requested on the first read.
+func (d *download) reader(body io.ReadCloser, off, end int64) *resumingReader {
+	return &resumingReader{d: d, body: body, off: off, end: end}
+}
+
+// resumingReader reads a part of a file, and resumes where it stopped if the
+// connection fails.
+type resumingReader struct {
+	d    *download
+	body io.ReadCloser
+
+	off, end int64
+	resumes  int
+}
+
+// Read implements io.Reader.
+func (r *resumingReader) Read(p []byte) (int, error) {
+	if r.end >= 0 {
+		if r.off >= r.end {
+			r.close()
+			return 0, io.EOF
+		}
+		if int64(len(p)) > r.end-r.off {
+			p = p[:r.end-r.off]
+		}
+	}
+	for {
+		var err error
+		if r.body == nil {
+			r.body, err = r.d.get(r.off, r.end)
+		}
+		if err == nil {
+			var n int
+			n, err = r.body.Read(p)
+			r.off += int64(n)
+			if n > 0 && r.d.h.Progress != nil {
+				r.d.h.Progress.Write(p[:n])
+			}
+			if err == io.EOF && r.end >= 0 && r.off < r.end {
+				err = io.ErrUnexpectedEOF
+			}
+			if err == io.EOF {
+				r.close()
+			}
+			if n > 0 || err == nil || err == io.EOF {
+				return n, err
+			}
+		}
+
+		// Errors of the server are not going to go away.
+		var codeErr *HTTPClientCodeError
+		if errors.Is(err, errNoRanges) || errors.Is(err, errChanged) || errors.As(err, &codeErr) || r.resumes >= r.d.h.Resumes || r.d.ctx.Err() != nil {
+			r.close()
+			return 0, err
+		}
+		r.resumes++
+		r.close()
+		log.Printf("Downloading %s failed at byte %d: %v; resuming", r.d.u, r.off, err)
+		select {
+		case <-time.After(time.Duration(r.resumes) * resumeDelay):
+		case <-r.d.ctx.Done():
+			return 0, r.d.ctx.Err()
+		}
+	}
+}
+
+func (r *resumingReader) close() {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+}
+
+// segments downloads the size bytes of the file in parallel range requests.
+// first is the response to the request of the whole file, whose body
+// supplies the first segment.
+func (d *download) segments(first *http.Response, size int64) (io.ReaderAt, error) {
+	n := int64(d.h.Segments)
+	segSize := (size + n - 1) / n
+	buf := make([]byte, size)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for start := int64(0); start < size; start += segSize {
+		end := start + segSize
+		if end > size {
+			end = size
+		}
+		var body io.ReadCloser
+		if start == 0 {
+			body = first.Body
+		}
+		r := d.reader(body, start, end)
+		wg.Add(1)
+		go func(start, end int64) {
+			defer wg.Done()
+			defer r.close()
+			if _, err := io.ReadFull(r, buf[start:end]); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("bytes %d-%d: %v", start, end-1, err))
+				mu.Unlock()
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return bytes.NewReader(buf), nil
+}
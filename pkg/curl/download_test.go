@@ -0,0 +1,181 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// flakyServer serves content, but breaks off the first fails responses
+// after cut bytes.
+type flakyServer struct {
+	content []byte
+	modTime time.Time
+	cut     int
+
+	mu       sync.Mutex
+	fails    int
+	requests []string
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Header.Get("Range"))
+	fail := s.fails > 0
+	if fail {
+		s.fails--
+	}
+	s.mu.Unlock()
+
+	if !fail {
+		http.ServeContent(w, r, "file", s.modTime, bytes.NewReader(s.content))
+		return
+	}
+	rec := httptest.NewRecorder()
+	http.ServeContent(rec, r, "file", s.modTime, bytes.NewReader(s.content))
+	for k, v := range rec.Header() {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.Code)
+	body := rec.Body.Bytes()
+	if len(body) > s.cut {
+		body = body[:s.cut]
+	}
+	w.Write(body)
+	w.(http.Flusher).Flush()
+	// Break the connection, so that the client sees a short body.
+	panic(http.ErrAbortHandler)
+}
+
+func (s *flakyServer) requested() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func testContent(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func fetchAll(t *testing.T, h *HTTPClient, u string) ([]byte, error) {
+	t.Helper()
+	pu, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := h.Fetch(context.Background(), pu)
+	if err != nil {
+		return nil, err
+	}
+	return uio.ReadAll(r)
+}
+
+func TestHTTPResume(t *testing.T) {
+	defer func(d time.Duration) { resumeDelay = d }(resumeDelay)
+	resumeDelay = 0
+
+	content := testContent(100000)
+	s := &flakyServer{content: content, modTime: time.Unix(1600000000, 0), cut: 30000, fails: 2}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	var progress bytes.Buffer
+	h := NewHTTPClient(ts.Client())
+	h.Progress = &uio.ProgressWriter{Symbol: "#", Interval: 10000, W: &progress}
+	got, err := fetchAll(t, h, ts.URL)
+	if err != nil {
+		t.Fatalf("Fetch = %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Fetch returned %d bytes differing from the %d bytes served", len(got), len(content))
+	}
+	if want := []string{"", "bytes=30000-", "bytes=60000-"}; strings.Join(s.requested(), ",") != strings.Join(want, ",") {
+		t.Errorf("requests = %q, want %q", s.requested(), want)
+	}
+	if progress.String() != strings.Repeat("#", 10) {
+		t.Errorf("progress = %q, want 10 #", progress.String())
+	}
+}
+
+func TestHTTPResumeLimit(t *testing.T) {
+	defer func(d time.Duration) { resumeDelay = d }(resumeDelay)
+	resumeDelay = 0
+
+	s := &flakyServer{content: testContent(100000), cut: 100, fails: 10}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	h := NewHTTPClient(ts.Client())
+	h.Resumes = 2
+	if _, err := fetchAll(t, h, ts.URL); err == nil {
+		t.Error("Fetch succeeded, want error after 2 resumes")
+	}
+	if n := len(s.requested()); n != 3 {
+		t.Errorf("made %d requests, want 3", n)
+	}
+}
+
+func TestHTTPResumeNoRanges(t *testing.T) {
+	defer func(d time.Duration) { resumeDelay = d }(resumeDelay)
+	resumeDelay = 0
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Length", "1000")
+		w.Write(make([]byte, 100))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer ts.Close()
+
+	if _, err := fetchAll(t, NewHTTPClient(ts.Client()), ts.URL); !errors.Is(err, errNoRanges) {
+		t.Errorf("Fetch = %v, want %v", err, errNoRanges)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("made %d requests, want 2", n)
+	}
+}
+
+func TestHTTPSegments(t *testing.T) {
+	defer func(d time.Duration) { resumeDelay = d }(resumeDelay)
+	resumeDelay = 0
+
+	content := testContent(100003)
+	// One of the segments is resumed.
+	s := &flakyServer{content: content, modTime: time.Unix(1600000000, 0), cut: 1000, fails: 1}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	h := NewHTTPClient(ts.Client())
+	h.Segments = 4
+	h.SegmentSize = 1000
+	got, err := fetchAll(t, h, ts.URL)
+	if err != nil {
+		t.Fatalf("Fetch = %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Fetch returned %d bytes differing from the %d bytes served", len(got), len(content))
+	}
+	if r := s.requested(); len(r) != 5 {
+		t.Errorf("requests = %q, want 5", r)
+	}
+}
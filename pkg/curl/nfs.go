@@ -0,0 +1,109 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/u-root/u-root/pkg/nfs"
+)
+
+// NFSClient implements FileScheme for files on NFS exports, with URLs like
+//
+//	nfs://server[:port]/export/path/to/file
+//
+// The port, if any, is the port of the NFS service. The export is the
+// longest of the server's exports that the path starts with, or the
+// directory of the file if the server does not list its exports.
+//
+// Exports stay mounted for further files until Close is called.
+type NFSClient struct {
+	c nfs.Config
+
+	mu      sync.Mutex
+	clients map[string]*nfs.Client
+	exports map[string][]string
+}
+
+// NewNFSClient returns a new NFS FileScheme using c.
+func NewNFSClient(c nfs.Config) *NFSClient {
+	return &NFSClient{
+		c:       c,
+		clients: make(map[string]*nfs.Client),
+		exports: make(map[string][]string),
+	}
+}
+
+// export returns the export of server that p is in, and the path of p in
+// the export.
+func (n *NFSClient) export(ctx context.Context, server string, c nfs.Config, p string) (string, string) {
+	exports, ok := n.exports[server]
+	if !ok {
+		// Not listing exports is allowed.
+		exports, _ = nfs.Exports(ctx, server, c)
+		n.exports[server] = exports
+	}
+	var best string
+	for _, e := range exports {
+		e = path.Clean(e)
+		if len(e) > len(best) && (p == e || strings.HasPrefix(p, strings.TrimSuffix(e, "/")+"/")) {
+			best = e
+		}
+	}
+	if best == "" {
+		best = path.Dir(p)
+	}
+	return best, strings.TrimPrefix(p, best)
+}
+
+// Fetch implements FileScheme.Fetch.
+func (n *NFSClient) Fetch(ctx context.Context, u *url.URL) (io.ReaderAt, error) {
+	c := n.c
+	if port := u.Port(); port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, err
+		}
+		c.Port = p
+	}
+	server := u.Hostname()
+	p := path.Clean("/" + u.Path)
+
+	n.mu.Lock()
+	export, name := n.export(ctx, server, c, p)
+	key := u.Host + ":" + export
+	cl, ok := n.clients[key]
+	if !ok {
+		var err error
+		if cl, err = nfs.Dial(ctx, server, export, c); err != nil {
+			n.mu.Unlock()
+			return nil, err
+		}
+		n.clients[key] = cl
+	}
+	n.mu.Unlock()
+
+	return cl.Open(ctx, name)
+}
+
+// Close unmounts all exports.
+func (n *NFSClient) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var err error
+	for key, cl := range n.clients {
+		if cerr := cl.Close(); err == nil {
+			err = cerr
+		}
+		delete(n.clients, key)
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/nfs"
+	"github.com/u-root/u-root/pkg/nfs/nfstest"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+func TestNFS(t *testing.T) {
+	s, err := nfstest.NewServer(
+		[]string{"/srv", "/srv/boot/pxe"},
+		map[string]string{
+			"/srv/boot/pxe/vmlinuz":   "kernel",
+			"/srv/boot/pxe/initrd":    "initrd",
+			"/srv/boot/grub/grub.cfg": "menuentry",
+		},
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	n := NewNFSClient(nfs.Config{PortmapPort: s.Port})
+	defer n.Close()
+	schemes := Schemes{"nfs": n}
+
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte("kernel")))
+	for _, tt := range []struct {
+		path string
+		want string
+		err  error
+	}{
+		{path: "/srv/boot/pxe/vmlinuz", want: "kernel"},
+		{path: "/srv/boot/pxe/vmlinuz#sha256=" + sum, want: "kernel"},
+		{path: "/srv/boot/pxe/initrd", want: "initrd"},
+		{path: "/srv/boot/grub/grub.cfg", want: "menuentry"},
+		{path: "/srv/boot/pxe/missing", err: os.ErrNotExist},
+	} {
+		u, err := url.Parse(fmt.Sprintf("nfs://127.0.0.1:%d%s", s.Port, tt.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := schemes.Fetch(context.Background(), u)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Fetch(%s) = %v, want %v", u, err, tt.err)
+		}
+		if err != nil {
+			continue
+		}
+		if b, err := uio.ReadAll(f); err != nil || string(b) != tt.want {
+			t.Errorf("Fetch(%s) = %q, %v, want %q", u, b, err, tt.want)
+		}
+	}
+
+	// The longest exports are mounted, once.
+	if got := s.Mounts("/srv/boot/pxe"); got != 1 {
+		t.Errorf("/srv/boot/pxe mounted %d times, want 1", got)
+	}
+	if got := s.Mounts("/srv"); got != 1 {
+		t.Errorf("/srv mounted %d times, want 1", got)
+	}
+	if err := n.Close(); err != nil {
+		t.Errorf("Close = %v", err)
+	}
+	if got := s.Mounts("/srv/boot/pxe"); got != 0 {
+		t.Errorf("/srv/boot/pxe mounted %d times after Close, want 0", got)
+	}
+}
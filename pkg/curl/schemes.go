@@ -4,7 +4,7 @@
 
 // Package curl implements routines to fetch files given a URL.
 //
-// curl currently supports HTTP, TFTP, and local files.
+// curl currently supports HTTP, TFTP, NFS, and local files.
 package curl
 
 import (
@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/cenkalti/backoff"
+	"github.com/u-root/u-root/pkg/nfs"
 	"github.com/u-root/u-root/pkg/uio"
 	"pack.ag/tftp"
 )
@@ -64,10 +65,14 @@ var (
 	// DefaultTFTPClient is the default TFTP FileScheme.
 	DefaultTFTPClient = NewTFTPClient(tftp.ClientMode(tftp.ModeOctet), tftp.ClientBlocksize(1450), tftp.ClientWindowsize(65535))
 
+	// DefaultNFSClient is the default NFS FileScheme.
+	DefaultNFSClient = NewNFSClient(nfs.Config{})
+
 	// DefaultSchemes are the schemes supported by default.
 	DefaultSchemes = Schemes{
 		"tftp": DefaultTFTPClient,
 		"http": DefaultHTTPClient,
+		"nfs":  DefaultNFSClient,
 		"file": &LocalFileClient{},
 	}
 )
@@ -133,6 +138,9 @@ func (f file) String() string {
 // Fetch fetchs the file with the given `u`. `u.Scheme` is used to
 // select the FileScheme via `s`.
 //
+// If the fragment of `u` names a digest (see Digest), the file is read
+// completely and checked against it.
+//
 // If `s` does not contain a FileScheme for `u.Scheme`, ErrNoSuchScheme is
 // returned.
 func (s Schemes) Fetch(ctx context.Context, u *url.URL) (File, error) {
@@ -140,7 +148,7 @@ func (s Schemes) Fetch(ctx context.Context, u *url.URL) (File, error) {
 	if !ok {
 		return nil, &URLError{URL: u, Err: ErrNoSuchScheme}
 	}
-	r, err := fg.Fetch(ctx, u)
+	r, err := fetchVerified(ctx, fg, u)
 	if err != nil {
 		return nil, &URLError{URL: u, Err: err}
 	}
@@ -165,7 +173,7 @@ func (s Schemes) LazyFetch(u *url.URL) (File, error) {
 		url: u,
 		ReaderAt: uio.NewLazyOpenerAt(u.String(), func() (io.ReaderAt, error) {
 			// TODO
-			r, err := fg.Fetch(context.TODO(), u)
+			r, err := fetchVerified(context.TODO(), fg, u)
 			if err != nil {
 				return nil, &URLError{URL: u, Err: err}
 			}
@@ -286,12 +294,33 @@ func (h *HTTPClientCodeError) Unwrap() error {
 // HTTPClient implements FileScheme for HTTP files.
 type HTTPClient struct {
 	c *http.Client
+
+	// Resumes is how often a download that fails part way through is
+	// resumed with a range request where it stopped.
+	Resumes int
+
+	// Segments is the number of range requests a file of at least
+	// SegmentSize bytes is downloaded with in parallel. Files are
+	// downloaded completely before Fetch returns then; otherwise they
+	// are downloaded as they are read.
+	Segments    int
+	SegmentSize int64
+
+	// Progress, if set, is written the bytes as they are downloaded, e.g.
+	// a uio.ProgressWriter. It must be safe for concurrent use if Segments
+	// is more than 1.
+	Progress io.Writer
 }
 
+// DefaultResumes is the number of times NewHTTPClient's clients resume a
+// download.
+const DefaultResumes = 5
+
 // NewHTTPClient returns a new HTTP FileScheme based on the given http.Client.
 func NewHTTPClient(c *http.Client) *HTTPClient {
 	return &HTTPClient{
-		c: c,
+		c:       c,
+		Resumes: DefaultResumes,
 	}
 }
 
@@ -307,9 +336,19 @@ func (h HTTPClient) Fetch(ctx context.Context, u *url.URL) (io.ReaderAt, error)
 	}
 
 	if resp.StatusCode != 200 {
+		resp.Body.Close()
 		return nil, &HTTPClientCodeError{err, resp.StatusCode}
 	}
-	return uio.NewCachingReader(resp.Body), nil
+	d := &download{
+		ctx:       ctx,
+		h:         &h,
+		u:         u,
+		validator: validator(resp),
+	}
+	if h.Segments > 1 && resp.ContentLength >= h.SegmentSize && resp.ContentLength > 0 && resp.Header.Get("Accept-Ranges") == "bytes" {
+		return d.segments(resp, resp.ContentLength)
+	}
+	return uio.NewCachingReader(d.reader(resp.Body, 0, -1)), nil
 }
 
 // RetryOr returns a DoRetry function that returns true if any one of fn return
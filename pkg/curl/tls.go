@@ -0,0 +1,122 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ErrPinMismatch is returned when a server's certificate does not have any
+// of the pinned public keys.
+var ErrPinMismatch = errors.New("server certificate does not match any pinned public key")
+
+// TLSOptions configures the TLS connections of an HTTPS client.
+type TLSOptions struct {
+	// RootCAs is a PEM file of the CAs that server certificates are
+	// verified against, instead of the system's.
+	RootCAs string
+
+	// Cert and Key are the PEM files of the certificate that the client
+	// authenticates itself with, if the server asks for one.
+	Cert string
+	Key  string
+
+	// Pins are the hex-encoded SHA-256 hashes of public keys (see
+	// PublicKeyPin), one of which the server's certificate must have.
+	//
+	// If RootCAs is set, a certificate of the verified chain must have
+	// one of the pins. If RootCAs is empty, the server's own certificate
+	// is verified by its pin alone, so that self-signed certificates can
+	// be used; the pin then names the server, and its host name is not
+	// checked.
+	Pins []string
+}
+
+// PublicKeyPin returns the pin of the public key of cert: the hex-encoded
+// SHA-256 hash of its DER-encoded SubjectPublicKeyInfo.
+func PublicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// Config returns the tls.Config for o.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	c := &tls.Config{}
+	if o.RootCAs != "" {
+		pem, err := ioutil.ReadFile(o.RootCAs)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.RootCAs)
+		}
+	}
+	if o.Cert != "" || o.Key != "" {
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(o.Pins) > 0 {
+		pins := make(map[string]bool)
+		for _, p := range o.Pins {
+			pins[strings.ToLower(p)] = true
+		}
+		if o.RootCAs == "" {
+			// The pin takes the place of the chain of trust, which
+			// crypto/tls can only be told to skip entirely. Only the
+			// server's own certificate is proven by the handshake.
+			c.InsecureSkipVerify = true
+			c.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 {
+					return ErrPinMismatch
+				}
+				cert, err := x509.ParseCertificate(rawCerts[0])
+				if err != nil {
+					return err
+				}
+				if !pins[PublicKeyPin(cert)] {
+					return ErrPinMismatch
+				}
+				return nil
+			}
+		} else {
+			c.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+				for _, chain := range verifiedChains {
+					for _, cert := range chain {
+						if pins[PublicKeyPin(cert)] {
+							return nil
+						}
+					}
+				}
+				return ErrPinMismatch
+			}
+		}
+	}
+	return c, nil
+}
+
+// NewHTTPSClient returns an HTTP FileScheme whose TLS connections are
+// configured by o.
+func NewHTTPSClient(o TLSOptions) (*HTTPClient, error) {
+	c, err := o.Config()
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = c
+	return NewHTTPClient(&http.Client{Transport: t}), nil
+}
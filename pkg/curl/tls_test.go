@@ -0,0 +1,208 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package curl
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+// writeCert writes a self-signed certificate and its key to dir as
+// name.pem and name-key.pem.
+func writeCert(t *testing.T, dir, name string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func fetchString(t *testing.T, c *HTTPClient, u string) (string, error) {
+	t.Helper()
+	pu, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Fetch(context.Background(), pu)
+	if err != nil {
+		return "", err
+	}
+	b, err := uio.ReadAll(r)
+	return string(b), err
+}
+
+func TestHTTPSPin(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pinned"))
+	}))
+	defer ts.Close()
+	pin := PublicKeyPin(ts.Certificate())
+
+	c, err := NewHTTPSClient(TLSOptions{Pins: []string{"00", pin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fetchString(t, c, ts.URL); err != nil || got != "pinned" {
+		t.Errorf("Fetch with matching pin = %q, %v, want pinned", got, err)
+	}
+
+	c, err = NewHTTPSClient(TLSOptions{Pins: []string{"00"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetchString(t, c, ts.URL); !errors.Is(err, ErrPinMismatch) {
+		t.Errorf("Fetch with other pin = %v, want %v", err, ErrPinMismatch)
+	}
+
+	// Without a pin or CA, the test server's certificate is not trusted.
+	c, err = NewHTTPSClient(TLSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetchString(t, c, ts.URL); err == nil {
+		t.Error("Fetch from untrusted server succeeded")
+	}
+}
+
+func TestHTTPSPinLeaf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "curl-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pinned := writeCert(t, dir, "pinned")
+
+	// The server sends a certificate that is pinned after its own, but
+	// does not have its key.
+	local := httptest.NewTLSServer(nil)
+	cert := local.TLS.Certificates[0]
+	local.Close()
+	cert.Certificate = append(cert.Certificate[:1:1], pinned.Raw)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pinned"))
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		o    TLSOptions
+		err  error
+	}{
+		{"pin only", TLSOptions{Pins: []string{PublicKeyPin(pinned)}}, ErrPinMismatch},
+		{"pin not in verified chain", TLSOptions{RootCAs: caFile, Pins: []string{PublicKeyPin(pinned)}}, ErrPinMismatch},
+		{"pin in verified chain", TLSOptions{RootCAs: caFile, Pins: []string{PublicKeyPin(ts.Certificate())}}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewHTTPSClient(tt.o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fetchString(t, c, ts.URL); !errors.Is(err, tt.err) {
+				t.Errorf("Fetch = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestHTTPSClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "curl-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clientCert := writeCert(t, dir, "client")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	// Trust the test server's CA.
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewHTTPSClient(TLSOptions{
+		RootCAs: caFile,
+		Cert:    filepath.Join(dir, "client.pem"),
+		Key:     filepath.Join(dir, "client-key.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fetchString(t, c, ts.URL); err != nil || got != "client" {
+		t.Errorf("Fetch with client certificate = %q, %v, want client", got, err)
+	}
+
+	c, err = NewHTTPSClient(TLSOptions{RootCAs: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetchString(t, c, ts.URL); err == nil {
+		t.Error("Fetch without client certificate succeeded")
+	}
+}
@@ -137,6 +137,11 @@ type Config struct {
 	// and received.
 	LogLevel LogLevel
 
+	// HTTPBoot identifies the requests as those of a UEFI HTTP Boot
+	// client, so that servers answer with the URL of a file to boot
+	// rather than a TFTP file name.
+	HTTPBoot bool
+
 	// Modifiers4 allows modifications to the IPv4 DHCP request.
 	Modifiers4 []dhcpv4.Modifier
 
@@ -158,7 +163,7 @@ type Config struct {
 	V4ServerAddr *net.UDPAddr
 }
 
-func lease4(ctx context.Context, iface netlink.Link, c Config) (Lease, error) {
+func clientOpts4(c Config) []nclient4.ClientOpt {
 	mods := []nclient4.ClientOpt{
 		nclient4.WithTimeout(c.Timeout),
 		nclient4.WithRetry(c.Retries),
@@ -172,22 +177,30 @@ func lease4(ctx context.Context, iface netlink.Link, c Config) (Lease, error) {
 	if c.V4ServerAddr != nil {
 		mods = append(mods, nclient4.WithServerAddr(c.V4ServerAddr))
 	}
-	client, err := nclient4.New(iface.Attrs().Name, mods...)
+	return mods
+}
+
+func modifiers4(c Config) []dhcpv4.Modifier {
+	// Prepend modifiers with default options, so they can be overriden.
+	mods := []dhcpv4.Modifier{
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXE UROOT")),
+		dhcpv4.WithRequestedOptions(dhcpv4.OptionSubnetMask),
+		dhcpv4.WithNetboot,
+	}
+	if c.HTTPBoot {
+		mods = append(mods, httpModifiers4()...)
+	}
+	return append(mods, c.Modifiers4...)
+}
+
+func lease4(ctx context.Context, iface netlink.Link, c Config) (Lease, error) {
+	client, err := nclient4.New(iface.Attrs().Name, clientOpts4(c)...)
 	if err != nil {
 		return nil, err
 	}
 
-	// Prepend modifiers with default options, so they can be overriden.
-	reqmods := append(
-		[]dhcpv4.Modifier{
-			dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXE UROOT")),
-			dhcpv4.WithRequestedOptions(dhcpv4.OptionSubnetMask),
-			dhcpv4.WithNetboot,
-		},
-		c.Modifiers4...)
-
 	log.Printf("Attempting to get DHCPv4 lease on %s", iface.Attrs().Name)
-	_, p, err := client.Request(ctx, reqmods...)
+	_, p, err := client.Request(ctx, modifiers4(c)...)
 	if err != nil {
 		return nil, err
 	}
@@ -197,32 +210,34 @@ func lease4(ctx context.Context, iface netlink.Link, c Config) (Lease, error) {
 	return packet, nil
 }
 
-func lease6(ctx context.Context, iface netlink.Link, c Config, linkUpTimeout time.Duration) (Lease, error) {
+// waitIPv6Ready waits until iface has a non-tentative link-local IPv6
+// address, which DHCPv6 clients need to bind to.
+func waitIPv6Ready(ctx context.Context, iface netlink.Link, linkUpTimeout time.Duration) error {
 	// For ipv6, we cannot bind to the port until Duplicate Address
 	// Detection (DAD) is complete which is indicated by the link being no
 	// longer marked as "tentative". This usually takes about a second.
 
 	// If the link is never going to be ready, don't wait forever.
 	// (The user may not have configured a ctx with a timeout.)
-	//
-	// Hardcode the timeout to 30s for now.
 	linkTimeout := time.After(linkUpTimeout)
 	for {
 		if ready, err := isIpv6LinkReady(iface); err != nil {
-			return nil, err
+			return err
 		} else if ready {
-			break
+			return nil
 		}
 		select {
 		case <-time.After(100 * time.Millisecond):
 			continue
 		case <-linkTimeout:
-			return nil, errors.New("timeout after waiting for a non-tentative IPv6 address")
+			return errors.New("timeout after waiting for a non-tentative IPv6 address")
 		case <-ctx.Done():
-			return nil, errors.New("timeout after waiting for a non-tentative IPv6 address")
+			return errors.New("timeout after waiting for a non-tentative IPv6 address")
 		}
 	}
+}
 
+func clientOpts6(c Config) []nclient6.ClientOpt {
 	mods := []nclient6.ClientOpt{
 		nclient6.WithTimeout(c.Timeout),
 		nclient6.WithRetry(c.Retries),
@@ -236,20 +251,32 @@ func lease6(ctx context.Context, iface netlink.Link, c Config, linkUpTimeout tim
 	if c.V6ServerAddr != nil {
 		mods = append(mods, nclient6.WithBroadcastAddr(c.V6ServerAddr))
 	}
-	client, err := nclient6.New(iface.Attrs().Name, mods...)
-	if err != nil {
+	return mods
+}
+
+func modifiers6(c Config) []dhcpv6.Modifier {
+	// Prepend modifiers with default options, so they can be overriden.
+	mods := []dhcpv6.Modifier{
+		dhcpv6.WithNetboot,
+	}
+	if c.HTTPBoot {
+		mods = append(mods, httpModifiers6()...)
+	}
+	return append(mods, c.Modifiers6...)
+}
+
+func lease6(ctx context.Context, iface netlink.Link, c Config, linkUpTimeout time.Duration) (Lease, error) {
+	if err := waitIPv6Ready(ctx, iface, linkUpTimeout); err != nil {
 		return nil, err
 	}
 
-	// Prepend modifiers with default options, so they can be overriden.
-	reqmods := append(
-		[]dhcpv6.Modifier{
-			dhcpv6.WithNetboot,
-		},
-		c.Modifiers6...)
+	client, err := nclient6.New(iface.Attrs().Name, clientOpts6(c)...)
+	if err != nil {
+		return nil, err
+	}
 
 	log.Printf("Attempting to get DHCPv6 lease on %s", iface.Attrs().Name)
-	p, err := client.RapidSolicit(ctx, reqmods...)
+	p, err := client.RapidSolicit(ctx, modifiers6(c)...)
 	if err != nil {
 		return nil, err
 	}
@@ -278,7 +305,7 @@ func (n NetworkProtocol) String() string {
 	case NetBoth:
 		return "IPv4+IPv6"
 	}
-	return fmt.Sprintf("unknown network protocol (%#x)", n)
+	return fmt.Sprintf("unknown network protocol (%#x)", int(n))
 }
 
 // Result is the result of a particular DHCP attempt.
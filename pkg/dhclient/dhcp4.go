@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv6"
@@ -115,6 +116,38 @@ func (p *Packet4) Configure() error {
 	return nil
 }
 
+// Deconfigure removes the leased address from the interface, along with the
+// routes through it.
+func (p *Packet4) Deconfigure() error {
+	l := p.Lease()
+	if err := netlink.AddrDel(p.iface, &netlink.Addr{IPNet: l}); err != nil {
+		return fmt.Errorf("delete %s from %v: %v", l, p.iface, err)
+	}
+	return nil
+}
+
+// duration returns the duration in option code, or def.
+func (p *Packet4) duration(code dhcpv4.OptionCode, def time.Duration) time.Duration {
+	var d dhcpv4.Duration
+	if v := p.P.Options.Get(code); v == nil || d.FromBytes(v) != nil {
+		return def
+	}
+	return time.Duration(d)
+}
+
+// Timers returns the times after which the lease should be renewed with the
+// server that granted it (T1), renewed with any server (T2), and after which
+// it expires.
+//
+// Leases without a lease time never expire. As in RFC 2131, Section 4.4.5,
+// T1 and T2 default to 0.5 and 0.875 times the lease time.
+func (p *Packet4) Timers() (t1, t2, expiry time.Duration) {
+	expiry = p.P.IPAddressLeaseTime(dhcpv4.MaxLeaseTime)
+	t1 = p.duration(dhcpv4.OptionRenewTimeValue, expiry/2)
+	t2 = p.duration(dhcpv4.OptionRebindingTimeValue, expiry/8*7)
+	return t1, t2, expiry
+}
+
 func (p *Packet4) String() string {
 	return fmt.Sprintf("IPv4 DHCP Lease IP %s", p.Lease())
 }
@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"time"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv6"
@@ -90,6 +91,44 @@ func (p *Packet6) Configure() error {
 	return nil
 }
 
+// Deconfigure removes the leased address from the interface.
+func (p *Packet6) Deconfigure() error {
+	l := p.Lease()
+	if l == nil {
+		return fmt.Errorf("no lease returned")
+	}
+	dst := &netlink.Addr{
+		IPNet: &net.IPNet{
+			IP:   l.IPv6Addr,
+			Mask: net.CIDRMask(128, 128),
+		},
+	}
+	if err := netlink.AddrDel(p.iface, dst); err != nil {
+		return fmt.Errorf("delete %s from %v: %v", dst, p.iface, err)
+	}
+	return nil
+}
+
+// Timers returns the times after which the lease should be renewed with the
+// server that granted it (T1), renewed with any server (T2), and after which
+// the leased address is no longer valid.
+//
+// If the server leaves T1 and T2 to the client, they are 0.5 and 0.8 times
+// the preferred lifetime of the address, as suggested by RFC 8415, Section
+// 21.4.
+func (p *Packet6) Timers() (t1, t2, expiry time.Duration) {
+	l := p.Lease()
+	if l == nil {
+		return 0, 0, 0
+	}
+	iana := p.p.Options.OneIANA()
+	t1, t2 = iana.T1, iana.T2
+	if t1 == 0 || t2 == 0 || t1 > t2 {
+		t1, t2 = l.PreferredLifetime/2, l.PreferredLifetime/5*4
+	}
+	return t1, t2, l.ValidLifetime
+}
+
 func (p *Packet6) String() string {
 	return fmt.Sprintf("IPv6 DHCP Lease IP %s", p.Lease().IPv6Addr)
 }
@@ -0,0 +1,65 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dhclient
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// HTTPClient is the vendor class UEFI HTTP Boot clients identify with, and
+// servers answer them with.
+const HTTPClient = "HTTPClient"
+
+// enterpriseIntel is the enterprise number of DHCPv6 PXE and HTTP Boot vendor
+// classes.
+const enterpriseIntel = 343
+
+// httpArchs are the IANA processor architecture types of UEFI HTTP Boot
+// clients, by GOARCH.
+var httpArchs = map[string]iana.Arch{
+	"386":     0x0f,
+	"amd64":   0x10,
+	"arm":     0x12,
+	"arm64":   0x13,
+	"riscv64": 0x1c,
+}
+
+// httpArch returns the architecture type to request an HTTP boot file for.
+func httpArch() iana.Arch {
+	if a, ok := httpArchs[runtime.GOARCH]; ok {
+		return a
+	}
+	return httpArchs["amd64"]
+}
+
+// httpVendorClass returns the vendor class of a UEFI HTTP Boot client, as in
+// UEFI 2.8, Section 24.7.2.
+func httpVendorClass() string {
+	return fmt.Sprintf("%s:Arch:%05d:UNDI:003001", HTTPClient, httpArch())
+}
+
+func httpModifiers4() []dhcpv4.Modifier {
+	return []dhcpv4.Modifier{
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier(httpVendorClass())),
+		dhcpv4.WithOption(dhcpv4.OptClientArch(httpArch())),
+	}
+}
+
+func httpModifiers6() []dhcpv6.Modifier {
+	return []dhcpv6.Modifier{
+		func(d dhcpv6.DHCPv6) {
+			d.UpdateOption(&dhcpv6.OptVendorClass{
+				EnterpriseNumber: enterpriseIntel,
+				Data:             [][]byte{[]byte(httpVendorClass())},
+			})
+			d.UpdateOption(dhcpv6.OptClientArchType(httpArch()))
+		},
+	}
+}
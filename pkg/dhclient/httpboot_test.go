@@ -0,0 +1,48 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dhclient
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+func TestHTTPBootModifiers(t *testing.T) {
+	for _, tt := range []struct {
+		httpBoot bool
+		class    string
+	}{
+		{httpBoot: false, class: "PXE UROOT"},
+		{httpBoot: true, class: "HTTPClient:Arch:"},
+	} {
+		c := Config{HTTPBoot: tt.httpBoot}
+
+		m4, err := dhcpv4.New(modifiers4(c)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m4.ClassIdentifier(); !strings.HasPrefix(got, tt.class) {
+			t.Errorf("HTTPBoot=%t: DHCPv4 class identifier = %q, want prefix %q", tt.httpBoot, got, tt.class)
+		}
+		if archs := m4.ClientArch(); tt.httpBoot != (len(archs) == 1 && archs[0] == httpArch()) {
+			t.Errorf("HTTPBoot=%t: DHCPv4 client architecture = %v", tt.httpBoot, archs)
+		}
+
+		m6, err := dhcpv6.NewMessage(modifiers6(c)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vc, _ := m6.GetOneOption(dhcpv6.OptionVendorClass).(*dhcpv6.OptVendorClass)
+		if got := vc != nil && vc.EnterpriseNumber == enterpriseIntel && len(vc.Data) == 1 && string(vc.Data[0]) == httpVendorClass(); got != tt.httpBoot {
+			t.Errorf("HTTPBoot=%t: DHCPv6 vendor class = %v", tt.httpBoot, vc)
+		}
+		if archs := m6.Options.ArchTypes(); tt.httpBoot != (len(archs) == 1 && archs[0] == httpArch()) {
+			t.Errorf("HTTPBoot=%t: DHCPv6 client architecture = %v", tt.httpBoot, archs)
+		}
+	}
+}
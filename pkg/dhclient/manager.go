@@ -0,0 +1,491 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dhclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/nclient6"
+	"github.com/vishvananda/netlink"
+)
+
+// errLeaseLost is returned when the server refuses to extend a lease.
+var errLeaseLost = errors.New("server refused to extend the lease")
+
+// leaser is a DHCP client of one protocol that gets and extends leases.
+type leaser interface {
+	// request gets a new lease.
+	request(ctx context.Context) (Lease, error)
+
+	// renew extends l with the server that granted it, or with any server
+	// if rebind is true.
+	renew(ctx context.Context, l Lease, rebind bool) (Lease, error)
+
+	// release gives l back to the server that granted it.
+	release(l Lease) error
+
+	close() error
+}
+
+// timers returns T1, T2 and the expiry of l.
+func timers(l Lease) (t1, t2, expiry time.Duration) {
+	switch p := l.(type) {
+	case *Packet4:
+		return p.Timers()
+	case *Packet6:
+		return p.Timers()
+	}
+	return 0, 0, 0
+}
+
+// Manager keeps the DHCPv4 and DHCPv6 leases of a network interface alive.
+//
+// It gets a lease, renews it at T1 with the server that granted it, rebinds
+// it at T2 with any server, and gets a new lease once it expires or the server
+// refuses to extend it. Leases are released when the Manager stops.
+type Manager struct {
+	iface         netlink.Link
+	c             Config
+	linkUpTimeout time.Duration
+
+	// Configure applies new and extended leases to the interface. It
+	// defaults to Lease.Configure.
+	Configure func(Lease) error
+
+	// Deconfigure removes expired and released leases from the interface.
+	// It defaults to removing the leased address.
+	Deconfigure func(Lease) error
+
+	// listen4 and listen6 open the sockets of the DHCP clients.
+	listen4 func(ctx context.Context) (net.PacketConn, error)
+	listen6 func(ctx context.Context) (net.PacketConn, error)
+
+	// minRetry is the shortest time to wait before retrying a failed
+	// request.
+	minRetry time.Duration
+}
+
+// NewManager returns a Manager for the leases of iface, which must be up; see
+// IfUp.
+func NewManager(iface netlink.Link, c Config, linkUpTimeout time.Duration) *Manager {
+	m := &Manager{
+		iface:         iface,
+		c:             c,
+		linkUpTimeout: linkUpTimeout,
+		Configure: func(l Lease) error {
+			return l.Configure()
+		},
+		Deconfigure: deconfigure,
+		// RFC 2131, Section 4.4.5.
+		minRetry: time.Minute,
+	}
+	m.listen4 = func(ctx context.Context) (net.PacketConn, error) {
+		return nclient4.NewRawUDPConn(iface.Attrs().Name, nclient4.ClientPort)
+	}
+	m.listen6 = func(ctx context.Context) (net.PacketConn, error) {
+		if err := waitIPv6Ready(ctx, iface, linkUpTimeout); err != nil {
+			return nil, err
+		}
+		return nclient6.NewIPv6UDPConn(iface.Attrs().Name, dhcpv6.DefaultClientPort)
+	}
+	return m
+}
+
+func deconfigure(l Lease) error {
+	switch p := l.(type) {
+	case *Packet4:
+		return p.Deconfigure()
+	case *Packet6:
+		return p.Deconfigure()
+	}
+	return fmt.Errorf("cannot deconfigure %v", l)
+}
+
+// Run keeps the leases of the interface alive until ctx is done, and then
+// releases them.
+//
+// ipv4 and ipv6 determine whether to keep DHCPv4 and DHCPv6 leases,
+// respectively.
+func (m *Manager) Run(ctx context.Context, ipv4, ipv6 bool) {
+	var wg sync.WaitGroup
+	if ipv4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.keep(ctx, NetIPv4, m.dial4)
+		}()
+	}
+	if ipv6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.keep(ctx, NetIPv6, m.dial6)
+		}()
+	}
+	wg.Wait()
+}
+
+// sleep waits for d, and returns false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// keep gets leases with the client returned by dial and keeps them alive
+// until ctx is done.
+func (m *Manager) keep(ctx context.Context, proto NetworkProtocol, dial func(context.Context) (leaser, error)) {
+	name := m.iface.Attrs().Name
+
+	var c leaser
+	defer func() {
+		if c != nil {
+			c.close()
+		}
+	}()
+	for ctx.Err() == nil {
+		if c == nil {
+			var err error
+			if c, err = dial(ctx); err != nil {
+				log.Printf("Could not start %s client on %s: %v", proto, name, err)
+				sleep(ctx, m.minRetry)
+				continue
+			}
+		}
+
+		log.Printf("Attempting to get %s lease on %s", proto, name)
+		l, err := c.request(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Could not get %s lease on %s: %v", proto, name, err)
+				sleep(ctx, m.minRetry)
+			}
+			continue
+		}
+		log.Printf("Got %s lease on %s: %v", proto, name, l)
+		m.configure(l)
+		m.maintain(ctx, proto, c, l)
+	}
+}
+
+func (m *Manager) configure(l Lease) {
+	if err := m.Configure(l); err != nil {
+		log.Printf("Could not configure %s with %v: %v", m.iface.Attrs().Name, l, err)
+	}
+}
+
+func (m *Manager) deconfigure(l Lease) {
+	if err := m.Deconfigure(l); err != nil {
+		log.Printf("Could not deconfigure %s from %v: %v", m.iface.Attrs().Name, l, err)
+	}
+}
+
+func (m *Manager) release(proto NetworkProtocol, c leaser, l Lease) {
+	if err := c.release(l); err != nil {
+		log.Printf("Could not release %s lease on %s: %v", proto, m.iface.Attrs().Name, err)
+	} else {
+		log.Printf("Released %s lease on %s: %v", proto, m.iface.Attrs().Name, l)
+	}
+	m.deconfigure(l)
+}
+
+// maintain renews and rebinds l until it is lost, or until ctx is done and it
+// is released.
+func (m *Manager) maintain(ctx context.Context, proto NetworkProtocol, c leaser, l Lease) {
+	name := m.iface.Attrs().Name
+	start := time.Now()
+	t1, t2, expiry := timers(l)
+	for {
+		var rebind bool
+		var until time.Time
+		switch since := time.Since(start); {
+		case since >= expiry:
+			log.Printf("%s lease on %s expired: %v", proto, name, l)
+			m.deconfigure(l)
+			return
+
+		case since >= t2:
+			rebind, until = true, start.Add(expiry)
+
+		case since >= t1:
+			until = start.Add(t2)
+
+		default:
+			if !sleep(ctx, t1-since) {
+				m.release(proto, c, l)
+				return
+			}
+			continue
+		}
+
+		sent := time.Now()
+		rctx, cancel := context.WithDeadline(ctx, until)
+		renewed, err := c.renew(rctx, l, rebind)
+		cancel()
+		switch {
+		case err == nil:
+			log.Printf("Extended %s lease on %s: %v", proto, name, renewed)
+			l, start = renewed, sent
+			t1, t2, expiry = timers(l)
+			m.configure(l)
+			continue
+
+		case errors.Is(err, errLeaseLost):
+			log.Printf("Lost %s lease on %s: %v", proto, name, l)
+			m.deconfigure(l)
+			return
+
+		case ctx.Err() != nil:
+			m.release(proto, c, l)
+			return
+		}
+
+		// RFC 2131, Section 4.4.5: wait for half the time left until
+		// T2, or until the lease expires, but at least a minute.
+		left := time.Until(until)
+		log.Printf("Could not extend %s lease on %s, %v left: %v", proto, name, left.Round(time.Second), err)
+		wait := left / 2
+		if wait < m.minRetry {
+			wait = m.minRetry
+		}
+		if wait > left {
+			wait = left
+		}
+		if !sleep(ctx, wait) {
+			m.release(proto, c, l)
+			return
+		}
+	}
+}
+
+// client4 is a DHCPv4 leaser.
+type client4 struct {
+	iface  netlink.Link
+	conn   net.PacketConn
+	client *nclient4.Client
+	server *net.UDPAddr
+	mods   []dhcpv4.Modifier
+}
+
+func (m *Manager) dial4(ctx context.Context) (leaser, error) {
+	conn, err := m.listen4(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client, err := nclient4.NewWithConn(conn, m.iface.Attrs().HardwareAddr, clientOpts4(m.c)...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	server := m.c.V4ServerAddr
+	if server == nil {
+		server = nclient4.DefaultServers
+	}
+	return &client4{
+		iface:  m.iface,
+		conn:   conn,
+		client: client,
+		server: server,
+		mods:   modifiers4(m.c),
+	}, nil
+}
+
+func (c *client4) ack(p *dhcpv4.DHCPv4) (Lease, error) {
+	switch t := p.MessageType(); t {
+	case dhcpv4.MessageTypeAck:
+		return NewPacket4(c.iface, p), nil
+	case dhcpv4.MessageTypeNak:
+		return nil, errLeaseLost
+	default:
+		return nil, fmt.Errorf("got %s instead of an ACK", t)
+	}
+}
+
+func (c *client4) request(ctx context.Context) (Lease, error) {
+	_, ack, err := c.client.Request(ctx, c.mods...)
+	if err != nil {
+		return nil, err
+	}
+	return c.ack(ack)
+}
+
+// unicast returns the address of the server that granted l.
+func (c *client4) unicast(l *Packet4) *net.UDPAddr {
+	if sid := l.P.ServerIdentifier(); sid != nil {
+		return &net.UDPAddr{IP: sid, Port: c.server.Port}
+	}
+	return c.server
+}
+
+// renew sends a DHCPREQUEST in the RENEWING or REBINDING state, as in RFC
+// 2131, Section 4.3.2.
+func (c *client4) renew(ctx context.Context, l Lease, rebind bool) (Lease, error) {
+	p := l.(*Packet4)
+	req, err := dhcpv4.New(dhcpv4.PrependModifiers(c.mods,
+		dhcpv4.WithHwAddr(c.iface.Attrs().HardwareAddr),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithClientIP(p.P.YourIPAddr),
+		dhcpv4.WithOption(dhcpv4.OptMaxMessageSize(nclient4.MaxMessageSize)),
+	)...)
+	if err != nil {
+		return nil, err
+	}
+	dest := c.server
+	if !rebind {
+		dest = c.unicast(p)
+	}
+	ack, err := c.client.SendAndRead(ctx, dest, req, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.ack(ack)
+}
+
+// release sends a DHCPRELEASE. The server does not answer it.
+func (c *client4) release(l Lease) error {
+	p := l.(*Packet4)
+	req, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(c.iface.Attrs().HardwareAddr),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease),
+		dhcpv4.WithClientIP(p.P.YourIPAddr),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(p.P.ServerIdentifier())),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.WriteTo(req.ToBytes(), c.unicast(p))
+	return err
+}
+
+func (c *client4) close() error {
+	return c.client.Close()
+}
+
+// client6 is a DHCPv6 leaser.
+type client6 struct {
+	iface  netlink.Link
+	conn   net.PacketConn
+	client *nclient6.Client
+	server *net.UDPAddr
+	mods   []dhcpv6.Modifier
+}
+
+func (m *Manager) dial6(ctx context.Context) (leaser, error) {
+	conn, err := m.listen6(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client, err := nclient6.NewWithConn(conn, m.iface.Attrs().HardwareAddr, clientOpts6(m.c)...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	server := m.c.V6ServerAddr
+	if server == nil {
+		server = &net.UDPAddr{
+			IP:   dhcpv6.AllDHCPRelayAgentsAndServers,
+			Port: dhcpv6.DefaultServerPort,
+		}
+	}
+	return &client6{
+		iface:  m.iface,
+		conn:   conn,
+		client: client,
+		server: server,
+		mods:   modifiers6(m.c),
+	}, nil
+}
+
+func (c *client6) reply(p *dhcpv6.Message) (Lease, error) {
+	lease := NewPacket6(c.iface, p)
+	if lease.Lease() == nil {
+		// E.g. the server has no binding for the IA.
+		return nil, errLeaseLost
+	}
+	return lease, nil
+}
+
+func (c *client6) request(ctx context.Context) (Lease, error) {
+	p, err := c.client.RapidSolicit(ctx, c.mods...)
+	if err != nil {
+		return nil, err
+	}
+	return c.reply(p)
+}
+
+// message returns a message of type t about the lease l, to the server that
+// granted it if server is true.
+func (c *client6) message(t dhcpv6.MessageType, l Lease, server bool) (*dhcpv6.Message, error) {
+	p := l.(*Packet6).p
+	cid, sid, iana := p.GetOneOption(dhcpv6.OptionClientID), p.GetOneOption(dhcpv6.OptionServerID), p.Options.OneIANA()
+	if cid == nil || sid == nil || iana == nil {
+		return nil, fmt.Errorf("lease has no client ID, server ID or IA_NA")
+	}
+	msg, err := dhcpv6.NewMessage()
+	if err != nil {
+		return nil, err
+	}
+	msg.MessageType = t
+	msg.AddOption(cid)
+	if server {
+		msg.AddOption(sid)
+	}
+	msg.AddOption(dhcpv6.OptElapsedTime(0))
+	msg.AddOption(iana)
+	return msg, nil
+}
+
+// renew sends a Renew or Rebind message, as in RFC 8415, Sections 18.2.4 and
+// 18.2.5.
+func (c *client6) renew(ctx context.Context, l Lease, rebind bool) (Lease, error) {
+	t := dhcpv6.MessageTypeRenew
+	if rebind {
+		t = dhcpv6.MessageTypeRebind
+	}
+	msg, err := c.message(t, l, !rebind)
+	if err != nil {
+		return nil, err
+	}
+	msg.AddOption(dhcpv6.OptRequestedOption(
+		dhcpv6.OptionDNSRecursiveNameServer,
+		dhcpv6.OptionDomainSearchList,
+	))
+	for _, mod := range c.mods {
+		mod(msg)
+	}
+	reply, err := c.client.SendAndRead(ctx, c.server, msg, nclient6.IsMessageType(dhcpv6.MessageTypeReply))
+	if err != nil {
+		return nil, err
+	}
+	return c.reply(reply)
+}
+
+// release sends a Release message, without waiting for the reply.
+func (c *client6) release(l Lease) error {
+	msg, err := c.message(dhcpv6.MessageTypeRelease, l, true)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.WriteTo(msg.ToBytes(), c.server)
+	return err
+}
+
+func (c *client6) close() error {
+	return c.client.Close()
+}
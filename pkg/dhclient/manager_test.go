@@ -0,0 +1,343 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dhclient
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/server6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	testMAC   = net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+	testLink  = &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "test0", HardwareAddr: testMAC}}
+	testIP4   = net.IP{192, 0, 2, 10}
+	testIP6   = net.ParseIP("2001:db8::10")
+	serverIP4 = net.IP{127, 0, 0, 1}
+)
+
+// event is a call of Manager.Configure or Manager.Deconfigure.
+type event struct {
+	configure bool
+	ip        net.IP
+}
+
+// testManager returns a Manager that talks to servers over loopback sockets,
+// and reports how it configures the interface on events.
+func testManager(t *testing.T, c Config) (*Manager, chan event) {
+	events := make(chan event, 10)
+	ip := func(l Lease) net.IP {
+		switch p := l.(type) {
+		case *Packet4:
+			return p.Lease().IP
+		case *Packet6:
+			return p.Lease().IPv6Addr
+		}
+		t.Errorf("unknown lease %v", l)
+		return nil
+	}
+
+	c.Timeout = 200 * time.Millisecond
+	c.Retries = 2
+	m := NewManager(testLink, c, time.Second)
+	m.Configure = func(l Lease) error {
+		events <- event{true, ip(l)}
+		return nil
+	}
+	m.Deconfigure = func(l Lease) error {
+		events <- event{false, ip(l)}
+		return nil
+	}
+	m.listen4 = func(context.Context) (net.PacketConn, error) {
+		return net.ListenUDP("udp4", &net.UDPAddr{IP: serverIP4})
+	}
+	m.listen6 = func(context.Context) (net.PacketConn, error) {
+		return net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	}
+	m.minRetry = 100 * time.Millisecond
+	return m, events
+}
+
+func wantEvent(t *testing.T, events chan event, want event) {
+	t.Helper()
+	select {
+	case e := <-events:
+		if e.configure != want.configure || !e.ip.Equal(want.ip) {
+			t.Fatalf("got event %+v, want %+v", e, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %+v", want)
+	}
+}
+
+// eventually waits until the server has seen what the client sent.
+func eventually(t *testing.T, f func() bool) {
+	t.Helper()
+	for i := 0; i < 100 && !f(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testServer4 is a DHCPv4 server that hands out testIP4. It refuses to extend
+// leases if nak is set, and ignores attempts to if ignore is set.
+type testServer4 struct {
+	mu       sync.Mutex
+	nak      bool
+	ignore   bool
+	messages []*dhcpv4.DHCPv4
+}
+
+func (s *testServer4) handle(conn net.PacketConn, peer net.Addr, m *dhcpv4.DHCPv4) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, m)
+
+	var reply dhcpv4.MessageType
+	switch m.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		reply = dhcpv4.MessageTypeOffer
+	case dhcpv4.MessageTypeRequest:
+		reply = dhcpv4.MessageTypeAck
+		// A renewing or rebinding client has an address.
+		if !m.ClientIPAddr.Equal(net.IPv4zero) {
+			if s.ignore {
+				return
+			}
+			if s.nak {
+				reply = dhcpv4.MessageTypeNak
+			}
+		}
+	default:
+		return
+	}
+	resp, err := dhcpv4.NewReplyFromRequest(m,
+		dhcpv4.WithMessageType(reply),
+		dhcpv4.WithYourIP(testIP4),
+		dhcpv4.WithNetmask(net.CIDRMask(24, 32)),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverIP4)),
+		dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(3*time.Second)),
+		dhcpv4.WithGeneric(dhcpv4.OptionRenewTimeValue, dhcpv4.Duration(time.Second).ToBytes()),
+		dhcpv4.WithGeneric(dhcpv4.OptionRebindingTimeValue, dhcpv4.Duration(2*time.Second).ToBytes()),
+	)
+	if err != nil {
+		return
+	}
+	conn.WriteTo(resp.ToBytes(), peer)
+}
+
+func (s *testServer4) types() []dhcpv4.MessageType {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var types []dhcpv4.MessageType
+	for _, m := range s.messages {
+		types = append(types, m.MessageType())
+	}
+	return types
+}
+
+func (s *testServer4) last() *dhcpv4.DHCPv4 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.messages[len(s.messages)-1]
+}
+
+func startServer4(t *testing.T, s *testServer4) (*net.UDPAddr, func()) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: serverIP4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := server4.NewServer("", nil, s.handle, server4.WithConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	return conn.LocalAddr().(*net.UDPAddr), func() { server.Close() }
+}
+
+func TestManager4(t *testing.T) {
+	s := &testServer4{}
+	addr, stop := startServer4(t, s)
+	defer stop()
+
+	m, events := testManager(t, Config{V4ServerAddr: addr})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx, true, false)
+		close(done)
+	}()
+
+	wantEvent(t, events, event{true, testIP4})
+	// Renewed after T1.
+	wantEvent(t, events, event{true, testIP4})
+	req := s.last()
+	if req.MessageType() != dhcpv4.MessageTypeRequest || !req.ClientIPAddr.Equal(testIP4) || req.RequestedIPAddress() != nil {
+		t.Errorf("renewal is %s", req.Summary())
+	}
+
+	// Released once stopped.
+	cancel()
+	wantEvent(t, events, event{false, testIP4})
+	<-done
+	eventually(t, func() bool {
+		return s.last().MessageType() == dhcpv4.MessageTypeRelease
+	})
+	if req := s.last(); !req.ClientIPAddr.Equal(testIP4) || !req.ServerIdentifier().Equal(serverIP4) {
+		t.Errorf("release is %s", req.Summary())
+	}
+}
+
+func TestManager4Lost(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		s    *testServer4
+		want []dhcpv4.MessageType
+	}{
+		{
+			name: "nak",
+			s:    &testServer4{nak: true},
+			want: []dhcpv4.MessageType{
+				dhcpv4.MessageTypeDiscover,
+				dhcpv4.MessageTypeRequest,
+				dhcpv4.MessageTypeRequest,
+				dhcpv4.MessageTypeDiscover,
+			},
+		},
+		{
+			// The lease expires after renewing and rebinding
+			// failed.
+			name: "expired",
+			s:    &testServer4{ignore: true},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, stop := startServer4(t, tt.s)
+			defer stop()
+
+			m, events := testManager(t, Config{V4ServerAddr: addr})
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				m.Run(ctx, true, false)
+				close(done)
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			wantEvent(t, events, event{true, testIP4})
+			start := time.Now()
+			wantEvent(t, events, event{false, testIP4})
+			if tt.s.ignore && time.Since(start) < 2*time.Second {
+				t.Errorf("lease lost after %v, before it expired", time.Since(start))
+			}
+			// A new lease is requested.
+			wantEvent(t, events, event{true, testIP4})
+
+			if tt.want != nil {
+				if got := tt.s.types(); len(got) < len(tt.want) || !reflect.DeepEqual(got[:len(tt.want)], tt.want) {
+					t.Errorf("server got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// testServer6 is a DHCPv6 server that hands out testIP6 with rapid commit.
+type testServer6 struct {
+	mu    sync.Mutex
+	types []dhcpv6.MessageType
+}
+
+func (s *testServer6) handle(conn net.PacketConn, peer net.Addr, m dhcpv6.DHCPv6) {
+	msg, err := m.GetInnerMessage()
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.types = append(s.types, msg.MessageType)
+	s.mu.Unlock()
+
+	if msg.MessageType == dhcpv6.MessageTypeRelease {
+		return
+	}
+	reply, err := dhcpv6.NewReplyFromMessage(msg, dhcpv6.WithServerID(dhcpv6.Duid{
+		Type:          dhcpv6.DUID_LL,
+		HwType:        iana.HWTypeEthernet,
+		LinkLayerAddr: net.HardwareAddr{0x52, 0x54, 0x00, 0, 0, 1},
+	}))
+	if err != nil {
+		return
+	}
+	if cid := msg.GetOneOption(dhcpv6.OptionClientID); cid != nil {
+		reply.UpdateOption(cid)
+	}
+	iaid := [4]byte{1, 2, 3, 4}
+	if iana := msg.Options.OneIANA(); iana != nil {
+		iaid = iana.IaId
+	}
+	reply.AddOption(&dhcpv6.OptIANA{
+		IaId: iaid,
+		T1:   time.Second,
+		T2:   2 * time.Second,
+		Options: dhcpv6.IdentityOptions{Options: dhcpv6.Options{&dhcpv6.OptIAAddress{
+			IPv6Addr:          testIP6,
+			PreferredLifetime: 3 * time.Second,
+			ValidLifetime:     4 * time.Second,
+		}}},
+	})
+	conn.WriteTo(reply.ToBytes(), peer)
+}
+
+func TestManager6(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	s := &testServer6{}
+	server, err := server6.NewServer("", nil, s.handle, server6.WithConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Close()
+
+	m, events := testManager(t, Config{V6ServerAddr: conn.LocalAddr().(*net.UDPAddr)})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx, false, true)
+		close(done)
+	}()
+
+	wantEvent(t, events, event{true, testIP6})
+	wantEvent(t, events, event{true, testIP6})
+	cancel()
+	wantEvent(t, events, event{false, testIP6})
+	<-done
+
+	eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.types) >= 3
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	want := []dhcpv6.MessageType{dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRelease}
+	if !reflect.DeepEqual(s.types, want) {
+		t.Errorf("server got %v, want %v", s.types, want)
+	}
+}
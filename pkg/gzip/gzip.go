@@ -10,17 +10,28 @@ import (
 	"github.com/klauspost/pgzip"
 )
 
-// Compress takes input from io.Reader and deflates it using pgzip
-// to io.Writer. Data is compressed in blocksize (KB) chunks using
-// upto the number of CPU cores specified.
-func Compress(r io.Reader, w io.Writer, level int, blocksize int, processes int) error {
+// NewWriter returns a WriteCloser that deflates to w using pgzip. Data is
+// compressed in blocksize (KB) chunks using upto the number of CPU cores
+// specified. The output does not depend on the number of cores.
+func NewWriter(w io.Writer, level int, blocksize int, processes int) (io.WriteCloser, error) {
 	zw, err := pgzip.NewWriterLevel(w, level)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if err := zw.SetConcurrency(blocksize*1024, processes); err != nil {
 		zw.Close()
+		return nil, err
+	}
+	return zw, nil
+}
+
+// Compress takes input from io.Reader and deflates it using pgzip
+// to io.Writer. Data is compressed in blocksize (KB) chunks using
+// upto the number of CPU cores specified.
+func Compress(r io.Reader, w io.Writer, level int, blocksize int, processes int) error {
+	zw, err := NewWriter(w, level, blocksize, processes)
+	if err != nil {
 		return err
 	}
 
@@ -0,0 +1,52 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iscsi
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// chapMD5 is the CHAP_A value of MD5, the only algorithm iSCSI requires.
+const chapMD5 = "5"
+
+// chapResponse returns the CHAP response to challenge, RFC 1994 Section 4.1.
+func chapResponse(id byte, secret string, challenge []byte) []byte {
+	h := md5.New()
+	h.Write([]byte{id})
+	h.Write([]byte(secret))
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+// chapChallenge returns a random identifier and challenge to authenticate
+// the target with.
+func chapChallenge() (byte, []byte, error) {
+	b := make([]byte, 17)
+	if _, err := rand.Read(b); err != nil {
+		return 0, nil, err
+	}
+	return b[0], b[1:], nil
+}
+
+// parseBinary parses a binary value of a text key, which is hex encoded with
+// a 0x prefix or base64 encoded with a 0b prefix, RFC 7143 Section 6.1.
+func parseBinary(s string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0X"):
+		return hex.DecodeString(s[2:])
+	case strings.HasPrefix(s, "0b"), strings.HasPrefix(s, "0B"):
+		return base64.StdEncoding.DecodeString(s[2:])
+	}
+	return nil, fmt.Errorf("binary value %q is neither hex nor base64", s)
+}
+
+func formatBinary(b []byte) string {
+	return "0x" + hex.EncodeToString(b)
+}
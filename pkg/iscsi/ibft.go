@@ -0,0 +1,54 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iscsi
+
+import (
+	"encoding/binary"
+
+	"github.com/u-root/u-root/pkg/boot/ibft"
+)
+
+// CHAP types of iBFT targets.
+const (
+	ibftNoCHAP     = 0
+	ibftCHAP       = 1
+	ibftMutualCHAP = 2
+)
+
+// IBFT returns an iBFT that tells the next OS to boot from l, reaching the
+// target through nic.
+func (l *LUN) IBFT(nic ibft.NIC) *ibft.IBFT {
+	c := l.s.c
+	nic.Valid, nic.Boot = true, true
+	t := ibft.Target{
+		Valid:      true,
+		Boot:       true,
+		CHAP:       c.CHAPName != "",
+		RCHAP:      c.ReverseCHAPName != "",
+		Target:     c.Target,
+		TargetName: c.TargetName,
+		CHAPType:   ibftNoCHAP,
+
+		// The iBFT holds the LUN structure as it is on the wire.
+		BootLUN: binary.LittleEndian.Uint64(l.addr[:]),
+	}
+	if t.CHAP {
+		t.CHAPType = ibftCHAP
+		t.CHAPName, t.CHAPSecret = c.CHAPName, c.CHAPSecret
+	}
+	if t.RCHAP {
+		t.CHAPType = ibftMutualCHAP
+		t.ReverseCHAPName, t.ReverseCHAPSecret = c.ReverseCHAPName, c.ReverseCHAPSecret
+	}
+	return &ibft.IBFT{
+		Initiator: ibft.Initiator{
+			Name:  c.InitiatorName,
+			Valid: true,
+			Boot:  true,
+		},
+		NIC0:    nic,
+		Target0: t,
+	}
+}
@@ -0,0 +1,524 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package iscsi is an iSCSI initiator that runs over TCP in userspace.
+//
+// It logs into a target, optionally authenticating with CHAP, and reads and
+// writes its logical units with SCSI commands. A LUN is an io.ReaderAt and
+// io.WriterAt, so it can be inspected in place or exported to the kernel as a
+// block device, e.g. with package nbd.
+//
+// Only what booting from a target needs is implemented (RFC 7143): a single
+// connection per session, one outstanding command at a time, no header or
+// data digests, and error recovery level 0.
+package iscsi
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultInitiatorName is the initiator name used if Config.InitiatorName is
+// empty.
+const DefaultInitiatorName = "iqn.2020-01.org.u-root:initiator"
+
+// Login stages, RFC 7143 Section 11.12.3.
+const (
+	stageSecurity    = 0
+	stageOperational = 1
+	stageFullFeature = 3
+)
+
+const (
+	loginTransit  = 0x80
+	loginContinue = 0x40
+
+	// maxRecvData is the MaxRecvDataSegmentLength declared to targets.
+	maxRecvData = 256 << 10
+
+	// maxBurst is the MaxBurstLength offered to targets.
+	maxBurst = 256 << 10
+
+	// defaultMaxData is the MaxRecvDataSegmentLength of targets that do
+	// not declare one.
+	defaultMaxData = 8192
+
+	defaultTimeout = 30 * time.Second
+
+	// maxLoginExchanges bounds the requests of a login, so that a target
+	// cannot keep it from completing.
+	maxLoginExchanges = 16
+)
+
+// ErrClosed is returned for commands on a closed session.
+var ErrClosed = errors.New("iSCSI session is closed")
+
+// Config is the target to log into, and how.
+type Config struct {
+	// InitiatorName is the iSCSI name of this initiator. Targets may
+	// grant access by it. DefaultInitiatorName is used if it is empty.
+	InitiatorName string
+
+	// Target is the address of the target portal.
+	Target *net.TCPAddr
+
+	// TargetName is the iSCSI name of the target.
+	TargetName string
+
+	// CHAPName and CHAPSecret, if set, authenticate the initiator to the
+	// target with CHAP.
+	CHAPName   string
+	CHAPSecret string
+
+	// ReverseCHAPName and ReverseCHAPSecret, if set, authenticate the
+	// target to the initiator as well (mutual CHAP).
+	ReverseCHAPName   string
+	ReverseCHAPSecret string
+
+	// Timeout is how long to wait for the target to respond. Zero means
+	// 30 seconds.
+	Timeout time.Duration
+}
+
+// LoginError is a login the target refused, RFC 7143 Section 11.13.5.
+type LoginError struct {
+	Class  uint8
+	Detail uint8
+}
+
+var loginErrors = map[uint16]string{
+	0x0200: "initiator error",
+	0x0201: "authentication failure",
+	0x0202: "authorization failure",
+	0x0203: "target not found",
+	0x0204: "target removed",
+	0x0300: "target error",
+	0x0301: "service unavailable",
+	0x0302: "out of resources",
+}
+
+func (e *LoginError) Error() string {
+	if s, ok := loginErrors[uint16(e.Class)<<8|uint16(e.Detail)]; ok {
+		return fmt.Sprintf("login refused: %s", s)
+	}
+	return fmt.Sprintf("login refused with status class %d, detail %#x", e.Class, e.Detail)
+}
+
+// Session is a logged in session with a target.
+type Session struct {
+	c    Config
+	conn net.Conn
+
+	// mu serializes commands, and guards all fields below.
+	mu        sync.Mutex
+	closed    bool
+	isid      [6]byte
+	tsih      uint16
+	itt       uint32
+	cmdSN     uint32
+	expStatSN uint32
+
+	// maxSendData is the MaxRecvDataSegmentLength of the target.
+	maxSendData int
+
+	// maxBurst is the negotiated MaxBurstLength.
+	maxBurst int
+}
+
+// Dial connects to the target of c and logs into it.
+func Dial(ctx context.Context, c Config) (*Session, error) {
+	if c.Target == nil || c.TargetName == "" {
+		return nil, errors.New("iSCSI target address and name are required")
+	}
+	if c.InitiatorName == "" {
+		c.InitiatorName = DefaultInitiatorName
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultTimeout
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.Target.String())
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		c:           c,
+		conn:        conn,
+		maxSendData: defaultMaxData,
+		maxBurst:    maxBurst,
+	}
+	if err := s.login(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("logging into %s at %s: %w", c.TargetName, c.Target, err)
+	}
+	return s, nil
+}
+
+// Config returns the configuration the session logged in with.
+func (s *Session) Config() Config {
+	return s.c
+}
+
+func (s *Session) deadline(ctx context.Context) {
+	d := time.Now().Add(s.c.Timeout)
+	if cd, ok := ctx.Deadline(); ok && cd.Before(d) {
+		d = cd
+	}
+	s.conn.SetDeadline(d)
+}
+
+// nextITT returns a new initiator task tag.
+func (s *Session) nextITT() uint32 {
+	s.itt++
+	if s.itt == reservedTag {
+		s.itt = 0
+	}
+	return s.itt
+}
+
+// status updates the expected status sequence number from the StatSN of a
+// response.
+func (s *Session) status(p *pdu) {
+	s.expStatSN = p.uint32(24) + 1
+}
+
+// loginExchange sends a login request with keys in stage csg, asking to
+// transit to stage nsg if transit is set. It returns the final response and
+// the keys of all responses, following continued responses.
+func (s *Session) loginExchange(csg, nsg uint8, transit bool, itt uint32, keys []byte) (*pdu, map[string]string, error) {
+	var data []byte
+	for {
+		p := newPDU(opLogin, true)
+		p.bhs[1] = csg<<2 | nsg
+		if transit {
+			p.bhs[1] |= loginTransit
+		}
+		// The version is 0 in both VersionMax and VersionMin.
+		copy(p.bhs[8:14], s.isid[:])
+		p.bhs[14], p.bhs[15] = byte(s.tsih>>8), byte(s.tsih)
+		p.putUint32(16, itt)
+		p.putUint32(24, s.cmdSN)
+		p.putUint32(28, s.expStatSN)
+		p.data = keys
+		if err := p.writeTo(s.conn); err != nil {
+			return nil, nil, err
+		}
+
+		resp, err := readPDU(s.conn)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch resp.opcode() {
+		case opLoginResp:
+		case opReject:
+			return nil, nil, fmt.Errorf("login request rejected with reason %#x", resp.bhs[2])
+		default:
+			return nil, nil, fmt.Errorf("unexpected %v during login", resp)
+		}
+		if class := resp.bhs[36]; class != 0 {
+			return nil, nil, &LoginError{Class: class, Detail: resp.bhs[37]}
+		}
+		s.tsih = uint16(resp.bhs[14])<<8 | uint16(resp.bhs[15])
+		s.status(resp)
+		data = append(data, resp.data...)
+
+		// Continued responses are collected with empty requests.
+		if resp.flags()&loginContinue == 0 {
+			kv, err := parseTextKeys(data)
+			return resp, kv, err
+		}
+		keys, transit = nil, false
+	}
+}
+
+// login negotiates the security and operational parameters of the session,
+// RFC 7143 Section 6.
+func (s *Session) login(ctx context.Context) error {
+	if _, err := rand.Read(s.isid[1:]); err != nil {
+		return err
+	}
+	// A random ISID, Section 10.12.5.
+	s.isid[0] = 0x80
+	s.deadline(ctx)
+	defer s.conn.SetDeadline(time.Time{})
+
+	if err := s.loginSecurity(); err != nil {
+		return err
+	}
+	return s.loginOperational()
+}
+
+func (s *Session) loginSecurity() error {
+	chap := s.c.CHAPName != ""
+	mutual := s.c.ReverseCHAPName != ""
+	if mutual && !chap {
+		return errors.New("mutual CHAP requires CHAP")
+	}
+
+	method := "None"
+	if mutual {
+		// The target must authenticate itself.
+		method = "CHAP"
+	} else if chap {
+		method = "CHAP,None"
+	}
+	keys := textKeys(
+		"InitiatorName="+s.c.InitiatorName,
+		"InitiatorAlias=u-root",
+		"SessionType=Normal",
+		"TargetName="+s.c.TargetName,
+		"AuthMethod="+method,
+	)
+
+	var (
+		itt       = s.nextITT()
+		transit   = !chap
+		authed    = !chap
+		challenge []byte
+		id        byte
+
+		targetCHAP = make(map[string]string)
+	)
+	for i := 0; i < maxLoginExchanges; i++ {
+		resp, kv, err := s.loginExchange(stageSecurity, stageOperational, transit, itt, keys)
+		if err != nil {
+			return err
+		}
+		// The target may answer the challenge before it agrees to
+		// transit.
+		for k, v := range kv {
+			if k == "CHAP_N" || k == "CHAP_R" {
+				targetCHAP[k] = v
+			}
+		}
+		if resp.flags()&loginTransit != 0 {
+			if !authed {
+				return errors.New("target skipped CHAP authentication")
+			}
+			if mutual {
+				if err := s.checkTargetCHAP(targetCHAP, id, challenge); err != nil {
+					return err
+				}
+			}
+			if next := resp.flags() & 3; next != stageOperational {
+				return fmt.Errorf("target moved to login stage %d, want %d", next, stageOperational)
+			}
+			return nil
+		}
+
+		keys = nil
+		switch {
+		case kv["AuthMethod"] == "None":
+			if mutual {
+				return errors.New("target refused CHAP authentication")
+			}
+			authed, transit = true, true
+
+		case kv["AuthMethod"] == "CHAP":
+			keys = textKeys("CHAP_A=" + chapMD5)
+
+		case kv["CHAP_C"] != "":
+			if kv["CHAP_A"] != chapMD5 {
+				return fmt.Errorf("target chose unsupported CHAP algorithm %q", kv["CHAP_A"])
+			}
+			tid, err := strconv.ParseUint(kv["CHAP_I"], 0, 8)
+			if err != nil {
+				return fmt.Errorf("invalid CHAP_I %q", kv["CHAP_I"])
+			}
+			c, err := parseBinary(kv["CHAP_C"])
+			if err != nil {
+				return fmt.Errorf("invalid CHAP_C: %v", err)
+			}
+			kvs := []string{
+				"CHAP_N=" + s.c.CHAPName,
+				"CHAP_R=" + formatBinary(chapResponse(byte(tid), s.c.CHAPSecret, c)),
+			}
+			if mutual {
+				if id, challenge, err = chapChallenge(); err != nil {
+					return err
+				}
+				kvs = append(kvs, fmt.Sprintf("CHAP_I=%d", id), "CHAP_C="+formatBinary(challenge))
+			}
+			keys = textKeys(kvs...)
+			authed, transit = true, true
+
+		case kv["AuthMethod"] != "" && kv["AuthMethod"] != "None":
+			return fmt.Errorf("target chose unsupported AuthMethod %q", kv["AuthMethod"])
+
+		default:
+			// The target may take its time to agree to transit.
+			transit = authed
+		}
+	}
+	return errors.New("security negotiation did not complete")
+}
+
+// checkTargetCHAP verifies the CHAP response of the target to challenge.
+func (s *Session) checkTargetCHAP(kv map[string]string, id byte, challenge []byte) error {
+	if kv["CHAP_N"] != s.c.ReverseCHAPName {
+		return fmt.Errorf("target authenticated as %q, want %q", kv["CHAP_N"], s.c.ReverseCHAPName)
+	}
+	r, err := parseBinary(kv["CHAP_R"])
+	if err != nil {
+		return fmt.Errorf("invalid CHAP_R from target: %v", err)
+	}
+	if string(r) != string(chapResponse(id, s.c.ReverseCHAPSecret, challenge)) {
+		return errors.New("target failed mutual CHAP authentication")
+	}
+	return nil
+}
+
+func (s *Session) loginOperational() error {
+	keys := textKeys(
+		"HeaderDigest=None",
+		"DataDigest=None",
+		"MaxConnections=1",
+		"InitialR2T=Yes",
+		"ImmediateData=No",
+		"MaxRecvDataSegmentLength="+strconv.Itoa(maxRecvData),
+		"MaxBurstLength="+strconv.Itoa(maxBurst),
+		"FirstBurstLength="+strconv.Itoa(maxBurst),
+		"DefaultTime2Wait=0",
+		"DefaultTime2Retain=0",
+		"MaxOutstandingR2T=1",
+		"DataPDUInOrder=Yes",
+		"DataSequenceInOrder=Yes",
+		"ErrorRecoveryLevel=0",
+	)
+	itt := s.nextITT()
+	for i := 0; i < maxLoginExchanges; i++ {
+		resp, kv, err := s.loginExchange(stageOperational, stageFullFeature, true, itt, keys)
+		if err != nil {
+			return err
+		}
+		if err := s.negotiated(kv); err != nil {
+			return err
+		}
+		if resp.flags()&loginTransit != 0 && resp.flags()&3 == stageFullFeature {
+			// Commands start at the sequence number the target
+			// expects.
+			s.cmdSN = resp.uint32(28)
+			return nil
+		}
+		keys = nil
+	}
+	return errors.New("operational negotiation did not complete")
+}
+
+// negotiated applies the parameters the target responded with.
+func (s *Session) negotiated(kv map[string]string) error {
+	for k, v := range kv {
+		switch k {
+		case "HeaderDigest", "DataDigest":
+			if v != "None" {
+				return fmt.Errorf("target requires %s %s", k, v)
+			}
+		case "MaxRecvDataSegmentLength":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 512 {
+				return fmt.Errorf("invalid %s=%s", k, v)
+			}
+			s.maxSendData = n
+		case "MaxBurstLength":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 512 {
+				return fmt.Errorf("invalid %s=%s", k, v)
+			}
+			if n < s.maxBurst {
+				s.maxBurst = n
+			}
+		case "ErrorRecoveryLevel":
+			if v != "0" {
+				return fmt.Errorf("target requires %s %s", k, v)
+			}
+		}
+	}
+	return nil
+}
+
+// Close logs out of the session and closes the connection.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.closed = true
+	err := s.logout()
+	if cerr := s.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// logout closes the session, RFC 7143 Section 11.14.
+func (s *Session) logout() error {
+	s.deadline(context.Background())
+	itt := s.nextITT()
+	p := newPDU(opLogout, true)
+	// Reason code 0 closes the session.
+	p.bhs[1] = finalBit
+	p.putUint32(16, itt)
+	p.putUint32(24, s.cmdSN)
+	p.putUint32(28, s.expStatSN)
+	if err := p.writeTo(s.conn); err != nil {
+		return err
+	}
+	for {
+		resp, err := s.recv()
+		if err != nil {
+			return err
+		}
+		if resp.opcode() != opLogoutResp || resp.itt() != itt {
+			continue
+		}
+		if r := resp.bhs[2]; r != 0 {
+			return fmt.Errorf("logout failed with response %d", r)
+		}
+		return nil
+	}
+}
+
+// recv returns the next PDU from the target, answering pings and skipping
+// asynchronous messages along the way.
+func (s *Session) recv() (*pdu, error) {
+	for {
+		p, err := readPDU(s.conn)
+		if err != nil {
+			return nil, err
+		}
+		switch p.opcode() {
+		case opNOPIn:
+			ttt := p.uint32(20)
+			if ttt == reservedTag {
+				continue
+			}
+			// Echo the ping, Section 11.18.
+			r := newPDU(opNOPOut, true)
+			r.bhs[1] = finalBit
+			copy(r.bhs[8:16], p.bhs[8:16])
+			r.putUint32(16, reservedTag)
+			r.putUint32(20, ttt)
+			r.putUint32(24, s.cmdSN)
+			r.putUint32(28, s.expStatSN)
+			r.data = p.data
+			if err := r.writeTo(s.conn); err != nil {
+				return nil, err
+			}
+			continue
+
+		case opAsync:
+			s.status(p)
+			continue
+		}
+		return p, nil
+	}
+}
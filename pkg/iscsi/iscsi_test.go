@@ -0,0 +1,641 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iscsi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/boot/ibft"
+)
+
+const testTargetName = "iqn.2020-01.org.u-root:test"
+
+// testTarget is an in-memory iSCSI target with a single LUN 0.
+type testTarget struct {
+	disk      []byte
+	blockSize int
+
+	// maxRecvData and maxBurst are declared to initiators.
+	maxRecvData int
+	maxBurst    int
+
+	chapName, chapSecret       string
+	reverseName, reverseSecret string
+
+	// unitAttention fails the first command with a unit attention.
+	unitAttention bool
+
+	// ping pings the initiator before responding to each command.
+	ping bool
+
+	// capacity16 makes initiators use READ CAPACITY (16).
+	capacity16 bool
+
+	mu     sync.Mutex
+	pongs  int
+	logout bool
+}
+
+func (t *testTarget) start(tb testing.TB) (*net.TCPAddr, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := t.serve(conn); err != nil && err != io.EOF {
+					tb.Logf("target: %v", err)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr), func() { ln.Close() }
+}
+
+// targetConn is the state of a connection to testTarget.
+type targetConn struct {
+	t      *testTarget
+	conn   net.Conn
+	statSN uint32
+	cmdSN  uint32
+}
+
+func (c *targetConn) send(p *pdu, itt uint32) error {
+	p.putUint32(16, itt)
+	p.putUint32(24, c.statSN)
+	p.putUint32(28, c.cmdSN)
+	p.putUint32(32, c.cmdSN+16)
+	return p.writeTo(c.conn)
+}
+
+// next returns the next PDU from the initiator, other than ping responses.
+func (c *targetConn) next() (*pdu, error) {
+	for {
+		p, err := readPDU(c.conn)
+		if err != nil {
+			return nil, err
+		}
+		if p.opcode() != opNOPOut {
+			return p, nil
+		}
+		if p.uint32(20) != 0x1234 || string(p.data) != "ping" {
+			return nil, fmt.Errorf("bad ping response %v", p)
+		}
+		c.t.mu.Lock()
+		c.t.pongs++
+		c.t.mu.Unlock()
+	}
+}
+
+func (t *testTarget) serve(conn net.Conn) error {
+	c := &targetConn{t: t, conn: conn}
+	if err := c.login(); err != nil {
+		return err
+	}
+
+	attention := t.unitAttention
+	for {
+		p, err := c.next()
+		if err != nil {
+			return err
+		}
+		switch p.opcode() {
+		case opSCSICmd:
+			c.cmdSN = p.uint32(24) + 1
+			if t.ping {
+				ping := newPDU(opNOPIn, false)
+				ping.bhs[1] = finalBit
+				ping.putUint32(20, 0x1234)
+				ping.data = []byte("ping")
+				if err := c.send(ping, reservedTag); err != nil {
+					return err
+				}
+			}
+			if attention {
+				attention = false
+				// POWER ON, RESET, OR BUS DEVICE RESET OCCURRED.
+				sense := make([]byte, 18)
+				sense[0], sense[2], sense[12] = 0x70, senseUnitAttention, 0x29
+				if err := c.respond(p, statusCheckCondition, sense); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := c.command(p); err != nil {
+				return err
+			}
+
+		case opLogout:
+			t.mu.Lock()
+			t.logout = true
+			t.mu.Unlock()
+			r := newPDU(opLogoutResp, false)
+			r.bhs[1] = finalBit
+			return c.send(r, p.itt())
+
+		default:
+			return fmt.Errorf("unexpected %v", p)
+		}
+	}
+}
+
+func (c *targetConn) loginResponse(req *pdu, flags byte, keys []byte, class, detail byte) error {
+	r := newPDU(opLoginResp, false)
+	r.bhs[1] = flags
+	copy(r.bhs[8:14], req.bhs[8:14])
+	r.bhs[15] = 1
+	r.bhs[36], r.bhs[37] = class, detail
+	r.data = keys
+	c.cmdSN = req.uint32(24)
+	err := c.send(r, req.itt())
+	c.statSN++
+	return err
+}
+
+func (c *targetConn) login() error {
+	t := c.t
+	challenge := []byte("0123456789abcdef")
+	for {
+		req, err := c.next()
+		if err != nil {
+			return err
+		}
+		if req.opcode() != opLogin || req.bhs[0]&immediateBit == 0 {
+			return fmt.Errorf("unexpected %v during login", req)
+		}
+		kv, err := parseTextKeys(req.data)
+		if err != nil {
+			return err
+		}
+		csg, transit := req.flags()>>2&3, req.flags()&loginTransit != 0
+
+		var keys []byte
+		switch csg {
+		case stageSecurity:
+			switch {
+			case kv["CHAP_R"] != "":
+				r, _ := parseBinary(kv["CHAP_R"])
+				if kv["CHAP_N"] != t.chapName || !bytes.Equal(r, chapResponse(7, t.chapSecret, challenge)) {
+					return c.loginResponse(req, 0, nil, 2, 1)
+				}
+				if kv["CHAP_C"] != "" {
+					id, _ := strconv.Atoi(kv["CHAP_I"])
+					ic, _ := parseBinary(kv["CHAP_C"])
+					keys = textKeys("CHAP_N="+t.reverseName, "CHAP_R="+formatBinary(chapResponse(byte(id), t.reverseSecret, ic)))
+				}
+			case kv["CHAP_A"] != "":
+				keys = textKeys("CHAP_A=5", "CHAP_I=7", "CHAP_C="+formatBinary(challenge))
+				transit = false
+			case t.chapName != "":
+				if kv["AuthMethod"] != "CHAP" && kv["AuthMethod"] != "CHAP,None" {
+					return c.loginResponse(req, 0, nil, 2, 1)
+				}
+				keys = textKeys("AuthMethod=CHAP")
+				transit = false
+			default:
+				keys = textKeys("AuthMethod=None")
+			}
+			flags := csg << 2
+			if transit {
+				flags |= loginTransit | stageOperational
+			}
+			if err := c.loginResponse(req, flags, keys, 0, 0); err != nil {
+				return err
+			}
+
+		case stageOperational:
+			if kv["HeaderDigest"] != "None" || kv["ImmediateData"] != "No" {
+				return fmt.Errorf("unexpected operational keys %v", kv)
+			}
+			keys = textKeys(
+				"HeaderDigest=None",
+				"DataDigest=None",
+				"MaxRecvDataSegmentLength="+strconv.Itoa(t.maxRecvData),
+				"MaxBurstLength="+strconv.Itoa(t.maxBurst),
+				"ErrorRecoveryLevel=0",
+			)
+			return c.loginResponse(req, loginTransit|stageOperational<<2|stageFullFeature, keys, 0, 0)
+		}
+	}
+}
+
+func (c *targetConn) respond(cmd *pdu, status byte, sense []byte) error {
+	r := newPDU(opSCSIResp, false)
+	r.bhs[1] = finalBit
+	r.bhs[3] = status
+	if sense != nil {
+		r.data = append([]byte{0, byte(len(sense))}, sense...)
+	}
+	err := c.send(r, cmd.itt())
+	c.statSN++
+	return err
+}
+
+func (c *targetConn) command(p *pdu) error {
+	t := c.t
+	cdb := p.bhs[32:48]
+	blocks := uint64(len(t.disk) / t.blockSize)
+
+	var lba, count uint64
+	switch cdb[0] {
+	case opRead10, opWrite10:
+		lba, count = uint64(binary.BigEndian.Uint32(cdb[2:])), uint64(binary.BigEndian.Uint16(cdb[7:]))
+	case opRead16, opWrite16:
+		lba, count = binary.BigEndian.Uint64(cdb[2:]), uint64(binary.BigEndian.Uint32(cdb[10:]))
+	}
+	if (lba+count)*uint64(t.blockSize) > uint64(len(t.disk)) {
+		return fmt.Errorf("access of %d blocks at %d beyond the disk", count, lba)
+	}
+	data := t.disk[lba*uint64(t.blockSize) : (lba+count)*uint64(t.blockSize)]
+
+	switch cdb[0] {
+	case opReadCapacity10:
+		b := make([]byte, 8)
+		last := uint32(blocks - 1)
+		if t.capacity16 {
+			last = 0xffffffff
+		}
+		binary.BigEndian.PutUint32(b, last)
+		binary.BigEndian.PutUint32(b[4:], uint32(t.blockSize))
+		return c.dataIn(p, b)
+
+	case opServiceAction16:
+		b := make([]byte, 32)
+		binary.BigEndian.PutUint64(b, blocks-1)
+		binary.BigEndian.PutUint32(b[8:], uint32(t.blockSize))
+		return c.dataIn(p, b)
+
+	case opRead10, opRead16:
+		return c.dataIn(p, data)
+
+	case opWrite10, opWrite16:
+		if edtl := int(p.uint32(20)); edtl != len(data) {
+			return fmt.Errorf("expected data transfer length is %d, want %d", edtl, len(data))
+		}
+		for off, sn := 0, uint32(0); off < len(data); sn++ {
+			length := len(data) - off
+			if length > t.maxBurst {
+				length = t.maxBurst
+			}
+			r2t := newPDU(opR2T, false)
+			r2t.bhs[1] = finalBit
+			r2t.putUint32(20, 0x100+sn)
+			r2t.putUint32(36, sn)
+			r2t.putUint32(40, uint32(off))
+			r2t.putUint32(44, uint32(length))
+			if err := c.send(r2t, p.itt()); err != nil {
+				return err
+			}
+			for end := off + length; off < end; {
+				d, err := c.next()
+				if err != nil {
+					return err
+				}
+				if d.opcode() != opDataOut || d.uint32(20) != 0x100+sn || int(d.uint32(40)) != off {
+					return fmt.Errorf("unexpected %v for R2T %d at %d", d, sn, off)
+				}
+				if len(d.data) > t.maxRecvData {
+					return fmt.Errorf("data-out of %d bytes, more than %d", len(d.data), t.maxRecvData)
+				}
+				off += copy(data[off:end], d.data)
+				if d.final() != (off == end) {
+					return fmt.Errorf("data-out at %d of %d has final bit %v", off, end, d.final())
+				}
+			}
+		}
+		return c.respond(p, statusGood, nil)
+
+	case opSyncCache10:
+		return c.respond(p, statusGood, nil)
+	}
+
+	// INVALID COMMAND OPERATION CODE.
+	sense := make([]byte, 18)
+	sense[0], sense[2], sense[12] = 0x70, 0x5, 0x20
+	return c.respond(p, statusCheckCondition, sense)
+}
+
+// dataIn sends data in odd sized chunks, with the status in the last.
+func (c *targetConn) dataIn(cmd *pdu, data []byte) error {
+	const chunk = 1001
+	for off := 0; ; off += chunk {
+		p := newPDU(opDataIn, false)
+		p.putUint32(40, uint32(off))
+		end := off + chunk
+		if end >= len(data) {
+			end = len(data)
+			p.bhs[1] = finalBit | dataInStatus
+		}
+		p.data = data[off:end]
+		if err := c.send(p, cmd.itt()); err != nil {
+			return err
+		}
+		if end == len(data) {
+			c.statSN++
+			return nil
+		}
+	}
+}
+
+func newTestTarget() *testTarget {
+	t := &testTarget{
+		disk:        make([]byte, 64<<10),
+		blockSize:   512,
+		maxRecvData: 4096,
+		maxBurst:    8192,
+	}
+	for i := range t.disk {
+		t.disk[i] = byte(i * 7)
+	}
+	return t
+}
+
+func dial(t *testing.T, addr *net.TCPAddr, c Config) *Session {
+	t.Helper()
+	c.Target = addr
+	c.TargetName = testTargetName
+	s, err := Dial(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestReadWrite(t *testing.T) {
+	target := newTestTarget()
+	target.unitAttention = true
+	target.ping = true
+	addr, stop := target.start(t)
+	defer stop()
+
+	s := dial(t, addr, Config{})
+	lun, err := s.OpenLUN(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lun.Size() != int64(len(target.disk)) || lun.BlockSize() != 512 {
+		t.Fatalf("LUN has %d bytes in blocks of %d, want %d in blocks of 512", lun.Size(), lun.BlockSize(), len(target.disk))
+	}
+
+	want := append([]byte(nil), target.disk...)
+	for _, tt := range []struct {
+		off, n int
+	}{
+		{0, len(want)},
+		{1000, 100},
+		{511, 2},
+		{4096, 20000},
+	} {
+		got := make([]byte, tt.n)
+		if _, err := lun.ReadAt(got, int64(tt.off)); err != nil {
+			t.Errorf("ReadAt(%d bytes, %d) = %v", tt.n, tt.off, err)
+		} else if !bytes.Equal(got, want[tt.off:tt.off+tt.n]) {
+			t.Errorf("ReadAt(%d bytes, %d) read wrong data", tt.n, tt.off)
+		}
+	}
+	tail := make([]byte, 100)
+	if n, err := lun.ReadAt(tail, lun.Size()-10); n != 10 || err != io.EOF {
+		t.Errorf("ReadAt at the end = (%d, %v), want (10, EOF)", n, err)
+	}
+
+	for _, tt := range []struct {
+		off, n int
+	}{
+		{700, 3000},
+		{8192, 20480},
+		{65535, 1},
+	} {
+		data := bytes.Repeat([]byte{byte(tt.n)}, tt.n)
+		if _, err := lun.WriteAt(data, int64(tt.off)); err != nil {
+			t.Fatalf("WriteAt(%d bytes, %d) = %v", tt.n, tt.off, err)
+		}
+		copy(want[tt.off:], data)
+	}
+	if !bytes.Equal(target.disk, want) {
+		t.Errorf("disk does not hold the written data")
+	}
+	if _, err := lun.WriteAt(make([]byte, 2), lun.Size()-1); err == nil {
+		t.Errorf("WriteAt beyond the end succeeded")
+	}
+	if err := lun.Sync(); err != nil {
+		t.Errorf("Sync() = %v", err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if _, err := lun.ReadAt(tail, 0); err != ErrClosed {
+		t.Errorf("ReadAt after Close = %v, want %v", err, ErrClosed)
+	}
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	if !target.logout {
+		t.Errorf("session was not logged out")
+	}
+	if target.pongs == 0 {
+		t.Errorf("pings were not answered")
+	}
+}
+
+func TestCapacity16(t *testing.T) {
+	target := newTestTarget()
+	target.capacity16 = true
+	addr, stop := target.start(t)
+	defer stop()
+
+	s := dial(t, addr, Config{})
+	defer s.Close()
+	lun, err := s.OpenLUN(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lun.Size() != int64(len(target.disk)) {
+		t.Errorf("LUN has %d bytes, want %d", lun.Size(), len(target.disk))
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	target := newTestTarget()
+	addr, stop := target.start(t)
+	defer stop()
+
+	s := dial(t, addr, Config{})
+	defer s.Close()
+	_, err := s.do(context.Background(), &command{cdb: []byte{0xff, 5: 0}})
+	want := &SCSIError{Status: statusCheckCondition, SenseKey: 0x5, ASC: 0x20}
+	if e, ok := err.(*SCSIError); !ok || *e != *want {
+		t.Errorf("unknown command = %v, want %v", err, want)
+	}
+
+	// The session survives SCSI errors.
+	if _, err := s.OpenLUN(context.Background(), 0); err != nil {
+		t.Errorf("OpenLUN() = %v", err)
+	}
+}
+
+func TestCHAP(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		c      Config
+		target *testTarget
+		auth   bool
+	}{
+		{
+			name:   "chap",
+			c:      Config{CHAPName: "user", CHAPSecret: "secretsecret"},
+			target: &testTarget{chapName: "user", chapSecret: "secretsecret"},
+		},
+		{
+			name:   "wrong secret",
+			c:      Config{CHAPName: "user", CHAPSecret: "wrongwrongwrong"},
+			target: &testTarget{chapName: "user", chapSecret: "secretsecret"},
+			auth:   true,
+		},
+		{
+			name:   "chap required",
+			target: &testTarget{chapName: "user", chapSecret: "secretsecret"},
+			auth:   true,
+		},
+		{
+			name: "mutual",
+			c: Config{
+				CHAPName: "user", CHAPSecret: "secretsecret",
+				ReverseCHAPName: "target", ReverseCHAPSecret: "targetsecret",
+			},
+			target: &testTarget{
+				chapName: "user", chapSecret: "secretsecret",
+				reverseName: "target", reverseSecret: "targetsecret",
+			},
+		},
+		{
+			name: "impostor",
+			c: Config{
+				CHAPName: "user", CHAPSecret: "secretsecret",
+				ReverseCHAPName: "target", ReverseCHAPSecret: "targetsecret",
+			},
+			target: &testTarget{
+				chapName: "user", chapSecret: "secretsecret",
+				reverseName: "target", reverseSecret: "guessedsecret",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newTestTarget()
+			target.chapName, target.chapSecret = tt.target.chapName, tt.target.chapSecret
+			target.reverseName, target.reverseSecret = tt.target.reverseName, tt.target.reverseSecret
+			addr, stop := target.start(t)
+			defer stop()
+
+			tt.c.Target, tt.c.TargetName = addr, testTargetName
+			s, err := Dial(context.Background(), tt.c)
+			wantErr := tt.auth || tt.target.reverseSecret != tt.c.ReverseCHAPSecret
+			if wantErr {
+				if err == nil {
+					s.Close()
+					t.Fatalf("Dial succeeded")
+				}
+				var le *LoginError
+				if tt.auth && (!errors.As(err, &le) || le.Class != 2 || le.Detail != 1) {
+					t.Errorf("Dial = %v, want an authentication failure", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Close(); err != nil {
+				t.Errorf("Close() = %v", err)
+			}
+		})
+	}
+}
+
+func TestLUNAddress(t *testing.T) {
+	for _, tt := range []struct {
+		lun  uint64
+		want [8]byte
+	}{
+		{0, [8]byte{}},
+		{5, [8]byte{0, 5}},
+		{300, [8]byte{0x41, 0x2c}},
+	} {
+		got, err := lunAddress(tt.lun)
+		if err != nil || got != tt.want {
+			t.Errorf("lunAddress(%d) = %x, %v, want %x", tt.lun, got, err, tt.want)
+		}
+	}
+	if _, err := lunAddress(1 << 14); err == nil {
+		t.Errorf("lunAddress(%d) succeeded", 1<<14)
+	}
+}
+
+func TestIBFT(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: 3260}
+	lun := &LUN{
+		s: &Session{c: Config{
+			InitiatorName: "iqn.2020-01.org.u-root:test-initiator",
+			Target:        addr,
+			TargetName:    testTargetName,
+			CHAPName:      "user",
+			CHAPSecret:    "secretsecret",
+		}},
+		Number: 1,
+		addr:   [8]byte{0, 1},
+	}
+	got := lun.IBFT(ibft.NIC{MACAddress: net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x56}})
+	if !got.Initiator.Valid || got.Initiator.Name != "iqn.2020-01.org.u-root:test-initiator" {
+		t.Errorf("initiator = %+v", got.Initiator)
+	}
+	if !got.NIC0.Valid || !got.NIC0.Boot || got.NIC0.MACAddress == nil {
+		t.Errorf("NIC = %+v", got.NIC0)
+	}
+	want := ibft.Target{
+		Valid:      true,
+		Boot:       true,
+		CHAP:       true,
+		Target:     addr,
+		BootLUN:    0x100,
+		CHAPType:   ibftCHAP,
+		TargetName: testTargetName,
+		CHAPName:   "user",
+		CHAPSecret: "secretsecret",
+	}
+	if fmt.Sprintf("%+v", got.Target0) != fmt.Sprintf("%+v", want) {
+		t.Errorf("target = %+v, want %+v", got.Target0, want)
+	}
+}
+
+func TestParseTextKeys(t *testing.T) {
+	got, err := parseTextKeys([]byte("TargetAlias=disk\x00MaxBurstLength=262144\x00TargetAddress=[::1]:3260,1\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"TargetAlias":    "disk",
+		"MaxBurstLength": "262144",
+		"TargetAddress":  "[::1]:3260,1",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("parseTextKeys = %v, want %v", got, want)
+	}
+	if _, err := parseTextKeys([]byte("novalue\x00")); err == nil {
+		t.Errorf("parseTextKeys of a key without value succeeded")
+	}
+}
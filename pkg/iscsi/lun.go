@@ -0,0 +1,255 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iscsi
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SCSI operation codes, SBC-3.
+const (
+	opReadCapacity10  = 0x25
+	opRead10          = 0x28
+	opWrite10         = 0x2a
+	opSyncCache10     = 0x35
+	opRead16          = 0x88
+	opWrite16         = 0x8a
+	opServiceAction16 = 0x9e
+
+	// saReadCapacity16 is the service action of READ CAPACITY (16).
+	saReadCapacity16 = 0x10
+
+	// maxTransferBlocks is the most blocks a READ (10) can transfer.
+	maxTransferBlocks = 0xffff
+)
+
+// LUN is a logical unit of a target. It reads and writes like a disk of
+// Size bytes.
+type LUN struct {
+	s *Session
+
+	// Number is the logical unit number.
+	Number uint64
+
+	addr      [8]byte
+	blockSize int64
+	blocks    int64
+}
+
+var (
+	_ io.ReaderAt = &LUN{}
+	_ io.WriterAt = &LUN{}
+)
+
+// lunAddress returns the 8 byte LUN structure of lun, SAM-5 Section 4.7.
+func lunAddress(lun uint64) ([8]byte, error) {
+	var a [8]byte
+	switch {
+	case lun < 256:
+		// Peripheral device addressing.
+		a[1] = byte(lun)
+	case lun < 1<<14:
+		// Flat space addressing.
+		a[0] = 0x40 | byte(lun>>8)
+		a[1] = byte(lun)
+	default:
+		return a, fmt.Errorf("LUN %d is out of range", lun)
+	}
+	return a, nil
+}
+
+// OpenLUN returns logical unit lun of the target, and reads its capacity.
+func (s *Session) OpenLUN(ctx context.Context, lun uint64) (*LUN, error) {
+	addr, err := lunAddress(lun)
+	if err != nil {
+		return nil, err
+	}
+	l := &LUN{s: s, Number: lun, addr: addr}
+
+	buf := make([]byte, 8)
+	if _, err := s.do(ctx, &command{lun: addr, cdb: []byte{opReadCapacity10, 9: 0}, in: buf}); err != nil {
+		return nil, fmt.Errorf("READ CAPACITY (10): %w", err)
+	}
+	last := uint64(binary.BigEndian.Uint32(buf))
+	l.blockSize = int64(binary.BigEndian.Uint32(buf[4:]))
+
+	// Units of 2 TiB and more need READ CAPACITY (16).
+	if last == 0xffffffff {
+		cdb := make([]byte, 16)
+		cdb[0], cdb[1] = opServiceAction16, saReadCapacity16
+		buf = make([]byte, 32)
+		binary.BigEndian.PutUint32(cdb[10:], uint32(len(buf)))
+		if _, err := s.do(ctx, &command{lun: addr, cdb: cdb, in: buf}); err != nil {
+			return nil, fmt.Errorf("READ CAPACITY (16): %w", err)
+		}
+		last = binary.BigEndian.Uint64(buf)
+		l.blockSize = int64(binary.BigEndian.Uint32(buf[8:]))
+	}
+	if l.blockSize == 0 {
+		return nil, fmt.Errorf("LUN %d has no block size", lun)
+	}
+	l.blocks = int64(last) + 1
+	return l, nil
+}
+
+// Size returns the size of the logical unit in bytes.
+func (l *LUN) Size() int64 {
+	return l.blocks * l.blockSize
+}
+
+// BlockSize returns the size of the blocks of the logical unit.
+func (l *LUN) BlockSize() int64 {
+	return l.blockSize
+}
+
+// Session returns the session l belongs to.
+func (l *LUN) Session() *Session {
+	return l.s
+}
+
+func (l *LUN) String() string {
+	return fmt.Sprintf("iSCSI(%s LUN %d)", l.s.c.TargetName, l.Number)
+}
+
+// maxBlocks is the most blocks to transfer with one command.
+func (l *LUN) maxBlocks() int64 {
+	l.s.mu.Lock()
+	n := int64(l.s.maxBurst) / l.blockSize
+	l.s.mu.Unlock()
+	if n < 1 {
+		return 1
+	}
+	if n > maxTransferBlocks {
+		return maxTransferBlocks
+	}
+	return n
+}
+
+// rw returns a READ or WRITE CDB of count blocks at lba.
+func rw(op10, op16 byte, lba, count int64) []byte {
+	if lba+count <= 0xffffffff {
+		cdb := make([]byte, 10)
+		cdb[0] = op10
+		binary.BigEndian.PutUint32(cdb[2:], uint32(lba))
+		binary.BigEndian.PutUint16(cdb[7:], uint16(count))
+		return cdb
+	}
+	cdb := make([]byte, 16)
+	cdb[0] = op16
+	binary.BigEndian.PutUint64(cdb[2:], uint64(lba))
+	binary.BigEndian.PutUint32(cdb[10:], uint32(count))
+	return cdb
+}
+
+func (l *LUN) readBlocks(lba int64, buf []byte) error {
+	cdb := rw(opRead10, opRead16, lba, int64(len(buf))/l.blockSize)
+	n, err := l.s.do(context.Background(), &command{lun: l.addr, cdb: cdb, in: buf})
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return fmt.Errorf("read %d bytes at block %d, want %d", n, lba, len(buf))
+	}
+	return nil
+}
+
+func (l *LUN) writeBlocks(lba int64, buf []byte) error {
+	cdb := rw(opWrite10, opWrite16, lba, int64(len(buf))/l.blockSize)
+	_, err := l.s.do(context.Background(), &command{lun: l.addr, cdb: cdb, out: buf})
+	return err
+}
+
+// chunk returns the blocks to transfer next for rem bytes at off: either as
+// many whole blocks as possible, or the one block off is in if it does not
+// cover it.
+func (l *LUN) chunk(off int64, rem int) (lba, count int64, aligned bool) {
+	lba = off / l.blockSize
+	if off%l.blockSize != 0 || int64(rem) < l.blockSize {
+		return lba, 1, false
+	}
+	count = int64(rem) / l.blockSize
+	if m := l.maxBlocks(); count > m {
+		count = m
+	}
+	return lba, count, true
+}
+
+// ReadAt implements io.ReaderAt.
+func (l *LUN) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= l.Size() {
+		return 0, io.EOF
+	}
+	var eof error
+	if rem := l.Size() - off; int64(len(p)) > rem {
+		p, eof = p[:rem], io.EOF
+	}
+
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		lba, count, aligned := l.chunk(pos, len(p)-n)
+		if aligned {
+			length := int(count * l.blockSize)
+			if err := l.readBlocks(lba, p[n:n+length]); err != nil {
+				return n, err
+			}
+			n += length
+			continue
+		}
+		buf := make([]byte, l.blockSize)
+		if err := l.readBlocks(lba, buf); err != nil {
+			return n, err
+		}
+		n += copy(p[n:], buf[pos%l.blockSize:])
+	}
+	return n, eof
+}
+
+// WriteAt implements io.WriterAt. Partially written blocks are read first.
+func (l *LUN) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off+int64(len(p)) > l.Size() {
+		return 0, fmt.Errorf("writing %d bytes at %d: beyond the end of %d bytes", len(p), off, l.Size())
+	}
+
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		lba, count, aligned := l.chunk(pos, len(p)-n)
+		if aligned {
+			length := int(count * l.blockSize)
+			if err := l.writeBlocks(lba, p[n:n+length]); err != nil {
+				return n, err
+			}
+			n += length
+			continue
+		}
+		buf := make([]byte, l.blockSize)
+		if err := l.readBlocks(lba, buf); err != nil {
+			return n, err
+		}
+		c := copy(buf[pos%l.blockSize:], p[n:])
+		if err := l.writeBlocks(lba, buf); err != nil {
+			return n, err
+		}
+		n += c
+	}
+	return n, nil
+}
+
+// Sync flushes the write cache of the logical unit.
+func (l *LUN) Sync() error {
+	_, err := l.s.do(context.Background(), &command{lun: l.addr, cdb: []byte{opSyncCache10, 9: 0}})
+	return err
+}
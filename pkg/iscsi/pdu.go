@@ -0,0 +1,173 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iscsi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// opcode is the operation of a PDU, RFC 7143 Section 11.2.1.2.
+type opcode uint8
+
+// Initiator opcodes.
+const (
+	opNOPOut  opcode = 0x00
+	opSCSICmd opcode = 0x01
+	opLogin   opcode = 0x03
+	opText    opcode = 0x04
+	opDataOut opcode = 0x05
+	opLogout  opcode = 0x06
+)
+
+// Target opcodes.
+const (
+	opNOPIn      opcode = 0x20
+	opSCSIResp   opcode = 0x21
+	opTaskResp   opcode = 0x22
+	opLoginResp  opcode = 0x23
+	opTextResp   opcode = 0x24
+	opDataIn     opcode = 0x25
+	opLogoutResp opcode = 0x26
+	opR2T        opcode = 0x31
+	opAsync      opcode = 0x32
+	opReject     opcode = 0x3f
+)
+
+const (
+	// bhsLen is the length of the basic header segment.
+	bhsLen = 48
+
+	// maxDataLen bounds the data segments accepted from a target. The
+	// format allows 16 MiB.
+	maxDataLen = 1 << 24
+
+	immediateBit = 0x40
+	finalBit     = 0x80
+
+	// reservedTag is the initiator or target transfer tag that is not
+	// associated with a task.
+	reservedTag = 0xffffffff
+)
+
+// pdu is an iSCSI protocol data unit: a basic header segment, followed by a
+// data segment. Additional header segments and digests are not supported.
+type pdu struct {
+	bhs  [bhsLen]byte
+	data []byte
+}
+
+func newPDU(op opcode, immediate bool) *pdu {
+	p := &pdu{}
+	p.bhs[0] = byte(op)
+	if immediate {
+		p.bhs[0] |= immediateBit
+	}
+	return p
+}
+
+func (p *pdu) opcode() opcode {
+	return opcode(p.bhs[0] & 0x3f)
+}
+
+func (p *pdu) flags() byte {
+	return p.bhs[1]
+}
+
+func (p *pdu) final() bool {
+	return p.bhs[1]&finalBit != 0
+}
+
+func (p *pdu) uint32(off int) uint32 {
+	return binary.BigEndian.Uint32(p.bhs[off:])
+}
+
+func (p *pdu) putUint32(off int, v uint32) {
+	binary.BigEndian.PutUint32(p.bhs[off:], v)
+}
+
+// itt is the initiator task tag.
+func (p *pdu) itt() uint32 {
+	return p.uint32(16)
+}
+
+func (p *pdu) String() string {
+	return fmt.Sprintf("PDU(opcode=%#x, flags=%#x, itt=%#x, %d bytes of data)", p.opcode(), p.flags(), p.itt(), len(p.data))
+}
+
+// readPDU reads one PDU from r.
+func readPDU(r io.Reader) (*pdu, error) {
+	p := &pdu{}
+	if _, err := io.ReadFull(r, p.bhs[:]); err != nil {
+		return nil, err
+	}
+	if ahs := int64(p.bhs[4]) * 4; ahs > 0 {
+		if _, err := io.CopyN(ioutil.Discard, r, ahs); err != nil {
+			return nil, err
+		}
+	}
+	n := int(p.bhs[5])<<16 | int(p.bhs[6])<<8 | int(p.bhs[7])
+	if n > maxDataLen {
+		return nil, fmt.Errorf("%v: data segment too long", p)
+	}
+	buf := make([]byte, padded(n))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	p.data = buf[:n]
+	return p, nil
+}
+
+// padded returns n rounded up to the 4 byte alignment of data segments.
+func padded(n int) int {
+	return (n + 3) &^ 3
+}
+
+// writeTo writes p to w in a single write.
+func (p *pdu) writeTo(w io.Writer) error {
+	n := len(p.data)
+	if n > maxDataLen {
+		return fmt.Errorf("%v: data segment too long", p)
+	}
+	p.bhs[4] = 0
+	p.bhs[5], p.bhs[6], p.bhs[7] = byte(n>>16), byte(n>>8), byte(n)
+
+	buf := make([]byte, bhsLen+padded(n))
+	copy(buf, p.bhs[:])
+	copy(buf[bhsLen:], p.data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// textKeys marshals key=value pairs for login and text requests, RFC 7143
+// Section 6.1.
+func textKeys(kv ...string) []byte {
+	var b bytes.Buffer
+	for _, s := range kv {
+		b.WriteString(s)
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+// parseTextKeys parses the key=value pairs of login and text responses.
+func parseTextKeys(data []byte) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, kv := range bytes.Split(data, []byte{0}) {
+		if len(kv) == 0 {
+			continue
+		}
+		i := strings.IndexByte(string(kv), '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid text key %q", kv)
+		}
+		keys[string(kv[:i])] = string(kv[i+1:])
+	}
+	return keys, nil
+}
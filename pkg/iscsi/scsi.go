@@ -0,0 +1,228 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iscsi
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// SCSI status codes, SAM-5 Section 5.3.
+const (
+	statusGood           = 0x00
+	statusCheckCondition = 0x02
+)
+
+// Sense keys, SPC-4 Section 4.5.6.
+const (
+	senseUnitAttention = 0x6
+)
+
+// Flags of SCSI command and response PDUs.
+const (
+	cmdRead   = 0x40
+	cmdWrite  = 0x20
+	cmdSimple = 0x01
+
+	dataInStatus = 0x01
+
+	// maxUnitAttempts is how often commands are issued when the logical
+	// unit reports unit attentions.
+	maxUnitAttempts = 3
+)
+
+// SCSIError is a SCSI command that completed with a status other than GOOD.
+type SCSIError struct {
+	// Status is the SCSI status code.
+	Status uint8
+
+	// SenseKey, ASC and ASCQ describe CHECK CONDITION statuses.
+	SenseKey uint8
+	ASC      uint8
+	ASCQ     uint8
+}
+
+func (e *SCSIError) Error() string {
+	if e.Status == statusCheckCondition {
+		return fmt.Sprintf("SCSI check condition: sense key %#x, ASC/ASCQ %#02x/%#02x", e.SenseKey, e.ASC, e.ASCQ)
+	}
+	return fmt.Sprintf("SCSI status %#02x", e.Status)
+}
+
+// scsiError returns the error of status, decoding fixed or descriptor format
+// sense data, SPC-4 Section 4.5.
+func scsiError(status uint8, sense []byte) error {
+	if status == statusGood {
+		return nil
+	}
+	e := &SCSIError{Status: status}
+	if len(sense) == 0 {
+		return e
+	}
+	switch sense[0] & 0x7f {
+	case 0x70, 0x71:
+		if len(sense) >= 14 {
+			e.SenseKey, e.ASC, e.ASCQ = sense[2]&0xf, sense[12], sense[13]
+		}
+	case 0x72, 0x73:
+		if len(sense) >= 4 {
+			e.SenseKey, e.ASC, e.ASCQ = sense[1]&0xf, sense[2], sense[3]
+		}
+	}
+	return e
+}
+
+// command is a SCSI command to a logical unit.
+type command struct {
+	lun [8]byte
+	cdb []byte
+
+	// in receives data from the target. Its length is the expected
+	// transfer length.
+	in []byte
+
+	// out is sent to the target.
+	out []byte
+}
+
+// do executes cmd, retrying it if the logical unit reports a unit attention,
+// as it does for the first command after a reset or login. It returns the
+// number of bytes received.
+//
+// Without error recovery, the session cannot be used after any error other
+// than a SCSIError, and is closed.
+func (s *Session) do(ctx context.Context, cmd *command) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, ErrClosed
+	}
+
+	for i := 0; ; i++ {
+		n, err := s.exec(ctx, cmd)
+		e, ok := err.(*SCSIError)
+		if ok && e.SenseKey == senseUnitAttention && i+1 < maxUnitAttempts {
+			continue
+		}
+		if err != nil && !ok {
+			s.closed = true
+			s.conn.Close()
+		}
+		return n, err
+	}
+}
+
+// exec executes cmd, RFC 7143 Section 11.3.
+func (s *Session) exec(ctx context.Context, cmd *command) (int, error) {
+	s.deadline(ctx)
+	defer s.conn.SetDeadline(time.Time{})
+
+	itt := s.nextITT()
+	p := newPDU(opSCSICmd, false)
+	p.bhs[1] = finalBit | cmdSimple
+	edtl := 0
+	if cmd.in != nil {
+		p.bhs[1] |= cmdRead
+		edtl = len(cmd.in)
+	}
+	if cmd.out != nil {
+		p.bhs[1] |= cmdWrite
+		edtl = len(cmd.out)
+	}
+	copy(p.bhs[8:16], cmd.lun[:])
+	p.putUint32(16, itt)
+	p.putUint32(20, uint32(edtl))
+	p.putUint32(24, s.cmdSN)
+	p.putUint32(28, s.expStatSN)
+	copy(p.bhs[32:48], cmd.cdb)
+	s.cmdSN++
+	if err := p.writeTo(s.conn); err != nil {
+		return 0, err
+	}
+
+	var n int
+	for {
+		resp, err := s.recv()
+		if err != nil {
+			return n, err
+		}
+		if resp.opcode() == opReject {
+			return n, fmt.Errorf("command rejected with reason %#x", resp.bhs[2])
+		}
+		if resp.itt() != itt {
+			return n, fmt.Errorf("unexpected %v, want task %#x", resp, itt)
+		}
+
+		switch resp.opcode() {
+		case opDataIn:
+			off := int(resp.uint32(40))
+			if off+len(resp.data) > len(cmd.in) {
+				return n, fmt.Errorf("target sent %d bytes at offset %d, more than the %d requested", len(resp.data), off, len(cmd.in))
+			}
+			n += copy(cmd.in[off:], resp.data)
+			if resp.flags()&dataInStatus != 0 {
+				s.status(resp)
+				return n, scsiError(resp.bhs[3], nil)
+			}
+
+		case opR2T:
+			if err := s.dataOut(cmd, resp); err != nil {
+				return n, err
+			}
+
+		case opSCSIResp:
+			s.status(resp)
+			if r := resp.bhs[2]; r != 0 {
+				return n, fmt.Errorf("target failed the command with response %#x", r)
+			}
+			var sense []byte
+			if len(resp.data) >= 2 {
+				l := int(resp.data[0])<<8 | int(resp.data[1])
+				if l <= len(resp.data)-2 {
+					sense = resp.data[2 : 2+l]
+				}
+			}
+			return n, scsiError(resp.bhs[3], sense)
+
+		default:
+			return n, fmt.Errorf("unexpected %v during command", resp)
+		}
+	}
+}
+
+// dataOut sends the data that r2t asks for, RFC 7143 Section 11.7.
+func (s *Session) dataOut(cmd *command, r2t *pdu) error {
+	off, length := int(r2t.uint32(40)), int(r2t.uint32(44))
+	if off+length > len(cmd.out) {
+		return fmt.Errorf("target asked for %d bytes at offset %d of %d", length, off, len(cmd.out))
+	}
+	data := cmd.out[off : off+length]
+	for sn := uint32(0); ; sn++ {
+		p := newPDU(opDataOut, false)
+		chunk := data
+		if len(chunk) > s.maxSendData {
+			chunk = chunk[:s.maxSendData]
+		}
+		data = data[len(chunk):]
+		if len(data) == 0 {
+			p.bhs[1] = finalBit
+		}
+		copy(p.bhs[8:16], cmd.lun[:])
+		p.putUint32(16, r2t.itt())
+		p.putUint32(20, r2t.uint32(20))
+		p.putUint32(28, s.expStatSN)
+		p.putUint32(36, sn)
+		p.putUint32(40, uint32(off))
+		p.data = chunk
+		if err := p.writeTo(s.conn); err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		off += len(chunk)
+	}
+}
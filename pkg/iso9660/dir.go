@@ -0,0 +1,404 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iso9660
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Directory record flags.
+const (
+	flagDir        = 0x02
+	flagAssociated = 0x04
+	flagMultiExt   = 0x80
+)
+
+const (
+	// maxContinuations bounds the SUSP continuation areas of a record.
+	maxContinuations = 16
+
+	// maxDirSize bounds the size of a directory.
+	maxDirSize = 16 << 20
+)
+
+var errBadRecord = errors.New("bad directory record")
+
+// extent is a contiguous part of a file.
+type extent struct {
+	off, size int64
+}
+
+// dirent is a directory entry. It implements os.FileInfo.
+type dirent struct {
+	name    string
+	extents []extent
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+
+	// target is the target of a symbolic link.
+	target string
+
+	// relocated is set for a Rock Ridge RE entry, the real location of
+	// a deep directory, which is listed where its CL entry is instead.
+	relocated bool
+}
+
+// Name implements os.FileInfo.
+func (d *dirent) Name() string { return d.name }
+
+// Size implements os.FileInfo.
+func (d *dirent) Size() int64 { return d.size }
+
+// Mode implements os.FileInfo.
+func (d *dirent) Mode() os.FileMode { return d.mode }
+
+// ModTime implements os.FileInfo.
+func (d *dirent) ModTime() time.Time { return d.modTime }
+
+// IsDir implements os.FileInfo.
+func (d *dirent) IsDir() bool { return d.mode.IsDir() }
+
+// Sys implements os.FileInfo.
+func (d *dirent) Sys() interface{} { return nil }
+
+// systemUse returns the system use area of a directory record.
+func systemUse(rec []byte) []byte {
+	nameLen := int(rec[32])
+	start := 33 + nameLen
+	// The name is padded to an even length.
+	if nameLen%2 == 0 {
+		start++
+	}
+	if start > len(rec) {
+		return nil
+	}
+	return rec[start:]
+}
+
+// recordTime decodes the 7 byte time of a directory record.
+func recordTime(b []byte) time.Time {
+	if b[1] == 0 {
+		return time.Time{}
+	}
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone)
+}
+
+// decodeUCS2 decodes a big-endian UCS-2 Joliet name.
+func decodeUCS2(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// isoName turns a plain ISO 9660 file identifier like "VMLINUZ.;1" into
+// "VMLINUZ".
+func isoName(id string) string {
+	if i := strings.LastIndexByte(id, ';'); i >= 0 {
+		id = id[:i]
+	}
+	return strings.TrimSuffix(id, ".")
+}
+
+// parseRecord parses a directory record. If self is set, it is the "." or
+// root record of a directory, whose name is not decoded.
+func (fs *FS) parseRecord(rec []byte, self bool) (*dirent, error) {
+	if len(rec) < 34 || int(rec[0]) > len(rec) || 33+int(rec[32]) > int(rec[0]) {
+		return nil, errBadRecord
+	}
+	rec = rec[:rec[0]]
+	flags := rec[25]
+	d := &dirent{
+		extents: []extent{{
+			off:  int64(binary.LittleEndian.Uint32(rec[2:])) * fs.blockSize,
+			size: int64(binary.LittleEndian.Uint32(rec[10:])),
+		}},
+		modTime: recordTime(rec[18:25]),
+		mode:    0444,
+	}
+	d.size = d.extents[0].size
+	if flags&flagDir != 0 {
+		d.mode = os.ModeDir | 0555
+	}
+
+	if !self {
+		id := rec[33 : 33+rec[32]]
+		if fs.joliet {
+			d.name = isoName(decodeUCS2(id))
+		} else {
+			d.name = isoName(string(id))
+		}
+	}
+	if fs.rockRidge {
+		if err := fs.parseSUSP(d, systemUse(rec), self); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// parseSUSP applies the Rock Ridge entries in the system use area su to d.
+// Child links are not followed for "." records.
+func (fs *FS) parseSUSP(d *dirent, su []byte, self bool) error {
+	if len(su) < fs.suspSkip {
+		return nil
+	}
+	su = su[fs.suspSkip:]
+
+	var (
+		name      []byte
+		hasName   bool
+		link      []string
+		linkCont  bool
+		component []byte
+		areas     int
+	)
+	for {
+		if len(su) < 4 {
+			break
+		}
+		sig, l := string(su[:2]), int(su[2])
+		if l < 4 || l > len(su) {
+			break
+		}
+		e := su[:l]
+		su = su[l:]
+
+		switch sig {
+		case "CE":
+			// Continuation area: the entries go on elsewhere.
+			if l < 28 || areas >= maxContinuations {
+				continue
+			}
+			areas++
+			block := int64(binary.LittleEndian.Uint32(e[4:]))
+			off := int64(binary.LittleEndian.Uint32(e[12:]))
+			n := binary.LittleEndian.Uint32(e[20:])
+			if n > sectorSize {
+				return fmt.Errorf("%w: continuation area of %d bytes", errBadRecord, n)
+			}
+			ce := make([]byte, n)
+			if _, err := fs.r.ReadAt(ce, block*fs.blockSize+off); err != nil {
+				return err
+			}
+			su = append(su, ce...)
+
+		case "NM":
+			if l < 5 {
+				continue
+			}
+			flags := e[4]
+			switch {
+			case flags&0x02 != 0:
+				name = []byte(".")
+			case flags&0x04 != 0:
+				name = []byte("..")
+			default:
+				name = append(name, e[5:]...)
+			}
+			hasName = true
+
+		case "PX":
+			if l < 12 {
+				continue
+			}
+			d.mode = posixMode(binary.LittleEndian.Uint32(e[4:]))
+
+		case "SL":
+			if l < 5 {
+				continue
+			}
+			comps := e[5:]
+			for len(comps) >= 2 {
+				flags, n := comps[0], int(comps[1])
+				if 2+n > len(comps) {
+					break
+				}
+				var c string
+				switch {
+				case flags&0x02 != 0:
+					c = "."
+				case flags&0x04 != 0:
+					c = ".."
+				case flags&0x08 != 0:
+					c = "/"
+				default:
+					c = string(comps[2 : 2+n])
+				}
+				component = append(component, c...)
+				// A component may go on in the next one.
+				if flags&0x01 == 0 {
+					link = append(link, string(component))
+					component = nil
+				}
+				comps = comps[2+n:]
+			}
+			linkCont = e[4]&0x01 != 0
+
+		case "CL":
+			// Child link: a deep directory relocated to where the
+			// entry points.
+			if l < 12 || self {
+				continue
+			}
+			block := int64(binary.LittleEndian.Uint32(e[4:]))
+			dir, err := fs.readSelf(block * fs.blockSize)
+			if err != nil {
+				return err
+			}
+			d.extents, d.size = dir.extents, dir.size
+			d.mode = os.ModeDir | d.mode.Perm()
+
+		case "RE":
+			d.relocated = true
+
+		case "ST":
+			su = nil
+		}
+	}
+
+	if hasName {
+		d.name = string(name)
+	}
+	if len(link) > 0 && !linkCont {
+		d.target = joinLink(link)
+	}
+	return nil
+}
+
+// joinLink joins symbolic link components, where "/" is the root.
+func joinLink(comps []string) string {
+	var b strings.Builder
+	for i, c := range comps {
+		if c == "/" {
+			b.WriteString("/")
+			continue
+		}
+		if i > 0 && comps[i-1] != "/" {
+			b.WriteString("/")
+		}
+		b.WriteString(c)
+	}
+	return b.String()
+}
+
+// posixMode converts a POSIX file mode to an os.FileMode.
+func posixMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	switch m & 0170000 {
+	case 0040000:
+		mode |= os.ModeDir
+	case 0120000:
+		mode |= os.ModeSymlink
+	case 0020000:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case 0060000:
+		mode |= os.ModeDevice
+	case 0010000:
+		mode |= os.ModeNamedPipe
+	case 0140000:
+		mode |= os.ModeSocket
+	}
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// readSelf reads the "." record of the directory at off.
+func (fs *FS) readSelf(off int64) (*dirent, error) {
+	b := make([]byte, sectorSize)
+	if _, err := fs.r.ReadAt(b, off); err != nil {
+		return nil, err
+	}
+	if b[0] == 0 {
+		return nil, errBadRecord
+	}
+	return fs.parseRecord(b[:b[0]], true)
+}
+
+// readDir returns the entries of directory d, without "." and "..".
+func (fs *FS) readDir(d *dirent) ([]*dirent, error) {
+	off := d.extents[0].off
+	fs.mu.Lock()
+	ents, ok := fs.dirs[off]
+	fs.mu.Unlock()
+	if ok {
+		return ents, nil
+	}
+
+	if d.size > maxDirSize {
+		return nil, fmt.Errorf("%w: directory of %d bytes", errBadRecord, d.size)
+	}
+	b := make([]byte, d.size)
+	if _, err := fs.r.ReadAt(b, off); err != nil {
+		return nil, err
+	}
+	var multi *dirent
+	for pos := 0; pos < len(b); {
+		l := int(b[pos])
+		if l == 0 {
+			// Records do not cross sectors; the rest of this one
+			// is padding.
+			pos = (pos/sectorSize + 1) * sectorSize
+			continue
+		}
+		if pos+l > len(b) || l < 34 {
+			return nil, errBadRecord
+		}
+		rec := b[pos : pos+l]
+		pos += l
+
+		// Skip "." and "..".
+		if rec[32] == 1 && (rec[33] == 0 || rec[33] == 1) {
+			continue
+		}
+		flags := rec[25]
+		if flags&flagAssociated != 0 {
+			continue
+		}
+		e, err := fs.parseRecord(rec, false)
+		if err != nil {
+			return nil, err
+		}
+		if multi != nil {
+			// Further extents of a file are recorded under the
+			// same name.
+			multi.extents = append(multi.extents, e.extents[0])
+			multi.size += e.size
+			if flags&flagMultiExt == 0 {
+				multi = nil
+			}
+			continue
+		}
+		if e.relocated {
+			continue
+		}
+		if flags&flagMultiExt != 0 {
+			multi = e
+		}
+		ents = append(ents, e)
+	}
+
+	fs.mu.Lock()
+	fs.dirs[off] = ents
+	fs.mu.Unlock()
+	return ents, nil
+}
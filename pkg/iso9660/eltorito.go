@@ -0,0 +1,150 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iso9660
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Platform is the platform an El Torito boot image is for.
+type Platform uint8
+
+// Platforms.
+const (
+	PlatformX86     Platform = 0
+	PlatformPowerPC Platform = 1
+	PlatformMac     Platform = 2
+	PlatformEFI     Platform = 0xef
+)
+
+func (p Platform) String() string {
+	switch p {
+	case PlatformX86:
+		return "x86"
+	case PlatformPowerPC:
+		return "PowerPC"
+	case PlatformMac:
+		return "Mac"
+	case PlatformEFI:
+		return "EFI"
+	}
+	return fmt.Sprintf("Platform(%#x)", uint8(p))
+}
+
+// Emulation is the media an El Torito boot image emulates.
+type Emulation uint8
+
+// Emulation types.
+const (
+	NoEmulation Emulation = 0
+	Floppy12M   Emulation = 1
+	Floppy144M  Emulation = 2
+	Floppy288M  Emulation = 3
+	HardDisk    Emulation = 4
+)
+
+// BootImage is an entry of the El Torito boot catalog.
+type BootImage struct {
+	// Platform is the platform the image boots on.
+	Platform Platform
+
+	// Bootable is false for images that are not to be booted.
+	Bootable bool
+
+	// Emulation is the media the image emulates.
+	Emulation Emulation
+
+	// Sector is the block the image starts at.
+	Sector uint32
+
+	// Sectors is the number of 512 byte sectors the firmware loads, which
+	// for EFI system partition images may be less than their size.
+	Sectors uint16
+
+	// Image reads the loaded part of the image.
+	Image *io.SectionReader
+}
+
+var (
+	// ErrNoBootCatalog is returned by BootCatalog for images that are
+	// not El Torito bootable.
+	ErrNoBootCatalog = errors.New("no El Torito boot catalog")
+
+	errBadCatalog = errors.New("bad El Torito boot catalog")
+)
+
+// Boot catalog entry types.
+const (
+	headerValidation = 0x01
+	headerMore       = 0x90
+	headerFinal      = 0x91
+	entryBootable    = 0x88
+	entryExtension   = 0x44
+	catalogEntryLen  = 32
+)
+
+// BootCatalog returns the entries of the El Torito boot catalog: the default
+// entry first, then those of the sections.
+func (fs *FS) BootCatalog() ([]BootImage, error) {
+	if fs.bootCatalog == 0 {
+		return nil, ErrNoBootCatalog
+	}
+	b := make([]byte, sectorSize)
+	if _, err := fs.r.ReadAt(b, fs.bootCatalog*fs.blockSize); err != nil {
+		return nil, err
+	}
+
+	// The validation entry identifies the catalog, and the platform of
+	// the default entry.
+	v := b[:catalogEntryLen]
+	if v[0] != headerValidation || v[30] != 0x55 || v[31] != 0xaa {
+		return nil, errBadCatalog
+	}
+	var sum uint16
+	for i := 0; i < catalogEntryLen; i += 2 {
+		sum += binary.LittleEndian.Uint16(v[i:])
+	}
+	if sum != 0 {
+		return nil, fmt.Errorf("%w: checksum %#x", errBadCatalog, sum)
+	}
+
+	images := []BootImage{fs.bootImage(Platform(v[1]), b[catalogEntryLen:2*catalogEntryLen])}
+	for pos := 2 * catalogEntryLen; pos+catalogEntryLen <= len(b); {
+		h := b[pos : pos+catalogEntryLen]
+		pos += catalogEntryLen
+		if h[0] != headerMore && h[0] != headerFinal {
+			break
+		}
+		platform := Platform(h[1])
+		n := int(binary.LittleEndian.Uint16(h[2:]))
+		for i := 0; i < n && pos+catalogEntryLen <= len(b); pos += catalogEntryLen {
+			e := b[pos : pos+catalogEntryLen]
+			if e[0] == entryExtension {
+				continue
+			}
+			images = append(images, fs.bootImage(platform, e))
+			i++
+		}
+		if h[0] == headerFinal {
+			break
+		}
+	}
+	return images, nil
+}
+
+func (fs *FS) bootImage(p Platform, e []byte) BootImage {
+	img := BootImage{
+		Platform:  p,
+		Bootable:  e[0] == entryBootable,
+		Emulation: Emulation(e[1] & 0x0f),
+		Sectors:   binary.LittleEndian.Uint16(e[6:]),
+		Sector:    binary.LittleEndian.Uint32(e[8:]),
+	}
+	img.Image = io.NewSectionReader(fs.r, int64(img.Sector)*fs.blockSize, int64(img.Sectors)*512)
+	return img
+}
@@ -0,0 +1,402 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package iso9660 reads ISO 9660 file system images, such as installer CDs.
+//
+// Rock Ridge names, permissions and symbolic links are used if the image has
+// them, otherwise Joliet names are. Images are read through an io.ReaderAt,
+// so they do not need to be loop-mounted, or even be downloaded completely.
+//
+// The El Torito boot catalog can be read with BootCatalog.
+//
+// References:
+//
+//	ECMA-119: https://www.ecma-international.org/publications/standards/Ecma-119.htm
+//	Rock Ridge (RRIP and SUSP): IEEE P1282 and P1281
+//	Joliet: https://pismotec.com/cfs/jolspec.html
+//	El Torito: https://pdos.csail.mit.edu/6.828/2018/readings/boot-cdrom.pdf
+package iso9660
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	// sectorSize is the size of a logical sector. Logical blocks may be
+	// smaller, but never are in practice.
+	sectorSize = 2048
+
+	// firstDescriptor is the sector of the first volume descriptor; the
+	// system area comes before.
+	firstDescriptor = 16
+
+	// maxDescriptors bounds the volume descriptor set.
+	maxDescriptors = 64
+
+	// maxLinks bounds the symbolic links followed to open a file.
+	maxLinks = 40
+)
+
+// Volume descriptor types.
+const (
+	vdBootRecord    = 0
+	vdPrimary       = 1
+	vdSupplementary = 2
+	vdTerminator    = 255
+)
+
+var (
+	// ErrNotISO9660 is returned by Open if the image has no ISO 9660 file
+	// system.
+	ErrNotISO9660 = errors.New("not an ISO 9660 image")
+
+	errTooManyLinks = errors.New("too many levels of symbolic links")
+)
+
+// FS is an ISO 9660 file system image.
+type FS struct {
+	// VolumeID is the name of the volume.
+	VolumeID string
+
+	r         io.ReaderAt
+	blockSize int64
+	root      *dirent
+
+	// rockRidge is set if the directory records have SUSP entries, which
+	// are preceded by suspSkip bytes.
+	rockRidge bool
+	suspSkip  int
+
+	// joliet is set if root is the Joliet directory hierarchy.
+	joliet bool
+
+	// bootCatalog is the block of the El Torito boot catalog, or 0.
+	bootCatalog int64
+
+	mu   sync.Mutex
+	dirs map[int64][]*dirent
+}
+
+// Open opens the ISO 9660 file system in r.
+func Open(r io.ReaderAt) (*FS, error) {
+	fs := &FS{
+		r:    r,
+		dirs: make(map[int64][]*dirent),
+	}
+
+	var primary, joliet []byte
+	b := make([]byte, sectorSize)
+	for i := int64(firstDescriptor); i < firstDescriptor+maxDescriptors; i++ {
+		if _, err := r.ReadAt(b, i*sectorSize); err != nil {
+			if primary != nil {
+				break
+			}
+			return nil, ErrNotISO9660
+		}
+		if string(b[1:6]) != "CD001" {
+			if primary != nil {
+				break
+			}
+			return nil, ErrNotISO9660
+		}
+		switch b[0] {
+		case vdBootRecord:
+			if strings.HasPrefix(string(b[7:39]), "EL TORITO SPECIFICATION") {
+				fs.bootCatalog = int64(binary.LittleEndian.Uint32(b[0x47:]))
+			}
+		case vdPrimary:
+			if primary == nil {
+				primary = append([]byte(nil), b...)
+			}
+		case vdSupplementary:
+			// Joliet is identified by its UCS-2 escape sequence.
+			switch string(b[88:91]) {
+			case "%/@", "%/C", "%/E":
+				joliet = append([]byte(nil), b...)
+			}
+		}
+		if b[0] == vdTerminator {
+			break
+		}
+	}
+	if primary == nil {
+		return nil, ErrNotISO9660
+	}
+
+	fs.VolumeID = strings.TrimRight(string(primary[40:72]), " \x00")
+	fs.blockSize = int64(binary.LittleEndian.Uint16(primary[128:]))
+	if fs.blockSize == 0 || fs.blockSize > sectorSize {
+		return nil, fmt.Errorf("%w: logical block size %d", ErrNotISO9660, fs.blockSize)
+	}
+
+	root, err := fs.parseRecord(primary[156:190], true)
+	if err != nil {
+		return nil, err
+	}
+	fs.root = root
+	// Rock Ridge is announced by a SUSP SP entry in the first record of
+	// the root directory.
+	if err := fs.detectRockRidge(); err != nil {
+		return nil, err
+	}
+
+	if !fs.rockRidge && joliet != nil {
+		root, err := fs.parseRecord(joliet[156:190], true)
+		if err != nil {
+			return nil, err
+		}
+		fs.root, fs.joliet = root, true
+		if v := strings.TrimRight(decodeUCS2(joliet[40:72]), " \x00"); v != "" {
+			fs.VolumeID = v
+		}
+	}
+	return fs, nil
+}
+
+// detectRockRidge checks the "." record of the root directory for a SUSP SP
+// entry.
+func (fs *FS) detectRockRidge() error {
+	b := make([]byte, sectorSize)
+	if _, err := fs.r.ReadAt(b, fs.root.extents[0].off); err != nil {
+		return err
+	}
+	l := int(b[0])
+	if l < 34 || l > len(b) {
+		return fmt.Errorf("%w: bad root directory", ErrNotISO9660)
+	}
+	su := systemUse(b[:l])
+	if len(su) >= 7 && string(su[:2]) == "SP" && su[4] == 0xbe && su[5] == 0xef {
+		fs.rockRidge = true
+		fs.suspSkip = int(su[6])
+	}
+	return nil
+}
+
+// Open opens the named file for reading, following symbolic links.
+//
+// Names are slash-separated and relative to the root of the image; a leading
+// slash is optional. If no file matches exactly, a name that matches
+// case-insensitively is used, as plain ISO 9660 names are upper case.
+func (fs *FS) Open(name string) (*File, error) {
+	d, err := fs.lookup(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return fs.newFile(name, d), nil
+}
+
+// Stat returns the FileInfo of the named file, following symbolic links.
+func (fs *FS) Stat(name string) (os.FileInfo, error) {
+	d, err := fs.lookup(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Lstat returns the FileInfo of the named file. A symbolic link is not
+// followed.
+func (fs *FS) Lstat(name string) (os.FileInfo, error) {
+	d, err := fs.lookup(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Readlink returns the target of the named symbolic link.
+func (fs *FS) Readlink(name string) (string, error) {
+	d, err := fs.lookup(name, false)
+	if err != nil {
+		return "", err
+	}
+	if d.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrInvalid}
+	}
+	return d.target, nil
+}
+
+// ReadDir returns the entries of the named directory.
+func (fs *FS) ReadDir(name string) ([]os.FileInfo, error) {
+	d, err := fs.lookup(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !d.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	ents, err := fs.readDir(d)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	fis := make([]os.FileInfo, len(ents))
+	for i, e := range ents {
+		fis[i] = e
+	}
+	return fis, nil
+}
+
+// Fetch implements curl.FileScheme, so that files in the image can be
+// fetched as e.g. iso:///isolinux/isolinux.cfg.
+func (fs *FS) Fetch(_ context.Context, u *url.URL) (io.ReaderAt, error) {
+	f, err := fs.Open(u.Path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// lookup walks the directories to the named file. Symbolic links in the
+// middle of name are always followed, and at the end if follow is set.
+func (fs *FS) lookup(name string, follow bool) (*dirent, error) {
+	perr := func(err error) error {
+		return &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	// stack is the directories from the root to the current one.
+	stack := []*dirent{fs.root}
+	todo := splitPath(name)
+	links := 0
+	for len(todo) > 0 {
+		comp := todo[0]
+		todo = todo[1:]
+		switch comp {
+		case ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+
+		dir := stack[len(stack)-1]
+		if !dir.IsDir() {
+			return nil, perr(errors.New("not a directory"))
+		}
+		ents, err := fs.readDir(dir)
+		if err != nil {
+			return nil, perr(err)
+		}
+		d := findEntry(ents, comp)
+		if d == nil {
+			return nil, perr(os.ErrNotExist)
+		}
+
+		if d.mode&os.ModeSymlink != 0 && (len(todo) > 0 || follow) {
+			if links++; links > maxLinks {
+				return nil, perr(errTooManyLinks)
+			}
+			if path.IsAbs(d.target) {
+				stack = stack[:1]
+			}
+			todo = append(splitPath(d.target), todo...)
+			continue
+		}
+		stack = append(stack, d)
+	}
+	return stack[len(stack)-1], nil
+}
+
+func splitPath(name string) []string {
+	var comps []string
+	for _, c := range strings.Split(name, "/") {
+		if c != "" {
+			comps = append(comps, c)
+		}
+	}
+	return comps
+}
+
+// findEntry returns the entry named name, or one that matches it
+// case-insensitively.
+func findEntry(ents []*dirent, name string) *dirent {
+	var fold *dirent
+	for _, e := range ents {
+		if e.name == name {
+			return e
+		}
+		if fold == nil && strings.EqualFold(e.name, name) {
+			fold = e
+		}
+	}
+	return fold
+}
+
+// File is a file in an ISO 9660 image.
+type File struct {
+	io.ReaderAt
+
+	name string
+	d    *dirent
+}
+
+func (fs *FS) newFile(name string, d *dirent) *File {
+	f := &File{name: name, d: d}
+	if len(d.extents) == 1 {
+		f.ReaderAt = io.NewSectionReader(fs.r, d.extents[0].off, d.extents[0].size)
+	} else {
+		f.ReaderAt = &multiExtent{r: fs.r, extents: d.extents}
+	}
+	return f
+}
+
+// Stat returns the FileInfo of f.
+func (f *File) Stat() (os.FileInfo, error) {
+	return f.d, nil
+}
+
+// Size returns the size of f in bytes.
+func (f *File) Size() int64 {
+	return f.d.size
+}
+
+// String implements fmt.Stringer.
+func (f *File) String() string {
+	return f.name
+}
+
+// multiExtent reads a file recorded in several extents, which files of 4 GiB
+// and more need.
+type multiExtent struct {
+	r       io.ReaderAt
+	extents []extent
+}
+
+// ReadAt implements io.ReaderAt.
+func (m *multiExtent) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	n := 0
+	for _, e := range m.extents {
+		if len(p) == 0 {
+			break
+		}
+		if off >= e.size {
+			off -= e.size
+			continue
+		}
+		k, err := io.NewSectionReader(m.r, e.off, e.size).ReadAt(p, off)
+		n += k
+		p = p[k:]
+		off = 0
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,224 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iso9660
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// openImage opens testdata/name.iso.gz, which were made with
+//
+//	bsdtar -cf name.iso --format iso9660 --options ... -C src .
+func openImage(t *testing.T, name string) *FS {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name+".iso.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := Open(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("Open(%s) = %v", name, err)
+	}
+	return fs
+}
+
+func readFile(fs *FS, name string) (string, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, f.Size())
+	if _, err := f.ReadAt(b, 0); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func TestOpen(t *testing.T) {
+	for _, tt := range []struct {
+		image    string
+		volumeID string
+		files    map[string]string
+	}{
+		{
+			image:    "rr",
+			volumeID: "ROCKRIDGE",
+			files: map[string]string{
+				"/casper/vmlinuz":                 "kernel",
+				"casper/initrd":                   "initrd",
+				"CASPER/INITRD":                   "initrd",
+				"Long File Name.txt":              "hello\n",
+				"deep/a/b/c/d/e/f/g/h/i/file.txt": "deep\n",
+				"vmlinuz":                         "kernel",
+				"casperlink/vmlinuz":              "kernel",
+				"casper/../casper/./initrd":       "initrd",
+			},
+		},
+		{
+			image:    "joliet",
+			volumeID: "JOLIET",
+			files: map[string]string{
+				"/casper/vmlinuz":    "kernel",
+				"Long File Name.txt": "hello\n",
+			},
+		},
+		{
+			image:    "plain",
+			volumeID: "PLAIN",
+			files: map[string]string{
+				"/casper/vmlinuz":       "kernel",
+				"/CASPER/VMLINUZ":       "kernel",
+				"boot/grub/grub.cfg":    "menuentry \"Live system\" {\n\tlinux /casper/vmlinuz boot=casper quiet\n\tinitrd /casper/initrd\n}\n",
+				"long_fil.txt":          "hello\n",
+				"isolinux/isolinux.bin": "bootimage",
+			},
+		},
+	} {
+		t.Run(tt.image, func(t *testing.T) {
+			fs := openImage(t, tt.image)
+			if fs.VolumeID != tt.volumeID {
+				t.Errorf("VolumeID = %q, want %q", fs.VolumeID, tt.volumeID)
+			}
+			for name, want := range tt.files {
+				if got, err := readFile(fs, name); err != nil || got != want {
+					t.Errorf("reading %s = %q, %v, want %q", name, got, err, want)
+				}
+			}
+			if _, err := fs.Open("casper/nope"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Open(casper/nope) = %v, want %v", err, os.ErrNotExist)
+			}
+			if _, err := fs.Open("casper/vmlinuz/foo"); err == nil {
+				t.Errorf("Open(casper/vmlinuz/foo) succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	fs := openImage(t, "rr")
+	fis, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	want := []string{"Long File Name.txt", "boot", "boot.catalog", "casper", "casperlink", "deep", "isolinux", "rr_moved", "vmlinuz"}
+	if !equal(names, want) {
+		t.Errorf("ReadDir(/) = %v, want %v", names, want)
+	}
+
+	fi, err := fs.Stat("casper/vmlinuz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 6 || fi.Mode() != 0444 || fi.IsDir() || fi.ModTime().IsZero() {
+		t.Errorf("Stat(casper/vmlinuz) = size %d, mode %v, time %v", fi.Size(), fi.Mode(), fi.ModTime())
+	}
+	if fi, err := fs.Stat("deep/a/b/c/d/e/f/g/h"); err != nil || !fi.IsDir() {
+		t.Errorf("Stat(relocated directory) = %v, %v, want a directory", fi, err)
+	}
+	if fi, err := fs.Lstat("vmlinuz"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat(vmlinuz) = %v, %v, want a symbolic link", fi, err)
+	}
+	for link, want := range map[string]string{"vmlinuz": "casper/vmlinuz", "casperlink": "/casper"} {
+		if got, err := fs.Readlink(link); err != nil || got != want {
+			t.Errorf("Readlink(%s) = %q, %v, want %q", link, got, err, want)
+		}
+	}
+	if _, err := fs.ReadDir("casper/vmlinuz"); err == nil {
+		t.Errorf("ReadDir(file) succeeded, want error")
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBootCatalog(t *testing.T) {
+	fs := openImage(t, "rr")
+	imgs, err := fs.BootCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imgs) != 1 {
+		t.Fatalf("BootCatalog() = %v, want 1 image", imgs)
+	}
+	img := imgs[0]
+	if img.Platform != PlatformX86 || !img.Bootable || img.Emulation != NoEmulation {
+		t.Errorf("boot image = %+v, want a bootable x86 image without emulation", img)
+	}
+	b := make([]byte, 9)
+	if _, err := img.Image.ReadAt(b, 0); err != nil || string(b) != "bootimage" {
+		t.Errorf("boot image contents = %q, %v, want %q", b, err, "bootimage")
+	}
+
+	if _, err := openImage(t, "plain").BootCatalog(); err != ErrNoBootCatalog {
+		t.Errorf("BootCatalog() = %v, want %v", err, ErrNoBootCatalog)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	fs := openImage(t, "rr")
+	r, err := fs.Fetch(context.Background(), &url.URL{Scheme: "iso", Path: "/isolinux/isolinux.cfg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 12)
+	if _, err := r.ReadAt(b, 0); err != nil || string(b) != "default live" {
+		t.Errorf("Fetch() = %q, %v", b, err)
+	}
+}
+
+func TestNotISO9660(t *testing.T) {
+	for _, b := range [][]byte{nil, make([]byte, 64<<10)} {
+		if _, err := Open(bytes.NewReader(b)); !errors.Is(err, ErrNotISO9660) {
+			t.Errorf("Open(%d bytes) = %v, want %v", len(b), err, ErrNotISO9660)
+		}
+	}
+}
+
+func TestMultiExtent(t *testing.T) {
+	data := []byte("0123456789")
+	m := &multiExtent{
+		r:       bytes.NewReader(data),
+		extents: []extent{{off: 6, size: 4}, {off: 0, size: 3}},
+	}
+	b := make([]byte, 5)
+	if n, err := m.ReadAt(b, 2); n != 5 || err != nil || string(b) != "89012" {
+		t.Errorf("ReadAt(2) = %d, %v, %q, want 5, nil, %q", n, err, b[:n], "89012")
+	}
+	if n, err := m.ReadAt(b, 4); n != 3 || err == nil || string(b[:n]) != "012" {
+		t.Errorf("ReadAt(4) = %d, %v, %q, want 3, EOF, %q", n, err, b[:n], "012")
+	}
+}
@@ -5,8 +5,10 @@
 package libinit
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/u-root/u-root/pkg/netconf"
 	"github.com/u-root/u-root/pkg/ulog"
 	"github.com/vishvananda/netlink"
 )
@@ -16,6 +18,20 @@ func linuxNetInit() {
 	if err := loopbackUp(); err != nil {
 		ulog.KernelLog.Printf("Failed to initialize loopback: %v", err)
 	}
+
+	// Static networking from ip=, vlan=, bond= and nameserver=, or from
+	// /etc/netconf.{json,yaml}.
+	c, err := netconf.SystemConfig()
+	if err != nil {
+		ulog.KernelLog.Printf("Network configuration: %v", err)
+		return
+	}
+	if c.Empty() {
+		return
+	}
+	if err := netconf.Apply(context.Background(), c); err != nil {
+		ulog.KernelLog.Printf("Failed to configure network: %v", err)
+	}
 }
 
 func loopbackUp() error {
@@ -0,0 +1,124 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nbd exposes an io.ReaderAt as a Linux network block device.
+//
+// The kernel's NBD client is handed one end of a socket pair, and this package
+// serves its requests from the other end, so the device does not need to be a
+// file, e.g. an iSCSI logical unit.
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+// NBD protocol, see
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md.
+const (
+	requestMagic = 0x25609513
+	replyMagic   = 0x67446698
+
+	cmdRead  = 0
+	cmdWrite = 1
+	cmdDisc  = 2
+	cmdFlush = 3
+
+	requestLen = 28
+	replyLen   = 16
+
+	// maxRequest bounds the length of requests.
+	maxRequest = 32 << 20
+)
+
+// ErrBadRequest is returned by Serve if the client does not speak NBD.
+var ErrBadRequest = errors.New("bad NBD request")
+
+// syncer is implemented by devices with a write cache.
+type syncer interface {
+	Sync() error
+}
+
+// Serve answers NBD requests on rw from dev until the client disconnects.
+// Writes fail unless dev is an io.WriterAt, and flushes call its Sync method
+// if it has one.
+func Serve(rw io.ReadWriter, dev io.ReaderAt) error {
+	var req [requestLen]byte
+	for {
+		if _, err := io.ReadFull(rw, req[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(req[0:]) != requestMagic {
+			return fmt.Errorf("%w: magic %#x", ErrBadRequest, req[0:4])
+		}
+		// The upper 16 bits are command flags.
+		typ := binary.BigEndian.Uint16(req[6:])
+		handle := req[8:16]
+		off := int64(binary.BigEndian.Uint64(req[16:]))
+		length := binary.BigEndian.Uint32(req[24:])
+		if length > maxRequest {
+			return fmt.Errorf("%w: %d bytes long", ErrBadRequest, length)
+		}
+
+		var (
+			errno unix.Errno
+			data  []byte
+		)
+		switch typ {
+		case cmdRead:
+			data = make([]byte, length)
+			if n, err := dev.ReadAt(data, off); n != len(data) {
+				errno, data = errnoOf(err), nil
+			}
+
+		case cmdWrite:
+			buf := make([]byte, length)
+			if _, err := io.ReadFull(rw, buf); err != nil {
+				return err
+			}
+			if w, ok := dev.(io.WriterAt); !ok {
+				errno = unix.EPERM
+			} else if _, err := w.WriteAt(buf, off); err != nil {
+				errno = errnoOf(err)
+			}
+
+		case cmdFlush:
+			if s, ok := dev.(syncer); ok {
+				if err := s.Sync(); err != nil {
+					errno = errnoOf(err)
+				}
+			}
+
+		case cmdDisc:
+			return nil
+
+		default:
+			errno = unix.EINVAL
+		}
+
+		reply := make([]byte, replyLen+len(data))
+		binary.BigEndian.PutUint32(reply[0:], replyMagic)
+		binary.BigEndian.PutUint32(reply[4:], uint32(errno))
+		copy(reply[8:], handle)
+		copy(reply[replyLen:], data)
+		if _, err := rw.Write(reply); err != nil {
+			return err
+		}
+	}
+}
+
+// errnoOf returns the error number to report err to the client with.
+func errnoOf(err error) unix.Errno {
+	var errno unix.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+	return unix.EIO
+}
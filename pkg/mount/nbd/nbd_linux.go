@@ -0,0 +1,156 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// NBD ioctl commands, from linux/nbd.h.
+	_NBD_SET_SOCK        = 0xab00
+	_NBD_SET_BLKSIZE     = 0xab01
+	_NBD_DO_IT           = 0xab03
+	_NBD_CLEAR_SOCK      = 0xab04
+	_NBD_CLEAR_QUE       = 0xab05
+	_NBD_SET_SIZE_BLOCKS = 0xab07
+	_NBD_DISCONNECT      = 0xab08
+	_NBD_SET_FLAGS       = 0xab0a
+
+	_NBD_FLAG_HAS_FLAGS  = 1 << 0
+	_NBD_FLAG_READ_ONLY  = 1 << 1
+	_NBD_FLAG_SEND_FLUSH = 1 << 2
+)
+
+// Device is an io.ReaderAt attached to a network block device.
+type Device struct {
+	// Dev is the device path, e.g. /dev/nbd0.
+	Dev string
+
+	f      *os.File
+	client *os.File
+	server *os.File
+
+	// done receives the result of NBD_DO_IT, and served the result of
+	// Serve.
+	done   chan error
+	served chan error
+}
+
+// FindDevice returns the path of an unused network block device.
+func FindDevice() (string, error) {
+	devs, err := filepath.Glob("/sys/block/nbd*")
+	if err != nil {
+		return "", err
+	}
+	for _, d := range devs {
+		// pid exists while a client is attached.
+		if _, err := os.Stat(filepath.Join(d, "pid")); os.IsNotExist(err) {
+			return filepath.Join("/dev", filepath.Base(d)), nil
+		}
+	}
+	return "", errors.New("no unused NBD device, is the nbd module loaded?")
+}
+
+// Attach exposes size bytes of dev at network block device path, in blocks
+// of blockSize bytes. The device is read-only unless dev is an io.WriterAt.
+//
+// dev is served until Detach is called.
+func Attach(path string, dev io.ReaderAt, size, blockSize int64) (*Device, error) {
+	if blockSize <= 0 || size%blockSize != 0 {
+		return nil, fmt.Errorf("size %d is not a multiple of block size %d", size, blockSize)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	d := &Device{
+		Dev:    path,
+		f:      f,
+		client: os.NewFile(uintptr(fds[0]), "nbd-client"),
+		server: os.NewFile(uintptr(fds[1]), "nbd-server"),
+		done:   make(chan error, 1),
+		served: make(chan error, 1),
+	}
+
+	flags := _NBD_FLAG_HAS_FLAGS | _NBD_FLAG_READ_ONLY
+	if _, ok := dev.(io.WriterAt); ok {
+		flags = _NBD_FLAG_HAS_FLAGS | _NBD_FLAG_SEND_FLUSH
+	}
+	fd := int(f.Fd())
+	for _, ioctl := range []struct {
+		name  string
+		req   uint
+		value int
+	}{
+		{"NBD_CLEAR_SOCK", _NBD_CLEAR_SOCK, 0},
+		{"NBD_SET_BLKSIZE", _NBD_SET_BLKSIZE, int(blockSize)},
+		{"NBD_SET_SIZE_BLOCKS", _NBD_SET_SIZE_BLOCKS, int(size / blockSize)},
+		{"NBD_SET_FLAGS", _NBD_SET_FLAGS, flags},
+		{"NBD_SET_SOCK", _NBD_SET_SOCK, fds[0]},
+	} {
+		if err := unix.IoctlSetInt(fd, ioctl.req, ioctl.value); err != nil {
+			d.close()
+			return nil, fmt.Errorf("%s on %s: %v", ioctl.name, path, err)
+		}
+	}
+
+	go func() {
+		d.served <- Serve(d.server, dev)
+	}()
+	go func() {
+		// NBD_DO_IT returns once the device is disconnected.
+		err := unix.IoctlSetInt(fd, _NBD_DO_IT, 0)
+		unix.IoctlSetInt(fd, _NBD_CLEAR_QUE, 0)
+		unix.IoctlSetInt(fd, _NBD_CLEAR_SOCK, 0)
+		d.done <- err
+	}()
+
+	// Wait for the device to come up, so that its partitions can be
+	// found right away.
+	pid := filepath.Join("/sys/block", filepath.Base(path), "pid")
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(pid); err == nil {
+			break
+		}
+		select {
+		case err := <-d.done:
+			d.close()
+			return nil, fmt.Errorf("NBD_DO_IT on %s: %v", path, err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return d, nil
+}
+
+func (d *Device) close() {
+	d.client.Close()
+	d.server.Close()
+	d.f.Close()
+}
+
+// Detach disconnects the network block device. It must not be mounted.
+func (d *Device) Detach() error {
+	if err := unix.IoctlSetInt(int(d.f.Fd()), _NBD_DISCONNECT, 0); err != nil {
+		return fmt.Errorf("NBD_DISCONNECT on %s: %v", d.Dev, err)
+	}
+	// The kernel shuts the socket down, which ends Serve.
+	<-d.done
+	err := <-d.served
+	d.close()
+	return err
+}
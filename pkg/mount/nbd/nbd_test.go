@@ -0,0 +1,163 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// disk is a device in memory.
+type disk struct {
+	b      []byte
+	synced bool
+}
+
+func (d *disk) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(d.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *disk) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(d.b)) {
+		return 0, unix.ENOSPC
+	}
+	return copy(d.b[off:], p), nil
+}
+
+func (d *disk) Sync() error {
+	d.synced = true
+	return nil
+}
+
+// client sends NBD requests like the kernel does.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (c *client) request(typ uint16, handle uint64, off int64, length uint32, data []byte) {
+	c.t.Helper()
+	req := make([]byte, requestLen, requestLen+len(data))
+	binary.BigEndian.PutUint32(req[0:], requestMagic)
+	binary.BigEndian.PutUint16(req[6:], typ)
+	binary.BigEndian.PutUint64(req[8:], handle)
+	binary.BigEndian.PutUint64(req[16:], uint64(off))
+	binary.BigEndian.PutUint32(req[24:], length)
+	if _, err := c.conn.Write(append(req, data...)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// reply reads a reply, and n bytes of data if it succeeded.
+func (c *client) reply(handle uint64, n int) (unix.Errno, []byte) {
+	c.t.Helper()
+	r := make([]byte, replyLen)
+	if _, err := io.ReadFull(c.conn, r); err != nil {
+		c.t.Fatal(err)
+	}
+	if m := binary.BigEndian.Uint32(r); m != replyMagic {
+		c.t.Fatalf("reply magic %#x, want %#x", m, replyMagic)
+	}
+	if h := binary.BigEndian.Uint64(r[8:]); h != handle {
+		c.t.Fatalf("reply handle %#x, want %#x", h, handle)
+	}
+	errno := unix.Errno(binary.BigEndian.Uint32(r[4:]))
+	if errno != 0 {
+		return errno, nil
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(c.conn, data); err != nil {
+		c.t.Fatal(err)
+	}
+	return 0, data
+}
+
+func serve(t *testing.T, dev io.ReaderAt) (*client, chan error) {
+	server, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(server, dev)
+		server.Close()
+	}()
+	return &client{t: t, conn: conn}, done
+}
+
+func TestServe(t *testing.T) {
+	d := &disk{b: make([]byte, 4096)}
+	for i := range d.b {
+		d.b[i] = byte(i)
+	}
+	c, done := serve(t, d)
+
+	c.request(cmdRead, 1, 512, 1024, nil)
+	if errno, data := c.reply(1, 1024); errno != 0 || !bytes.Equal(data, d.b[512:1536]) {
+		t.Errorf("read = %v, %x", errno, data[:16])
+	}
+
+	want := bytes.Repeat([]byte{0xaa}, 512)
+	c.request(cmdWrite, 2, 1024, 512, want)
+	if errno, _ := c.reply(2, 0); errno != 0 {
+		t.Errorf("write = %v", errno)
+	}
+	if !bytes.Equal(d.b[1024:1536], want) {
+		t.Errorf("write did not reach the device")
+	}
+
+	c.request(cmdWrite, 3, 4096, 512, want)
+	if errno, _ := c.reply(3, 0); errno != unix.ENOSPC {
+		t.Errorf("write beyond the end = %v, want %v", errno, unix.ENOSPC)
+	}
+	c.request(cmdRead, 4, 4000, 512, nil)
+	if errno, _ := c.reply(4, 0); errno != unix.EIO {
+		t.Errorf("read beyond the end = %v, want %v", errno, unix.EIO)
+	}
+
+	c.request(cmdFlush, 5, 0, 0, nil)
+	if errno, _ := c.reply(5, 0); errno != 0 || !d.synced {
+		t.Errorf("flush = %v, synced %v", errno, d.synced)
+	}
+	c.request(42, 6, 0, 0, nil)
+	if errno, _ := c.reply(6, 0); errno != unix.EINVAL {
+		t.Errorf("unknown command = %v, want %v", errno, unix.EINVAL)
+	}
+
+	c.request(cmdDisc, 7, 0, 0, nil)
+	if err := <-done; err != nil {
+		t.Errorf("Serve() = %v", err)
+	}
+}
+
+func TestServeReadOnly(t *testing.T) {
+	c, done := serve(t, bytes.NewReader(make([]byte, 4096)))
+	c.request(cmdWrite, 1, 0, 512, make([]byte, 512))
+	if errno, _ := c.reply(1, 0); errno != unix.EPERM {
+		t.Errorf("write = %v, want %v", errno, unix.EPERM)
+	}
+	c.conn.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Serve() = %v", err)
+	}
+}
+
+func TestServeBadRequest(t *testing.T) {
+	c, done := serve(t, bytes.NewReader(nil))
+	go c.conn.Write(make([]byte, requestLen))
+	if err := <-done; !errors.Is(err, ErrBadRequest) {
+		t.Errorf("Serve() = %v, want %v", err, ErrBadRequest)
+	}
+}
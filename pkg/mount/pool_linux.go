@@ -0,0 +1,89 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mount
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// devicePather is implemented by Mounters that know the path of the device
+// they mount, such as block.BlockDev.
+type devicePather interface {
+	DevicePath() string
+}
+
+// Pool keeps track of multiple MountPoints.
+//
+// A Pool mounts each device at most once: asking the pool to mount a device
+// it already mounted returns the existing MountPoint.
+type Pool struct {
+	// MountPoints are all the file systems mounted by or added to this
+	// pool.
+	MountPoints []*MountPoint
+
+	tmpDir string
+}
+
+// Add adds MountPoints that were mounted elsewhere to the pool.
+func (p *Pool) Add(m ...*MountPoint) {
+	p.MountPoints = append(p.MountPoints, m...)
+}
+
+// Mount mounts the file system of mounter in a new temporary directory and
+// adds the MountPoint to the pool.
+//
+// If mounter knows its device path (e.g. it is a block.BlockDev) and that
+// device is already in the pool, the existing MountPoint is returned instead.
+func (p *Pool) Mount(mounter Mounter, flags uintptr) (*MountPoint, error) {
+	var prefix string
+	if d, ok := mounter.(devicePather); ok {
+		for _, mp := range p.MountPoints {
+			if mp.Device == d.DevicePath() {
+				return mp, nil
+			}
+		}
+		prefix = filepath.Base(d.DevicePath()) + "-"
+	}
+
+	if len(p.tmpDir) == 0 {
+		dir, err := ioutil.TempDir("", "u-root-mounts")
+		if err != nil {
+			return nil, fmt.Errorf("cannot create tmpdir: %v", err)
+		}
+		p.tmpDir = dir
+	}
+
+	path, err := ioutil.TempDir(p.tmpDir, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create tmpdir: %v", err)
+	}
+	mp, err := mounter.Mount(path, flags)
+	if err != nil {
+		os.RemoveAll(path)
+		return nil, err
+	}
+	p.MountPoints = append(p.MountPoints, mp)
+	return mp, nil
+}
+
+// UnmountAll unmounts all MountPoints in the pool.
+//
+// UnmountAll tries to unmount every MountPoint, even if some fail, and
+// returns the last error.
+func (p *Pool) UnmountAll(flags uintptr) error {
+	var lastErr error
+	for _, mp := range p.MountPoints {
+		if err := mp.Unmount(flags); err != nil {
+			lastErr = err
+		}
+	}
+	if lastErr == nil {
+		p.MountPoints = nil
+	}
+	return lastErr
+}
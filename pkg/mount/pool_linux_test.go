@@ -0,0 +1,70 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mount
+
+import (
+	"os"
+	"testing"
+)
+
+type fakeMounter struct {
+	dev    string
+	mounts int
+}
+
+func (f *fakeMounter) DevicePath() string {
+	return f.dev
+}
+
+func (f *fakeMounter) Mount(path string, flags uintptr) (*MountPoint, error) {
+	f.mounts++
+	return &MountPoint{Path: path, Device: f.dev, Flags: flags}, nil
+}
+
+func TestPoolMount(t *testing.T) {
+	var p Pool
+	sda1 := &fakeMounter{dev: "/dev/sda1"}
+	sda2 := &fakeMounter{dev: "/dev/sda2"}
+
+	mp1, err := p.Mount(sda1, ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(p.tmpDir)
+
+	mp2, err := p.Mount(sda2, ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp1.Path == mp2.Path {
+		t.Errorf("sda1 and sda2 mounted at the same path %s", mp1.Path)
+	}
+
+	again, err := p.Mount(sda1, ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != mp1 || sda1.mounts != 1 {
+		t.Errorf("Mount(sda1) twice = %v (%d mounts), want %v (1 mount)", again, sda1.mounts, mp1)
+	}
+	if got := len(p.MountPoints); got != 2 {
+		t.Errorf("pool has %d mount points, want 2", got)
+	}
+}
+
+func TestPoolAdd(t *testing.T) {
+	var p Pool
+	mp := &MountPoint{Path: "/mnt/foo", Device: "/dev/sdb1"}
+	p.Add(mp)
+
+	sdb1 := &fakeMounter{dev: "/dev/sdb1"}
+	got, err := p.Mount(sdb1, ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != mp || sdb1.mounts != 0 {
+		t.Errorf("Mount(sdb1) = %v (%d mounts), want added %v", got, sdb1.mounts, mp)
+	}
+}
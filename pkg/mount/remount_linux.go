@@ -0,0 +1,105 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mount
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// remountFlags are the mount flags kept when remounting.
+const remountFlags = unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_NOATIME | unix.MS_NODIRATIME | unix.MS_RELATIME
+
+// RemountWritable remounts the file system that path is on read-write if it
+// is mounted read-only, and returns a function that remounts it read-only
+// again. It is meant for file systems that are mounted read-only to be
+// looked at, but need one file written, e.g. a boot partition.
+func RemountWritable(path string) (restore func() error, err error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return nil, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	if st.Flags&unix.ST_RDONLY == 0 {
+		return func() error { return nil }, nil
+	}
+
+	mp, err := mountPointOf(path)
+	if err != nil {
+		return nil, err
+	}
+	flags := uintptr(st.Flags) & remountFlags
+	if err := unix.Mount("", mp, "", unix.MS_REMOUNT|flags, ""); err != nil {
+		return nil, &os.PathError{Op: "remount read-write", Path: mp, Err: err}
+	}
+	return func() error {
+		if err := unix.Mount("", mp, "", unix.MS_REMOUNT|unix.MS_RDONLY|flags, ""); err != nil {
+			return &os.PathError{Op: "remount read-only", Path: mp, Err: err}
+		}
+		return nil
+	}, nil
+}
+
+// mountPointOf returns the mount point of the file system that path is on,
+// according to /proc/self/mountinfo.
+func mountPointOf(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return "", err
+	}
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// The last of several file systems mounted at the same place is the
+	// visible one.
+	var mp string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		p := unescapeMountInfo(fields[4])
+		if len(p) >= len(mp) && (p == path || p == "/" || strings.HasPrefix(path, p+"/")) {
+			mp = p
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	if mp == "" {
+		return "", fmt.Errorf("no mount point found for %s", path)
+	}
+	return mp, nil
+}
+
+// unescapeMountInfo undoes the octal escapes of spaces and the like in paths
+// in /proc/self/mountinfo.
+func unescapeMountInfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
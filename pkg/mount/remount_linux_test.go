@@ -0,0 +1,70 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mount
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/testutil"
+)
+
+func TestRemountWritable(t *testing.T) {
+	testutil.SkipIfNotRoot(t)
+
+	dir, err := ioutil.TempDir("", "remount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mp, err := Mount("tmpfs", filepath.Join(dir, "with space"), "tmpfs", "", ReadOnly)
+	if err != nil {
+		t.Skipf("cannot mount tmpfs: %v", err)
+	}
+	defer mp.Unmount(MNT_DETACH)
+
+	file := filepath.Join(mp.Path, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err == nil {
+		t.Fatalf("writing to a read-only mount succeeded")
+	}
+
+	restore, err := RemountWritable(mp.Path)
+	if err != nil {
+		t.Fatalf("RemountWritable() = %v", err)
+	}
+	if err := ioutil.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Errorf("writing to the remounted file system: %v", err)
+	}
+
+	// A file on a writable file system needs nothing restored.
+	again, err := RemountWritable(file)
+	if err != nil {
+		t.Fatalf("RemountWritable() = %v", err)
+	}
+	if err := again(); err != nil {
+		t.Errorf("restore() = %v", err)
+	}
+
+	if err := restore(); err != nil {
+		t.Fatalf("restore() = %v", err)
+	}
+	if err := ioutil.WriteFile(file, nil, 0644); err == nil {
+		t.Errorf("writing after restoring the read-only mount succeeded")
+	}
+}
+
+func TestMountPointOf(t *testing.T) {
+	// /proc/self is a symlink to a directory in /proc.
+	for path, want := range map[string]string{
+		"/":          "/",
+		"/proc/self": "/proc",
+	} {
+		if got, err := mountPointOf(path); err != nil || got != want {
+			t.Errorf("mountPointOf(%s) = %s, %v, want %s", path, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netconf
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/u-root/u-root/pkg/dhclient"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// DHCP is how interfaces with DHCP enabled request their addresses.
+var DHCP = dhclient.Config{
+	Timeout: 15 * time.Second,
+	Retries: 3,
+}
+
+// linkUpTimeout is how long to wait for links to come up for DHCP.
+const linkUpTimeout = 30 * time.Second
+
+// Apply configures the network as c describes: it creates bonds and VLANs,
+// configures interfaces, requests DHCP leases, and writes resolv.conf.
+//
+// Apply goes on after errors, so that as much of the network as possible is
+// configured, and returns the first.
+func Apply(ctx context.Context, c *Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	var errs []error
+	for _, b := range c.Bonds {
+		if err := addBond(b); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, v := range c.VLANs {
+		if err := addVLAN(v); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	var dhcp4, dhcp6 []netlink.Link
+	for _, i := range c.Interfaces {
+		links, err := interfaceLinks(i.Name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// Static configuration goes to the first of the interfaces.
+		if err := configure(links[0], i); err != nil {
+			errs = append(errs, err)
+		}
+		if i.DHCP4 {
+			dhcp4 = append(dhcp4, links...)
+		}
+		if i.DHCP6 {
+			dhcp6 = append(dhcp6, links...)
+		}
+	}
+	if err := requestLeases(ctx, dhcp4, true, false); err != nil {
+		errs = append(errs, err)
+	}
+	if err := requestLeases(ctx, dhcp6, false, true); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Static DNS settings win over those of DHCP.
+	if len(c.Nameservers) > 0 || len(c.Search) > 0 || c.Domain != "" {
+		var ns []net.IP
+		for _, s := range c.Nameservers {
+			ns = append(ns, net.ParseIP(s))
+		}
+		if err := dhclient.WriteDNSSettings(ns, c.Search, c.Domain); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.Hostname != "" {
+		if err := unix.Sethostname([]byte(c.Hostname)); err != nil {
+			errs = append(errs, fmt.Errorf("setting host name %s: %v", c.Hostname, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// interfaceLinks returns the link called name, or, if name is empty, all
+// physical links that are not bond slaves, ordered by index.
+func interfaceLinks(name string) ([]netlink.Link, error) {
+	if name != "" {
+		l, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("interface %s: %v", name, err)
+		}
+		return []netlink.Link{l}, nil
+	}
+	all, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	var links []netlink.Link
+	for _, l := range all {
+		a := l.Attrs()
+		if l.Type() != "device" || a.Flags&net.FlagLoopback != 0 || a.MasterIndex != 0 {
+			continue
+		}
+		links = append(links, l)
+	}
+	if len(links) == 0 {
+		return nil, fmt.Errorf("no network interfaces")
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Attrs().Index < links[j].Attrs().Index })
+	return links, nil
+}
+
+func addBond(b Bond) error {
+	l, err := netlink.LinkByName(b.Name)
+	if err != nil {
+		bond := netlink.NewLinkBond(netlink.LinkAttrs{Name: b.Name, MTU: b.MTU})
+		if b.Mode != "" {
+			bond.Mode = netlink.StringToBondMode(b.Mode)
+		}
+		if b.Miimon != 0 {
+			bond.Miimon = b.Miimon
+		}
+		if b.LACPRate != "" {
+			bond.LacpRate = netlink.StringToBondLacpRate(b.LACPRate)
+		}
+		if b.XmitHashPolicy != "" {
+			bond.XmitHashPolicy = netlink.StringToBondXmitHashPolicy(b.XmitHashPolicy)
+		}
+		if err := netlink.LinkAdd(bond); err != nil {
+			return fmt.Errorf("adding bond %s: %v", b.Name, err)
+		}
+		if l, err = netlink.LinkByName(b.Name); err != nil {
+			return fmt.Errorf("bond %s: %v", b.Name, err)
+		}
+	}
+	for _, s := range b.Slaves {
+		sl, err := netlink.LinkByName(s)
+		if err != nil {
+			return fmt.Errorf("bond %s: slave %s: %v", b.Name, s, err)
+		}
+		if sl.Attrs().MasterIndex == l.Attrs().Index {
+			continue
+		}
+		// Links have to be down to be enslaved.
+		if err := netlink.LinkSetDown(sl); err != nil {
+			return fmt.Errorf("bond %s: slave %s: %v", b.Name, s, err)
+		}
+		if err := netlink.LinkSetMasterByIndex(sl, l.Attrs().Index); err != nil {
+			return fmt.Errorf("bond %s: enslaving %s: %v", b.Name, s, err)
+		}
+		if err := netlink.LinkSetUp(sl); err != nil {
+			return fmt.Errorf("bond %s: slave %s: %v", b.Name, s, err)
+		}
+	}
+	if err := netlink.LinkSetUp(l); err != nil {
+		return fmt.Errorf("bond %s: %v", b.Name, err)
+	}
+	return nil
+}
+
+func addVLAN(v VLAN) error {
+	parent, err := netlink.LinkByName(v.Link)
+	if err != nil {
+		return fmt.Errorf("VLAN %s: %v", v.Name, err)
+	}
+	if err := netlink.LinkSetUp(parent); err != nil {
+		return fmt.Errorf("VLAN %s: %v", v.Name, err)
+	}
+	if _, err := netlink.LinkByName(v.Name); err == nil {
+		return nil
+	}
+	vlan := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{Name: v.Name, ParentIndex: parent.Attrs().Index},
+		VlanId:    v.ID,
+	}
+	if err := netlink.LinkAdd(vlan); err != nil {
+		return fmt.Errorf("adding VLAN %s: %v", v.Name, err)
+	}
+	return nil
+}
+
+// configure configures the static settings of i on l, and brings l up.
+func configure(l netlink.Link, i Interface) error {
+	name := l.Attrs().Name
+	if i.MAC != "" {
+		mac, _ := net.ParseMAC(i.MAC)
+		// Many drivers only change the address of links that are down.
+		if err := netlink.LinkSetDown(l); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if err := netlink.LinkSetHardwareAddr(l, mac); err != nil {
+			return fmt.Errorf("%s: setting MAC address %s: %v", name, mac, err)
+		}
+	}
+	if i.MTU != 0 {
+		if err := netlink.LinkSetMTU(l, i.MTU); err != nil {
+			return fmt.Errorf("%s: setting MTU %d: %v", name, i.MTU, err)
+		}
+	}
+	if err := netlink.LinkSetUp(l); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	for _, a := range i.Addresses {
+		ip, n, _ := net.ParseCIDR(a)
+		n.IP = ip
+		if err := netlink.AddrReplace(l, &netlink.Addr{IPNet: n}); err != nil {
+			return fmt.Errorf("%s: adding %s: %v", name, a, err)
+		}
+	}
+	if i.Gateway != "" {
+		r := &netlink.Route{
+			LinkIndex: l.Attrs().Index,
+			Gw:        net.ParseIP(i.Gateway),
+		}
+		if err := netlink.RouteReplace(r); err != nil {
+			return fmt.Errorf("%s: adding default route via %s: %v", name, i.Gateway, err)
+		}
+	}
+	return nil
+}
+
+// requestLeases requests DHCP leases on links and configures them. It
+// fails only if no link gets a lease.
+func requestLeases(ctx context.Context, links []netlink.Link, ipv4, ipv6 bool) error {
+	if len(links) == 0 {
+		return nil
+	}
+	var (
+		configured bool
+		lastErr    error
+	)
+	for r := range dhclient.SendRequests(ctx, links, ipv4, ipv6, DHCP, linkUpTimeout) {
+		err := r.Err
+		if err == nil {
+			err = r.Lease.Configure()
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %s: %v", r.Interface.Attrs().Name, r.Protocol, err)
+			log.Print(lastErr)
+			continue
+		}
+		log.Printf("Configured %s with %s", r.Interface.Attrs().Name, r.Lease)
+		configured = true
+	}
+	if !configured && lastErr != nil {
+		return lastErr
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netconf
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/cmdline"
+	"github.com/vishvananda/netlink"
+)
+
+// ParseCmdline parses the network parameters of a kernel command line:
+//
+//	ip=<client-ip>:<server-ip>:<gw-ip>:<netmask>:<hostname>:<device>:<autoconf>[:<dns0-ip>[:<dns1-ip>]]
+//	ip=<client-ip>:<server-ip>:<gw-ip>:<netmask>:<hostname>:<device>:<autoconf>:[<mtu>][:<mac>]
+//	ip=[<device>:]{dhcp|dhcp6|on|any|off|none}[:<mtu>[:<mac>]]
+//	vlan=<name>:<device>
+//	bond=<name>[:<slaves>[:<options>[:<mtu>]]]
+//	nameserver=<ip>
+//
+// ip= may be given once per interface. IPv6 addresses are in brackets, and
+// netmasks may be prefix lengths. The server IP of ip= is ignored.
+//
+// VLAN names are <device>.<id> or vlan<id>. Bond slaves and options are
+// comma separated, as in bond=bond0:eth0,eth1:mode=802.3ad,miimon=100.
+func ParseCmdline(c cmdline.CmdLine) (*Config, error) {
+	conf := &Config{}
+	for _, v := range c.Values("bond") {
+		// A bare "bond" has the value "1".
+		if v == "1" {
+			v = ""
+		}
+		b, err := parseBond(v)
+		if err != nil {
+			return nil, err
+		}
+		conf.Bonds = append(conf.Bonds, *b)
+	}
+	for _, v := range c.Values("vlan") {
+		vlan, err := parseVLAN(v)
+		if err != nil {
+			return nil, err
+		}
+		conf.VLANs = append(conf.VLANs, *vlan)
+	}
+	for _, v := range c.Values("ip") {
+		if err := conf.parseIP(v); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range c.Values("nameserver") {
+		ns := strings.Trim(v, "[]")
+		if net.ParseIP(ns) == nil {
+			return nil, fmt.Errorf("nameserver=%s: invalid address", v)
+		}
+		conf.Nameservers = append(conf.Nameservers, ns)
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// splitFields splits s at colons that are not within brackets, and removes
+// the brackets.
+func splitFields(s string) []string {
+	var (
+		fields  []string
+		field   strings.Builder
+		bracket bool
+	)
+	for _, r := range s {
+		switch {
+		case r == '[':
+			bracket = true
+		case r == ']':
+			bracket = false
+		case r == ':' && !bracket:
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	return append(fields, field.String())
+}
+
+// autoconf returns the DHCP protocols of an ip= autoconfiguration method,
+// and whether it is one.
+func autoconf(method string) (dhcp4, dhcp6, ok bool) {
+	switch method {
+	case "", "off", "none", "static", "auto6":
+		// Addresses of auto6 come from router advertisements, which
+		// the kernel handles as soon as the link is up.
+		return false, false, true
+	case "dhcp":
+		return true, false, true
+	case "dhcp6":
+		return false, true, true
+	case "on", "any", "both":
+		return true, true, true
+	}
+	return false, false, false
+}
+
+// parseIP parses the value of an ip= parameter into c.
+func (c *Config) parseIP(v string) error {
+	f := splitFields(v)
+
+	// ip=<method> and ip=<device>:<method>[:<mtu>[:<mac>]].
+	if _, _, ok := autoconf(f[0]); ok && len(f) == 1 {
+		f = []string{"", "", "", "", "", "", f[0]}
+	} else if len(f) > 1 && f[0] != "" && f[1] != "" && net.ParseIP(f[0]) == nil {
+		if _, _, ok := autoconf(f[1]); ok {
+			f = append([]string{"", "", "", "", "", f[0]}, f[1:]...)
+		}
+	}
+	for len(f) < 7 {
+		f = append(f, "")
+	}
+
+	dhcp4, dhcp6, ok := autoconf(f[6])
+	if !ok {
+		return fmt.Errorf("ip=%s: unknown autoconfiguration method %q", v, f[6])
+	}
+	if (f[6] == "off" || f[6] == "none") && f[0] == "" && f[5] == "" {
+		// Networking is off.
+		return nil
+	}
+	i := Interface{
+		Name:    f[5],
+		Gateway: f[2],
+		DHCP4:   dhcp4,
+		DHCP6:   dhcp6,
+	}
+
+	if f[0] != "" {
+		ip := net.ParseIP(f[0])
+		if ip == nil {
+			return fmt.Errorf("ip=%s: invalid client address %q", v, f[0])
+		}
+		mask, err := parseMask(ip, f[3])
+		if err != nil {
+			return fmt.Errorf("ip=%s: %v", v, err)
+		}
+		i.Addresses = []string{(&net.IPNet{IP: ip, Mask: mask}).String()}
+	}
+	if f[4] != "" {
+		c.Hostname = f[4]
+	}
+
+	// The kernel has DNS servers after the method, dracut an MTU and a
+	// MAC address, which has colons itself.
+	if rest := f[7:]; len(rest) > 0 {
+		mtu, err := strconv.Atoi(rest[0])
+		mac := strings.Join(rest[1:], ":")
+		_, macErr := net.ParseMAC(mac)
+		if (err == nil || rest[0] == "") && (len(rest) == 1 || macErr == nil) {
+			i.MTU = mtu
+			if len(rest) > 1 {
+				i.MAC = mac
+			}
+		} else {
+			// Ignore the NTP server.
+			if len(rest) > 2 {
+				rest = rest[:2]
+			}
+			for _, ns := range rest {
+				if ns == "" {
+					continue
+				}
+				if net.ParseIP(ns) == nil {
+					return fmt.Errorf("ip=%s: invalid DNS server %q", v, ns)
+				}
+				c.Nameservers = append(c.Nameservers, ns)
+			}
+		}
+	}
+	c.Interfaces = append(c.Interfaces, i)
+	return nil
+}
+
+// parseMask parses a dotted netmask or prefix length for ip. Empty means
+// the default mask of the address class of IPv4 addresses, and /64 for IPv6.
+func parseMask(ip net.IP, mask string) (net.IPMask, error) {
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		bits = 8 * net.IPv4len
+	}
+	switch {
+	case mask == "" && bits == 32:
+		return ip.DefaultMask(), nil
+	case mask == "":
+		return net.CIDRMask(64, bits), nil
+	}
+	if n, err := strconv.Atoi(mask); err == nil {
+		if n < 0 || n > bits {
+			return nil, fmt.Errorf("invalid prefix length %d", n)
+		}
+		return net.CIDRMask(n, bits), nil
+	}
+	m := net.ParseIP(mask)
+	if m == nil || m.To4() == nil || bits != 32 {
+		return nil, fmt.Errorf("invalid netmask %q", mask)
+	}
+	im := net.IPMask(m.To4())
+	if ones, _ := im.Size(); ones == 0 && !m.Equal(net.IPv4zero) {
+		return nil, fmt.Errorf("netmask %s is not contiguous", mask)
+	}
+	return im, nil
+}
+
+// parseVLAN parses the value of a vlan= parameter.
+func parseVLAN(v string) (*VLAN, error) {
+	f := strings.Split(v, ":")
+	if len(f) != 2 || f[0] == "" || f[1] == "" {
+		return nil, fmt.Errorf("vlan=%s: not <name>:<device>", v)
+	}
+	id := f[0]
+	if i := strings.LastIndexByte(id, '.'); i >= 0 {
+		id = id[i+1:]
+	} else {
+		id = strings.TrimPrefix(id, "vlan")
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, fmt.Errorf("vlan=%s: name %s is neither <device>.<id> nor vlan<id>", v, f[0])
+	}
+	return &VLAN{Name: f[0], Link: f[1], ID: n}, nil
+}
+
+// parseBond parses the value of a bond= parameter. Without slaves, a bond
+// is made of eth0 and eth1, as dracut does.
+func parseBond(v string) (*Bond, error) {
+	f := strings.Split(v, ":")
+	b := &Bond{Name: f[0], Slaves: []string{"eth0", "eth1"}}
+	if b.Name == "" {
+		b.Name = "bond0"
+	}
+	if len(f) > 1 && f[1] != "" {
+		b.Slaves = strings.Split(f[1], ",")
+	}
+	if len(f) > 2 && f[2] != "" {
+		for _, o := range strings.Split(f[2], ",") {
+			kv := strings.SplitN(o, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("bond=%s: option %q is not key=value", v, o)
+			}
+			var err error
+			switch kv[0] {
+			case "mode":
+				b.Mode = kv[1]
+				// Modes may be given by number, too.
+				if n, nerr := strconv.Atoi(kv[1]); nerr == nil && n >= 0 && netlink.BondMode(n) < netlink.BOND_MODE_UNKNOWN {
+					b.Mode = netlink.BondMode(n).String()
+				}
+			case "miimon":
+				b.Miimon, err = strconv.Atoi(kv[1])
+			case "lacp_rate":
+				b.LACPRate = kv[1]
+			case "xmit_hash_policy":
+				b.XmitHashPolicy = kv[1]
+			default:
+				return nil, fmt.Errorf("bond=%s: unsupported option %q", v, kv[0])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("bond=%s: %v", v, err)
+			}
+		}
+	}
+	if len(f) > 3 && f[3] != "" {
+		mtu, err := strconv.Atoi(f[3])
+		if err != nil {
+			return nil, fmt.Errorf("bond=%s: invalid MTU %q", v, f[3])
+		}
+		b.MTU = mtu
+	}
+	return b, nil
+}
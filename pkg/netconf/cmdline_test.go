@@ -0,0 +1,110 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netconf
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cmdline"
+)
+
+func TestParseCmdline(t *testing.T) {
+	for _, tt := range []struct {
+		cmdline string
+		want    *Config
+	}{
+		{
+			cmdline: "console=ttyS0 quiet",
+			want:    &Config{},
+		},
+		{
+			cmdline: "ip=dhcp",
+			want:    &Config{Interfaces: []Interface{{DHCP4: true}}},
+		},
+		{
+			cmdline: "ip=off",
+			want:    &Config{},
+		},
+		{
+			cmdline: "ip=eth1:dhcp6 ip=eth2:on:9000:52:54:00:12:34:56",
+			want: &Config{Interfaces: []Interface{
+				{Name: "eth1", DHCP6: true},
+				{Name: "eth2", DHCP4: true, DHCP6: true, MTU: 9000, MAC: "52:54:00:12:34:56"},
+			}},
+		},
+		{
+			cmdline: "ip=10.0.0.2:10.0.0.10:10.0.0.1:255.255.255.0:box:eth0:off:10.0.0.53:10.0.1.53:10.0.0.123",
+			want: &Config{
+				Interfaces:  []Interface{{Name: "eth0", Addresses: []string{"10.0.0.2/24"}, Gateway: "10.0.0.1"}},
+				Nameservers: []string{"10.0.0.53", "10.0.1.53"},
+				Hostname:    "box",
+			},
+		},
+		{
+			// Class A default netmask.
+			cmdline: "ip=10.0.0.2:::::eth0:none",
+			want:    &Config{Interfaces: []Interface{{Name: "eth0", Addresses: []string{"10.0.0.2/8"}}}},
+		},
+		{
+			cmdline: "ip=[fd00::2]::[fd00::1]:64::eth0:none:1500 nameserver=[fd00::53] nameserver=10.0.0.53",
+			want: &Config{
+				Interfaces:  []Interface{{Name: "eth0", Addresses: []string{"fd00::2/64"}, Gateway: "fd00::1", MTU: 1500}},
+				Nameservers: []string{"fd00::53", "10.0.0.53"},
+			},
+		},
+		{
+			cmdline: "bond=bond0:eth0,eth1:mode=4,miimon=100,lacp_rate=fast,xmit_hash_policy=layer3+4:9000 " +
+				"vlan=bond0.100:bond0 vlan=vlan0200:eth2 ip=10.0.0.2::10.0.0.1:24::bond0.100:none",
+			want: &Config{
+				Bonds: []Bond{{
+					Name:           "bond0",
+					Slaves:         []string{"eth0", "eth1"},
+					Mode:           "802.3ad",
+					Miimon:         100,
+					LACPRate:       "fast",
+					XmitHashPolicy: "layer3+4",
+					MTU:            9000,
+				}},
+				VLANs: []VLAN{
+					{Name: "bond0.100", Link: "bond0", ID: 100},
+					{Name: "vlan0200", Link: "eth2", ID: 200},
+				},
+				Interfaces: []Interface{{Name: "bond0.100", Addresses: []string{"10.0.0.2/24"}, Gateway: "10.0.0.1"}},
+			},
+		},
+		{
+			cmdline: "bond",
+			want:    &Config{Bonds: []Bond{{Name: "bond0", Slaves: []string{"eth0", "eth1"}}}},
+		},
+		{cmdline: "ip=10.0.0.2:::255.0.255.0::eth0:none"},
+		{cmdline: "ip=10.0.0.2:::33::eth0:none"},
+		{cmdline: "ip=10.0.0.300:::::eth0:none"},
+		{cmdline: "ip=eth0:bootp"},
+		{cmdline: "ip=10.0.0.2:::::eth0:none:10.0.0.1:dns"},
+		{cmdline: "ip=:::::eth0:dhcp::52:54:00"},
+		{cmdline: "vlan=eth0"},
+		{cmdline: "vlan=foo:eth0"},
+		{cmdline: "vlan=eth0.5000:eth0"},
+		{cmdline: "bond=bond0:eth0:mode=fastest"},
+		{cmdline: "bond=bond0:eth0:primary=eth0"},
+		{cmdline: "nameserver=dns"},
+	} {
+		got, err := ParseCmdline(cmdline.CmdLine{Raw: tt.cmdline})
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ParseCmdline(%q) = %+v, want error", tt.cmdline, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCmdline(%q) = %v", tt.cmdline, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseCmdline(%q) = %+v, want %+v", tt.cmdline, got, tt.want)
+		}
+	}
+}
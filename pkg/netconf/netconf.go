@@ -0,0 +1,257 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package netconf configures networking from a declarative description.
+//
+// The description is either a JSON or YAML file, such as
+//
+//	{
+//	  "bonds": [{"name": "bond0", "slaves": ["eth0", "eth1"], "mode": "802.3ad"}],
+//	  "vlans": [{"name": "bond0.100", "link": "bond0", "id": 100}],
+//	  "interfaces": [
+//	    {"name": "bond0.100", "addresses": ["10.0.0.2/24"], "gateway": "10.0.0.1"},
+//	    {"name": "eth2", "dhcp4": true}
+//	  ],
+//	  "nameservers": ["10.0.0.1"]
+//	}
+//
+// or the kernel command line parameters ip=, vlan=, bond= and nameserver=
+// in the format of the kernel and dracut (see ParseCmdline).
+package netconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/cmdline"
+	"github.com/vishvananda/netlink"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultFiles are the configuration files SystemConfig reads, if they
+// exist.
+var DefaultFiles = []string{"/etc/netconf.json", "/etc/netconf.yaml"}
+
+// Config is a network configuration.
+type Config struct {
+	// Bonds are created first, then VLANs, then Interfaces are
+	// configured, so that interfaces may be bonds and VLANs.
+	Bonds      []Bond      `json:"bonds,omitempty" yaml:"bonds,omitempty"`
+	VLANs      []VLAN      `json:"vlans,omitempty" yaml:"vlans,omitempty"`
+	Interfaces []Interface `json:"interfaces,omitempty" yaml:"interfaces,omitempty"`
+
+	// Nameservers, Search and Domain are written to resolv.conf, if any
+	// is set.
+	Nameservers []string `json:"nameservers,omitempty" yaml:"nameservers,omitempty"`
+	Search      []string `json:"search,omitempty" yaml:"search,omitempty"`
+	Domain      string   `json:"domain,omitempty" yaml:"domain,omitempty"`
+
+	// Hostname, if set, is the host name to set.
+	Hostname string `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+}
+
+// Interface is the configuration of a network interface.
+type Interface struct {
+	// Name is the name of the interface. Empty means the first interface
+	// that is not a loopback, bond or VLAN.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// Addresses are static addresses in CIDR notation.
+	Addresses []string `json:"addresses,omitempty" yaml:"addresses,omitempty"`
+
+	// Gateway, if set, is the default gateway through the interface.
+	Gateway string `json:"gateway,omitempty" yaml:"gateway,omitempty"`
+
+	// DHCP4 and DHCP6 request addresses with DHCPv4 and DHCPv6.
+	DHCP4 bool `json:"dhcp4,omitempty" yaml:"dhcp4,omitempty"`
+	DHCP6 bool `json:"dhcp6,omitempty" yaml:"dhcp6,omitempty"`
+
+	// MTU, if not zero, is the MTU to set.
+	MTU int `json:"mtu,omitempty" yaml:"mtu,omitempty"`
+
+	// MAC, if set, is the hardware address to set.
+	MAC string `json:"mac,omitempty" yaml:"mac,omitempty"`
+}
+
+// VLAN is an 802.1Q VLAN interface.
+type VLAN struct {
+	// Name is the name of the VLAN interface.
+	Name string `json:"name" yaml:"name"`
+
+	// Link is the interface the VLAN is on.
+	Link string `json:"link" yaml:"link"`
+
+	// ID is the VLAN ID.
+	ID int `json:"id" yaml:"id"`
+}
+
+// Bond is a bonding interface.
+type Bond struct {
+	// Name is the name of the bond.
+	Name string `json:"name" yaml:"name"`
+
+	// Slaves are the interfaces the bond is made of.
+	Slaves []string `json:"slaves" yaml:"slaves"`
+
+	// Mode is the bonding mode, such as "active-backup" or "802.3ad".
+	// Empty means the kernel's default, "balance-rr".
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+
+	// Miimon is the link monitoring interval in milliseconds, if not
+	// zero.
+	Miimon int `json:"miimon,omitempty" yaml:"miimon,omitempty"`
+
+	// LACPRate is "slow" or "fast" in 802.3ad mode.
+	LACPRate string `json:"lacp_rate,omitempty" yaml:"lacp_rate,omitempty"`
+
+	// XmitHashPolicy is the policy to pick slaves with, such as
+	// "layer3+4".
+	XmitHashPolicy string `json:"xmit_hash_policy,omitempty" yaml:"xmit_hash_policy,omitempty"`
+
+	// MTU, if not zero, is the MTU to set.
+	MTU int `json:"mtu,omitempty" yaml:"mtu,omitempty"`
+}
+
+// Empty returns whether c configures nothing.
+func (c *Config) Empty() bool {
+	return len(c.Bonds) == 0 && len(c.VLANs) == 0 && len(c.Interfaces) == 0 &&
+		len(c.Nameservers) == 0 && len(c.Search) == 0 && c.Domain == "" && c.Hostname == ""
+}
+
+// Merge appends the configuration of o to c. The host name and domain of o
+// replace those of c if they are set.
+func (c *Config) Merge(o *Config) {
+	c.Bonds = append(c.Bonds, o.Bonds...)
+	c.VLANs = append(c.VLANs, o.VLANs...)
+	c.Interfaces = append(c.Interfaces, o.Interfaces...)
+	c.Nameservers = append(c.Nameservers, o.Nameservers...)
+	c.Search = append(c.Search, o.Search...)
+	if o.Domain != "" {
+		c.Domain = o.Domain
+	}
+	if o.Hostname != "" {
+		c.Hostname = o.Hostname
+	}
+}
+
+// Validate checks that all addresses and names in c are valid.
+func (c *Config) Validate() error {
+	for _, b := range c.Bonds {
+		if b.Name == "" {
+			return errors.New("bond without name")
+		}
+		if len(b.Slaves) == 0 {
+			return fmt.Errorf("bond %s has no slaves", b.Name)
+		}
+		if b.Mode != "" {
+			if _, ok := netlink.StringToBondModeMap[b.Mode]; !ok {
+				return fmt.Errorf("bond %s: unknown mode %q", b.Name, b.Mode)
+			}
+		}
+		if b.LACPRate != "" && b.LACPRate != "slow" && b.LACPRate != "fast" {
+			return fmt.Errorf("bond %s: unknown LACP rate %q", b.Name, b.LACPRate)
+		}
+		if b.XmitHashPolicy != "" {
+			if _, ok := netlink.StringToBondXmitHashPolicyMap[b.XmitHashPolicy]; !ok {
+				return fmt.Errorf("bond %s: unknown transmit hash policy %q", b.Name, b.XmitHashPolicy)
+			}
+		}
+	}
+	for _, v := range c.VLANs {
+		if v.Name == "" || v.Link == "" {
+			return fmt.Errorf("VLAN %d needs a name and a link", v.ID)
+		}
+		if v.ID < 1 || v.ID > 4094 {
+			return fmt.Errorf("VLAN %s: ID %d is not within 1-4094", v.Name, v.ID)
+		}
+	}
+	for _, i := range c.Interfaces {
+		for _, a := range i.Addresses {
+			if _, _, err := net.ParseCIDR(a); err != nil {
+				return fmt.Errorf("interface %s: %v", i.Name, err)
+			}
+		}
+		if i.Gateway != "" && net.ParseIP(i.Gateway) == nil {
+			return fmt.Errorf("interface %s: invalid gateway %q", i.Name, i.Gateway)
+		}
+		if i.MAC != "" {
+			if _, err := net.ParseMAC(i.MAC); err != nil {
+				return fmt.Errorf("interface %s: %v", i.Name, err)
+			}
+		}
+	}
+	for _, ns := range c.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("invalid nameserver %q", ns)
+		}
+	}
+	return nil
+}
+
+// Parse parses a JSON or YAML configuration. JSON is a subset of YAML, so
+// both are parsed as YAML.
+func Parse(b []byte) (*Config, error) {
+	var c Config
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Load reads a configuration from a JSON or YAML file.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c *Config
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		// Better error messages for JSON.
+		c = &Config{}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(c); err == nil {
+			err = c.Validate()
+		}
+	default:
+		c, err = Parse(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// SystemConfig returns the configuration of DefaultFiles, followed by that
+// of the kernel command line.
+func SystemConfig() (*Config, error) {
+	c := &Config{}
+	for _, f := range DefaultFiles {
+		fc, err := Load(f)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.Merge(fc)
+	}
+	cc, err := ParseCmdline(cmdline.NewCmdLine())
+	if err != nil {
+		return nil, err
+	}
+	c.Merge(cc)
+	return c, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netconf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var want = &Config{
+	Bonds:       []Bond{{Name: "bond0", Slaves: []string{"eth0", "eth1"}, Mode: "active-backup", Miimon: 100}},
+	VLANs:       []VLAN{{Name: "bond0.100", Link: "bond0", ID: 100}},
+	Interfaces:  []Interface{{Name: "bond0.100", Addresses: []string{"10.0.0.2/24"}, Gateway: "10.0.0.1"}, {Name: "eth2", DHCP4: true}},
+	Nameservers: []string{"10.0.0.53"},
+	Search:      []string{"example.com"},
+}
+
+const jsonConfig = `{
+  "bonds": [{"name": "bond0", "slaves": ["eth0", "eth1"], "mode": "active-backup", "miimon": 100}],
+  "vlans": [{"name": "bond0.100", "link": "bond0", "id": 100}],
+  "interfaces": [
+    {"name": "bond0.100", "addresses": ["10.0.0.2/24"], "gateway": "10.0.0.1"},
+    {"name": "eth2", "dhcp4": true}
+  ],
+  "nameservers": ["10.0.0.53"],
+  "search": ["example.com"]
+}`
+
+const yamlConfig = `
+bonds:
+- name: bond0
+  slaves: [eth0, eth1]
+  mode: active-backup
+  miimon: 100
+vlans:
+- {name: bond0.100, link: bond0, id: 100}
+interfaces:
+- name: bond0.100
+  addresses: [10.0.0.2/24]
+  gateway: 10.0.0.1
+- name: eth2
+  dhcp4: true
+nameservers: [10.0.0.53]
+search: [example.com]
+`
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range []struct {
+		file    string
+		content string
+		err     bool
+	}{
+		{file: "netconf.json", content: jsonConfig},
+		{file: "netconf.yaml", content: yamlConfig},
+		// JSON is YAML, too.
+		{file: "netconf.yml", content: jsonConfig},
+		{file: "typo.json", content: `{"interface": []}`, err: true},
+		{file: "typo.yaml", content: `interface: []`, err: true},
+		{file: "invalid.yaml", content: `interfaces: [{name: eth0, addresses: [10.0.0.2]}]`, err: true},
+	} {
+		path := filepath.Join(dir, tt.file)
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := Load(path)
+		if tt.err {
+			if err == nil {
+				t.Errorf("Load(%s) = %+v, want error", tt.file, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Load(%s) = %v", tt.file, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("Load(%s) = %+v, want %+v", tt.file, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []*Config{
+		{Bonds: []Bond{{Slaves: []string{"eth0"}}}},
+		{Bonds: []Bond{{Name: "bond0"}}},
+		{Bonds: []Bond{{Name: "bond0", Slaves: []string{"eth0"}, LACPRate: "faster"}}},
+		{Bonds: []Bond{{Name: "bond0", Slaves: []string{"eth0"}, XmitHashPolicy: "layer5"}}},
+		{VLANs: []VLAN{{Name: "eth0.0", Link: "eth0"}}},
+		{VLANs: []VLAN{{Link: "eth0", ID: 5}}},
+		{Interfaces: []Interface{{Name: "eth0", Gateway: "gw"}}},
+		{Interfaces: []Interface{{Name: "eth0", MAC: "52:54"}}},
+		{Nameservers: []string{"ns1"}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%+v.Validate() = nil, want error", c)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	c := &Config{Interfaces: []Interface{{Name: "eth0"}}, Hostname: "a", Domain: "example.com"}
+	c.Merge(&Config{Interfaces: []Interface{{Name: "eth1"}}, Hostname: "b", Nameservers: []string{"10.0.0.53"}})
+	m := &Config{
+		Interfaces:  []Interface{{Name: "eth0"}, {Name: "eth1"}},
+		Nameservers: []string{"10.0.0.53"},
+		Domain:      "example.com",
+		Hostname:    "b",
+	}
+	if !reflect.DeepEqual(c, m) {
+		t.Errorf("Merge = %+v, want %+v", c, m)
+	}
+	if c.Empty() || !(&Config{}).Empty() {
+		t.Errorf("Empty is wrong")
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nfs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/mount"
+)
+
+// Mount mounts export of server at dir with the kernel's NFS client, for
+// example as the root file system to switch_root into.
+//
+// The kernel does not resolve host names, so Mount passes the address of the
+// server, and NFS version 3 without locking unless options say otherwise.
+func Mount(ctx context.Context, server, export, dir, options string, flags uintptr) (*mount.MountPoint, error) {
+	data := mountData(options)
+	if _, ok := data["addr"]; !ok {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, server)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no address for NFS server %s", server)
+		}
+		options = appendOption(options, "addr="+ips[0].IP.String())
+	}
+	if _, ok := data["vers"]; !ok {
+		if _, ok := data["nfsvers"]; !ok {
+			options = appendOption(options, "vers=3")
+		}
+	}
+	if _, ok := data["lock"]; !ok {
+		if _, ok := data["nolock"]; !ok {
+			options = appendOption(options, "nolock")
+		}
+	}
+	source := server + ":" + export
+	if strings.Contains(server, ":") {
+		source = "[" + server + "]:" + export
+	}
+	return mount.Mount(source, dir, "nfs", options, flags)
+}
+
+// mountData returns the names of the comma separated options.
+func mountData(options string) map[string]struct{} {
+	data := make(map[string]struct{})
+	for _, o := range strings.Split(options, ",") {
+		if i := strings.IndexByte(o, '='); i >= 0 {
+			o = o[:i]
+		}
+		if o != "" {
+			data[o] = struct{}{}
+		}
+	}
+	return data
+}
+
+func appendOption(options, o string) string {
+	if options == "" {
+		return o
+	}
+	return options + "," + o
+}
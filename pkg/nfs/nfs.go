@@ -0,0 +1,619 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nfs implements a read-only NFSv3 client, RFC 1813.
+//
+// The client mounts an export with the MOUNT protocol and reads files from it
+// over UDP or TCP, asking the server's portmapper for the ports of both.
+// Only AUTH_UNIX credentials are supported.
+package nfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RPC programs, versions and procedures.
+const (
+	portmapProg = 100000
+	portmapVers = 2
+	pmapGetPort = 3
+
+	mountProg   = 100005
+	mountVers   = 3
+	mountMnt    = 1
+	mountUmnt   = 3
+	mountExport = 5
+
+	nfsProg     = 100003
+	nfsVers     = 3
+	nfsGetattr  = 1
+	nfsLookup   = 3
+	nfsReadlink = 5
+	nfsRead     = 6
+)
+
+const (
+	// PortmapPort is the port of the portmapper.
+	PortmapPort = 111
+
+	// NFSPort is the port of the NFS server if the portmapper does not know
+	// it.
+	NFSPort = 2049
+
+	// maxFH is the maximum size of an NFSv3 file handle.
+	maxFH = 64
+
+	// maxPath is the maximum length of a path or symlink target.
+	maxPath = 4096
+
+	// maxLinks is the number of symlinks a lookup follows.
+	maxLinks = 40
+
+	// maxExports bounds the exports and groups listed by a server.
+	maxExports = 4096
+
+	// Read sizes. Datagrams have to fit a UDP packet.
+	tcpReadSize = 32 << 10
+	udpReadSize = 8 << 10
+)
+
+// Error is a status an NFS or MOUNT server returned, nfsstat3 and
+// mountstat3 in RFC 1813.
+type Error uint32
+
+// Status values shared by nfsstat3 and mountstat3.
+const (
+	ErrPerm        Error = 1
+	ErrNoEnt       Error = 2
+	ErrIO          Error = 5
+	ErrNXIO        Error = 6
+	ErrAccess      Error = 13
+	ErrExist       Error = 17
+	ErrNotDir      Error = 20
+	ErrIsDir       Error = 21
+	ErrInval       Error = 22
+	ErrNameTooLong Error = 63
+	ErrStale       Error = 70
+	ErrBadHandle   Error = 10001
+	ErrServerFault Error = 10006
+)
+
+var errorNames = map[Error]string{
+	ErrPerm:        "operation not permitted",
+	ErrNoEnt:       "no such file or directory",
+	ErrIO:          "I/O error",
+	ErrNXIO:        "no such device or address",
+	ErrAccess:      "permission denied",
+	ErrExist:       "file exists",
+	ErrNotDir:      "not a directory",
+	ErrIsDir:       "is a directory",
+	ErrInval:       "invalid argument",
+	ErrNameTooLong: "file name too long",
+	ErrStale:       "stale file handle",
+	ErrBadHandle:   "bad file handle",
+	ErrServerFault: "server fault",
+}
+
+// Error implements error.
+func (e Error) Error() string {
+	if s, ok := errorNames[e]; ok {
+		return "NFS: " + s
+	}
+	return fmt.Sprintf("NFS error %d", uint32(e))
+}
+
+// Is makes errors.Is match ErrNoEnt with os.ErrNotExist, and ErrPerm and
+// ErrAccess with os.ErrPermission.
+func (e Error) Is(target error) bool {
+	switch target {
+	case os.ErrNotExist:
+		return e == ErrNoEnt
+	case os.ErrPermission:
+		return e == ErrPerm || e == ErrAccess
+	}
+	return false
+}
+
+// Config is how to talk to an NFS server.
+type Config struct {
+	// Network is "tcp" or "udp". Empty means "tcp".
+	Network string
+
+	// Port is the port of the NFS service. Zero means asking the
+	// portmapper, and NFSPort if that fails.
+	Port int
+
+	// MountPort is the port of the MOUNT service. Zero means asking the
+	// portmapper.
+	MountPort int
+
+	// PortmapPort is the port of the portmapper. Zero means PortmapPort.
+	PortmapPort int
+
+	// UID and GID are the credentials of the client.
+	UID, GID uint32
+
+	// Timeout is how long to wait for each reply. Zero means 30 seconds.
+	Timeout time.Duration
+}
+
+func (c Config) network() string {
+	if c.Network == "" {
+		return "tcp"
+	}
+	return c.Network
+}
+
+func (c Config) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return 30 * time.Second
+	}
+	return c.Timeout
+}
+
+// port returns the port of prog on server, asking the portmapper.
+func (c Config) port(ctx context.Context, server string, prog, vers uint32) (int, error) {
+	pp := c.PortmapPort
+	if pp == 0 {
+		pp = PortmapPort
+	}
+	rc, err := dialRPC(ctx, c.network(), net.JoinHostPort(server, strconv.Itoa(pp)), c)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	proto := uint32(6)
+	if c.network() == "udp" {
+		proto = 17
+	}
+	var e encoder
+	e.uint32(prog)
+	e.uint32(vers)
+	e.uint32(proto)
+	e.uint32(0)
+	d, err := rc.call(ctx, portmapProg, portmapVers, pmapGetPort, e.b)
+	if err != nil {
+		return 0, fmt.Errorf("portmapper of %s: %w", server, err)
+	}
+	port := d.uint32()
+	if d.err != nil {
+		return 0, fmt.Errorf("portmapper of %s: %v", server, d.err)
+	}
+	if port == 0 || port > 65535 {
+		return 0, fmt.Errorf("program %d version %d is not registered with the portmapper of %s", prog, vers, server)
+	}
+	return int(port), nil
+}
+
+// dialMount connects to the MOUNT service of server.
+func (c Config) dialMount(ctx context.Context, server string) (*rpcClient, error) {
+	port := c.MountPort
+	if port == 0 {
+		var err error
+		if port, err = c.port(ctx, server, mountProg, mountVers); err != nil {
+			return nil, err
+		}
+	}
+	return dialRPC(ctx, c.network(), net.JoinHostPort(server, strconv.Itoa(port)), c)
+}
+
+// Exports returns the exports of server.
+func Exports(ctx context.Context, server string, c Config) ([]string, error) {
+	mc, err := c.dialMount(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	defer mc.Close()
+
+	d, err := mc.call(ctx, mountProg, mountVers, mountExport, nil)
+	if err != nil {
+		return nil, err
+	}
+	var exports []string
+	for d.bool() && len(exports) < maxExports {
+		exports = append(exports, d.string(maxPath))
+		// Skip the groups allowed to mount the export.
+		for i := 0; d.bool() && i < maxExports; i++ {
+			d.string(maxPath)
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return exports, nil
+}
+
+// Client is a mounted NFS export.
+type Client struct {
+	c        Config
+	server   string
+	export   string
+	mnt      *rpcClient
+	nfs      *rpcClient
+	root     []byte
+	readSize int
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Dial mounts export of server.
+func Dial(ctx context.Context, server, export string, c Config) (*Client, error) {
+	if n := c.network(); n != "tcp" && n != "udp" {
+		return nil, fmt.Errorf("unsupported network %q for NFS", n)
+	}
+	mc, err := c.dialMount(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+
+	var e encoder
+	e.string(export)
+	d, err := mc.call(ctx, mountProg, mountVers, mountMnt, e.b)
+	if err != nil {
+		mc.Close()
+		return nil, err
+	}
+	if stat := Error(d.uint32()); d.err == nil && stat != 0 {
+		mc.Close()
+		return nil, fmt.Errorf("mounting %s:%s: %w", server, export, stat)
+	}
+	root := d.opaque(maxFH)
+	if d.err != nil {
+		mc.Close()
+		return nil, fmt.Errorf("mounting %s:%s: %v", server, export, d.err)
+	}
+
+	port := c.Port
+	if port == 0 {
+		if port, err = c.port(ctx, server, nfsProg, nfsVers); err != nil {
+			port = NFSPort
+		}
+	}
+	nc, err := dialRPC(ctx, c.network(), net.JoinHostPort(server, strconv.Itoa(port)), c)
+	if err != nil {
+		mc.Close()
+		return nil, err
+	}
+	cl := &Client{
+		c:        c,
+		server:   server,
+		export:   export,
+		mnt:      mc,
+		nfs:      nc,
+		root:     append([]byte(nil), root...),
+		readSize: tcpReadSize,
+	}
+	if nc.udp {
+		cl.readSize = udpReadSize
+	}
+	return cl, nil
+}
+
+// Close unmounts the export and closes the connections to the server.
+func (cl *Client) Close() error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.closed {
+		return nil
+	}
+	cl.closed = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), cl.c.timeout())
+	defer cancel()
+	var e encoder
+	e.string(cl.export)
+	_, err := cl.mnt.call(ctx, mountProg, mountVers, mountUmnt, e.b)
+	cl.mnt.Close()
+	cl.nfs.Close()
+	return err
+}
+
+// File types, ftype3.
+const (
+	typeReg  = 1
+	typeDir  = 2
+	typeBlk  = 3
+	typeChr  = 4
+	typeLink = 5
+	typeSock = 6
+	typeFIFO = 7
+)
+
+// attr are the attributes of a file, fattr3.
+type attr struct {
+	typ   uint32
+	mode  uint32
+	nlink uint32
+	uid   uint32
+	gid   uint32
+	size  uint64
+	mtime time.Time
+}
+
+func (d *decoder) attr() *attr {
+	a := &attr{
+		typ:   d.uint32(),
+		mode:  d.uint32(),
+		nlink: d.uint32(),
+		uid:   d.uint32(),
+		gid:   d.uint32(),
+		size:  d.uint64(),
+	}
+	d.uint64() // used
+	d.uint64() // rdev
+	d.uint64() // fsid
+	d.uint64() // fileid
+	d.uint64() // atime
+	a.mtime = time.Unix(int64(d.uint32()), int64(d.uint32()))
+	d.uint64() // ctime
+	return a
+}
+
+// postOpAttr decodes optional attributes, post_op_attr.
+func (d *decoder) postOpAttr() *attr {
+	if !d.bool() {
+		return nil
+	}
+	return d.attr()
+}
+
+// fileInfo implements os.FileInfo.
+type fileInfo struct {
+	name string
+	a    *attr
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return int64(fi.a.size) }
+func (fi *fileInfo) ModTime() time.Time { return fi.a.mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.a.typ == typeDir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	m := os.FileMode(fi.a.mode & 0777)
+	switch fi.a.typ {
+	case typeDir:
+		m |= os.ModeDir
+	case typeBlk:
+		m |= os.ModeDevice
+	case typeChr:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case typeLink:
+		m |= os.ModeSymlink
+	case typeSock:
+		m |= os.ModeSocket
+	case typeFIFO:
+		m |= os.ModeNamedPipe
+	}
+	if fi.a.mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if fi.a.mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if fi.a.mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// call calls an NFS procedure, and checks the status of its reply.
+func (cl *Client) call(ctx context.Context, proc uint32, args []byte) (*decoder, Error, error) {
+	d, err := cl.nfs.call(ctx, nfsProg, nfsVers, proc, args)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat := Error(d.uint32())
+	return d, stat, d.err
+}
+
+func (cl *Client) getattr(ctx context.Context, fh []byte) (*attr, error) {
+	var e encoder
+	e.opaque(fh)
+	d, stat, err := cl.call(ctx, nfsGetattr, e.b)
+	if err != nil {
+		return nil, err
+	}
+	if stat != 0 {
+		return nil, stat
+	}
+	a := d.attr()
+	return a, d.err
+}
+
+func (cl *Client) lookup(ctx context.Context, dir []byte, name string) ([]byte, *attr, error) {
+	var e encoder
+	e.opaque(dir)
+	e.string(name)
+	d, stat, err := cl.call(ctx, nfsLookup, e.b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if stat != 0 {
+		return nil, nil, stat
+	}
+	fh := d.opaque(maxFH)
+	a := d.postOpAttr()
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+	if a == nil {
+		if a, err = cl.getattr(ctx, fh); err != nil {
+			return nil, nil, err
+		}
+	}
+	return fh, a, nil
+}
+
+func (cl *Client) readlink(ctx context.Context, fh []byte) (string, error) {
+	var e encoder
+	e.opaque(fh)
+	d, stat, err := cl.call(ctx, nfsReadlink, e.b)
+	if err != nil {
+		return "", err
+	}
+	d.postOpAttr()
+	if stat != 0 {
+		return "", stat
+	}
+	target := d.string(maxPath)
+	return target, d.err
+}
+
+// read reads up to count bytes at off.
+func (cl *Client) read(ctx context.Context, fh []byte, off uint64, count int) ([]byte, bool, error) {
+	var e encoder
+	e.opaque(fh)
+	e.uint64(off)
+	e.uint32(uint32(count))
+	d, stat, err := cl.call(ctx, nfsRead, e.b)
+	if err != nil {
+		return nil, false, err
+	}
+	d.postOpAttr()
+	if stat != 0 {
+		return nil, false, stat
+	}
+	d.uint32() // count
+	eof := d.bool()
+	data := d.opaque(count)
+	return data, eof, d.err
+}
+
+// walk looks up name relative to the root of the export, following
+// symlinks. Absolute symlinks are resolved relative to the root of the
+// export as well.
+func (cl *Client) walk(ctx context.Context, name string) ([]byte, *attr, error) {
+	type entry struct {
+		fh []byte
+		a  *attr
+	}
+	stack := []entry{{fh: cl.root}}
+	parts := strings.Split(name, "/")
+	links := 0
+	for len(parts) > 0 {
+		p := parts[0]
+		parts = parts[1:]
+		switch p {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+		fh, a, err := cl.lookup(ctx, stack[len(stack)-1].fh, p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if a.typ != typeLink {
+			stack = append(stack, entry{fh, a})
+			continue
+		}
+		if links++; links > maxLinks {
+			return nil, nil, fmt.Errorf("too many levels of symbolic links in %q", name)
+		}
+		target, err := cl.readlink(ctx, fh)
+		if err != nil {
+			return nil, nil, err
+		}
+		if strings.HasPrefix(target, "/") {
+			stack = stack[:1]
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+
+	top := stack[len(stack)-1]
+	if top.a == nil {
+		a, err := cl.getattr(ctx, top.fh)
+		if err != nil {
+			return nil, nil, err
+		}
+		top.a = a
+	}
+	return top.fh, top.a, nil
+}
+
+// Stat returns information about the file name in the export.
+func (cl *Client) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	_, a, err := cl.walk(ctx, name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return &fileInfo{name: path.Base("/" + name), a: a}, nil
+}
+
+// Open opens the file name in the export for reading.
+func (cl *Client) Open(ctx context.Context, name string) (*File, error) {
+	fh, a, err := cl.walk(ctx, name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	if a.typ == typeDir {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrIsDir}
+	}
+	return &File{
+		cl:   cl,
+		fh:   fh,
+		info: fileInfo{name: path.Base("/" + name), a: a},
+	}, nil
+}
+
+// File is a file opened for reading.
+type File struct {
+	cl   *Client
+	fh   []byte
+	info fileInfo
+}
+
+// Stat returns the attributes the file had when it was opened.
+func (f *File) Stat() os.FileInfo {
+	return &f.info
+}
+
+// Size returns the size the file had when it was opened.
+func (f *File) Size() int64 {
+	return f.info.Size()
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	// Each call is bounded by the timeout of the client.
+	ctx := context.Background()
+	var n int
+	for n < len(p) {
+		count := len(p) - n
+		if count > f.cl.readSize {
+			count = f.cl.readSize
+		}
+		data, eof, err := f.cl.read(ctx, f.fh, uint64(off)+uint64(n), count)
+		if err != nil {
+			return n, &os.PathError{Op: "read", Path: f.info.name, Err: err}
+		}
+		n += copy(p[n:], data)
+		if eof || len(data) == 0 {
+			if n < len(p) {
+				return n, io.EOF
+			}
+			break
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,262 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/u-root/u-root/pkg/nfs/nfstest"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+var kernel = strings.Repeat("kernel", 20000)
+
+func testServer(t *testing.T) *nfstest.Server {
+	t.Helper()
+	s, err := nfstest.NewServer(
+		[]string{"/srv/boot", "/srv/root"},
+		map[string]string{
+			"/srv/boot/vmlinuz":    kernel,
+			"/srv/boot/initrd":     "initrd",
+			"/srv/boot/cfg/empty":  "",
+			"/srv/root/etc/passwd": "root:x:0:0::/root:/bin/sh",
+		},
+		map[string]string{
+			"/srv/boot/current":   "cfg/..",
+			"/srv/boot/abs":       "/initrd",
+			"/srv/boot/chain":     "abs",
+			"/srv/boot/loop":      "loop",
+			"/srv/boot/cfg/up":    "../initrd",
+			"/srv/boot/dangling":  "nowhere",
+			"/srv/boot/cfg/above": "../../../initrd",
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestReadFiles(t *testing.T) {
+	s := testServer(t)
+	defer s.Close()
+
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			ctx := context.Background()
+			cl, err := Dial(ctx, "127.0.0.1", "/srv/boot", Config{Network: network, PortmapPort: s.Port})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Mounts("/srv/boot"); got != 1 {
+				t.Errorf("mounts = %d, want 1", got)
+			}
+
+			for _, tt := range []struct {
+				name string
+				want string
+				err  error
+			}{
+				{name: "vmlinuz", want: kernel},
+				{name: "/initrd", want: "initrd"},
+				{name: "cfg/empty", want: ""},
+				{name: "cfg/../initrd", want: "initrd"},
+				{name: "current/initrd", want: "initrd"},
+				{name: "abs", want: "initrd"},
+				{name: "chain", want: "initrd"},
+				{name: "cfg/up", want: "initrd"},
+				{name: "cfg/above", want: "initrd"},
+				{name: "missing", err: os.ErrNotExist},
+				{name: "dangling", err: os.ErrNotExist},
+				{name: "cfg", err: ErrIsDir},
+			} {
+				f, err := cl.Open(ctx, tt.name)
+				if !errors.Is(err, tt.err) {
+					t.Errorf("Open(%q) = %v, want %v", tt.name, err, tt.err)
+				}
+				if err != nil {
+					continue
+				}
+				if f.Size() != int64(len(tt.want)) {
+					t.Errorf("Open(%q).Size() = %d, want %d", tt.name, f.Size(), len(tt.want))
+				}
+				b, err := uio.ReadAll(f)
+				if err != nil {
+					t.Errorf("reading %q: %v", tt.name, err)
+				} else if string(b) != tt.want {
+					t.Errorf("reading %q = %d bytes, want %d", tt.name, len(b), len(tt.want))
+				}
+			}
+
+			if _, err := cl.Open(ctx, "loop"); err == nil || !strings.Contains(err.Error(), "symbolic links") {
+				t.Errorf("Open(loop) = %v, want too many symbolic links", err)
+			}
+
+			if err := cl.Close(); err != nil {
+				t.Errorf("Close = %v", err)
+			}
+			if got := s.Mounts("/srv/boot"); got != 0 {
+				t.Errorf("mounts after Close = %d, want 0", got)
+			}
+		})
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	s := testServer(t)
+	defer s.Close()
+
+	ctx := context.Background()
+	cl, err := Dial(ctx, "127.0.0.1", "/srv/boot", Config{PortmapPort: s.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	f, err := cl.Open(ctx, "vmlinuz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		off, len int
+		n        int
+		err      error
+	}{
+		{off: 0, len: 10, n: 10},
+		{off: 1000, len: 100000, n: 100000},
+		{off: len(kernel) - 5, len: 10, n: 5, err: io.EOF},
+		{off: len(kernel), len: 10, n: 0, err: io.EOF},
+	} {
+		p := make([]byte, tt.len)
+		n, err := f.ReadAt(p, int64(tt.off))
+		if n != tt.n || err != tt.err {
+			t.Errorf("ReadAt(%d bytes, %d) = %d, %v, want %d, %v", tt.len, tt.off, n, err, tt.n, tt.err)
+		}
+		if !bytes.Equal(p[:n], []byte(kernel[tt.off:tt.off+n])) {
+			t.Errorf("ReadAt(%d bytes, %d) read the wrong bytes", tt.len, tt.off)
+		}
+	}
+}
+
+func TestStat(t *testing.T) {
+	s := testServer(t)
+	defer s.Close()
+
+	ctx := context.Background()
+	cl, err := Dial(ctx, "127.0.0.1", "/srv/root", Config{PortmapPort: s.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	fi, err := cl.Stat(ctx, "etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Name() != "etc" || !fi.IsDir() || fi.Mode() != os.ModeDir|0755 {
+		t.Errorf("Stat(etc) = %s %v, want directory etc", fi.Name(), fi.Mode())
+	}
+	fi, err = cl.Stat(ctx, "etc/passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Name() != "passwd" || fi.Mode() != 0644 || fi.Size() != 25 || !fi.ModTime().Equal(time.Unix(1e9, 0)) {
+		t.Errorf("Stat(etc/passwd) = %s %v %d %v", fi.Name(), fi.Mode(), fi.Size(), fi.ModTime())
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	s := testServer(t)
+	defer s.Close()
+
+	_, err := Dial(context.Background(), "127.0.0.1", "/srv", Config{PortmapPort: s.Port})
+	if !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Dial of an unexported directory = %v, want permission error", err)
+	}
+}
+
+func TestExports(t *testing.T) {
+	s := testServer(t)
+	defer s.Close()
+
+	exports, err := Exports(context.Background(), "127.0.0.1", Config{Network: "udp", PortmapPort: s.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/srv/boot", "/srv/root"}; !reflect.DeepEqual(exports, want) {
+		t.Errorf("Exports = %v, want %v", exports, want)
+	}
+}
+
+func TestUDPRetransmit(t *testing.T) {
+	defer func(d time.Duration) { retransmit = d }(retransmit)
+	retransmit = 10 * time.Millisecond
+
+	s := testServer(t)
+	defer s.Close()
+
+	s.DropUDP(2)
+	exports, err := Exports(context.Background(), "127.0.0.1", Config{Network: "udp", PortmapPort: s.Port})
+	if err != nil || len(exports) != 2 {
+		t.Errorf("Exports with lost datagrams = %v, %v, want 2 exports", exports, err)
+	}
+
+	s.DropUDP(1000)
+	_, err = Exports(context.Background(), "127.0.0.1", Config{Network: "udp", PortmapPort: s.Port, Timeout: 50 * time.Millisecond})
+	var nerr interface{ Timeout() bool }
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Errorf("Exports without replies = %v, want timeout", err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	s := testServer(t)
+	defer s.Close()
+
+	s.DropUDP(1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := Exports(ctx, "127.0.0.1", Config{Network: "udp", PortmapPort: s.Port}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Exports = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestParseRootPath(t *testing.T) {
+	for _, tt := range []struct {
+		rootPath string
+		want     *RootPath
+	}{
+		{rootPath: "/srv/root", want: &RootPath{Server: "10.0.0.1", Export: "/srv/root"}},
+		{rootPath: "10.0.0.2:/srv/root", want: &RootPath{Server: "10.0.0.2", Export: "/srv/root"}},
+		{rootPath: "nfs.example.com:/srv/root,vers=4,ro", want: &RootPath{Server: "nfs.example.com", Export: "/srv/root", Options: "vers=4,ro"}},
+		{rootPath: "[fd00::1]:/srv/root", want: &RootPath{Server: "fd00::1", Export: "/srv/root"}},
+		{rootPath: "/srv/a:/b", want: &RootPath{Server: "10.0.0.1", Export: "/srv/a:/b"}},
+		{rootPath: "srv/root"},
+		{rootPath: "server:"},
+	} {
+		got, err := ParseRootPath(tt.rootPath, "10.0.0.1")
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ParseRootPath(%q) = %+v, want error", tt.rootPath, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRootPath(%q) = %+v, %v, want %+v", tt.rootPath, got, err, tt.want)
+		}
+	}
+
+	if _, err := ParseRootPath("/srv/root", ""); err == nil {
+		t.Errorf("ParseRootPath without a server = nil, want error")
+	}
+}
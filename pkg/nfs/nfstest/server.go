@@ -0,0 +1,393 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nfstest implements an in-process NFSv3 server for tests.
+//
+// The server serves files from memory. Its portmapper, MOUNT and NFS services
+// all listen on the same TCP and UDP port, and it implements only what a
+// read-only client needs.
+package nfstest
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Server is an in-process NFS server.
+type Server struct {
+	// Port is the port of all services, on TCP and UDP.
+	Port int
+
+	exports map[string]bool
+	files   map[string]string
+	links   map[string]string
+	dirs    map[string]bool
+
+	tcp net.Listener
+	udp net.PacketConn
+
+	mu     sync.Mutex
+	drop   int
+	mounts map[string]int
+	calls  map[uint32]int
+	wg     sync.WaitGroup
+}
+
+// NewServer starts a server on localhost with exports, the regular files
+// files and the symlinks links, keyed by their absolute paths. Directories
+// are implied by the paths.
+func NewServer(exports []string, files, links map[string]string) (*Server, error) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	port := tcp.Addr().(*net.TCPAddr).Port
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		tcp.Close()
+		return nil, err
+	}
+	s := &Server{
+		Port:    port,
+		exports: make(map[string]bool),
+		files:   files,
+		links:   links,
+		dirs:    map[string]bool{"/": true},
+		tcp:     tcp,
+		udp:     udp,
+		mounts:  make(map[string]int),
+		calls:   make(map[uint32]int),
+	}
+	for _, e := range exports {
+		s.exports[e] = true
+		s.addDirs(e)
+	}
+	for p := range files {
+		s.addDirs(path.Dir(p))
+	}
+	for p := range links {
+		s.addDirs(path.Dir(p))
+	}
+	s.wg.Add(2)
+	go s.serveTCP()
+	go s.serveUDP()
+	return s, nil
+}
+
+func (s *Server) addDirs(dir string) {
+	for ; dir != "/"; dir = path.Dir(dir) {
+		s.dirs[dir] = true
+	}
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.tcp.Close()
+	s.udp.Close()
+	s.wg.Wait()
+}
+
+// DropUDP makes the server ignore the next n calls over UDP.
+func (s *Server) DropUDP(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drop = n
+}
+
+// Mounts returns how often export is mounted.
+func (s *Server) Mounts(export string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mounts[export]
+}
+
+// Calls returns the number of calls of RPC program prog served.
+func (s *Server) Calls(prog uint32) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[prog]
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			for {
+				var hdr [4]byte
+				if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+					return
+				}
+				call := make([]byte, binary.BigEndian.Uint32(hdr[:])&^(1<<31))
+				if _, err := io.ReadFull(conn, call); err != nil {
+					return
+				}
+				reply := s.handle(call)
+				// Send the reply in two fragments, as servers may.
+				half := len(reply) / 2
+				var rec []byte
+				rec = appendUint32(rec, uint32(half))
+				rec = append(rec, reply[:half]...)
+				rec = appendUint32(rec, 1<<31|uint32(len(reply)-half))
+				rec = append(rec, reply[half:]...)
+				if _, err := conn.Write(rec); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		drop := s.drop > 0
+		if drop {
+			s.drop--
+		}
+		s.mu.Unlock()
+		if drop {
+			continue
+		}
+		s.udp.WriteTo(s.handle(append([]byte(nil), buf[:n]...)), addr)
+	}
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var w [4]byte
+	binary.BigEndian.PutUint32(w[:], v)
+	return append(b, w[:]...)
+}
+
+// xdr is an XDR encoder and decoder.
+type xdr struct {
+	b   []byte
+	err error
+}
+
+func (x *xdr) uint32() uint32 {
+	if len(x.b) < 4 {
+		x.err = errors.New("short call")
+		return 0
+	}
+	v := binary.BigEndian.Uint32(x.b)
+	x.b = x.b[4:]
+	return v
+}
+
+func (x *xdr) opaque() []byte {
+	n := int(x.uint32())
+	if x.err != nil || n > len(x.b) {
+		x.err = errors.New("short call")
+		return nil
+	}
+	b := x.b[:n]
+	x.b = x.b[(n+3)&^3:]
+	return b
+}
+
+func (x *xdr) put(vs ...uint32) {
+	for _, v := range vs {
+		x.b = appendUint32(x.b, v)
+	}
+}
+
+func (x *xdr) putOpaque(b []byte) {
+	x.put(uint32(len(b)))
+	x.b = append(x.b, b...)
+	for len(x.b)%4 != 0 {
+		x.b = append(x.b, 0)
+	}
+}
+
+// Status values.
+const (
+	statOK   = 0
+	errNoEnt = 2
+	errAcces = 13
+	errIsDir = 21
+	errStale = 70
+)
+
+// handle returns the reply to call.
+func (s *Server) handle(call []byte) []byte {
+	in := &xdr{b: call}
+	xid := in.uint32()
+	in.uint32() // Message type.
+	in.uint32() // RPC version.
+	prog, vers, proc := in.uint32(), in.uint32(), in.uint32()
+	in.uint32() // Credential.
+	in.opaque()
+	in.uint32() // Verifier.
+	in.opaque()
+
+	s.mu.Lock()
+	s.calls[prog]++
+	s.mu.Unlock()
+
+	out := &xdr{}
+	out.put(xid, 1, 0, 0, 0)
+	if in.err != nil {
+		out.put(4) // GARBAGE_ARGS
+		return out.b
+	}
+	res := &xdr{}
+	var stat uint32 = 3 // PROC_UNAVAIL
+	switch {
+	case prog == 100000 && vers == 2 && proc == 3:
+		stat = 0
+		res.put(uint32(s.Port))
+	case prog == 100005 && vers == 3:
+		stat = s.mount(proc, in, res)
+	case prog == 100003 && vers == 3:
+		stat = s.nfs(proc, in, res)
+	default:
+		stat = 1 // PROG_UNAVAIL
+	}
+	out.put(stat)
+	return append(out.b, res.b...)
+}
+
+func (s *Server) mount(proc uint32, in, res *xdr) uint32 {
+	switch proc {
+	case 0:
+	case 1: // MNT
+		dir := string(in.opaque())
+		if !s.exports[dir] {
+			res.put(errAcces)
+			break
+		}
+		s.mu.Lock()
+		s.mounts[dir]++
+		s.mu.Unlock()
+		res.put(statOK)
+		res.putOpaque([]byte(dir))
+		res.put(1, 1) // AUTH_UNIX
+	case 3: // UMNT
+		dir := string(in.opaque())
+		s.mu.Lock()
+		s.mounts[dir]--
+		s.mu.Unlock()
+	case 5: // EXPORT
+		var exports []string
+		for e := range s.exports {
+			exports = append(exports, e)
+		}
+		sort.Strings(exports)
+		for _, e := range exports {
+			res.put(1)
+			res.putOpaque([]byte(e))
+			res.put(1)
+			res.putOpaque([]byte("*"))
+			res.put(0)
+		}
+		res.put(0)
+	default:
+		return 3
+	}
+	return 0
+}
+
+// attr appends the fattr3 of p.
+func (s *Server) attr(res *xdr, p string) {
+	typ, mode, size := uint32(1), uint32(0644), uint64(len(s.files[p]))
+	if s.dirs[p] {
+		typ, mode, size = 2, 0755, 4096
+	} else if l, ok := s.links[p]; ok {
+		typ, mode, size = 5, 0777, uint64(len(l))
+	}
+	res.put(typ, mode, 1, 0, 0)
+	res.put(uint32(size>>32), uint32(size))
+	res.put(uint32(size>>32), uint32(size))
+	res.put(0, 0, 0, 0, 0, 0)
+	res.put(0, 0, 1e9, 0, 1e9, 0)
+}
+
+func (s *Server) exists(p string) bool {
+	_, isFile := s.files[p]
+	_, isLink := s.links[p]
+	return isFile || isLink || s.dirs[p]
+}
+
+func (s *Server) nfs(proc uint32, in, res *xdr) uint32 {
+	if proc == 0 {
+		return 0
+	}
+	fh := string(in.opaque())
+	if !s.exists(fh) {
+		res.put(errStale, 0)
+		return 0
+	}
+	switch proc {
+	case 1: // GETATTR
+		res.put(statOK)
+		s.attr(res, fh)
+	case 3: // LOOKUP
+		name := string(in.opaque())
+		p := path.Join(fh, name)
+		if name == ".." {
+			p = path.Dir(fh)
+		}
+		if strings.Contains(name, "/") || !s.exists(p) {
+			res.put(errNoEnt, 0)
+			break
+		}
+		res.put(statOK)
+		res.putOpaque([]byte(p))
+		res.put(1)
+		s.attr(res, p)
+		res.put(0)
+	case 5: // READLINK
+		l, isLink := s.links[fh]
+		if !isLink {
+			res.put(22, 0) // INVAL
+			break
+		}
+		res.put(statOK, 0)
+		res.putOpaque([]byte(l))
+	case 6: // READ
+		off := uint64(in.uint32())<<32 | uint64(in.uint32())
+		count := uint64(in.uint32())
+		if s.dirs[fh] {
+			res.put(errIsDir, 0)
+			break
+		}
+		data := s.files[fh]
+		if off > uint64(len(data)) {
+			off = uint64(len(data))
+		}
+		end := off + count
+		if end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+		res.put(statOK, 0, uint32(end-off))
+		if end == uint64(len(data)) {
+			res.put(1)
+		} else {
+			res.put(0)
+		}
+		res.putOpaque([]byte(data[off:end]))
+	default:
+		return 3
+	}
+	return 0
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nfs
+
+import (
+	"errors"
+	"strings"
+)
+
+// RootPath is an NFS root file system.
+type RootPath struct {
+	// Server is the host name or address of the NFS server.
+	Server string
+
+	// Export is the path of the export on the server.
+	Export string
+
+	// Options are the mount options, comma separated.
+	Options string
+}
+
+// ParseRootPath parses a root path in the format of the kernel's nfsroot
+// parameter and of DHCP's root path option 17,
+//
+//	[<server>:]<export>[,<options>]
+//
+// defaultServer is used if the root path names no server, as the server is
+// usually the DHCP server or the next server then.
+func ParseRootPath(rootPath, defaultServer string) (*RootPath, error) {
+	rp := &RootPath{Server: defaultServer}
+	s := rootPath
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		s, rp.Options = s[:i], s[i+1:]
+	}
+	// The export is an absolute path, so a colon before its first slash
+	// ends the server name. IPv6 servers are in brackets.
+	if i := strings.Index(s, ":/"); i >= 0 && !strings.Contains(s[:i], "/") {
+		rp.Server, s = strings.TrimSuffix(strings.TrimPrefix(s[:i], "["), "]"), s[i+1:]
+	}
+	rp.Export = s
+	if !strings.HasPrefix(rp.Export, "/") {
+		return nil, errors.New("NFS root path " + rootPath + " is not [server:]/export[,options]")
+	}
+	if rp.Server == "" {
+		return nil, errors.New("NFS root path " + rootPath + " names no server")
+	}
+	return rp, nil
+}
@@ -0,0 +1,293 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nfs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ONC RPC (RFC 5531) constants.
+const (
+	rpcVersion = 2
+
+	msgCall  = 0
+	msgReply = 1
+
+	replyAccepted = 0
+	replyDenied   = 1
+
+	acceptSuccess      = 0
+	acceptProgUnavail  = 1
+	acceptProgMismatch = 2
+	acceptProcUnavail  = 3
+	acceptGarbageArgs  = 4
+	acceptSystemErr    = 5
+
+	authNone = 0
+	authUnix = 1
+
+	// lastFragment marks the last fragment of a record on TCP.
+	lastFragment = 1 << 31
+
+	// maxRecord bounds the size of a reply.
+	maxRecord = 1 << 20
+
+	// maxAuth is the maximum size of an authenticator body.
+	maxAuth = 400
+)
+
+// retransmit is how long to wait for a reply over UDP before sending a call
+// again.
+var retransmit = time.Second
+
+// RPCError is an RPC call the server did not execute.
+type RPCError struct {
+	// Prog, Vers and Proc identify the call.
+	Prog, Vers, Proc uint32
+
+	// Accepted is set if the server accepted the call, but did not run
+	// it, and Stat is one of RFC 5531's accept_stat values then.
+	// Otherwise, Stat is a reject_stat.
+	Accepted bool
+	Stat     uint32
+}
+
+// Error implements error.
+func (e *RPCError) Error() string {
+	var reason string
+	switch {
+	case e.Accepted && e.Stat == acceptProgUnavail:
+		reason = "program unavailable"
+	case e.Accepted && e.Stat == acceptProgMismatch:
+		reason = "program version mismatch"
+	case e.Accepted && e.Stat == acceptProcUnavail:
+		reason = "procedure unavailable"
+	case e.Accepted && e.Stat == acceptGarbageArgs:
+		reason = "garbage arguments"
+	case e.Accepted && e.Stat == acceptSystemErr:
+		reason = "system error"
+	case e.Accepted:
+		reason = fmt.Sprintf("accept status %d", e.Stat)
+	case e.Stat == 0:
+		reason = "RPC version mismatch"
+	default:
+		reason = "authentication error"
+	}
+	return fmt.Sprintf("RPC program %d version %d procedure %d: %s", e.Prog, e.Vers, e.Proc, reason)
+}
+
+// rpcClient makes ONC RPC calls over a TCP or UDP connection, one at a time.
+type rpcClient struct {
+	mu   sync.Mutex
+	conn net.Conn
+	udp  bool
+	xid  uint32
+	cred []byte
+
+	// timeout bounds each call, in addition to its context.
+	timeout time.Duration
+}
+
+// authUnixCred returns the body of an AUTH_UNIX credential for uid and gid.
+func authUnixCred(uid, gid uint32) []byte {
+	host, _ := os.Hostname()
+	if len(host) > 255 {
+		host = host[:255]
+	}
+	var e encoder
+	e.uint32(uint32(time.Now().Unix()))
+	e.string(host)
+	e.uint32(uid)
+	e.uint32(gid)
+	e.uint32(0) // No supplementary groups.
+	return e.b
+}
+
+// dialRPC connects to an RPC server at addr over network "tcp" or "udp".
+func dialRPC(ctx context.Context, network, addr string, c Config) (*rpcClient, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &rpcClient{
+		conn:    conn,
+		udp:     network == "udp",
+		xid:     rand.Uint32(),
+		cred:    authUnixCred(c.UID, c.GID),
+		timeout: c.timeout(),
+	}, nil
+}
+
+// Close closes the connection.
+func (c *rpcClient) Close() error {
+	return c.conn.Close()
+}
+
+// call calls procedure proc of version vers of program prog with the encoded
+// args, and returns a decoder of the results.
+func (c *rpcClient) call(ctx context.Context, prog, vers, proc uint32, args []byte) (*decoder, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.xid++
+	xid := c.xid
+	var e encoder
+	e.uint32(xid)
+	e.uint32(msgCall)
+	e.uint32(rpcVersion)
+	e.uint32(prog)
+	e.uint32(vers)
+	e.uint32(proc)
+	e.uint32(authUnix)
+	e.opaque(c.cred)
+	e.uint32(authNone)
+	e.opaque(nil)
+	e.b = append(e.b, args...)
+
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	// Stop waiting for replies when ctx is done.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	var (
+		reply []byte
+		err   error
+	)
+	if c.udp {
+		reply, err = c.exchangeUDP(e.b, xid, deadline)
+	} else {
+		reply, err = c.exchangeTCP(e.b, xid, deadline)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseReply(reply, prog, vers, proc)
+}
+
+// exchangeTCP sends the call as a single record and reads records until
+// the one replying to xid.
+func (c *rpcClient) exchangeTCP(call []byte, xid uint32, deadline time.Time) ([]byte, error) {
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	rec := make([]byte, 4, 4+len(call))
+	binary.BigEndian.PutUint32(rec, lastFragment|uint32(len(call)))
+	if _, err := c.conn.Write(append(rec, call...)); err != nil {
+		return nil, err
+	}
+	for {
+		reply, err := c.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		if len(reply) >= 4 && binary.BigEndian.Uint32(reply) == xid {
+			return reply, nil
+		}
+	}
+}
+
+// readRecord reads a record made of one or more fragments.
+func (c *rpcClient) readRecord() ([]byte, error) {
+	var rec []byte
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.conn, hdr[:]); err != nil {
+			return nil, err
+		}
+		h := binary.BigEndian.Uint32(hdr[:])
+		n := int(h &^ lastFragment)
+		if len(rec)+n > maxRecord {
+			return nil, fmt.Errorf("RPC record of more than %d bytes", maxRecord)
+		}
+		frag := make([]byte, n)
+		if _, err := io.ReadFull(c.conn, frag); err != nil {
+			return nil, err
+		}
+		rec = append(rec, frag...)
+		if h&lastFragment != 0 {
+			return rec, nil
+		}
+	}
+}
+
+// exchangeUDP sends the call, and sends it again until the reply to xid
+// arrives or the deadline passes.
+func (c *rpcClient) exchangeUDP(call []byte, xid uint32, deadline time.Time) ([]byte, error) {
+	buf := make([]byte, 65536)
+	for {
+		if _, err := c.conn.Write(call); err != nil {
+			return nil, err
+		}
+		wait := time.Now().Add(retransmit)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		if err := c.conn.SetReadDeadline(wait); err != nil {
+			return nil, err
+		}
+		for {
+			n, err := c.conn.Read(buf)
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() && time.Now().Before(deadline) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if n >= 4 && binary.BigEndian.Uint32(buf) == xid {
+				return append([]byte(nil), buf[:n]...), nil
+			}
+		}
+	}
+}
+
+// parseReply checks the reply header and returns a decoder of the results.
+func parseReply(reply []byte, prog, vers, proc uint32) (*decoder, error) {
+	d := &decoder{b: reply}
+	d.uint32() // xid
+	if mt := d.uint32(); d.err == nil && mt != msgReply {
+		return nil, fmt.Errorf("RPC message type %d, want reply", mt)
+	}
+	stat := d.uint32()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if stat == replyDenied {
+		return nil, &RPCError{Prog: prog, Vers: vers, Proc: proc, Stat: d.uint32()}
+	}
+	d.uint32()        // Verifier flavor.
+	d.opaque(maxAuth) // Verifier body.
+	if accept := d.uint32(); d.err == nil && accept != acceptSuccess {
+		return nil, &RPCError{Prog: prog, Vers: vers, Proc: proc, Accepted: true, Stat: accept}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nfs
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// errShort is returned when a reply ends before all of its fields.
+var errShort = errors.New("short XDR message")
+
+// encoder appends XDR (RFC 4506) data to a buffer.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.uint32(1)
+	} else {
+		e.uint32(0)
+	}
+}
+
+// opaque appends variable-length opaque data, padded to 4 bytes.
+func (e *encoder) opaque(b []byte) {
+	e.uint32(uint32(len(b)))
+	e.b = append(e.b, b...)
+	for len(e.b)%4 != 0 {
+		e.b = append(e.b, 0)
+	}
+}
+
+func (e *encoder) string(s string) {
+	e.opaque([]byte(s))
+}
+
+// decoder reads XDR data. The first error sticks, and makes all further
+// reads return zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = errShort
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *decoder) bool() bool {
+	return d.uint32() != 0
+}
+
+// opaque reads variable-length opaque data of at most max bytes.
+func (d *decoder) opaque(max int) []byte {
+	n := d.uint32()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint32(max) {
+		d.err = errShort
+		return nil
+	}
+	b := d.next(int(n))
+	d.next(int(-n & 3))
+	return b
+}
+
+func (d *decoder) string(max int) string {
+	return string(d.opaque(max))
+}
@@ -20,7 +20,8 @@ import (
 	"github.com/u-root/u-root/pkg/termios"
 )
 
-// New returns a new Pty.
+// New returns a new Pty, set up to relay to and from the controlling
+// terminal of the process.
 func New() (*Pty, error) {
 	tty, err := termios.New()
 	if err != nil {
@@ -30,18 +31,30 @@ func New() (*Pty, error) {
 	if err != nil {
 		return nil, err
 	}
+	p, err := Open()
+	if err != nil {
+		return nil, err
+	}
+	p.TTY, p.Restorer = tty, restorer
+	return p, nil
+}
 
+// Open returns a new Pty which is not tied to a controlling terminal, for
+// processes such as servers which relay Ptm themselves.
+func Open() (*Pty, error) {
 	ptm, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
 	if err != nil {
 		return nil, err
 	}
 
 	if err := ptsunlock(ptm); err != nil {
+		ptm.Close()
 		return nil, err
 	}
 
 	sname, err := ptsname(ptm)
 	if err != nil {
+		ptm.Close()
 		return nil, err
 	}
 
@@ -57,9 +70,10 @@ func New() (*Pty, error) {
 
 	pts, err := os.OpenFile(sname, os.O_RDWR|syscall.O_NOCTTY, 0)
 	if err != nil {
+		ptm.Close()
 		return nil, err
 	}
-	return &Pty{Ptm: ptm, Pts: pts, Sname: sname, Kid: -1, TTY: tty, Restorer: restorer}, nil
+	return &Pty{Ptm: ptm, Pts: pts, Sname: sname, Kid: -1}, nil
 }
 
 func ptsname(f *os.File) (string, error) {
@@ -19,3 +19,8 @@ import (
 func New() (*Pty, error) {
 	return nil, fmt.Errorf("not yet")
 }
+
+// Open returns a new Pty which is not tied to a controlling terminal.
+func Open() (*Pty, error) {
+	return nil, fmt.Errorf("not yet")
+}
@@ -66,3 +66,28 @@ func TestRunRestoreTTYMode(t *testing.T) {
 		t.Errorf("bogus returned data: got %q, want %q", string(b[:n]), "hi\r\n")
 	}
 }
+
+func TestOpen(t *testing.T) {
+	p, err := Open()
+	if os.IsNotExist(err) {
+		t.Skipf("Failed to allocate /dev/pts device")
+	} else if err != nil {
+		t.Fatalf("Open pty: want nil, got %v", err)
+	}
+	defer p.Ptm.Close()
+	defer p.Pts.Close()
+	if p.TTY != nil {
+		t.Errorf("Open pty: want no controlling TTY, got %v", p.TTY)
+	}
+	if _, err := p.Pts.Write([]byte("hi\n")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 16)
+	n, err := p.Ptm.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b[:n]), "hi\r\n"; got != want {
+		t.Errorf("Ptm read: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sftp
+
+import (
+	"os"
+)
+
+// owner returns the user and group IDs of fi, which Plan 9 does not have.
+func owner(fi os.FileInfo) (uint32, uint32, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,21 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package sftp
+
+import (
+	"os"
+	"syscall"
+)
+
+// owner returns the user and group IDs of fi.
+func owner(fi os.FileInfo) (uint32, uint32, bool) {
+	s, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return s.Uid, s.Gid, true
+}
@@ -0,0 +1,509 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/u-root/u-root/pkg/ls"
+)
+
+var (
+	errBadHandle   = errors.New("invalid handle")
+	errUnsupported = errors.New("operation unsupported")
+)
+
+// maxRead is the most a READ returns, so that DATA fits in a packet.
+const maxRead = maxPacket - 1024
+
+// extensions are the OpenSSH extensions the server announces.
+var extensions = []string{
+	"posix-rename@openssh.com", "1",
+	"fsync@openssh.com", "1",
+}
+
+// handle is an open file or directory.
+type handle struct {
+	f *os.File
+	// dir is the path of a directory handle, for READDIR.
+	dir string
+	// WriteAt does not work for files opened with O_APPEND.
+	append bool
+}
+
+// Server serves the SFTP protocol to a client. Paths are resolved relative
+// to the current directory of the process.
+type Server struct {
+	rw      io.ReadWriter
+	handles map[string]*handle
+	next    uint64
+}
+
+// NewServer returns a Server for the client at the other end of rw, which is
+// usually the channel of an SSH session that requested the sftp subsystem.
+func NewServer(rw io.ReadWriter) *Server {
+	return &Server{rw: rw, handles: map[string]*handle{}}
+}
+
+// Serve serves requests until the client goes away, then closes any handles
+// the client left open.
+func (s *Server) Serve() error {
+	defer func() {
+		for _, h := range s.handles {
+			h.f.Close()
+		}
+	}()
+	t, p, err := readPacket(s.rw)
+	if err != nil {
+		return err
+	}
+	if t != fxpInit {
+		return fmt.Errorf("want INIT, got packet type %d", t)
+	}
+	b := buffer(p)
+	if _, err := b.uint32(); err != nil {
+		return err
+	}
+	// Clients all speak version 3, whichever version they send.
+	v := appendUint32(nil, Version)
+	for _, e := range extensions {
+		v = appendString(v, e)
+	}
+	if err := writePacket(s.rw, fxpVersion, v); err != nil {
+		return err
+	}
+
+	for {
+		t, p, err := readPacket(s.rw)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		b := buffer(p)
+		id, err := b.uint32()
+		if err != nil {
+			return err
+		}
+		rt, r, err := s.request(t, &b)
+		if err != nil {
+			rt, r = fxpStatus, status(err)
+		}
+		if err := writePacket(s.rw, rt, append(appendUint32(nil, id), r...)); err != nil {
+			return err
+		}
+	}
+}
+
+// status returns the STATUS payload for err, which is nil for success.
+func status(err error) []byte {
+	code, msg := uint32(fxOK), "Success"
+	switch {
+	case err == nil:
+	case err == io.EOF:
+		code, msg = fxEOF, "End of file"
+	case err == errShortPacket:
+		code, msg = fxBadMessage, err.Error()
+	case err == errUnsupported:
+		code, msg = fxOpUnsupported, err.Error()
+	case os.IsNotExist(err):
+		code, msg = fxNoSuchFile, err.Error()
+	case os.IsPermission(err):
+		code, msg = fxPermissionDenied, err.Error()
+	default:
+		code, msg = fxFailure, err.Error()
+	}
+	return appendString(appendString(appendUint32(nil, code), msg), "")
+}
+
+// name is an entry of a NAME reply.
+type name struct {
+	name, long string
+	a          attrs
+}
+
+func names(n ...name) []byte {
+	b := appendUint32(nil, uint32(len(n)))
+	for _, e := range n {
+		b = appendAttrs(appendString(appendString(b, e.name), e.long), e.a)
+	}
+	return b
+}
+
+// request carries out the request of type t, and returns the type and the
+// payload, without the ID, of the reply. Errors are replied with STATUS.
+func (s *Server) request(t byte, b *buffer) (byte, []byte, error) {
+	switch t {
+	case fxpOpen:
+		return s.open(b)
+	case fxpOpendir:
+		return s.opendir(b)
+	case fxpClose:
+		h, id, err := s.handle(b)
+		if err != nil {
+			return 0, nil, err
+		}
+		delete(s.handles, id)
+		return fxpStatus, status(nil), h.f.Close()
+	case fxpRead:
+		return s.read(b)
+	case fxpReaddir:
+		return s.readdir(b)
+	case fxpWrite:
+		return s.write(b)
+	case fxpStat, fxpLstat, fxpFstat:
+		var fi os.FileInfo
+		if t == fxpFstat {
+			h, _, err := s.handle(b)
+			if err != nil {
+				return 0, nil, err
+			}
+			fi, err = h.f.Stat()
+			if err != nil {
+				return 0, nil, err
+			}
+		} else {
+			p, err := b.string()
+			if err != nil {
+				return 0, nil, err
+			}
+			stat := os.Stat
+			if t == fxpLstat {
+				stat = os.Lstat
+			}
+			if fi, err = stat(p); err != nil {
+				return 0, nil, err
+			}
+		}
+		return fxpAttrs, appendAttrs(nil, fileAttrs(fi)), nil
+	case fxpSetstat, fxpFsetstat:
+		var f *os.File
+		var p string
+		var err error
+		if t == fxpFsetstat {
+			var h *handle
+			if h, _, err = s.handle(b); err != nil {
+				return 0, nil, err
+			}
+			f, p = h.f, h.f.Name()
+		} else if p, err = b.string(); err != nil {
+			return 0, nil, err
+		}
+		a, err := b.attrs()
+		if err != nil {
+			return 0, nil, err
+		}
+		return fxpStatus, status(nil), setAttrs(p, f, a)
+	case fxpRemove, fxpRmdir:
+		p, err := b.string()
+		if err != nil {
+			return 0, nil, err
+		}
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return 0, nil, err
+		}
+		if t == fxpRemove && fi.IsDir() {
+			return 0, nil, fmt.Errorf("%s: is a directory", p)
+		}
+		if t == fxpRmdir && !fi.IsDir() {
+			return 0, nil, fmt.Errorf("%s: not a directory", p)
+		}
+		return fxpStatus, status(nil), os.Remove(p)
+	case fxpMkdir:
+		p, err := b.string()
+		if err != nil {
+			return 0, nil, err
+		}
+		a, err := b.attrs()
+		if err != nil {
+			return 0, nil, err
+		}
+		perm := os.FileMode(0755)
+		if a.Flags&attrPermissions != 0 {
+			perm = a.fileMode()
+		}
+		return fxpStatus, status(nil), os.Mkdir(p, perm)
+	case fxpRealpath:
+		p, err := b.string()
+		if err != nil {
+			return 0, nil, err
+		}
+		if p == "" {
+			p = "."
+		}
+		if p, err = filepath.Abs(p); err != nil {
+			return 0, nil, err
+		}
+		return fxpName, names(name{name: p, long: p}), nil
+	case fxpRename:
+		from, to, err := b.pair()
+		if err != nil {
+			return 0, nil, err
+		}
+		// Unlike rename(2), RENAME does not replace to.
+		if _, err := os.Lstat(to); err == nil {
+			return 0, nil, fmt.Errorf("%s: file exists", to)
+		}
+		return fxpStatus, status(nil), os.Rename(from, to)
+	case fxpReadlink:
+		p, err := b.string()
+		if err != nil {
+			return 0, nil, err
+		}
+		if p, err = os.Readlink(p); err != nil {
+			return 0, nil, err
+		}
+		return fxpName, names(name{name: p, long: p}), nil
+	case fxpSymlink:
+		// OpenSSH sends the target first, the other way around
+		// from the draft, and every client follows OpenSSH.
+		target, link, err := b.pair()
+		if err != nil {
+			return 0, nil, err
+		}
+		return fxpStatus, status(nil), os.Symlink(target, link)
+	case fxpExtended:
+		return s.extended(b)
+	}
+	return 0, nil, errUnsupported
+}
+
+// pair decodes two strings, the two paths of RENAME and SYMLINK.
+func (b *buffer) pair() (string, string, error) {
+	p, err := b.string()
+	if err != nil {
+		return "", "", err
+	}
+	q, err := b.string()
+	return p, q, err
+}
+
+// handle decodes a handle and returns it, as well as its ID.
+func (s *Server) handle(b *buffer) (*handle, string, error) {
+	id, err := b.string()
+	if err != nil {
+		return nil, "", err
+	}
+	h, ok := s.handles[id]
+	if !ok {
+		return nil, "", errBadHandle
+	}
+	return h, id, nil
+}
+
+func (s *Server) newHandle(h *handle) (byte, []byte, error) {
+	s.next++
+	id := strconv.FormatUint(s.next, 10)
+	s.handles[id] = h
+	return fxpHandle, appendString(nil, id), nil
+}
+
+func (s *Server) open(b *buffer) (byte, []byte, error) {
+	p, err := b.string()
+	if err != nil {
+		return 0, nil, err
+	}
+	pflags, err := b.uint32()
+	if err != nil {
+		return 0, nil, err
+	}
+	a, err := b.attrs()
+	if err != nil {
+		return 0, nil, err
+	}
+	var flags int
+	switch pflags & (fxfRead | fxfWrite) {
+	case fxfWrite:
+		flags = os.O_WRONLY
+	case fxfRead | fxfWrite:
+		flags = os.O_RDWR
+	default:
+		flags = os.O_RDONLY
+	}
+	for _, f := range []struct {
+		pflag uint32
+		flag  int
+	}{
+		{fxfAppend, os.O_APPEND},
+		{fxfCreat, os.O_CREATE},
+		{fxfTrunc, os.O_TRUNC},
+		{fxfExcl, os.O_EXCL},
+	} {
+		if pflags&f.pflag != 0 {
+			flags |= f.flag
+		}
+	}
+	perm := os.FileMode(0644)
+	if a.Flags&attrPermissions != 0 {
+		perm = a.fileMode()
+	}
+	f, err := os.OpenFile(p, flags, perm)
+	if err != nil {
+		return 0, nil, err
+	}
+	return s.newHandle(&handle{f: f, append: pflags&fxfAppend != 0})
+}
+
+func (s *Server) opendir(b *buffer) (byte, []byte, error) {
+	p, err := b.string()
+	if err != nil {
+		return 0, nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil && !fi.IsDir() {
+		err = fmt.Errorf("%s: not a directory", p)
+	}
+	if err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+	return s.newHandle(&handle{f: f, dir: p})
+}
+
+func (s *Server) read(b *buffer) (byte, []byte, error) {
+	h, _, err := s.handle(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	off, err := b.uint64()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := b.uint32()
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > maxRead {
+		n = maxRead
+	}
+	data := make([]byte, n)
+	m, err := h.f.ReadAt(data, int64(off))
+	if m == 0 && err != nil {
+		return 0, nil, err
+	}
+	return fxpData, appendBytes(nil, data[:m]), nil
+}
+
+func (s *Server) write(b *buffer) (byte, []byte, error) {
+	h, _, err := s.handle(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	off, err := b.uint64()
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := b.bytes()
+	if err != nil {
+		return 0, nil, err
+	}
+	if h.append {
+		_, err = h.f.Write(data)
+	} else {
+		_, err = h.f.WriteAt(data, int64(off))
+	}
+	return fxpStatus, status(nil), err
+}
+
+func (s *Server) readdir(b *buffer) (byte, []byte, error) {
+	h, _, err := s.handle(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if h.dir == "" {
+		return 0, nil, errBadHandle
+	}
+	fis, err := h.f.Readdir(128)
+	if len(fis) == 0 {
+		return 0, nil, err
+	}
+	var n []name
+	long := ls.LongStringer{Name: ls.NameStringer{}}
+	for _, fi := range fis {
+		n = append(n, name{
+			name: fi.Name(),
+			long: long.FileString(ls.FromOSFileInfo(filepath.Join(h.dir, fi.Name()), fi)),
+			a:    fileAttrs(fi),
+		})
+	}
+	return fxpName, names(n...), nil
+}
+
+func (s *Server) extended(b *buffer) (byte, []byte, error) {
+	req, err := b.string()
+	if err != nil {
+		return 0, nil, err
+	}
+	switch req {
+	case "posix-rename@openssh.com":
+		from, to, err := b.pair()
+		if err != nil {
+			return 0, nil, err
+		}
+		return fxpStatus, status(nil), os.Rename(from, to)
+	case "fsync@openssh.com":
+		h, _, err := s.handle(b)
+		if err != nil {
+			return 0, nil, err
+		}
+		return fxpStatus, status(nil), h.f.Sync()
+	}
+	return 0, nil, errUnsupported
+}
+
+// setAttrs sets the attributes a of the file p, through f if it is open.
+func setAttrs(p string, f *os.File, a attrs) error {
+	if a.Flags&attrSize != 0 {
+		var err error
+		if f != nil {
+			err = f.Truncate(int64(a.Size))
+		} else {
+			err = os.Truncate(p, int64(a.Size))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if a.Flags&attrPermissions != 0 {
+		var err error
+		if f != nil {
+			err = f.Chmod(a.fileMode())
+		} else {
+			err = os.Chmod(p, a.fileMode())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if a.Flags&attrUIDGID != 0 {
+		var err error
+		if f != nil {
+			err = f.Chown(int(a.UID), int(a.GID))
+		} else {
+			err = os.Chown(p, int(a.UID), int(a.GID))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if a.Flags&attrACModTime != 0 {
+		atime, mtime := a.times()
+		if err := os.Chtimes(p, atime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
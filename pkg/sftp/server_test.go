@@ -0,0 +1,308 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sftp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// client is just enough of an SFTP client to test the server.
+type client struct {
+	c  net.Conn
+	id uint32
+}
+
+func newClient(t *testing.T) (*client, <-chan error) {
+	c, s := net.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- NewServer(s).Serve()
+		s.Close()
+	}()
+	if err := writePacket(c, fxpInit, appendUint32(nil, Version)); err != nil {
+		t.Fatal(err)
+	}
+	typ, p, err := readPacket(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != fxpVersion {
+		t.Fatalf("INIT: got packet type %d, want VERSION", typ)
+	}
+	b := buffer(p)
+	if v, err := b.uint32(); err != nil || v != Version {
+		t.Fatalf("VERSION: got version %d, %v, want %d, nil", v, err, Version)
+	}
+	var ext []string
+	for len(b) > 0 {
+		s, err := b.string()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ext = append(ext, s)
+	}
+	if !reflect.DeepEqual(ext, extensions) {
+		t.Errorf("VERSION: got extensions %q, want %q", ext, extensions)
+	}
+	return &client{c: c}, errs
+}
+
+// call sends a request of type typ, and returns the reply.
+func (c *client) call(typ byte, fields ...interface{}) (byte, buffer, error) {
+	c.id++
+	p := appendUint32(nil, c.id)
+	for _, f := range fields {
+		switch f := f.(type) {
+		case string:
+			p = appendString(p, f)
+		case uint32:
+			p = appendUint32(p, f)
+		case uint64:
+			p = appendUint64(p, f)
+		case attrs:
+			p = appendAttrs(p, f)
+		default:
+			return 0, nil, fmt.Errorf("can't encode %T", f)
+		}
+	}
+	if err := writePacket(c.c, typ, p); err != nil {
+		return 0, nil, err
+	}
+	rt, r, err := readPacket(c.c)
+	if err != nil {
+		return 0, nil, err
+	}
+	b := buffer(r)
+	id, err := b.uint32()
+	if err != nil {
+		return 0, nil, err
+	}
+	if id != c.id {
+		return 0, nil, fmt.Errorf("got reply to request %d, want %d", id, c.id)
+	}
+	return rt, b, nil
+}
+
+// status sends a request, and returns the code of its STATUS reply.
+func (c *client) status(typ byte, fields ...interface{}) (uint32, error) {
+	rt, b, err := c.call(typ, fields...)
+	if err != nil {
+		return 0, err
+	}
+	if rt != fxpStatus {
+		return 0, fmt.Errorf("got packet type %d, want STATUS", rt)
+	}
+	return b.uint32()
+}
+
+// reply sends a request, and fails unless its reply is of type want.
+func (c *client) reply(t *testing.T, want byte, typ byte, fields ...interface{}) *buffer {
+	t.Helper()
+	rt, b, err := c.call(typ, fields...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt != want {
+		code, _ := b.uint32()
+		msg, _ := b.string()
+		t.Fatalf("request %d: got packet type %d (%d %q), want %d", typ, rt, code, msg, want)
+	}
+	return &b
+}
+
+func (c *client) ok(t *testing.T, typ byte, fields ...interface{}) {
+	t.Helper()
+	code, err := c.status(typ, fields...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != fxOK {
+		t.Fatalf("request %d: got status %d, want OK", typ, code)
+	}
+}
+
+func (c *client) handle(t *testing.T, typ byte, fields ...interface{}) string {
+	t.Helper()
+	b := c.reply(t, fxpHandle, typ, fields...)
+	h, err := b.string()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func (c *client) names(t *testing.T, typ byte, fields ...interface{}) []string {
+	t.Helper()
+	b := c.reply(t, fxpName, typ, fields...)
+	n, err := b.uint32()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for i := uint32(0); i < n; i++ {
+		name, err := b.string()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.string(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.attrs(); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestServer(t *testing.T) {
+	d, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	c, errs := newClient(t)
+
+	// Write a file in two pieces, and read it back.
+	f := filepath.Join(d, "file")
+	h := c.handle(t, fxpOpen, f, uint32(fxfWrite|fxfCreat|fxfTrunc), attrs{Flags: attrPermissions, Mode: 0600})
+	c.ok(t, fxpWrite, h, uint64(6), "world")
+	c.ok(t, fxpWrite, h, uint64(0), "hello ")
+	c.ok(t, fxpClose, h)
+	if code, err := c.status(fxpClose, h); err != nil || code != fxFailure {
+		t.Errorf("CLOSE of closed handle: got %d, %v, want %d, nil", code, err, fxFailure)
+	}
+
+	a, err := c.reply(t, fxpAttrs, fxpStat, f).attrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Size != 11 || a.Mode != sIFREG|0600 {
+		t.Errorf("STAT: got size %d mode %o, want 11 and %o", a.Size, a.Mode, sIFREG|0600)
+	}
+
+	h = c.handle(t, fxpOpen, f, uint32(fxfRead), attrs{})
+	data, err := c.reply(t, fxpData, fxpRead, h, uint64(6), uint32(100)).string()
+	if err != nil || data != "world" {
+		t.Errorf("READ: got %q, %v, want %q, nil", data, err, "world")
+	}
+	if code, err := c.status(fxpRead, h, uint64(11), uint32(100)); err != nil || code != fxEOF {
+		t.Errorf("READ at end: got %d, %v, want EOF", code, err)
+	}
+	a, err = c.reply(t, fxpAttrs, fxpFstat, h).attrs()
+	if err != nil || a.Size != 11 {
+		t.Errorf("FSTAT: got size %d, %v, want 11, nil", a.Size, err)
+	}
+	c.ok(t, fxpClose, h)
+
+	// Appending ignores the offset.
+	h = c.handle(t, fxpOpen, f, uint32(fxfWrite|fxfAppend), attrs{})
+	c.ok(t, fxpWrite, h, uint64(0), "!")
+	c.ok(t, fxpFsetstat, h, attrs{Flags: attrPermissions, Mode: 0644})
+	c.ok(t, fxpExtended, "fsync@openssh.com", h)
+	c.ok(t, fxpClose, h)
+	if b, err := ioutil.ReadFile(f); err != nil || string(b) != "hello world!" {
+		t.Errorf("file: got %q, %v, want %q, nil", b, err, "hello world!")
+	}
+	if fi, err := os.Stat(f); err != nil || fi.Mode() != 0644 {
+		t.Errorf("FSETSTAT: got mode %v, %v, want %v", fi.Mode(), err, os.FileMode(0644))
+	}
+	c.ok(t, fxpSetstat, f, attrs{Flags: attrSize, Size: 5})
+	if b, err := ioutil.ReadFile(f); err != nil || string(b) != "hello" {
+		t.Errorf("SETSTAT: got %q, %v, want %q, nil", b, err, "hello")
+	}
+
+	// Directories.
+	sub := filepath.Join(d, "sub")
+	c.ok(t, fxpMkdir, sub, attrs{})
+	if code, err := c.status(fxpRemove, sub); err != nil || code != fxFailure {
+		t.Errorf("REMOVE of directory: got %d, %v, want %d", code, err, fxFailure)
+	}
+	c.ok(t, fxpSymlink, "file", filepath.Join(d, "link"))
+	if n := c.names(t, fxpReadlink, filepath.Join(d, "link")); !reflect.DeepEqual(n, []string{"file"}) {
+		t.Errorf("READLINK: got %q, want [file]", n)
+	}
+	a, err = c.reply(t, fxpAttrs, fxpLstat, filepath.Join(d, "link")).attrs()
+	if err != nil || a.Mode&sIFMT != sIFLNK {
+		t.Errorf("LSTAT: got mode %o, %v, want a symlink", a.Mode, err)
+	}
+
+	h = c.handle(t, fxpOpendir, d)
+	got := map[string]bool{}
+	for {
+		rt, b, err := c.call(fxpReaddir, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rt == fxpStatus {
+			if code, _ := b.uint32(); code != fxEOF {
+				t.Fatalf("READDIR: got status %d, want EOF", code)
+			}
+			break
+		}
+		n, _ := b.uint32()
+		for i := uint32(0); i < n; i++ {
+			name, _ := b.string()
+			if _, err := b.string(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.attrs(); err != nil {
+				t.Fatal(err)
+			}
+			got[name] = true
+		}
+	}
+	c.ok(t, fxpClose, h)
+	if want := map[string]bool{"file": true, "link": true, "sub": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("READDIR: got %v, want %v", got, want)
+	}
+
+	// RENAME does not overwrite, posix-rename does.
+	g := filepath.Join(d, "g")
+	if err := ioutil.WriteFile(g, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code, err := c.status(fxpRename, f, g); err != nil || code != fxFailure {
+		t.Errorf("RENAME onto a file: got %d, %v, want %d", code, err, fxFailure)
+	}
+	c.ok(t, fxpExtended, "posix-rename@openssh.com", f, g)
+	c.ok(t, fxpRename, g, f)
+	c.ok(t, fxpRemove, f)
+	c.ok(t, fxpRmdir, sub)
+	if code, err := c.status(fxpStat, f); err != nil || code != fxNoSuchFile {
+		t.Errorf("STAT of removed file: got %d, %v, want %d", code, err, fxNoSuchFile)
+	}
+
+	if n := c.names(t, fxpRealpath, d+"/sub/../."); !reflect.DeepEqual(n, []string{d}) {
+		t.Errorf("REALPATH: got %q, want [%s]", n, d)
+	}
+	if code, err := c.status(fxpExtended, "statvfs@openssh.com", d); err != nil || code != fxOpUnsupported {
+		t.Errorf("unknown extension: got %d, %v, want %d", code, err, fxOpUnsupported)
+	}
+	if code, err := c.status(99); err != nil || code != fxOpUnsupported {
+		t.Errorf("unknown request: got %d, %v, want %d", code, err, fxOpUnsupported)
+	}
+
+	c.c.Close()
+	if err := <-errs; err != nil && err != io.ErrClosedPipe {
+		t.Errorf("Serve: got %v, want nil", err)
+	}
+}
+
+func TestServeNoInit(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	go writePacket(c, fxpOpen, appendUint32(nil, 1))
+	if err := NewServer(s).Serve(); err == nil {
+		t.Errorf("Serve without INIT: got nil, want error")
+	}
+}
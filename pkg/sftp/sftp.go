@@ -0,0 +1,324 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sftp implements the server side of version 3 of the SSH file
+// transfer protocol, which is what OpenSSH's sftp and scp -s speak.
+//
+// The protocol is described in draft-ietf-secsh-filexfer-02, and the
+// OpenSSH extensions in PROTOCOL in the OpenSSH sources.
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Version is the protocol version the server speaks.
+const Version = 3
+
+// Packet types.
+const (
+	fxpInit          = 1
+	fxpVersion       = 2
+	fxpOpen          = 3
+	fxpClose         = 4
+	fxpRead          = 5
+	fxpWrite         = 6
+	fxpLstat         = 7
+	fxpFstat         = 8
+	fxpSetstat       = 9
+	fxpFsetstat      = 10
+	fxpOpendir       = 11
+	fxpReaddir       = 12
+	fxpRemove        = 13
+	fxpMkdir         = 14
+	fxpRmdir         = 15
+	fxpRealpath      = 16
+	fxpStat          = 17
+	fxpRename        = 18
+	fxpReadlink      = 19
+	fxpSymlink       = 20
+	fxpStatus        = 101
+	fxpHandle        = 102
+	fxpData          = 103
+	fxpName          = 104
+	fxpAttrs         = 105
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+)
+
+// Status codes.
+const (
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxOpUnsupported    = 8
+)
+
+// Flags of OPEN.
+const (
+	fxfRead   = 0x01
+	fxfWrite  = 0x02
+	fxfAppend = 0x04
+	fxfCreat  = 0x08
+	fxfTrunc  = 0x10
+	fxfExcl   = 0x20
+)
+
+// Flags of the attributes that are present.
+const (
+	attrSize        = 0x00000001
+	attrUIDGID      = 0x00000002
+	attrPermissions = 0x00000004
+	attrACModTime   = 0x00000008
+	attrExtended    = 0x80000000
+)
+
+// maxPacket is the largest packet the server accepts. OpenSSH uses the
+// same limit.
+const maxPacket = 256 * 1024
+
+// errShortPacket is returned when a packet ends before its fields do.
+var errShortPacket = errors.New("short packet")
+
+// readPacket reads a packet, returning its type and its payload.
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n == 0 || n > maxPacket {
+		return 0, nil, fmt.Errorf("bad packet length %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	return b[0], b[1:], nil
+}
+
+// writePacket writes a packet of type t with payload p.
+func writePacket(w io.Writer, t byte, p []byte) error {
+	b := make([]byte, 5, 5+len(p))
+	binary.BigEndian.PutUint32(b, uint32(1+len(p)))
+	b[4] = t
+	_, err := w.Write(append(b, p...))
+	return err
+}
+
+// buffer decodes the fields of a payload.
+type buffer []byte
+
+func (b *buffer) uint32() (uint32, error) {
+	if len(*b) < 4 {
+		return 0, errShortPacket
+	}
+	v := binary.BigEndian.Uint32(*b)
+	*b = (*b)[4:]
+	return v, nil
+}
+
+func (b *buffer) uint64() (uint64, error) {
+	if len(*b) < 8 {
+		return 0, errShortPacket
+	}
+	v := binary.BigEndian.Uint64(*b)
+	*b = (*b)[8:]
+	return v, nil
+}
+
+func (b *buffer) bytes() ([]byte, error) {
+	n, err := b.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(*b)) < n {
+		return nil, errShortPacket
+	}
+	v := (*b)[:n]
+	*b = (*b)[n:]
+	return v, nil
+}
+
+func (b *buffer) string() (string, error) {
+	v, err := b.bytes()
+	return string(v), err
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUint32(b, uint32(len(s))), s...)
+}
+
+func appendBytes(b []byte, v []byte) []byte {
+	return append(appendUint32(b, uint32(len(v))), v...)
+}
+
+// attrs are file attributes. Flags says which of the others are set.
+type attrs struct {
+	Flags    uint32
+	Size     uint64
+	UID, GID uint32
+	Mode     uint32
+	Atime    uint32
+	Mtime    uint32
+}
+
+// Bits of the POSIX mode of attrs.
+const (
+	sIFMT   = 0170000
+	sIFSOCK = 0140000
+	sIFLNK  = 0120000
+	sIFREG  = 0100000
+	sIFBLK  = 0060000
+	sIFDIR  = 0040000
+	sIFCHR  = 0020000
+	sIFIFO  = 0010000
+	sISUID  = 0004000
+	sISGID  = 0002000
+	sISVTX  = 0001000
+)
+
+// fileAttrs returns the attributes of fi.
+func fileAttrs(fi os.FileInfo) attrs {
+	m := fi.Mode()
+	mode := uint32(m.Perm())
+	switch {
+	case m.IsDir():
+		mode |= sIFDIR
+	case m&os.ModeSymlink != 0:
+		mode |= sIFLNK
+	case m&os.ModeNamedPipe != 0:
+		mode |= sIFIFO
+	case m&os.ModeSocket != 0:
+		mode |= sIFSOCK
+	case m&os.ModeCharDevice != 0:
+		mode |= sIFCHR
+	case m&os.ModeDevice != 0:
+		mode |= sIFBLK
+	default:
+		mode |= sIFREG
+	}
+	if m&os.ModeSetuid != 0 {
+		mode |= sISUID
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= sISGID
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= sISVTX
+	}
+	a := attrs{
+		Flags: attrSize | attrPermissions | attrACModTime,
+		Size:  uint64(fi.Size()),
+		Mode:  mode,
+		Atime: uint32(fi.ModTime().Unix()),
+		Mtime: uint32(fi.ModTime().Unix()),
+	}
+	if uid, gid, ok := owner(fi); ok {
+		a.Flags |= attrUIDGID
+		a.UID, a.GID = uid, gid
+	}
+	return a
+}
+
+// fileMode returns the os.FileMode of the permission bits of a.
+func (a attrs) fileMode() os.FileMode {
+	m := os.FileMode(a.Mode & 0777)
+	if a.Mode&sISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if a.Mode&sISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if a.Mode&sISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+func (a attrs) times() (time.Time, time.Time) {
+	return time.Unix(int64(a.Atime), 0), time.Unix(int64(a.Mtime), 0)
+}
+
+func (b *buffer) attrs() (attrs, error) {
+	var a attrs
+	var err error
+	if a.Flags, err = b.uint32(); err != nil {
+		return a, err
+	}
+	if a.Flags&attrSize != 0 {
+		if a.Size, err = b.uint64(); err != nil {
+			return a, err
+		}
+	}
+	if a.Flags&attrUIDGID != 0 {
+		if a.UID, err = b.uint32(); err != nil {
+			return a, err
+		}
+		if a.GID, err = b.uint32(); err != nil {
+			return a, err
+		}
+	}
+	if a.Flags&attrPermissions != 0 {
+		if a.Mode, err = b.uint32(); err != nil {
+			return a, err
+		}
+	}
+	if a.Flags&attrACModTime != 0 {
+		if a.Atime, err = b.uint32(); err != nil {
+			return a, err
+		}
+		if a.Mtime, err = b.uint32(); err != nil {
+			return a, err
+		}
+	}
+	if a.Flags&attrExtended != 0 {
+		// Nothing uses extended attributes, but they must be
+		// skipped.
+		n, err := b.uint32()
+		if err != nil {
+			return a, err
+		}
+		for i := uint32(0); i < 2*n; i++ {
+			if _, err := b.string(); err != nil {
+				return a, err
+			}
+		}
+	}
+	return a, nil
+}
+
+func appendAttrs(b []byte, a attrs) []byte {
+	flags := a.Flags &^ attrExtended
+	b = appendUint32(b, flags)
+	if flags&attrSize != 0 {
+		b = appendUint64(b, a.Size)
+	}
+	if flags&attrUIDGID != 0 {
+		b = appendUint32(appendUint32(b, a.UID), a.GID)
+	}
+	if flags&attrPermissions != 0 {
+		b = appendUint32(b, a.Mode)
+	}
+	if flags&attrACModTime != 0 {
+		b = appendUint32(appendUint32(b, a.Atime), a.Mtime)
+	}
+	return b
+}
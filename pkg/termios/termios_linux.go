@@ -104,9 +104,16 @@ func (t *TTYIO) Ctty(c *exec.Cmd) {
 	c.SysProcAttr.Ctty = int(t.f.Fd())
 }
 
+// dup returns a copy of term. Termios holds a pointer, so plain copies
+// share their state.
+func dup(term *Termios) *Termios {
+	t := *term.Termios
+	return &Termios{Termios: &t}
+}
+
 // MakeRaw modifies Termio state so, if it used for an fd or tty, it will set it to raw mode.
 func MakeRaw(term *Termios) *Termios {
-	raw := *term
+	raw := dup(term)
 	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
 	raw.Oflag &^= unix.OPOST
 	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
@@ -116,12 +123,12 @@ func MakeRaw(term *Termios) *Termios {
 	raw.Cc[unix.VMIN] = 1
 	raw.Cc[unix.VTIME] = 0
 
-	return &raw
+	return raw
 }
 
 // MakeSerialBaud updates the Termios to set the baudrate
 func MakeSerialBaud(term *Termios, baud int) (*Termios, error) {
-	t := *term
+	t := dup(term)
 	rate, ok := baud2unixB[baud]
 	if !ok {
 		return nil, fmt.Errorf("%d: Unrecognized baud rate", baud)
@@ -132,7 +139,7 @@ func MakeSerialBaud(term *Termios, baud int) (*Termios, error) {
 	t.Ispeed = rate
 	t.Ospeed = rate
 
-	return &t, nil
+	return t, nil
 }
 
 // MakeSerialDefault updates the Termios to typical serial configuration:
@@ -143,7 +150,7 @@ func MakeSerialBaud(term *Termios, baud int) (*Termios, error) {
 // - Local ECHO is added (and handled by line editing)
 // - Map newline to carriage return newline on output
 func MakeSerialDefault(term *Termios) *Termios {
-	t := *term
+	t := dup(term)
 	/* Clear all except baud, stop bit and parity settings */
 	t.Cflag &= unix.CBAUD | unix.CSTOPB | unix.PARENB | unix.PARODD
 	/* Set: 8 bits; ignore Carrier Detect; enable receive */
@@ -158,5 +165,5 @@ func MakeSerialDefault(term *Termios) *Termios {
 	t.Cc[unix.VTIME] = 0
 	t.Line = 0
 
-	return &t
+	return t
 }
@@ -20,6 +20,7 @@ import (
 	"testing"
 
 	"github.com/u-root/u-root/pkg/testutil"
+	"golang.org/x/sys/unix"
 )
 
 func TestNew(t *testing.T) {
@@ -64,6 +65,29 @@ func TestRaw(t *testing.T) {
 	}
 }
 
+func TestMakeRawCopies(t *testing.T) {
+	term := &Termios{Termios: &unix.Termios{Lflag: unix.ECHO | unix.ICANON}}
+	orig := *term.Termios
+	for _, f := range []func(*Termios) *Termios{
+		MakeRaw,
+		MakeSerialDefault,
+		func(t *Termios) *Termios {
+			s, _ := MakeSerialBaud(t, 115200)
+			return s
+		},
+	} {
+		if got := f(term); got.Termios == term.Termios {
+			t.Errorf("got a Termios sharing its state with the original")
+		}
+		if !reflect.DeepEqual(*term.Termios, orig) {
+			t.Fatalf("original changed: got %+v, want %+v", *term.Termios, orig)
+		}
+	}
+	if raw := MakeRaw(term); raw.Lflag&unix.ECHO != 0 {
+		t.Errorf("MakeRaw: got ECHO set, want cleared")
+	}
+}
+
 // Test proper unmarshaling and consistent, repeatable output from String()
 func TestString(t *testing.T) {
 	// This JSON is from a real device.
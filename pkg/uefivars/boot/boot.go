@@ -47,6 +47,28 @@ type EfiLoadOption struct {
 }
 type BootEntryVars []*BootEntryVar
 
+// Attributes of an EfiLoadOption, as defined in UEFI spec v2.8A section 3.1.3.
+const (
+	LoadOptionActive         = 0x00000001
+	LoadOptionForceReconnect = 0x00000002
+	LoadOptionHidden         = 0x00000008
+	LoadOptionCategory       = 0x00001F00
+
+	LoadOptionCategoryBoot = 0x00000000
+	LoadOptionCategoryApp  = 0x00000100
+)
+
+// Active returns true if the firmware would try to boot the entry.
+func (o EfiLoadOption) Active() bool {
+	return o.Attributes&LoadOptionActive != 0
+}
+
+// IsApp returns true if the entry is an application, e.g. the firmware setup,
+// rather than an OS loader.
+func (o EfiLoadOption) IsApp() bool {
+	return o.Attributes&LoadOptionCategory == LoadOptionCategoryApp
+}
+
 // Gets BootXXXX var, if it exists
 func ReadBootVar(num uint16) (*BootEntryVar, error) {
 	v, err := uefivars.ReadVar(BootUUID, fmt.Sprintf("Boot%04X", num))
@@ -179,6 +201,37 @@ func ReadBootCurrent() *BootCurrentVar {
 	}
 }
 
+// ReadBootOrder reads and returns the BootOrder var, the numbers of the boot
+// entries in the order in which they are tried.
+func ReadBootOrder() ([]uint16, error) {
+	v, err := uefivars.ReadVar(BootUUID, "BootOrder")
+	if err != nil {
+		return nil, fmt.Errorf("reading var BootOrder: %w", err)
+	}
+	if len(v.Data)%2 != 0 {
+		return nil, fmt.Errorf("reading var BootOrder: odd length %d", len(v.Data))
+	}
+	order := make([]uint16, 0, len(v.Data)/2)
+	for i := 0; i < len(v.Data); i += 2 {
+		order = append(order, uefivars.BytesToU16(v.Data[i:i+2]))
+	}
+	return order, nil
+}
+
+// ReadBootNext reads and returns the BootNext var, the number of the boot
+// entry to try first on the next boot only. The returned error wraps
+// os.ErrNotExist if BootNext is not set.
+func ReadBootNext() (uint16, error) {
+	v, err := uefivars.ReadVar(BootUUID, "BootNext")
+	if err != nil {
+		return 0, fmt.Errorf("reading var BootNext: %w", err)
+	}
+	if len(v.Data) != 2 {
+		return 0, fmt.Errorf("reading var BootNext: invalid length %d", len(v.Data))
+	}
+	return uefivars.BytesToU16(v.Data), nil
+}
+
 // BootEntries takes a list of efi vars and parses any that are boot entries,
 // returning a list of them.
 func BootEntries(vars uefivars.EfiVars) (bootvars BootEntryVars) {
@@ -8,7 +8,9 @@
 package boot
 
 import (
+	"errors"
 	"os"
+	"reflect"
 	"testing"
 
 	"github.com/u-root/u-root/pkg/uefivars"
@@ -110,3 +112,41 @@ func TestBootCurrent(t *testing.T) {
 		t.Errorf("want %d got %d", want, bc.Current)
 	}
 }
+
+//func ReadBootOrder() ([]uint16, error)
+func TestReadBootOrder(t *testing.T) {
+	order, err := ReadBootOrder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint16{10, 7, 8, 0, 1, 2, 3, 5, 9, 4, 6}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("want %v got %v", want, order)
+	}
+}
+
+//func ReadBootNext() (uint16, error)
+func TestReadBootNext(t *testing.T) {
+	if _, err := ReadBootNext(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want %v got %v", os.ErrNotExist, err)
+	}
+}
+
+func TestLoadOptionAttributes(t *testing.T) {
+	for _, tt := range []struct {
+		num    uint16
+		active bool
+		app    bool
+	}{
+		{num: 0, active: true, app: true},
+		{num: 7, active: true, app: false},
+	} {
+		b, err := ReadBootVar(tt.num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Active() != tt.active || b.IsApp() != tt.app {
+			t.Errorf("Boot%04X: want active=%t app=%t, got active=%t app=%t", tt.num, tt.active, tt.app, b.Active(), b.IsApp())
+		}
+	}
+}
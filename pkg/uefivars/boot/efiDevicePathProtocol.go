@@ -102,6 +102,12 @@ loop:
 				p, err = ParseDppMsgATAPI(h, data)
 			case DppMsgTypeMAC:
 				p, err = ParseDppMsgMAC(h, data)
+			case DppMsgTypeIP4:
+				p, err = ParseDppMsgIP4(h, data)
+			case DppMsgTypeIP6:
+				p, err = ParseDppMsgIP6(h, data)
+			case DppMsgTypeURI:
+				p, err = ParseDppMsgURI(h, data)
 			default:
 				log.Printf("unhandled msg subtype %s: %q", st, data)
 			}
@@ -10,6 +10,8 @@ package boot
 import (
 	"encoding/binary"
 	"fmt"
+	"net"
+	"strings"
 )
 
 type EfiDppMsgSubType EfiDevPathProtoSubType
@@ -174,3 +176,184 @@ func (e *DppMsgMAC) String() string {
 func (e *DppMsgMAC) Resolver() (EfiPathSegmentResolver, error) {
 	return nil, ErrUnimpl
 }
+
+// ipProtocol returns the name of an IANA protocol number.
+func ipProtocol(p uint16) string {
+	switch p {
+	case 6:
+		return "TCP"
+	case 17:
+		return "UDP"
+	}
+	return fmt.Sprintf("0x%x", p)
+}
+
+// DppMsgIP4 contains an IPv4 configuration. Firmware uses it to select the
+// IPv4 stack for network boot; the addresses are usually unspecified, in which
+// case they are obtained with DHCP.
+// pg 301
+type DppMsgIP4 struct {
+	Hdr                   EfiDevicePathProtocolHdr
+	LocalIP, RemoteIP     net.IP
+	LocalPort, RemotePort uint16
+	Protocol              uint16
+	StaticIP              bool
+	Gateway               net.IP //only in UEFI 2.0+
+	SubnetMask            net.IPMask
+}
+
+var _ EfiDevicePathProtocol = (*DppMsgIP4)(nil)
+
+// ParseDppMsgIP4 parses input into a DppMsgIP4.
+func ParseDppMsgIP4(h EfiDevicePathProtocolHdr, b []byte) (*DppMsgIP4, error) {
+	// Before UEFI 2.0, the node did not contain the gateway and mask.
+	if h.Length != 27 && h.Length != 19 {
+		return nil, ErrParse
+	}
+	ip := &DppMsgIP4{
+		Hdr:        h,
+		LocalIP:    net.IP(append([]byte{}, b[0:4]...)),
+		RemoteIP:   net.IP(append([]byte{}, b[4:8]...)),
+		LocalPort:  binary.LittleEndian.Uint16(b[8:10]),
+		RemotePort: binary.LittleEndian.Uint16(b[10:12]),
+		Protocol:   binary.LittleEndian.Uint16(b[12:14]),
+		StaticIP:   b[14] != 0,
+	}
+	if h.Length == 27 {
+		ip.Gateway = net.IP(append([]byte{}, b[15:19]...))
+		ip.SubnetMask = net.IPMask(append([]byte{}, b[19:23]...))
+	}
+	return ip, nil
+}
+
+func (e *DppMsgIP4) Header() EfiDevicePathProtocolHdr { return e.Hdr }
+
+// ProtoSubTypeStr returns the subtype as human readable.
+func (e *DppMsgIP4) ProtoSubTypeStr() string {
+	return EfiDppMsgSubType(e.Hdr.ProtoSubType).String()
+}
+
+func (e *DppMsgIP4) String() string {
+	origin := "DHCP"
+	if e.StaticIP {
+		origin = "Static"
+	}
+	s := fmt.Sprintf("IPv4(%s,%s,%s,%s", e.RemoteIP, ipProtocol(e.Protocol), origin, e.LocalIP)
+	if e.Gateway != nil {
+		s += fmt.Sprintf(",%s,%s", e.Gateway, net.IP(e.SubnetMask))
+	}
+	return s + ")"
+}
+
+// Resolver returns a nil EfiPathSegmentResolver and ErrUnimpl, as network
+// devices have no file system to resolve.
+func (e *DppMsgIP4) Resolver() (EfiPathSegmentResolver, error) {
+	return nil, ErrUnimpl
+}
+
+// DppMsgIP6 contains an IPv6 configuration. Like DppMsgIP4, it is used to
+// select the IPv6 stack for network boot.
+// pg 302
+type DppMsgIP6 struct {
+	Hdr                   EfiDevicePathProtocolHdr
+	LocalIP, RemoteIP     net.IP
+	LocalPort, RemotePort uint16
+	Protocol              uint16
+	Origin                uint8 //0 - static; 1 - SLAAC; 2 - DHCPv6
+	PrefixLength          uint8 //only in UEFI 2.4+
+	Gateway               net.IP
+}
+
+var _ EfiDevicePathProtocol = (*DppMsgIP6)(nil)
+
+// ParseDppMsgIP6 parses input into a DppMsgIP6.
+func ParseDppMsgIP6(h EfiDevicePathProtocolHdr, b []byte) (*DppMsgIP6, error) {
+	// Before UEFI 2.4, the node did not contain the prefix and gateway.
+	if h.Length != 60 && h.Length != 43 {
+		return nil, ErrParse
+	}
+	ip := &DppMsgIP6{
+		Hdr:        h,
+		LocalIP:    net.IP(append([]byte{}, b[0:16]...)),
+		RemoteIP:   net.IP(append([]byte{}, b[16:32]...)),
+		LocalPort:  binary.LittleEndian.Uint16(b[32:34]),
+		RemotePort: binary.LittleEndian.Uint16(b[34:36]),
+		Protocol:   binary.LittleEndian.Uint16(b[36:38]),
+		Origin:     b[38],
+	}
+	if h.Length == 60 {
+		ip.PrefixLength = b[39]
+		ip.Gateway = net.IP(append([]byte{}, b[40:56]...))
+	}
+	return ip, nil
+}
+
+func (e *DppMsgIP6) Header() EfiDevicePathProtocolHdr { return e.Hdr }
+
+// ProtoSubTypeStr returns the subtype as human readable.
+func (e *DppMsgIP6) ProtoSubTypeStr() string {
+	return EfiDppMsgSubType(e.Hdr.ProtoSubType).String()
+}
+
+func (e *DppMsgIP6) String() string {
+	var origin string
+	switch e.Origin {
+	case 0:
+		origin = "Static"
+	case 1:
+		origin = "StatelessAutoConfigure"
+	case 2:
+		origin = "StatefulAutoConfigure"
+	default:
+		origin = fmt.Sprintf("0x%x", e.Origin)
+	}
+	s := fmt.Sprintf("IPv6(%s,%s,%s,%s", e.RemoteIP, ipProtocol(e.Protocol), origin, e.LocalIP)
+	if e.Gateway != nil {
+		s += fmt.Sprintf(",%d,%s", e.PrefixLength, e.Gateway)
+	}
+	return s + ")"
+}
+
+// Resolver returns a nil EfiPathSegmentResolver and ErrUnimpl, as network
+// devices have no file system to resolve.
+func (e *DppMsgIP6) Resolver() (EfiPathSegmentResolver, error) {
+	return nil, ErrUnimpl
+}
+
+// DppMsgURI contains the URI of a file to boot over HTTP. An empty URI means
+// the URI is obtained with DHCP.
+// pg 314
+type DppMsgURI struct {
+	Hdr EfiDevicePathProtocolHdr
+	URI string
+}
+
+var _ EfiDevicePathProtocol = (*DppMsgURI)(nil)
+
+// ParseDppMsgURI parses input into a DppMsgURI.
+func ParseDppMsgURI(h EfiDevicePathProtocolHdr, b []byte) (*DppMsgURI, error) {
+	if h.Length < 4 {
+		return nil, ErrParse
+	}
+	return &DppMsgURI{
+		Hdr: h,
+		URI: strings.TrimRight(string(b), "\x00"),
+	}, nil
+}
+
+func (e *DppMsgURI) Header() EfiDevicePathProtocolHdr { return e.Hdr }
+
+// ProtoSubTypeStr returns the subtype as human readable.
+func (e *DppMsgURI) ProtoSubTypeStr() string {
+	return EfiDppMsgSubType(e.Hdr.ProtoSubType).String()
+}
+
+func (e *DppMsgURI) String() string {
+	return fmt.Sprintf("Uri(%s)", e.URI)
+}
+
+// Resolver returns a nil EfiPathSegmentResolver and ErrUnimpl, as network
+// devices have no file system to resolve.
+func (e *DppMsgURI) Resolver() (EfiPathSegmentResolver, error) {
+	return nil, ErrUnimpl
+}
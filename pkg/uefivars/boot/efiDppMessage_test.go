@@ -64,3 +64,103 @@ func TestParseDppMsgMAC(t *testing.T) {
 		t.Errorf("want %s got %s", wantp, gotp)
 	}
 }
+
+//func ParseDppMsgIP4(h EfiDevicePathProtocolHdr, b []byte) (*DppMsgIP4, error)
+func TestParseDppMsgIP4(t *testing.T) {
+	in := []byte{
+		0, 0, 0, 0, //local
+		192, 168, 0, 1, //remote
+		0, 0, 0, 0, //ports
+		6, 0, //protocol
+		0,          //static
+		0, 0, 0, 0, //gateway
+		0, 0, 0, 0, //mask
+	}
+	hdr := EfiDevicePathProtocolHdr{
+		ProtoType:    3,
+		ProtoSubType: 12,
+		Length:       uint16(len(in) + 4),
+	}
+	p, err := ParseDppMsgIP4(hdr, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "IPv4(192.168.0.1,TCP,DHCP,0.0.0.0,0.0.0.0,0.0.0.0)"
+	got := p.String()
+	if want != got {
+		t.Errorf("\nwant %s\n got %s", want, got)
+	}
+	wantp := "IPv4"
+	gotp := p.ProtoSubTypeStr()
+	if wantp != gotp {
+		t.Errorf("want %s got %s", wantp, gotp)
+	}
+
+	hdr.Length = 19
+	p, err = ParseDppMsgIP4(hdr, in[:15])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "IPv4(192.168.0.1,TCP,DHCP,0.0.0.0)"
+	got = p.String()
+	if want != got {
+		t.Errorf("\nwant %s\n got %s", want, got)
+	}
+
+	hdr.Length = 20
+	if _, err := ParseDppMsgIP4(hdr, in[:16]); err != ErrParse {
+		t.Errorf("want %v got %v", ErrParse, err)
+	}
+}
+
+//func ParseDppMsgIP6(h EfiDevicePathProtocolHdr, b []byte) (*DppMsgIP6, error)
+func TestParseDppMsgIP6(t *testing.T) {
+	in := make([]byte, 56)
+	in[16], in[17], in[31] = 0x20, 0x01, 0x01 //remote 2001::1
+	in[36] = 6                                //protocol
+	in[38] = 2                                //origin
+	in[39] = 64                               //prefix
+	hdr := EfiDevicePathProtocolHdr{
+		ProtoType:    3,
+		ProtoSubType: 13,
+		Length:       uint16(len(in) + 4),
+	}
+	p, err := ParseDppMsgIP6(hdr, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "IPv6(2001::1,TCP,StatefulAutoConfigure,::,64,::)"
+	got := p.String()
+	if want != got {
+		t.Errorf("\nwant %s\n got %s", want, got)
+	}
+	wantp := "IPv6"
+	gotp := p.ProtoSubTypeStr()
+	if wantp != gotp {
+		t.Errorf("want %s got %s", wantp, gotp)
+	}
+}
+
+//func ParseDppMsgURI(h EfiDevicePathProtocolHdr, b []byte) (*DppMsgURI, error)
+func TestParseDppMsgURI(t *testing.T) {
+	in := []byte("http://192.168.0.1/boot.efi")
+	hdr := EfiDevicePathProtocolHdr{
+		ProtoType:    3,
+		ProtoSubType: 24,
+		Length:       uint16(len(in) + 4),
+	}
+	p, err := ParseDppMsgURI(hdr, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Uri(http://192.168.0.1/boot.efi)"
+	got := p.String()
+	if want != got {
+		t.Errorf("\nwant %s\n got %s", want, got)
+	}
+	wantp := "URI"
+	gotp := p.ProtoSubTypeStr()
+	if wantp != gotp {
+		t.Errorf("want %s got %s", wantp, gotp)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// SPDX-License-Identifier: BSD-3-Clause
+//
+
+package boot
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/uefivars"
+)
+
+// MarshalBinary encodes the load option as stored in a BootXXXX var. Only
+// device paths made of HDD, FilePath and raw nodes can be encoded.
+func (o EfiLoadOption) MarshalBinary() ([]byte, error) {
+	path, err := o.FilePathList.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if len(path) > 0xffff {
+		return nil, fmt.Errorf("FilePathList too long: %d bytes", len(path))
+	}
+	b := make([]byte, 6)
+	binary.LittleEndian.PutUint32(b[:4], o.Attributes)
+	binary.LittleEndian.PutUint16(b[4:6], uint16(len(path)))
+	b = append(b, uefivars.EncodeUTF16(o.Description)...)
+	b = append(b, 0, 0)
+	b = append(b, path...)
+	return append(b, o.OptionalData...), nil
+}
+
+// MarshalBinary encodes the list of device path nodes, terminated by an End
+// node.
+func (list EfiDevicePathProtocolList) MarshalBinary() ([]byte, error) {
+	var b []byte
+	for _, p := range list {
+		var data []byte
+		switch n := p.(type) {
+		case *DppMediaHDD:
+			data = make([]byte, 38)
+			binary.LittleEndian.PutUint32(data[:4], n.PartNum)
+			binary.LittleEndian.PutUint64(data[4:12], n.PartStart)
+			binary.LittleEndian.PutUint64(data[12:20], n.PartSize)
+			copy(data[20:36], n.PartSig[:])
+			data[36] = n.PartFmt
+			data[37] = n.SigType
+		case *DppMediaFilePath:
+			path := strings.Replace(n.PathNameDecoded, string(os.PathSeparator), `\`, -1)
+			data = append(uefivars.EncodeUTF16(path), 0, 0)
+		case *EfiDevPathRaw:
+			data = n.Raw
+		case *EfiDevPathEnd:
+			// Added below.
+			continue
+		default:
+			return nil, fmt.Errorf("encoding %s: %w", p, ErrUnimpl)
+		}
+		b = append(b, encodeNode(p.Header(), data)...)
+	}
+	end := EfiDevicePathProtocolHdr{
+		ProtoType:    DppTypeEnd,
+		ProtoSubType: EfiDevPathProtoSubType(DppETypeEndEntire),
+	}
+	return append(b, encodeNode(end, nil)...), nil
+}
+
+// encodeNode encodes a device path node, with the length in the header set
+// to that of data.
+func encodeNode(h EfiDevicePathProtocolHdr, data []byte) []byte {
+	b := make([]byte, 4, 4+len(data))
+	b[0] = byte(h.ProtoType)
+	b[1] = byte(h.ProtoSubType)
+	binary.LittleEndian.PutUint16(b[2:4], uint16(4+len(data)))
+	return append(b, data...)
+}
+
+// NewDppMediaHDD returns the device path node for a GPT partition, identified
+// by its number and unique partition GUID. start and size are in logical
+// blocks.
+func NewDppMediaHDD(partNum uint32, start, size uint64, guid uefivars.MixedGUID) *DppMediaHDD {
+	return &DppMediaHDD{
+		Hdr: EfiDevicePathProtocolHdr{
+			ProtoType:    DppTypeMedia,
+			ProtoSubType: EfiDevPathProtoSubType(DppMTypeHdd),
+			Length:       42,
+		},
+		PartNum:   partNum,
+		PartStart: start,
+		PartSize:  size,
+		PartSig:   guid,
+		PartFmt:   2,
+		SigType:   2,
+	}
+}
+
+// NewDppMediaFilePath returns the device path node for a file, relative to
+// the root of the partition.
+func NewDppMediaFilePath(path string) *DppMediaFilePath {
+	return &DppMediaFilePath{
+		Hdr: EfiDevicePathProtocolHdr{
+			ProtoType:    DppTypeMedia,
+			ProtoSubType: EfiDevPathProtoSubType(DppMTypeFilePath),
+			Length:       uint16(4 + len(uefivars.EncodeUTF16(path)) + 2),
+		},
+		PathNameDecoded: path,
+	}
+}
+
+// WriteBootVar creates or replaces the BootXXXX var of the entry.
+func WriteBootVar(b *BootEntryVar) error {
+	data, err := b.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("encoding Boot%04X: %w", b.Number, err)
+	}
+	return uefivars.WriteVar(BootUUID, fmt.Sprintf("Boot%04X", b.Number), uefivars.DefaultAttrs, data)
+}
+
+// RemoveBootVar deletes the BootXXXX var. BootOrder is not changed.
+func RemoveBootVar(num uint16) error {
+	return uefivars.RemoveVar(BootUUID, fmt.Sprintf("Boot%04X", num))
+}
+
+// SetBootVarAttributes changes the attributes of an existing BootXXXX var,
+// e.g. to set or clear LoadOptionActive. The rest of the var is left as is,
+// so that entries with device paths we cannot encode can be changed too.
+func SetBootVarAttributes(num uint16, attrs uint32) error {
+	name := fmt.Sprintf("Boot%04X", num)
+	varAttrs, data, err := uefivars.ReadVarAttrs(BootUUID, name)
+	if err != nil {
+		return fmt.Errorf("reading var %s: %w", name, err)
+	}
+	if len(data) < 6 {
+		return fmt.Errorf("reading var %s: %w", name, ErrParse)
+	}
+	binary.LittleEndian.PutUint32(data[:4], attrs)
+	return uefivars.WriteVar(BootUUID, name, varAttrs, data)
+}
+
+// FreeBootNumber returns the lowest number that is not used by a boot entry.
+func FreeBootNumber() (uint16, error) {
+	used := make(map[uint16]bool)
+	for _, e := range AllBootEntryVars() {
+		used[e.Number] = true
+	}
+	for n := 0; n <= 0xffff; n++ {
+		if !used[uint16(n)] {
+			return uint16(n), nil
+		}
+	}
+	return 0, errors.New("no free boot entry number")
+}
+
+// WriteBootOrder writes the BootOrder var.
+func WriteBootOrder(order []uint16) error {
+	data := make([]byte, 2*len(order))
+	for i, n := range order {
+		binary.LittleEndian.PutUint16(data[2*i:], n)
+	}
+	return uefivars.WriteVar(BootUUID, "BootOrder", uefivars.DefaultAttrs, data)
+}
+
+// RemoveBootOrder deletes the BootOrder var.
+func RemoveBootOrder() error {
+	return uefivars.RemoveVar(BootUUID, "BootOrder")
+}
+
+// WriteBootNext writes the BootNext var, the entry to try first on the next
+// boot only.
+func WriteBootNext(num uint16) error {
+	data := make([]byte, 2)
+	binary.LittleEndian.PutUint16(data, num)
+	return uefivars.WriteVar(BootUUID, "BootNext", uefivars.DefaultAttrs, data)
+}
+
+// RemoveBootNext deletes the BootNext var.
+func RemoveBootNext() error {
+	return uefivars.RemoveVar(BootUUID, "BootNext")
+}
+
+// ReadTimeout reads and returns the Timeout var, the number of seconds the
+// firmware waits before booting the first entry of BootOrder. The returned
+// error wraps os.ErrNotExist if Timeout is not set.
+func ReadTimeout() (uint16, error) {
+	v, err := uefivars.ReadVar(BootUUID, "Timeout")
+	if err != nil {
+		return 0, fmt.Errorf("reading var Timeout: %w", err)
+	}
+	if len(v.Data) != 2 {
+		return 0, fmt.Errorf("reading var Timeout: invalid length %d", len(v.Data))
+	}
+	return uefivars.BytesToU16(v.Data), nil
+}
+
+// WriteTimeout writes the Timeout var.
+func WriteTimeout(seconds uint16) error {
+	data := make([]byte, 2)
+	binary.LittleEndian.PutUint16(data, seconds)
+	return uefivars.WriteVar(BootUUID, "Timeout", uefivars.DefaultAttrs, data)
+}
+
+// RemoveTimeout deletes the Timeout var.
+func RemoveTimeout() error {
+	return uefivars.RemoveVar(BootUUID, "Timeout")
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// SPDX-License-Identifier: BSD-3-Clause
+//
+
+package boot
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uefivars"
+)
+
+// setupVarFs points uefivars at an empty fake efivarfs until the returned
+// function is called.
+func setupVarFs(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "efivarfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldFs, oldDir := uefivars.EfiVarFs, uefivars.EfiVarDir
+	uefivars.EfiVarFs, uefivars.EfiVarDir = dir, fp.Join(dir, "does-not-exist")
+	return func() {
+		uefivars.EfiVarFs, uefivars.EfiVarDir = oldFs, oldDir
+		os.RemoveAll(dir)
+	}
+}
+
+//func (o EfiLoadOption) MarshalBinary() ([]byte, error)
+func TestMarshalBinary(t *testing.T) {
+	// Boot0007 is HD(...)/File(\EFI\BOOT\BOOTX64.EFI) with optional data.
+	v, err := uefivars.ReadVar(BootUUID, "Boot0007")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := BootVar(v).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, v.Data) {
+		t.Errorf("want\n%x\ngot\n%x", v.Data, b)
+	}
+
+	// Boot0006 has a MAC node, which cannot be encoded.
+	e, err := ReadBootVar(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.MarshalBinary(); !errors.Is(err, ErrUnimpl) {
+		t.Errorf("want %v got %v", ErrUnimpl, err)
+	}
+}
+
+//func WriteBootVar(b *BootEntryVar) error
+func TestWriteBootVar(t *testing.T) {
+	var guid uefivars.MixedGUID
+	copy(guid[:], []byte{0xcd, 0x5c, 0x63, 0x81, 0x4f, 0x1b, 0x3f, 0x4d, 0xb7, 0xb7, 0xf7, 0x8a, 0x5b, 0x02, 0x9f, 0x35})
+	want := &BootEntryVar{
+		Number: 0x1a,
+		EfiLoadOption: EfiLoadOption{
+			Attributes:  LoadOptionActive,
+			Description: "Linux",
+			FilePathList: EfiDevicePathProtocolList{
+				NewDppMediaHDD(1, 0x800, 0x100000, guid),
+				NewDppMediaFilePath("/EFI/Linux/vmlinuz.efi"),
+			},
+			OptionalData: uefivars.EncodeUTF16("root=/dev/sda2"),
+		},
+	}
+
+	defer setupVarFs(t)()
+	if err := WriteBootVar(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadBootVar(0x1a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.FilePathListLength = got.FilePathListLength
+	if got.String() != want.String() {
+		t.Errorf("want %s\ngot %s", want, got)
+	}
+	if s := "HD(1,GPT,81635ccd-1b4f-4d3f-b7b7-f78a5b029f35,0x800,0x100000)/File(/EFI/Linux/vmlinuz.efi)"; got.FilePathList.String() != s {
+		t.Errorf("want %s got %s", s, got.FilePathList)
+	}
+
+	if err := SetBootVarAttributes(0x1a, 0); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ReadBootVar(0x1a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Active() || got.Description != "Linux" {
+		t.Errorf("after SetBootVarAttributes: %s", got)
+	}
+
+	if n, err := FreeBootNumber(); err != nil || n != 0 {
+		t.Errorf("FreeBootNumber = %d, %v, want 0", n, err)
+	}
+	if err := RemoveBootVar(0x1a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadBootVar(0x1a); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want %v got %v", os.ErrNotExist, err)
+	}
+}
+
+func TestWriteBootOrderNextTimeout(t *testing.T) {
+	defer setupVarFs(t)()
+
+	order := []uint16{3, 0x1a, 0}
+	if err := WriteBootOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadBootOrder(); err != nil || !reflect.DeepEqual(got, order) {
+		t.Errorf("ReadBootOrder = %v, %v, want %v", got, err, order)
+	}
+
+	if err := WriteBootNext(0x1a); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadBootNext(); err != nil || got != 0x1a {
+		t.Errorf("ReadBootNext = %d, %v, want 26", got, err)
+	}
+	if err := RemoveBootNext(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadBootNext(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want %v got %v", os.ErrNotExist, err)
+	}
+
+	if _, err := ReadTimeout(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want %v got %v", os.ErrNotExist, err)
+	}
+	if err := WriteTimeout(5); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadTimeout(); err != nil || got != 5 {
+		t.Errorf("ReadTimeout = %d, %v, want 5", got, err)
+	}
+	if err := RemoveTimeout(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// SPDX-License-Identifier: BSD-3-Clause
+//
+
+package uefivars
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+)
+
+// Attributes of a var, as defined in UEFI spec v2.8A section 8.2.
+const (
+	AttrNonVolatile                       uint32 = 0x00000001
+	AttrBootServiceAccess                 uint32 = 0x00000002
+	AttrRuntimeAccess                     uint32 = 0x00000004
+	AttrHardwareErrorRecord               uint32 = 0x00000008
+	AttrAuthenticatedWriteAccess          uint32 = 0x00000010 //deprecated
+	AttrTimeBasedAuthenticatedWriteAccess uint32 = 0x00000020
+	AttrAppendWrite                       uint32 = 0x00000040
+
+	// DefaultAttrs are the attributes of vars like BootXXXX.
+	DefaultAttrs = AttrNonVolatile | AttrBootServiceAccess | AttrRuntimeAccess
+)
+
+var (
+	// ErrUnsigned is returned when writing a time-based authenticated var
+	// whose data does not begin with an EFI_VARIABLE_AUTHENTICATION_2.
+	ErrUnsigned = errors.New("authenticated var data must begin with EFI_VARIABLE_AUTHENTICATION_2")
+
+	// ErrDeprecatedAuth is returned when writing a var with the deprecated
+	// EFI_VARIABLE_AUTHENTICATED_WRITE_ACCESS attribute, which firmware
+	// rejects.
+	ErrDeprecatedAuth = errors.New("EFI_VARIABLE_AUTHENTICATED_WRITE_ACCESS is deprecated")
+)
+
+// fsPath returns the path of a var in efivarfs.
+func fsPath(uuid, name string) string {
+	return fp.Join(EfiVarFs, name+"-"+uuid)
+}
+
+// ReadVarAttrs reads a var from efivarfs, returning its attributes and data.
+func ReadVarAttrs(uuid, name string) (uint32, []byte, error) {
+	b, err := ioutil.ReadFile(fsPath(uuid, name))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(b) < 4 {
+		return 0, nil, fmt.Errorf("reading efi var %s-%s: missing attributes", name, uuid)
+	}
+	return binary.LittleEndian.Uint32(b[:4]), b[4:], nil
+}
+
+// WriteVar creates or replaces a var through efivarfs. If attrs include
+// AttrAppendWrite, data is appended to the var instead.
+//
+// Vars with AttrTimeBasedAuthenticatedWriteAccess, such as db or KEK, can only
+// be written with data signed by the owner of the platform: data must begin
+// with an EFI_VARIABLE_AUTHENTICATION_2 descriptor, e.g. as created by
+// sign-efi-sig-list, and is verified by the firmware.
+func WriteVar(uuid, name string, attrs uint32, data []byte) error {
+	if attrs&AttrAuthenticatedWriteAccess != 0 {
+		return ErrDeprecatedAuth
+	}
+	if attrs&AttrTimeBasedAuthenticatedWriteAccess != 0 && !isAuthenticated(data) {
+		return ErrUnsigned
+	}
+
+	path := fsPath(uuid, name)
+	wasImmutable, err := clearImmutable(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if wasImmutable {
+		defer setImmutable(path)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if attrs&AttrAppendWrite != 0 {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	// efivarfs requires attributes and data in a single write.
+	b := make([]byte, 4+len(data))
+	binary.LittleEndian.PutUint32(b, attrs)
+	copy(b[4:], data)
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("writing efi var %s-%s: %w", name, uuid, err)
+	}
+	return f.Close()
+}
+
+// RemoveVar deletes a var through efivarfs.
+func RemoveVar(uuid, name string) error {
+	path := fsPath(uuid, name)
+	if _, err := clearImmutable(path); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// isAuthenticated returns true if data begins with an
+// EFI_VARIABLE_AUTHENTICATION_2 descriptor:
+//
+//	typedef struct {
+//	    EFI_TIME TimeStamp;              // 16 bytes
+//	    WIN_CERTIFICATE_UEFI_GUID AuthInfo;
+//	} EFI_VARIABLE_AUTHENTICATION_2;
+//
+//	typedef struct {
+//	    UINT32 dwLength;                 // of the whole WIN_CERTIFICATE_UEFI_GUID
+//	    UINT16 wRevision;                // 0x0200
+//	    UINT16 wCertificateType;         // WIN_CERT_TYPE_EFI_GUID, 0x0EF1
+//	    EFI_GUID CertType;
+//	    UINT8 CertData[];
+//	} WIN_CERTIFICATE_UEFI_GUID;
+func isAuthenticated(data []byte) bool {
+	const hdrLen = 16 + 4 + 2 + 2 + 16
+	if len(data) < hdrLen {
+		return false
+	}
+	le := binary.LittleEndian
+	certLen := le.Uint32(data[16:20])
+	return le.Uint16(data[20:22]) == 0x0200 &&
+		le.Uint16(data[22:24]) == 0x0EF1 &&
+		certLen >= hdrLen-16 && uint64(certLen) <= uint64(len(data)-16)
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// SPDX-License-Identifier: BSD-3-Clause
+//
+
+package uefivars
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"testing"
+)
+
+const testUUID = "8be4df61-93ca-11d2-aa0d-00e098032b8c"
+
+// setupVarFs points EfiVarFs to an empty temp dir, and EfiVarDir to a
+// directory that does not exist, as on kernels without the sysfs interface.
+func setupVarFs(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "efivarfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldFs, oldDir := EfiVarFs, EfiVarDir
+	EfiVarFs, EfiVarDir = dir, fp.Join(dir, "does-not-exist")
+	return func() {
+		EfiVarFs, EfiVarDir = oldFs, oldDir
+		os.RemoveAll(dir)
+	}
+}
+
+//func WriteVar(uuid, name string, attrs uint32, data []byte) error
+func TestWriteVar(t *testing.T) {
+	defer setupVarFs(t)()
+
+	if err := WriteVar(testUUID, "Timeout", DefaultAttrs, []byte{5, 0}); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(fp.Join(EfiVarFs, "Timeout-"+testUUID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{7, 0, 0, 0, 5, 0}; !bytes.Equal(raw, want) {
+		t.Errorf("want %x got %x", want, raw)
+	}
+
+	// Replace.
+	if err := WriteVar(testUUID, "Timeout", DefaultAttrs, []byte{3, 0}); err != nil {
+		t.Fatal(err)
+	}
+	attrs, data, err := ReadVarAttrs(testUUID, "Timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs != DefaultAttrs || !bytes.Equal(data, []byte{3, 0}) {
+		t.Errorf("want attrs %x data %x, got attrs %x data %x", DefaultAttrs, []byte{3, 0}, attrs, data)
+	}
+
+	// ReadVar and ReadVars fall back to efivarfs.
+	v, err := ReadVar(testUUID, "Timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v.Data, []byte{3, 0}) {
+		t.Errorf("ReadVar: want %x got %x", []byte{3, 0}, v.Data)
+	}
+	if vars := AllVars(); len(vars) != 1 || vars[0].Name != "Timeout" || vars[0].Uuid != testUUID {
+		t.Errorf("AllVars: want Timeout, got %v", vars)
+	}
+
+	//func RemoveVar(uuid, name string) error
+	if err := RemoveVar(testUUID, "Timeout"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadVar(testUUID, "Timeout"); !os.IsNotExist(err) {
+		t.Errorf("want not exist, got %v", err)
+	}
+	if err := RemoveVar(testUUID, "Timeout"); !os.IsNotExist(err) {
+		t.Errorf("want not exist, got %v", err)
+	}
+}
+
+func TestWriteVarAppend(t *testing.T) {
+	defer setupVarFs(t)()
+
+	if err := WriteVar(testUUID, "Test", DefaultAttrs, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	// The kernel would not store the attributes of an append, but a plain
+	// file does.
+	if err := WriteVar(testUUID, "Test", DefaultAttrs|AttrAppendWrite, []byte("def")); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(fp.Join(EfiVarFs, "Test-"+testUUID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("\x07\x00\x00\x00abc\x47\x00\x00\x00def")
+	if !bytes.Equal(raw, want) {
+		t.Errorf("want %q got %q", want, raw)
+	}
+}
+
+func TestWriteVarAuthenticated(t *testing.T) {
+	defer setupVarFs(t)()
+
+	attrs := DefaultAttrs | AttrTimeBasedAuthenticatedWriteAccess
+	if err := WriteVar(testUUID, "db", attrs, []byte("not signed")); err != ErrUnsigned {
+		t.Errorf("want %v got %v", ErrUnsigned, err)
+	}
+	if err := WriteVar(testUUID, "db", DefaultAttrs|AttrAuthenticatedWriteAccess, nil); err != ErrDeprecatedAuth {
+		t.Errorf("want %v got %v", ErrDeprecatedAuth, err)
+	}
+
+	// EFI_TIME, then WIN_CERTIFICATE_UEFI_GUID with an empty signature.
+	signed := make([]byte, 16+24+4)
+	binary.LittleEndian.PutUint32(signed[16:], 24)
+	binary.LittleEndian.PutUint16(signed[20:], 0x0200)
+	binary.LittleEndian.PutUint16(signed[22:], 0x0EF1)
+	if err := WriteVar(testUUID, "db", attrs, signed); err != nil {
+		t.Fatal(err)
+	}
+
+	binary.LittleEndian.PutUint32(signed[16:], 100)
+	if err := WriteVar(testUUID, "db", attrs, signed); err != ErrUnsigned {
+		t.Errorf("certificate longer than data: want %v got %v", ErrUnsigned, err)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// SPDX-License-Identifier: BSD-3-Clause
+//
+
+package uefivars
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fsImmutableFl is FS_IMMUTABLE_FL from linux/fs.h. efivarfs marks most vars
+// immutable, so that they are not deleted by accident, e.g. by rm -rf.
+const fsImmutableFl = 0x00000010
+
+// fsIocSetflags is FS_IOC_SETFLAGS, _IOW('f', 2, long), which is missing from
+// x/sys/unix. It only differs from FS_IOC_GETFLAGS, _IOR('f', 1, long), in
+// the number and direction, whose encoding depends on the architecture.
+var fsIocSetflags = func() uint {
+	get := uint(unix.FS_IOC_GETFLAGS)
+	write := uint(0x80000000) // mips, powerpc, sparc
+	if get&0x80000000 != 0 {
+		write = 0x40000000 // everything else
+	}
+	return get&^0xe00000ff | write | 2
+}()
+
+// clearImmutable clears the immutable flag of the file at path, and returns
+// whether it was set. File systems without flags are ignored.
+func clearImmutable(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil || flags&fsImmutableFl == 0 {
+		return false, nil
+	}
+	if err := unix.IoctlSetPointerInt(int(f.Fd()), fsIocSetflags, int(flags&^fsImmutableFl)); err != nil {
+		return false, &os.PathError{Op: "clear immutable flag", Path: path, Err: err}
+	}
+	return true, nil
+}
+
+// setImmutable sets the immutable flag of the file at path.
+func setImmutable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return err
+	}
+	return unix.IoctlSetPointerInt(int(f.Fd()), fsIocSetflags, int(flags|fsImmutableFl))
+}
@@ -24,6 +24,10 @@ import (
 //overridden for testing
 var EfiVarDir = "/sys/firmware/efi/vars"
 
+// EfiVarFs is where efivarfs is mounted. Vars are written through efivarfs,
+// and read from it if EfiVarDir does not exist. Overridden for testing.
+var EfiVarFs = "/sys/firmware/efi/efivars"
+
 //EfiVar is a generic efi var
 type EfiVar struct {
 	Uuid, Name string
@@ -32,19 +36,35 @@ type EfiVar struct {
 type EfiVars []EfiVar
 
 func ReadVar(uuid, name string) (e EfiVar, err error) {
-	path := fp.Join(EfiVarDir, name+"-"+uuid, "data")
 	e.Uuid = uuid
 	e.Name = name
+	if useVarFs() {
+		_, e.Data, err = ReadVarAttrs(uuid, name)
+		return
+	}
+	path := fp.Join(EfiVarDir, name+"-"+uuid, "data")
 	e.Data, err = ioutil.ReadFile(path)
 	return
 }
 
+// useVarFs returns true if vars must be read from efivarfs, because the
+// deprecated sysfs interface at EfiVarDir does not exist.
+func useVarFs() bool {
+	_, err := os.Stat(EfiVarDir)
+	return os.IsNotExist(err)
+}
+
 // AllVars returns all efi variables
 func AllVars() (vars EfiVars) { return ReadVars(nil) }
 
 // ReadVars returns efi variables matching filter
 func ReadVars(filt VarFilter) (vars EfiVars) {
-	entries, err := fp.Glob(fp.Join(EfiVarDir, "*-*"))
+	dir := EfiVarDir
+	varFs := useVarFs()
+	if varFs {
+		dir = EfiVarFs
+	}
+	entries, err := fp.Glob(fp.Join(dir, "*-*"))
 	if err != nil {
 		log.Printf("error reading efi vars: %s", err)
 		return
@@ -60,8 +80,9 @@ func ReadVars(filt VarFilter) (vars EfiVars) {
 		if filt != nil && !filt(components[1], components[0]) {
 			continue
 		}
+		// sysfs has a directory per var, efivarfs a file.
 		info, err := os.Stat(entry)
-		if err == nil && info.IsDir() {
+		if err == nil && info.IsDir() != varFs {
 			v, err := ReadVar(components[1], components[0])
 			if err != nil {
 				log.Printf("reading efi var %s: %s", base, err)
@@ -127,6 +148,17 @@ func DecodeUTF16(b []byte) (string, error) {
 	return ret.String(), nil
 }
 
+// EncodeUTF16 encodes s as utf16, without null termination.
+func EncodeUTF16(s string) []byte {
+	u16s := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u16s))
+	for i, u := range u16s {
+		b[2*i] = byte(u)
+		b[2*i+1] = byte(u >> 8)
+	}
+	return b
+}
+
 // BytesToU16 converts a []byte of length 2 to a uint16.
 func BytesToU16(b []byte) uint16 {
 	if len(b) != 2 {
@@ -8,6 +8,7 @@
 package uefivars
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -32,6 +33,18 @@ func TestDecodeUTF16(t *testing.T) {
 	}
 }
 
+//func EncodeUTF16(s string) []byte
+func TestEncodeUTF16(t *testing.T) {
+	want := []byte{84, 0, 69, 0, 83, 0, 84, 0, 0x3d, 0xd8, 0x00, 0xde}
+	got := EncodeUTF16("TEST\U0001f600")
+	if !bytes.Equal(got, want) {
+		t.Errorf("want %x, got %x", want, got)
+	}
+	if s, err := DecodeUTF16(got[:8]); err != nil || s != "TEST" {
+		t.Errorf("round trip: got %q, %v", s, err)
+	}
+}
+
 //func (vars EfiVars) Filter(filt VarFilter) EfiVars
 func TestFilter(t *testing.T) {
 	filt := func(_, _ string) bool { return true }
@@ -7,6 +7,7 @@ package uio
 import (
 	"io"
 	"strings"
+	"sync"
 )
 
 // ProgressReader implements io.Reader and prints Symbol to W after every
@@ -31,3 +32,27 @@ func (r *ProgressReader) Read(p []byte) (n int, err error) {
 	}()
 	return r.R.Read(p)
 }
+
+// ProgressWriter implements io.Writer and prints Symbol to W after every
+// Interval bytes written to it. The bytes themselves are discarded, so it
+// is used alongside the actual destination, e.g. with io.MultiWriter.
+//
+// It is safe for concurrent use, e.g. by parallel downloads.
+type ProgressWriter struct {
+	Symbol   string
+	Interval int
+	W        io.Writer
+
+	mu      sync.Mutex
+	counter int
+}
+
+// Write implements io.Writer for ProgressWriter.
+func (w *ProgressWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	numSymbols := (w.counter%w.Interval + len(p)) / w.Interval
+	w.W.Write([]byte(strings.Repeat(w.Symbol, numSymbols)))
+	w.counter += len(p)
+	return len(p), nil
+}
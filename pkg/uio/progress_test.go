@@ -42,3 +42,29 @@ func TestProgressReader(t *testing.T) {
 		t.Errorf("found %q, expected %q to be written", string(output), "456789012")
 	}
 }
+
+func TestProgressWriter(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	pw := &ProgressWriter{
+		Symbol:   "#",
+		Interval: 4,
+		W:        stdout,
+	}
+
+	for i := 0; i < 3; i++ {
+		pw.Write([]byte("0"))
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("found %q, but expected no bytes to be written", stdout)
+	}
+	pw.Write([]byte("0"))
+	if stdout.String() != "#" {
+		t.Errorf("found %q, expected %q to be written", stdout.String(), "#")
+	}
+	if n, err := pw.Write([]byte("012345678")); n != 9 || err != nil {
+		t.Errorf("Write = %d, %v, want 9, nil", n, err)
+	}
+	if stdout.String() != "###" {
+		t.Errorf("found %q, expected %q to be written", stdout.String(), "###")
+	}
+}
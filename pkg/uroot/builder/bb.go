@@ -31,7 +31,11 @@ var skip = map[string]struct{}{
 //
 // See bb/README.md for a detailed explanation of the implementation of busybox
 // mode.
-type BBBuilder struct{}
+type BBBuilder struct {
+	// Cache, if not nil, holds rewritten packages and busybox binaries of
+	// earlier builds, so that only changed commands are built again.
+	Cache *bb.Cache
+}
 
 // DefaultBinaryDir implements Builder.DefaultBinaryDir.
 //
@@ -41,10 +45,14 @@ func (BBBuilder) DefaultBinaryDir() string {
 }
 
 // Build is an implementation of Builder.Build for a busybox-like initramfs.
-func (BBBuilder) Build(af *initramfs.Files, opts Opts) error {
+func (b BBBuilder) Build(af *initramfs.Files, opts Opts) error {
 	// Build the busybox binary.
 	bbPath := filepath.Join(opts.TempDir, "bb")
-	if err := bb.BuildBusybox(opts.Env, opts.Packages, bbPath); err != nil {
+	build := bb.BuildBusybox
+	if b.Cache != nil {
+		build = b.Cache.BuildBusybox
+	}
+	if err := build(opts.Env, opts.Packages, bbPath); err != nil {
 		return err
 	}
 
@@ -23,9 +23,12 @@ var (
 	//
 	// - cpio: writes the initramfs to a cpio.
 	// - dir:  writes the initramfs relative to a specified directory.
+	// - gzip, zstd: write the initramfs to a compressed cpio.
 	Archivers = map[string]Archiver{
 		"cpio": CPIO,
 		"dir":  Dir,
+		"gzip": CompressedArchiver{CPIOArchiver: CPIO, Compressor: Gzip},
+		"zstd": CompressedArchiver{CPIOArchiver: CPIO, Compressor: Zstd},
 	}
 )
 
@@ -0,0 +1,295 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package initramfs
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/u-root/u-root/pkg/cpio"
+	ugzip "github.com/u-root/u-root/pkg/gzip"
+	"github.com/u-root/u-root/pkg/ulog"
+)
+
+var (
+	// Gzip compresses with gzip, using several cores.
+	Gzip Compressor = gzipCompressor{}
+
+	// Zstd compresses with zstd.
+	Zstd Compressor = zstdCompressor{}
+
+	// Compressors are the compressions that archives are read in.
+	Compressors = []Compressor{Gzip, Zstd}
+)
+
+// Compressor is a compression the kernel can unpack an initramfs from.
+//
+// Compressed output must only depend on the input and the level, so that
+// initramfs files are reproducible.
+type Compressor interface {
+	// Magic returns the bytes a compressed stream starts with.
+	Magic() []byte
+
+	// Suffix returns the file name suffix, e.g. ".gz".
+	Suffix() string
+
+	// Writer returns a WriteCloser that compresses to w at the given
+	// level. Level 0 is the compressor's default.
+	Writer(w io.Writer, level int) (io.WriteCloser, error)
+
+	// Decompress decompresses the stream at the start of r. It returns
+	// the decompressed data and the length of the stream in r, so that
+	// whatever follows can be read.
+	Decompress(r io.ReaderAt) ([]byte, int64, error)
+}
+
+// CompressedArchiver is an implementation of Archiver for compressed cpio
+// archives.
+type CompressedArchiver struct {
+	CPIOArchiver
+
+	// Compressor compresses the archive.
+	Compressor Compressor
+
+	// Level is the compression level. 0 is the Compressor's default.
+	Level int
+}
+
+// OpenWriter opens `path` as the correct file type and returns an
+// Writer pointing to `path`.
+//
+// If `path` is empty, a default path of /tmp/initramfs.GOOS_GOARCH.cpio with
+// the Compressor's suffix is used.
+func (ca CompressedArchiver) OpenWriter(l ulog.Logger, path, goos, goarch string) (Writer, error) {
+	if len(path) == 0 && len(goos) == 0 && len(goarch) == 0 {
+		return nil, fmt.Errorf("passed no path, GOOS, and GOARCH to CompressedArchiver.OpenWriter")
+	}
+	if len(path) == 0 {
+		path = fmt.Sprintf("/tmp/initramfs.%s_%s.cpio%s", goos, goarch, ca.Compressor.Suffix())
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	zw, err := ca.Compressor.Writer(f, ca.Level)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.Printf("Filename is %s", path)
+	return compressedWriter{ca.RecordFormat.Writer(zw), zw, f}, nil
+}
+
+// compressedWriter implements Writer.
+type compressedWriter struct {
+	cpio.RecordWriter
+
+	zw io.WriteCloser
+	f  *os.File
+}
+
+// Finish implements Writer.Finish.
+func (c compressedWriter) Finish() error {
+	err := cpio.WriteTrailer(c)
+	if cerr := c.zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := c.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// offsetReader reads from an io.ReaderAt, keeping track of the offset. It
+// is an io.ByteReader so that decompressors do not read ahead of what they
+// use.
+type offsetReader struct {
+	r   io.ReaderAt
+	off int64
+
+	buf    [4096]byte
+	bufOff int64
+	bufLen int
+}
+
+func (o *offsetReader) fill() error {
+	if o.off >= o.bufOff && o.off < o.bufOff+int64(o.bufLen) {
+		return nil
+	}
+	n, err := o.r.ReadAt(o.buf[:], o.off)
+	o.bufOff, o.bufLen = o.off, n
+	if n > 0 {
+		return nil
+	}
+	if err == nil {
+		err = io.ErrNoProgress
+	}
+	return err
+}
+
+// Read implements io.Reader.
+func (o *offsetReader) Read(p []byte) (int, error) {
+	if err := o.fill(); err != nil {
+		return 0, err
+	}
+	n := copy(p, o.buf[o.off-o.bufOff:o.bufLen])
+	o.off += int64(n)
+	return n, nil
+}
+
+// ReadByte implements io.ByteReader.
+func (o *offsetReader) ReadByte() (byte, error) {
+	if err := o.fill(); err != nil {
+		return 0, err
+	}
+	b := o.buf[o.off-o.bufOff]
+	o.off++
+	return b, nil
+}
+
+type gzipCompressor struct{}
+
+// Magic implements Compressor.Magic.
+func (gzipCompressor) Magic() []byte {
+	return []byte{0x1f, 0x8b}
+}
+
+// Suffix implements Compressor.Suffix.
+func (gzipCompressor) Suffix() string {
+	return ".gz"
+}
+
+// Writer implements Compressor.Writer.
+//
+// Levels are 1 to 9.
+func (gzipCompressor) Writer(w io.Writer, level int) (io.WriteCloser, error) {
+	if level < 0 || level > 9 {
+		return nil, fmt.Errorf("gzip level %d is not between 0 and 9", level)
+	}
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return ugzip.NewWriter(w, level, 128, runtime.NumCPU())
+}
+
+// Decompress implements Compressor.Decompress.
+func (gzipCompressor) Decompress(r io.ReaderAt) ([]byte, int64, error) {
+	o := &offsetReader{r: r}
+	zr, err := gzip.NewReader(o)
+	if err != nil {
+		return nil, 0, err
+	}
+	zr.Multistream(false)
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b, o.off, nil
+}
+
+type zstdCompressor struct{}
+
+// Magic implements Compressor.Magic.
+func (zstdCompressor) Magic() []byte {
+	return []byte{0x28, 0xb5, 0x2f, 0xfd}
+}
+
+// Suffix implements Compressor.Suffix.
+func (zstdCompressor) Suffix() string {
+	return ".zst"
+}
+
+// Writer implements Compressor.Writer.
+//
+// Levels are zstd's 1 to 22, which map onto fewer levels of the encoder.
+func (zstdCompressor) Writer(w io.Writer, level int) (io.WriteCloser, error) {
+	if level < 0 || level > 22 {
+		return nil, fmt.Errorf("zstd level %d is not between 0 and 22", level)
+	}
+	if level == 0 {
+		level = 3
+	}
+	return zstd.NewWriter(w,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+		zstd.WithEncoderConcurrency(1))
+}
+
+var errZstdReserved = errors.New("zstd: reserved block type")
+
+// zstdFrameLen finds the length of the zstd frame at the start of r by
+// walking its block headers.
+func zstdFrameLen(r io.ReaderAt) (int64, error) {
+	hdr := make([]byte, 6)
+	if n, err := r.ReadAt(hdr, 0); n < len(hdr) {
+		return 0, err
+	}
+	fhd := hdr[4]
+	singleSegment := fhd&0x20 != 0
+	checksum := fhd&0x04 != 0
+
+	off := int64(5)
+	if !singleSegment {
+		// Window descriptor.
+		off++
+	}
+	off += []int64{0, 1, 2, 4}[fhd&0x3]
+	fcsLen := []int64{0, 2, 4, 8}[fhd>>6]
+	if fcsLen == 0 && singleSegment {
+		fcsLen = 1
+	}
+	off += fcsLen
+
+	for {
+		var b [3]byte
+		if n, err := r.ReadAt(b[:], off); n < len(b) {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		h := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+		off += 3
+		switch (h >> 1) & 0x3 {
+		case 1:
+			// RLE blocks hold one byte.
+			off++
+		case 3:
+			return 0, errZstdReserved
+		default:
+			off += int64(h >> 3)
+		}
+		if h&1 != 0 {
+			break
+		}
+	}
+	if checksum {
+		off += 4
+	}
+	return off, nil
+}
+
+// Decompress implements Compressor.Decompress.
+func (zstdCompressor) Decompress(r io.ReaderAt) ([]byte, int64, error) {
+	n, err := zstdFrameLen(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	zr, err := zstd.NewReader(io.NewSectionReader(r, 0, n), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer zr.Close()
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b, n, nil
+}
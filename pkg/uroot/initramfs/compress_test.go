@@ -0,0 +1,293 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package initramfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+func testRecords() []cpio.Record {
+	// Random data does not compress.
+	random := make([]byte, 100<<10)
+	rand.New(rand.NewSource(0)).Read(random)
+	return []cpio.Record{
+		cpio.Directory("etc", 0755),
+		cpio.StaticFile("etc/motd", strings.Repeat("welcome to u-root\n", 1000), 0644),
+		cpio.StaticRecord(random, cpio.Info{Name: "random", Mode: cpio.S_IFREG | 0600}),
+		cpio.Symlink("init", "bbin/init"),
+	}
+}
+
+// writeArchive writes records with a to a file and returns its contents.
+func writeArchive(t *testing.T, a Archiver, records []cpio.Record) []byte {
+	dir, err := ioutil.TempDir("", "initramfs-compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "initramfs")
+	w, err := a.OpenWriter(log.New(ioutil.Discard, "", 0), path, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range records {
+		if err := w.WriteRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// readArchive reads all records of rr. Later files replace earlier ones.
+func readArchive(t *testing.T, rr Reader) map[string]string {
+	files := make(map[string]string)
+	for {
+		r, err := rr.ReadRecord()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := uio.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[r.Name] = string(content)
+	}
+}
+
+// checkNames checks that rr reads records of the names in want, in order.
+func checkNames(t *testing.T, rr Reader, want []string) {
+	var got []string
+	for {
+		r, err := rr.ReadRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r.Name)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got records %q, want %q", got, want)
+	}
+}
+
+func checkFiles(t *testing.T, got map[string]string, want []cpio.Record) {
+	if len(got) != len(want) {
+		t.Errorf("got %d files, want %d", len(got), len(want))
+	}
+	for _, r := range want {
+		var content []byte
+		if r.ReaderAt != nil {
+			var err error
+			if content, err = uio.ReadAll(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if c, ok := got[r.Name]; !ok {
+			t.Errorf("file %q is missing", r.Name)
+		} else if c != string(content) {
+			t.Errorf("file %q has %d bytes of content, want %d", r.Name, len(c), len(content))
+		}
+	}
+}
+
+func TestCompressedArchivers(t *testing.T) {
+	records := testRecords()
+	for _, format := range []string{"gzip", "zstd"} {
+		for _, level := range []int{0, 1, 9} {
+			a, err := GetArchiver(format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ca := a.(CompressedArchiver)
+			ca.Level = level
+
+			b := writeArchive(t, ca, records)
+			if !bytes.HasPrefix(b, ca.Compressor.Magic()) {
+				t.Errorf("%s level %d: archive starts with %#x, want magic %#x", format, level, b[:8], ca.Compressor.Magic())
+			}
+			checkFiles(t, readArchive(t, CPIO.Reader(bytes.NewReader(b))), records)
+
+			if b2 := writeArchive(t, ca, records); !bytes.Equal(b, b2) {
+				t.Errorf("%s level %d: archive is not reproducible", format, level)
+			}
+		}
+	}
+}
+
+func TestCompressorLevels(t *testing.T) {
+	for _, tt := range []struct {
+		c     Compressor
+		level int
+	}{
+		{Gzip, -1},
+		{Gzip, 10},
+		{Zstd, -1},
+		{Zstd, 23},
+	} {
+		// 0 is a valid level, the default.
+		if _, err := tt.c.Writer(ioutil.Discard, tt.level); err == nil || !strings.Contains(err.Error(), "between 0 and") {
+			t.Errorf("%T.Writer(level %d) = %v, want error saying the level is not between 0 and the maximum", tt.c, tt.level, err)
+		}
+	}
+}
+
+func TestReaderSegments(t *testing.T) {
+	records := testRecords()
+	early := []cpio.Record{
+		cpio.Directory("kernel", 0755),
+		cpio.StaticFile("kernel/microcode.bin", "microcode", 0644),
+		cpio.StaticFile("etc/motd", "replaced", 0644),
+	}
+	late := []cpio.Record{
+		cpio.StaticFile("etc/hostname", "u-root", 0644),
+	}
+
+	// An uncompressed archive, then every compression with zero padding
+	// between them, as the kernel accepts.
+	var b []byte
+	b = append(b, writeArchive(t, CPIO, early)...)
+	b = append(b, make([]byte, 512-len(b)%512)...)
+	for i, c := range Compressors {
+		rs := late
+		if i == 0 {
+			rs = records
+		}
+		b = append(b, writeArchive(t, CompressedArchiver{CPIOArchiver: CPIO, Compressor: c}, rs)...)
+		b = append(b, make([]byte, 4)...)
+	}
+	// A compressed stream holding two archives.
+	var two bytes.Buffer
+	zw, err := Gzip.Writer(&two, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(writeArchive(t, CPIO, early[:1]))
+	zw.Write(writeArchive(t, CPIO, []cpio.Record{cpio.StaticFile("last", "one", 0644)}))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b = append(b, two.Bytes()...)
+
+	// Reader returns every record, in order.
+	checkNames(t, CPIO.Reader(bytes.NewReader(b)), []string{
+		"kernel", "kernel/microcode.bin", "etc/motd",
+		"etc", "etc/motd", "random", "init",
+		"etc/hostname",
+		"kernel", "last",
+	})
+
+	// MergeReader replaces earlier files, in the place of the earlier.
+	var want []cpio.Record
+	want = append(want, early[:2]...)
+	want = append(want, records...)
+	want = append(want, late[0], cpio.StaticFile("last", "one", 0644))
+	checkFiles(t, readArchive(t, CPIO.MergeReader(bytes.NewReader(b))), want)
+	checkNames(t, CPIO.MergeReader(bytes.NewReader(b)), []string{
+		"kernel", "kernel/microcode.bin", "etc/motd",
+		"etc", "random", "init",
+		"etc/hostname", "last",
+	})
+}
+
+func TestMergeReaderDuplicates(t *testing.T) {
+	// Files of the same name in one archive are all kept, and a later
+	// archive replaces all of them.
+	// Writers drop records of names they wrote before, so use two.
+	var buf bytes.Buffer
+	if err := cpio.WriteRecords(cpio.Newc.Writer(&buf), []cpio.Record{
+		cpio.StaticFile("a", "1", 0644),
+		cpio.StaticFile("b", "1", 0644),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	w := cpio.Newc.Writer(&buf)
+	if err := w.WriteRecord(cpio.StaticFile("a", "2", 0644)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpio.WriteTrailer(w); err != nil {
+		t.Fatal(err)
+	}
+	first := buf.Bytes()
+	second := writeArchive(t, CPIO, []cpio.Record{
+		cpio.StaticFile("a", "3", 0644),
+		cpio.StaticFile("c", "3", 0644),
+	})
+
+	checkNames(t, CPIO.MergeReader(bytes.NewReader(first)), []string{"a", "b", "a"})
+	checkNames(t, CPIO.MergeReader(bytes.NewReader(first), bytes.NewReader(second)), []string{"a", "b", "c"})
+
+	rr := CPIO.MergeReader(bytes.NewReader(append(append([]byte{}, first...), second...)))
+	for _, want := range []string{"3", "1", "3"} {
+		r, err := rr.ReadRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content, _ := uio.ReadAll(r); string(content) != want {
+			t.Errorf("%q has content %q, want %q", r.Name, content, want)
+		}
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	good := writeArchive(t, CompressedArchiver{CPIOArchiver: CPIO, Compressor: Zstd}, testRecords())
+	var twice bytes.Buffer
+	zw, err := Gzip.Writer(&twice, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(good)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		b    []byte
+		err  string
+	}{
+		{"unknown", []byte("not an archive"), "unknown archive format at offset 0"},
+		{"truncated", good[:len(good)/2], "decompressing archive at offset 0"},
+		{"compressed twice", twice.Bytes(), "unknown archive format at offset 0"},
+		{"empty", nil, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CPIO.Reader(bytes.NewReader(tt.b)).ReadRecord()
+			if tt.err == "" {
+				if err != io.EOF {
+					t.Errorf("ReadRecord() = %v, want EOF", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ReadRecord() = %v, want error containing %q", err, tt.err)
+			}
+		})
+	}
+}
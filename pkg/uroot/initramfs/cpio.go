@@ -5,8 +5,10 @@
 package initramfs
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"os"
 
 	"github.com/u-root/u-root/pkg/cpio"
@@ -53,6 +55,241 @@ func (o osWriter) Finish() error {
 }
 
 // Reader implements Archiver.Reader.
+//
+// Like the kernel, Reader reads archives that are compressed with any of
+// Compressors, and several archives concatenated with zero padding between
+// them. Records are read one at a time, in the order they are in r,
+// including records with the same name.
 func (ca CPIOArchiver) Reader(r io.ReaderAt) Reader {
-	return ca.RecordFormat.Reader(r)
+	return ca.MultiReader(r)
+}
+
+// MultiReader returns a Reader for all archives in several files, as if the
+// files were concatenated.
+func (ca CPIOArchiver) MultiReader(rs ...io.ReaderAt) Reader {
+	return &segmentReader{format: ca.RecordFormat, rs: rs}
+}
+
+// MergeReader returns a Reader for all archives in several files, in which
+// a file replaces files of the same name in earlier archives, as when the
+// kernel unpacks them. Files of the same name in one archive are all kept.
+//
+// Unlike MultiReader, MergeReader reads all records before it returns the
+// first.
+func (ca CPIOArchiver) MergeReader(rs ...io.ReaderAt) Reader {
+	return &mergeReader{s: &segmentReader{format: ca.RecordFormat, rs: rs}}
+}
+
+// stream is a file or a decompressed stream that holds archives.
+type stream struct {
+	r   io.ReaderAt
+	off int64
+
+	// compressed is whether the stream was decompressed from the one
+	// below it, at offset from.
+	compressed bool
+	from       int64
+}
+
+// segmentReader reads records from all archives in files.
+type segmentReader struct {
+	format cpio.RecordFormat
+	rs     []io.ReaderAt
+
+	// streams are the streams being read. Archives in a compressed stream
+	// are not compressed again, so there are at most two.
+	streams []*stream
+
+	// rr reads the archive at base in the top stream, if any. end is the
+	// end of the last record read from it.
+	rr   cpio.RecordReader
+	base int64
+	end  int64
+
+	// segment counts the archives read so far.
+	segment int
+
+	err error
+}
+
+// ReadRecord implements cpio.RecordReader.
+func (s *segmentReader) ReadRecord() (cpio.Record, error) {
+	for s.err == nil {
+		if s.rr == nil {
+			s.err = s.next()
+			continue
+		}
+		rec, err := s.rr.ReadRecord()
+		if err == io.EOF && s.end == 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			s.err = s.wrap(fmt.Errorf("archive at offset %d: %v", s.base, err))
+			break
+		}
+		if err == nil {
+			s.end = (rec.FilePos + int64(rec.FileSize) + 3) &^ 3
+			if rec.Name != cpio.Trailer {
+				return rec, nil
+			}
+		}
+		// The trailer tells where the archive ends.
+		s.streams[len(s.streams)-1].off = s.base + s.end
+		s.rr = nil
+	}
+	return cpio.Record{}, s.err
+}
+
+// next finds the next archive, decompressing it if need be.
+func (s *segmentReader) next() error {
+	if len(s.streams) == 0 {
+		if len(s.rs) == 0 {
+			return io.EOF
+		}
+		s.streams = append(s.streams, &stream{r: s.rs[0]})
+		s.rs = s.rs[1:]
+	}
+	top := s.streams[len(s.streams)-1]
+
+	off, err := skipZeros(top.r, top.off)
+	if err == io.EOF {
+		s.streams = s.streams[:len(s.streams)-1]
+		return nil
+	}
+	if err != nil {
+		return s.wrap(err)
+	}
+	magic := make([]byte, 6)
+	if n, err := top.r.ReadAt(magic, off); n < len(magic) {
+		if err != io.EOF {
+			return s.wrap(err)
+		}
+		magic = magic[:n]
+	}
+	sr := io.NewSectionReader(top.r, off, math.MaxInt64-off)
+
+	if bytes.HasPrefix(magic, []byte("0707")) {
+		s.rr = s.format.Reader(sr)
+		// Read the trailer, which tells where the archive ends.
+		if e, ok := s.rr.(cpio.EOFReader); ok {
+			s.rr = e.RecordReader
+		}
+		s.base, s.end = off, 0
+		s.segment++
+		return nil
+	}
+	c := compressorFor(magic)
+	if c == nil || top.compressed {
+		return s.wrap(fmt.Errorf("unknown archive format at offset %d", off))
+	}
+	data, n, err := c.Decompress(sr)
+	if err != nil {
+		return s.wrap(fmt.Errorf("decompressing archive at offset %d: %v", off, err))
+	}
+	top.off = off + n
+	s.streams = append(s.streams, &stream{r: bytes.NewReader(data), compressed: true, from: off})
+	return nil
+}
+
+// wrap adds the compressed streams being read to err.
+func (s *segmentReader) wrap(err error) error {
+	for i := len(s.streams) - 1; i >= 0; i-- {
+		if s.streams[i].compressed {
+			err = fmt.Errorf("archive decompressed from offset %d: %v", s.streams[i].from, err)
+		}
+	}
+	return err
+}
+
+// mergeReader reads records from all archives in files, replacing files of
+// earlier archives.
+type mergeReader struct {
+	s *segmentReader
+
+	loaded  bool
+	err     error
+	records []cpio.Record
+}
+
+// ReadRecord implements cpio.RecordReader.
+func (m *mergeReader) ReadRecord() (cpio.Record, error) {
+	if !m.loaded {
+		m.loaded = true
+		m.err = m.load()
+	}
+	if m.err != nil {
+		return cpio.Record{}, m.err
+	}
+	if len(m.records) == 0 {
+		return cpio.Record{}, io.EOF
+	}
+	rec := m.records[0]
+	m.records = m.records[1:]
+	return rec, nil
+}
+
+// load reads all records. A file that replaces files of earlier archives
+// takes the place of the first of them, so that it still comes after its
+// directory.
+func (m *mergeReader) load() error {
+	type entry struct {
+		rec     cpio.Record
+		segment int
+		dropped bool
+	}
+	var entries []entry
+	index := make(map[string][]int)
+	for {
+		rec, err := m.s.ReadRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		is := index[rec.Name]
+		if len(is) > 0 && entries[is[len(is)-1]].segment < m.s.segment {
+			entries[is[0]] = entry{rec: rec, segment: m.s.segment}
+			for _, i := range is[1:] {
+				entries[i].dropped = true
+			}
+			index[rec.Name] = is[:1]
+			continue
+		}
+		index[rec.Name] = append(is, len(entries))
+		entries = append(entries, entry{rec: rec, segment: m.s.segment})
+	}
+	for _, e := range entries {
+		if !e.dropped {
+			m.records = append(m.records, e.rec)
+		}
+	}
+	return nil
+}
+
+// skipZeros returns the offset of the first non-zero byte in r from off.
+func skipZeros(r io.ReaderAt, off int64) (int64, error) {
+	buf := make([]byte, 512)
+	for {
+		n, err := r.ReadAt(buf, off)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return off, nil
+			}
+			off++
+		}
+		if err != nil {
+			return off, err
+		}
+	}
+}
+
+// compressorFor returns the Compressor whose streams start with magic.
+func compressorFor(magic []byte) Compressor {
+	for _, c := range Compressors {
+		if bytes.HasPrefix(magic, c.Magic()) {
+			return c
+		}
+	}
+	return nil
 }
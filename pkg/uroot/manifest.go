@@ -0,0 +1,534 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uroot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/uio"
+	"github.com/u-root/u-root/pkg/uroot/builder"
+	"github.com/u-root/u-root/pkg/uroot/initramfs"
+)
+
+// Builders are the builders a manifest can name.
+var Builders = map[string]builder.Builder{
+	"bb":     builder.BusyBox,
+	"binary": builder.Binary,
+	"source": builder.Source,
+}
+
+// Manifest is a declarative description of an initramfs, which Opts can be
+// loaded from. Manifests are JSON, e.g.
+//
+//   {
+//     "include": ["../base.json"],
+//     "commands": [
+//       {"builder": "bb", "packages": ["github.com/u-root/u-root/cmds/core/*"]}
+//     ],
+//     "files": [
+//       {"source": "config/ssh_host_key", "dest": "etc/ssh_host_key", "mode": "0600"}
+//     ],
+//     "symlinks": [{"name": "bin/vi", "target": "/bbin/elvish"}],
+//     "devices": [{"name": "dev/null", "type": "char", "major": 1, "minor": 3, "mode": "0666"}],
+//     "uinitcmd": "systemboot",
+//     "uinitargs": ["-v"]
+//   }
+//
+// A manifest is layered on top of the manifests it includes, in order:
+//
+//   - Commands of the same builder are merged. Exclude removes packages of
+//     earlier layers.
+//   - A file, symlink or device replaces whatever an earlier layer put at
+//     its path.
+//   - All other fields replace those of earlier layers if they are set.
+//     Lists such as uinitargs are replaced as a whole, and [] clears them.
+//
+// Relative paths are relative to the manifest's directory. So are package
+// paths starting with "./" or "../".
+type Manifest struct {
+	// Include are the manifests this one is layered on top of.
+	Include []string `json:"include,omitempty"`
+
+	// Commands are the Go commands to build, by builder.
+	Commands []ManifestCommands `json:"commands,omitempty"`
+
+	// Files are files from the host to add.
+	Files []ManifestFile `json:"files,omitempty"`
+
+	// Symlinks are symlinks to add.
+	Symlinks []ManifestSymlink `json:"symlinks,omitempty"`
+
+	// Devices are device nodes to add.
+	Devices []ManifestDevice `json:"devices,omitempty"`
+
+	// BaseArchives are existing initramfs files to add files to.
+	BaseArchives []string `json:"base,omitempty"`
+
+	// ReplaceBase is whether a file in a later archive of BaseArchives
+	// replaces files of the same name in earlier ones, as when the kernel
+	// unpacks them. Otherwise the first of them is used.
+	ReplaceBase *bool `json:"replacebase,omitempty"`
+
+	// UseExistingInit is Opts.UseExistingInit.
+	UseExistingInit *bool `json:"useinit,omitempty"`
+
+	// SkipLDD is Opts.SkipLDD.
+	SkipLDD *bool `json:"skipldd,omitempty"`
+
+	// InitCmd is Opts.InitCmd.
+	InitCmd *string `json:"initcmd,omitempty"`
+
+	// UinitCmd is Opts.UinitCmd.
+	UinitCmd *string `json:"uinitcmd,omitempty"`
+
+	// UinitArgs is Opts.UinitArgs.
+	UinitArgs []string `json:"uinitargs,omitempty"`
+
+	// DefaultShell is Opts.DefaultShell.
+	DefaultShell *string `json:"defaultsh,omitempty"`
+}
+
+// ManifestCommands are the commands built by one builder.
+type ManifestCommands struct {
+	// Builder is the name of the builder in Builders.
+	Builder string `json:"builder"`
+
+	// Packages are as in Commands.Packages.
+	Packages []string `json:"packages,omitempty"`
+
+	// Exclude are packages of earlier layers not to build.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// ManifestFile is a file from the host.
+type ManifestFile struct {
+	// Source is the path on the host.
+	Source string `json:"source"`
+
+	// Dest is the path in the initramfs. It defaults to Source.
+	Dest string `json:"dest,omitempty"`
+
+	// Mode is the octal permission bits, e.g. "0644". It defaults to
+	// those of Source.
+	Mode string `json:"mode,omitempty"`
+
+	// UID and GID are the owner. They default to root.
+	UID *uint64 `json:"uid,omitempty"`
+	GID *uint64 `json:"gid,omitempty"`
+}
+
+// ManifestSymlink is a symlink.
+type ManifestSymlink struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+}
+
+// ManifestDevice is a device node.
+type ManifestDevice struct {
+	Name string `json:"name"`
+
+	// Type is "char" or "block".
+	Type string `json:"type"`
+
+	Major uint64 `json:"major"`
+	Minor uint64 `json:"minor"`
+
+	// Mode is the octal permission bits. It defaults to "0600".
+	Mode string `json:"mode,omitempty"`
+
+	UID uint64 `json:"uid,omitempty"`
+	GID uint64 `json:"gid,omitempty"`
+}
+
+// LoadManifest reads the manifest at path and layers it on top of the
+// manifests it includes. The result includes nothing and has absolute
+// paths.
+func LoadManifest(path string) (*Manifest, error) {
+	return loadManifest(path, nil)
+}
+
+func loadManifest(path string, including []string) (*Manifest, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range including {
+		if p == path {
+			return nil, fmt.Errorf("manifest %s includes itself", path)
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := ParseManifest(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("manifest %s: %v", path, err)
+	}
+	m.resolve(filepath.Dir(path))
+
+	effective := &Manifest{}
+	for _, inc := range m.Include {
+		im, err := loadManifest(inc, append(including, path))
+		if err != nil {
+			return nil, err
+		}
+		effective.Override(im)
+	}
+	m.Include = nil
+	effective.Override(m)
+	return effective, nil
+}
+
+// ParseManifest parses a manifest. Includes and relative paths are left
+// as they are.
+func ParseManifest(r io.Reader) (*Manifest, error) {
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+	m := &Manifest{}
+	if err := d.Decode(m); err != nil {
+		return nil, err
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// WriteTo writes m as indented JSON.
+func (m *Manifest) WriteTo(w io.Writer) (int64, error) {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(b, '\n'))
+	return int64(n), err
+}
+
+func (m *Manifest) validate() error {
+	for _, c := range m.Commands {
+		if _, ok := Builders[c.Builder]; !ok {
+			return fmt.Errorf("unknown builder %q", c.Builder)
+		}
+	}
+	for _, f := range m.Files {
+		if f.Source == "" {
+			return fmt.Errorf("file without a source")
+		}
+		if _, err := parseMode(f.Mode, 0); err != nil {
+			return fmt.Errorf("file %s: %v", f.Source, err)
+		}
+	}
+	for _, s := range m.Symlinks {
+		if s.Name == "" || s.Target == "" {
+			return fmt.Errorf("symlink %q -> %q needs a name and a target", s.Name, s.Target)
+		}
+	}
+	for _, d := range m.Devices {
+		if d.Name == "" {
+			return fmt.Errorf("device without a name")
+		}
+		if d.Type != "char" && d.Type != "block" {
+			return fmt.Errorf("device %s: type %q is not char or block", d.Name, d.Type)
+		}
+		if _, err := parseMode(d.Mode, 0); err != nil {
+			return fmt.Errorf("device %s: %v", d.Name, err)
+		}
+	}
+	return nil
+}
+
+// resolve makes the paths of m relative to dir absolute.
+func (m *Manifest) resolve(dir string) {
+	abs := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	for i, inc := range m.Include {
+		m.Include[i] = abs(inc)
+	}
+	for i, c := range m.Commands {
+		for j, p := range c.Packages {
+			if strings.HasPrefix(p, "./") || strings.HasPrefix(p, "../") {
+				c.Packages[j] = abs(p)
+			}
+		}
+		for j, p := range c.Exclude {
+			if strings.HasPrefix(p, "./") || strings.HasPrefix(p, "../") {
+				c.Exclude[j] = abs(p)
+			}
+		}
+		m.Commands[i] = c
+	}
+	for i, f := range m.Files {
+		if f.Dest == "" {
+			f.Dest = f.Source
+		}
+		f.Source = abs(f.Source)
+		m.Files[i] = f
+	}
+	for i, b := range m.BaseArchives {
+		m.BaseArchives[i] = abs(b)
+	}
+}
+
+// Override layers o on top of m.
+//
+// Includes of o are not loaded.
+func (m *Manifest) Override(o *Manifest) {
+	for _, c := range o.Commands {
+		i := 0
+		for ; i < len(m.Commands); i++ {
+			if m.Commands[i].Builder == c.Builder {
+				break
+			}
+		}
+		if i == len(m.Commands) {
+			m.Commands = append(m.Commands, ManifestCommands{Builder: c.Builder})
+		}
+		mc := &m.Commands[i]
+		mc.Packages = without(mc.Packages, c.Exclude)
+		mc.Packages = append(mc.Packages, without(c.Packages, mc.Packages)...)
+	}
+
+	for _, f := range o.Files {
+		m.remove(f.Dest)
+		m.Files = append(m.Files, f)
+	}
+	for _, s := range o.Symlinks {
+		m.remove(s.Name)
+		m.Symlinks = append(m.Symlinks, s)
+	}
+	for _, d := range o.Devices {
+		m.remove(d.Name)
+		m.Devices = append(m.Devices, d)
+	}
+
+	if o.BaseArchives != nil {
+		m.BaseArchives = o.BaseArchives
+	}
+	if o.ReplaceBase != nil {
+		m.ReplaceBase = o.ReplaceBase
+	}
+	if o.UseExistingInit != nil {
+		m.UseExistingInit = o.UseExistingInit
+	}
+	if o.SkipLDD != nil {
+		m.SkipLDD = o.SkipLDD
+	}
+	if o.InitCmd != nil {
+		m.InitCmd = o.InitCmd
+	}
+	if o.UinitCmd != nil {
+		m.UinitCmd = o.UinitCmd
+	}
+	if o.UinitArgs != nil {
+		m.UinitArgs = o.UinitArgs
+	}
+	if o.DefaultShell != nil {
+		m.DefaultShell = o.DefaultShell
+	}
+}
+
+// remove removes the file, symlink or device at path.
+func (m *Manifest) remove(path string) {
+	path = cpio.Normalize(path)
+	var files []ManifestFile
+	for _, f := range m.Files {
+		if cpio.Normalize(f.Dest) != path {
+			files = append(files, f)
+		}
+	}
+	m.Files = files
+	var symlinks []ManifestSymlink
+	for _, s := range m.Symlinks {
+		if cpio.Normalize(s.Name) != path {
+			symlinks = append(symlinks, s)
+		}
+	}
+	m.Symlinks = symlinks
+	var devices []ManifestDevice
+	for _, d := range m.Devices {
+		if cpio.Normalize(d.Name) != path {
+			devices = append(devices, d)
+		}
+	}
+	m.Devices = devices
+}
+
+// without returns the strings of a that are not in b.
+func without(a, b []string) []string {
+	var r []string
+	for _, s := range a {
+		found := false
+		for _, t := range b {
+			if s == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			r = append(r, s)
+		}
+	}
+	return r
+}
+
+func parseMode(s string, def uint64) (uint64, error) {
+	if s == "" {
+		return def, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode&^07777 != 0 {
+		return 0, fmt.Errorf("mode %q is not octal permission bits", s)
+	}
+	return mode, nil
+}
+
+// ApplyTo sets the parts of opts that m describes.
+//
+// Files with neither a mode nor an owner become ExtraFiles, so that their
+// shared libraries are added. The others become ExtraRecords.
+func (m *Manifest) ApplyTo(opts *Opts) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	for _, c := range m.Commands {
+		if len(c.Packages) == 0 {
+			continue
+		}
+		opts.Commands = append(opts.Commands, Commands{
+			Builder:  Builders[c.Builder],
+			Packages: c.Packages,
+		})
+	}
+
+	for _, f := range m.Files {
+		if f.Mode == "" && f.UID == nil && f.GID == nil {
+			opts.ExtraFiles = append(opts.ExtraFiles, fmt.Sprintf("%s:%s", f.Source, f.Dest))
+			continue
+		}
+		r, err := f.record()
+		if err != nil {
+			return err
+		}
+		opts.ExtraRecords = append(opts.ExtraRecords, r)
+	}
+	for _, s := range m.Symlinks {
+		opts.ExtraRecords = append(opts.ExtraRecords, cpio.Symlink(cpio.Normalize(s.Name), s.Target))
+	}
+	for _, d := range m.Devices {
+		mode, _ := parseMode(d.Mode, 0600)
+		typ := uint64(cpio.S_IFCHR)
+		if d.Type == "block" {
+			typ = cpio.S_IFBLK
+		}
+		opts.ExtraRecords = append(opts.ExtraRecords, cpio.Record{
+			Info: cpio.Info{
+				Name:   cpio.Normalize(d.Name),
+				Mode:   typ | mode,
+				UID:    d.UID,
+				GID:    d.GID,
+				Rmajor: d.Major,
+				Rminor: d.Minor,
+			},
+		})
+	}
+
+	if m.BaseArchives != nil {
+		var rs []io.ReaderAt
+		for _, b := range m.BaseArchives {
+			if _, err := os.Stat(b); err != nil {
+				return fmt.Errorf("base archive: %v", err)
+			}
+			rs = append(rs, uio.NewLazyFile(b))
+		}
+		if m.ReplaceBase != nil && *m.ReplaceBase {
+			opts.BaseArchive = initramfs.CPIO.MergeReader(rs...)
+		} else {
+			opts.BaseArchive = initramfs.CPIO.MultiReader(rs...)
+		}
+	}
+	if m.UseExistingInit != nil {
+		opts.UseExistingInit = *m.UseExistingInit
+	}
+	if m.SkipLDD != nil {
+		opts.SkipLDD = *m.SkipLDD
+	}
+	if m.InitCmd != nil {
+		opts.InitCmd = *m.InitCmd
+	}
+	if m.UinitCmd != nil {
+		opts.UinitCmd = *m.UinitCmd
+	}
+	if m.UinitArgs != nil {
+		opts.UinitArgs = m.UinitArgs
+	}
+	if m.DefaultShell != nil {
+		opts.DefaultShell = *m.DefaultShell
+	}
+	return nil
+}
+
+// record returns the record of a file whose mode or owner is set.
+func (f ManifestFile) record() (cpio.Record, error) {
+	fi, err := os.Stat(f.Source)
+	if err != nil {
+		return cpio.Record{}, err
+	}
+	if !fi.Mode().IsRegular() {
+		return cpio.Record{}, fmt.Errorf("%s: the mode and owner can only be set for regular files", f.Source)
+	}
+	mode, err := parseMode(f.Mode, uint64(fi.Mode().Perm()))
+	if err != nil {
+		return cpio.Record{}, err
+	}
+	r := cpio.Record{
+		ReaderAt: uio.NewLazyFile(f.Source),
+		Info: cpio.Info{
+			Name:     cpio.Normalize(f.Dest),
+			Mode:     cpio.S_IFREG | mode,
+			NLink:    1,
+			FileSize: uint64(fi.Size()),
+		},
+	}
+	if f.UID != nil {
+		r.UID = *f.UID
+	}
+	if f.GID != nil {
+		r.GID = *f.GID
+	}
+	return r, nil
+}
+
+// ParseManifestFile parses an ExtraFiles entry, "src:dst" or "src", into
+// a ManifestFile.
+func ParseManifestFile(s string) (ManifestFile, error) {
+	var f ManifestFile
+	parts := strings.SplitN(s, ":", 2)
+	f.Source = filepath.Clean(parts[0])
+	if len(parts) == 2 {
+		f.Dest = filepath.Clean(parts[1])
+	} else {
+		f.Dest = cpio.Normalize(f.Source)
+	}
+	src, err := filepath.Abs(f.Source)
+	if err != nil {
+		return ManifestFile{}, fmt.Errorf("couldn't find absolute path for %q: %v", f.Source, err)
+	}
+	f.Source = src
+	return f, nil
+}
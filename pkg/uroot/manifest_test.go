@@ -0,0 +1,212 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uroot
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/cpio"
+	"github.com/u-root/u-root/pkg/golang"
+	"github.com/u-root/u-root/pkg/uroot/builder"
+	itest "github.com/u-root/u-root/pkg/uroot/initramfs/test"
+)
+
+func writeManifests(t *testing.T, manifests map[string]string) string {
+	dir, err := ioutil.TempDir("", "uroot-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, m := range manifests {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(m), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestLoadManifest(t *testing.T) {
+	dir := writeManifests(t, map[string]string{
+		"base.json": `{
+			"commands": [
+				{"builder": "bb", "packages": ["github.com/u-root/u-root/cmds/core/ls", "github.com/u-root/u-root/cmds/core/init"]}
+			],
+			"files": [{"source": "etc/motd"}, {"source": "/etc/hosts", "dest": "etc/hosts"}],
+			"symlinks": [{"name": "bin/vi", "target": "/bbin/elvish"}],
+			"initcmd": "init",
+			"uinitargs": ["-v"],
+			"base": ["base.cpio"],
+			"replacebase": true
+		}`,
+		"platform/board.json": `{
+			"include": ["../base.json"],
+			"commands": [
+				{"builder": "bb", "packages": ["./cmds/board"], "exclude": ["github.com/u-root/u-root/cmds/core/ls"]},
+				{"builder": "binary", "packages": ["github.com/u-root/u-root/cmds/core/dd"]}
+			],
+			"files": [{"source": "hosts", "dest": "/etc/hosts", "mode": "0600", "uid": 1000}],
+			"devices": [{"name": "bin/vi", "type": "char", "major": 1, "minor": 3}],
+			"uinitcmd": "systemboot",
+			"uinitargs": []
+		}`,
+	})
+	defer os.RemoveAll(dir)
+
+	m, err := LoadManifest(filepath.Join(dir, "platform/board.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := uint64(1000)
+	replaceBase := true
+	want := &Manifest{
+		Commands: []ManifestCommands{
+			{Builder: "bb", Packages: []string{"github.com/u-root/u-root/cmds/core/init", filepath.Join(dir, "platform/cmds/board")}},
+			{Builder: "binary", Packages: []string{"github.com/u-root/u-root/cmds/core/dd"}},
+		},
+		Files: []ManifestFile{
+			{Source: filepath.Join(dir, "etc/motd"), Dest: "etc/motd"},
+			{Source: filepath.Join(dir, "platform/hosts"), Dest: "/etc/hosts", Mode: "0600", UID: &uid},
+		},
+		Devices:      []ManifestDevice{{Name: "bin/vi", Type: "char", Major: 1, Minor: 3}},
+		BaseArchives: []string{filepath.Join(dir, "base.cpio")},
+		ReplaceBase:  &replaceBase,
+		InitCmd:      strPtr("init"),
+		UinitCmd:     strPtr("systemboot"),
+		UinitArgs:    []string{},
+	}
+	if !reflect.DeepEqual(m, want) {
+		var got, w bytes.Buffer
+		m.WriteTo(&got)
+		want.WriteTo(&w)
+		t.Errorf("LoadManifest() =\n%s\nwant\n%s", got.String(), w.String())
+	}
+
+	// The effective manifest reads back the same, except that an empty
+	// list, which has nothing left to clear, is omitted.
+	m.UinitArgs = nil
+	var b bytes.Buffer
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	m2, err := ParseManifest(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m2, m) {
+		t.Errorf("ParseManifest(WriteTo()) = %+v, want %+v", m2, m)
+	}
+}
+
+func TestLoadManifestErrors(t *testing.T) {
+	dir := writeManifests(t, map[string]string{
+		"a.json":       `{"include": ["b.json"]}`,
+		"b.json":       `{"include": ["a.json"]}`,
+		"typo.json":    `{"uinit": "systemboot"}`,
+		"builder.json": `{"commands": [{"builder": "bbb", "packages": ["ls"]}]}`,
+		"mode.json":    `{"files": [{"source": "a", "mode": "0999"}]}`,
+		"device.json":  `{"devices": [{"name": "dev/null", "type": "pipe"}]}`,
+		"symlink.json": `{"symlinks": [{"name": "bin/sh"}]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	for name, want := range map[string]string{
+		"a.json":       "includes itself",
+		"typo.json":    `unknown field "uinit"`,
+		"builder.json": `unknown builder "bbb"`,
+		"mode.json":    "is not octal permission bits",
+		"device.json":  "is not char or block",
+		"symlink.json": "needs a name and a target",
+		"none.json":    "no such file",
+	} {
+		if _, err := LoadManifest(filepath.Join(dir, name)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadManifest(%s) = %v, want error containing %q", name, err, want)
+		}
+	}
+}
+
+func TestManifestApplyTo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uroot-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	motd := filepath.Join(dir, "motd")
+	if err := ioutil.WriteFile(motd, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	uid, gid := uint64(1000), uint64(100)
+	m := &Manifest{
+		Commands: []ManifestCommands{
+			{Builder: "bb"},
+			{Builder: "source", Packages: []string{"github.com/u-root/u-root/cmds/core/ls"}},
+		},
+		Files: []ManifestFile{
+			{Source: motd, Dest: "etc/motd"},
+			{Source: motd, Dest: "/etc/issue", Mode: "0600", UID: &uid, GID: &gid},
+		},
+		Symlinks:     []ManifestSymlink{{Name: "/bin/vi", Target: "/bbin/elvish"}},
+		Devices:      []ManifestDevice{{Name: "dev/sda", Type: "block", Major: 8}},
+		UinitCmd:     strPtr("systemboot"),
+		UinitArgs:    []string{"-v"},
+		DefaultShell: strPtr(""),
+	}
+	opts := Opts{
+		Env:          golang.Default(),
+		TempDir:      dir,
+		DefaultShell: "elvish",
+	}
+	if err := m.ApplyTo(&opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []Commands{{Builder: builder.Source, Packages: []string{"github.com/u-root/u-root/cmds/core/ls"}}}; !reflect.DeepEqual(opts.Commands, want) {
+		t.Errorf("Commands = %v, want %v", opts.Commands, want)
+	}
+	if want := []string{motd + ":etc/motd"}; !reflect.DeepEqual(opts.ExtraFiles, want) {
+		t.Errorf("ExtraFiles = %v, want %v", opts.ExtraFiles, want)
+	}
+	if opts.UinitCmd != "systemboot" || !reflect.DeepEqual(opts.UinitArgs, []string{"-v"}) || opts.DefaultShell != "" {
+		t.Errorf("uinit %q %q, defaultsh %q; want systemboot [-v] and no shell", opts.UinitCmd, opts.UinitArgs, opts.DefaultShell)
+	}
+
+	// Build the archive without commands, to check the records.
+	opts.Commands = nil
+	opts.SkipLDD = true
+	archive := inMemArchive{cpio.InMemArchive()}
+	opts.OutputFile = archive
+	if err := CreateInitramfs(log.New(ioutil.Discard, "", 0), opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []itest.ArchiveValidator{
+		itest.HasContent{Path: "etc/motd", Content: "hello"},
+		itest.HasContent{Path: "etc/issue", Content: "hello"},
+		itest.HasRecord{R: cpio.Symlink("bin/vi", "/bbin/elvish")},
+		itest.HasRecord{R: cpio.Record{Info: cpio.Info{Name: "dev/sda", Mode: cpio.S_IFBLK | 0600, Rmajor: 8}}},
+		itest.HasContent{Path: "etc/uinit.flags", Content: "\"-v\""},
+	} {
+		if err := v.Validate(archive.Archive); err != nil {
+			t.Errorf("validator failed: %v / archive:\n%s", err, archive)
+		}
+	}
+	issue, _ := archive.Get("etc/issue")
+	if issue.Mode != cpio.S_IFREG|0600 || issue.UID != uid || issue.GID != gid {
+		t.Errorf("etc/issue has mode %o and owner %d:%d, want %o and %d:%d", issue.Mode, issue.UID, issue.GID, cpio.S_IFREG|0600, uid, gid)
+	}
+}
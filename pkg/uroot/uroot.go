@@ -168,6 +168,11 @@ type Opts struct {
 	// will misbehave.
 	SkipLDD bool
 
+	// ExtraRecords are records to add to the archive in addition to
+	// ExtraFiles, such as symlinks, device nodes, and files whose mode and
+	// owner are not those on the host.
+	ExtraRecords []cpio.Record
+
 	// OutputFile is the archive output file.
 	OutputFile initramfs.Writer
 
@@ -265,6 +270,11 @@ func CreateInitramfs(logger ulog.Logger, opts Opts) error {
 	if err := ParseExtraFiles(logger, archive.Files, opts.ExtraFiles, !opts.SkipLDD); err != nil {
 		return err
 	}
+	for _, r := range opts.ExtraRecords {
+		if err := archive.AddRecord(r); err != nil {
+			return fmt.Errorf("couldn't add %q to archive: %v", r.Name, err)
+		}
+	}
 
 	if err := opts.addSymlinkTo(logger, archive, opts.UinitCmd, "bin/uinit"); err != nil {
 		return fmt.Errorf("%v: specify -uinitcmd=\"\" to ignore this error and build without a uinit", err)
@@ -484,7 +494,7 @@ func (o *Opts) AddCommands(c ...Commands) {
 
 func (o *Opts) AddBusyBoxCommands(pkgs ...string) {
 	for i, cmds := range o.Commands {
-		if cmds.Builder == builder.BusyBox {
+		if _, ok := cmds.Builder.(builder.BBBuilder); ok {
 			o.Commands[i].Packages = append(cmds.Packages, pkgs...)
 			return
 		}
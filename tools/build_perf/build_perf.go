@@ -9,19 +9,28 @@
 // - build_perf_user.csv
 // - build_perf_sys.csv
 // - build_perf_max_rss.csv
+//
+// With -bbcache, measure instead how a busybox of the given packages, or of
+// cmds/core, builds with the bb build cache. Each build is a row of
+// build_perf_bbcache.csv with its time and cache hit rates.
 package main
 
 import (
 	"encoding/csv"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
+
+	"github.com/u-root/u-root/pkg/bb"
+	"github.com/u-root/u-root/pkg/golang"
 )
 
 const (
@@ -71,6 +80,11 @@ var descs = []csvDesc{
 
 var wg sync.WaitGroup
 
+var (
+	bbCache = flag.String("bbcache", "", "Measure busybox builds with this bb build cache directory instead of GOGC values")
+	bbRuns  = flag.Int("bbruns", 2, "Number of busybox builds to measure with -bbcache")
+)
+
 // Return a list of command names.
 func getCmdNames() ([]string, error) {
 	files, err := ioutil.ReadDir(os.ExpandEnv(cmdsPath))
@@ -164,7 +178,91 @@ func writeCsv(cmds []string, gogcs []int, d csvDesc) {
 	wg.Done()
 }
 
+// Return the import paths of the commands in cmds/core.
+func getCorePkgs() ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(os.ExpandEnv(cmdsPath), "core"))
+	if err != nil {
+		return nil, err
+	}
+	pkgs := []string{}
+	for _, file := range files {
+		if file.IsDir() {
+			pkgs = append(pkgs, path.Join("github.com/u-root/u-root/cmds/core", file.Name()))
+		}
+	}
+	return pkgs, nil
+}
+
+// measureBBCache builds a busybox of pkgs runs times with the cache in dir and
+// writes the time and hit rates of each build to build_perf_bbcache.csv.
+func measureBBCache(dir string, pkgs []string, runs int) error {
+	c, err := bb.NewCache(dir)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir("", "build_perf")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	f, err := os.Create("build_perf_bbcache.csv")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"build", "real", "package hits", "package misses", "package hit rate", "binary hits", "binary misses"})
+
+	for i := 1; i <= runs; i++ {
+		before := c.Stats
+		start := time.Now()
+		if err := c.BuildBusybox(golang.Default(), pkgs, filepath.Join(tmp, "bb")); err != nil {
+			return err
+		}
+		secs := time.Since(start).Seconds()
+		s := bb.CacheStats{
+			PackageHits:   c.Stats.PackageHits - before.PackageHits,
+			PackageMisses: c.Stats.PackageMisses - before.PackageMisses,
+			BinaryHits:    c.Stats.BinaryHits - before.BinaryHits,
+			BinaryMisses:  c.Stats.BinaryMisses - before.BinaryMisses,
+		}
+		fmt.Printf("build %d: %.1fs, %v\n", i, secs, s)
+		w.Write([]string{
+			fmt.Sprint(i),
+			fmt.Sprint(secs),
+			fmt.Sprint(s.PackageHits),
+			fmt.Sprint(s.PackageMisses),
+			fmt.Sprint(s.PackageHitRate()),
+			fmt.Sprint(s.BinaryHits),
+			fmt.Sprint(s.BinaryMisses),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	fmt.Printf("total: %v\n", c.Stats)
+	return nil
+}
+
 func main() {
+	flag.Parse()
+
+	if *bbCache != "" {
+		pkgs := flag.Args()
+		if len(pkgs) == 0 {
+			var err error
+			if pkgs, err = getCorePkgs(); err != nil {
+				log.Fatal("Cannot get list of commands:", err)
+			}
+		}
+		if err := measureBBCache(*bbCache, pkgs, *bbRuns); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Get list of commands.
 	cmds, err := getCmdNames()
 	if err != nil {
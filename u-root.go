@@ -10,9 +10,11 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 
+	"github.com/u-root/u-root/pkg/bb"
 	"github.com/u-root/u-root/pkg/golang"
 	"github.com/u-root/u-root/pkg/shlex"
 	"github.com/u-root/u-root/pkg/uroot"
@@ -35,12 +37,17 @@ func (m *multiFlag) Set(value string) error {
 // Flags for u-root builder.
 var (
 	build, format, tmpDir, base, outputPath *string
+	level                                   *int
 	uinitCmd, initCmd                       *string
 	defaultShell                            *string
 	useExistingInit                         *bool
+	replaceBase                             *bool
 	fourbins                                *bool
 	noCommands                              *bool
 	extraFiles                              multiFlag
+	manifestPath                            *string
+	dumpManifest                            *bool
+	bbCache                                 *string
 )
 
 func init() {
@@ -54,12 +61,14 @@ func init() {
 
 	fourbins = flag.Bool("fourbins", false, "build installcommand on boot, no ahead of time, so we have only four binares")
 	build = flag.String("build", "bb", "u-root build format (e.g. bb or source).")
-	format = flag.String("format", "cpio", "Archival format.")
+	format = flag.String("format", "cpio", "Archival format (cpio, dir, gzip or zstd).")
+	level = flag.Int("level", 0, "Compression level of the gzip and zstd formats. 0 is the format's default.")
 
 	tmpDir = flag.String("tmpdir", "", "Temporary directory to put binaries in.")
 
-	base = flag.String("base", "", "Base archive to add files to. By default, this is a couple of directories like /bin, /etc, etc. u-root has a default internally supplied set of files; use base=/dev/null if you don't want any base files.")
+	base = flag.String("base", "", "Base archive to add files to. It may be compressed or several concatenated archives, as the kernel accepts. By default, this is a couple of directories like /bin, /etc, etc. u-root has a default internally supplied set of files; use base=/dev/null if you don't want any base files.")
 	useExistingInit = flag.Bool("useinit", false, "Use existing init from base archive (only if --base was specified).")
+	replaceBase = flag.Bool("replacebase", false, "Replace files in the base archive with files of the same name in later archives concatenated to it, as the kernel does.")
 	outputPath = flag.String("o", "", "Path to output initramfs file.")
 
 	initCmd = flag.String("initcmd", "init", "Symlink target for /init. Can be an absolute path or a u-root command name. Use initcmd=\"\" if you don't want the symlink.")
@@ -69,11 +78,27 @@ func init() {
 	noCommands = flag.Bool("nocmd", false, "Build no Go commands; initramfs only")
 
 	flag.Var(&extraFiles, "files", "Additional files, directories, and binaries (with their ldd dependencies) to add to archive. Can be speficified multiple times.")
+
+	manifestPath = flag.String("manifest", "", "JSON manifest describing the initramfs. Flags that are set override it.")
+	dumpManifest = flag.Bool("dumpmanifest", false, "Print the effective manifest of the manifest and flags instead of building.")
+
+	bbCache = flag.String("bbcache", "", "Directory of the bb build cache of rewritten commands and busybox binaries, e.g. ~/.cache/u-root/bb. By default, no cache is used.")
 }
 
 func main() {
 	flag.Parse()
 
+	if *dumpManifest {
+		m, err := manifest()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := m.WriteTo(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Main is in a separate functions so defers run on return.
 	if err := Main(); err != nil {
 		log.Fatal(err)
@@ -95,6 +120,111 @@ func isRecommendedVersion(v string) bool {
 	return false
 }
 
+// manifest returns the effective manifest: u-root's defaults, then the
+// -manifest file, then the flags that were set.
+func manifest() (*uroot.Manifest, error) {
+	if _, ok := uroot.Builders[*build]; !ok {
+		return nil, fmt.Errorf("could not find builder %q", *build)
+	}
+	initDefault := flag.Lookup("initcmd").DefValue
+	shDefault := flag.Lookup("defaultsh").DefValue
+	m := &uroot.Manifest{
+		InitCmd:      &initDefault,
+		DefaultShell: &shDefault,
+	}
+	if *manifestPath != "" {
+		fm, err := uroot.LoadManifest(*manifestPath)
+		if err != nil {
+			return nil, err
+		}
+		m.Override(fm)
+	}
+
+	var (
+		fl  uroot.Manifest
+		err error
+	)
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "initcmd":
+			fl.InitCmd = initCmd
+		case "defaultsh":
+			fl.DefaultShell = defaultShell
+		case "uinitcmd":
+			uinitArgs := shlex.Argv(*uinitCmd)
+			cmd := ""
+			if len(uinitArgs) > 0 {
+				cmd = uinitArgs[0]
+			}
+			fl.UinitCmd = &cmd
+			fl.UinitArgs = []string{}
+			if len(uinitArgs) > 1 {
+				fl.UinitArgs = uinitArgs[1:]
+			}
+		case "useinit":
+			fl.UseExistingInit = useExistingInit
+		case "replacebase":
+			fl.ReplaceBase = replaceBase
+		case "base":
+			b, aerr := filepath.Abs(*base)
+			if aerr != nil {
+				err = aerr
+			}
+			fl.BaseArchives = []string{b}
+		case "files":
+			for _, f := range extraFiles {
+				// filepath.Clean interprets an empty string as CWD for no good reason.
+				if len(f) == 0 {
+					continue
+				}
+				mf, perr := uroot.ParseManifestFile(f)
+				if perr != nil {
+					err = perr
+				}
+				fl.Files = append(fl.Files, mf)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve globs into package imports.
+	//
+	// Currently allowed formats:
+	//   Go package imports; e.g. github.com/u-root/u-root/cmds/ls (must be in $GOPATH)
+	//   Paths to Go package directories; e.g. $GOPATH/src/github.com/u-root/u-root/cmds/*
+	var pkgs []string
+	for _, a := range flag.Args() {
+		p, ok := templates[a]
+		if !ok {
+			pkgs = append(pkgs, a)
+			continue
+		}
+		pkgs = append(pkgs, p...)
+	}
+	if len(pkgs) > 0 {
+		fl.Commands = []uroot.ManifestCommands{{Builder: *build, Packages: pkgs}}
+	}
+	if *fourbins && *build == "source" {
+		goCmd := "/go/bin/go"
+		fl.InitCmd = &goCmd
+	}
+	m.Override(&fl)
+
+	// The command-line tool only allows specifying one build mode
+	// right now.
+	if *noCommands {
+		m.Commands = nil
+	} else if len(m.Commands) == 0 {
+		m.Commands = []uroot.ManifestCommands{{
+			Builder:  *build,
+			Packages: []string{"github.com/u-root/u-root/cmds/core/*"},
+		}}
+	}
+	return m, nil
+}
+
 // Main is a separate function so defers are run on return, which they wouldn't
 // on exit.
 func Main() error {
@@ -124,10 +254,23 @@ func Main() error {
 			v, recommendedVersions, recommendedVersions[0])
 	}
 
+	m, err := manifest()
+	if err != nil {
+		return err
+	}
+
 	archiver, err := initramfs.GetArchiver(*format)
 	if err != nil {
 		return err
 	}
+	if *level != 0 {
+		ca, ok := archiver.(initramfs.CompressedArchiver)
+		if !ok {
+			return fmt.Errorf("archival format %q has no compression level", *format)
+		}
+		ca.Level = *level
+		archiver = ca
+	}
 
 	logger := log.New(os.Stderr, "", log.LstdFlags)
 	// Open the target initramfs file.
@@ -136,18 +279,6 @@ func Main() error {
 		return err
 	}
 
-	var baseFile initramfs.Reader
-	if *base != "" {
-		bf, err := os.Open(*base)
-		if err != nil {
-			return err
-		}
-		defer bf.Close()
-		baseFile = archiver.Reader(bf)
-	} else {
-		baseFile = uroot.DefaultRamfs().Reader()
-	}
-
 	tempDir := *tmpDir
 	if tempDir == "" {
 		var err error
@@ -162,72 +293,40 @@ func Main() error {
 		}
 	}
 
-	var (
-		c           []uroot.Commands
-		initCommand = *initCmd
-	)
-	if !*noCommands {
-		var b builder.Builder
-		switch *build {
-		case "bb":
-			b = builder.BBBuilder{}
-		case "binary":
-			b = builder.BinaryBuilder{}
-		case "source":
-			b = builder.SourceBuilder{
+	opts := uroot.Opts{
+		Env:        env,
+		TempDir:    tempDir,
+		OutputFile: w,
+	}
+	if err := m.ApplyTo(&opts); err != nil {
+		return err
+	}
+	if opts.BaseArchive == nil {
+		opts.BaseArchive = uroot.DefaultRamfs().Reader()
+	}
+	var cache *bb.Cache
+	if *bbCache != "" {
+		if cache, err = bb.NewCache(*bbCache); err != nil {
+			return err
+		}
+	}
+	for i, c := range opts.Commands {
+		switch c.Builder.(type) {
+		case builder.SourceBuilder:
+			opts.Commands[i].Builder = builder.SourceBuilder{
 				FourBins: *fourbins,
 			}
-		default:
-			return fmt.Errorf("could not find builder %q", *build)
-		}
-
-		// Resolve globs into package imports.
-		//
-		// Currently allowed formats:
-		//   Go package imports; e.g. github.com/u-root/u-root/cmds/ls (must be in $GOPATH)
-		//   Paths to Go package directories; e.g. $GOPATH/src/github.com/u-root/u-root/cmds/*
-		var pkgs []string
-		for _, a := range flag.Args() {
-			p, ok := templates[a]
-			if !ok {
-				pkgs = append(pkgs, a)
-				continue
+		case builder.BBBuilder:
+			opts.Commands[i].Builder = builder.BBBuilder{
+				Cache: cache,
 			}
-			pkgs = append(pkgs, p...)
-		}
-		if len(pkgs) == 0 {
-			pkgs = []string{"github.com/u-root/u-root/cmds/core/*"}
-		}
-
-		if *fourbins && *build == "source" {
-			initCommand = "/go/bin/go"
 		}
-
-		// The command-line tool only allows specifying one build mode
-		// right now.
-		c = append(c, uroot.Commands{
-			Builder:  b,
-			Packages: pkgs,
-		})
 	}
-
-	opts := uroot.Opts{
-		Env:             env,
-		Commands:        c,
-		TempDir:         tempDir,
-		ExtraFiles:      extraFiles,
-		OutputFile:      w,
-		BaseArchive:     baseFile,
-		UseExistingInit: *useExistingInit,
-		InitCmd:         initCommand,
-		DefaultShell:    *defaultShell,
-	}
-	uinitArgs := shlex.Argv(*uinitCmd)
-	if len(uinitArgs) > 0 {
-		opts.UinitCmd = uinitArgs[0]
-	}
-	if len(uinitArgs) > 1 {
-		opts.UinitArgs = uinitArgs[1:]
-	}
-	return uroot.CreateInitramfs(logger, opts)
+	if err := uroot.CreateInitramfs(logger, opts); err != nil {
+		return err
+	}
+	if cache != nil {
+		logger.Printf("bb build cache: %v", cache.Stats)
+	}
+	return nil
 }